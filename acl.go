@@ -0,0 +1,77 @@
+package main
+
+import "fmt"
+
+/*
+インターフェイスで受信したIPパケットのフィルタ
+ルールを上から順に評価して最初に一致したルールに従う
+どのルールにも一致しなかったパケットは破棄する
+*/
+
+type aclAction uint8
+
+const (
+	aclPermit aclAction = iota
+	aclDeny
+)
+
+type aclRule struct {
+	action       aclAction
+	srcPrefix    uint32
+	srcPrefixLen uint32
+	dstPrefix    uint32
+	dstPrefixLen uint32
+	protocol     uint8 // 0なら全てのプロトコル
+}
+
+// インターフェイス名ごとの受信時のACL
+var ingressACL = map[string][]aclRule{}
+
+// プレフィックスに含まれるアドレスか
+func prefixContains(prefix, prefixLen, addr uint32) bool {
+	if prefixLen == 0 {
+		return true
+	}
+	mask := ^uint32(0) << (32 - prefixLen)
+	return addr&mask == prefix&mask
+}
+
+func (rule aclRule) match(ipheader *ipHeader) bool {
+	if rule.protocol != 0 && rule.protocol != ipheader.protocol {
+		return false
+	}
+	return prefixContains(rule.srcPrefix, rule.srcPrefixLen, ipheader.srcAddr) &&
+		prefixContains(rule.dstPrefix, rule.dstPrefixLen, ipheader.destAddr)
+}
+
+/*
+受信したパケットを通してよいか判定する
+ACLが設定されていないインターフェイスでは全て通す
+*/
+func aclPermitted(inputdev *netDevice, ipheader *ipHeader) bool {
+	rules, ok := ingressACL[inputdev.name]
+	if !ok || !isDefaultInstanceDevice(inputdev) {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.match(ipheader) {
+			return rule.action == aclPermit
+		}
+	}
+	return false
+}
+
+// ACLのプロトコル名をプロトコル番号にする
+func parseACLProtocol(protocol string) (uint8, error) {
+	switch protocol {
+	case "", "any", "ip":
+		return 0, nil
+	case "icmp":
+		return IP_PROTOCOL_NUM_ICMP, nil
+	case "tcp":
+		return IP_PROTOCOL_NUM_TCP, nil
+	case "udp":
+		return IP_PROTOCOL_NUM_UDP, nil
+	}
+	return 0, fmt.Errorf("unknown acl protocol %s", protocol)
+}
@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+HTTPの管理API
+  GET    /routes      ルートテーブルの一覧
+  POST   /routes      経路の追加 {"prefix": "192.168.2.0/24", "nexthop": "192.168.0.2", "distance": 200, "metric": 10}
+                      {"prefix": "198.51.100.0/24", "type": "blackhole"}で捨てる経路、"reject"でICMPを返して捨てる経路
+  DELETE /routes      経路の削除 /routes?prefix=192.168.2.0/24、&nexthop=192.168.0.2でネクストホップを指定する
+  GET    /rib         FIBに入っていない経路も含めた経路の候補の一覧
+  GET    /arp         ARPテーブルの一覧
+  GET    /interfaces  インターフェイスと統計情報の一覧
+  POST   /interfaces/down インターフェイスを管理上止める {"name": "router1-host2"}
+  POST   /interfaces/up   止めたインターフェイスを戻す {"name": "router1-host2"}
+  GET    /stats       ルータ全体の統計情報
+  GET    /drops       破棄したパケットの理由ごとの数
+  GET    /multicast   マルチキャストグループのメンバーシップとIGMPプロキシが上流で参加しているグループの一覧
+  GET    /lldp/neighbors LLDPで見つけた隣接機器の一覧
+  GET    /bridges     ブリッジとSTPのポートの役割、ポートセキュリティ、MACアドレステーブルの一覧
+  GET    /ntp         NTPの同期の状態とルータの時刻
+  GET    /vrrp        VRRPの仮想ルータとマスターかバックアップかの一覧
+  GET    /pppoe       PPPoEのセッションの状態と受け取ったアドレス
+  GET    /ipsec       IPsecのトンネルと送受信、破棄した数
+  GET    /dhcpv6-pd   DHCPv6で委譲されたプレフィックスとLAN側に割り当てたサブプレフィックス
+  GET    /events      パケットのイベントをServer-Sent Eventsで流し続ける /events?sample=10で10個に1個のパケットに間引く
+  GET    /nat         NATの設定とポートフォワード、変換中のセッションの一覧
+  GET    /logs        最近のログ /logs?lines=100で行数を指定する
+  GET    /top-talkers 通信量の多いフローをレートの高い順に並べる /top-talkers?limit=20で数を指定する、0なら全て
+  GET    /debug/packet パケットのトレースの条件
+  POST   /debug/packet 条件に一致したパケットの処理をログに出す {"dst": "192.168.0.2/32", "protocol": "icmp", "interface": "router1-host1", "ttl": 2}
+  DELETE /debug/packet トレースをやめる
+  GET    /tables      ARPテーブルとルートテーブルをまとめて書き出す、-load-tablesでそのまま読み込める
+  POST   /tables      書き出したARPテーブルとルートテーブルを読み込む、経路は静的経路として入れる
+  GET    /instances   同じプロセスで動かしているルータのインスタンスと、それぞれのルートテーブルとARPテーブル
+  GET    /            ブラウザで状態を見るダッシュボード
+tokenを指定した場合はAuthorization: Bearer <token>ヘッダが必要になる
+ブラウザのEventSourceはヘッダをつけられないので、/eventsだけは?token=<token>でも認証できる
+ダッシュボードのページ自体はルータの状態を含まないので認証しない、ページからAPIを呼ぶ時にtokenを使う
+*/
+
+type routeJSON struct {
+	Prefix   string `json:"prefix"`
+	Type     string `json:"type,omitempty"`
+	Nexthop  string `json:"nexthop,omitempty"`
+	Device   string `json:"device,omitempty"`
+	Source   string `json:"source,omitempty"`
+	Distance uint8  `json:"distance"`
+	Metric   uint32 `json:"metric"`
+}
+
+type ribRouteJSON struct {
+	routeJSON
+	Selected bool `json:"selected"`
+}
+
+type arpJSON struct {
+	IPAddress  string `json:"ip_address"`
+	MacAddress string `json:"mac_address"`
+	Device     string `json:"device"`
+	Static     bool   `json:"static"`
+}
+
+type countersJSON struct {
+	RxPackets          uint64 `json:"rx_packets"`
+	RxBytes            uint64 `json:"rx_bytes"`
+	TxPackets          uint64 `json:"tx_packets"`
+	TxBytes            uint64 `json:"tx_bytes"`
+	IPChecksumErrors   uint64 `json:"ip_checksum_errors"`
+	ICMPChecksumErrors uint64 `json:"icmp_checksum_errors"`
+	RxPoliced          uint64 `json:"rx_policed"`
+	TxQueueDrops       uint64 `json:"tx_queue_drops"`
+	TxErrors           uint64 `json:"tx_errors"`
+	UrpfDrops          uint64 `json:"urpf_drops"`
+	DscpRemarked       uint64 `json:"dscp_remarked"`
+	ImpairLost         uint64 `json:"impair_lost"`
+}
+
+type impairmentJSON struct {
+	DelayMs  int64   `json:"delay_ms"`
+	JitterMs int64   `json:"jitter_ms"`
+	Loss     float64 `json:"loss"`
+	Reorder  float64 `json:"reorder"`
+	Queued   int     `json:"queued"`
+}
+
+type qosRateJSON struct {
+	Kbps  uint64 `json:"kbps"`
+	Burst uint64 `json:"burst"`
+}
+
+type interfaceJSON struct {
+	Name       string       `json:"name"`
+	MacAddress string       `json:"mac_address"`
+	Address    string       `json:"address,omitempty"`
+	Counters   countersJSON `json:"counters"`
+	Shaping    *qosRateJSON `json:"shaping,omitempty"`
+	Policing   *qosRateJSON `json:"policing,omitempty"`
+	Scheduler  string       `json:"qos_scheduler,omitempty"`
+	TxQueue    int          `json:"tx_queue"`
+	Queues     []queueJSON  `json:"queues,omitempty"`
+	// セカンダリのアドレス
+	SecondaryAddresses []string `json:"secondary_addresses,omitempty"`
+	// プロミスキャスモードか、追加で受け取るMACアドレス
+	Promisc   bool     `json:"promisc"`
+	MacFilter []string `json:"mac_filter,omitempty"`
+	// 管理上の状態とリンクも含めた動作状態、upかdown
+	AdminState string `json:"admin_state"`
+	OperState  string `json:"oper_state"`
+	// 送信元アドレスを検証するuRPFのモード
+	Urpf string `json:"urpf"`
+	// チェックサムの検証のポリシーと、ethtoolで調べたチェックサムオフロード
+	ChecksumPolicy    string `json:"checksum_policy"`
+	RxChecksumOffload bool   `json:"rx_checksum_offload"`
+	TxChecksumOffload bool   `json:"tx_checksum_offload"`
+	// 送信の遅延と損失のエミュレーション、無効なら省略する
+	Impairment *impairmentJSON `json:"impairment,omitempty"`
+}
+
+type interfaceStateJSON struct {
+	Name string `json:"name"`
+}
+
+type queueJSON struct {
+	Class   string `json:"class"`
+	Len     int    `json:"len"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type statsJSON struct {
+	Interfaces    int          `json:"interfaces"`
+	Routes        int          `json:"routes"`
+	ArpEntries    int          `json:"arp_entries"`
+	ArpMacChanges uint64       `json:"arp_mac_changes"`
+	RouterID      string       `json:"router_id"`
+	Counters      countersJSON `json:"counters"`
+}
+
+type dropCounterJSON struct {
+	Reason string `json:"reason"`
+	Count  uint64 `json:"count"`
+}
+
+type multicastJSON struct {
+	Group  string `json:"group"`
+	Device string `json:"device"`
+	Local  bool   `json:"local"`
+	Proxy  bool   `json:"proxy,omitempty"`
+}
+
+type lldpNeighborJSON struct {
+	Device          string `json:"device"`
+	ChassisID       string `json:"chassis_id"`
+	PortID          string `json:"port_id"`
+	PortDescription string `json:"port_description,omitempty"`
+	SystemName      string `json:"system_name,omitempty"`
+	TTL             int    `json:"ttl"`
+}
+
+type fdbJSON struct {
+	MacAddress string `json:"mac_address"`
+	Port       string `json:"port"`
+	Age        int    `json:"age"`
+	Sticky     bool   `json:"sticky,omitempty"`
+}
+
+type portSecurityJSON struct {
+	MaxMacs    int    `json:"max_macs"`
+	Sticky     bool   `json:"sticky"`
+	Violation  string `json:"violation"`
+	Violations uint64 `json:"violations"`
+	Learned    int    `json:"learned"`
+}
+
+type bridgePortJSON struct {
+	Name  string `json:"name"`
+	Role  string `json:"role,omitempty"`
+	State string `json:"state"`
+	// ポートセキュリティが無効なら省略する
+	PortSecurity *portSecurityJSON `json:"port_security,omitempty"`
+}
+
+type bridgeJSON struct {
+	Name     string           `json:"name"`
+	STP      bool             `json:"stp"`
+	BridgeID string           `json:"bridge_id,omitempty"`
+	RootID   string           `json:"root_id,omitempty"`
+	RootPort string           `json:"root_port,omitempty"`
+	Ports    []bridgePortJSON `json:"ports"`
+	FDB      []fdbJSON        `json:"fdb"`
+	// 学習したMACアドレスを保持する秒数
+	AgingTime int `json:"aging_time"`
+}
+
+type ntpJSON struct {
+	Enabled      bool    `json:"enabled"`
+	Serving      bool    `json:"serving"`
+	Synchronized bool    `json:"synchronized"`
+	Server       string  `json:"server,omitempty"`
+	Stratum      uint8   `json:"stratum,omitempty"`
+	OffsetMs     float64 `json:"offset_ms"`
+	DelayMs      float64 `json:"delay_ms"`
+	LastSync     string  `json:"last_sync,omitempty"`
+	Time         string  `json:"time"`
+}
+
+type vrrpRouterJSON struct {
+	Device         string `json:"device"`
+	VRID           uint8  `json:"vrid"`
+	Address        string `json:"address"`
+	Priority       uint8  `json:"priority"`
+	State          string `json:"state"`
+	Master         string `json:"master,omitempty"`
+	AdvertInterval int    `json:"advert_interval"`
+}
+
+type pppoeJSON struct {
+	Enabled   bool   `json:"enabled"`
+	Device    string `json:"device,omitempty"`
+	State     string `json:"state,omitempty"`
+	ACName    string `json:"ac_name,omitempty"`
+	ACMacAddr string `json:"ac_mac_address,omitempty"`
+	SessionID uint16 `json:"session_id,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Peer      string `json:"peer,omitempty"`
+	MRU       uint16 `json:"mru,omitempty"`
+	UpSince   string `json:"up_since,omitempty"`
+}
+
+type dhcpv6PdJSON struct {
+	Enabled  bool                 `json:"enabled"`
+	Device   string               `json:"device,omitempty"`
+	State    string               `json:"state,omitempty"`
+	Server   string               `json:"server,omitempty"`
+	Prefix   string               `json:"prefix,omitempty"`
+	Assigned []dhcpv6AssignedJSON `json:"assigned,omitempty"`
+	Expires  string               `json:"expires,omitempty"`
+}
+
+type dhcpv6AssignedJSON struct {
+	Device string `json:"device"`
+	Prefix string `json:"prefix"`
+}
+
+type ipsecTunnelJSON struct {
+	Peer         string   `json:"peer"`
+	SPIOut       string   `json:"spi_out"`
+	SPIIn        string   `json:"spi_in"`
+	Routes       []string `json:"routes"`
+	TxPackets    uint64   `json:"tx_packets"`
+	RxPackets    uint64   `json:"rx_packets"`
+	AuthFailures uint64   `json:"auth_failures"`
+	Replayed     uint64   `json:"replayed"`
+}
+
+type packetEventJSON struct {
+	Time         string `json:"time"`
+	Packet       uint64 `json:"packet"`
+	Device       string `json:"device"`
+	Action       string `json:"action"`
+	SrcAddress   string `json:"src_address"`
+	DestAddress  string `json:"dest_address"`
+	Protocol     uint8  `json:"protocol"`
+	Length       int    `json:"length"`
+	OutputDevice string `json:"output_device,omitempty"`
+	Route        string `json:"route,omitempty"`
+	Nexthop      string `json:"nexthop,omitempty"`
+	DropReason   string `json:"drop_reason,omitempty"`
+}
+
+type natSessionJSON struct {
+	Protocol      string `json:"protocol"`
+	LocalAddress  string `json:"local_address"`
+	LocalPort     uint16 `json:"local_port"`
+	GlobalAddress string `json:"global_address"`
+	GlobalPort    uint16 `json:"global_port"`
+	Idle          int    `json:"idle"`
+}
+
+type topTalkerJSON struct {
+	Protocol    string `json:"protocol"`
+	Source      string `json:"src"`
+	SourcePort  uint16 `json:"src_port,omitempty"`
+	Destination string `json:"dst"`
+	DestPort    uint16 `json:"dst_port,omitempty"`
+	Packets     uint64 `json:"packets"`
+	Bytes       uint64 `json:"bytes"`
+	Bps         uint64 `json:"bps"`
+	Idle        int    `json:"idle"`
+}
+
+type natJSON struct {
+	Enabled  bool             `json:"enabled"`
+	Outside  string           `json:"outside,omitempty"`
+	Inside   []string         `json:"inside,omitempty"`
+	Sessions []natSessionJSON `json:"sessions"`
+	// ポートフォワード
+	PortForwards []natPortForwardJSON `json:"port_forwards,omitempty"`
+}
+
+type natPortForwardJSON struct {
+	Protocol     string `json:"protocol"`
+	Port         uint16 `json:"port"`
+	LocalAddress string `json:"local_address"`
+	LocalPort    uint16 `json:"local_port"`
+}
+
+type logLineJSON struct {
+	Time string `json:"time"`
+	Line string `json:"line"`
+}
+
+type debugPacketJSON struct {
+	Enabled   bool   `json:"enabled"`
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	TTL       uint8  `json:"ttl,omitempty"`
+}
+
+type routerInstanceJSON struct {
+	Name       string      `json:"name"`
+	Netns      string      `json:"netns,omitempty"`
+	Interfaces []string    `json:"interfaces"`
+	Routes     []routeJSON `json:"routes"`
+	Arp        []arpJSON   `json:"arp"`
+}
+
+type tablesImportJSON struct {
+	ArpEntries int `json:"arp_entries"`
+	Routes     int `json:"routes"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+func newCountersJSON(stats netDeviceStats) countersJSON {
+	return countersJSON{
+		RxPackets:          stats.rxPackets,
+		RxBytes:            stats.rxBytes,
+		TxPackets:          stats.txPackets,
+		TxBytes:            stats.txBytes,
+		IPChecksumErrors:   stats.ipChecksumErrors,
+		ICMPChecksumErrors: stats.icmpChecksumErrors,
+		RxPoliced:          stats.rxPoliced,
+		TxQueueDrops:       stats.txQueueDrops,
+		TxErrors:           stats.txErrors,
+		UrpfDrops:          stats.urpfDrops,
+		DscpRemarked:       stats.dscpRemarked,
+		ImpairLost:         stats.impairLost,
+	}
+}
+
+func newQosRateJSON(rate *qosRate) *qosRateJSON {
+	if rate == nil {
+		return nil
+	}
+	return &qosRateJSON{Kbps: rate.kbps, Burst: rate.burst}
+}
+
+/*
+HTTPの管理APIを起動する
+*/
+func startAdminAPIServer(addr, token string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", adminRoutesHandler)
+	mux.HandleFunc("/rib", adminGetOnly(adminRibHandler))
+	mux.HandleFunc("/arp", adminGetOnly(adminArpHandler))
+	mux.HandleFunc("/interfaces", adminGetOnly(adminInterfacesHandler))
+	mux.HandleFunc("/interfaces/down", adminInterfaceStateHandler(false))
+	mux.HandleFunc("/interfaces/up", adminInterfaceStateHandler(true))
+	mux.HandleFunc("/stats", adminGetOnly(adminStatsHandler))
+	mux.HandleFunc("/drops", adminGetOnly(adminDropsHandler))
+	mux.HandleFunc("/multicast", adminGetOnly(adminMulticastHandler))
+	mux.HandleFunc("/lldp/neighbors", adminGetOnly(adminLldpNeighborsHandler))
+	mux.HandleFunc("/bridges", adminGetOnly(adminBridgesHandler))
+	mux.HandleFunc("/ntp", adminGetOnly(adminNtpHandler))
+	mux.HandleFunc("/vrrp", adminGetOnly(adminVrrpHandler))
+	mux.HandleFunc("/pppoe", adminGetOnly(adminPppoeHandler))
+	mux.HandleFunc("/ipsec", adminGetOnly(adminIpsecHandler))
+	mux.HandleFunc("/dhcpv6-pd", adminGetOnly(adminDhcpv6PdHandler))
+	mux.HandleFunc("/events", adminGetOnly(adminEventsHandler))
+	mux.HandleFunc("/nat", adminGetOnly(adminNatHandler))
+	mux.HandleFunc("/logs", adminGetOnly(adminLogsHandler))
+	mux.HandleFunc("/top-talkers", adminGetOnly(adminTopTalkersHandler))
+	mux.HandleFunc("/debug/packet", adminDebugPacketHandler)
+	mux.HandleFunc("/tables", adminTablesHandler)
+	mux.HandleFunc("/instances", adminGetOnly(adminInstancesHandler))
+	mux.HandleFunc("/", adminGetOnly(adminDashboardHandler))
+
+	server := &http.Server{
+		Handler: adminAuth(token, mux),
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+// tokenが設定されていればAuthorizationヘッダを確認する
+func adminAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.URL.Path != "/" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if given == "" && r.URL.Path == "/events" {
+				given = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				writeJSON(w, http.StatusUnauthorized, errorJSON{Error: "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminGetOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		routes := []routeJSON{}
+		for _, route := range controlListRoutes() {
+			routes = append(routes, newRouteJSON(route))
+		}
+		writeJSON(w, http.StatusOK, routes)
+	case http.MethodPost:
+		var route routeJSON
+		err := json.NewDecoder(r.Body).Decode(&route)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		prefix, err := parseIPv4Prefix(route.Prefix)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		iptype, err := parseStaticRouteType(route.Type)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		var nexthop netip.Addr
+		if route.Nexthop != "" {
+			nexthop, err = parseIPv4Addr(route.Nexthop)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+				return
+			}
+		}
+		err = controlAddRoute(prefix, iptype, nexthop, route.Distance, route.Metric)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, route)
+	case http.MethodDelete:
+		prefix, err := parseIPv4Prefix(r.URL.Query().Get("prefix"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		var nexthop netip.Addr
+		if s := r.URL.Query().Get("nexthop"); s != "" {
+			nexthop, err = parseIPv4Addr(s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+				return
+			}
+		}
+		err = controlDeleteRoute(prefix, nexthop)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, errorJSON{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+	}
+}
+
+func newRouteJSON(route routeInfo) routeJSON {
+	return routeJSON{
+		Prefix:   route.prefix.String(),
+		Type:     route.iptype,
+		Nexthop:  addrString(route.nexthop),
+		Device:   route.device,
+		Source:   route.source,
+		Distance: route.distance,
+		Metric:   route.metric,
+	}
+}
+
+func adminRibHandler(w http.ResponseWriter, r *http.Request) {
+	routes := []ribRouteJSON{}
+	for _, route := range controlListRib() {
+		routes = append(routes, ribRouteJSON{routeJSON: newRouteJSON(route), Selected: route.selected})
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+func adminArpHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newArpJSONs(controlListArp()))
+}
+
+func newArpJSONs(arp []arpInfo) []arpJSON {
+	entries := []arpJSON{}
+	for _, entry := range arp {
+		entries = append(entries, arpJSON{
+			IPAddress:  entry.ipAddr.String(),
+			MacAddress: entry.macAddr.String(),
+			Device:     entry.device,
+			Static:     entry.static,
+		})
+	}
+	return entries
+}
+
+func adminInstancesHandler(w http.ResponseWriter, r *http.Request) {
+	instances := []routerInstanceJSON{}
+	for _, inst := range controlListRouterInstances() {
+		instJSON := routerInstanceJSON{
+			Name:       inst.name,
+			Netns:      inst.netns,
+			Interfaces: inst.interfaces,
+			Routes:     []routeJSON{},
+			Arp:        newArpJSONs(inst.arp),
+		}
+		for _, route := range inst.routes {
+			instJSON.Routes = append(instJSON.Routes, newRouteJSON(route))
+		}
+		instances = append(instances, instJSON)
+	}
+	writeJSON(w, http.StatusOK, instances)
+}
+
+func adminInterfacesHandler(w http.ResponseWriter, r *http.Request) {
+	interfaces := []interfaceJSON{}
+	for _, netif := range controlListInterfaces() {
+		netifJSON := interfaceJSON{
+			Name:       netif.name,
+			MacAddress: netif.macAddr.String(),
+			Address:    prefixString(netif.address),
+			Counters:   newCountersJSON(netif.stats),
+			Shaping:    newQosRateJSON(netif.shaping),
+			Policing:   newQosRateJSON(netif.policing),
+			Scheduler:  netif.scheduler,
+		}
+		netifJSON.SecondaryAddresses = prefixStrings(netif.secondaryAddrs)
+		netifJSON.Promisc = netif.promisc
+		netifJSON.MacFilter = netif.macFilter
+		netifJSON.AdminState = netif.adminState
+		netifJSON.OperState = netif.operState
+		netifJSON.Urpf = netif.urpf
+		netifJSON.ChecksumPolicy = netif.checksumPolicy
+		netifJSON.RxChecksumOffload = netif.rxChecksumOffload
+		netifJSON.TxChecksumOffload = netif.txChecksumOffload
+		if imp := netif.impairment; imp != nil {
+			netifJSON.Impairment = &impairmentJSON{
+				DelayMs:  imp.delay.Milliseconds(),
+				JitterMs: imp.jitter.Milliseconds(),
+				Loss:     imp.loss,
+				Reorder:  imp.reorder,
+				Queued:   netif.impairQueued,
+			}
+		}
+		for _, queue := range netif.queues {
+			netifJSON.TxQueue += queue.len
+			netifJSON.Queues = append(netifJSON.Queues, queueJSON{
+				Class:   queue.class,
+				Len:     queue.len,
+				Sent:    queue.sent,
+				Dropped: queue.dropped,
+			})
+		}
+		interfaces = append(interfaces, netifJSON)
+	}
+	writeJSON(w, http.StatusOK, interfaces)
+}
+
+func adminInterfaceStateHandler(up bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+			return
+		}
+		var req interfaceStateJSON
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		err = controlSetInterfaceState(req.Name, up)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func adminDebugPacketHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		info, ok := controlGetPacketTrace()
+		if !ok {
+			writeJSON(w, http.StatusOK, debugPacketJSON{})
+			return
+		}
+		writeJSON(w, http.StatusOK, newDebugPacketJSON(info))
+	case http.MethodPost:
+		var req debugPacketJSON
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		info := packetTraceInfo{device: req.Interface, maxTTL: req.TTL}
+		if req.Src != "" {
+			info.src, err = parseIPv4Prefix(req.Src)
+		}
+		if err == nil && req.Dst != "" {
+			info.dst, err = parseIPv4Prefix(req.Dst)
+		}
+		if err == nil && req.Protocol != "" {
+			info.protocol, err = parseTraceProtocol(req.Protocol)
+		}
+		if err == nil {
+			err = controlSetPacketTrace(info)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, newDebugPacketJSON(info))
+	case http.MethodDelete:
+		controlClearPacketTrace()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+	}
+}
+
+func adminTablesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, controlDumpTables())
+	case http.MethodPost:
+		var tables tablesJSON
+		err := json.NewDecoder(r.Body).Decode(&tables)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		arpCount, routeCount, err := controlImportTables(tables)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, tablesImportJSON{ArpEntries: arpCount, Routes: routeCount})
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, errorJSON{Error: "method not allowed"})
+	}
+}
+
+func newDebugPacketJSON(info packetTraceInfo) debugPacketJSON {
+	debugPacket := debugPacketJSON{
+		Enabled:   true,
+		Src:       prefixString(info.src),
+		Dst:       prefixString(info.dst),
+		Interface: info.device,
+		TTL:       info.maxTTL,
+	}
+	if info.protocol != 0 {
+		debugPacket.Protocol = ipProtocolName(info.protocol)
+	}
+	return debugPacket
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := controlStats()
+	writeJSON(w, http.StatusOK, statsJSON{
+		Interfaces:    stats.interfaces,
+		Routes:        stats.routes,
+		ArpEntries:    stats.arpEntries,
+		ArpMacChanges: stats.arpMacChanges,
+		RouterID:      stats.routerID,
+		Counters:      newCountersJSON(stats.total),
+	})
+}
+
+func adminDropsHandler(w http.ResponseWriter, r *http.Request) {
+	counters := []dropCounterJSON{}
+	for _, counter := range controlListDropCounters() {
+		counters = append(counters, dropCounterJSON{
+			Reason: counter.reason,
+			Count:  counter.count,
+		})
+	}
+	writeJSON(w, http.StatusOK, counters)
+}
+
+func adminMulticastHandler(w http.ResponseWriter, r *http.Request) {
+	groups := []multicastJSON{}
+	for _, group := range controlListMulticastGroups() {
+		groups = append(groups, multicastJSON{
+			Group:  group.group,
+			Device: group.device,
+			Local:  group.local,
+			Proxy:  group.proxy,
+		})
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func adminLldpNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	neighbors := []lldpNeighborJSON{}
+	for _, n := range controlListLldpNeighbors() {
+		neighbors = append(neighbors, lldpNeighborJSON{
+			Device:          n.device,
+			ChassisID:       n.chassisID,
+			PortID:          n.portID,
+			PortDescription: n.portDescription,
+			SystemName:      n.systemName,
+			TTL:             n.ttl,
+		})
+	}
+	writeJSON(w, http.StatusOK, neighbors)
+}
+
+func adminBridgesHandler(w http.ResponseWriter, r *http.Request) {
+	bridges := []bridgeJSON{}
+	for _, br := range controlListBridges() {
+		b := bridgeJSON{
+			Name:      br.name,
+			STP:       br.stp,
+			BridgeID:  br.bridgeID,
+			RootID:    br.rootID,
+			RootPort:  br.rootPort,
+			Ports:     []bridgePortJSON{},
+			FDB:       []fdbJSON{},
+			AgingTime: br.agingTime,
+		}
+		for _, port := range br.ports {
+			p := bridgePortJSON{
+				Name:  port.name,
+				Role:  port.role,
+				State: port.state,
+			}
+			if port.portSecurity {
+				p.PortSecurity = &portSecurityJSON{
+					MaxMacs:    port.maxMacs,
+					Sticky:     port.sticky,
+					Violation:  port.violation,
+					Violations: port.violations,
+					Learned:    port.learned,
+				}
+			}
+			b.Ports = append(b.Ports, p)
+		}
+		for _, entry := range br.fdb {
+			b.FDB = append(b.FDB, fdbJSON{
+				MacAddress: entry.macAddr,
+				Port:       entry.port,
+				Age:        entry.age,
+				Sticky:     entry.sticky,
+			})
+		}
+		bridges = append(bridges, b)
+	}
+	writeJSON(w, http.StatusOK, bridges)
+}
+
+func adminNtpHandler(w http.ResponseWriter, r *http.Request) {
+	status := controlNtpStatus()
+	ntp := ntpJSON{
+		Enabled:      status.enabled,
+		Serving:      status.serving,
+		Synchronized: status.synchronized,
+		Server:       status.server,
+		Stratum:      status.stratum,
+		OffsetMs:     float64(status.offset) / float64(time.Millisecond),
+		DelayMs:      float64(status.delay) / float64(time.Millisecond),
+		Time:         status.time.Format(time.RFC3339Nano),
+	}
+	if !status.lastSync.IsZero() {
+		ntp.LastSync = status.lastSync.Add(status.offset).Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, ntp)
+}
+
+func adminVrrpHandler(w http.ResponseWriter, r *http.Request) {
+	routers := []vrrpRouterJSON{}
+	for _, vr := range controlListVrrpRouters() {
+		routers = append(routers, vrrpRouterJSON{
+			Device:         vr.device,
+			VRID:           vr.vrid,
+			Address:        vr.address,
+			Priority:       vr.priority,
+			State:          vr.state,
+			Master:         vr.master,
+			AdvertInterval: vr.advertInterval,
+		})
+	}
+	writeJSON(w, http.StatusOK, routers)
+}
+
+func adminPppoeHandler(w http.ResponseWriter, r *http.Request) {
+	status := controlPppoeStatus()
+	session := pppoeJSON{
+		Enabled:   status.enabled,
+		Device:    status.device,
+		State:     status.state,
+		ACName:    status.acName,
+		ACMacAddr: status.acMacAddr,
+		SessionID: status.sessionID,
+		Address:   status.address,
+		Peer:      status.peer,
+		MRU:       status.mru,
+	}
+	if !status.upSince.IsZero() {
+		session.UpSince = status.upSince.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func adminDhcpv6PdHandler(w http.ResponseWriter, r *http.Request) {
+	status := controlDhcpv6PdStatus()
+	pd := dhcpv6PdJSON{
+		Enabled: status.enabled,
+		Device:  status.device,
+		State:   status.state,
+		Server:  status.server,
+		Prefix:  status.prefix,
+	}
+	for _, assigned := range status.assigned {
+		pd.Assigned = append(pd.Assigned, dhcpv6AssignedJSON{Device: assigned.device, Prefix: assigned.prefix})
+	}
+	if !status.expires.IsZero() {
+		pd.Expires = status.expires.Format(time.RFC3339)
+	}
+	writeJSON(w, http.StatusOK, pd)
+}
+
+func adminIpsecHandler(w http.ResponseWriter, r *http.Request) {
+	tunnels := []ipsecTunnelJSON{}
+	for _, tunnel := range controlListIpsecTunnels() {
+		tunnels = append(tunnels, ipsecTunnelJSON{
+			Peer:         tunnel.peer,
+			SPIOut:       tunnel.spiOut,
+			SPIIn:        tunnel.spiIn,
+			Routes:       tunnel.routes,
+			TxPackets:    tunnel.stats.txPackets,
+			RxPackets:    tunnel.stats.rxPackets,
+			AuthFailures: tunnel.stats.authFailures,
+			Replayed:     tunnel.stats.replayed,
+		})
+	}
+	writeJSON(w, http.StatusOK, tunnels)
+}
+
+/*
+パケットのイベントをServer-Sent Eventsで送る
+1つのイベントを1つのdata行のJSONにする、クライアントが切断するまで返らない
+*/
+func adminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	sample := 1
+	if s := r.URL.Query().Get("sample"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: "invalid sample " + s})
+			return
+		}
+		sample = n
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, errorJSON{Error: "streaming is not supported"})
+		return
+	}
+	events, cancel := subscribePacketEvents(sample)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(newPacketEventJSON(event))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func newPacketEventJSON(event packetEvent) packetEventJSON {
+	v := packetEventJSON{
+		Time:         event.timestamp.Format(time.RFC3339Nano),
+		Packet:       event.packetID,
+		Device:       event.device,
+		Action:       event.action,
+		SrcAddress:   printIPAddr(event.srcAddr),
+		DestAddress:  printIPAddr(event.destAddr),
+		Protocol:     event.protocol,
+		Length:       event.length,
+		OutputDevice: event.outputDevice,
+		Route:        event.route,
+		DropReason:   event.dropReason,
+	}
+	if event.nexthop != 0 {
+		v.Nexthop = printIPAddr(event.nexthop)
+	}
+	return v
+}
+
+func adminNatHandler(w http.ResponseWriter, r *http.Request) {
+	status := controlNatStatus()
+	v := natJSON{
+		Enabled:  status.enabled,
+		Outside:  status.outside,
+		Inside:   status.inside,
+		Sessions: []natSessionJSON{},
+	}
+	for _, session := range status.sessions {
+		v.Sessions = append(v.Sessions, natSessionJSON{
+			Protocol:      session.protocol,
+			LocalAddress:  session.localAddr,
+			LocalPort:     session.localPort,
+			GlobalAddress: session.globalAddr,
+			GlobalPort:    session.globalPort,
+			Idle:          session.idle,
+		})
+	}
+	for _, fwd := range status.portForwards {
+		v.PortForwards = append(v.PortForwards, natPortForwardJSON{
+			Protocol:     fwd.protocol,
+			Port:         fwd.globalPort,
+			LocalAddress: fwd.localAddr,
+			LocalPort:    fwd.localPort,
+		})
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func adminLogsHandler(w http.ResponseWriter, r *http.Request) {
+	n := LOG_BUFFER_LINES
+	if s := r.URL.Query().Get("lines"); s != "" {
+		lines, err := strconv.Atoi(s)
+		if err != nil || lines < 1 {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: "invalid lines " + s})
+			return
+		}
+		n = lines
+	}
+	lines := []logLineJSON{}
+	for _, line := range recentLogLines(n) {
+		lines = append(lines, logLineJSON{
+			Time: line.time.Format(time.RFC3339Nano),
+			Line: line.text,
+		})
+	}
+	writeJSON(w, http.StatusOK, lines)
+}
+
+func adminTopTalkersHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, errorJSON{Error: "invalid limit " + s})
+			return
+		}
+		limit = n
+	}
+	talkers := []topTalkerJSON{}
+	for _, talker := range controlTopTalkers(limit) {
+		talkers = append(talkers, topTalkerJSON{
+			Protocol:    talker.protocol,
+			Source:      talker.srcAddr,
+			SourcePort:  talker.srcPort,
+			Destination: talker.destAddr,
+			DestPort:    talker.destPort,
+			Packets:     talker.packets,
+			Bytes:       talker.bytes,
+			Bps:         talker.bps,
+			Idle:        talker.idle,
+		})
+	}
+	writeJSON(w, http.StatusOK, talkers)
+}
+
+// 他のパスに一致しなかったリクエストも来るので、/以外は404にする
+func adminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeJSON(w, http.StatusNotFound, errorJSON{Error: "not found"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+NATのALG(Application Level Gateway)
+FTPとSIPはペイロードの中にIPアドレスとポート番号を書いて相手に別のコネクションを張らせるので、
+アドレスを書き換えるだけのNAPTでは内側のアドレスが外に漏れて通信できない
+内側から外側へ出ていくパケットのペイロードの中の内側のアドレスとポート番号を外側のアドレスと割り当てたポート番号に書き換え、
+相手から張られるコネクションのためのNATのエントリ(期待するコネクション)を先に作っておく
+  FTP  クライアントのPORT/EPRTコマンドと、ポートフォワードしたサーバの227(PASV)/229(EPSV)の応答
+  SIP  Via、Contactなどのヘッダとボディ(SDP)のc=、o=の内側のアドレス、m=のメディア(RTP)のポート番号
+書き換えでTCPのペイロードの長さが変わると、それより後ろのシーケンス番号がずれるので、
+コネクションごとにずれを覚えて、出ていくパケットのシーケンス番号と入ってくるパケットのACK番号を直す
+*/
+
+const FTP_CONTROL_PORT uint16 = 21
+const SIP_PORT uint16 = 5060
+
+// ALGでペイロードの長さを変えたTCPのコネクションのシーケンス番号のずれ
+type natSeqAdjust struct {
+	localAddr  uint32
+	localPort  uint16
+	remoteAddr uint32
+	remotePort uint16
+	// correctionPosより後ろのシーケンス番号にはoffsetAfter、それまではoffsetBeforeを足す
+	correctionPos uint32
+	offsetBefore  int32
+	offsetAfter   int32
+	lastUsed      time.Time
+}
+
+var natSeqAdjustList []*natSeqAdjust
+
+func searchNatSeqAdjust(localAddr uint32, localPort uint16, remoteAddr uint32, remotePort uint16) *natSeqAdjust {
+	for _, adjust := range natSeqAdjustList {
+		if adjust.localAddr == localAddr && adjust.localPort == localPort &&
+			adjust.remoteAddr == remoteAddr && adjust.remotePort == remotePort {
+			return adjust
+		}
+	}
+	return nil
+}
+
+// 期限切れのシーケンス番号のずれを消す
+func natExpireSeqAdjusts(now time.Time) {
+	var adjusts []*natSeqAdjust
+	for _, adjust := range natSeqAdjustList {
+		if now.Sub(adjust.lastUsed) < NAT_TCP_ENTRY_TIMEOUT {
+			adjusts = append(adjusts, adjust)
+		}
+	}
+	natSeqAdjustList = adjusts
+}
+
+/*
+相手から張られるコネクションのためのNATのエントリを作り、外側のポート番号を返す
+同じ内側のポート番号のエントリがあればそれを使う
+*/
+func natAlgExpect(protocol uint8, localAddr uint32, localPort uint16, outsidedev *netDevice) (uint16, bool) {
+	now := time.Now()
+	for _, entry := range natEntryList {
+		if entry.protocol == protocol && entry.localAddr == localAddr && entry.localPort == localPort {
+			entry.lastUsed = now
+			return entry.globalPort, true
+		}
+	}
+	globalPort, ok := natAllocateGlobalPort(protocol)
+	if !ok {
+		fmt.Println("NAT table is full")
+		return 0, false
+	}
+	entry := &natEntry{
+		protocol:   protocol,
+		localAddr:  localAddr,
+		localPort:  localPort,
+		globalAddr: outsidedev.ipDev.address,
+		globalPort: globalPort,
+		lastUsed:   now,
+	}
+	natEntryList = append(natEntryList, entry)
+	fmt.Printf("Created NAT expectation %s:%d => %s:%d (protocol %d)\n", printIPAddr(localAddr), localPort,
+		printIPAddr(entry.globalAddr), globalPort, protocol)
+	return globalPort, true
+}
+
+/*
+相手から張られるコネクションの外側のポート番号
+ポートフォワードしているポート番号はそのまま使い、それ以外はNATのエントリを作る
+*/
+func natAlgGlobalPort(protocol uint8, localAddr uint32, localPort uint16, outsidedev *netDevice) (uint16, bool) {
+	if fwd := natSearchPortForwardByLocal(protocol, localAddr, localPort); fwd != nil {
+		return fwd.globalPort, true
+	}
+	return natAlgExpect(protocol, localAddr, localPort, outsidedev)
+}
+
+/*
+内側から外側へ出ていくパケットのペイロードを書き換える
+NATでアドレスを書き換える前に呼び、ペイロードの長さが変わったパケットを返す
+*/
+func natAlgOutbound(ipPacket []byte, outsidedev *netDevice) []byte {
+	// 分割されたパケットはペイロードが揃っていないので書き換えない
+	if byteToUint16(ipPacket[6:8])&0x3fff != 0 {
+		return ipPacket
+	}
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	l4 := ipPacket[headerLen:]
+	srcAddr := byteToUint32(ipPacket[12:16])
+	destAddr := byteToUint32(ipPacket[16:20])
+	switch ipPacket[9] {
+	case IP_PROTOCOL_NUM_TCP:
+		if len(l4) < 20 || int(l4[12]>>4)*4 < 20 || len(l4) < int(l4[12]>>4)*4 {
+			return ipPacket
+		}
+		srcPort, destPort := byteToUint16(l4[0:2]), byteToUint16(l4[2:4])
+		if srcPort != FTP_CONTROL_PORT && destPort != FTP_CONTROL_PORT {
+			return ipPacket
+		}
+		now := time.Now()
+		natExpireSeqAdjusts(now)
+		dataOffset := headerLen + int(l4[12]>>4)*4
+		seq := byteToUint32(l4[4:8])
+		diff := 0
+		payload, rewritten := ftpAlgRewrite(ipPacket[dataOffset:], srcAddr, outsidedev)
+		if rewritten {
+			diff = len(payload) - (len(ipPacket) - dataOffset)
+			ipPacket = natAlgReplacePayload(ipPacket, dataOffset, payload)
+			l4 = ipPacket[headerLen:]
+		}
+		adjust := searchNatSeqAdjust(srcAddr, srcPort, destAddr, destPort)
+		if adjust == nil && diff != 0 {
+			adjust = &natSeqAdjust{localAddr: srcAddr, localPort: srcPort, remoteAddr: destAddr, remotePort: destPort}
+			natSeqAdjustList = append(natSeqAdjustList, adjust)
+		}
+		if adjust != nil {
+			// 書き換えたパケットより前のデータの再送には前のずれを使う
+			offset := adjust.offsetBefore
+			if int32(seq-adjust.correctionPos) > 0 {
+				offset = adjust.offsetAfter
+			}
+			// 書き換えたパケットの再送ではずれを足し直さない
+			if diff != 0 && (adjust.offsetBefore == adjust.offsetAfter || int32(seq-adjust.correctionPos) > 0) {
+				adjust.correctionPos = seq
+				adjust.offsetBefore = adjust.offsetAfter
+				adjust.offsetAfter += int32(diff)
+			}
+			adjust.lastUsed = now
+			copy(l4[4:8], uint32ToByte(seq+uint32(offset)))
+		}
+		if !rewritten && adjust == nil {
+			return ipPacket
+		}
+		setTransportChecksum(ipPacket, 16)
+	case IP_PROTOCOL_NUM_UDP:
+		if len(l4) < 8 {
+			return ipPacket
+		}
+		srcPort, destPort := byteToUint16(l4[0:2]), byteToUint16(l4[2:4])
+		if srcPort != SIP_PORT && destPort != SIP_PORT {
+			return ipPacket
+		}
+		payload, ok := sipAlgRewrite(l4[8:], srcAddr, srcPort, outsidedev)
+		if !ok {
+			return ipPacket
+		}
+		ipPacket = natAlgReplacePayload(ipPacket, headerLen+8, payload)
+		l4 = ipPacket[headerLen:]
+		copy(l4[4:6], uint16ToByte(uint16(len(l4))))
+		if byteToUint16(l4[6:8]) != 0 {
+			setTransportChecksum(ipPacket, 6)
+		}
+	default:
+		return ipPacket
+	}
+	setIPHeaderChecksum(ipPacket)
+	return ipPacket
+}
+
+/*
+外側から入ってきたパケットのACK番号を、ALGで書き換えた分だけ戻す
+NATで宛先を内側のホストに書き換えた後に呼ぶ
+*/
+func natAlgInbound(ipPacket []byte) {
+	if ipPacket[9] != IP_PROTOCOL_NUM_TCP || len(natSeqAdjustList) == 0 || byteToUint16(ipPacket[6:8])&0x3fff != 0 {
+		return
+	}
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	l4 := ipPacket[headerLen:]
+	if len(l4) < 20 {
+		return
+	}
+	adjust := searchNatSeqAdjust(byteToUint32(ipPacket[16:20]), byteToUint16(l4[2:4]),
+		byteToUint32(ipPacket[12:16]), byteToUint16(l4[0:2]))
+	if adjust == nil {
+		return
+	}
+	ack := byteToUint32(l4[8:12])
+	offset := adjust.offsetBefore
+	if int32(ack-uint32(adjust.offsetBefore)-adjust.correctionPos) > 0 {
+		offset = adjust.offsetAfter
+	}
+	copy(l4[8:12], uint32ToByte(ack-uint32(offset)))
+	setTransportChecksum(ipPacket, 16)
+}
+
+// offsetから後ろのペイロードを入れ替えて、IPヘッダの全長を直したパケットを返す
+func natAlgReplacePayload(ipPacket []byte, offset int, payload []byte) []byte {
+	packet := make([]byte, offset+len(payload))
+	copy(packet, ipPacket[:offset])
+	copy(packet[offset:], payload)
+	copy(packet[2:4], uint16ToByte(uint16(len(packet))))
+	return packet
+}
+
+/*
+FTPのコマンドと応答の中のアドレスとポート番号を書き換える
+
+	PORT 192,168,1,2,78,32
+	EPRT |1|192.168.1.2|20000|
+	227 Entering Passive Mode (192,168,1,2,78,32).
+	229 Entering Extended Passive Mode (|||20000|)
+*/
+func ftpAlgRewrite(payload []byte, localAddr uint32, outsidedev *netDevice) ([]byte, bool) {
+	if len(payload) < 4 {
+		return nil, false
+	}
+	command := string(bytes.ToUpper(payload[:4]))
+	switch command {
+	case "PORT", "227 ":
+		start, end := 5, bytes.IndexByte(payload, '\r')
+		if command == "227 " {
+			start, end = bytes.IndexByte(payload, '(')+1, bytes.IndexByte(payload, ')')
+		}
+		if start < 1 || end < start {
+			return nil, false
+		}
+		addr, port, ok := parseFtpHostPort(string(payload[start:end]))
+		if !ok || addr != localAddr {
+			return nil, false
+		}
+		globalPort, ok := natAlgGlobalPort(IP_PROTOCOL_NUM_TCP, localAddr, port, outsidedev)
+		if !ok {
+			return nil, false
+		}
+		global := uint32ToByte(outsidedev.ipDev.address)
+		hostPort := fmt.Sprintf("%d,%d,%d,%d,%d,%d", global[0], global[1], global[2], global[3], globalPort>>8, globalPort&0xff)
+		return natAlgSplice(payload, start, end, hostPort), true
+	case "EPRT", "229 ":
+		// |プロトコル|アドレス|ポート番号|、EPSVの応答はアドレスを省略する
+		start := bytes.IndexByte(payload, '|')
+		if start < 0 || len(payload) < start+4 {
+			return nil, false
+		}
+		delim := payload[start]
+		fields := bytes.SplitN(payload[start+1:], []byte{delim}, 4)
+		if len(fields) < 4 {
+			return nil, false
+		}
+		port, err := strconv.ParseUint(string(fields[2]), 10, 16)
+		if err != nil {
+			return nil, false
+		}
+		if command == "EPRT" {
+			addr, err := parseIPAddr(string(fields[1]))
+			if err != nil || string(fields[0]) != "1" || addr != localAddr {
+				return nil, false
+			}
+		} else if len(fields[0]) != 0 || len(fields[1]) != 0 {
+			return nil, false
+		}
+		globalPort, ok := natAlgGlobalPort(IP_PROTOCOL_NUM_TCP, localAddr, uint16(port), outsidedev)
+		if !ok {
+			return nil, false
+		}
+		end := start + 1 + len(fields[0]) + 1 + len(fields[1]) + 1 + len(fields[2])
+		hostPort := fmt.Sprintf("%c%s%c%s%c%d", delim, fields[0], delim, fields[1], delim, globalPort)
+		if command == "EPRT" {
+			hostPort = fmt.Sprintf("%c1%c%s%c%d", delim, delim, printIPAddr(outsidedev.ipDev.address), delim, globalPort)
+		}
+		return natAlgSplice(payload, start, end, hostPort), true
+	}
+	return nil, false
+}
+
+// "h1,h2,h3,h4,p1,p2"を読む
+func parseFtpHostPort(s string) (uint32, uint16, bool) {
+	var b [6]uint64
+	fields := bytes.Split([]byte(s), []byte(","))
+	if len(fields) != 6 {
+		return 0, 0, false
+	}
+	for i, field := range fields {
+		v, err := strconv.ParseUint(string(bytes.TrimSpace(field)), 10, 8)
+		if err != nil {
+			return 0, 0, false
+		}
+		b[i] = v
+	}
+	addr := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	return addr, uint16(b[4])<<8 | uint16(b[5]), true
+}
+
+// payloadのstartからendまでをsに入れ替える
+func natAlgSplice(payload []byte, start, end int, s string) []byte {
+	var b []byte
+	b = append(b, payload[:start]...)
+	b = append(b, s...)
+	return append(b, payload[end:]...)
+}
+
+/*
+SIPのメッセージの中の内側のアドレスを書き換える
+ヘッダの"内側のアドレス:ポート番号"はNATで割り当てる外側のポート番号にし、残りの内側のアドレスは外側のアドレスにする
+ボディのSDPのm=のメディアのポート番号は、相手からRTPを受け取れるようにNATのエントリを作って書き換える
+RTCPはRTPの次のポート番号を使うが、外側で続きのポート番号を取れるとは限らないので扱わない
+ボディの長さが変わるのでContent-Lengthを直す
+*/
+func sipAlgRewrite(payload []byte, localAddr uint32, localPort uint16, outsidedev *netDevice) ([]byte, bool) {
+	local := printIPAddr(localAddr)
+	if !bytes.Contains(payload, []byte(local)) {
+		return nil, false
+	}
+	global := printIPAddr(outsidedev.ipDev.address)
+	header, body, found := bytes.Cut(payload, []byte("\r\n\r\n"))
+	if globalPort, ok := natAlgGlobalPort(IP_PROTOCOL_NUM_UDP, localAddr, localPort, outsidedev); ok {
+		header = natAlgReplaceAddr(header, fmt.Sprintf("%s:%d", local, localPort), fmt.Sprintf("%s:%d", global, globalPort))
+	}
+	header = natAlgReplaceAddr(header, local, global)
+	if !found {
+		return header, true
+	}
+
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\r\n")) {
+		// m=audio 49170 RTP/AVP 0
+		if fields := bytes.Fields(line); bytes.HasPrefix(line, []byte("m=")) && len(fields) >= 2 {
+			port, err := strconv.ParseUint(string(fields[1]), 10, 16)
+			if err == nil && port != 0 {
+				if globalPort, ok := natAlgGlobalPort(IP_PROTOCOL_NUM_UDP, localAddr, uint16(port), outsidedev); ok {
+					fields[1] = []byte(strconv.Itoa(int(globalPort)))
+					line = bytes.Join(fields, []byte(" "))
+				}
+			}
+		}
+		lines = append(lines, natAlgReplaceAddr(line, local, global))
+	}
+	body = bytes.Join(lines, []byte("\r\n"))
+
+	var headers [][]byte
+	for _, line := range bytes.Split(header, []byte("\r\n")) {
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		name = bytes.ToLower(bytes.TrimSpace(name))
+		if bytes.Equal(name, []byte("content-length")) || bytes.Equal(name, []byte("l")) {
+			line = []byte(fmt.Sprintf("Content-Length: %d", len(body)))
+		}
+		headers = append(headers, line)
+	}
+	var b []byte
+	b = append(b, bytes.Join(headers, []byte("\r\n"))...)
+	b = append(b, "\r\n\r\n"...)
+	return append(b, body...), true
+}
+
+// アドレスを書き換える、192.168.1.2を書き換える時に192.168.1.20は書き換えない
+func natAlgReplaceAddr(b []byte, old, new string) []byte {
+	var result []byte
+	for {
+		i := bytes.Index(b, []byte(old))
+		if i < 0 {
+			return append(result, b...)
+		}
+		end := i + len(old)
+		boundary := (i == 0 || !isAddrChar(b[i-1])) && (end == len(b) || !isAddrChar(b[end]))
+		result = append(result, b[:i]...)
+		if boundary {
+			result = append(result, new...)
+		} else {
+			result = append(result, old...)
+		}
+		b = b[end:]
+	}
+}
+
+func isAddrChar(c byte) bool {
+	return '0' <= c && c <= '9' || c == '.'
+}
@@ -3,13 +3,26 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 )
 
 const ARP_OPERATION_CODE_REQUEST = 1
 const ARP_OPERATION_CODE_REPLY = 2
 const ARP_HTYPE_ETHERNET uint16 = 0001
 
+// ARPリクエストの送信間隔と再送の上限
+const ARP_REQUEST_INTERVAL = 1 * time.Second
+const ARP_REQUEST_MAX_INTERVAL = 8 * time.Second
+const ARP_REQUEST_MAX_RETRY = 3
+
+// 応答の無かったアドレスをネガティブキャッシュしておく時間
+const ARP_NEGATIVE_CACHE_TIMEOUT = 20 * time.Second
+
+// 解決中のアドレスがこの数の倍数になるたびに、使われなくなった送信状況を消す
+const ARP_PENDING_SWEEP_SIZE = 256
+
 /**
  * ARPテーブル
  * グローバル変数にテーブルを保持
@@ -34,6 +47,107 @@ type arpTableEntry struct {
 	netdev  *netDevice
 }
 
+/*
+解決中のアドレスごとのARPリクエストの送信状況
+ホストがダウンしているときにリクエストでLANを溢れさせないようにする
+*/
+type arpPendingEntry struct {
+	lastSent      time.Time     // 最後にリクエストを送った時刻
+	interval      time.Duration // 次のリクエストまでの間隔
+	retry         int           // 応答が無いまま送ったリクエストの数
+	negativeUntil time.Time     // この時刻までは到達不能として扱う
+}
+
+var arpPendingList = map[uint32]*arpPendingEntry{}
+
+// ネガティブキャッシュが切れていて、再送を待っているリクエストも無い送信状況か
+func (pending *arpPendingEntry) stale(now time.Time) bool {
+	if now.Before(pending.negativeUntil) {
+		return false
+	}
+	return pending.lastSent.IsZero() || ARP_NEGATIVE_CACHE_TIMEOUT <= now.Sub(pending.lastSent)
+}
+
+/*
+使われなくなった送信状況を消す
+応答が無いアドレスの送信状況はARPリプライでは消えないので、スキャンされても溜まり続けないようにする
+*/
+func expireArpPending(now time.Time) {
+	for ipaddr, pending := range arpPendingList {
+		if pending.stale(now) {
+			delete(arpPendingList, ipaddr)
+		}
+	}
+}
+
+/*
+静的なARPエントリ
+学習したエントリより優先し、ARPリプライやIPパケットの送信元で上書きされない
+*/
+type staticArpEntry struct {
+	ifname  string
+	ipAddr  uint32
+	macAddr [6]uint8
+}
+
+var staticArpEntries []staticArpEntry
+
+// コマンドラインで指定された静的なエントリ
+var staticArpConfigs []staticArpEntry
+
+// 既に学習していたアドレスのMACアドレスが変わった回数、ARPスプーフィングの兆候
+var arpMacChanges uint64
+
+// "eth1=192.168.1.2/02:00:00:00:00:01"を読む
+func parseStaticArpEntry(spec string) (staticArpEntry, error) {
+	ifname, rest, found := strings.Cut(spec, "=")
+	address, mac, found2 := strings.Cut(rest, "/")
+	if !found || !found2 || ifname == "" {
+		return staticArpEntry{}, fmt.Errorf("invalid static arp entry %q, format is name=address/mac", spec)
+	}
+	return newStaticArpEntry(ifname, address, mac)
+}
+
+func newStaticArpEntry(ifname, address, mac string) (staticArpEntry, error) {
+	ipaddr, err := parseIPAddr(address)
+	if err != nil {
+		return staticArpEntry{}, err
+	}
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwaddr) != ETHERNET_ADDRES_LEN {
+		return staticArpEntry{}, fmt.Errorf("invalid mac address %s", mac)
+	}
+	return staticArpEntry{ifname: ifname, ipAddr: ipaddr, macAddr: setMacAddr(hwaddr)}, nil
+}
+
+/*
+静的なエントリを入れ替える
+同じアドレスを学習していたら消して、静的なエントリが使われるようにする
+*/
+func setStaticArpEntries(entries []staticArpEntry) {
+	for _, entry := range entries {
+		var learned []arpTableEntry
+		for _, arpTable := range ArpTableEntryList {
+			if arpTable.ipAddr != entry.ipAddr {
+				learned = append(learned, arpTable)
+			}
+		}
+		ArpTableEntryList = learned
+		delete(arpPendingList, entry.ipAddr)
+		fmt.Printf("Set static arp entry %s => %s on %s\n", printIPAddr(entry.ipAddr), printMacAddr(entry.macAddr), entry.ifname)
+	}
+	staticArpEntries = entries
+}
+
+func searchStaticArpEntry(ipaddr uint32) *staticArpEntry {
+	for i := range staticArpEntries {
+		if staticArpEntries[i].ipAddr == ipaddr {
+			return &staticArpEntries[i]
+		}
+	}
+	return nil
+}
+
 func (arpmsg arpIPToEthernet) ToPacket() []byte {
 	var b bytes.Buffer
 
@@ -50,15 +164,20 @@ func (arpmsg arpIPToEthernet) ToPacket() []byte {
 	return b.Bytes()
 }
 
+func init() {
+	registerEtherType(ETHER_TYPE_ARP, arpInput)
+}
+
 /*
 ARPパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L139
 */
-func arpInput(netdev *netDevice, packet []byte) {
+func arpInput(ctx *inputContext, packet []byte) error {
+	netdev := ctx.netdev
 	// ARPパケットの規定より短かったら
 	if len(packet) < 28 {
-		fmt.Printf("received ARP Packet is too short")
-		return
+		fmt.Println("received ARP Packet is too short")
+		return dropPacket(DROP_REASON_ARP_TOO_SHORT)
 	}
 
 	// 構造体にセット
@@ -79,12 +198,12 @@ func arpInput(netdev *netDevice, packet []byte) {
 
 		if arpMsg.hardwareLen != ETHERNET_ADDRES_LEN {
 			fmt.Println("Illegal hardware address length")
-			return
+			return dropPacket(DROP_REASON_ARP_BAD_ADDRESS_LEN)
 		}
 
 		if arpMsg.protocolLen != IP_ADDRESS_LEN {
 			fmt.Println("Illegal protocol address length")
-			return
+			return dropPacket(DROP_REASON_ARP_BAD_ADDRESS_LEN)
 		}
 
 		// オペレーションコードによって分岐
@@ -98,30 +217,41 @@ func arpInput(netdev *netDevice, packet []byte) {
 			arpReplyArrives(netdev, arpMsg)
 		}
 	}
+	return nil
 }
 
 /*
 ARPテーブルにエントリの追加と更新
+静的なエントリと違うMACアドレスは登録せずにfalseを返す
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L23
 */
-func addArpTableEntry(netdev *netDevice, ipaddr uint32, macaddr [6]uint8) {
+func addArpTableEntry(netdev *netDevice, ipaddr uint32, macaddr [6]uint8) bool {
+	// 静的なエントリは上書きしない
+	if static := searchStaticArpEntry(ipaddr); static != nil {
+		if static.macAddr != macaddr {
+			fmt.Printf("Ignored %s for %s on %s, static arp entry is %s (possible arp spoofing)\n",
+				printMacAddr(macaddr), printIPAddr(ipaddr), netdev.name, printMacAddr(static.macAddr))
+			return false
+		}
+		return true
+	}
 
 	// 既存のARPテーブルの更新が必要か確認
-	if len(ArpTableEntryList) != 0 {
-		for _, arpTable := range ArpTableEntryList {
-			// IPアドレスは同じだがMacアドレスが異なる場合は更新
-			if arpTable.ipAddr == ipaddr && arpTable.macAddr != macaddr {
-				arpTable.macAddr = macaddr
-			}
-			// Macアドレスは同じだがIPアドレスが変わった場合は更新
-			if arpTable.macAddr == macaddr && arpTable.ipAddr != ipaddr {
-				arpTable.ipAddr = ipaddr
-			}
-			// 既に存在する場合はreturnする
-			if arpTable.macAddr == macaddr && arpTable.ipAddr == ipaddr {
-				return
-			}
+	for i := range ArpTableEntryList {
+		arpTable := &ArpTableEntryList[i]
+		if arpTable.ipAddr != ipaddr {
+			continue
+		}
+		// IPアドレスは同じだがMacアドレスが異なる場合は記録して更新
+		if arpTable.macAddr != macaddr {
+			fmt.Printf("MAC address of %s changed from %s to %s on %s (possible arp spoofing)\n",
+				printIPAddr(ipaddr), printMacAddr(arpTable.macAddr), printMacAddr(macaddr), netdev.name)
+			arpMacChanges++
+			arpTable.macAddr = macaddr
+			arpTable.netdev = netdev
 		}
+		delete(arpPendingList, ipaddr)
+		return true
 	}
 
 	ArpTableEntryList = append(ArpTableEntryList, arpTableEntry{
@@ -129,13 +259,55 @@ func addArpTableEntry(netdev *netDevice, ipaddr uint32, macaddr [6]uint8) {
 		ipAddr:  ipaddr,
 		netdev:  netdev,
 	})
+	// 解決できたので送信状況を消す
+	delete(arpPendingList, ipaddr)
 	//fmt.Printf("ARP TABEL is %+v\n", ArpTableEntryList)
+	return true
+}
+
+/*
+受信したIPパケットの送信元からARPテーブルを学習する
+ARPを使わずにIPパケットだけでエントリを作られないように、インターフェイスのサブネットの中で
+リクエストを送って解決を待っているアドレスだけを登録する、登録済みのエントリは書き換えない
+*/
+func arpLearnFromIP(netdev *netDevice, ipaddr uint32, macaddr [6]uint8) {
+	if !netdev.ipDev.inSubnet(ipaddr) || netdev.ipDev.hasAddr(ipaddr) {
+		return
+	}
+	if _, requested := arpPendingList[ipaddr]; !requested {
+		return
+	}
+	if known, _ := searchArpTableEntry(ipaddr); known != [6]uint8{} {
+		return
+	}
+	if addArpTableEntry(netdev, ipaddr, macaddr) {
+		debugPrintf("Added arp table entry by ip packet (%s => %s)\n", printIPAddr(ipaddr), printMacAddr(macaddr))
+	}
+}
+
+/*
+デバイスで学習したARPテーブルのエントリを削除
+*/
+func flushArpTableEntry(netdev *netDevice) {
+	var entries []arpTableEntry
+	for _, arpTable := range ArpTableEntryList {
+		if arpTable.netdev != netdev {
+			entries = append(entries, arpTable)
+		}
+	}
+	ArpTableEntryList = entries
 }
 
 /*
 ARPテーブルの検索
+静的なエントリはインターフェイスがあれば学習したものより優先する
 */
 func searchArpTableEntry(ipaddr uint32) ([6]uint8, *netDevice) {
+	if static := searchStaticArpEntry(ipaddr); static != nil {
+		if netdev := searchNetDeviceByName(static.ifname); netdev != nil {
+			return static.macAddr, netdev
+		}
+	}
 	if len(ArpTableEntryList) != 0 {
 		for _, arpTable := range ArpTableEntryList {
 			if arpTable.ipAddr == ipaddr {
@@ -151,8 +323,31 @@ ARPリクエストパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L181
 */
 func arpRequestArrives(netdev *netDevice, arp arpIPToEthernet) {
-	// IPアドレスが設定されているデバイスからの受信かつ要求されているアドレスが自分の物だったら
-	if netdev.ipDev.address != 00000000 && netdev.ipDev.address == arp.targetIPAddr {
+	// VRRPのマスターなら仮想IPアドレスに仮想MACアドレスで答える
+	if vr := searchVrrpMaster(netdev, arp.targetIPAddr); vr != nil {
+		macaddr := vrrpMacAddr(vr.config.vrid)
+		fmt.Printf("Sending arp reply to %s with virtual mac address %s\n", printIPAddr(arp.targetIPAddr), printMacAddr(macaddr))
+		arpPacket := arpIPToEthernet{
+			hardwareType:        ARP_HTYPE_ETHERNET,
+			protocolType:        ETHER_TYPE_IP,
+			hardwareLen:         ETHERNET_ADDRES_LEN,
+			protocolLen:         IP_ADDRESS_LEN,
+			opcode:              ARP_OPERATION_CODE_REPLY,
+			senderHardwareAddr:  macaddr,
+			senderIPAddr:        vr.config.address,
+			targetHardwareAddrr: arp.senderHardwareAddr,
+			targetIPAddr:        arp.senderIPAddr,
+		}.ToPacket()
+		ethernetOutputFrom(netdev, macaddr, arp.senderHardwareAddr, arpPacket, ETHER_TYPE_ARP)
+		return
+	}
+	// IPアドレスが設定されているデバイスからの受信かつ要求されているアドレスが自分の物(セカンダリを含む)だったら
+	if netdev.ipDev.address != 00000000 && netdev.ipDev.hasAddr(arp.targetIPAddr) {
+		// 自分宛てのリクエストの送信元は、すぐに自分に送ってくるので学習しておく(RFC 826)
+		// IPパケットの送信元からは学習しないので、ここで覚えないと応答を返す前にARPを解決し直すことになる
+		if netdev.ipDev.inSubnet(arp.senderIPAddr) && !netdev.ipDev.hasAddr(arp.senderIPAddr) {
+			addArpTableEntry(netdev, arp.senderIPAddr, arp.senderHardwareAddr)
+		}
 		fmt.Printf("Sending arp reply to %s\n", printIPAddr(arp.targetIPAddr))
 		// APRリプライのパケットを作成
 		arpPacket := arpIPToEthernet{
@@ -162,7 +357,7 @@ func arpRequestArrives(netdev *netDevice, arp arpIPToEthernet) {
 			protocolLen:         IP_ADDRESS_LEN,
 			opcode:              ARP_OPERATION_CODE_REPLY,
 			senderHardwareAddr:  netdev.macAddr,
-			senderIPAddr:        netdev.ipDev.address,
+			senderIPAddr:        arp.targetIPAddr,
 			targetHardwareAddrr: arp.senderHardwareAddr,
 			targetIPAddr:        arp.senderIPAddr,
 		}.ToPacket()
@@ -179,9 +374,26 @@ https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L2
 func arpReplyArrives(netdev *netDevice, arp arpIPToEthernet) {
 	// IPアドレスが設定されているデバイスからの受信だったら
 	if netdev.ipDev.address != 00000000 {
-		fmt.Printf("Added arp table entry by arp reply (%s => %s)\n", printIPAddr(arp.senderIPAddr), printMacAddr(arp.senderHardwareAddr))
+		// リクエストを送っていないアドレスで、インターフェイスのサブネットの外のものは受け取らない
+		_, requested := arpPendingList[arp.senderIPAddr]
+		if !requested && !netdev.ipDev.inSubnet(arp.senderIPAddr) {
+			fmt.Printf("Ignored unsolicited arp reply for %s on %s\n", printIPAddr(arp.senderIPAddr), netdev.name)
+			countDrop(DROP_REASON_ARP_UNSOLICITED)
+			return
+		}
+		// 自分のアドレスを名乗るリプライ
+		if netdev.ipDev.hasAddr(arp.senderIPAddr) {
+			fmt.Printf("Ignored arp reply claiming our address %s from %s on %s (possible arp spoofing)\n",
+				printIPAddr(arp.senderIPAddr), printMacAddr(arp.senderHardwareAddr), netdev.name)
+			countDrop(DROP_REASON_ARP_SPOOFED)
+			return
+		}
 		// ARPテーブルエントリの追加
-		addArpTableEntry(netdev, arp.senderIPAddr, arp.senderHardwareAddr)
+		if !addArpTableEntry(netdev, arp.senderIPAddr, arp.senderHardwareAddr) {
+			countDrop(DROP_REASON_ARP_SPOOFED)
+			return
+		}
+		fmt.Printf("Added arp table entry by arp reply (%s => %s)\n", printIPAddr(arp.senderIPAddr), printMacAddr(arp.senderHardwareAddr))
 	}
 }
 
@@ -207,10 +419,78 @@ func sendArpRequest(netdev *netDevice, targetip uint32) {
 		protocolLen:         IP_ADDRESS_LEN,
 		opcode:              ARP_OPERATION_CODE_REQUEST,
 		senderHardwareAddr:  netdev.macAddr,
-		senderIPAddr:        netdev.ipDev.address,
+		senderIPAddr:        netdev.ipDev.addrFor(targetip),
 		targetHardwareAddrr: ETHERNET_ADDRESS_BROADCAST,
 		targetIPAddr:        targetip,
 	}.ToPacket()
 	// ethernetでカプセル化して送信
 	ethernetOutput(netdev, ETHERNET_ADDRESS_BROADCAST, arpPacket, ETHER_TYPE_ARP)
 }
+
+/*
+Gratuitous ARPの送信
+自分のアドレスを問い合わせるリクエストで、LANのホストのARPテーブルとスイッチのMACアドレステーブルを更新させる
+*/
+func sendGratuitousArp(netdev *netDevice, macaddr [6]uint8, ipaddr uint32) {
+	fmt.Printf("Sending gratuitous arp via %s for %s\n", netdev.name, printIPAddr(ipaddr))
+	arpPacket := arpIPToEthernet{
+		hardwareType:        ARP_HTYPE_ETHERNET,
+		protocolType:        ETHER_TYPE_IP,
+		hardwareLen:         ETHERNET_ADDRES_LEN,
+		protocolLen:         IP_ADDRESS_LEN,
+		opcode:              ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr:  macaddr,
+		senderIPAddr:        ipaddr,
+		targetHardwareAddrr: ETHERNET_ADDRESS_BROADCAST,
+		targetIPAddr:        ipaddr,
+	}.ToPacket()
+	ethernetOutputFrom(netdev, macaddr, ETHERNET_ADDRESS_BROADCAST, arpPacket, ETHER_TYPE_ARP)
+}
+
+/*
+ARPエントリが無かった時のARPリクエストの送信
+同じ宛先へのリクエストは間隔を倍にしながら送り、上限まで応答が無ければネガティブキャッシュする
+到達不能と判断した場合はtrueを返す
+*/
+func arpResolve(netdev *netDevice, targetip uint32) (unreachable bool) {
+	now := time.Now()
+	pending, ok := arpPendingList[targetip]
+	if ok && pending.stale(now) {
+		// 前の解決の状況は引き継がずに最初から送り直す
+		ok = false
+	}
+	if !ok {
+		if n := len(arpPendingList); n != 0 && n%ARP_PENDING_SWEEP_SIZE == 0 {
+			expireArpPending(now)
+		}
+		pending = &arpPendingEntry{interval: ARP_REQUEST_INTERVAL}
+		arpPendingList[targetip] = pending
+	}
+	// ネガティブキャッシュされている間はリクエストを送らない
+	if now.Before(pending.negativeUntil) {
+		return true
+	}
+	// 前回のリクエストから間隔が空いていなければ送らない
+	if now.Sub(pending.lastSent) < pending.interval {
+		return false
+	}
+	if !pending.lastSent.IsZero() {
+		// 前回のリクエストに応答が無かった
+		pending.retry++
+		if ARP_REQUEST_MAX_RETRY <= pending.retry {
+			fmt.Printf("No arp reply from %s, mark as unreachable\n", printIPAddr(targetip))
+			pending.negativeUntil = now.Add(ARP_NEGATIVE_CACHE_TIMEOUT)
+			pending.retry = 0
+			pending.interval = ARP_REQUEST_INTERVAL
+			pending.lastSent = time.Time{}
+			return true
+		}
+		pending.interval *= 2
+		if ARP_REQUEST_MAX_INTERVAL < pending.interval {
+			pending.interval = ARP_REQUEST_MAX_INTERVAL
+		}
+	}
+	pending.lastSent = now
+	sendArpRequest(netdev, targetip)
+	return false
+}
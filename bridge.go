@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ブリッジ(L2スイッチ)
+ブリッジに入れたインターフェイスはIPのルーティングをせずに、学習したMACアドレスに従ってフレームを転送する
+宛先が分からないユニキャストとブロードキャスト、マルチキャストは他の全てのポートにフラッディングする
+*/
+
+// 学習したMACアドレスを保持する時間のデフォルト
+const BRIDGE_FDB_AGING_TIME = 300 * time.Second
+
+// 学習したMACアドレスのエントリ
+type fdbEntry struct {
+	port    *netDevice
+	expires time.Time
+	// ポートセキュリティのstickyで学習したエントリはエージングで消さない
+	sticky bool
+}
+
+func (entry *fdbEntry) valid(now time.Time) bool {
+	return entry.sticky || now.Before(entry.expires)
+}
+
+// ブリッジのポート
+type bridgePort struct {
+	netdev *netDevice
+	stp    stpPort
+	// ポートセキュリティが無効ならnil
+	security         *portSecurityConfig
+	violations       uint64
+	lastViolationLog time.Time
+}
+
+type bridge struct {
+	name  string
+	ports []*bridgePort
+	fdb   map[[6]uint8]*fdbEntry
+	stp   *stpBridge // STPが無効ならnil
+	// 学習したMACアドレスを保持する時間
+	agingTime time.Duration
+}
+
+var bridgeList []*bridge
+
+// "br0=eth1,eth2"の形式のブリッジの設定
+type bridgeConfig struct {
+	name         string
+	ports        []string
+	stp          bool
+	priority     uint16
+	forwardDelay time.Duration
+	// MACアドレスのエージングの時間とポートごとのポートセキュリティ
+	agingTime    time.Duration
+	portSecurity []portSecurityConfig
+}
+
+// コマンドラインで指定されたブリッジ
+var bridgeConfigs []bridgeConfig
+
+func parseBridgeConfig(spec string) (bridgeConfig, error) {
+	name, ports, found := strings.Cut(spec, "=")
+	if !found || name == "" || ports == "" {
+		return bridgeConfig{}, fmt.Errorf("invalid bridge config %q, format is name=port1,port2", spec)
+	}
+	return bridgeConfig{
+		name:         name,
+		ports:        strings.Split(ports, ","),
+		priority:     STP_DEFAULT_BRIDGE_PRIORITY,
+		forwardDelay: STP_DEFAULT_FORWARD_DELAY,
+		agingTime:    BRIDGE_FDB_AGING_TIME,
+	}, nil
+}
+
+// 01:80:c2:00:00:00から0fはブリッジが転送しない
+func isBridgeReservedMacAddr(macaddr [6]uint8) bool {
+	return macaddr[0] == 0x01 && macaddr[1] == 0x80 && macaddr[2] == 0xc2 &&
+		macaddr[3] == 0x00 && macaddr[4] == 0x00 && macaddr[5]&0xf0 == 0x00
+}
+
+func searchBridgeByName(name string) *bridge {
+	for _, br := range bridgeList {
+		if br.name == name {
+			return br
+		}
+	}
+	return nil
+}
+
+func (br *bridge) searchPort(netdev *netDevice) *bridgePort {
+	for _, port := range br.ports {
+		if port.netdev == netdev {
+			return port
+		}
+	}
+	return nil
+}
+
+// STPが無効なら全てのポートがフォワーディング
+func (br *bridge) portState(port *bridgePort) stpPortState {
+	if br.stp == nil {
+		return stpPortForwarding
+	}
+	return port.stp.state
+}
+
+/*
+ブリッジの構成を入れ替える
+ポートから外れたインターフェイスはルーティングするインターフェイスに戻す
+*/
+func setBridges(configs []bridgeConfig) {
+	var bridges []*bridge
+	members := map[*netDevice]*bridge{}
+	for _, config := range configs {
+		br := &bridge{
+			name:      config.name,
+			fdb:       map[[6]uint8]*fdbEntry{},
+			agingTime: config.agingTime,
+		}
+		if br.agingTime == 0 {
+			br.agingTime = BRIDGE_FDB_AGING_TIME
+		}
+		secured := map[string]bool{}
+		// 同じ名前のブリッジがあれば学習したMACアドレスを引き継ぐ
+		old := searchBridgeByName(config.name)
+		if old != nil {
+			br.fdb = old.fdb
+		}
+		for _, name := range config.ports {
+			netdev := searchNetDeviceByName(name)
+			if netdev == nil {
+				fmt.Printf("Port %s of bridge %s is not found\n", name, config.name)
+				continue
+			}
+			if members[netdev] != nil {
+				fmt.Printf("Port %s is already in bridge %s\n", name, members[netdev].name)
+				continue
+			}
+			members[netdev] = br
+			port := &bridgePort{netdev: netdev}
+			for i := range config.portSecurity {
+				if config.portSecurity[i].ifname == name {
+					port.security = &config.portSecurity[i]
+					secured[name] = true
+				}
+			}
+			// 違反の回数は設定を読み直しても引き継ぐ
+			if old != nil {
+				if oldPort := old.searchPort(netdev); oldPort != nil {
+					port.violations = oldPort.violations
+				}
+			}
+			br.ports = append(br.ports, port)
+		}
+		for _, security := range config.portSecurity {
+			if !secured[security.ifname] {
+				fmt.Printf("Port security interface %s is not a port of bridge %s\n", security.ifname, config.name)
+			}
+		}
+		if config.stp {
+			stpInitBridge(br, old, config.priority, config.forwardDelay)
+		}
+		bridges = append(bridges, br)
+	}
+
+	for _, netdev := range netDeviceList {
+		br := members[netdev]
+		if netdev.bridge == br {
+			continue
+		}
+		if netdev.bridge != nil {
+			bridgeRemovePort(netdev)
+		}
+		if br != nil {
+			bridgeAddPort(br, netdev)
+		}
+	}
+	bridgeList = bridges
+	for _, br := range bridgeList {
+		for mac, entry := range br.fdb {
+			if entry.port.bridge != br {
+				delete(br.fdb, mac)
+				continue
+			}
+			// stickyでなくなったポートのエントリはエージングで消えるようにする
+			if security := br.searchPort(entry.port).security; entry.sticky && (security == nil || !security.sticky) {
+				entry.sticky = false
+				entry.expires = time.Now().Add(br.agingTime)
+			}
+		}
+	}
+}
+
+// 学習したMACアドレスを全て消す、ポートセキュリティのstickyで学習したものは残す
+func bridgeFlushFdb(br *bridge) {
+	for mac, entry := range br.fdb {
+		if !entry.sticky {
+			delete(br.fdb, mac)
+		}
+	}
+}
+
+// インターフェイスをブリッジのポートにする
+func bridgeAddPort(br *bridge, netdev *netDevice) {
+	// ポートではIPのルーティングをしない
+	deleteConnectedRoute(netdev)
+	flushArpTableEntry(netdev)
+	netdev.bridge = br
+	// 自分宛て以外のフレームも受け取る
+	updateMacFilter(netdev)
+	netdev.updateSocketFilter()
+	fmt.Printf("Added %s to bridge %s\n", netdev.name, br.name)
+}
+
+// インターフェイスをブリッジから外してルーティングするインターフェイスに戻す
+func bridgeRemovePort(netdev *netDevice) {
+	br := netdev.bridge
+	netdev.bridge = nil
+	for mac, entry := range br.fdb {
+		if entry.port == netdev {
+			delete(br.fdb, mac)
+		}
+	}
+	addConnectedRoute(netdev)
+	updateMacFilter(netdev)
+	netdev.updateSocketFilter()
+	fmt.Printf("Removed %s from bridge %s\n", netdev.name, br.name)
+}
+
+// インターフェイスが削除された時にブリッジのポートからも消す
+func bridgeDeletePort(netdev *netDevice) {
+	br := netdev.bridge
+	if br == nil {
+		return
+	}
+	for i, port := range br.ports {
+		if port.netdev == netdev {
+			br.ports = append(br.ports[:i], br.ports[i+1:]...)
+			break
+		}
+	}
+	for mac, entry := range br.fdb {
+		if entry.port == netdev {
+			delete(br.fdb, mac)
+		}
+	}
+	netdev.bridge = nil
+	// ルートポートが無くなったかもしれないので選び直す
+	if br.stp != nil {
+		stpRecompute(br, time.Now())
+	}
+}
+
+/*
+ブリッジのポートで受信したフレームの処理
+*/
+func bridgeInput(inputdev *netDevice, frame []byte) {
+	br := inputdev.bridge
+	destAddr := setMacAddr(frame[0:6])
+	srcAddr := setMacAddr(frame[6:12])
+	now := time.Now()
+
+	// ポートセキュリティで止めたポートで既に受信していたフレームは捨てる
+	if !inputdev.isUp() {
+		countDrop(DROP_REASON_INTERFACE_DOWN)
+		return
+	}
+	// ブロッキングとリスニングのポートではBPDU以外を受け取らない
+	port := br.searchPort(inputdev)
+	state := br.portState(port)
+	if state != stpPortLearning && state != stpPortForwarding {
+		countDrop(DROP_REASON_STP_BLOCKED)
+		return
+	}
+
+	// 送信元のMACアドレスを学習する、ポートセキュリティに違反したら転送しない
+	if srcAddr[0]&0x01 == 0 && !bridgeLearn(br, port, srcAddr, now) {
+		return
+	}
+	// ラーニングのポートは学習だけして転送しない
+	if state != stpPortForwarding {
+		return
+	}
+	// 受信のバッファは使い回すので、送信キューに入れる前にコピーする
+	frame = append([]byte(nil), frame...)
+
+	// 宛先を学習していればそのポートにだけ転送する
+	if destAddr[0]&0x01 == 0 {
+		if entry, ok := br.fdb[destAddr]; ok && entry.valid(now) {
+			if entry.port != inputdev && br.portState(br.searchPort(entry.port)) == stpPortForwarding {
+				entry.port.netDeviceTransmit(frame)
+			}
+			return
+		}
+	}
+	// 宛先が分からなければ受信したポート以外にフラッディングする
+	for _, port := range br.ports {
+		if port.netdev != inputdev && br.portState(port) == stpPortForwarding {
+			port.netdev.netDeviceTransmit(frame)
+		}
+	}
+}
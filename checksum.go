@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+受信したパケットのチェックサムの検証とチェックサムオフロード
+vethやvirtioでは送信側のカーネルがTCP/UDPのチェックサムの計算をNICに任せたまま(CHECKSUM_PARTIAL)フレームを渡すので、
+AF_PACKETで受け取ると疑似ヘッダの分しか計算されていないチェックサムが入っている
+-checksum-policyや設定ファイルの"checksum_policy"で、インターフェイスごとにTCP/UDPのチェックサムを検証するか決める
+  auto    ethtoolで受信のチェックサムオフロードが有効なインターフェイスでは検証しない(デフォルト)
+  verify  常に検証する
+  skip    検証しない
+IPヘッダやICMPのチェックサムはオフロードされないので常に検証する
+フォワードするパケットは、計算途中のチェックサムで届いたものだけポリシーによらず計算し直してから送る
+  AF_PACKET  PACKET_AUXDATAのtp_statusにTP_STATUS_CSUMNOTREADYが立っているフレーム
+  AF_XDP     チェックサムの状態が分からないので、受信のチェックサムオフロードが有効でskipでないインターフェイスの全てのフレーム
+  tap        カーネルが計算し終えてから渡すので計算し直さない
+それ以外はチェックサムが間違っていてもそのまま送るので、skipのインターフェイスで受けた壊れたパケットは宛先のホストで捨てられる
+ルータが作るパケットのチェックサムは全て自分で計算するので、カーネルの送信のオフロードの設定には影響されない
+*/
+
+type checksumPolicy uint8
+
+const (
+	checksumAuto checksumPolicy = iota
+	checksumVerify
+	checksumSkip
+)
+
+// コマンドラインで指定されたインターフェイスごとのポリシー
+var checksumPolicyFlags = map[string]checksumPolicy{}
+
+func parseChecksumPolicy(s string) (checksumPolicy, error) {
+	switch s {
+	case "", "auto":
+		return checksumAuto, nil
+	case "verify":
+		return checksumVerify, nil
+	case "skip":
+		return checksumSkip, nil
+	}
+	return checksumAuto, fmt.Errorf("unknown checksum policy %s", s)
+}
+
+func (policy checksumPolicy) String() string {
+	switch policy {
+	case checksumVerify:
+		return "verify"
+	case checksumSkip:
+		return "skip"
+	}
+	return "auto"
+}
+
+// "eth1=verify"を読む
+func parseChecksumPolicyConfig(s string) (string, checksumPolicy, error) {
+	name, policy, found := strings.Cut(s, "=")
+	if !found || name == "" {
+		return "", checksumAuto, fmt.Errorf("invalid checksum policy %q, format is ifname=auto, ifname=verify or ifname=skip", s)
+	}
+	p, err := parseChecksumPolicy(policy)
+	if err != nil {
+		return "", checksumAuto, err
+	}
+	return name, p, nil
+}
+
+// 受信したTCP/UDPのチェックサムを検証するか
+func (netdev *netDevice) verifyTransportChecksum() bool {
+	switch netdev.checksumPolicy {
+	case checksumVerify:
+		return true
+	case checksumSkip:
+		return false
+	}
+	return !netdev.rxChecksumOffload
+}
+
+/*
+フォワードするパケットのTCP/UDPのチェックサムを計算し直す
+分割されたパケットはヘッダが最初の断片にしかないので、そのまま送る
+*/
+func fixTransportChecksum(ipPacket []byte) {
+	if byteToUint16(ipPacket[6:8])&0x3fff != 0 {
+		return
+	}
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	switch ipPacket[9] {
+	case IP_PROTOCOL_NUM_UDP:
+		// UDPのチェックサムが0の場合は計算されていないのでそのままにする
+		if len(ipPacket) >= headerLen+UDP_HEADER_LEN && byteToUint16(ipPacket[headerLen+6:headerLen+8]) != 0 {
+			setTransportChecksum(ipPacket, 6)
+		}
+	case IP_PROTOCOL_NUM_TCP:
+		setTransportChecksum(ipPacket, 16)
+	}
+}
+
+// ethtoolのioctl
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/ethtool.h
+const (
+	SIOCETHTOOL     = 0x8946
+	ETHTOOL_GRXCSUM = 0x00000014
+	ETHTOOL_GTXCSUM = 0x00000016
+)
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte
+}
+
+// ethtoolで受信と送信のチェックサムオフロードが有効か調べる
+func ethtoolChecksumOffload(name string) (rx bool, tx bool, err error) {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return false, false, fmt.Errorf("create socket err : %s", err)
+	}
+	defer syscall.Close(sock)
+
+	get := func(cmd uint32) (bool, error) {
+		value := ethtoolValue{cmd: cmd}
+		var ifr ifreqData
+		copy(ifr.name[:], name)
+		ifr.data = unsafe.Pointer(&value)
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+		if errno != 0 {
+			return false, fmt.Errorf("ioctl SIOCETHTOOL to %s err : %s", name, errno)
+		}
+		return value.data != 0, nil
+	}
+	if rx, err = get(ETHTOOL_GRXCSUM); err != nil {
+		return false, false, err
+	}
+	if tx, err = get(ETHTOOL_GTXCSUM); err != nil {
+		return false, false, err
+	}
+	return rx, tx, nil
+}
+
+// インターフェイスのチェックサムオフロードを調べる、調べられないデバイスは無効として扱う
+func detectChecksumOffload(netdev *netDevice) {
+	if netdev.backend == loopbackDevice {
+		return
+	}
+	rx, tx, err := ethtoolChecksumOffload(netdev.name)
+	if err != nil {
+		debugPrintf("%s\n", err)
+		return
+	}
+	netdev.rxChecksumOffload = rx
+	netdev.txChecksumOffload = tx
+	debugPrintf("Checksum offload of %s is rx %t, tx %t\n", netdev.name, rx, tx)
+}
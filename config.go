@@ -0,0 +1,1237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+ルータの設定ファイル(JSON)
+{
+  "backend": "tun",
+  "interfaces": [
+    {"name": "tap0", "address": "192.168.1.1/24", "secondary_addresses": ["192.168.3.1/24"], "multicast_groups": ["224.0.0.9"]},
+    {"name": "tap1", "address": "192.168.0.1/24", "icmp_redirect": false, "shaping": "1000/15000", "policing": "2000",
+     "qos_scheduler": "wrr", "promisc": true, "mac_allow": ["02:00:00:00:00:10"]},
+    {"name": "tap4", "address": "192.168.5.1/24", "shutdown": true, "urpf": "strict", "icmp_timestamp": true, "icmp_mask_reply": true,
+     "checksum_policy": "verify", "impairment": {"delay_ms": 50, "jitter_ms": 10, "loss": 1, "reorder": 5}}
+  ],
+  "static_routes": [
+    {"prefix": "192.168.2.0/24", "nexthop": "192.168.0.2"},
+    {"prefix": "192.168.2.0/24", "nexthop": "192.168.1.2", "distance": 200, "metric": 10},
+    {"prefix": "198.51.100.0/24", "type": "blackhole"},
+    {"prefix": "203.0.113.0/24", "type": "reject"}
+  ],
+  "default_gateway": "192.168.0.254",
+  "loopback": ["10.255.0.1/32"],
+  "router_id": "10.255.0.1",
+  "static_arp": [
+    {"interface": "tap0", "address": "192.168.1.2", "mac": "02:00:00:00:00:01"}
+  ],
+  "acls": [
+    {"interface": "tap0", "rules": [
+      {"action": "deny", "protocol": "icmp", "dst": "192.168.0.0/24"},
+      {"action": "permit"}
+    ]}
+  ],
+  "dscp_policies": [
+    {"interface": "tap0", "rules": [
+      {"protocol": "udp", "dst_port": 5004, "dscp": "ef"},
+      {"src": "192.168.1.0/24", "protocol": "tcp", "dscp": "cs1"}
+    ]}
+  ],
+  "nat": {"outside": "tap1", "inside": ["tap0"], "port_forwards": [
+    {"protocol": "tcp", "port": 8080, "to": "192.168.1.2:80"}
+  ]},
+  "bridges": [
+    {"name": "br0", "interfaces": ["tap2", "tap3"], "stp": true, "priority": 4096, "forward_delay": 15, "aging_time": 300,
+     "port_security": [{"interface": "tap2", "max_macs": 2, "sticky": true, "violation": "restrict"}]}
+  ],
+  "dns": {"upstreams": ["8.8.8.8"], "hosts": {"router.lan": "192.168.1.1"}},
+  "ntp": {"servers": ["192.168.0.2"], "serve": true},
+  "snmp": {"community": "public"},
+  "sflow": {"collector": "192.168.0.2:6343", "sampling_rate": 1000, "header_size": 128},
+  "vrrp": [
+    {"interface": "tap0", "vrid": 1, "address": "192.168.1.254", "priority": 200, "advert_interval": 1}
+  ],
+  "router_advertisements": [
+    {"interface": "tap0", "prefixes": ["2001:db8:1::/64"], "mtu": 1500, "interval": 200}
+  ],
+  "pppoe": {"interface": "tap1", "username": "user", "password": "secret"},
+  "dhcpv6_pd": {"interface": "tap1", "lan_interfaces": ["tap0"], "prefix_hint": 56},
+  "igmp_proxy": {"upstream": "tap1", "downstream": ["tap0"]},
+  "flow_table_size": 4096,
+  "ipsec": [
+    {"peer": "192.168.0.2", "spi_out": 4097, "key_out": "<40桁の16進数>", "spi_in": 8193, "key_in": "<40桁の16進数>",
+     "routes": ["192.168.2.0/24"]}
+  ],
+  "logging": {"debug": false, "syslog": {"server": "udp://192.168.0.2:514", "facility": "local0", "rate": 100}}
+}
+default_gatewayはstatic_routesにprefixを"default"(0.0.0.0/0)として書くのと同じ
+static_routesのdistanceを大きくした経路は、同じプレフィックスの他の経路が無い時だけ使われる
+static_routesのtypeがblackholeの経路は宛先のパケットを黙って捨て、rejectの経路は捨ててICMP Host Unreachableを返す、
+どちらもnexthopは書かない
+dscp_policiesのdscpは"ef"、"af41"、"cs1"などの名前か0から63の数字、src_portとdst_portはprotocolがtcpかudpの時だけ書ける
+SIGHUPを受け取ると読み直して、変更された部分だけを反映する
+*/
+
+type routerConfigFile struct {
+	Backend        string                `json:"backend"`
+	Interfaces     []interfaceConfig     `json:"interfaces"`
+	StaticRoutes   []staticRouteConfig   `json:"static_routes"`
+	DefaultGateway string                `json:"default_gateway"`
+	StaticARP      []staticArpConfigFile `json:"static_arp"`
+	Loopback       []string              `json:"loopback"`
+	RouterID       string                `json:"router_id"`
+	ACLs           []aclConfig           `json:"acls"`
+	NAT            natConfigFile         `json:"nat"`
+	Bridges        []bridgeConfigFile    `json:"bridges"`
+	DNS            dnsConfigFile         `json:"dns"`
+	NTP            ntpConfigFile         `json:"ntp"`
+	VRRP           []vrrpConfigFile      `json:"vrrp"`
+	PPPoE          pppoeConfigFile       `json:"pppoe"`
+	IPsec          []ipsecConfigFile     `json:"ipsec"`
+	SNMP           snmpConfigFile        `json:"snmp"`
+	SFlow          sflowConfigFile       `json:"sflow"`
+	Logging        loggingConfig         `json:"logging"`
+	// 受信したパケットのDSCPを書き換えるポリシー
+	DscpPolicies []dscpPolicyConfig `json:"dscp_policies"`
+	// IPv6のルータ広告
+	RouterAdvertisements []raConfigFile `json:"router_advertisements"`
+	// DHCPv6でプレフィックスの委譲を受けるWAN側のインターフェイス
+	DHCPv6PD dhcpv6PdConfigFile `json:"dhcpv6_pd"`
+	// 上流と下流のインターフェイスを決めて動かすIGMPプロキシ
+	IGMPProxy igmpProxyConfigFile `json:"igmp_proxy"`
+	// フローごとに通信量を数える表の大きさ、0なら数えない
+	FlowTableSize *int `json:"flow_table_size"`
+}
+
+// tunバックエンドでは作成するtapデバイス、packetバックエンドではアドレスを上書きするNIC
+type interfaceConfig struct {
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	ICMPRedirect *bool  `json:"icmp_redirect"`
+	// addressに加えてつけるセカンダリのアドレス
+	SecondaryAddresses []string `json:"secondary_addresses"`
+	// ルータが参加するマルチキャストグループ
+	MulticastGroups []string `json:"multicast_groups"`
+	// "kbps/バースト(バイト)"の形式の送信と受信のレート
+	Shaping  string `json:"shaping"`
+	Policing string `json:"policing"`
+	// シェーピングの優先度ごとの送信キューのスケジューラ、strictかwrr
+	QosScheduler string `json:"qos_scheduler"`
+	// プロミスキャスモードにするか、追加で受け取るユニキャストのMACアドレス
+	Promisc  *bool    `json:"promisc"`
+	MacAllow []string `json:"mac_allow"`
+	// 管理上止めておくか
+	Shutdown *bool `json:"shutdown"`
+	// 送信元アドレスを検証するuRPFのモード、strictかlooseかoff
+	Urpf string `json:"urpf"`
+	// ICMPのTimestamp RequestとAddress Mask Requestに答えるか
+	ICMPTimestamp *bool `json:"icmp_timestamp"`
+	ICMPMaskReply *bool `json:"icmp_mask_reply"`
+	// 64:ff9b::/96宛てのIPv6のパケットをNAT64で変換するか
+	NAT64 *bool `json:"nat64"`
+	// 受信したTCP/UDPのチェックサムを検証するか、autoかverifyかskip
+	ChecksumPolicy string `json:"checksum_policy"`
+	// 送信の遅延と損失のエミュレーション
+	Impairment *impairmentConfigFile `json:"impairment"`
+}
+
+// 遅延と揺らぎはミリ秒、損失と順番の入れ替えは%
+type impairmentConfigFile struct {
+	DelayMs  int     `json:"delay_ms"`
+	JitterMs int     `json:"jitter_ms"`
+	Loss     float64 `json:"loss"`
+	Reorder  float64 `json:"reorder"`
+}
+
+type staticRouteConfig struct {
+	Prefix   string `json:"prefix"`
+	Type     string `json:"type"`
+	Nexthop  string `json:"nexthop"`
+	Distance int    `json:"distance"`
+	Metric   uint32 `json:"metric"`
+}
+
+type aclConfig struct {
+	Interface string          `json:"interface"`
+	Rules     []aclRuleConfig `json:"rules"`
+}
+
+type aclRuleConfig struct {
+	Action   string `json:"action"`
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Protocol string `json:"protocol"`
+}
+
+type dscpPolicyConfig struct {
+	Interface string           `json:"interface"`
+	Rules     []dscpRuleConfig `json:"rules"`
+}
+
+type dscpRuleConfig struct {
+	Src      string `json:"src"`
+	Dst      string `json:"dst"`
+	Protocol string `json:"protocol"`
+	SrcPort  uint16 `json:"src_port"`
+	DstPort  uint16 `json:"dst_port"`
+	Dscp     string `json:"dscp"`
+}
+
+type natConfigFile struct {
+	Outside string   `json:"outside"`
+	Inside  []string `json:"inside"`
+	// 外側のポートを内側のホストに転送する
+	PortForwards []natPortForwardConfigFile `json:"port_forwards"`
+}
+
+type natPortForwardConfigFile struct {
+	Protocol string `json:"protocol"`
+	Port     uint16 `json:"port"`
+	To       string `json:"to"`
+}
+
+type bridgeConfigFile struct {
+	Name         string   `json:"name"`
+	Interfaces   []string `json:"interfaces"`
+	STP          bool     `json:"stp"`
+	Priority     *int     `json:"priority"`
+	ForwardDelay int      `json:"forward_delay"` // 秒
+	// 学習したMACアドレスを保持する秒数とポートセキュリティ
+	AgingTime    int                      `json:"aging_time"`
+	PortSecurity []portSecurityConfigFile `json:"port_security"`
+}
+
+type portSecurityConfigFile struct {
+	Interface string `json:"interface"`
+	MaxMacs   int    `json:"max_macs"` // 省略すると1
+	Sticky    bool   `json:"sticky"`
+	Violation string `json:"violation"` // protect, restrict, shutdown
+}
+
+// 上位のDNSサーバと、ルータが答えるホストの表
+type dnsConfigFile struct {
+	Upstreams []string          `json:"upstreams"`
+	Hosts     map[string]string `json:"hosts"`
+	// AAAAレコードの無い名前にNAT64のアドレスを合成して答えるか
+	DNS64 *bool `json:"dns64"`
+}
+
+// 時刻を合わせる上位のNTPサーバと、ルータがNTPサーバとして答えるか
+type ntpConfigFile struct {
+	Servers []string `json:"servers"`
+	Serve   bool     `json:"serve"`
+}
+
+// sFlowのコレクタとサンプリングの割合、collectorが空ならコマンドラインの指定を使う
+type sflowConfigFile struct {
+	Collector    string `json:"collector"`
+	SamplingRate int    `json:"sampling_rate"` // 省略すると1000
+	HeaderSize   int    `json:"header_size"`   // 省略すると128
+}
+
+// SNMPのエージェントが受け付けるコミュニティ名、空ならエージェントを動かさない
+type snmpConfigFile struct {
+	Community string `json:"community"`
+}
+
+// 学習で上書きされないARPエントリ
+type staticArpConfigFile struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	MAC       string `json:"mac"`
+}
+
+// VRRPの仮想ルータ、優先度と間隔(秒)は省略すると100と1
+type vrrpConfigFile struct {
+	Interface      string `json:"interface"`
+	VRID           int    `json:"vrid"`
+	Address        string `json:"address"`
+	Priority       int    `json:"priority"`
+	AdvertInterval int    `json:"advert_interval"`
+}
+
+// IPv6のルータ広告、間隔と有効期間(秒)は省略するとRFC 4861の既定値
+type raConfigFile struct {
+	Interface         string   `json:"interface"`
+	Prefixes          []string `json:"prefixes"`
+	MTU               uint32   `json:"mtu"`
+	Interval          int      `json:"interval"`
+	RouterLifetime    int      `json:"router_lifetime"`
+	ValidLifetime     int      `json:"valid_lifetime"`
+	PreferredLifetime int      `json:"preferred_lifetime"`
+}
+
+// upstreamが空ならコマンドラインの指定を使う
+type igmpProxyConfigFile struct {
+	Upstream   string   `json:"upstream"`
+	Downstream []string `json:"downstream"`
+}
+
+// 委譲されたプレフィックスはlan_interfacesの順に/64ずつ割り当てる、prefix_hintは0なら指定しない
+type dhcpv6PdConfigFile struct {
+	Interface     string   `json:"interface"`
+	LanInterfaces []string `json:"lan_interfaces"`
+	PrefixHint    int      `json:"prefix_hint"`
+}
+
+// PPPoEでアドレスを受け取るWAN側のインターフェイス、ユーザ名が空ならPAPの認証をしない
+type pppoeConfigFile struct {
+	Interface string `json:"interface"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// IPsecのトンネル、鍵はAESの鍵に4バイトのソルトをつけた16進数
+type ipsecConfigFile struct {
+	Peer   string   `json:"peer"`
+	SPIOut uint32   `json:"spi_out"`
+	KeyOut string   `json:"key_out"`
+	SPIIn  uint32   `json:"spi_in"`
+	KeyIn  string   `json:"key_in"`
+	Routes []string `json:"routes"`
+}
+
+type loggingConfig struct {
+	Debug  bool             `json:"debug"`
+	Syslog syslogConfigFile `json:"syslog"`
+}
+
+// ログを送るsyslogのサーバ、書かなかった項目はコマンドラインの指定を使う
+type syslogConfigFile struct {
+	Server   string `json:"server"`
+	Facility string `json:"facility"`
+	Rate     int    `json:"rate"`
+}
+
+// 読み込んで検証した設定
+type routerConfig struct {
+	backend         string
+	interfaces      map[string]ipDevice
+	icmpRedirect    map[string]bool // 指定されたインターフェイスだけ
+	multicastGroups map[string][]netip.Addr
+	shapingRates    map[string]qosRate
+	policingRates   map[string]qosRate
+	qosSchedulers   map[string]qosScheduler
+	staticRoutes    map[netip.Prefix][]staticRoute
+	staticArp       []staticArpEntry
+	loopback        []netip.Addr
+	routerID        netip.Addr
+	acls            map[string][]aclRule
+	natOutside      string
+	natInside       []string
+	natPortForwards []natPortForward
+	bridges         []bridgeConfig
+	dnsUpstreams    []netip.Addr
+	dnsHosts        map[string]uint32
+	ntpServers      []netip.Addr
+	ntpServe        bool
+	vrrp            []vrrpConfig
+	pppoe           pppoeConfigFile
+	ipsec           []espTunnelConfig
+	snmpCommunity   string
+	sflow           *sflowConfig
+	debug           bool
+	syslog          syslogConfigFile
+	promisc         map[string]bool // 指定されたインターフェイスだけ
+	macAllow        map[string][][6]uint8
+	shutdown        map[string]bool     // 指定されたインターフェイスだけ
+	urpf            map[string]urpfMode // 指定されたインターフェイスだけ
+	dscpPolicies    map[string][]dscpRule
+	icmpTimestamp   map[string]bool // 指定されたインターフェイスだけ
+	icmpMaskReply   map[string]bool // 指定されたインターフェイスだけ
+	ra              []raConfig
+	dhcpv6Pd        dhcpv6PdConfigFile
+	nat64           map[string]bool // 指定されたインターフェイスだけ
+	dns64           *bool
+	checksumPolicy  map[string]checksumPolicy // 指定されたインターフェイスだけ
+	impairments     map[string]impairment
+	igmpProxy       *igmpProxyConfig
+	flowTableSize   *int
+}
+
+type staticRoute struct {
+	iptype   ipRouteType
+	nexthop  netip.Addr // blackholeとrejectの経路では無効なアドレス
+	distance uint8
+	metric   uint32
+}
+
+func (route staticRoute) String() string {
+	if route.iptype != network {
+		return route.iptype.String()
+	}
+	return "via " + route.nexthop.String()
+}
+
+// 設定ファイルのパスと反映済みの設定
+var configPath string
+var currentConfig *routerConfig
+
+/*
+設定ファイルを読み込んで検証する
+反映の途中で失敗しないように、ここで全ての値を変換しておく
+*/
+func loadRouterConfig(path string) (*routerConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config err : %s", err)
+	}
+	var file routerConfigFile
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s err : %s", path, err)
+	}
+
+	config := &routerConfig{
+		backend:         file.Backend,
+		interfaces:      map[string]ipDevice{},
+		icmpRedirect:    map[string]bool{},
+		multicastGroups: map[string][]netip.Addr{},
+		shapingRates:    map[string]qosRate{},
+		policingRates:   map[string]qosRate{},
+		qosSchedulers:   map[string]qosScheduler{},
+		staticRoutes:    map[netip.Prefix][]staticRoute{},
+		acls:            map[string][]aclRule{},
+		natOutside:      file.NAT.Outside,
+		natInside:       file.NAT.Inside,
+		dnsHosts:        map[string]uint32{},
+		ntpServe:        file.NTP.Serve,
+		pppoe:           file.PPPoE,
+		snmpCommunity:   file.SNMP.Community,
+		debug:           file.Logging.Debug,
+		syslog:          file.Logging.Syslog,
+		promisc:         map[string]bool{},
+		macAllow:        map[string][][6]uint8{},
+		shutdown:        map[string]bool{},
+		urpf:            map[string]urpfMode{},
+		dscpPolicies:    map[string][]dscpRule{},
+		icmpTimestamp:   map[string]bool{},
+		icmpMaskReply:   map[string]bool{},
+		nat64:           map[string]bool{},
+		checksumPolicy:  map[string]checksumPolicy{},
+		impairments:     map[string]impairment{},
+	}
+	switch config.backend {
+	case "", "packet", "xdp", "tun":
+	default:
+		return nil, fmt.Errorf("unknown backend %s", config.backend)
+	}
+
+	for _, netif := range file.Interfaces {
+		if netif.Name == "" {
+			return nil, fmt.Errorf("interface name is empty")
+		}
+		var ipdev ipDevice
+		if netif.Address != "" {
+			ipdev, err = parseIPDevice(strings.Join(append([]string{netif.Address}, netif.SecondaryAddresses...), "+"))
+			if err != nil {
+				return nil, err
+			}
+		} else if len(netif.SecondaryAddresses) != 0 {
+			return nil, fmt.Errorf("secondary addresses of %s are given without address", netif.Name)
+		}
+		config.interfaces[netif.Name] = ipdev
+		if netif.ICMPRedirect != nil {
+			config.icmpRedirect[netif.Name] = *netif.ICMPRedirect
+		}
+		if netif.ICMPTimestamp != nil {
+			config.icmpTimestamp[netif.Name] = *netif.ICMPTimestamp
+		}
+		if netif.ICMPMaskReply != nil {
+			config.icmpMaskReply[netif.Name] = *netif.ICMPMaskReply
+		}
+		if netif.NAT64 != nil {
+			config.nat64[netif.Name] = *netif.NAT64
+		}
+		for _, group := range netif.MulticastGroups {
+			addr, err := parseIPv4Addr(group)
+			if err != nil {
+				return nil, err
+			}
+			if !addr.IsMulticast() {
+				return nil, fmt.Errorf("%s is not multicast address", group)
+			}
+			config.multicastGroups[netif.Name] = append(config.multicastGroups[netif.Name], addr)
+		}
+		if netif.Shaping != "" {
+			rate, err := parseQosRate(netif.Shaping)
+			if err != nil {
+				return nil, fmt.Errorf("shaping of %s : %s", netif.Name, err)
+			}
+			config.shapingRates[netif.Name] = rate
+		}
+		if netif.Policing != "" {
+			rate, err := parseQosRate(netif.Policing)
+			if err != nil {
+				return nil, fmt.Errorf("policing of %s : %s", netif.Name, err)
+			}
+			config.policingRates[netif.Name] = rate
+		}
+		if netif.QosScheduler != "" {
+			scheduler, err := parseQosScheduler(netif.QosScheduler)
+			if err != nil {
+				return nil, fmt.Errorf("qos scheduler of %s : %s", netif.Name, err)
+			}
+			config.qosSchedulers[netif.Name] = scheduler
+		}
+		if netif.Promisc != nil {
+			config.promisc[netif.Name] = *netif.Promisc
+		}
+		if netif.MacAllow != nil {
+			macs, err := parseMacAllowList(netif.MacAllow)
+			if err != nil {
+				return nil, fmt.Errorf("mac allow list of %s : %s", netif.Name, err)
+			}
+			config.macAllow[netif.Name] = macs
+		}
+		if netif.Shutdown != nil {
+			config.shutdown[netif.Name] = *netif.Shutdown
+		}
+		if netif.Urpf != "" {
+			mode, err := parseUrpfMode(netif.Urpf)
+			if err != nil {
+				return nil, fmt.Errorf("urpf of %s : %s", netif.Name, err)
+			}
+			config.urpf[netif.Name] = mode
+		}
+		if netif.ChecksumPolicy != "" {
+			policy, err := parseChecksumPolicy(netif.ChecksumPolicy)
+			if err != nil {
+				return nil, fmt.Errorf("checksum policy of %s : %s", netif.Name, err)
+			}
+			config.checksumPolicy[netif.Name] = policy
+		}
+		if netif.Impairment != nil {
+			imp := impairment{
+				delay:   time.Duration(netif.Impairment.DelayMs) * time.Millisecond,
+				jitter:  time.Duration(netif.Impairment.JitterMs) * time.Millisecond,
+				loss:    netif.Impairment.Loss,
+				reorder: netif.Impairment.Reorder,
+			}
+			if err := imp.validate(); err != nil {
+				return nil, fmt.Errorf("impairment of %s : %s", netif.Name, err)
+			}
+			config.impairments[netif.Name] = imp
+		}
+	}
+
+	for _, route := range file.StaticRoutes {
+		prefix, err := parseIPv4Prefix(route.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		iptype, err := parseStaticRouteType(route.Type)
+		if err != nil {
+			return nil, fmt.Errorf("static route %s : %s", prefix, err)
+		}
+		var nexthop netip.Addr
+		if iptype == network {
+			nexthop, err = parseIPv4Addr(route.Nexthop)
+			if err != nil {
+				return nil, err
+			}
+		} else if route.Nexthop != "" {
+			return nil, fmt.Errorf("%s route %s can not have nexthop", iptype, prefix)
+		}
+		if route.Distance < 0 || route.Distance > ROUTE_DISTANCE_UNREACHABLE {
+			return nil, fmt.Errorf("invalid distance %d of static route %s", route.Distance, prefix)
+		}
+		for _, r := range config.staticRoutes[prefix] {
+			if r.nexthop == nexthop {
+				return nil, fmt.Errorf("static route %s %s is duplicated", prefix, r)
+			}
+		}
+		config.staticRoutes[prefix] = append(config.staticRoutes[prefix], staticRoute{
+			iptype:   iptype,
+			nexthop:  nexthop,
+			distance: uint8(route.Distance),
+			metric:   route.Metric,
+		})
+	}
+	if file.DefaultGateway != "" {
+		nexthop, err := parseIPv4Addr(file.DefaultGateway)
+		if err != nil {
+			return nil, err
+		}
+		defaultRoute := netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+		if _, ok := config.staticRoutes[defaultRoute]; ok {
+			return nil, fmt.Errorf("default route is set in both static_routes and default_gateway")
+		}
+		config.staticRoutes[defaultRoute] = []staticRoute{{iptype: network, nexthop: nexthop}}
+	}
+
+	for _, acl := range file.ACLs {
+		var rules []aclRule
+		for _, r := range acl.Rules {
+			rule, err := parseACLRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("acl of %s : %s", acl.Interface, err)
+			}
+			rules = append(rules, rule)
+		}
+		config.acls[acl.Interface] = rules
+	}
+
+	for _, policy := range file.DscpPolicies {
+		var rules []dscpRule
+		for _, r := range policy.Rules {
+			rule, err := parseDscpRule(r)
+			if err != nil {
+				return nil, fmt.Errorf("dscp policy of %s : %s", policy.Interface, err)
+			}
+			rules = append(rules, rule)
+		}
+		config.dscpPolicies[policy.Interface] = rules
+	}
+
+	for _, br := range file.Bridges {
+		if br.Name == "" {
+			return nil, fmt.Errorf("bridge name is empty")
+		}
+		bridge := bridgeConfig{
+			name:         br.Name,
+			ports:        br.Interfaces,
+			stp:          br.STP,
+			priority:     STP_DEFAULT_BRIDGE_PRIORITY,
+			forwardDelay: STP_DEFAULT_FORWARD_DELAY,
+		}
+		if br.Priority != nil {
+			if *br.Priority < 0 || *br.Priority > 0xffff {
+				return nil, fmt.Errorf("invalid stp priority %d of bridge %s", *br.Priority, br.Name)
+			}
+			bridge.priority = uint16(*br.Priority)
+		}
+		if br.ForwardDelay != 0 {
+			if br.ForwardDelay < 4 {
+				return nil, fmt.Errorf("stp forward delay of bridge %s must be at least 4", br.Name)
+			}
+			bridge.forwardDelay = time.Duration(br.ForwardDelay) * time.Second
+		}
+		bridge.agingTime = BRIDGE_FDB_AGING_TIME
+		if br.AgingTime != 0 {
+			if br.AgingTime < 1 {
+				return nil, fmt.Errorf("aging time of bridge %s must be at least 1", br.Name)
+			}
+			bridge.agingTime = time.Duration(br.AgingTime) * time.Second
+		}
+		for _, security := range br.PortSecurity {
+			if security.Interface == "" {
+				return nil, fmt.Errorf("port security interface of bridge %s is empty", br.Name)
+			}
+			if security.MaxMacs == 0 {
+				security.MaxMacs = 1
+			}
+			if security.MaxMacs < 1 {
+				return nil, fmt.Errorf("max macs of port security on %s must be at least 1", security.Interface)
+			}
+			violation, err := parsePortSecurityViolation(security.Violation)
+			if err != nil {
+				return nil, err
+			}
+			bridge.portSecurity = append(bridge.portSecurity, portSecurityConfig{
+				ifname:    security.Interface,
+				maxMacs:   security.MaxMacs,
+				sticky:    security.Sticky,
+				violation: violation,
+			})
+		}
+		config.bridges = append(config.bridges, bridge)
+	}
+
+	if file.SFlow.Collector != "" {
+		rate, header := file.SFlow.SamplingRate, file.SFlow.HeaderSize
+		if rate == 0 {
+			rate = SFLOW_DEFAULT_SAMPLING_RATE
+		}
+		if header == 0 {
+			header = SFLOW_DEFAULT_HEADER_SIZE
+		}
+		sflow, err := newSflowConfig(file.SFlow.Collector, rate, header)
+		if err != nil {
+			return nil, err
+		}
+		config.sflow = &sflow
+	}
+
+	for _, upstream := range file.DNS.Upstreams {
+		addr, err := parseIPv4Addr(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("dns upstream : %s", err)
+		}
+		config.dnsUpstreams = append(config.dnsUpstreams, addr)
+	}
+	for _, server := range file.NTP.Servers {
+		addr, err := parseIPv4Addr(server)
+		if err != nil {
+			return nil, fmt.Errorf("ntp server : %s", err)
+		}
+		config.ntpServers = append(config.ntpServers, addr)
+	}
+	for name, address := range file.DNS.Hosts {
+		err := parseDnsHost(name+"="+address, config.dnsHosts)
+		if err != nil {
+			return nil, fmt.Errorf("dns host : %s", err)
+		}
+	}
+	config.dns64 = file.DNS.DNS64
+
+	for _, addr := range file.Loopback {
+		loopback, err := parseLoopbackAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		config.loopback = append(config.loopback, ipv4Addr(loopback))
+	}
+	if file.RouterID != "" {
+		config.routerID, err = parseIPv4Addr(file.RouterID)
+		if err != nil {
+			return nil, fmt.Errorf("router id : %s", err)
+		}
+	}
+
+	for _, arp := range file.StaticARP {
+		entry, err := newStaticArpEntry(arp.Interface, arp.Address, arp.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("static arp on %s : %s", arp.Interface, err)
+		}
+		config.staticArp = append(config.staticArp, entry)
+	}
+
+	for _, vr := range file.VRRP {
+		address, err := parseIPAddr(vr.Address)
+		if err != nil {
+			return nil, fmt.Errorf("vrrp %d on %s : %s", vr.VRID, vr.Interface, err)
+		}
+		priority := vr.Priority
+		if priority == 0 {
+			priority = int(VRRP_PRIORITY_DEFAULT)
+		}
+		interval := VRRP_DEFAULT_ADVERT_INTERVAL
+		if vr.AdvertInterval != 0 {
+			interval = time.Duration(vr.AdvertInterval) * time.Second
+		}
+		vrrp, err := newVrrpConfig(vr.Interface, vr.VRID, address, priority, interval)
+		if err != nil {
+			return nil, fmt.Errorf("vrrp on %s : %s", vr.Interface, err)
+		}
+		config.vrrp = append(config.vrrp, vrrp)
+	}
+
+	if err := checkDhcpv6PdHint(file.DHCPv6PD.PrefixHint); err != nil {
+		return nil, err
+	}
+	config.dhcpv6Pd = file.DHCPv6PD
+
+	if file.IGMPProxy.Upstream != "" {
+		proxy, err := newIgmpProxyConfig(file.IGMPProxy.Upstream, file.IGMPProxy.Downstream)
+		if err != nil {
+			return nil, err
+		}
+		config.igmpProxy = &proxy
+	}
+
+	if file.FlowTableSize != nil && *file.FlowTableSize < 0 {
+		return nil, fmt.Errorf("invalid flow table size %d", *file.FlowTableSize)
+	}
+	config.flowTableSize = file.FlowTableSize
+
+	for _, ra := range file.RouterAdvertisements {
+		second := func(n int) time.Duration { return time.Duration(n) * time.Second }
+		advert, err := newRaConfig(ra.Interface, ra.Prefixes, ra.MTU, second(ra.Interval),
+			second(ra.RouterLifetime), second(ra.ValidLifetime), second(ra.PreferredLifetime))
+		if err != nil {
+			return nil, fmt.Errorf("router advertisement on %s : %s", ra.Interface, err)
+		}
+		config.ra = append(config.ra, advert)
+	}
+
+	for _, tunnel := range file.IPsec {
+		esp, err := newEspTunnelConfig(tunnel.Peer, tunnel.SPIOut, tunnel.KeyOut, tunnel.SPIIn, tunnel.KeyIn, tunnel.Routes)
+		if err != nil {
+			return nil, fmt.Errorf("ipsec tunnel to %s : %s", tunnel.Peer, err)
+		}
+		config.ipsec = append(config.ipsec, esp)
+	}
+
+	if config.natOutside == "" && (len(config.natInside) != 0 || len(file.NAT.PortForwards) != 0) {
+		return nil, fmt.Errorf("nat outside interface is not specified")
+	}
+	for _, fwd := range file.NAT.PortForwards {
+		portForward, err := parseNatPortForward(fwd.Protocol, fwd.Port, fwd.To)
+		if err != nil {
+			return nil, fmt.Errorf("nat port forward %s/%d : %s", fwd.Protocol, fwd.Port, err)
+		}
+		for _, other := range config.natPortForwards {
+			if other.protocol == portForward.protocol && other.globalPort == portForward.globalPort {
+				return nil, fmt.Errorf("nat port forward %s/%d is duplicated", fwd.Protocol, fwd.Port)
+			}
+		}
+		config.natPortForwards = append(config.natPortForwards, portForward)
+	}
+	if err := config.syslogConfig().validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// コマンドラインのsyslogの指定を設定ファイルで上書きする
+func (config *routerConfig) syslogConfig() syslogConfig {
+	syslog := syslogFlagConfig
+	if config.syslog.Server != "" {
+		syslog.server = config.syslog.Server
+	}
+	if config.syslog.Facility != "" {
+		syslog.facility = config.syslog.Facility
+	}
+	if config.syslog.Rate != 0 {
+		syslog.rate = config.syslog.Rate
+	}
+	return syslog
+}
+
+func parseACLRule(r aclRuleConfig) (rule aclRule, err error) {
+	switch r.Action {
+	case "permit":
+		rule.action = aclPermit
+	case "deny":
+		rule.action = aclDeny
+	default:
+		return rule, fmt.Errorf("unknown acl action %q", r.Action)
+	}
+	if r.Src != "" {
+		rule.srcPrefix, rule.srcPrefixLen, err = parsePrefix(r.Src)
+		if err != nil {
+			return rule, err
+		}
+	}
+	if r.Dst != "" {
+		rule.dstPrefix, rule.dstPrefixLen, err = parsePrefix(r.Dst)
+		if err != nil {
+			return rule, err
+		}
+	}
+	rule.protocol, err = parseACLProtocol(r.Protocol)
+	return rule, err
+}
+
+func parseDscpRule(r dscpRuleConfig) (rule dscpRule, err error) {
+	rule.dscp, err = parseDscp(r.Dscp)
+	if err != nil {
+		return rule, err
+	}
+	if r.Src != "" {
+		rule.srcPrefix, rule.srcPrefixLen, err = parsePrefix(r.Src)
+		if err != nil {
+			return rule, err
+		}
+	}
+	if r.Dst != "" {
+		rule.dstPrefix, rule.dstPrefixLen, err = parsePrefix(r.Dst)
+		if err != nil {
+			return rule, err
+		}
+	}
+	rule.protocol, err = parseACLProtocol(r.Protocol)
+	if err != nil {
+		return rule, err
+	}
+	rule.srcPort, rule.dstPort = r.SrcPort, r.DstPort
+	if (rule.srcPort != 0 || rule.dstPort != 0) && rule.protocol != IP_PROTOCOL_NUM_TCP && rule.protocol != IP_PROTOCOL_NUM_UDP {
+		return rule, fmt.Errorf("port requires tcp or udp protocol")
+	}
+	return rule, nil
+}
+
+// "192.168.1.1/24"をipDeviceにする、"192.168.1.1/24+192.168.3.1/24"のように2つ目以降はセカンダリのアドレス
+func parseIPDevice(address string) (ipDevice, error) {
+	var ipdev ipDevice
+	for _, a := range strings.Split(address, "+") {
+		ip, ipnet, err := net.ParseCIDR(a)
+		if err != nil || ip.To4() == nil {
+			return ipDevice{}, fmt.Errorf("invalid ipv4 address %s", a)
+		}
+		addr := newIPInterfaceAddr(byteToUint32(ip.To4()), byteToUint32(ipnet.Mask))
+		if addr.address == 0 || ipdev.hasAddr(addr.address) {
+			return ipDevice{}, fmt.Errorf("invalid or duplicate address %s", a)
+		}
+		ipdev.addAddr(addr)
+	}
+	return ipdev, nil
+}
+
+/*
+設定を反映する
+oldがnilの場合は起動時の反映
+*/
+func applyRouterConfig(epfd int, old, config *routerConfig) {
+	if old == nil {
+		old = &routerConfig{}
+	}
+	debug = config.debug
+	setSyslog(config.syslogConfig())
+
+	// インターフェイス
+	for name, ipdev := range config.interfaces {
+		netdev := searchNetDeviceByName(name)
+		if netdev == nil {
+			if config.backend != "tun" {
+				fmt.Printf("Interface %s in config is not found\n", name)
+				continue
+			}
+			netdev, err := newTapNetDevice(tapDeviceConfig{name: name, ipdev: ipdev})
+			if err != nil {
+				fmt.Printf("create tap device err : %s\n", err)
+				continue
+			}
+			fmt.Printf("Created tap device %s fd %d adddress %s\n",
+				netdev.name, netdev.socket, printMacAddr(netdev.macAddr))
+			err = registerNetDevice(epfd, netdev)
+			if err != nil {
+				syscall.Close(netdev.socket)
+				fmt.Println(err)
+			}
+			continue
+		}
+		if ipdev.address != 0 && !ipdev.equal(netdev.ipDev) {
+			setNetDeviceAddress(netdev, ipdev)
+		}
+	}
+	if config.backend == "tun" {
+		for name := range old.interfaces {
+			if _, ok := config.interfaces[name]; ok {
+				continue
+			}
+			if netdev := searchNetDeviceByName(name); netdev != nil {
+				unregisterNetDevice(epfd, netdev)
+			}
+		}
+	}
+
+	// ICMP Redirectの設定、指定が無くなったインターフェイスはコマンドラインの指定に戻す
+	for _, netdev := range netDeviceList {
+		if enabled, ok := config.icmpRedirect[netdev.name]; ok {
+			netdev.icmpRedirect = enabled
+		} else if _, ok := old.icmpRedirect[netdev.name]; ok {
+			netdev.icmpRedirect = !icmpRedirectDisabled[netdev.name]
+		}
+	}
+
+	// ICMP TimestampとAddress Maskに答えるか、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		enabled, ok := config.icmpTimestamp[netdev.name]
+		if !ok {
+			enabled = icmpTimestampInterfaces[netdev.name]
+		}
+		netdev.icmpTimestamp = enabled
+		enabled, ok = config.icmpMaskReply[netdev.name]
+		if !ok {
+			enabled = icmpMaskReplyInterfaces[netdev.name]
+		}
+		netdev.icmpMaskReply = enabled
+	}
+
+	// NAT64で変換するか、設定ファイルに無ければコマンドラインの指定を使う
+	// IPv6のフレームを受け取るかが変わるのでソケットフィルタも更新する
+	for _, netdev := range netDeviceList {
+		enabled, ok := config.nat64[netdev.name]
+		if !ok {
+			enabled = nat64Interfaces[netdev.name]
+		}
+		if netdev.nat64 != enabled {
+			netdev.nat64 = enabled
+			netdev.updateSocketFilter()
+		}
+	}
+
+	// プロミスキャスモードと追加で受け取るMACアドレス、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		promisc, ok := config.promisc[netdev.name]
+		if !ok {
+			promisc = promiscInterfaces[netdev.name]
+		}
+		allow, ok := config.macAllow[netdev.name]
+		if !ok {
+			allow = macAllowFlags[netdev.name]
+		}
+		setNetDeviceMacFilter(netdev, promisc, allow)
+	}
+
+	// uRPF、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		mode, ok := config.urpf[netdev.name]
+		if !ok {
+			mode = urpfFlags[netdev.name]
+		}
+		netdev.urpf = mode
+	}
+
+	// チェックサムの検証のポリシー、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		policy, ok := config.checksumPolicy[netdev.name]
+		if !ok {
+			policy = checksumPolicyFlags[netdev.name]
+		}
+		netdev.checksumPolicy = policy
+	}
+
+	// 管理上の状態、設定ファイルで変わったインターフェイスだけ反映して、管理APIで変えた状態は上書きしない
+	for _, netdev := range netDeviceList {
+		down, ok := config.shutdown[netdev.name]
+		if !ok {
+			down = shutdownInterfaces[netdev.name]
+		}
+		oldDown, ok := old.shutdown[netdev.name]
+		if !ok {
+			oldDown = shutdownInterfaces[netdev.name]
+		}
+		if down != oldDown {
+			if err := setNetDeviceAdminState(epfd, netdev, !down); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
+	// シェーピングとポリシング、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		var shaping, policing *qosRate
+		if rate, ok := config.shapingRates[netdev.name]; ok {
+			shaping = &rate
+		} else if rate, ok := shapingRates[netdev.name]; ok {
+			shaping = &rate
+		}
+		if rate, ok := config.policingRates[netdev.name]; ok {
+			policing = &rate
+		} else if rate, ok := policingRates[netdev.name]; ok {
+			policing = &rate
+		}
+		scheduler := defaultQosScheduler
+		if s, ok := config.qosSchedulers[netdev.name]; ok {
+			scheduler = s
+		}
+		setNetDeviceQos(netdev, shaping, policing, scheduler)
+	}
+
+	// 送信の遅延と損失のエミュレーション、設定ファイルに無ければコマンドラインの指定を使う
+	for _, netdev := range netDeviceList {
+		if imp, ok := config.impairments[netdev.name]; ok {
+			setNetDeviceImpairment(netdev, &imp)
+		} else {
+			setNetDeviceImpairmentFromFlags(netdev)
+		}
+	}
+
+	// マルチキャストグループへの参加
+	for _, netdev := range netDeviceList {
+		for _, group := range old.multicastGroups[netdev.name] {
+			if !containsAddr(config.multicastGroups[netdev.name], group) {
+				leaveMulticastGroup(netdev, ipv4Uint32(group))
+			}
+		}
+		for _, group := range config.multicastGroups[netdev.name] {
+			joinMulticastGroup(netdev, ipv4Uint32(group))
+		}
+	}
+
+	// 静的経路
+	for prefix, routes := range old.staticRoutes {
+		addr, prefixLen := prefixRoute(prefix)
+		for _, route := range routes {
+			if !containsStaticRoute(config.staticRoutes[prefix], route) {
+				_, ok := ribDeleteRoute(addr, prefixLen, ipRouteEntry{source: routeSourceStatic, nexthop: ipv4Uint32(route.nexthop)})
+				if !ok {
+					continue
+				}
+				fmt.Printf("Deleted static route %s %s\n", prefix, route)
+			}
+		}
+	}
+	for prefix, routes := range config.staticRoutes {
+		addr, prefixLen := prefixRoute(prefix)
+		for _, route := range routes {
+			if !containsStaticRoute(old.staticRoutes[prefix], route) {
+				addStaticRoute(addr, prefixLen, route.iptype, ipv4Uint32(route.nexthop), route.distance, route.metric)
+				fmt.Printf("Added static route %s %s\n", prefix, route)
+			}
+		}
+	}
+
+	// ループバックのアドレス、コマンドラインで指定されたものと合わせる
+	if len(config.loopback) != 0 || len(old.loopback) != 0 {
+		setLoopbackAddresses(append(append([]uint32{}, loopbackAddrs...), ipv4Uint32s(config.loopback)...))
+	}
+	// ルータID、設定ファイルで指定されていればコマンドラインの指定より優先する
+	configuredRouterID = routerIDFlag
+	if config.routerID.IsValid() {
+		configuredRouterID = ipv4Uint32(config.routerID)
+	}
+
+	// 静的なARPエントリ、コマンドラインで指定されたものと合わせる
+	if len(config.staticArp) != 0 || len(old.staticArp) != 0 {
+		setStaticArpEntries(append(append([]staticArpEntry{}, staticArpConfigs...), config.staticArp...))
+	}
+
+	// ブリッジ、コマンドラインで指定されたものと合わせる
+	if len(config.bridges) != 0 || len(old.bridges) != 0 {
+		setBridges(append(append([]bridgeConfig{}, bridgeConfigs...), config.bridges...))
+	}
+
+	// VRRP、コマンドラインで指定されたものと合わせる
+	if len(config.vrrp) != 0 || len(old.vrrp) != 0 {
+		setVrrpRouters(append(append([]vrrpConfig{}, vrrpConfigs...), config.vrrp...))
+	}
+
+	// ルータ広告、コマンドラインで指定されたものと合わせる
+	if len(config.ra) != 0 || len(old.ra) != 0 {
+		raFileConfigs = config.ra
+		updateRouterAdvertisements()
+	}
+
+	// IPsec、コマンドラインで指定されたものと合わせる
+	if len(config.ipsec) != 0 || len(old.ipsec) != 0 {
+		setEspTunnels(append(append([]espTunnelConfig{}, espTunnelConfigs...), config.ipsec...))
+	}
+
+	// ACL
+	ingressACL = config.acls
+
+	// DSCPの書き換え
+	ingressDscpPolicies = config.dscpPolicies
+
+	// NAT
+	if config.natOutside != old.natOutside || fmt.Sprint(config.natInside) != fmt.Sprint(old.natInside) ||
+		fmt.Sprint(config.natPortForwards) != fmt.Sprint(old.natPortForwards) {
+		setNatConfig(config.natOutside, config.natInside, config.natPortForwards)
+	}
+
+	// DNSフォワーダ、上位のサーバは設定ファイルを優先し、ホストはコマンドラインの指定と合わせる
+	upstreams := dnsUpstreams
+	if len(config.dnsUpstreams) != 0 {
+		upstreams = ipv4Uint32s(config.dnsUpstreams)
+	}
+	hosts := map[string]uint32{}
+	for name, addr := range dnsHosts {
+		hosts[name] = addr
+	}
+	for name, addr := range config.dnsHosts {
+		hosts[name] = addr
+	}
+	dns64 := dns64Enabled
+	if config.dns64 != nil {
+		dns64 = *config.dns64
+	}
+	setDnsForwarder(upstreams, hosts, dns64)
+
+	// NTP、上位のサーバは設定ファイルを優先する
+	servers := ntpServers
+	if len(config.ntpServers) != 0 {
+		servers = ipv4Uint32s(config.ntpServers)
+	}
+	setNtp(servers, ntpServe || config.ntpServe)
+
+	// SNMP、コミュニティ名は設定ファイルを優先する
+	community := snmpCommunity
+	if config.snmpCommunity != "" {
+		community = config.snmpCommunity
+	}
+	setSnmpAgent(community)
+
+	// sFlow、設定ファイルで指定されていればコマンドラインの指定より優先する
+	if config.sflow != nil {
+		setSflow(*config.sflow)
+	} else {
+		setSflow(sflowFlagConfig)
+	}
+
+	// PPPoE、設定ファイルで指定されていればコマンドラインの指定より優先する
+	if config.pppoe.Interface != "" {
+		setPppoe(config.pppoe.Interface, config.pppoe.Username, config.pppoe.Password)
+	} else {
+		setPppoe(pppoeInterface, pppoeUsername, pppoePassword)
+	}
+
+	// DHCPv6-PD、設定ファイルで指定されていればコマンドラインの指定より優先する
+	if config.dhcpv6Pd.Interface != "" {
+		setDhcpv6Pd(config.dhcpv6Pd.Interface, config.dhcpv6Pd.LanInterfaces, config.dhcpv6Pd.PrefixHint)
+	} else {
+		setDhcpv6Pd(dhcpv6PdInterface, dhcpv6PdLanInterfaces, dhcpv6PdHint)
+	}
+
+	// IGMPプロキシ、設定ファイルで指定されていればコマンドラインの指定より優先する
+	if config.igmpProxy != nil {
+		setIgmpProxy(*config.igmpProxy)
+	} else {
+		setIgmpProxy(igmpProxyFlagConfig)
+	}
+
+	// フローの表の大きさ、設定ファイルで指定されていればコマンドラインの指定より優先する
+	size := flowTableSize
+	if config.flowTableSize != nil {
+		size = *config.flowTableSize
+	}
+	setFlowTableSize(size)
+}
+
+/*
+SIGHUPで設定ファイルを読み直す
+読み込みに失敗した場合は今の設定のまま動き続ける
+*/
+func watchConfigReload(epfd int) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			fmt.Printf("Reloading config %s\n", configPath)
+			config, err := loadRouterConfig(configPath)
+			if err != nil {
+				fmt.Printf("reload config err : %s\n", err)
+				continue
+			}
+			routerMutex.Lock()
+			if config.backend != currentConfig.backend {
+				fmt.Println("Changing backend requires restart, ignore it")
+				config.backend = currentConfig.backend
+			}
+			applyRouterConfig(epfd, currentConfig, config)
+			currentConfig = config
+			routerMutex.Unlock()
+			fmt.Println("Config is reloaded")
+		}
+	}()
+}
+
+func containsUint32(list []uint32, v uint32) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(list []netip.Addr, v netip.Addr) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStaticRoute(list []staticRoute, v staticRoute) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
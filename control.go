@@ -0,0 +1,874 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+管理APIからルータの状態を操作する処理
+パケットの処理と管理APIのgoroutineが同時にテーブルに触らないように、routerMutexで排他する
+*/
+var routerMutex sync.Mutex
+
+type routeInfo struct {
+	prefix  netip.Prefix
+	iptype  string
+	nexthop netip.Addr // 直接接続の経路では無効なアドレス
+	device  string
+	// 経路の元とディスタンス、メトリック、RIBの一覧ではFIBに入っているか
+	source   string
+	distance uint8
+	metric   uint32
+	selected bool
+}
+
+type arpInfo struct {
+	ipAddr  netip.Addr
+	macAddr net.HardwareAddr
+	device  string
+	static  bool
+}
+
+type interfaceInfo struct {
+	name     string
+	macAddr  net.HardwareAddr
+	address  netip.Prefix // アドレスが無ければ無効なプレフィックス
+	stats    netDeviceStats
+	shaping  *qosRate
+	policing *qosRate
+	// シェーピングしている時の優先度ごとの送信キュー
+	scheduler string
+	queues    []qosQueueInfo
+	// セカンダリのアドレス
+	secondaryAddrs []netip.Prefix
+	// プロミスキャスモードか、フィルタに登録した追加で受け取るMACアドレス
+	promisc   bool
+	macFilter []string
+	// 管理上の状態とリンクも含めた動作状態
+	adminState string
+	operState  string
+	// 送信元アドレスを検証するuRPFのモード
+	urpf string
+	// チェックサムの検証のポリシーと、ethtoolで調べたチェックサムオフロード
+	checksumPolicy    string
+	rxChecksumOffload bool
+	txChecksumOffload bool
+	// 送信の遅延と損失のエミュレーションと遅延させているフレームの数、無効ならimpairmentはnil
+	impairment   *impairment
+	impairQueued int
+}
+
+type qosQueueInfo struct {
+	class   string
+	len     int
+	sent    uint64
+	dropped uint64
+}
+
+func (iptype ipRouteType) String() string {
+	switch iptype {
+	case connected:
+		return "connected"
+	case network:
+		return "network"
+	case ipsec:
+		return "ipsec"
+	case blackhole:
+		return "blackhole"
+	case reject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// 静的経路の種類を読む、空ならNextHopに送る経路
+func parseStaticRouteType(s string) (ipRouteType, error) {
+	switch s {
+	case "", "network":
+		return network, nil
+	case "blackhole":
+		return blackhole, nil
+	case "reject":
+		return reject, nil
+	}
+	return 0, fmt.Errorf("unknown route type %s", s)
+}
+
+// "192.168.2.0/24"をプレフィックスとプレフィックス長にする
+func parsePrefix(prefix string) (uint32, uint32, error) {
+	p, err := parseIPv4Prefix(prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	addr, prefixLen := prefixRoute(p)
+	return addr, prefixLen, nil
+}
+
+func parseIPAddr(addr string) (uint32, error) {
+	a, err := parseIPv4Addr(addr)
+	if err != nil {
+		return 0, err
+	}
+	return ipv4Uint32(a), nil
+}
+
+// 経路の追加、distanceが0なら静的経路の既定値を使う、blackholeとrejectの経路はnexthopを指定しない
+func controlAddRoute(prefix netip.Prefix, iptype ipRouteType, nexthop netip.Addr, distance uint8, metric uint32) error {
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("invalid ipv4 prefix %s", prefix)
+	}
+	if iptype == network && !nexthop.Is4() {
+		return fmt.Errorf("invalid route %s via %s", prefix, nexthop)
+	}
+	if iptype != network && nexthop.IsValid() {
+		return fmt.Errorf("%s route %s can not have nexthop", iptype, prefix)
+	}
+	prefixAddr, prefixLen := prefixRoute(prefix.Masked())
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	addStaticRoute(prefixAddr, prefixLen, iptype, ipv4Uint32(nexthop), distance, metric)
+	return nil
+}
+
+// 経路の削除、nexthopが無効なアドレスならそのプレフィックスの静的経路を全て削除する
+func controlDeleteRoute(prefix netip.Prefix, nexthop netip.Addr) error {
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("invalid ipv4 prefix %s", prefix)
+	}
+	prefixAddr, prefixLen := prefixRoute(prefix.Masked())
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	return deleteStaticRoute(prefixAddr, prefixLen, ipv4Uint32(nexthop))
+}
+
+// インターフェイスを管理上アップかダウンにする
+func controlSetInterfaceState(name string, up bool) error {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	netdev := searchNetDeviceByName(name)
+	if netdev == nil {
+		return fmt.Errorf("interface %s is not found", name)
+	}
+	return setNetDeviceAdminState(routerEpfd, netdev, up)
+}
+
+// debug packetのトレースの条件
+type packetTraceInfo struct {
+	src      netip.Prefix
+	dst      netip.Prefix
+	protocol uint8
+	device   string
+	maxTTL   uint8
+}
+
+// トレースの条件を返す、トレースしていなければfalse
+func controlGetPacketTrace() (packetTraceInfo, bool) {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	if packetTrace == nil {
+		return packetTraceInfo{}, false
+	}
+	return packetTraceInfo{
+		src:      routePrefix(packetTrace.srcPrefix, packetTrace.srcPrefixLen),
+		dst:      routePrefix(packetTrace.dstPrefix, packetTrace.dstPrefixLen),
+		protocol: packetTrace.protocol,
+		device:   packetTrace.device,
+		maxTTL:   packetTrace.maxTTL,
+	}, true
+}
+
+// トレースの条件を置き換える、インターフェイスを指定したら存在するか確認する
+func controlSetPacketTrace(info packetTraceInfo) error {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	if info.device != "" && searchNetDeviceByName(info.device) == nil {
+		return fmt.Errorf("interface %s is not found", info.device)
+	}
+	packetTrace = newPacketTraceMatch(info.src, info.dst, info.protocol, info.device, info.maxTTL)
+	fmt.Printf("Debug packet is enabled for %s\n", packetTrace)
+	return nil
+}
+
+// ARPテーブルとルートテーブルを書き出せる形で返す
+func controlDumpTables() tablesJSON {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	return dumpTables()
+}
+
+// 書き出したARPテーブルとルートテーブルを読み込み、読み込んだARPのエントリと経路の数を返す
+func controlImportTables(tables tablesJSON) (int, int, error) {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	return importTables(tables)
+}
+
+// トレースをやめる
+func controlClearPacketTrace() {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	if packetTrace != nil {
+		fmt.Println("Debug packet is disabled")
+	}
+	packetTrace = nil
+}
+
+// ルートテーブルの一覧
+func controlListRoutes() []routeInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var routes []routeInfo
+	iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+		routes = append(routes, newRouteInfo(prefix, prefixLen, entry, true))
+	})
+	return routes
+}
+
+// RIBの経路の候補の一覧、FIBに入っていない経路も返す
+func controlListRib() []routeInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var routes []routeInfo
+	ribWalk(func(prefix, prefixLen uint32, entry ipRouteEntry, selected bool) {
+		routes = append(routes, newRouteInfo(prefix, prefixLen, entry, selected))
+	})
+	return routes
+}
+
+func newRouteInfo(prefix, prefixLen uint32, entry ipRouteEntry, selected bool) routeInfo {
+	route := routeInfo{
+		prefix:   routePrefix(prefix, prefixLen),
+		iptype:   entry.iptype.String(),
+		source:   entry.source.String(),
+		distance: entry.distance,
+		metric:   entry.metric,
+		selected: selected,
+	}
+	if entry.iptype == network {
+		route.nexthop = ipv4Addr(entry.nexthop)
+	}
+	if entry.iptype == ipsec {
+		route.nexthop = ipv4Addr(entry.tunnel.config.peer)
+	}
+	if entry.netdev != nil {
+		route.device = entry.netdev.name
+	}
+	return route
+}
+
+// ARPテーブルの一覧
+func controlListArp() []arpInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+	return listArpInfo()
+}
+
+func listArpInfo() []arpInfo {
+	var entries []arpInfo
+	for _, static := range staticArpEntries {
+		entries = append(entries, arpInfo{
+			ipAddr:  ipv4Addr(static.ipAddr),
+			macAddr: hardwareAddr(static.macAddr),
+			device:  static.ifname,
+			static:  true,
+		})
+	}
+	for _, arpTable := range ArpTableEntryList {
+		entry := arpInfo{
+			ipAddr:  ipv4Addr(arpTable.ipAddr),
+			macAddr: hardwareAddr(arpTable.macAddr),
+		}
+		if arpTable.netdev != nil {
+			entry.device = arpTable.netdev.name
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// インターフェイスと統計情報の一覧
+func controlListInterfaces() []interfaceInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var interfaces []interfaceInfo
+	for _, netdev := range netDeviceList {
+		info := interfaceInfo{
+			name:    netdev.name,
+			macAddr: hardwareAddr(netdev.macAddr),
+			stats:   netdev.stats,
+		}
+		if netdev.shaper != nil {
+			rate := netdev.shaper.rate
+			info.shaping = &rate
+			info.scheduler = netdev.txQueues.scheduler.String()
+			for class, queue := range netdev.txQueues.queues {
+				info.queues = append(info.queues, qosQueueInfo{
+					class:   qosClassNames[class],
+					len:     len(queue.frames),
+					sent:    queue.sent,
+					dropped: queue.dropped,
+				})
+			}
+		}
+		if netdev.policer != nil {
+			rate := netdev.policer.rate
+			info.policing = &rate
+		}
+		if netdev.ipDev.address != 0 {
+			info.address = addrPrefix(netdev.ipDev.address, netdev.ipDev.netmask)
+		}
+		for _, addr := range netdev.ipDev.secondaries {
+			info.secondaryAddrs = append(info.secondaryAddrs, addrPrefix(addr.address, addr.netmask))
+		}
+		info.promisc = netdev.promisc
+		info.macFilter = netdev.macFilterStrings()
+		info.urpf = netdev.urpf.String()
+		info.checksumPolicy = netdev.checksumPolicy.String()
+		info.rxChecksumOffload = netdev.rxChecksumOffload
+		info.txChecksumOffload = netdev.txChecksumOffload
+		if netdev.impairment != nil {
+			imp := *netdev.impairment
+			info.impairment = &imp
+			info.impairQueued = len(netdev.impairQueue)
+		}
+		info.adminState = netdev.adminStateString()
+		info.operState = netdev.operStateString()
+		interfaces = append(interfaces, info)
+	}
+	return interfaces
+}
+
+// ルータ全体の統計情報
+type routerStats struct {
+	interfaces    int
+	routes        int
+	arpEntries    int
+	arpMacChanges uint64
+	routerID      string
+	total         netDeviceStats
+}
+
+// インターフェイスの統計情報を合計する
+func controlStats() routerStats {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	stats := routerStats{
+		interfaces:    len(netDeviceList),
+		arpEntries:    len(ArpTableEntryList) + len(staticArpEntries),
+		arpMacChanges: arpMacChanges,
+		routerID:      printIPAddr(currentRouterID()),
+	}
+	iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+		stats.routes++
+	})
+	for _, netdev := range netDeviceList {
+		stats.total.rxPackets += netdev.stats.rxPackets
+		stats.total.rxBytes += netdev.stats.rxBytes
+		stats.total.txPackets += netdev.stats.txPackets
+		stats.total.txBytes += netdev.stats.txBytes
+		stats.total.ipChecksumErrors += netdev.stats.ipChecksumErrors
+		stats.total.icmpChecksumErrors += netdev.stats.icmpChecksumErrors
+		stats.total.rxPoliced += netdev.stats.rxPoliced
+		stats.total.txQueueDrops += netdev.stats.txQueueDrops
+		stats.total.txErrors += netdev.stats.txErrors
+		stats.total.urpfDrops += netdev.stats.urpfDrops
+		stats.total.dscpRemarked += netdev.stats.dscpRemarked
+		stats.total.impairLost += netdev.stats.impairLost
+	}
+	return stats
+}
+
+type dropCounterInfo struct {
+	reason string
+	count  uint64
+}
+
+// 破棄したパケットの理由ごとの数
+func controlListDropCounters() []dropCounterInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var counters []dropCounterInfo
+	for reason, count := range dropCounters {
+		counters = append(counters, dropCounterInfo{
+			reason: dropReason(reason).String(),
+			count:  count,
+		})
+	}
+	return counters
+}
+
+type multicastGroupInfo struct {
+	group  string
+	device string
+	local  bool
+	// IGMPプロキシが上流で参加しているグループ
+	proxy bool
+}
+
+// マルチキャストグループのメンバーシップの一覧
+func controlListMulticastGroups() []multicastGroupInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var groups []multicastGroupInfo
+	for _, membership := range multicastMembershipList {
+		groups = append(groups, multicastGroupInfo{
+			group:  printIPAddr(membership.group),
+			device: membership.netdev.name,
+			local:  membership.local,
+		})
+	}
+	for _, group := range igmpProxyGroups() {
+		groups = append(groups, multicastGroupInfo{
+			group:  printIPAddr(group),
+			device: igmpProxy.config.upstream,
+			proxy:  true,
+		})
+	}
+	return groups
+}
+
+type lldpNeighborInfo struct {
+	device          string
+	chassisID       string
+	portID          string
+	portDescription string
+	systemName      string
+	ttl             int // 残りの秒数
+}
+
+// LLDPで見つけた隣接機器の一覧
+func controlListLldpNeighbors() []lldpNeighborInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	now := time.Now()
+	expireLldpNeighbors(now)
+	var neighbors []lldpNeighborInfo
+	for _, n := range lldpNeighborList {
+		neighbors = append(neighbors, lldpNeighborInfo{
+			device:          n.netdev.name,
+			chassisID:       n.chassisID,
+			portID:          n.portID,
+			portDescription: n.portDescription,
+			systemName:      n.systemName,
+			ttl:             int(n.expires.Sub(now) / time.Second),
+		})
+	}
+	return neighbors
+}
+
+type fdbInfo struct {
+	macAddr string
+	port    string
+	age     int // 最後に受信してからの秒数
+	// ポートセキュリティのstickyで学習したか
+	sticky bool
+}
+
+type bridgePortInfo struct {
+	name  string
+	role  string // STPが無効なら空
+	state string
+	// ポートセキュリティ、無効ならportSecurityはfalse
+	portSecurity bool
+	maxMacs      int
+	sticky       bool
+	violation    string
+	violations   uint64
+	learned      int
+}
+
+type bridgeInfo struct {
+	name     string
+	ports    []bridgePortInfo
+	fdb      []fdbInfo
+	stp      bool
+	bridgeID string
+	rootID   string
+	rootPort string
+	// 学習したMACアドレスを保持する秒数
+	agingTime int
+}
+
+// ブリッジとMACアドレステーブルの一覧
+func controlListBridges() []bridgeInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	now := time.Now()
+	var bridges []bridgeInfo
+	for _, br := range bridgeList {
+		info := bridgeInfo{name: br.name, agingTime: int(br.agingTime / time.Second)}
+		if br.stp != nil {
+			info.stp = true
+			info.bridgeID = printStpBridgeID(br.stp.bridgeID)
+			info.rootID = printStpBridgeID(br.stp.rootID)
+			if br.stp.rootPort != nil {
+				info.rootPort = br.stp.rootPort.netdev.name
+			}
+		}
+		for _, port := range br.ports {
+			portInfo := bridgePortInfo{name: port.netdev.name, state: br.portState(port).String()}
+			if br.stp != nil {
+				portInfo.role = port.stp.role.String()
+			}
+			if port.security != nil {
+				portInfo.portSecurity = true
+				portInfo.maxMacs = port.security.maxMacs
+				portInfo.sticky = port.security.sticky
+				portInfo.violation = port.security.violation.String()
+				portInfo.violations = port.violations
+				portInfo.learned = br.countPortMacs(port.netdev, now)
+			}
+			info.ports = append(info.ports, portInfo)
+		}
+		for mac, entry := range br.fdb {
+			if !entry.valid(now) {
+				delete(br.fdb, mac)
+				continue
+			}
+			info.fdb = append(info.fdb, fdbInfo{
+				macAddr: printMacAddr(mac),
+				port:    entry.port.name,
+				age:     int((br.agingTime - entry.expires.Sub(now)) / time.Second),
+				sticky:  entry.sticky,
+			})
+		}
+		sort.Slice(info.fdb, func(i, j int) bool { return info.fdb[i].macAddr < info.fdb[j].macAddr })
+		bridges = append(bridges, info)
+	}
+	return bridges
+}
+
+type ntpStatusInfo struct {
+	enabled      bool // SNTPクライアントが動いているか
+	serving      bool
+	synchronized bool
+	server       string
+	stratum      uint8
+	offset       time.Duration
+	delay        time.Duration
+	lastSync     time.Time
+	time         time.Time // 補正したルータの時刻
+}
+
+// SNTPクライアントの同期の状態
+func controlNtpStatus() ntpStatusInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	status := ntpStatusInfo{
+		serving: ntpServing,
+		time:    routerNow(),
+	}
+	if ntpState != nil {
+		status.enabled = true
+		status.synchronized = ntpState.synchronized
+		if ntpState.synchronized {
+			status.server = printIPAddr(ntpState.server)
+			status.stratum = ntpState.stratum
+			status.offset = ntpState.offset
+			status.delay = ntpState.delay
+			status.lastSync = ntpState.lastSync
+		}
+	}
+	return status
+}
+
+type pppoeStatusInfo struct {
+	enabled   bool
+	device    string
+	state     string
+	acName    string
+	acMacAddr string
+	sessionID uint16
+	address   string
+	peer      string
+	mru       uint16
+	upSince   time.Time
+}
+
+// PPPoEのセッションの状態
+func controlPppoeStatus() pppoeStatusInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	client := pppoe
+	if client == nil {
+		return pppoeStatusInfo{}
+	}
+	status := pppoeStatusInfo{
+		enabled: true,
+		device:  client.ifname,
+		state:   client.state.String(),
+	}
+	if client.state >= pppoeStateLcp {
+		status.acName = client.acName
+		status.acMacAddr = printMacAddr(client.acMacAddr)
+		status.sessionID = client.sessionID
+	}
+	if client.state == pppoeStateUp {
+		status.address = printIPAddr(client.localAddr)
+		status.peer = printIPAddr(client.peerAddr)
+		status.mru = client.peerMru
+		status.upSince = client.upSince
+	}
+	return status
+}
+
+type dhcpv6PdStatusInfo struct {
+	enabled  bool
+	device   string
+	state    string
+	server   string
+	prefix   string
+	assigned []dhcpv6AssignedPrefix
+	expires  time.Time
+}
+
+type dhcpv6AssignedPrefix struct {
+	device string
+	prefix string
+}
+
+// DHCPv6-PDで受け取ったプレフィックスとLAN側に割り当てたサブプレフィックス
+func controlDhcpv6PdStatus() dhcpv6PdStatusInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	client := dhcpv6
+	if client == nil {
+		return dhcpv6PdStatusInfo{}
+	}
+	status := dhcpv6PdStatusInfo{
+		enabled: true,
+		device:  client.ifname,
+		state:   client.state.String(),
+	}
+	if client.prefix.IsValid() {
+		status.server = netip.AddrFrom16(client.serverAddr).String()
+		status.prefix = client.prefix.String()
+		status.expires = client.boundAt.Add(client.validLifetime)
+		for i, lan := range client.lans {
+			if sub, ok := dhcpv6SubPrefix(client.prefix, i); ok {
+				status.assigned = append(status.assigned, dhcpv6AssignedPrefix{device: lan, prefix: sub.String()})
+			}
+		}
+	}
+	return status
+}
+
+type vrrpRouterInfo struct {
+	device         string
+	vrid           uint8
+	address        string
+	priority       uint8
+	state          string
+	master         string // バックアップの時はアドバタイズメントを送ってきたマスター
+	advertInterval int    // 秒
+}
+
+// VRRPの仮想ルータの一覧
+func controlListVrrpRouters() []vrrpRouterInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var routers []vrrpRouterInfo
+	for _, vr := range vrrpRouters {
+		info := vrrpRouterInfo{
+			device:         vr.config.ifname,
+			vrid:           vr.config.vrid,
+			address:        printIPAddr(vr.config.address),
+			priority:       vr.priority,
+			state:          vr.state.String(),
+			advertInterval: int(vr.config.advertInterval / time.Second),
+		}
+		if vr.state == vrrpStateInit {
+			info.priority = vr.config.priority
+		}
+		if vr.masterAddr != 0 && vr.state != vrrpStateInit {
+			info.master = printIPAddr(vr.masterAddr)
+		}
+		routers = append(routers, info)
+	}
+	return routers
+}
+
+type routerInstanceInfo struct {
+	name       string
+	netns      string
+	interfaces []string
+	routes     []routeInfo
+	arp        []arpInfo
+}
+
+// 同じプロセスで動かしているルータのインスタンスと、それぞれのルートテーブルとARPテーブル
+func controlListRouterInstances() []routerInstanceInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var instances []routerInstanceInfo
+	eachRouterInstance(func(inst *routerInstance) {
+		info := routerInstanceInfo{name: inst.name, netns: inst.netns, arp: listArpInfo()}
+		for _, netdev := range netDeviceList {
+			info.interfaces = append(info.interfaces, netdev.name)
+		}
+		iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+			info.routes = append(info.routes, newRouteInfo(prefix, prefixLen, entry, true))
+		})
+		instances = append(instances, info)
+	})
+	return instances
+}
+
+type ipsecTunnelInfo struct {
+	peer   string
+	spiOut string
+	spiIn  string
+	routes []string
+	stats  espTunnelStats
+}
+
+// IPsecのトンネルと統計情報の一覧
+func controlListIpsecTunnels() []ipsecTunnelInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var tunnels []ipsecTunnelInfo
+	for _, tunnel := range espTunnels {
+		info := ipsecTunnelInfo{
+			peer:   printIPAddr(tunnel.config.peer),
+			spiOut: fmt.Sprintf("0x%08x", tunnel.config.spiOut),
+			spiIn:  fmt.Sprintf("0x%08x", tunnel.config.spiIn),
+			stats:  tunnel.stats,
+		}
+		for _, route := range tunnel.config.routes {
+			info.routes = append(info.routes, fmt.Sprintf("%s/%d", printIPAddr(route.prefix), route.prefixLen))
+		}
+		tunnels = append(tunnels, info)
+	}
+	return tunnels
+}
+
+type natSessionInfo struct {
+	protocol   string
+	localAddr  string
+	localPort  uint16
+	globalAddr string
+	globalPort uint16
+	idle       int // 最後に使われてからの秒数
+}
+
+type natStatusInfo struct {
+	enabled  bool
+	outside  string
+	inside   []string
+	sessions []natSessionInfo
+	// ポートフォワードの外側のポート番号と転送先
+	portForwards []natPortForwardInfo
+}
+
+type natPortForwardInfo struct {
+	protocol   string
+	globalPort uint16
+	localAddr  string
+	localPort  uint16
+}
+
+// NATの設定と変換中のセッションの一覧
+func controlNatStatus() natStatusInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	var status natStatusInfo
+	if nat == nil {
+		return status
+	}
+	status.enabled = true
+	status.outside = nat.outsideDevice
+	for name := range nat.insideDevices {
+		status.inside = append(status.inside, name)
+	}
+	sort.Strings(status.inside)
+	for _, fwd := range nat.portForwards {
+		status.portForwards = append(status.portForwards, natPortForwardInfo{
+			protocol:   ipProtocolName(fwd.protocol),
+			globalPort: fwd.globalPort,
+			localAddr:  printIPAddr(fwd.localAddr),
+			localPort:  fwd.localPort,
+		})
+	}
+	now := time.Now()
+	natExpireEntries(now)
+	for _, entry := range natEntryList {
+		status.sessions = append(status.sessions, natSessionInfo{
+			protocol:   ipProtocolName(entry.protocol),
+			localAddr:  printIPAddr(entry.localAddr),
+			localPort:  entry.localPort,
+			globalAddr: printIPAddr(entry.globalAddr),
+			globalPort: entry.globalPort,
+			idle:       int(now.Sub(entry.lastUsed).Seconds()),
+		})
+	}
+	return status
+}
+
+// 表示用のプロトコル名、知らないものは番号にする
+func ipProtocolName(protocol uint8) string {
+	switch protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		return "icmp"
+	case IP_PROTOCOL_NUM_TCP:
+		return "tcp"
+	case IP_PROTOCOL_NUM_UDP:
+		return "udp"
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+type topTalkerInfo struct {
+	protocol string
+	srcAddr  string
+	srcPort  uint16
+	destAddr string
+	destPort uint16
+	packets  uint64
+	bytes    uint64
+	bps      uint64 // 最近の通信のビット毎秒
+	idle     int    // 最後にパケットが来てからの秒数
+}
+
+// 通信量の多いフローをレートの高い順にlimit個返す
+func controlTopTalkers(limit int) []topTalkerInfo {
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	now := time.Now()
+	var talkers []topTalkerInfo
+	for _, entry := range topTalkers(limit, now) {
+		talkers = append(talkers, topTalkerInfo{
+			protocol: ipProtocolName(entry.key.protocol),
+			srcAddr:  printIPAddr(entry.key.srcAddr),
+			srcPort:  entry.key.srcPort,
+			destAddr: printIPAddr(entry.key.destAddr),
+			destPort: entry.key.destPort,
+			packets:  entry.packets,
+			bytes:    entry.bytes,
+			bps:      uint64(entry.rate(now) * 8),
+			idle:     int(now.Sub(entry.lastSeen).Seconds()),
+		})
+	}
+	return talkers
+}
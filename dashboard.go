@@ -0,0 +1,13 @@
+package main
+
+import _ "embed"
+
+/*
+管理APIで配信するダッシュボード
+ワークショップでシェルに入れない受講者がブラウザでルータの状態を見られるように、
+インターフェイスのカウンタ、ルートテーブル、ARPテーブル、NATのセッション、最近のログを定期的に取得して表示する
+バイナリに埋め込むので、ルータを動かすマシンに他のファイルを置かなくてよい
+*/
+
+//go:embed dashboard/index.html
+var dashboardHTML []byte
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+/*
+DHCPv6のプレフィックス委譲(Prefix Delegation)のクライアント
+家庭用のルータと同じように、WAN側のインターフェイスでプロバイダのDHCPv6サーバからIA_PDでプレフィックスを受け取り、
+LAN側のインターフェイスに/64のサブプレフィックスを割り当ててルータ広告で配る
+  Solicit → Advertise → Request → Reply でプレフィックスを受け取る
+  T1でRenew、T2でRebindして延長し、有効期間が切れたらLAN側の広告から外してSolicitからやり直す
+  停止する時はReleaseでプレフィックスを返す、ただし-state-fileで状態を書き出す時はリースを書き出して返さず、
+  次に起動した時に有効期間が残っていれば同じプレフィックスを使い続ける
+LAN側のi番目(0から)のインターフェイスにはサブネットIDがiの/64を割り当てる、
+LAN側のインターフェイスに-raなどで広告の設定があれば、その広告にプレフィックスを加える
+このルータはIPv6のパケットをフォワードしないのでIPv6のルートテーブルは持たない、
+受け取ったプレフィックスと割り当てたサブプレフィックスは管理APIの/dhcpv6-pdで確認できる
+最初に届いたAdvertiseのサーバを使い、サーバの優先度は見ない
+https://www.rfc-editor.org/rfc/rfc8415
+*/
+
+const (
+	DHCPV6_CLIENT_PORT uint16 = 546
+	DHCPV6_SERVER_PORT uint16 = 547
+)
+
+// 全てのDHCPv6のリレーエージェントとサーバ、ff02::1:2
+var DHCPV6_ADDRESS_ALL_SERVERS = [16]uint8{0xff, 0x02, 13: 0x01, 15: 0x02}
+
+// リンクローカルのマルチキャストなのでホップリミットは1で送る
+const DHCPV6_HOP_LIMIT uint8 = 1
+
+const (
+	DHCPV6_MSG_SOLICIT   uint8 = 1
+	DHCPV6_MSG_ADVERTISE uint8 = 2
+	DHCPV6_MSG_REQUEST   uint8 = 3
+	DHCPV6_MSG_RENEW     uint8 = 5
+	DHCPV6_MSG_REBIND    uint8 = 6
+	DHCPV6_MSG_REPLY     uint8 = 7
+	DHCPV6_MSG_RELEASE   uint8 = 8
+)
+
+const (
+	DHCPV6_OPTION_CLIENTID     uint16 = 1
+	DHCPV6_OPTION_SERVERID     uint16 = 2
+	DHCPV6_OPTION_ELAPSED_TIME uint16 = 8
+	DHCPV6_OPTION_STATUS_CODE  uint16 = 13
+	DHCPV6_OPTION_IA_PD        uint16 = 25
+	DHCPV6_OPTION_IAPREFIX     uint16 = 26
+)
+
+const DHCPV6_STATUS_SUCCESS uint16 = 0
+
+// DUID-LL、リンク層のアドレスから作るクライアントの識別子
+const DHCPV6_DUID_TYPE_LL uint16 = 3
+const DHCPV6_HARDWARE_TYPE_ETHERNET uint16 = 1
+
+// IA_PDの識別子、1つしか要求しないので固定
+const DHCPV6_IAID uint32 = 1
+
+// IA_PDとIAPREFIXのオプションの固定部分の長さ
+const DHCPV6_IA_PD_LEN = 12
+const DHCPV6_IAPREFIX_LEN = 25
+
+// 再送の間隔の初期値と上限、Requestは送る回数の上限
+const (
+	DHCPV6_SOL_TIMEOUT = 1 * time.Second
+	DHCPV6_SOL_MAX_RT  = 3600 * time.Second
+	DHCPV6_REQ_TIMEOUT = 1 * time.Second
+	DHCPV6_REQ_MAX_RT  = 30 * time.Second
+	DHCPV6_REQ_MAX_RC  = 10
+	DHCPV6_REN_TIMEOUT = 10 * time.Second
+	DHCPV6_REN_MAX_RT  = 600 * time.Second
+	DHCPV6_REB_TIMEOUT = 10 * time.Second
+	DHCPV6_REB_MAX_RT  = 600 * time.Second
+)
+
+type dhcpv6State int
+
+const (
+	dhcpv6StateSolicit dhcpv6State = iota
+	dhcpv6StateRequest
+	dhcpv6StateBound
+	dhcpv6StateRenew
+	dhcpv6StateRebind
+)
+
+func (state dhcpv6State) String() string {
+	switch state {
+	case dhcpv6StateSolicit:
+		return "solicit"
+	case dhcpv6StateRequest:
+		return "request"
+	case dhcpv6StateBound:
+		return "bound"
+	case dhcpv6StateRenew:
+		return "renew"
+	case dhcpv6StateRebind:
+		return "rebind"
+	}
+	return "unknown"
+}
+
+type dhcpv6Client struct {
+	ifname  string
+	lans    []string // サブプレフィックスを割り当てるLAN側のインターフェイス
+	hint    int      // 要求するプレフィックス長、0なら指定しない
+	netdev  *netDevice
+	state   dhcpv6State
+	duid    []byte
+	xid     [3]uint8
+	started time.Time // 今のメッセージの交換を始めた時刻
+	// 次の再送の時刻と間隔、送った回数
+	nextSend time.Time
+	timeout  time.Duration
+	retry    int
+	// Advertiseを送ってきたサーバと提示されたプレフィックス
+	serverID []byte
+	offer    netip.Prefix
+	// 受け取ったプレフィックス
+	serverAddr        [16]uint8
+	prefix            netip.Prefix
+	t1, t2            time.Duration
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	boundAt           time.Time
+}
+
+// nilならDHCPv6-PDを使わない
+var dhcpv6 *dhcpv6Client
+
+// コマンドラインで指定されたWAN側とLAN側のインターフェイス、要求するプレフィックス長
+var dhcpv6PdInterface string
+var dhcpv6PdLanInterfaces []string
+var dhcpv6PdHint int
+
+// IA_PDで受け取ったプレフィックスの中身
+type dhcpv6IaPd struct {
+	t1, t2            time.Duration
+	prefix            netip.Prefix
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	status            uint16
+}
+
+// 要求するプレフィックス長を確認する
+func checkDhcpv6PdHint(hint int) error {
+	if hint < 0 || 64 < hint {
+		return fmt.Errorf("dhcpv6 prefix hint %d must be 0-64", hint)
+	}
+	return nil
+}
+
+/*
+DHCPv6-PDのクライアントを設定する
+設定が変わった時はプレフィックスを返してから始め直す
+*/
+func setDhcpv6Pd(ifname string, lans []string, hint int) {
+	if dhcpv6 != nil && dhcpv6.ifname == ifname && equalStrings(dhcpv6.lans, lans) && dhcpv6.hint == hint {
+		return
+	}
+	if dhcpv6 != nil {
+		dhcpv6Stop(dhcpv6, true)
+		fmt.Printf("DHCPv6 client on %s is stopped\n", dhcpv6.ifname)
+		dhcpv6 = nil
+	}
+	if ifname == "" {
+		return
+	}
+	dhcpv6 = &dhcpv6Client{
+		ifname: ifname,
+		lans:   append([]string{}, lans...),
+		hint:   hint,
+	}
+	fmt.Printf("DHCPv6 client on %s is started\n", ifname)
+	if dhcpv6Attach(dhcpv6) {
+		dhcpv6StartSolicit(dhcpv6, time.Now())
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// インターフェイスを探してプレフィックスを要求するデバイスにする
+func dhcpv6Attach(client *dhcpv6Client) bool {
+	if client.netdev != nil {
+		return true
+	}
+	netdev := searchNetDeviceByName(client.ifname)
+	if netdev == nil {
+		return false
+	}
+	client.netdev = netdev
+	client.duid = append(uint16ToByte(DHCPV6_DUID_TYPE_LL), uint16ToByte(DHCPV6_HARDWARE_TYPE_ETHERNET)...)
+	client.duid = append(client.duid, netdev.macAddr[:]...)
+	netdev.updateSocketFilter()
+	return true
+}
+
+// DHCPv6のメッセージを受け取るWAN側のインターフェイスか
+func dhcpv6Interface(netdev *netDevice) bool {
+	return dhcpv6 != nil && dhcpv6.netdev != nil && dhcpv6.netdev == netdev
+}
+
+// 新しいトランザクションを始める
+func dhcpv6NewExchange(client *dhcpv6Client, state dhcpv6State, timeout time.Duration, now time.Time) {
+	client.state = state
+	rand.Read(client.xid[:])
+	client.started = now
+	client.timeout = timeout
+	client.retry = 0
+	dhcpv6Transmit(client, now)
+}
+
+// 受け取っていたプレフィックスを消してSolicitからやり直す
+func dhcpv6StartSolicit(client *dhcpv6Client, now time.Time) {
+	client.serverID = nil
+	client.offer = netip.Prefix{}
+	dhcpv6NewExchange(client, dhcpv6StateSolicit, DHCPV6_SOL_TIMEOUT, now)
+}
+
+// 今の状態のメッセージを送り、次の再送の時刻を決める
+func dhcpv6Transmit(client *dhcpv6Client, now time.Time) {
+	var msgType uint8
+	var maxRT time.Duration
+	var prefix netip.Prefix
+	switch client.state {
+	case dhcpv6StateSolicit:
+		msgType, maxRT = DHCPV6_MSG_SOLICIT, DHCPV6_SOL_MAX_RT
+		if client.hint != 0 {
+			prefix = netip.PrefixFrom(netip.IPv6Unspecified(), client.hint)
+		}
+	case dhcpv6StateRequest:
+		msgType, maxRT, prefix = DHCPV6_MSG_REQUEST, DHCPV6_REQ_MAX_RT, client.offer
+	case dhcpv6StateRenew:
+		msgType, maxRT, prefix = DHCPV6_MSG_RENEW, DHCPV6_REN_MAX_RT, client.prefix
+	case dhcpv6StateRebind:
+		msgType, maxRT, prefix = DHCPV6_MSG_REBIND, DHCPV6_REB_MAX_RT, client.prefix
+	default:
+		return
+	}
+	// RebindはどのサーバからでもReplyを受け取るのでサーバの識別子をつけない
+	withServerID := client.state == dhcpv6StateRequest || client.state == dhcpv6StateRenew
+	dhcpv6Output(client, msgType, withServerID, prefix, now)
+
+	client.retry++
+	client.nextSend = now.Add(client.timeout)
+	client.timeout *= 2
+	if maxRT < client.timeout {
+		client.timeout = maxRT
+	}
+}
+
+// DHCPv6のメッセージを作って全てのサーバ宛てに送る
+func dhcpv6Output(client *dhcpv6Client, msgType uint8, withServerID bool, prefix netip.Prefix, now time.Time) {
+	var b bytes.Buffer
+	b.WriteByte(msgType)
+	b.Write(client.xid[:])
+	b.Write(dhcpv6Option(DHCPV6_OPTION_CLIENTID, client.duid))
+	if withServerID {
+		b.Write(dhcpv6Option(DHCPV6_OPTION_SERVERID, client.serverID))
+	}
+	// 交換を始めてからの経過時間、1/100秒単位
+	elapsed := now.Sub(client.started) / (10 * time.Millisecond)
+	if elapsed > 0xffff {
+		elapsed = 0xffff
+	}
+	b.Write(dhcpv6Option(DHCPV6_OPTION_ELAPSED_TIME, uint16ToByte(uint16(elapsed))))
+	b.Write(dhcpv6IaPdOption(prefix))
+
+	debugPrintf("Sending DHCPv6 message %d via %s\n", msgType, client.netdev.name)
+	udpv6Output(client.netdev, DHCPV6_ADDRESS_ALL_SERVERS, ipv6MulticastMacAddr(DHCPV6_ADDRESS_ALL_SERVERS),
+		DHCPV6_CLIENT_PORT, DHCPV6_SERVER_PORT, DHCPV6_HOP_LIMIT, b.Bytes())
+}
+
+func dhcpv6Option(code uint16, data []byte) []byte {
+	option := append(uint16ToByte(code), uint16ToByte(uint16(len(data)))...)
+	return append(option, data...)
+}
+
+// IA_PDのオプション、prefixが無効なアドレスならIAPREFIXをつけない、T1、T2と有効期間はサーバに任せて0にする
+func dhcpv6IaPdOption(prefix netip.Prefix) []byte {
+	iapd := append(uint32ToByte(DHCPV6_IAID), make([]byte, 8)...)
+	if prefix.IsValid() {
+		addr := prefix.Addr().As16()
+		iaprefix := append(make([]byte, 8), uint8(prefix.Bits()))
+		iapd = append(iapd, dhcpv6Option(DHCPV6_OPTION_IAPREFIX, append(iaprefix, addr[:]...))...)
+	}
+	return dhcpv6Option(DHCPV6_OPTION_IA_PD, iapd)
+}
+
+/*
+オプションを読む、同じオプションが複数あれば最初のものを使う
+長さが合わなければfalseを返す
+*/
+func dhcpv6ReadOptions(packet []byte) (map[uint16][]byte, bool) {
+	options := map[uint16][]byte{}
+	for len(packet) != 0 {
+		if len(packet) < 4 {
+			return nil, false
+		}
+		code := byteToUint16(packet[0:2])
+		length := int(byteToUint16(packet[2:4]))
+		if len(packet) < 4+length {
+			return nil, false
+		}
+		if _, ok := options[code]; !ok {
+			options[code] = packet[4 : 4+length]
+		}
+		packet = packet[4+length:]
+	}
+	return options, true
+}
+
+// ステータスコードのオプション、無ければ成功
+func dhcpv6Status(options map[uint16][]byte) (uint16, string) {
+	status, ok := options[DHCPV6_OPTION_STATUS_CODE]
+	if !ok || len(status) < 2 {
+		return DHCPV6_STATUS_SUCCESS, ""
+	}
+	return byteToUint16(status[0:2]), string(status[2:])
+}
+
+/*
+IA_PDのオプションを読む
+IAPREFIXがいくつあっても最初のものだけを使う
+*/
+func dhcpv6ReadIaPd(data []byte) (dhcpv6IaPd, bool) {
+	var iapd dhcpv6IaPd
+	if len(data) < DHCPV6_IA_PD_LEN || byteToUint32(data[0:4]) != DHCPV6_IAID {
+		return iapd, false
+	}
+	iapd.t1 = time.Duration(byteToUint32(data[4:8])) * time.Second
+	iapd.t2 = time.Duration(byteToUint32(data[8:12])) * time.Second
+	options, ok := dhcpv6ReadOptions(data[DHCPV6_IA_PD_LEN:])
+	if !ok {
+		return iapd, false
+	}
+	iapd.status, _ = dhcpv6Status(options)
+	iaprefix, ok := options[DHCPV6_OPTION_IAPREFIX]
+	if !ok {
+		return iapd, true
+	}
+	if len(iaprefix) < DHCPV6_IAPREFIX_LEN {
+		return iapd, false
+	}
+	iapd.preferredLifetime = time.Duration(byteToUint32(iaprefix[0:4])) * time.Second
+	iapd.validLifetime = time.Duration(byteToUint32(iaprefix[4:8])) * time.Second
+	bits := int(iaprefix[8])
+	var addr [16]uint8
+	copy(addr[:], iaprefix[9:25])
+	if 64 < bits {
+		return iapd, false
+	}
+	iapd.prefix = netip.PrefixFrom(netip.AddrFrom16(addr), bits).Masked()
+	// 委譲の状態はIAPREFIXの中のステータスコードでも知らされる
+	if prefixOptions, ok := dhcpv6ReadOptions(iaprefix[DHCPV6_IAPREFIX_LEN:]); ok && iapd.status == DHCPV6_STATUS_SUCCESS {
+		iapd.status, _ = dhcpv6Status(prefixOptions)
+	}
+	return iapd, true
+}
+
+/*
+サーバから受け取ったメッセージの処理
+自分のトランザクションへの応答でなければ捨てる
+*/
+func dhcpv6Input(client *dhcpv6Client, srcAddr [16]uint8, packet []byte) {
+	if len(packet) < 4 {
+		countDrop(DROP_REASON_DHCPV6_INVALID)
+		return
+	}
+	msgType := packet[0]
+	if !bytes.Equal(packet[1:4], client.xid[:]) {
+		debugPrintf("Ignore DHCPv6 message %d with other transaction id\n", msgType)
+		return
+	}
+	options, ok := dhcpv6ReadOptions(packet[4:])
+	if !ok || !bytes.Equal(options[DHCPV6_OPTION_CLIENTID], client.duid) || len(options[DHCPV6_OPTION_SERVERID]) == 0 {
+		countDrop(DROP_REASON_DHCPV6_INVALID)
+		return
+	}
+	serverID := append([]byte{}, options[DHCPV6_OPTION_SERVERID]...)
+	server := netip.AddrFrom16(srcAddr)
+	if status, message := dhcpv6Status(options); status != DHCPV6_STATUS_SUCCESS {
+		fmt.Printf("DHCPv6 server %s returned status %d %q\n", server, status, message)
+		return
+	}
+	iapd, ok := dhcpv6ReadIaPd(options[DHCPV6_OPTION_IA_PD])
+	if !ok {
+		countDrop(DROP_REASON_DHCPV6_INVALID)
+		return
+	}
+	now := time.Now()
+
+	switch {
+	case msgType == DHCPV6_MSG_ADVERTISE && client.state == dhcpv6StateSolicit:
+		if iapd.status != DHCPV6_STATUS_SUCCESS || !iapd.prefix.IsValid() {
+			fmt.Printf("DHCPv6 server %s has no prefix to delegate, status %d\n", server, iapd.status)
+			return
+		}
+		fmt.Printf("DHCPv6 server %s offers prefix %s on %s\n", server, iapd.prefix, client.netdev.name)
+		client.serverID = serverID
+		client.offer = iapd.prefix
+		dhcpv6NewExchange(client, dhcpv6StateRequest, DHCPV6_REQ_TIMEOUT, now)
+	case msgType == DHCPV6_MSG_REPLY &&
+		(client.state == dhcpv6StateRequest || client.state == dhcpv6StateRenew || client.state == dhcpv6StateRebind):
+		if iapd.status != DHCPV6_STATUS_SUCCESS || !iapd.prefix.IsValid() || iapd.validLifetime == 0 {
+			fmt.Printf("DHCPv6 server %s did not delegate prefix, status %d\n", server, iapd.status)
+			// 延長できなかった時は有効期間が切れるまで今のプレフィックスを使い続ける
+			if client.state == dhcpv6StateRequest {
+				dhcpv6StartSolicit(client, now)
+			}
+			return
+		}
+		dhcpv6Bind(client, serverID, srcAddr, iapd, now)
+	default:
+		debugPrintf("Ignore DHCPv6 message %d in state %s\n", msgType, client.state)
+	}
+}
+
+// 受け取ったプレフィックスを使い始め、LAN側の広告を更新する
+func dhcpv6Bind(client *dhcpv6Client, serverID []byte, serverAddr [16]uint8, iapd dhcpv6IaPd, now time.Time) {
+	changed := client.prefix != iapd.prefix
+	client.state = dhcpv6StateBound
+	client.serverID = serverID
+	client.serverAddr = serverAddr
+	client.prefix = iapd.prefix
+	client.validLifetime = iapd.validLifetime
+	client.preferredLifetime = iapd.preferredLifetime
+	client.boundAt = now
+	// サーバがT1とT2を決めなければ推奨の有効期間の0.5倍と0.8倍にする
+	client.t1, client.t2 = iapd.t1, iapd.t2
+	if client.t1 == 0 || client.t2 == 0 || client.t2 < client.t1 {
+		client.t1 = iapd.preferredLifetime / 2
+		client.t2 = iapd.preferredLifetime * 4 / 5
+	}
+	fmt.Printf("DHCPv6 prefix %s is delegated on %s from %s, valid %s, renew in %s\n",
+		client.prefix, client.netdev.name, netip.AddrFrom16(serverAddr), client.validLifetime, client.t1)
+	if changed {
+		for i, lan := range client.lans {
+			sub, ok := dhcpv6SubPrefix(client.prefix, i)
+			if !ok {
+				fmt.Printf("DHCPv6 prefix %s is too long to assign to %s\n", client.prefix, lan)
+				continue
+			}
+			fmt.Printf("DHCPv6 prefix %s is assigned to %s\n", sub, lan)
+		}
+	}
+	updateRouterAdvertisements()
+}
+
+/*
+状態ファイルから読み戻したリースで、再起動する前のプレフィックスを使い続ける
+同じWAN側のインターフェイスで有効期間が残っている時だけ戻し、T1を過ぎていれば次のタイマでRenewする
+*/
+func restoreDhcpv6Lease(ifname string, serverID []byte, serverAddr [16]uint8, iapd dhcpv6IaPd, boundAt time.Time, now time.Time) bool {
+	client := dhcpv6
+	if client == nil || client.ifname != ifname || !dhcpv6Attach(client) || client.prefix.IsValid() {
+		return false
+	}
+	if !now.Before(boundAt.Add(iapd.validLifetime)) {
+		return false
+	}
+	fmt.Printf("Restored DHCPv6 prefix %s on %s\n", iapd.prefix, ifname)
+	dhcpv6Bind(client, serverID, serverAddr, iapd, boundAt)
+	return true
+}
+
+// プレフィックスを使うのをやめ、LAN側の広告から外す
+func dhcpv6Withdraw(client *dhcpv6Client) {
+	if !client.prefix.IsValid() {
+		return
+	}
+	fmt.Printf("DHCPv6 prefix %s on %s is withdrawn\n", client.prefix, client.ifname)
+	client.prefix = netip.Prefix{}
+	updateRouterAdvertisements()
+}
+
+/*
+クライアントを止める
+releaseの時はReleaseでプレフィックスを返す、状態ファイルにリースを書き出した時は返さずに次の起動で使い続ける
+*/
+func dhcpv6Stop(client *dhcpv6Client, release bool) {
+	netdev := client.netdev
+	if netdev == nil {
+		return
+	}
+	if release && client.prefix.IsValid() && netdev.isUp() {
+		rand.Read(client.xid[:])
+		client.started = time.Now()
+		dhcpv6Output(client, DHCPV6_MSG_RELEASE, true, client.prefix, client.started)
+	}
+	dhcpv6Withdraw(client)
+	client.netdev = nil
+	netdev.updateSocketFilter()
+}
+
+// 委譲されたプレフィックスのi番目の/64
+func dhcpv6SubPrefix(prefix netip.Prefix, i int) (netip.Prefix, bool) {
+	bits := prefix.Bits()
+	if 64 < bits || (64-bits < 32 && i >= 1<<(64-bits)) {
+		return netip.Prefix{}, false
+	}
+	addr := prefix.Addr().As16()
+	binary.BigEndian.PutUint64(addr[:8], binary.BigEndian.Uint64(addr[:8])|uint64(i))
+	return netip.PrefixFrom(netip.AddrFrom16(addr), 64).Masked(), true
+}
+
+/*
+ルータ広告の設定に委譲されたプレフィックスのサブプレフィックスを加える
+LAN側のインターフェイスに広告の設定が無ければ、既定値の広告を受け取ったプレフィックスの有効期間で作る
+*/
+func dhcpv6DelegatedRaConfigs(configs []raConfig) []raConfig {
+	client := dhcpv6
+	if client == nil || !client.prefix.IsValid() {
+		return configs
+	}
+	for i, lan := range client.lans {
+		sub, ok := dhcpv6SubPrefix(client.prefix, i)
+		if !ok {
+			continue
+		}
+		found := false
+		for j := range configs {
+			if configs[j].ifname == lan {
+				configs[j].prefixes = append(append([]netip.Prefix{}, configs[j].prefixes...), sub)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		config, err := newRaConfig(lan, nil, 0, 0, 0, 0, 0)
+		if err != nil {
+			fmt.Printf("router advertisement on %s err : %s\n", lan, err)
+			continue
+		}
+		config.prefixes = []netip.Prefix{sub}
+		config.validLifetime = client.validLifetime
+		config.preferredLifetime = client.preferredLifetime
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// 再送と延長、有効期間の確認
+func dhcpv6Tick(now time.Time) {
+	client := dhcpv6
+	if client == nil {
+		return
+	}
+	if client.netdev == nil {
+		if dhcpv6Attach(client) {
+			dhcpv6StartSolicit(client, now)
+		}
+		return
+	}
+	if !client.netdev.isUp() {
+		return
+	}
+	if client.prefix.IsValid() && !now.Before(client.boundAt.Add(client.validLifetime)) {
+		fmt.Printf("DHCPv6 prefix %s is expired\n", client.prefix)
+		dhcpv6Withdraw(client)
+		dhcpv6StartSolicit(client, now)
+		return
+	}
+	switch client.state {
+	case dhcpv6StateBound:
+		if !now.Before(client.boundAt.Add(client.t1)) {
+			dhcpv6NewExchange(client, dhcpv6StateRenew, DHCPV6_REN_TIMEOUT, now)
+		}
+	case dhcpv6StateRenew:
+		if !now.Before(client.boundAt.Add(client.t2)) {
+			dhcpv6NewExchange(client, dhcpv6StateRebind, DHCPV6_REB_TIMEOUT, now)
+		} else if !now.Before(client.nextSend) {
+			dhcpv6Transmit(client, now)
+		}
+	case dhcpv6StateRequest:
+		if !now.Before(client.nextSend) {
+			if client.retry >= DHCPV6_REQ_MAX_RC {
+				dhcpv6StartSolicit(client, now)
+			} else {
+				dhcpv6Transmit(client, now)
+			}
+		}
+	default:
+		if !now.Before(client.nextSend) {
+			dhcpv6Transmit(client, now)
+		}
+	}
+}
+
+func startDhcpv6Timer() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for now := range ticker.C {
+			routerMutex.Lock()
+			dhcpv6Tick(now)
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+// インターフェイスが無くなったら、また現れた時にSolicitからやり直す
+func dhcpv6DeviceRemoved(netdev *netDevice) {
+	if !dhcpv6Interface(netdev) {
+		return
+	}
+	dhcpv6Withdraw(dhcpv6)
+	dhcpv6.netdev = nil
+	dhcpv6.state = dhcpv6StateSolicit
+}
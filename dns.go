@@ -0,0 +1,612 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+/*
+DNSフォワーダ
+LAN側のインターフェイスのアドレスの53番ポートで問い合わせを受け、上位のDNSサーバに転送する
+応答はTTLの間キャッシュし、静的なホストの表にある名前にはルータが直接答える
+IPv6を受け取るインターフェイスではリンクローカルアドレスの53番ポートでも問い合わせを受ける
+DNS64を有効にすると、AAAAレコードの無い名前にはAレコードから64:ff9b::/96のアドレスを合成して答える(nat64.go)
+https://www.rfc-editor.org/rfc/rfc1035
+https://www.rfc-editor.org/rfc/rfc6147
+*/
+
+const DNS_PORT uint16 = 53
+
+const (
+	DNS_TYPE_A    uint16 = 1
+	DNS_TYPE_AAAA uint16 = 28
+	DNS_TYPE_OPT  uint16 = 41
+	DNS_CLASS_IN  uint16 = 1
+)
+
+const DNS_RCODE_REFUSED uint16 = 5
+
+const DNS_FLAG_QR uint16 = 0x8000
+const DNS_FLAG_RD uint16 = 0x0100
+const DNS_FLAG_RA uint16 = 0x0080
+
+const DNS_HEADER_LEN = 12
+
+// 上位のサーバから応答が無いとみなすまでの時間
+const DNS_QUERY_TIMEOUT = 5 * time.Second
+
+// キャッシュするエントリの数とTTLの上限
+const DNS_CACHE_SIZE = 1024
+const DNS_CACHE_MAX_TTL = 24 * time.Hour
+
+// 答えの無い応答をキャッシュする時間
+const DNS_NEGATIVE_CACHE_TTL = 60 * time.Second
+
+// 静的なホストの表で答える時のTTL
+const DNS_STATIC_HOST_TTL = 60
+
+// 問い合わせの名前とタイプ
+type dnsQuestion struct {
+	name   string // 小文字にした名前
+	qtype  uint16
+	qclass uint16
+}
+
+// キャッシュした応答
+type dnsCacheEntry struct {
+	response []byte
+	cachedAt time.Time
+	expires  time.Time
+}
+
+// 上位のサーバに転送して応答を待っている問い合わせ
+type dnsPendingQuery struct {
+	question   dnsQuestion
+	clientAddr uint32
+	clientPort uint16
+	clientID   uint16
+	serverAddr uint32 // 問い合わせを受けたルータのアドレス
+	expires    time.Time
+	// IPv6で問い合わせてきたクライアント、netdevがnilならIPv4
+	clientAddr6 [16]uint8
+	clientMac   [6]uint8
+	netdev      *netDevice
+	// DNS64で合成するために送ったAの問い合わせなら、クライアントからのAAAAの問い合わせ
+	dns64Query []byte
+}
+
+// 応答のリソースレコード
+type dnsRecord struct {
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+type dnsForwarder struct {
+	upstreams []uint32
+	current   int // 問い合わせを送る上位のサーバ
+	hosts     map[string]uint32
+	cache     map[dnsQuestion]*dnsCacheEntry
+	pending   map[uint16]*dnsPendingQuery // 上位のサーバに送ったIDごと
+	port      uint16                      // 上位のサーバからの応答を受けるポート
+	// AAAAレコードの無い名前にAレコードから合成したAAAAレコードを答えるか
+	dns64 bool
+}
+
+// nilならDNSフォワーダは動いていない
+var dnsProxy *dnsForwarder
+
+// コマンドラインで指定された上位のサーバとホストの表
+var dnsUpstreams []uint32
+var dnsHosts = map[string]uint32{}
+var dns64Enabled bool
+
+// "router.lan=192.168.1.1"の形式のホストを読む
+func parseDnsHost(spec string, hosts map[string]uint32) error {
+	name, addrStr, found := strings.Cut(spec, "=")
+	if !found || name == "" {
+		return fmt.Errorf("invalid dns host %q, format is name=address", spec)
+	}
+	addr, err := parseIPAddr(addrStr)
+	if err != nil {
+		return err
+	}
+	hosts[dnsCanonicalName(name)] = addr
+	return nil
+}
+
+// 大文字と小文字を区別せず、最後のドットを取り除く
+func dnsCanonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+/*
+DNSフォワーダを設定する
+上位のサーバもホストも無ければ止める
+*/
+func setDnsForwarder(upstreams []uint32, hosts map[string]uint32, dns64 bool) {
+	if len(upstreams) == 0 && len(hosts) == 0 {
+		if dnsProxy != nil {
+			udpClose(DNS_PORT)
+			udpClose(dnsProxy.port)
+			dnsProxy = nil
+			fmt.Println("DNS forwarder is stopped")
+		}
+		return
+	}
+	if dnsProxy == nil {
+		dnsProxy = &dnsForwarder{
+			cache:   map[dnsQuestion]*dnsCacheEntry{},
+			pending: map[uint16]*dnsPendingQuery{},
+		}
+		// 上位のサーバへの問い合わせの送信元ポートは推測されにくいようにランダムにする
+		for {
+			dnsProxy.port = uint16(49152 + rand.Intn(16384))
+			if _, ok := udpHandlers[dnsProxy.port]; !ok {
+				break
+			}
+		}
+		udpListen(DNS_PORT, dnsQueryInput)
+		udpListen(dnsProxy.port, dnsResponseInput)
+		fmt.Println("DNS forwarder is started")
+	}
+	dnsProxy.upstreams = upstreams
+	dnsProxy.current = 0
+	dnsProxy.hosts = hosts
+	if dnsProxy.dns64 != dns64 {
+		// 合成した応答が残らないようにキャッシュを消す
+		dnsProxy.cache = map[dnsQuestion]*dnsCacheEntry{}
+		dnsProxy.dns64 = dns64
+		fmt.Printf("DNS64 is %s\n", map[bool]string{true: "enabled", false: "disabled"}[dns64])
+	}
+	for _, upstream := range upstreams {
+		fmt.Printf("DNS upstream server %s\n", printIPAddr(upstream))
+	}
+}
+
+/*
+名前を読む、圧縮されたポインタもたどる
+名前の次の位置を返す
+*/
+func dnsReadName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; jumps++ {
+		if offset >= len(msg) || jumps > 64 {
+			return "", 0, fmt.Errorf("invalid dns name")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+2 > len(msg) {
+				return "", 0, fmt.Errorf("invalid dns name")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(byteToUint16(msg[offset:offset+2]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("invalid dns name")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+// 最初の問い合わせを読み、その次の位置を返す
+func dnsReadQuestion(msg []byte) (dnsQuestion, int, error) {
+	if len(msg) < DNS_HEADER_LEN || byteToUint16(msg[4:6]) != 1 {
+		return dnsQuestion{}, 0, fmt.Errorf("dns message must have one question")
+	}
+	name, offset, err := dnsReadName(msg, DNS_HEADER_LEN)
+	if err != nil {
+		return dnsQuestion{}, 0, err
+	}
+	if offset+4 > len(msg) {
+		return dnsQuestion{}, 0, fmt.Errorf("dns question is too short")
+	}
+	question := dnsQuestion{
+		name:   dnsCanonicalName(name),
+		qtype:  byteToUint16(msg[offset : offset+2]),
+		qclass: byteToUint16(msg[offset+2 : offset+4]),
+	}
+	return question, offset + 4, nil
+}
+
+/*
+応答の全てのリソースレコードのTTLの位置を調べる
+OPTレコードのTTLはフラグなので含めない
+*/
+func dnsRecordTTLOffsets(msg []byte) ([]int, error) {
+	_, offset, err := dnsReadQuestion(msg)
+	if err != nil {
+		return nil, err
+	}
+	count := int(byteToUint16(msg[6:8])) + int(byteToUint16(msg[8:10])) + int(byteToUint16(msg[10:12]))
+	var offsets []int
+	for i := 0; i < count; i++ {
+		_, offset, err = dnsReadName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, fmt.Errorf("dns record is too short")
+		}
+		if byteToUint16(msg[offset:offset+2]) != DNS_TYPE_OPT {
+			offsets = append(offsets, offset+4)
+		}
+		offset += 10 + int(byteToUint16(msg[offset+8:offset+10]))
+		if offset > len(msg) {
+			return nil, fmt.Errorf("dns record is too short")
+		}
+	}
+	return offsets, nil
+}
+
+// 応答のAnswerセクションのレコードを読む
+func dnsReadAnswers(msg []byte) ([]dnsRecord, error) {
+	_, offset, err := dnsReadQuestion(msg)
+	if err != nil {
+		return nil, err
+	}
+	var records []dnsRecord
+	for i := 0; i < int(byteToUint16(msg[6:8])); i++ {
+		_, offset, err = dnsReadName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, fmt.Errorf("dns record is too short")
+		}
+		length := int(byteToUint16(msg[offset+8 : offset+10]))
+		if offset+10+length > len(msg) {
+			return nil, fmt.Errorf("dns record is too short")
+		}
+		records = append(records, dnsRecord{
+			rtype: byteToUint16(msg[offset : offset+2]),
+			ttl:   byteToUint32(msg[offset+4 : offset+8]),
+			data:  msg[offset+10 : offset+10+length],
+		})
+		offset += 10 + length
+	}
+	return records, nil
+}
+
+// 応答のヘッダを作る
+func dnsResponseHeader(id, flags uint16, qdcount, ancount uint16) []byte {
+	header := uint16ToByte(id)
+	header = append(header, uint16ToByte(flags)...)
+	header = append(header, uint16ToByte(qdcount)...)
+	header = append(header, uint16ToByte(ancount)...)
+	header = append(header, 0x00, 0x00, 0x00, 0x00)
+	return header
+}
+
+// 問い合わせに答えの無い応答を返す
+func dnsErrorResponse(query []byte, questionEnd int, rcode uint16) []byte {
+	flags := DNS_FLAG_QR | DNS_FLAG_RA | byteToUint16(query[2:4])&DNS_FLAG_RD | rcode
+	response := dnsResponseHeader(byteToUint16(query[0:2]), flags, 1, 0)
+	return append(response, query[DNS_HEADER_LEN:questionEnd]...)
+}
+
+// 静的なホストの表から応答を作る
+func dnsStaticResponse(query []byte, questionEnd int, question dnsQuestion, addr uint32) []byte {
+	flags := DNS_FLAG_QR | DNS_FLAG_RA | byteToUint16(query[2:4])&DNS_FLAG_RD
+	// Aレコード以外の問い合わせには答えの無い応答を返す
+	if question.qtype != DNS_TYPE_A || question.qclass != DNS_CLASS_IN {
+		response := dnsResponseHeader(byteToUint16(query[0:2]), flags, 1, 0)
+		return append(response, query[DNS_HEADER_LEN:questionEnd]...)
+	}
+	response := dnsResponseHeader(byteToUint16(query[0:2]), flags, 1, 1)
+	response = append(response, query[DNS_HEADER_LEN:questionEnd]...)
+	// 名前は問い合わせの名前へのポインタにする
+	response = append(response, 0xc0, DNS_HEADER_LEN)
+	response = append(response, uint16ToByte(DNS_TYPE_A)...)
+	response = append(response, uint16ToByte(DNS_CLASS_IN)...)
+	response = append(response, uint32ToByte(DNS_STATIC_HOST_TTL)...)
+	response = append(response, uint16ToByte(IP_ADDRESS_LEN)...)
+	response = append(response, uint32ToByte(addr)...)
+	return response
+}
+
+// 問い合わせのタイプを書き換えたものを作る
+func dnsChangeQuestionType(query []byte, questionEnd int, qtype uint16) []byte {
+	changed := make([]byte, questionEnd)
+	copy(changed, query[:questionEnd])
+	copy(changed[questionEnd-4:questionEnd-2], uint16ToByte(qtype))
+	return changed
+}
+
+/*
+DNS64でAの問い合わせの応答からAAAAの問い合わせの応答を作る
+AレコードのIPv4アドレスを64:ff9b::/96に埋め込み、名前は問い合わせの名前へのポインタにする
+CNAMEなどA以外のレコードは含めない
+*/
+func dns64Synthesize(query []byte, questionEnd int, aResponse []byte) []byte {
+	records, _ := dnsReadAnswers(aResponse)
+	var answers []byte
+	count := uint16(0)
+	for _, record := range records {
+		if record.rtype != DNS_TYPE_A || len(record.data) != IP_ADDRESS_LEN {
+			continue
+		}
+		addr := nat64Addr(byteToUint32(record.data))
+		answers = append(answers, 0xc0, DNS_HEADER_LEN)
+		answers = append(answers, uint16ToByte(DNS_TYPE_AAAA)...)
+		answers = append(answers, uint16ToByte(DNS_CLASS_IN)...)
+		answers = append(answers, uint32ToByte(record.ttl)...)
+		answers = append(answers, uint16ToByte(uint16(len(addr)))...)
+		answers = append(answers, addr[:]...)
+		count++
+	}
+	// フラグとRCODEはAの応答のものを使う
+	flags := byteToUint16(aResponse[2:4])
+	response := dnsResponseHeader(byteToUint16(query[0:2]), flags, 1, count)
+	response = append(response, query[DNS_HEADER_LEN:questionEnd]...)
+	return append(response, answers...)
+}
+
+/*
+キャッシュした応答をクライアントに返せる形にする
+IDを問い合わせに合わせ、TTLからキャッシュしてからの時間を引く
+*/
+func dnsCachedResponse(entry *dnsCacheEntry, id uint16, now time.Time) []byte {
+	response := make([]byte, len(entry.response))
+	copy(response, entry.response)
+	copy(response[0:2], uint16ToByte(id))
+	elapsed := uint32(now.Sub(entry.cachedAt) / time.Second)
+	offsets, _ := dnsRecordTTLOffsets(response)
+	for _, offset := range offsets {
+		ttl := byteToUint32(response[offset : offset+4])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		copy(response[offset:offset+4], uint32ToByte(ttl))
+	}
+	return response
+}
+
+// 期限切れのキャッシュと応答の無い問い合わせを消す
+func dnsExpire(now time.Time) {
+	for question, entry := range dnsProxy.cache {
+		if !now.Before(entry.expires) {
+			delete(dnsProxy.cache, question)
+		}
+	}
+	for id, query := range dnsProxy.pending {
+		if !now.Before(query.expires) {
+			delete(dnsProxy.pending, id)
+			// 応答しない上位のサーバは次の問い合わせから別のサーバに切り替える
+			if len(dnsProxy.upstreams) != 0 {
+				dnsProxy.current = (dnsProxy.current + 1) % len(dnsProxy.upstreams)
+			}
+			fmt.Printf("DNS query for %s timed out\n", query.question.name)
+		}
+	}
+}
+
+// LAN側のインターフェイスか、NATの外側では問い合わせを受け付けない
+func dnsServesInterface(netdev *netDevice) bool {
+	return !isNatOutsideDevice(netdev)
+}
+
+/*
+クライアントからの問い合わせの処理
+*/
+func dnsQueryInput(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, msg []byte) {
+	if !dnsServesInterface(inputdev) || ipheader.destAddr == IP_ADDRESS_LIMITED_BROADCAST {
+		countDrop(DROP_REASON_UDP_NO_LISTENER)
+		return
+	}
+	dnsResolve(&dnsPendingQuery{
+		clientAddr: ipheader.srcAddr,
+		clientPort: srcPort,
+		serverAddr: ipheader.destAddr,
+	}, printIPAddr(ipheader.srcAddr), msg)
+}
+
+/*
+IPv6のクライアントからの問い合わせの処理
+応答はリンクローカルアドレスから問い合わせてきたMACアドレスに返す
+*/
+func dnsQueryInput6(ctx *inputContext, srcAddr [16]uint8, srcPort uint16, msg []byte) {
+	if !dnsServesInterface(ctx.netdev) {
+		countDrop(DROP_REASON_UDP_NO_LISTENER)
+		return
+	}
+	dnsResolve(&dnsPendingQuery{
+		clientPort:  srcPort,
+		clientAddr6: srcAddr,
+		clientMac:   ctx.ethHeader.srcAddr,
+		netdev:      ctx.netdev,
+	}, netip.AddrFrom16(srcAddr).String(), msg)
+}
+
+// 問い合わせてきたクライアントに応答を返す
+func dnsReply(client *dnsPendingQuery, response []byte) {
+	if client.netdev != nil {
+		udpv6Output(client.netdev, client.clientAddr6, client.clientMac, DNS_PORT, client.clientPort, 64, response)
+		return
+	}
+	udpOutput(client.serverAddr, client.clientAddr, DNS_PORT, client.clientPort, response)
+}
+
+/*
+問い合わせに静的なホストの表かキャッシュで答え、無ければ上位のサーバに転送する
+clientには問い合わせてきたクライアントを入れておく
+*/
+func dnsResolve(client *dnsPendingQuery, clientName string, msg []byte) {
+	question, questionEnd, err := dnsReadQuestion(msg)
+	if err != nil || byteToUint16(msg[2:4])&DNS_FLAG_QR != 0 {
+		debugPrintf("Drop invalid DNS query from %s\n", clientName)
+		countDrop(DROP_REASON_DNS_INVALID)
+		return
+	}
+	debugPrintf("DNS query for %s type %d from %s\n", question.name, question.qtype, clientName)
+
+	if addr, ok := dnsProxy.hosts[question.name]; ok {
+		if dnsProxy.dns64 && question.qtype == DNS_TYPE_AAAA && question.qclass == DNS_CLASS_IN {
+			aQuery := dnsChangeQuestionType(msg, questionEnd, DNS_TYPE_A)
+			aQuestion := question
+			aQuestion.qtype = DNS_TYPE_A
+			dnsReply(client, dns64Synthesize(msg, questionEnd, dnsStaticResponse(aQuery, questionEnd, aQuestion, addr)))
+			return
+		}
+		dnsReply(client, dnsStaticResponse(msg, questionEnd, question, addr))
+		return
+	}
+
+	now := time.Now()
+	dnsExpire(now)
+	if entry, ok := dnsProxy.cache[question]; ok {
+		debugPrintf("DNS cache hit for %s\n", question.name)
+		dnsReply(client, dnsCachedResponse(entry, byteToUint16(msg[0:2]), now))
+		return
+	}
+	if len(dnsProxy.upstreams) == 0 {
+		dnsReply(client, dnsErrorResponse(msg, questionEnd, DNS_RCODE_REFUSED))
+		return
+	}
+	client.question = question
+	client.clientID = byteToUint16(msg[0:2])
+	dnsForward(client, msg)
+}
+
+/*
+上位のサーバに問い合わせを転送する
+上位のサーバには別のIDで送り、応答が来たら元のIDに戻す
+*/
+func dnsForward(query *dnsPendingQuery, msg []byte) {
+	var id uint16
+	for {
+		id = uint16(rand.Intn(0x10000))
+		if _, ok := dnsProxy.pending[id]; !ok {
+			break
+		}
+	}
+	query.expires = time.Now().Add(DNS_QUERY_TIMEOUT)
+	dnsProxy.pending[id] = query
+	forwarded := make([]byte, len(msg))
+	copy(forwarded, msg)
+	copy(forwarded[0:2], uint16ToByte(id))
+	udpOutput(0, dnsProxy.upstreams[dnsProxy.current], dnsProxy.port, DNS_PORT, forwarded)
+}
+
+/*
+上位のサーバからの応答の処理
+*/
+func dnsResponseInput(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, msg []byte) {
+	if len(msg) < DNS_HEADER_LEN || srcPort != DNS_PORT {
+		countDrop(DROP_REASON_DNS_INVALID)
+		return
+	}
+	id := byteToUint16(msg[0:2])
+	query, ok := dnsProxy.pending[id]
+	// 問い合わせたサーバ以外からの応答は受け取らない
+	if !ok || !containsUint32(dnsProxy.upstreams, ipheader.srcAddr) {
+		debugPrintf("Drop unexpected DNS response from %s\n", printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_DNS_INVALID)
+		return
+	}
+	question, _, err := dnsReadQuestion(msg)
+	if err != nil || question != query.question {
+		countDrop(DROP_REASON_DNS_INVALID)
+		return
+	}
+	delete(dnsProxy.pending, id)
+
+	// DNS64で送ったAの問い合わせの応答から、クライアントのAAAAの問い合わせの応答を作る
+	if query.dns64Query != nil {
+		aaaaQuestion, questionEnd, _ := dnsReadQuestion(query.dns64Query)
+		response := dns64Synthesize(query.dns64Query, questionEnd, msg)
+		debugPrintf("DNS64 synthesized %d records for %s\n", byteToUint16(response[6:8]), aaaaQuestion.name)
+		dnsReply(query, response)
+		dnsCacheResponse(aaaaQuestion, response)
+		return
+	}
+	// AAAAレコードが無ければ、同じ名前のAレコードを問い合わせ直す
+	if dnsProxy.dns64 && question.qtype == DNS_TYPE_AAAA && question.qclass == DNS_CLASS_IN &&
+		byteToUint16(msg[2:4])&0x000f == 0 && !dnsHasRecord(msg, DNS_TYPE_AAAA) {
+		_, questionEnd, _ := dnsReadQuestion(msg)
+		aQuery := dnsChangeQuestionType(msg, questionEnd, DNS_TYPE_A)
+		// クライアントには元のIDで応答を返す
+		copy(aQuery[0:2], uint16ToByte(query.clientID))
+		// 問い合わせのフラグは上位のサーバの応答のものなので、再帰の要求だけ残す
+		copy(aQuery[2:4], uint16ToByte(byteToUint16(msg[2:4])&DNS_FLAG_RD))
+		copy(aQuery[6:12], []byte{0, 0, 0, 0, 0, 0})
+		query.dns64Query = dnsChangeQuestionType(aQuery, questionEnd, DNS_TYPE_AAAA)
+		query.question.qtype = DNS_TYPE_A
+		dnsForward(query, aQuery)
+		return
+	}
+
+	response := make([]byte, len(msg))
+	copy(response, msg)
+	copy(response[0:2], uint16ToByte(query.clientID))
+	dnsReply(query, response)
+	dnsCacheResponse(question, response)
+}
+
+// 応答のAnswerセクションに指定したタイプのレコードがあるか
+func dnsHasRecord(msg []byte, rtype uint16) bool {
+	records, _ := dnsReadAnswers(msg)
+	for _, record := range records {
+		if record.rtype == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+応答をキャッシュする
+期限はレコードのTTLの最小値で、答えが無ければ短い時間だけキャッシュする
+*/
+func dnsCacheResponse(question dnsQuestion, response []byte) {
+	rcode := byteToUint16(response[2:4]) & 0x000f
+	// 切り詰められた応答とサーバのエラーはキャッシュしない
+	if byteToUint16(response[2:4])&0x0200 != 0 || (rcode != 0 && rcode != 3) {
+		return
+	}
+	offsets, err := dnsRecordTTLOffsets(response)
+	if err != nil {
+		return
+	}
+	ttl := DNS_CACHE_MAX_TTL
+	if len(offsets) == 0 || byteToUint16(response[6:8]) == 0 {
+		ttl = DNS_NEGATIVE_CACHE_TTL
+	}
+	for _, offset := range offsets {
+		if t := time.Duration(byteToUint32(response[offset:offset+4])) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	if len(dnsProxy.cache) >= DNS_CACHE_SIZE {
+		// 一杯なら適当に1つ消す
+		for q := range dnsProxy.cache {
+			delete(dnsProxy.cache, q)
+			break
+		}
+	}
+	now := time.Now()
+	dnsProxy.cache[question] = &dnsCacheEntry{
+		response: response,
+		cachedAt: now,
+		expires:  now.Add(ttl),
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+/*
+パケットを破棄した理由ごとのカウンタ
+pingが通らない時に、どこでパケットが捨てられているかを管理APIから確認できるようにする
+*/
+type dropReason uint8
+
+const (
+	DROP_REASON_FRAME_TOO_SHORT        dropReason = iota // イーサネットヘッダより短い
+	DROP_REASON_NOT_FOR_US                               // 宛先MACアドレスが自分でもブロードキャストでもない
+	DROP_REASON_UNSUPPORTED_ETHER_TYPE                   // ARPとIPv4以外のイーサタイプ
+	DROP_REASON_ARP_TOO_SHORT                            // ARPパケットが短い
+	DROP_REASON_ARP_BAD_ADDRESS_LEN                      // ARPのアドレス長が不正
+	DROP_REASON_NO_IP_ADDRESS                            // IPアドレスのついていないインターフェイスで受信
+	DROP_REASON_IP_TOO_SHORT                             // IPヘッダより短い
+	DROP_REASON_IP_BAD_VERSION                           // IPv4ではない
+	DROP_REASON_IP_OPTIONS                               // IPヘッダオプションがついている
+	DROP_REASON_IP_BAD_LENGTH                            // IPパケットの全長が不正
+	DROP_REASON_IP_BAD_CHECKSUM                          // IPヘッダのチェックサムが不正
+	DROP_REASON_ACL_DENIED                               // ACLで拒否された
+	DROP_REASON_UNSUPPORTED_PROTOCOL                     // 自分宛てのICMP以外のプロトコル
+	DROP_REASON_ICMP_TOO_SHORT                           // ICMPメッセージが短い
+	DROP_REASON_ICMP_BAD_CHECKSUM                        // ICMPのチェックサムが不正
+	DROP_REASON_NO_ROUTE                                 // 宛先への経路がない
+	DROP_REASON_TTL_EXCEEDED                             // TTLが尽きた
+	DROP_REASON_NEXTHOP_UNREACHABLE                      // NextHopへの直接接続の経路がない
+	DROP_REASON_ARP_UNRESOLVED                           // ARPの解決待ち
+	DROP_REASON_HOST_UNREACHABLE                         // ARPに応答がなく到達不能
+	DROP_REASON_IGMP_INVALID                             // IGMPメッセージが短いかチェックサムが不正
+	DROP_REASON_MULTICAST_NOT_JOINED                     // 参加していないマルチキャストグループ宛て
+	DROP_REASON_NO_MULTICAST_MEMBER                      // フォワード先にグループのメンバーがいない
+	DROP_REASON_LLDP_INVALID                             // LLDPDUに必須のTLVがない
+	DROP_REASON_STP_INVALID                              // BPDUが短いか形式が不正
+	DROP_REASON_STP_BLOCKED                              // STPでブロックしているブリッジのポートで受信
+	DROP_REASON_POLICED                                  // 受信のポリシングのレートを超えた
+	DROP_REASON_TX_QUEUE_FULL                            // シェーピングの送信キューが溢れた
+	DROP_REASON_UDP_INVALID                              // UDPデータグラムが短いかチェックサムが不正
+	DROP_REASON_UDP_NO_LISTENER                          // 宛先ポートで待っているサービスがない
+	DROP_REASON_DNS_INVALID                              // DNSメッセージが不正か問い合わせていない応答
+	DROP_REASON_NTP_INVALID                              // NTPメッセージが不正か問い合わせていない応答
+	DROP_REASON_VRRP_INVALID                             // VRRPアドバタイズメントが不正か知らない仮想ルータのもの
+	DROP_REASON_PPPOE_INVALID                            // PPPoEのフレームが不正か今のセッションのものでない
+	DROP_REASON_PPPOE_DOWN                               // PPPoEのセッションでIPを送受信できない
+	DROP_REASON_PPPOE_TOO_BIG                            // PPPoEのセッションのMRUを超える
+	DROP_REASON_ESP_INVALID                              // ESPのパケットが不正か知らないSPI、トンネルの経路にない送信元
+	DROP_REASON_ESP_REPLAYED                             // ESPのシーケンス番号が受信済みかウィンドウより古い
+	DROP_REASON_ESP_AUTH_FAILED                          // ESPの認証タグが一致しない
+	DROP_REASON_ESP_TOO_BIG                              // IPsecのトンネルのMTUを超える
+	DROP_REASON_ARP_UNSOLICITED                          // リクエストしていないサブネット外のアドレスのARPリプライ
+	DROP_REASON_ARP_SPOOFED                              // 自分のアドレスか静的なエントリと違うMACアドレスのARPリプライ
+	DROP_REASON_SNMP_INVALID                             // SNMPメッセージが不正かコミュニティ名が違う
+	DROP_REASON_TX_ERROR                                 // デバイスへの送信に失敗した
+	DROP_REASON_INTERFACE_DOWN                           // 送信するインターフェイスが止められているかリンクが落ちている
+	DROP_REASON_BLACKHOLE_ROUTE                          // 宛先への経路がブラックホール
+	DROP_REASON_REJECT_ROUTE                             // 宛先への経路がリジェクト
+	DROP_REASON_URPF_FAILED                              // uRPFで送信元アドレスへの戻りの経路が無い
+	DROP_REASON_NDP_INVALID                              // ホップリミットかチェックサムが不正な近隣探索のメッセージ
+	DROP_REASON_DHCPV6_INVALID                           // DHCPv6のメッセージが不正か自分宛てでない
+	DROP_REASON_NAT64_UNTRANSLATABLE                     // NAT64で変換できないパケットか、セッションを作れない
+	DROP_REASON_PORT_SECURITY                            // ポートセキュリティの違反で学習できない送信元MACアドレス
+	DROP_REASON_IMPAIRMENT_LOSS                          // 送信の損失のエミュレーションで捨てた
+	DROP_REASON_COUNT
+)
+
+var dropReasonNames = [DROP_REASON_COUNT]string{
+	DROP_REASON_FRAME_TOO_SHORT:        "frame_too_short",
+	DROP_REASON_NOT_FOR_US:             "not_for_us",
+	DROP_REASON_UNSUPPORTED_ETHER_TYPE: "unsupported_ether_type",
+	DROP_REASON_ARP_TOO_SHORT:          "arp_too_short",
+	DROP_REASON_ARP_BAD_ADDRESS_LEN:    "arp_bad_address_len",
+	DROP_REASON_NO_IP_ADDRESS:          "no_ip_address",
+	DROP_REASON_IP_TOO_SHORT:           "ip_too_short",
+	DROP_REASON_IP_BAD_VERSION:         "ip_bad_version",
+	DROP_REASON_IP_OPTIONS:             "ip_options",
+	DROP_REASON_IP_BAD_LENGTH:          "ip_bad_length",
+	DROP_REASON_IP_BAD_CHECKSUM:        "ip_bad_checksum",
+	DROP_REASON_ACL_DENIED:             "acl_denied",
+	DROP_REASON_UNSUPPORTED_PROTOCOL:   "unsupported_protocol",
+	DROP_REASON_ICMP_TOO_SHORT:         "icmp_too_short",
+	DROP_REASON_ICMP_BAD_CHECKSUM:      "icmp_bad_checksum",
+	DROP_REASON_NO_ROUTE:               "no_route",
+	DROP_REASON_TTL_EXCEEDED:           "ttl_exceeded",
+	DROP_REASON_NEXTHOP_UNREACHABLE:    "nexthop_unreachable",
+	DROP_REASON_ARP_UNRESOLVED:         "arp_unresolved",
+	DROP_REASON_HOST_UNREACHABLE:       "host_unreachable",
+	DROP_REASON_IGMP_INVALID:           "igmp_invalid",
+	DROP_REASON_MULTICAST_NOT_JOINED:   "multicast_not_joined",
+	DROP_REASON_NO_MULTICAST_MEMBER:    "no_multicast_member",
+	DROP_REASON_LLDP_INVALID:           "lldp_invalid",
+	DROP_REASON_STP_INVALID:            "stp_invalid",
+	DROP_REASON_STP_BLOCKED:            "stp_blocked",
+	DROP_REASON_POLICED:                "policed",
+	DROP_REASON_TX_QUEUE_FULL:          "tx_queue_full",
+	DROP_REASON_UDP_INVALID:            "udp_invalid",
+	DROP_REASON_UDP_NO_LISTENER:        "udp_no_listener",
+	DROP_REASON_DNS_INVALID:            "dns_invalid",
+	DROP_REASON_NTP_INVALID:            "ntp_invalid",
+	DROP_REASON_VRRP_INVALID:           "vrrp_invalid",
+	DROP_REASON_PPPOE_INVALID:          "pppoe_invalid",
+	DROP_REASON_PPPOE_DOWN:             "pppoe_down",
+	DROP_REASON_PPPOE_TOO_BIG:          "pppoe_too_big",
+	DROP_REASON_ESP_INVALID:            "esp_invalid",
+	DROP_REASON_ESP_REPLAYED:           "esp_replayed",
+	DROP_REASON_ESP_AUTH_FAILED:        "esp_auth_failed",
+	DROP_REASON_ESP_TOO_BIG:            "esp_too_big",
+	DROP_REASON_ARP_UNSOLICITED:        "arp_unsolicited",
+	DROP_REASON_ARP_SPOOFED:            "arp_spoofed",
+	DROP_REASON_SNMP_INVALID:           "snmp_invalid",
+	DROP_REASON_TX_ERROR:               "tx_error",
+	DROP_REASON_INTERFACE_DOWN:         "interface_down",
+	DROP_REASON_BLACKHOLE_ROUTE:        "blackhole_route",
+	DROP_REASON_REJECT_ROUTE:           "reject_route",
+	DROP_REASON_URPF_FAILED:            "urpf_failed",
+	DROP_REASON_NDP_INVALID:            "ndp_invalid",
+	DROP_REASON_DHCPV6_INVALID:         "dhcpv6_invalid",
+	DROP_REASON_NAT64_UNTRANSLATABLE:   "nat64_untranslatable",
+	DROP_REASON_PORT_SECURITY:          "port_security",
+	DROP_REASON_IMPAIRMENT_LOSS:        "impairment_loss",
+}
+
+// 理由ごとの破棄したパケットの数、routerMutexで保護する
+var dropCounters [DROP_REASON_COUNT]uint64
+
+func (reason dropReason) String() string {
+	return dropReasonNames[reason]
+}
+
+// 受信処理の関数はパケットを破棄した理由をエラーとして返す
+func (reason dropReason) Error() string {
+	return "drop packet : " + dropReasonNames[reason]
+}
+
+// パケットを破棄したことを記録して、理由をエラーとして返す
+func dropPacket(reason dropReason) error {
+	countDrop(reason)
+	return reason
+}
+
+// パケットを破棄したことを記録し、処理中のパケットなら破棄のイベントを送る
+func countDrop(reason dropReason) {
+	dropCounters[reason]++
+	tracef("dropped: %s", dropReasonNames[reason])
+	publishDropEvent(reason)
+}
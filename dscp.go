@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+受信したIPパケットのDSCPの書き換え(リマーキング)
+インターフェイスごとのルールを上から順に評価して、最初に一致したルールのDSCPに書き換える
+どのルールにも一致しなかったパケットはそのまま通す
+送信側のシェーピングの送信キューはDSCPで分けるので、ホストがつけたDSCPに関係なく
+特定の通信を優先させたり後回しにしたりする実験ができる
+ECNの下位2bitは残し、IPヘッダのチェックサムを計算し直す
+*/
+
+type dscpRule struct {
+	srcPrefix    uint32
+	srcPrefixLen uint32
+	dstPrefix    uint32
+	dstPrefixLen uint32
+	protocol     uint8  // 0なら全てのプロトコル
+	srcPort      uint16 // 0なら全てのポート番号、TCPとUDPだけ
+	dstPort      uint16
+	dscp         uint8 // 書き換えるDSCP
+}
+
+// インターフェイス名ごとの受信時のDSCPのポリシー
+var ingressDscpPolicies = map[string][]dscpRule{}
+
+// DSCPの名前、Class SelectorとAssured Forwarding、Expedited Forwarding
+var dscpNames = map[string]uint8{
+	"default": 0, "cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// "ef"や"af41"の名前か0から63の数字のDSCPを読む
+func parseDscp(s string) (uint8, error) {
+	if dscp, ok := dscpNames[s]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || 63 < dscp {
+		return 0, fmt.Errorf("invalid dscp %q", s)
+	}
+	return uint8(dscp), nil
+}
+
+func (rule dscpRule) match(ipheader *ipHeader, packet []byte) bool {
+	if rule.protocol != 0 && rule.protocol != ipheader.protocol {
+		return false
+	}
+	if !prefixContains(rule.srcPrefix, rule.srcPrefixLen, ipheader.srcAddr) ||
+		!prefixContains(rule.dstPrefix, rule.dstPrefixLen, ipheader.destAddr) {
+		return false
+	}
+	if rule.srcPort == 0 && rule.dstPort == 0 {
+		return true
+	}
+	// 先頭以外のフラグメントにはポート番号が無い
+	if ipheader.protocol != IP_PROTOCOL_NUM_TCP && ipheader.protocol != IP_PROTOCOL_NUM_UDP ||
+		ipheader.fragOffset&0x1fff != 0 {
+		return false
+	}
+	srcPort, dstPort, ok := natPorts(packet)
+	if !ok {
+		return false
+	}
+	return (rule.srcPort == 0 || rule.srcPort == srcPort) && (rule.dstPort == 0 || rule.dstPort == dstPort)
+}
+
+/*
+受信したパケットのDSCPをポリシーに従って書き換える
+ポリシーが設定されていないインターフェイスでは何もしない
+*/
+func dscpRemark(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+	rules, ok := ingressDscpPolicies[inputdev.name]
+	if !ok || !isDefaultInstanceDevice(inputdev) {
+		return
+	}
+	for _, rule := range rules {
+		if !rule.match(ipheader, packet) {
+			continue
+		}
+		if packet[1]>>2 != rule.dscp {
+			tracef("dscp: remarked from %d to %d", packet[1]>>2, rule.dscp)
+			packet[1] = rule.dscp<<2 | packet[1]&0x03
+			ipheader.tos = packet[1]
+			setIPHeaderChecksum(packet)
+			inputdev.stats.dscpRemarked++
+		}
+		return
+	}
+}
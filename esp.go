@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+IPsec ESPのトンネルモード
+対向のgo-curoと静的に決めたSPIとAES-GCMの鍵で、IPパケットを暗号化してIPにカプセル化する
+対向の先にあるネットワークの経路をトンネルに向けてradix treeに入れる
+鍵交換(IKE)はまだ無いので、鍵とSPIは両方のルータに手で設定する
+鍵が変わらないので、GCMのIVはSAを作る時に乱数で決めた値にシーケンス番号を足して、再起動しても同じノンスを使わないようにする
+送信のシーケンス番号は-state-fileで書き出して次の起動で続きから使う、状態を書き出せずに再起動した時は
+対向がリプレイとして捨ててしまうので、両方のルータでSPIを変えてSAを作り直す
+https://www.rfc-editor.org/rfc/rfc4303 (ESP)
+https://www.rfc-editor.org/rfc/rfc4106 (ESPでのAES-GCM)
+*/
+
+const IP_PROTOCOL_NUM_ESP uint8 = 50
+
+// SPIとシーケンス番号
+const ESP_HEADER_LEN = 8
+
+// AES-GCMの明示的なIVと認証タグ(ICV)の長さ
+const ESP_IV_LEN = 8
+const ESP_ICV_LEN = 16
+
+// 鍵の後ろにつけるソルトの長さ、ソルトとIVをつなげてGCMのノンスにする
+const ESP_SALT_LEN = 4
+
+// トレーラの次のヘッダ、トンネルモードなので中身はIPv4のパケット
+const (
+	ESP_NEXT_HEADER_IPV4 uint8 = 4
+	ESP_NEXT_HEADER_NONE uint8 = 59 // トラフィックを隠すためのダミー
+)
+
+// 外側のIPヘッダとESPのヘッダ、IV、パディング長と次のヘッダ、ICVを足して1500バイトに収まる大きさ
+// パディングが要らないように4の倍数から2を引いた値にしておく
+const ESP_TUNNEL_MTU = 1500 - 20 - ESP_HEADER_LEN - ESP_IV_LEN - 2 - ESP_ICV_LEN
+
+// アンチリプレイのウィンドウの大きさ
+const ESP_REPLAY_WINDOW = 64
+
+// 0から255のSPIは予約されている
+const ESP_MIN_SPI = 256
+
+type espRoute struct {
+	prefix    uint32
+	prefixLen uint32
+}
+
+// 対向ごとのトンネルの設定、鍵はソルトを含めた生のバイト列
+type espTunnelConfig struct {
+	peer   uint32
+	spiOut uint32
+	keyOut string
+	spiIn  uint32
+	keyIn  string
+	routes []espRoute
+}
+
+// 一方向のSA(Security Association)
+type espSA struct {
+	spi  uint32
+	aead cipher.AEAD
+	salt []byte
+	// 送信では最後に送ったシーケンス番号、受信では受け取った中で一番大きいもの
+	seq uint32
+	// 受信したシーケンス番号のビットマップ、最下位ビットがseq
+	window uint64
+	// 送信するIVの元になる乱数、シーケンス番号を足してIVにする
+	ivBase uint64
+}
+
+type espTunnelStats struct {
+	txPackets    uint64
+	rxPackets    uint64
+	authFailures uint64 // 認証タグが合わずに破棄した数
+	replayed     uint64 // 同じシーケンス番号か古すぎて破棄した数
+}
+
+type espTunnel struct {
+	config espTunnelConfig
+	out    espSA
+	in     espSA
+	stats  espTunnelStats
+}
+
+var espTunnels []*espTunnel
+
+// コマンドラインで指定されたトンネル
+var espTunnelConfigs []espTunnelConfig
+
+/*
+"peer=192.168.0.2,spi-out=0x1001,key-out=...,spi-in=0x2001,key-in=...,routes=192.168.2.0/24+192.168.3.0/24"を読む
+鍵はAES-128/192/256の鍵に4バイトのソルトをつけた16進数
+*/
+func parseEspTunnelConfig(spec string) (espTunnelConfig, error) {
+	var peer, spiOut, keyOut, spiIn, keyIn string
+	var routes []string
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return espTunnelConfig{}, fmt.Errorf("invalid ipsec config %q, format is peer=address,spi-out=spi,key-out=hex,spi-in=spi,key-in=hex,routes=prefix+prefix", spec)
+		}
+		switch key {
+		case "peer":
+			peer = value
+		case "spi-out":
+			spiOut = value
+		case "key-out":
+			keyOut = value
+		case "spi-in":
+			spiIn = value
+		case "key-in":
+			keyIn = value
+		case "routes":
+			routes = strings.Split(value, "+")
+		default:
+			return espTunnelConfig{}, fmt.Errorf("unknown ipsec config %q", key)
+		}
+	}
+	outSpi, err := strconv.ParseUint(spiOut, 0, 32)
+	if err != nil {
+		return espTunnelConfig{}, fmt.Errorf("invalid spi %q", spiOut)
+	}
+	inSpi, err := strconv.ParseUint(spiIn, 0, 32)
+	if err != nil {
+		return espTunnelConfig{}, fmt.Errorf("invalid spi %q", spiIn)
+	}
+	return newEspTunnelConfig(peer, uint32(outSpi), keyOut, uint32(inSpi), keyIn, routes)
+}
+
+// 値を確認してトンネルの設定を作る
+func newEspTunnelConfig(peer string, spiOut uint32, keyOut string, spiIn uint32, keyIn string, routes []string) (espTunnelConfig, error) {
+	peerAddr, err := parseIPAddr(peer)
+	if err != nil {
+		return espTunnelConfig{}, err
+	}
+	config := espTunnelConfig{peer: peerAddr, spiOut: spiOut, spiIn: spiIn}
+	if spiOut < ESP_MIN_SPI || spiIn < ESP_MIN_SPI {
+		return espTunnelConfig{}, fmt.Errorf("spi must be %d or larger", ESP_MIN_SPI)
+	}
+	for _, key := range []struct {
+		hex string
+		raw *string
+	}{{keyOut, &config.keyOut}, {keyIn, &config.keyIn}} {
+		b, err := hex.DecodeString(key.hex)
+		if err != nil {
+			return espTunnelConfig{}, fmt.Errorf("invalid ipsec key : %s", err)
+		}
+		switch len(b) - ESP_SALT_LEN {
+		case 16, 24, 32:
+		default:
+			return espTunnelConfig{}, fmt.Errorf("ipsec key must be 20, 28 or 36 bytes (aes key and 4 bytes salt), got %d", len(b))
+		}
+		*key.raw = string(b)
+	}
+	if len(routes) == 0 {
+		return espTunnelConfig{}, fmt.Errorf("ipsec tunnel to %s has no routes", peer)
+	}
+	for _, route := range routes {
+		prefix, prefixLen, err := parsePrefix(route)
+		if err != nil {
+			return espTunnelConfig{}, err
+		}
+		// 対向へのパケットまでトンネルに入るとカプセル化できない
+		if prefixContains(prefix, prefixLen, peerAddr) {
+			return espTunnelConfig{}, fmt.Errorf("ipsec route %s contains peer %s", route, peer)
+		}
+		config.routes = append(config.routes, espRoute{prefix: prefix, prefixLen: prefixLen})
+	}
+	return config, nil
+}
+
+func newEspSA(spi uint32, key string) (espSA, error) {
+	// 鍵の長さは設定を読む時に確認している
+	block, _ := aes.NewCipher([]byte(key[:len(key)-ESP_SALT_LEN]))
+	aead, _ := cipher.NewGCM(block)
+	ivBase := make([]byte, ESP_IV_LEN)
+	if _, err := rand.Read(ivBase); err != nil {
+		return espSA{}, fmt.Errorf("generate ipsec iv err : %s", err)
+	}
+	return espSA{spi: spi, aead: aead, salt: []byte(key[len(key)-ESP_SALT_LEN:]), ivBase: binary.BigEndian.Uint64(ivBase)}, nil
+}
+
+// SPIと鍵が同じならSAを引き継いで、シーケンス番号をやり直さないようにする
+func sameEspSAs(a, b espTunnelConfig) bool {
+	return a.peer == b.peer && a.spiOut == b.spiOut && a.keyOut == b.keyOut && a.spiIn == b.spiIn && a.keyIn == b.keyIn
+}
+
+/*
+トンネルを設定して経路を入れ替える
+*/
+func setEspTunnels(configs []espTunnelConfig) {
+	var tunnels []*espTunnel
+	for _, config := range configs {
+		var tunnel *espTunnel
+		for _, old := range espTunnels {
+			if sameEspSAs(old.config, config) {
+				tunnel = old
+				break
+			}
+		}
+		if tunnel == nil {
+			out, err := newEspSA(config.spiOut, config.keyOut)
+			if err != nil {
+				fmt.Printf("IPsec tunnel to %s is not added : %s\n", printIPAddr(config.peer), err)
+				continue
+			}
+			in, err := newEspSA(config.spiIn, config.keyIn)
+			if err != nil {
+				fmt.Printf("IPsec tunnel to %s is not added : %s\n", printIPAddr(config.peer), err)
+				continue
+			}
+			tunnel = &espTunnel{out: out, in: in}
+			fmt.Printf("IPsec tunnel to %s is added, spi out 0x%08x in 0x%08x\n",
+				printIPAddr(config.peer), config.spiOut, config.spiIn)
+		}
+		tunnel.config = config
+		tunnels = append(tunnels, tunnel)
+	}
+
+	// 古いトンネルに向いている経路を消してから新しい経路を入れる
+	for _, tunnel := range espTunnels {
+		for _, route := range tunnel.config.routes {
+			deleteEspRoute(tunnel, route)
+		}
+		if !containsEspTunnel(tunnels, tunnel) {
+			fmt.Printf("IPsec tunnel to %s is deleted\n", printIPAddr(tunnel.config.peer))
+		}
+	}
+	espTunnels = tunnels
+	for _, tunnel := range espTunnels {
+		for _, route := range tunnel.config.routes {
+			ribAddRoute(route.prefix, route.prefixLen, ipRouteEntry{iptype: ipsec, tunnel: tunnel, source: routeSourceIpsec})
+			fmt.Printf("Set route %s/%d via ipsec tunnel to %s\n",
+				printIPAddr(route.prefix), route.prefixLen, printIPAddr(tunnel.config.peer))
+		}
+	}
+}
+
+func containsEspTunnel(tunnels []*espTunnel, tunnel *espTunnel) bool {
+	for _, t := range tunnels {
+		if t == tunnel {
+			return true
+		}
+	}
+	return false
+}
+
+// トンネルに向けた経路をRIBから消す
+func deleteEspRoute(tunnel *espTunnel, route espRoute) {
+	ribDeleteRoute(route.prefix, route.prefixLen, ipRouteEntry{source: routeSourceIpsec, tunnel: tunnel})
+}
+
+/*
+書き出したシーケンス番号を読み戻す
+送信は前回の続きから使い、受信は前回受け取ったパケットをリプレイとして捨てる
+今の方が進んでいれば何もしない
+*/
+func restoreEspSequence(peer, spiOut, seqOut, spiIn, seqIn uint32, window uint64) bool {
+	for _, tunnel := range espTunnels {
+		if tunnel.config.peer != peer {
+			continue
+		}
+		restored := false
+		if tunnel.out.spi == spiOut && tunnel.out.seq < seqOut {
+			tunnel.out.seq = seqOut
+			restored = true
+		}
+		if tunnel.in.spi == spiIn && tunnel.in.seq < seqIn {
+			tunnel.in.seq = seqIn
+			tunnel.in.window = window
+			restored = true
+		}
+		return restored
+	}
+	return false
+}
+
+func searchEspTunnelBySpi(spi uint32) *espTunnel {
+	for _, tunnel := range espTunnels {
+		if tunnel.in.spi == spi {
+			return tunnel
+		}
+	}
+	return nil
+}
+
+// GCMのノンスはソルトとIVをつなげたもの
+func (sa *espSA) nonce(iv []byte) []byte {
+	return append(append([]byte{}, sa.salt...), iv...)
+}
+
+// 受け取ったことがなく、ウィンドウより古くないシーケンス番号か
+func (sa *espSA) checkReplay(seq uint32) bool {
+	if seq == 0 {
+		return false
+	}
+	if seq > sa.seq {
+		return true
+	}
+	diff := sa.seq - seq
+	if diff >= ESP_REPLAY_WINDOW {
+		return false
+	}
+	return sa.window&(1<<diff) == 0
+}
+
+// 認証できたパケットのシーケンス番号をウィンドウに記録する
+func (sa *espSA) updateReplay(seq uint32) {
+	if seq > sa.seq {
+		shift := seq - sa.seq
+		if shift >= ESP_REPLAY_WINDOW {
+			sa.window = 1
+		} else {
+			sa.window = sa.window<<shift | 1
+		}
+		sa.seq = seq
+		return
+	}
+	sa.window |= 1 << (sa.seq - seq)
+}
+
+/*
+IPパケットを暗号化してトンネルに送る
+トンネルのMTUを超える大きさは分割せずに破棄して、DFがついていれば送信元にICMPで知らせる
+*/
+func espOutput(tunnel *espTunnel, packet []byte) error {
+	if len(packet) > ESP_TUNNEL_MTU {
+		srcAddr := byteToUint32(packet[12:16])
+		if byteToUint16(packet[6:8])&(1<<14) != 0 && !isOurIPAddr(srcAddr) {
+			sendIcmpFragmentationNeeded(ipSourceAddr(srcAddr), ESP_TUNNEL_MTU, packet)
+		}
+		return dropPacket(DROP_REASON_ESP_TOO_BIG)
+	}
+	// 対向への経路がトンネルに向いているとカプセル化を繰り返してしまう
+	peer := tunnel.config.peer
+	if route, ok := iproute.radixTreeSearch(peer); !ok || route.iptype == ipsec {
+		fmt.Printf("No route to ipsec peer %s\n", printIPAddr(peer))
+		return dropPacket(DROP_REASON_NO_ROUTE)
+	}
+	srcAddr := ipSourceAddr(peer)
+	if srcAddr == 0 {
+		return dropPacket(DROP_REASON_NO_ROUTE)
+	}
+	sa := &tunnel.out
+	// シーケンス番号を使い切ったら、同じノンスを使わないように鍵を変えるまで送らない
+	if sa.seq == 0xffffffff {
+		fmt.Printf("Sequence number of ipsec spi 0x%08x is exhausted\n", sa.spi)
+		return dropPacket(DROP_REASON_ESP_INVALID)
+	}
+	sa.seq++
+
+	header := append(uint32ToByte(sa.spi), uint32ToByte(sa.seq)...)
+	// IVはSAの中で重ならなければよいので、乱数にシーケンス番号を足す
+	iv := make([]byte, ESP_IV_LEN)
+	binary.BigEndian.PutUint64(iv, sa.ivBase+uint64(sa.seq))
+	plaintext := append([]byte{}, packet...)
+	padLen := (4 - (len(packet)+2)%4) % 4
+	for i := 1; i <= padLen; i++ {
+		plaintext = append(plaintext, uint8(i))
+	}
+	plaintext = append(plaintext, uint8(padLen), ESP_NEXT_HEADER_IPV4)
+
+	esp := append(header, iv...)
+	esp = sa.aead.Seal(esp, sa.nonce(iv), plaintext, header)
+	tunnel.stats.txPackets++
+	tracef("ipsec: encrypted with spi 0x%08x seq %d to peer %s", sa.spi, sa.seq, printIPAddr(peer))
+	return ipPacketEncapsulateOutput(peer, srcAddr, esp, IP_PROTOCOL_NUM_ESP)
+}
+
+func init() {
+	registerIPProtocol(IP_PROTOCOL_NUM_ESP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		espInput(ctx.netdev, ipheader, packet)
+		return nil
+	})
+}
+
+/*
+ESPのパケットの受信処理
+SPIでトンネルを探し、リプレイでないことと認証タグを確認して復号する
+*/
+func espInput(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+	if len(packet) < ESP_HEADER_LEN+ESP_IV_LEN+ESP_ICV_LEN {
+		countDrop(DROP_REASON_ESP_INVALID)
+		return
+	}
+	spi := byteToUint32(packet[0:4])
+	seq := byteToUint32(packet[4:8])
+	tunnel := searchEspTunnelBySpi(spi)
+	if tunnel == nil || ipheader.srcAddr != tunnel.config.peer {
+		debugPrintf("Drop ESP packet with unknown spi 0x%08x from %s\n", spi, printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_ESP_INVALID)
+		return
+	}
+	sa := &tunnel.in
+	if !sa.checkReplay(seq) {
+		debugPrintf("Drop replayed ESP packet with sequence %d from %s\n", seq, printIPAddr(ipheader.srcAddr))
+		tunnel.stats.replayed++
+		countDrop(DROP_REASON_ESP_REPLAYED)
+		return
+	}
+	iv := packet[ESP_HEADER_LEN : ESP_HEADER_LEN+ESP_IV_LEN]
+	plaintext, err := sa.aead.Open(nil, sa.nonce(iv), packet[ESP_HEADER_LEN+ESP_IV_LEN:], packet[:ESP_HEADER_LEN])
+	if err != nil {
+		debugPrintf("Drop ESP packet with invalid icv from %s\n", printIPAddr(ipheader.srcAddr))
+		tunnel.stats.authFailures++
+		countDrop(DROP_REASON_ESP_AUTH_FAILED)
+		return
+	}
+	// 認証できてからウィンドウを進める
+	sa.updateReplay(seq)
+
+	if len(plaintext) < 2 || len(plaintext) < 2+int(plaintext[len(plaintext)-2]) {
+		countDrop(DROP_REASON_ESP_INVALID)
+		return
+	}
+	nextHeader := plaintext[len(plaintext)-1]
+	inner := plaintext[:len(plaintext)-2-int(plaintext[len(plaintext)-2])]
+	switch nextHeader {
+	case ESP_NEXT_HEADER_NONE:
+		return
+	case ESP_NEXT_HEADER_IPV4:
+		tunnel.stats.rxPackets++
+		espTunnelInput(inputdev, tunnel, inner)
+	default:
+		countDrop(DROP_REASON_ESP_INVALID)
+	}
+}
+
+/*
+復号した内側のIPパケットを処理する
+送信元がトンネルの経路に含まれていなければ、対向のネットワークからのものではないので破棄する
+*/
+func espTunnelInput(inputdev *netDevice, tunnel *espTunnel, packet []byte) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[0]&0x0f != 5 ||
+		int(byteToUint16(packet[2:4])) > len(packet) || !verifyChecksum(packet[:20]) {
+		countDrop(DROP_REASON_ESP_INVALID)
+		return
+	}
+	packet = packet[:byteToUint16(packet[2:4])]
+	ipheader := ipHeader{
+		version:        4,
+		headerLen:      5,
+		tos:            packet[1],
+		totalLen:       byteToUint16(packet[2:4]),
+		identify:       byteToUint16(packet[4:6]),
+		fragOffset:     byteToUint16(packet[6:8]),
+		ttl:            packet[8],
+		protocol:       packet[9],
+		headerChecksum: byteToUint16(packet[10:12]),
+		srcAddr:        byteToUint32(packet[12:16]),
+		destAddr:       byteToUint32(packet[16:20]),
+	}
+	var permitted bool
+	for _, route := range tunnel.config.routes {
+		if prefixContains(route.prefix, route.prefixLen, ipheader.srcAddr) {
+			permitted = true
+		}
+	}
+	if !permitted {
+		debugPrintf("Drop ESP inner packet from %s not in routes of tunnel to %s\n",
+			printIPAddr(ipheader.srcAddr), printIPAddr(tunnel.config.peer))
+		countDrop(DROP_REASON_ESP_INVALID)
+		return
+	}
+
+	fmt.Printf("Received IP in ipsec tunnel from %s, packet type %d from %s to %s\n", printIPAddr(tunnel.config.peer),
+		ipheader.protocol, printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+	if isOurIPAddr(ipheader.destAddr) {
+		// 取り出したパケットにはイーサネットヘッダが無い
+		ipInputToOurs(&inputContext{netdev: inputdev}, &ipheader, packet[20:])
+		return
+	}
+	ipForward(&inputContext{netdev: inputdev}, &ipheader, packet)
+}
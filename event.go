@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// パケットに対してルータが行ったこと
+const (
+	PACKET_EVENT_RECEIVED  = "received"
+	PACKET_EVENT_LOCAL     = "local"
+	PACKET_EVENT_FORWARDED = "forwarded"
+	PACKET_EVENT_DROPPED   = "dropped"
+)
+
+// 購読者ごとに溜めておくイベントの数
+const PACKET_EVENT_BUFFER_SIZE = 256
+
+/*
+ルータを通過するパケットのイベント
+管理APIから購読して外部のツールに流す
+ブラウザで動く可視化ツールがパケットの通り道をアニメーションにできるように、
+同じパケットのイベントには同じ番号をつけ、フォワードした経路と破棄した理由を入れる
+*/
+type packetEvent struct {
+	timestamp time.Time
+	device    string
+	action    string
+	srcAddr   uint32
+	destAddr  uint32
+	protocol  uint8
+	length    int
+	// 受信したパケットにつける番号、受信から破棄かフォワードまでのイベントで同じ
+	packetID uint64
+	// フォワードした時の出力インターフェイスと一致した経路、NextHop
+	outputDevice string
+	route        string
+	nexthop      uint32
+	// 破棄した時の理由
+	dropReason string
+}
+
+// 処理中の受信したパケット、routerMutexの中で1つずつ処理するのでロックしない
+type currentPacket struct {
+	id       uint64
+	device   string
+	ipheader *ipHeader
+	// debug packetの条件に一致して、処理の段階をログに出すパケットか
+	traced bool
+}
+
+var processingPacket currentPacket
+var packetEventSeq uint64
+
+var packetEventMutex sync.Mutex
+
+// 購読者ごとのサンプリングの間隔、nならn個に1個のパケットのイベントを送る
+var packetEventSubscribers = map[chan packetEvent]uint64{}
+
+/*
+イベントの購読を開始する
+sampleが2以上なら、パケットの番号でsample個に1個のパケットのイベントだけを受け取る
+返り値の関数を呼ぶと購読をやめる
+*/
+func subscribePacketEvents(sample int) (chan packetEvent, func()) {
+	if sample < 1 {
+		sample = 1
+	}
+	ch := make(chan packetEvent, PACKET_EVENT_BUFFER_SIZE)
+	packetEventMutex.Lock()
+	packetEventSubscribers[ch] = uint64(sample)
+	packetEventMutex.Unlock()
+
+	return ch, func() {
+		packetEventMutex.Lock()
+		delete(packetEventSubscribers, ch)
+		packetEventMutex.Unlock()
+	}
+}
+
+/*
+受信したパケットの処理を始める
+受信のイベントを送り、処理が終わるまでの破棄を受信したパケットのものとして送れるようにする
+返り値の関数を呼ぶと処理中のパケットを元に戻す(ESPやPPPoEで中のパケットを処理する時に入れ子になる)
+*/
+func receivePacketEvent(device string, ipheader *ipHeader) func() {
+	prev := processingPacket
+	packetEventSeq++
+	processingPacket = currentPacket{id: packetEventSeq, device: device, ipheader: ipheader,
+		traced: packetTrace.match(device, ipheader)}
+	publishPacketEvent(device, PACKET_EVENT_RECEIVED, ipheader)
+	return func() {
+		processingPacket = prev
+	}
+}
+
+// 受信、自分宛て、マルチキャストのフォワードのイベントを送る
+func publishPacketEvent(device, action string, ipheader *ipHeader) {
+	if !hasPacketEventSubscribers() {
+		return
+	}
+	sendPacketEvent(newPacketEvent(device, action, ipheader))
+}
+
+// フォワードしたイベントを、出力インターフェイスと一致した経路をつけて送る
+func publishForwardEvent(inputdev *netDevice, ipheader *ipHeader, route ipRouteEntry, outputdev *netDevice) {
+	if !hasPacketEventSubscribers() {
+		return
+	}
+	event := newPacketEvent(inputdev.name, PACKET_EVENT_FORWARDED, ipheader)
+	if outputdev != nil {
+		event.outputDevice = outputdev.name
+	}
+	if prefixLen, ok := iproute.radixTreeMatchedPrefixLen(ipheader.destAddr); ok {
+		event.route = fmt.Sprintf("%s/%d", printIPAddr(ipheader.destAddr&prefixMask(prefixLen)), prefixLen)
+	}
+	if route.iptype == network {
+		event.nexthop = route.nexthop
+	}
+	sendPacketEvent(event)
+}
+
+/*
+処理中の受信したパケットを破棄したイベントを送る
+countDropから呼ばれるので、IPヘッダを読む前の破棄やタイマーでの破棄は送らない
+*/
+func publishDropEvent(reason dropReason) {
+	if processingPacket.ipheader == nil || !hasPacketEventSubscribers() {
+		return
+	}
+	event := newPacketEvent(processingPacket.device, PACKET_EVENT_DROPPED, processingPacket.ipheader)
+	event.dropReason = reason.String()
+	sendPacketEvent(event)
+}
+
+func hasPacketEventSubscribers() bool {
+	packetEventMutex.Lock()
+	defer packetEventMutex.Unlock()
+	return len(packetEventSubscribers) != 0
+}
+
+func newPacketEvent(device, action string, ipheader *ipHeader) packetEvent {
+	return packetEvent{
+		timestamp: routerNow(),
+		device:    device,
+		action:    action,
+		srcAddr:   ipheader.srcAddr,
+		destAddr:  ipheader.destAddr,
+		protocol:  ipheader.protocol,
+		length:    int(ipheader.totalLen),
+		packetID:  processingPacket.id,
+	}
+}
+
+/*
+イベントを購読者に送る
+パケットの処理を止めないように、読み出しが追いついていない購読者には送らずに捨てる
+*/
+func sendPacketEvent(event packetEvent) {
+	packetEventMutex.Lock()
+	defer packetEventMutex.Unlock()
+	for ch, sample := range packetEventSubscribers {
+		if event.packetID%sample != 0 {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
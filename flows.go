@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+フローごとの通信量の集計
+フォワードしたIPv4のパケットを送信元と宛先のアドレス、ポート番号、プロトコルの組ごとに数え、
+実験中にルータを通っている通信のうち多いものを管理APIの/top-talkersで確認できるようにする
+表の大きさには上限があり、溢れたら一番長く通信の無いフローから消す(LRU)
+レートは直近の通信ほど重くする指数移動平均で、FLOW_RATE_TIME_CONSTANTほど前の通信は1/eの重さになる
+*/
+
+const FLOW_DEFAULT_TABLE_SIZE = 4096
+
+const FLOW_RATE_TIME_CONSTANT = 5 * time.Second
+
+type flowKey struct {
+	srcAddr  uint32
+	destAddr uint32
+	srcPort  uint16
+	destPort uint16
+	protocol uint8
+}
+
+type flowEntry struct {
+	key       flowKey
+	packets   uint64
+	bytes     uint64
+	firstSeen time.Time
+	lastSeen  time.Time
+	// 減衰させながら足したバイト数、FLOW_RATE_TIME_CONSTANTで割るとバイト毎秒になる
+	rateBytes float64
+}
+
+type flowTable struct {
+	size    int
+	entries map[flowKey]*list.Element
+	lru     *list.List // 先頭が最近通信したフロー
+	evicted uint64
+}
+
+// フローの表、nilなら数えない
+var flows *flowTable
+
+// コマンドラインで指定された表の大きさ、0なら数えない
+var flowTableSize = FLOW_DEFAULT_TABLE_SIZE
+
+/*
+フローの表の大きさを変える
+小さくした時は古いフローから消し、0なら表ごと消す
+*/
+func setFlowTableSize(size int) {
+	if size <= 0 {
+		flows = nil
+		return
+	}
+	if flows == nil {
+		flows = &flowTable{entries: map[flowKey]*list.Element{}, lru: list.New()}
+	}
+	flows.size = size
+	for flows.lru.Len() > size {
+		flows.evictOldest()
+	}
+}
+
+func (table *flowTable) evictOldest() {
+	elem := table.lru.Back()
+	table.lru.Remove(elem)
+	delete(table.entries, elem.Value.(*flowEntry).key)
+	table.evicted++
+}
+
+// パケットの5タプル、ポート番号の無いプロトコルと最初以外の断片は0にする
+func ipPacketFlowKey(ipheader *ipHeader, packet []byte) flowKey {
+	key := flowKey{srcAddr: ipheader.srcAddr, destAddr: ipheader.destAddr, protocol: ipheader.protocol}
+	headerLen := int(ipheader.headerLen) * 4
+	if byteToUint16(packet[6:8])&0x1fff != 0 || len(packet) < headerLen+4 {
+		return key
+	}
+	if ipheader.protocol == IP_PROTOCOL_NUM_TCP || ipheader.protocol == IP_PROTOCOL_NUM_UDP {
+		key.srcPort = byteToUint16(packet[headerLen : headerLen+2])
+		key.destPort = byteToUint16(packet[headerLen+2 : headerLen+4])
+	}
+	return key
+}
+
+// 経過した時間の分だけレートを減衰させる
+func (entry *flowEntry) decayedRateBytes(now time.Time) float64 {
+	elapsed := now.Sub(entry.lastSeen)
+	if elapsed <= 0 {
+		return entry.rateBytes
+	}
+	return entry.rateBytes * math.Exp(-float64(elapsed)/float64(FLOW_RATE_TIME_CONSTANT))
+}
+
+// バイト毎秒のレート
+func (entry *flowEntry) rate(now time.Time) float64 {
+	return entry.decayedRateBytes(now) / FLOW_RATE_TIME_CONSTANT.Seconds()
+}
+
+// フォワードするパケットを数える
+func flowAccount(ipheader *ipHeader, packet []byte) {
+	if flows == nil {
+		return
+	}
+	now := time.Now()
+	key := ipPacketFlowKey(ipheader, packet)
+	var entry *flowEntry
+	if elem, ok := flows.entries[key]; ok {
+		flows.lru.MoveToFront(elem)
+		entry = elem.Value.(*flowEntry)
+	} else {
+		if flows.lru.Len() >= flows.size {
+			flows.evictOldest()
+		}
+		entry = &flowEntry{key: key, firstSeen: now, lastSeen: now}
+		flows.entries[key] = flows.lru.PushFront(entry)
+	}
+	entry.rateBytes = entry.decayedRateBytes(now) + float64(len(packet))
+	entry.lastSeen = now
+	entry.packets++
+	entry.bytes += uint64(len(packet))
+}
+
+// レートの高い順にlimit個のフローを返す、limitが0なら全て返す
+func topTalkers(limit int, now time.Time) []*flowEntry {
+	if flows == nil {
+		return nil
+	}
+	entries := make([]*flowEntry, 0, flows.lru.Len())
+	for elem := flows.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*flowEntry))
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		ri, rj := entries[i].rate(now), entries[j].rate(now)
+		if ri != rj {
+			return ri > rj
+		}
+		return entries[i].bytes > entries[j].bytes
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
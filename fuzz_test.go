@@ -0,0 +1,468 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+受信処理とプロトコルのパーサのファズテスト
+短いパケットや壊れたパケットでパニックしないことを確かめる
+シードはgo testで毎回実行され、go test -fuzz=FuzzEthernetInput のように指定するとファジングする
+送信はループバックのデバイスで捨てるので、外にパケットは出ない
+*/
+
+var fuzzDeviceOnce sync.Once
+var fuzzDevice *netDevice
+
+const (
+	FUZZ_ROUTER_ADDR = 0xc0a80101 // 192.168.1.1
+	FUZZ_HOST_ADDR   = 0xc0a80102 // 192.168.1.2
+)
+
+var fuzzRouterMac = [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+var fuzzHostMac = [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+// ループバックのデバイスを作ってインターフェイスの一覧に加える、addrが0ならアドレスをつけない
+func newFuzzDevice(name string, macaddr [6]uint8, addr uint32) *netDevice {
+	var ipdev ipDevice
+	if addr != 0 {
+		ipdev.addAddr(newIPInterfaceAddr(addr, 0xffffff00))
+	}
+	netdev := &netDevice{
+		name:    name,
+		macAddr: macaddr,
+		ipDev:   ipdev,
+		backend: loopbackDevice,
+	}
+	if addr != 0 {
+		addConnectedRoute(netdev)
+	}
+	netDeviceList = append(netDeviceList, netdev)
+	return netdev
+}
+
+// 受信するインターフェイスと、ルータ宛てのUDPを受けるサービスを用意する
+func setupFuzzDevice() *netDevice {
+	fuzzDeviceOnce.Do(func() {
+		fuzzDevice = newFuzzDevice("fuzz0", fuzzRouterMac, FUZZ_ROUTER_ADDR)
+		setDnsForwarder(nil, map[string]uint32{"router.lan": FUZZ_ROUTER_ADDR}, false)
+		setNtp(nil, true)
+		setSnmpAgent("public")
+	})
+	return fuzzDevice
+}
+
+// ホストからルータ宛てのフレームを作る
+func fuzzFrame(protocol string, destPort uint16, payload []byte) []byte {
+	config := genConfig{
+		protocol: protocol,
+		srcAddr:  FUZZ_HOST_ADDR,
+		destAddr: FUZZ_ROUTER_ADDR,
+		srcMac:   fuzzHostMac,
+		destMac:  fuzzRouterMac,
+		srcPort:  GEN_DEFAULT_SRC_PORT,
+		destPort: destPort,
+		ttl:      GEN_DEFAULT_TTL,
+		size:     len(payload),
+		arpOp:    ARP_OPERATION_CODE_REQUEST,
+	}
+	frame := config.frame(0)
+	copy(frame[len(frame)-len(payload):], payload)
+	// データを入れ替えたので、ICMPはチェックサムを計算し直し、UDPはチェックサムを省略する
+	switch protocol {
+	case "icmp":
+		icmp := frame[14+20:]
+		icmp[2], icmp[3] = 0, 0
+		copy(icmp[2:4], calcChecksum(icmp))
+	case "udp":
+		frame[14+20+6], frame[14+20+7] = 0, 0
+	}
+	return frame
+}
+
+func berConcat(tlvs ...[]byte) []byte {
+	var b []byte
+	for _, tlv := range tlvs {
+		b = append(b, tlv...)
+	}
+	return b
+}
+
+func fuzzSeeds() [][]byte {
+	// sysDescr.0のGetRequest
+	varBind := berTLV(BER_TAG_SEQUENCE, berConcat(berTLV(BER_TAG_OID, berOID(snmpOID{1, 3, 6, 1, 2, 1, 1, 1, 0})), berTLV(BER_TAG_NULL, nil)))
+	pdu := berTLV(SNMP_PDU_GET_REQUEST, berConcat(berTLV(BER_TAG_INTEGER, berInteger(1)), berTLV(BER_TAG_INTEGER, berInteger(0)),
+		berTLV(BER_TAG_INTEGER, berInteger(0)), berTLV(BER_TAG_SEQUENCE, varBind)))
+	snmpGet := berTLV(BER_TAG_SEQUENCE, berConcat(berTLV(BER_TAG_INTEGER, berInteger(SNMP_VERSION_2C)),
+		berTLV(BER_TAG_OCTET_STRING, []byte("public")), pdu))
+	dnsQuery := append(dnsResponseHeader(1, 0x0100, 1, 0), 6, 'r', 'o', 'u', 't', 'e', 'r', 3, 'l', 'a', 'n', 0, 0, 1, 0, 1)
+	ntpRequest := make([]byte, 48)
+	ntpRequest[0] = 0x23
+	return [][]byte{
+		fuzzFrame("arp", 0, nil),
+		fuzzFrame("icmp", 0, []byte("ping")),
+		fuzzFrame("udp", SNMP_PORT, snmpGet),
+		fuzzFrame("udp", DNS_PORT, dnsQuery),
+		fuzzFrame("udp", NTP_PORT, ntpRequest),
+		fuzzFrame("udp", 9, []byte("discard")),
+	}
+}
+
+func FuzzEthernetInput(f *testing.F) {
+	for _, seed := range fuzzSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ethernetInput(&inputContext{netdev: netdev}, frame)
+	})
+}
+
+func FuzzArpInput(f *testing.F) {
+	f.Add(fuzzFrame("arp", 0, nil)[14:])
+	f.Add([]byte{0x00, 0x01, 0x08, 0x00, 0x06, 0x04})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		arpInput(&inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}, packet)
+	})
+}
+
+func FuzzIpInput(f *testing.F) {
+	for _, seed := range fuzzSeeds()[1:] {
+		f.Add(seed[14:])
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ipInput(&inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}, packet)
+	})
+}
+
+func FuzzIcmpInput(f *testing.F) {
+	f.Add(fuzzFrame("icmp", 0, []byte("ping"))[14+20:])
+	// タイムスタンプより短いエコーリクエスト
+	f.Add(icmpEcho{identify: 1, sequence: 1}.ToPacket(ICMP_TYPE_ECHO_REQUEST))
+	f.Add([]byte{ICMP_TYPE_ECHO_REQUEST, 0, 0xf7, 0xff})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		icmpInput(&inputContext{netdev: netdev}, FUZZ_HOST_ADDR, FUZZ_ROUTER_ADDR, packet)
+	})
+}
+
+func FuzzParseSnmpMessage(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(fuzzSeeds()[2][14+20+8:])
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		parseSnmpMessage(msg)
+	})
+}
+
+func FuzzDnsReadQuestion(f *testing.F) {
+	f.Add(fuzzSeeds()[3][14+20+8:])
+	// 自分を指す圧縮ポインタ
+	f.Add(append(dnsResponseHeader(1, 0x0100, 1, 0), 0xc0, 12, 0, 1, 0, 1))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if _, end, err := dnsReadQuestion(msg); err == nil && end > len(msg) {
+			t.Fatalf("question end %d is beyond message length %d", end, len(msg))
+		}
+		dnsRecordTTLOffsets(msg)
+	})
+}
+
+func FuzzPppoeReadTags(f *testing.F) {
+	f.Add(pppoePacket(PPPOE_CODE_PADO, 0, append(pppoeTag(PPPOE_TAG_SERVICE_NAME, nil), pppoeTag(PPPOE_TAG_AC_NAME, []byte("ac"))...)))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		if _, _, payload, ok := pppoeReadHeader(packet); ok {
+			pppoeReadTags(payload)
+		}
+		if _, _, data, ok := pppReadControlPacket(packet); ok {
+			pppReadOptions(data)
+		}
+	})
+}
+
+var fuzzBridgeOnce sync.Once
+var fuzzBridgePort *netDevice
+
+// STPを有効にしたブリッジと、そのポートのデバイスを用意する
+func setupFuzzBridge() *netDevice {
+	fuzzBridgeOnce.Do(func() {
+		fuzzBridgePort = newFuzzDevice("fuzzbr1", [6]uint8{0x02, 0x00, 0x00, 0x00, 0x01, 0x01}, 0)
+		newFuzzDevice("fuzzbr2", [6]uint8{0x02, 0x00, 0x00, 0x00, 0x01, 0x02}, 0)
+		setBridges([]bridgeConfig{{
+			name:         "fuzzbr",
+			ports:        []string{"fuzzbr1", "fuzzbr2"},
+			stp:          true,
+			priority:     STP_DEFAULT_BRIDGE_PRIORITY,
+			forwardDelay: STP_DEFAULT_FORWARD_DELAY,
+		}})
+	})
+	return fuzzBridgePort
+}
+
+// 隣のブリッジから届くフレーム、ルートブリッジのプライオリティを小さくしたConfiguration BPDUとTCN
+func fuzzBpduSeeds(netdev *netDevice) [][]byte {
+	br := netdev.bridge
+	header := func(bpdu []byte) []byte {
+		frame := append(macToByte(ETHERNET_ADDRESS_STP_MULTICAST), fuzzHostMac[:]...)
+		frame = append(frame, uint16ToByte(uint16(len(bpdu)))...)
+		return append(frame, bpdu...)
+	}
+	config := stpConfigBPDU(br, br.searchPort(netdev), 0, time.Now())
+	config[8], config[9] = 0x10, 0x00
+	config[20], config[21] = 0x10, 0x00
+	topologyChange := append([]byte{}, config...)
+	topologyChange[7] |= STP_FLAG_TOPOLOGY_CHANGE
+	return [][]byte{header(config), header(topologyChange), header(stpTcnBPDU())}
+}
+
+func FuzzStpInput(f *testing.F) {
+	routerMutex.Lock()
+	for _, seed := range fuzzBpduSeeds(setupFuzzBridge()) {
+		f.Add(seed)
+	}
+	routerMutex.Unlock()
+	// ブリッジが転送するフレーム
+	f.Add(fuzzFrame("icmp", 0, []byte("ping")))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		netdev := setupFuzzBridge()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ethernetInput(&inputContext{netdev: netdev}, frame)
+	})
+}
+
+func FuzzLldpInput(f *testing.F) {
+	netdev := setupFuzzDevice()
+	f.Add(lldpPacket(netdev, LLDP_TTL))
+	f.Add(lldpPacket(netdev, 0))
+	// 長さが足りないTLV
+	f.Add([]byte{LLDP_TLV_TYPE_CHASSIS_ID << 1, 0x07, LLDP_CHASSIS_ID_SUBTYPE_MAC_ADDRESS})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		lldpInput(netdev, packet)
+	})
+}
+
+func FuzzIgmpInput(f *testing.F) {
+	f.Add(igmpPacket(IGMP_TYPE_MEMBERSHIP_QUERY, 100, 0))
+	f.Add(igmpPacket(IGMP_TYPE_V2_MEMBERSHIP_REPORT, 0, 0xe0010101))
+	f.Add(igmpPacket(IGMP_TYPE_LEAVE_GROUP, 0, 0xe0010101))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzDevice()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ipheader := ipHeader{ttl: 1, protocol: IP_PROTOCOL_NUM_IGMP, srcAddr: FUZZ_HOST_ADDR, destAddr: IP_ADDRESS_ALL_SYSTEMS}
+		igmpInput(netdev, &ipheader, packet)
+	})
+}
+
+var fuzzVrrpOnce sync.Once
+var fuzzVrrpDevice *netDevice
+
+// バックアップの仮想ルータを動かすデバイスを用意する
+func setupFuzzVrrp() *netDevice {
+	fuzzVrrpOnce.Do(func() {
+		fuzzVrrpDevice = newFuzzDevice("fuzzvrrp", [6]uint8{0x02, 0x00, 0x00, 0x00, 0x02, 0x01}, 0xc0a80201)
+		config, err := newVrrpConfig("fuzzvrrp", 1, 0xc0a802fe, 100, time.Second)
+		if err != nil {
+			panic(err)
+		}
+		setVrrpRouters([]vrrpConfig{config})
+		vrrpStart(vrrpRouters[0], time.Now())
+	})
+	return fuzzVrrpDevice
+}
+
+func FuzzVrrpInput(f *testing.F) {
+	setupFuzzVrrp()
+	routerMutex.Lock()
+	vr := vrrpRouters[0]
+	// 優先度の高いマスター、低いマスター、停止の通知
+	for _, priority := range []uint8{200, 50, 0} {
+		f.Add(vrrpPacket(vr, priority))
+	}
+	routerMutex.Unlock()
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzVrrp()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ipheader := ipHeader{ttl: VRRP_TTL, protocol: IP_PROTOCOL_NUM_VRRP, srcAddr: 0xc0a80202, destAddr: IP_ADDRESS_VRRP}
+		vrrpInput(netdev, &ipheader, packet)
+	})
+}
+
+func FuzzDhcpv6ReadOptions(f *testing.F) {
+	f.Add(append(dhcpv6Option(DHCPV6_OPTION_SERVERID, []byte{0, 3, 0, 1}), dhcpv6IaPdOption(netip.MustParsePrefix("2001:db8::/56"))...))
+	f.Add([]byte{0x00, 0x01, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		options, ok := dhcpv6ReadOptions(packet)
+		if !ok {
+			return
+		}
+		total := 0
+		for _, data := range options {
+			total += 4 + len(data)
+		}
+		if total > len(packet) {
+			t.Fatalf("options of %d bytes are read from %d bytes", total, len(packet))
+		}
+	})
+}
+
+func FuzzDhcpv6ReadIaPd(f *testing.F) {
+	iapd := dhcpv6IaPdOption(netip.MustParsePrefix("2001:db8::/56"))[4:]
+	f.Add(iapd)
+	// IAPREFIXの中のステータスコード
+	f.Add(append(append([]byte{}, iapd[:len(iapd)-DHCPV6_IAPREFIX_LEN-4]...),
+		dhcpv6Option(DHCPV6_OPTION_IAPREFIX, append(iapd[len(iapd)-DHCPV6_IAPREFIX_LEN:],
+			dhcpv6Option(DHCPV6_OPTION_STATUS_CODE, []byte{0x00, 0x06})...))...))
+	f.Add(dhcpv6IaPdOption(netip.Prefix{})[4:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		iapd, ok := dhcpv6ReadIaPd(data)
+		if ok && iapd.prefix.IsValid() && iapd.prefix.Bits() > 64 {
+			t.Fatalf("prefix %s longer than /64 is accepted", iapd.prefix)
+		}
+	})
+}
+
+var fuzzIpv6Once sync.Once
+var fuzzIpv6Device *netDevice
+
+// ホストのリンクローカルアドレス
+var fuzzHostLinkLocalAddr = ipv6LinkLocalAddr(fuzzHostMac).As16()
+
+/*
+IPv6を受けるデバイスを用意する
+ルータ広告とNAT64、DHCPv6-PDのクライアントを動かす
+*/
+func setupFuzzIpv6() *netDevice {
+	setupFuzzDevice()
+	fuzzIpv6Once.Do(func() {
+		fuzzIpv6Device = newFuzzDevice("fuzz6", [6]uint8{0x02, 0x00, 0x00, 0x00, 0x06, 0x01}, 0)
+		fuzzIpv6Device.nat64 = true
+		config, err := newRaConfig("fuzz6", []string{"2001:db8:1::/64"}, 1500, RA_DEFAULT_INTERVAL,
+			0, RA_DEFAULT_VALID_LIFETIME, RA_DEFAULT_PREFERRED_LIFETIME)
+		if err != nil {
+			panic(err)
+		}
+		setRouterAdvertisements([]raConfig{config})
+		raStart(raInterfaces[0], time.Now())
+		setDhcpv6Pd("fuzz6", []string{"fuzz6"}, 56)
+	})
+	return fuzzIpv6Device
+}
+
+// ホストから送るIPv6のパケット、ICMPv6とUDP、TCPはチェックサムを計算する
+func fuzzIpv6Packet(srcAddr, destAddr [16]uint8, nextHeader, hopLimit uint8, payload []byte) []byte {
+	payload = append([]byte{}, payload...)
+	offset := map[uint8]int{IP_PROTOCOL_NUM_ICMPV6: 2, IP_PROTOCOL_NUM_UDP: 6, IP_PROTOCOL_NUM_TCP: 16}
+	if i, ok := offset[nextHeader]; ok && len(payload) >= i+2 {
+		checksum := calcChecksum(ipv6PseudoPacket(srcAddr, destAddr, nextHeader, payload))
+		payload[i], payload[i+1] = checksum[0], checksum[1]
+	}
+	return ipv6Packet(srcAddr, destAddr, nextHeader, hopLimit, payload)
+}
+
+func fuzzIpv6Seeds() [][]byte {
+	solicitation := []byte{ICMPV6_TYPE_ROUTER_SOLICITATION, 0, 0, 0, 0, 0, 0, 0, NDP_OPTION_SOURCE_LINK_ADDRESS, 1}
+	solicitation = append(solicitation, fuzzHostMac[:]...)
+	server := nat64Addr(FUZZ_HOST_ADDR)
+	udp := append(append(uint16ToByte(40000), uint16ToByte(7)...), 0x00, 0x0c, 0x00, 0x00, 'c', 'u', 'r', 'o')
+	tcp := append(append(uint16ToByte(40000), uint16ToByte(80)...), make([]byte, 16)...)
+	tcp[12], tcp[13] = 0x50, 0x02 // SYN
+	echo := []byte{ICMPV6_TYPE_ECHO_REQUEST, 0, 0, 0, 0x12, 0x34, 0x00, 0x01}
+	return [][]byte{
+		fuzzIpv6Packet([16]uint8{}, IPV6_ADDRESS_ALL_ROUTERS, IP_PROTOCOL_NUM_ICMPV6, NDP_HOP_LIMIT, solicitation[:RS_HEADER_LEN]),
+		fuzzIpv6Packet(fuzzHostLinkLocalAddr, IPV6_ADDRESS_ALL_ROUTERS, IP_PROTOCOL_NUM_ICMPV6, NDP_HOP_LIMIT, solicitation),
+		fuzzIpv6Packet(fuzzHostLinkLocalAddr, server, IP_PROTOCOL_NUM_ICMPV6, 64, echo),
+		fuzzIpv6Packet(fuzzHostLinkLocalAddr, server, IP_PROTOCOL_NUM_UDP, 64, udp),
+		fuzzIpv6Packet(fuzzHostLinkLocalAddr, server, IP_PROTOCOL_NUM_TCP, 64, tcp),
+	}
+}
+
+func FuzzIpv6Input(f *testing.F) {
+	for _, seed := range fuzzIpv6Seeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzIpv6()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ipv6Input(&inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}, packet)
+	})
+}
+
+func FuzzRaSolicitationInput(f *testing.F) {
+	for _, seed := range fuzzIpv6Seeds()[:2] {
+		f.Add(seed[IPV6_HEADER_LEN:])
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		netdev := setupFuzzIpv6()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ctx := &inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}
+		raSolicitationInput(ctx, fuzzHostLinkLocalAddr, IPV6_ADDRESS_ALL_ROUTERS, NDP_HOP_LIMIT, packet)
+	})
+}
+
+// 自分のトランザクションのAdvertise、サーバのメッセージをクライアントが受け取る
+func FuzzDhcpv6Input(f *testing.F) {
+	setupFuzzIpv6()
+	routerMutex.Lock()
+	advertise := []byte{DHCPV6_MSG_ADVERTISE, 0x01, 0x02, 0x03}
+	advertise = append(advertise, dhcpv6Option(DHCPV6_OPTION_CLIENTID, dhcpv6.duid)...)
+	advertise = append(advertise, dhcpv6Option(DHCPV6_OPTION_SERVERID, []byte{0, 3, 0, 1, 2, 0, 0, 0, 0, 9})...)
+	advertise = append(advertise, dhcpv6IaPdOption(netip.MustParsePrefix("2001:db8:100::/56"))...)
+	routerMutex.Unlock()
+	f.Add(advertise)
+	reply := append([]byte{DHCPV6_MSG_REPLY}, advertise[1:]...)
+	f.Add(reply)
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		setupFuzzIpv6()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		// 毎回同じトランザクションIDのSolicitからやり直す
+		dhcpv6Withdraw(dhcpv6)
+		dhcpv6StartSolicit(dhcpv6, time.Now())
+		dhcpv6.xid = [3]uint8{0x01, 0x02, 0x03}
+		dhcpv6Input(dhcpv6, ipv6LinkLocalAddr([6]uint8{0x02, 0, 0, 0, 0, 9}).As16(), packet)
+	})
+}
+
+// NAT64のセッションへのIPv4の応答、セッションは最初のシードのIPv6のパケットで作る
+func FuzzNat64Inbound(f *testing.F) {
+	netdev := setupFuzzIpv6()
+	routerMutex.Lock()
+	for _, seed := range fuzzIpv6Seeds()[2:] {
+		ipv6Input(&inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}, seed)
+	}
+	routerMutex.Unlock()
+	echo := icmpEcho{identify: NAT64_PORT_MIN, sequence: 1}.ToPacket(ICMP_TYPE_ECHO_REPLY)
+	udp := append(append(uint16ToByte(7), uint16ToByte(NAT64_PORT_MIN)...), 0x00, 0x0c, 0x00, 0x00, 'c', 'u', 'r', 'o')
+	tcp := append(append(uint16ToByte(80), uint16ToByte(NAT64_PORT_MIN)...), make([]byte, 16)...)
+	tcp[12], tcp[13] = 0x50, 0x12 // SYN+ACK
+	f.Add(IP_PROTOCOL_NUM_ICMP, uint16(0), echo)
+	f.Add(IP_PROTOCOL_NUM_UDP, uint16(0), udp)
+	f.Add(IP_PROTOCOL_NUM_TCP, uint16(0), tcp)
+	f.Add(IP_PROTOCOL_NUM_UDP, uint16(0x2000), udp)
+	f.Fuzz(func(t *testing.T, protocol uint8, fragOffset uint16, l4 []byte) {
+		setupFuzzIpv6()
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		ipheader := ipHeader{ttl: 64, protocol: protocol, fragOffset: fragOffset, srcAddr: FUZZ_HOST_ADDR, destAddr: FUZZ_ROUTER_ADDR}
+		nat64Inbound(&ipheader, l4)
+	})
+}
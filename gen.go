@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+パケットジェネレータ
+ルータとして動かずに、指定したインターフェイスからARP、ICMP、UDPのフレームを作って送信する
+ルータと同じToPacketでパケットを組み立てるので、外部のツール無しでフォワーディングやNATの処理を試せる
+  -gen udp,dev=eth1,dst=192.168.0.2,gw=192.168.1.1,dport=53 -gen-count 100 -gen-rate 10
+指定できる項目
+  dev    送信するインターフェイス(必須)
+  dst    宛先のIPアドレス(必須)、ARPでは問い合わせるアドレス
+  src    送信元のIPアドレス、省略するとインターフェイスのアドレス
+  gw     宛先のMACアドレスをARPで解決するネクストホップ、省略すると宛先を直接解決する
+  dmac   宛先のMACアドレス、指定するとARPで解決しない
+  smac   送信元のMACアドレス、省略するとインターフェイスのMACアドレス
+  sport  UDPの送信元ポート
+  dport  UDPの宛先ポート
+  ttl    IPのTTL
+  size   ICMPとUDPのデータの長さ
+  op     ARPのrequestかreply
+*/
+
+const (
+	GEN_DEFAULT_SRC_PORT uint16 = 40000
+	GEN_DEFAULT_DST_PORT uint16 = 9 // discard
+	GEN_DEFAULT_TTL      uint8  = 64
+	GEN_DEFAULT_SIZE            = 32
+)
+
+// 宛先のMACアドレスをARPで解決する時の待ち時間と回数
+const GEN_ARP_TIMEOUT = 1 * time.Second
+const GEN_ARP_RETRY = 3
+
+// ICMPとUDPのデータの先頭に入れる文字列、後ろに番号をつける
+const GEN_PAYLOAD_PREFIX = "go-curo gen "
+
+type genConfig struct {
+	protocol   string // arp、icmp、udp
+	ifname     string
+	srcAddr    uint32
+	destAddr   uint32
+	gateway    uint32
+	srcMac     [6]uint8
+	destMac    [6]uint8
+	hasSrcMac  bool
+	hasDestMac bool
+	srcPort    uint16
+	destPort   uint16
+	ttl        uint8
+	size       int
+	arpOp      uint16
+}
+
+// "udp,dev=eth1,dst=192.168.0.2,dport=53"を読む
+func parseGenSpec(spec string) (genConfig, error) {
+	fields := strings.Split(spec, ",")
+	config := genConfig{
+		protocol: fields[0],
+		srcPort:  GEN_DEFAULT_SRC_PORT,
+		destPort: GEN_DEFAULT_DST_PORT,
+		ttl:      GEN_DEFAULT_TTL,
+		size:     GEN_DEFAULT_SIZE,
+		arpOp:    ARP_OPERATION_CODE_REQUEST,
+	}
+	if config.protocol != "arp" && config.protocol != "icmp" && config.protocol != "udp" {
+		return genConfig{}, fmt.Errorf("unknown gen protocol %q, must be arp, icmp or udp", config.protocol)
+	}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return genConfig{}, fmt.Errorf("invalid gen field %q, format is key=value", field)
+		}
+		var err error
+		switch key {
+		case "dev":
+			config.ifname = value
+		case "dst":
+			config.destAddr, err = parseIPAddr(value)
+		case "src":
+			config.srcAddr, err = parseIPAddr(value)
+		case "gw":
+			config.gateway, err = parseIPAddr(value)
+		case "dmac":
+			config.destMac, err = parseGenMac(value)
+			config.hasDestMac = true
+		case "smac":
+			config.srcMac, err = parseGenMac(value)
+			config.hasSrcMac = true
+		case "sport", "dport":
+			var port uint64
+			port, err = strconv.ParseUint(value, 10, 16)
+			if key == "sport" {
+				config.srcPort = uint16(port)
+			} else {
+				config.destPort = uint16(port)
+			}
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(value, 10, 8)
+			config.ttl = uint8(ttl)
+		case "size":
+			config.size, err = strconv.Atoi(value)
+			if err == nil && (config.size < 0 || config.size > 1472) {
+				err = fmt.Errorf("gen size %d must be 0-1472", config.size)
+			}
+		case "op":
+			switch value {
+			case "request":
+				config.arpOp = ARP_OPERATION_CODE_REQUEST
+			case "reply":
+				config.arpOp = ARP_OPERATION_CODE_REPLY
+			default:
+				err = fmt.Errorf("unknown arp operation %q", value)
+			}
+		default:
+			err = fmt.Errorf("unknown gen field %q", key)
+		}
+		if err != nil {
+			return genConfig{}, fmt.Errorf("invalid gen field %q : %s", field, err)
+		}
+	}
+	if config.ifname == "" || config.destAddr == 0 {
+		return genConfig{}, fmt.Errorf("gen requires dev and dst")
+	}
+	return config, nil
+}
+
+func parseGenMac(s string) ([6]uint8, error) {
+	hwaddr, err := net.ParseMAC(s)
+	if err != nil {
+		return [6]uint8{}, fmt.Errorf("invalid mac address %s", s)
+	}
+	return macFromHardwareAddr(hwaddr)
+}
+
+/*
+パケットを生成して送信する
+rateは1秒あたりのパケット数で、0なら待たずに送る
+*/
+func runPacketGenerator(config genConfig, count, rate int) error {
+	netif, err := net.InterfaceByName(config.ifname)
+	if err != nil {
+		return err
+	}
+	netdev, err := newPacketSocketNetDevice(*netif)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(netdev.socket)
+
+	if !config.hasSrcMac {
+		config.srcMac = netdev.macAddr
+	}
+	if config.srcAddr == 0 {
+		config.srcAddr = netdev.ipDev.addrFor(config.destAddr)
+	}
+	if !config.hasDestMac {
+		if config.protocol == "arp" {
+			config.destMac = ETHERNET_ADDRESS_BROADCAST
+		} else {
+			nexthop := config.gateway
+			if nexthop == 0 {
+				if !netdev.ipDev.inSubnet(config.destAddr) {
+					return fmt.Errorf("%s is not on %s, gw or dmac is required", printIPAddr(config.destAddr), netdev.name)
+				}
+				nexthop = config.destAddr
+			}
+			config.destMac, err = genResolveMac(netdev, config.srcMac, config.srcAddr, nexthop)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Resolved %s to %s\n", printIPAddr(nexthop), printMacAddr(config.destMac))
+		}
+	}
+
+	fmt.Printf("Generating %d %s packets from %s to %s (%s)\n", count, config.protocol,
+		netdev.name, printIPAddr(config.destAddr), printMacAddr(config.destMac))
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+	start := time.Now()
+	var sentBytes int
+	for i := 0; i < count; i++ {
+		// 始めた時刻から数えて送る時刻を決め、送信にかかった時間で遅れないようにする
+		if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+		frame := config.frame(uint16(i))
+		if err := netdev.netDeviceWrite(frame); err != nil {
+			return fmt.Errorf("send err : %s", err)
+		}
+		sentBytes += len(frame)
+	}
+	elapsed := time.Since(start)
+	pps := float64(count)
+	if elapsed > 0 {
+		pps = float64(count) / elapsed.Seconds()
+	}
+	fmt.Printf("Generated %d packets (%d bytes) in %s, %.1f pps\n", count, sentBytes, elapsed.Round(time.Millisecond), pps)
+	return nil
+}
+
+// seq番目のフレームを作る
+func (config genConfig) frame(seq uint16) []byte {
+	ethType := ETHER_TYPE_IP
+	var packet []byte
+	switch config.protocol {
+	case "arp":
+		ethType = ETHER_TYPE_ARP
+		var targetMac [6]uint8
+		if config.arpOp == ARP_OPERATION_CODE_REPLY {
+			targetMac = config.destMac
+		}
+		packet = arpIPToEthernet{
+			hardwareType:        ARP_HTYPE_ETHERNET,
+			protocolType:        ETHER_TYPE_IP,
+			hardwareLen:         ETHERNET_ADDRES_LEN,
+			protocolLen:         IP_ADDRESS_LEN,
+			opcode:              config.arpOp,
+			senderHardwareAddr:  config.srcMac,
+			senderIPAddr:        config.srcAddr,
+			targetHardwareAddrr: targetMac,
+			targetIPAddr:        config.destAddr,
+		}.ToPacket()
+	case "icmp":
+		payload := icmpEcho{
+			identify: uint16(os.Getpid()),
+			sequence: seq,
+			data:     config.payload(seq),
+		}.ToPacket(ICMP_TYPE_ECHO_REQUEST)
+		packet = config.ipPacket(seq, IP_PROTOCOL_NUM_ICMP, payload)
+	case "udp":
+		data := config.payload(seq)
+		payload := uint16ToByte(config.srcPort)
+		payload = append(payload, uint16ToByte(config.destPort)...)
+		payload = append(payload, uint16ToByte(uint16(UDP_HEADER_LEN+len(data)))...)
+		payload = append(payload, 0x00, 0x00)
+		payload = append(payload, data...)
+		checksum := udpChecksum(config.srcAddr, config.destAddr, payload)
+		if checksum[0] == 0 && checksum[1] == 0 {
+			checksum = []byte{0xff, 0xff}
+		}
+		payload[6], payload[7] = checksum[0], checksum[1]
+		packet = config.ipPacket(seq, IP_PROTOCOL_NUM_UDP, payload)
+	}
+	frame := ethernetHeader{
+		destAddr:  config.destMac,
+		srcAddr:   config.srcMac,
+		etherType: ethType,
+	}.ToPacket()
+	return append(frame, packet...)
+}
+
+func (config genConfig) ipPacket(seq uint16, protocol uint8, payload []byte) []byte {
+	ipheader := ipHeader{
+		version:    4,
+		headerLen:  20 / 4,
+		totalLen:   uint16(20 + len(payload)),
+		identify:   seq,
+		fragOffset: 2 << 13,
+		ttl:        config.ttl,
+		protocol:   protocol,
+		srcAddr:    config.srcAddr,
+		destAddr:   config.destAddr,
+	}
+	return append(ipheader.ToPacket(true), payload...)
+}
+
+// 受け取った側でどのパケットか分かるように、データの先頭に番号を入れる
+func (config genConfig) payload(seq uint16) []byte {
+	data := make([]byte, config.size)
+	copy(data, fmt.Sprintf("%s%d", GEN_PAYLOAD_PREFIX, seq))
+	return data
+}
+
+// ARPリクエストを送ってリプライを待ち、ネクストホップのMACアドレスを得る
+func genResolveMac(netdev *netDevice, srcMac [6]uint8, srcAddr, nexthop uint32) ([6]uint8, error) {
+	tv := syscall.NsecToTimeval(int64(GEN_ARP_TIMEOUT / 10))
+	if err := syscall.SetsockoptTimeval(netdev.socket, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return [6]uint8{}, err
+	}
+	request := genConfig{
+		protocol: "arp",
+		srcAddr:  srcAddr,
+		destAddr: nexthop,
+		srcMac:   srcMac,
+		destMac:  ETHERNET_ADDRESS_BROADCAST,
+		arpOp:    ARP_OPERATION_CODE_REQUEST,
+	}.frame(0)
+	buf := make([]byte, 1514)
+	for i := 0; i < GEN_ARP_RETRY; i++ {
+		if err := netdev.netDeviceWrite(request); err != nil {
+			return [6]uint8{}, err
+		}
+		deadline := time.Now().Add(GEN_ARP_TIMEOUT)
+		for time.Now().Before(deadline) {
+			n, _, err := syscall.Recvfrom(netdev.socket, buf, 0)
+			if err != nil || n < 14+28 {
+				continue
+			}
+			arp := buf[14:n]
+			if byteToUint16(buf[12:14]) == ETHER_TYPE_ARP && byteToUint16(arp[6:8]) == ARP_OPERATION_CODE_REPLY &&
+				byteToUint32(arp[14:18]) == nexthop {
+				return setMacAddr(arp[8:14]), nil
+			}
+		}
+	}
+	return [6]uint8{}, fmt.Errorf("arp for %s is not replied", printIPAddr(nexthop))
+}
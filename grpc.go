@@ -0,0 +1,141 @@
+package main
+
+//go:generate protoc --proto_path=proto --go_out=. --go_opt=module=github.com/nilpoona/go-curo --go-grpc_out=. --go-grpc_opt=module=github.com/nilpoona/go-curo router.proto
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/nilpoona/go-curo/proto/routerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gRPCの管理APIの実装
+type routerServer struct {
+	routerpb.UnimplementedRouterServiceServer
+}
+
+/*
+gRPCの管理APIを起動する
+*/
+func startGrpcServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	routerpb.RegisterRouterServiceServer(server, &routerServer{})
+	go server.Serve(listener)
+	return nil
+}
+
+func (s *routerServer) AddRoute(ctx context.Context, req *routerpb.AddRouteRequest) (*routerpb.AddRouteResponse, error) {
+	prefix, err := parseIPv4Prefix(req.GetPrefix())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	nexthop, err := parseIPv4Addr(req.GetNexthop())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	err = controlAddRoute(prefix, network, nexthop, 0, 0)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &routerpb.AddRouteResponse{}, nil
+}
+
+func (s *routerServer) DeleteRoute(ctx context.Context, req *routerpb.DeleteRouteRequest) (*routerpb.DeleteRouteResponse, error) {
+	prefix, err := parseIPv4Prefix(req.GetPrefix())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	err = controlDeleteRoute(prefix, netip.Addr{})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &routerpb.DeleteRouteResponse{}, nil
+}
+
+func (s *routerServer) ListRoutes(ctx context.Context, req *routerpb.ListRoutesRequest) (*routerpb.ListRoutesResponse, error) {
+	var res routerpb.ListRoutesResponse
+	for _, route := range controlListRoutes() {
+		res.Routes = append(res.Routes, &routerpb.Route{
+			Prefix:  route.prefix.String(),
+			Type:    route.iptype,
+			Nexthop: addrString(route.nexthop),
+			Device:  route.device,
+		})
+	}
+	return &res, nil
+}
+
+func (s *routerServer) ListArpEntries(ctx context.Context, req *routerpb.ListArpEntriesRequest) (*routerpb.ListArpEntriesResponse, error) {
+	var res routerpb.ListArpEntriesResponse
+	for _, entry := range controlListArp() {
+		res.Entries = append(res.Entries, &routerpb.ArpEntry{
+			IpAddress:  entry.ipAddr.String(),
+			MacAddress: entry.macAddr.String(),
+			Device:     entry.device,
+		})
+	}
+	return &res, nil
+}
+
+func (s *routerServer) ListInterfaces(ctx context.Context, req *routerpb.ListInterfacesRequest) (*routerpb.ListInterfacesResponse, error) {
+	var res routerpb.ListInterfacesResponse
+	for _, netif := range controlListInterfaces() {
+		res.Interfaces = append(res.Interfaces, &routerpb.Interface{
+			Name:       netif.name,
+			MacAddress: netif.macAddr.String(),
+			Address:    prefixString(netif.address),
+			Counters: &routerpb.InterfaceCounters{
+				RxPackets:          netif.stats.rxPackets,
+				RxBytes:            netif.stats.rxBytes,
+				TxPackets:          netif.stats.txPackets,
+				TxBytes:            netif.stats.txBytes,
+				IpChecksumErrors:   netif.stats.ipChecksumErrors,
+				IcmpChecksumErrors: netif.stats.icmpChecksumErrors,
+			},
+		})
+	}
+	return &res, nil
+}
+
+func (s *routerServer) ListDropCounters(ctx context.Context, req *routerpb.ListDropCountersRequest) (*routerpb.ListDropCountersResponse, error) {
+	var res routerpb.ListDropCountersResponse
+	for _, counter := range controlListDropCounters() {
+		res.Counters = append(res.Counters, &routerpb.DropCounter{
+			Reason: counter.reason,
+			Count:  counter.count,
+		})
+	}
+	return &res, nil
+}
+
+func (s *routerServer) WatchPacketEvents(req *routerpb.WatchPacketEventsRequest, stream routerpb.RouterService_WatchPacketEventsServer) error {
+	events, cancel := subscribePacketEvents(1)
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			err := stream.Send(&routerpb.PacketEvent{
+				Timestamp:   event.timestamp.UnixNano(),
+				Device:      event.device,
+				Action:      event.action,
+				SrcAddress:  printIPAddr(event.srcAddr),
+				DestAddress: printIPAddr(event.destAddr),
+				Protocol:    uint32(event.protocol),
+				Length:      uint32(event.length),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+/*
+インターフェイスの管理上の状態(admin up/down)とリンクの状態(oper up/down)
+  管理者が止めたインターフェイスはsocketをepollから外して受信せず、送信するフレームも破棄する
+  リンクが落ちた(vethの相手が落ちた、ケーブルが抜けた)ことはnetlinkのRTM_NEWLINKのIFF_RUNNINGで検出する
+どちらかでダウンしたら直接接続の経路を消して、そのインターフェイスで学習したARPのエントリを消す
+経路が無くなるので他の経路があればそちらに切り替わり、無ければNo Routeで破棄してICMPを返す
+両方アップに戻ったら直接接続の経路を入れ直す
+-shutdownや設定ファイルの"shutdown": trueで止めた状態で起動し、管理APIで上げ下げする
+*/
+
+// コマンドラインで指定された止めた状態で起動するインターフェイス
+var shutdownInterfaces = map[string]bool{}
+
+// 管理APIからepollの監視を変えるために、ルータのepollを覚えておく
+var routerEpfd = -1
+
+// 管理上もリンクもアップしているか
+func (netdev *netDevice) isUp() bool {
+	return !netdev.adminDown && !netdev.linkDown
+}
+
+// RTM_NEWLINKのフラグからリンクがアップしているか
+func operUp(flags uint32) bool {
+	return flags&syscall.IFF_UP != 0 && flags&syscall.IFF_RUNNING != 0
+}
+
+// netパッケージのフラグは値が違うので、起動時と追加された時はこちらで確認する
+func netifOperUp(netif net.Interface) bool {
+	return netif.Flags&net.FlagUp != 0 && netif.Flags&net.FlagRunning != 0
+}
+
+/*
+インターフェイスを管理上アップかダウンにする
+ダウンにするとsocketをepollから外して受信を止める、socketは閉じないのでアップに戻せばそのまま使える
+*/
+func setNetDeviceAdminState(epfd int, netdev *netDevice, up bool) error {
+	if netdev.backend == loopbackDevice {
+		return fmt.Errorf("%s can not be shut down", netdev.name)
+	}
+	if netdev.adminDown == !up {
+		return nil
+	}
+	wasUp := netdev.isUp()
+	if up {
+		err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, netdev.socket, &syscall.EpollEvent{
+			Events: syscall.EPOLLIN,
+			Fd:     int32(netdev.socket),
+		})
+		if err != nil {
+			return fmt.Errorf("epoll ctrl err : %s", err)
+		}
+		netdev.adminDown = false
+		fmt.Printf("Interface %s is administratively up\n", netdev.name)
+	} else {
+		syscall.EpollCtl(epfd, syscall.EPOLL_CTL_DEL, netdev.socket, nil)
+		netdev.adminDown = true
+		fmt.Printf("Interface %s is administratively down\n", netdev.name)
+	}
+	netdev.stateChanged(wasUp)
+	return nil
+}
+
+// netlinkで通知されたリンクの状態を反映する
+func setNetDeviceLinkState(netdev *netDevice, up bool) {
+	if netdev.linkDown == !up {
+		return
+	}
+	wasUp := netdev.isUp()
+	netdev.linkDown = !up
+	if up {
+		fmt.Printf("Link of %s is up\n", netdev.name)
+	} else {
+		fmt.Printf("Link of %s is down\n", netdev.name)
+	}
+	netdev.stateChanged(wasUp)
+}
+
+// アップかダウンかが変わったら直接接続の経路とARPのエントリを入れ替える
+func (netdev *netDevice) stateChanged(wasUp bool) {
+	if netdev.isUp() == wasUp {
+		return
+	}
+	if netdev.isUp() {
+		addConnectedRoute(netdev)
+		return
+	}
+	netdev.txPending = nil
+	deleteConnectedRoute(netdev)
+	flushArpTableEntry(netdev)
+}
+
+func (netdev *netDevice) adminStateString() string {
+	if netdev.adminDown {
+		return "down"
+	}
+	return "up"
+}
+
+func (netdev *netDevice) operStateString() string {
+	if netdev.isUp() {
+		return "up"
+	}
+	return "down"
+}
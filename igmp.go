@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+マルチキャストとIGMPv2
+ルータが参加しているグループ宛てのパケットを受け取り、ホストからのメンバーシップレポートで
+インターフェイスごとのグループの表を作る。マルチキャストのフォワーディングを有効にすると、
+クエリアとして定期的にクエリを送り、表に従ってグループ宛てのパケットをフォワードする
+IGMPプロキシ(igmpproxy.go)を動かすと、下流のインターフェイスだけでクエリを送り、上流とのフォワードも決める
+https://www.rfc-editor.org/rfc/rfc2236
+*/
+
+const IP_PROTOCOL_NUM_IGMP uint8 = 0x02
+
+const (
+	IGMP_TYPE_MEMBERSHIP_QUERY     uint8 = 0x11
+	IGMP_TYPE_V1_MEMBERSHIP_REPORT uint8 = 0x12
+	IGMP_TYPE_V2_MEMBERSHIP_REPORT uint8 = 0x16
+	IGMP_TYPE_LEAVE_GROUP          uint8 = 0x17
+)
+
+const IP_ADDRESS_ALL_SYSTEMS uint32 = 0xe0000001 // 224.0.0.1
+const IP_ADDRESS_ALL_ROUTERS uint32 = 0xe0000002 // 224.0.0.2
+
+const IGMP_QUERY_INTERVAL = 125 * time.Second
+const IGMP_QUERY_RESPONSE_INTERVAL = 10 * time.Second
+
+// クエリに応答が無くなってからグループのメンバーがいなくなったとみなすまでの時間
+const IGMP_GROUP_MEMBERSHIP_INTERVAL = 2*IGMP_QUERY_INTERVAL + IGMP_QUERY_RESPONSE_INTERVAL
+
+// IPヘッダにつけるRouter Alertオプション
+var IP_OPTION_ROUTER_ALERT = []byte{0x94, 0x04, 0x00, 0x00}
+
+// インターフェイスのマルチキャストグループのメンバーシップ
+type multicastMembership struct {
+	netdev  *netDevice
+	group   uint32
+	local   bool      // ルータ自身が参加しているグループ
+	expires time.Time // ホストから学習したグループの期限
+}
+
+var multicastMembershipList []*multicastMembership
+
+// マルチキャストをフォワードするか
+var multicastForwarding bool
+
+// 224.0.0.0/4か
+func isMulticastAddr(addr uint32) bool {
+	return addr>>28 == 0xe
+}
+
+// ルータを越えてはいけない224.0.0.0/24か
+func isLinkLocalMulticastAddr(addr uint32) bool {
+	return addr&0xffffff00 == 0xe0000000
+}
+
+// グループのアドレスの下位23bitを01:00:5e:00:00:00に入れたMACアドレス
+func multicastMacAddr(group uint32) [6]uint8 {
+	return [6]uint8{0x01, 0x00, 0x5e, uint8(group>>16) & 0x7f, uint8(group >> 8), uint8(group)}
+}
+
+func searchMulticastMembership(netdev *netDevice, group uint32, local bool) *multicastMembership {
+	for _, membership := range multicastMembershipList {
+		if membership.netdev == netdev && membership.group == group && membership.local == local {
+			return membership
+		}
+	}
+	return nil
+}
+
+/*
+ルータ自身がグループに参加する
+OSPFやRIPのように224.0.0.xのグループ宛てのパケットを受け取るプロトコルから呼ぶ
+*/
+func joinMulticastGroup(netdev *netDevice, group uint32) {
+	if searchMulticastMembership(netdev, group, true) != nil {
+		return
+	}
+	multicastMembershipList = append(multicastMembershipList, &multicastMembership{
+		netdev: netdev,
+		group:  group,
+		local:  true,
+	})
+	fmt.Printf("Joined multicast group %s on %s\n", printIPAddr(group), netdev.name)
+	if !isLinkLocalMulticastAddr(group) {
+		igmpSendReport(netdev, group)
+	}
+}
+
+// ルータ自身がグループから抜ける
+func leaveMulticastGroup(netdev *netDevice, group uint32) {
+	var memberships []*multicastMembership
+	for _, membership := range multicastMembershipList {
+		if membership.netdev == netdev && membership.group == group && membership.local {
+			continue
+		}
+		memberships = append(memberships, membership)
+	}
+	multicastMembershipList = memberships
+	fmt.Printf("Left multicast group %s on %s\n", printIPAddr(group), netdev.name)
+	if !isLinkLocalMulticastAddr(group) && netdev.ipDev.address != 0 {
+		igmpOutput(netdev, IP_ADDRESS_ALL_ROUTERS, igmpPacket(IGMP_TYPE_LEAVE_GROUP, 0, group))
+	}
+}
+
+// ルータ自身が参加しているグループか、224.0.0.1には常に参加している
+func isJoinedMulticastGroup(netdev *netDevice, group uint32) bool {
+	return group == IP_ADDRESS_ALL_SYSTEMS || searchMulticastMembership(netdev, group, true) != nil
+}
+
+// 受け取るべきマルチキャストのMACアドレスか
+func acceptMulticastMacAddr(netdev *netDevice, macaddr [6]uint8) bool {
+	if macaddr[0] != 0x01 || macaddr[1] != 0x00 || macaddr[2] != 0x5e {
+		return false
+	}
+	// フォワードする場合はメンバーがいるか分からないので全て受け取る
+	if multicastForwarding || igmpProxy != nil || macaddr == multicastMacAddr(IP_ADDRESS_ALL_SYSTEMS) {
+		return true
+	}
+	for _, membership := range multicastMembershipList {
+		if membership.netdev == netdev && membership.local && multicastMacAddr(membership.group) == macaddr {
+			return true
+		}
+	}
+	return false
+}
+
+// インターフェイスのメンバーシップを全て消す
+func flushMulticastMembership(netdev *netDevice) {
+	var memberships []*multicastMembership
+	for _, membership := range multicastMembershipList {
+		if membership.netdev != netdev {
+			memberships = append(memberships, membership)
+		}
+	}
+	multicastMembershipList = memberships
+	igmpProxyUpdate()
+}
+
+// 期限切れの学習したメンバーシップを消す
+func expireMulticastMembership(now time.Time) {
+	var memberships []*multicastMembership
+	for _, membership := range multicastMembershipList {
+		if !membership.local && !now.Before(membership.expires) {
+			fmt.Printf("Multicast group %s on %s is expired\n", printIPAddr(membership.group), membership.netdev.name)
+			continue
+		}
+		memberships = append(memberships, membership)
+	}
+	multicastMembershipList = memberships
+	igmpProxyUpdate()
+}
+
+func init() {
+	registerIPProtocol(IP_PROTOCOL_NUM_IGMP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		igmpInput(ctx.netdev, ipheader, packet)
+		return nil
+	})
+}
+
+/*
+IGMPパケットの受信処理
+*/
+func igmpInput(inputdev *netDevice, ipheader *ipHeader, igmpPacket []byte) {
+	if len(igmpPacket) < 8 {
+		fmt.Println("Received IGMP packet is too short")
+		countDrop(DROP_REASON_IGMP_INVALID)
+		return
+	}
+	if !verifyChecksum(igmpPacket) {
+		debugPrintf("Drop IGMP packet with invalid checksum from %s in %s\n", printIPAddr(ipheader.srcAddr), inputdev.name)
+		countDrop(DROP_REASON_IGMP_INVALID)
+		return
+	}
+	group := byteToUint32(igmpPacket[4:8])
+
+	switch igmpPacket[0] {
+	case IGMP_TYPE_MEMBERSHIP_QUERY:
+		// 参加しているグループのレポートを返す
+		for _, membership := range multicastMembershipList {
+			if membership.netdev != inputdev || !membership.local || isLinkLocalMulticastAddr(membership.group) {
+				continue
+			}
+			if group == 0 || group == membership.group {
+				igmpSendReport(inputdev, membership.group)
+			}
+		}
+		// IGMPプロキシの上流では下流でまとめたグループも返す
+		if isIgmpProxyUpstream(inputdev) {
+			igmpProxyAnswerQuery(inputdev, group)
+		}
+	case IGMP_TYPE_V1_MEMBERSHIP_REPORT, IGMP_TYPE_V2_MEMBERSHIP_REPORT:
+		// IGMPプロキシの上流では他のホストのレポートから学習しない
+		if !isMulticastAddr(group) || isLinkLocalMulticastAddr(group) || isIgmpProxyUpstream(inputdev) {
+			return
+		}
+		membership := searchMulticastMembership(inputdev, group, false)
+		if membership == nil {
+			membership = &multicastMembership{
+				netdev: inputdev,
+				group:  group,
+			}
+			multicastMembershipList = append(multicastMembershipList, membership)
+			fmt.Printf("Learned multicast group %s on %s from %s\n", printIPAddr(group), inputdev.name, printIPAddr(ipheader.srcAddr))
+		}
+		membership.expires = time.Now().Add(IGMP_GROUP_MEMBERSHIP_INTERVAL)
+		igmpProxyUpdate()
+	case IGMP_TYPE_LEAVE_GROUP:
+		// 他のメンバーを確認するクエリは送らずにすぐに消す
+		var memberships []*multicastMembership
+		for _, membership := range multicastMembershipList {
+			if membership.netdev == inputdev && membership.group == group && !membership.local {
+				fmt.Printf("Multicast group %s on %s is left by %s\n", printIPAddr(group), inputdev.name, printIPAddr(ipheader.srcAddr))
+				continue
+			}
+			memberships = append(memberships, membership)
+		}
+		multicastMembershipList = memberships
+		igmpProxyUpdate()
+	}
+}
+
+// IGMPメッセージを作る
+func igmpPacket(igmpType, maxRespTime uint8, group uint32) []byte {
+	packet := []byte{igmpType, maxRespTime, 0x00, 0x00}
+	packet = append(packet, uint32ToByte(group)...)
+	checksum := calcChecksum(packet)
+	packet[2], packet[3] = checksum[0], checksum[1]
+	return packet
+}
+
+/*
+IGMPメッセージを送信する
+TTLは1で、Router Alertオプションをつけてグループ宛てに送る
+*/
+func igmpOutput(netdev *netDevice, destAddr uint32, payload []byte) {
+	headerLen := 20 + len(IP_OPTION_ROUTER_ALERT)
+	ipheader := ipHeader{
+		version:   4,
+		headerLen: uint8(headerLen / 4),
+		totalLen:  uint16(headerLen + len(payload)),
+		ttl:       1,
+		protocol:  IP_PROTOCOL_NUM_IGMP,
+		srcAddr:   netdev.ipDev.address,
+		destAddr:  destAddr,
+	}
+	packet := append(ipheader.ToPacket(false), IP_OPTION_ROUTER_ALERT...)
+	setIPHeaderChecksum(packet)
+	packet = append(packet, payload...)
+	ethernetOutput(netdev, multicastMacAddr(destAddr), packet, ETHER_TYPE_IP)
+}
+
+func igmpSendReport(netdev *netDevice, group uint32) {
+	if netdev.ipDev.address == 0 {
+		return
+	}
+	igmpOutput(netdev, group, igmpPacket(IGMP_TYPE_V2_MEMBERSHIP_REPORT, 0, group))
+}
+
+// 全てのホストにGeneral Queryを送る
+func igmpSendQuery(netdev *netDevice) {
+	if netdev.ipDev.address == 0 {
+		return
+	}
+	maxRespTime := uint8(IGMP_QUERY_RESPONSE_INTERVAL / (100 * time.Millisecond))
+	igmpOutput(netdev, IP_ADDRESS_ALL_SYSTEMS, igmpPacket(IGMP_TYPE_MEMBERSHIP_QUERY, maxRespTime, 0))
+}
+
+/*
+クエリアとして定期的にクエリを送り、期限切れのメンバーシップを消す
+マルチキャストのフォワーディングでは全てのインターフェイス、IGMPプロキシでは下流のインターフェイスに送る
+どちらも動いていなければクエリは送らない、設定ファイルを読み直して有効になった時のために常に起動しておく
+*/
+func startIgmpQuerier() {
+	query := func() {
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		expireMulticastMembership(time.Now())
+		for _, netdev := range netDeviceList {
+			if multicastForwarding || isIgmpProxyDownstream(netdev) {
+				igmpSendQuery(netdev)
+			}
+		}
+	}
+	query()
+	go func() {
+		ticker := time.NewTicker(IGMP_QUERY_INTERVAL)
+		for range ticker.C {
+			query()
+		}
+	}()
+}
+
+/*
+マルチキャストのパケットをグループのメンバーがいるインターフェイスにフォワードする
+*/
+func multicastForward(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+	if ipheader.ttl <= 1 {
+		countDrop(DROP_REASON_TTL_EXCEEDED)
+		return
+	}
+	forwardPacket := make([]byte, len(packet))
+	copy(forwardPacket, packet)
+	forwardPacket[8] = ipheader.ttl - 1
+	setIPHeaderChecksum(forwardPacket)
+
+	now := time.Now()
+	sent := map[*netDevice]bool{}
+	output := func(netdev *netDevice) {
+		sent[netdev] = true
+		fmt.Printf("Forwarding multicast packet from %s to %s on %s\n", printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr), netdev.name)
+		ethernetOutput(netdev, multicastMacAddr(ipheader.destAddr), forwardPacket, ETHER_TYPE_IP)
+	}
+	for _, membership := range multicastMembershipList {
+		netdev := membership.netdev
+		if membership.local || membership.group != ipheader.destAddr || netdev == inputdev || sent[netdev] {
+			continue
+		}
+		if !now.Before(membership.expires) {
+			continue
+		}
+		if igmpProxy != nil && !igmpProxyForwardTo(inputdev, netdev) {
+			continue
+		}
+		output(netdev)
+	}
+	// IGMPプロキシの下流から受け取ったパケットは上流にも送る
+	if isIgmpProxyDownstream(inputdev) {
+		if upstream := searchNetDeviceByName(igmpProxy.config.upstream); upstream != nil {
+			output(upstream)
+		}
+	}
+	if len(sent) == 0 {
+		countDrop(DROP_REASON_NO_MULTICAST_MEMBER)
+		return
+	}
+	publishPacketEvent(inputdev.name, PACKET_EVENT_FORWARDED, ipheader)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+IGMPプロキシ(RFC 4605)
+上流のインターフェイスを1つと下流のインターフェイスを決め、マルチキャストのルーティングプロトコルを使わずに
+下流のホストが参加したグループへのマルチキャストを上流から受け取れるようにする
+  下流  クエリアとしてクエリを送り、ホストのレポートからインターフェイスごとのグループの表を作る
+  上流  下流の全てのグループをまとめて、ルータがホストとしてレポートとLeaveを送る、クエリにもホストとして答える
+上流から受け取ったグループ宛てのパケットはメンバーのいる下流のインターフェイスにフォワードする
+下流から受け取ったパケットは上流と、メンバーのいる他の下流のインターフェイスにフォワードする
+https://www.rfc-editor.org/rfc/rfc4605
+*/
+
+// "upstream=eth0,downstream=eth1+eth2"の形式のIGMPプロキシの設定
+type igmpProxyConfig struct {
+	upstream    string
+	downstreams []string
+}
+
+type igmpProxyState struct {
+	config igmpProxyConfig
+	// 上流にレポートを送って参加しているグループ
+	groups map[uint32]bool
+}
+
+// IGMPプロキシ、nilなら動かさない
+var igmpProxy *igmpProxyState
+
+// コマンドラインで指定された設定
+var igmpProxyFlagConfig igmpProxyConfig
+
+func parseIgmpProxyConfig(spec string) (igmpProxyConfig, error) {
+	var config igmpProxyConfig
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return igmpProxyConfig{}, fmt.Errorf("invalid igmp proxy config %q, format is upstream=name,downstream=name+name", spec)
+		}
+		switch key {
+		case "upstream":
+			config.upstream = value
+		case "downstream":
+			config.downstreams = strings.Split(value, "+")
+		default:
+			return igmpProxyConfig{}, fmt.Errorf("unknown igmp proxy config %q", key)
+		}
+	}
+	return newIgmpProxyConfig(config.upstream, config.downstreams)
+}
+
+func newIgmpProxyConfig(upstream string, downstreams []string) (igmpProxyConfig, error) {
+	if upstream == "" {
+		return igmpProxyConfig{}, fmt.Errorf("igmp proxy upstream interface is not specified")
+	}
+	if len(downstreams) == 0 {
+		return igmpProxyConfig{}, fmt.Errorf("igmp proxy downstream interfaces are not specified")
+	}
+	for _, name := range downstreams {
+		if name == "" || name == upstream {
+			return igmpProxyConfig{}, fmt.Errorf("invalid igmp proxy downstream interface %q", name)
+		}
+	}
+	return igmpProxyConfig{upstream: upstream, downstreams: downstreams}, nil
+}
+
+func (config igmpProxyConfig) equal(other igmpProxyConfig) bool {
+	return config.upstream == other.upstream && strings.Join(config.downstreams, "+") == strings.Join(other.downstreams, "+")
+}
+
+/*
+IGMPプロキシを設定する
+上流のインターフェイスが空なら止めて、上流で参加していたグループから抜ける
+*/
+func setIgmpProxy(config igmpProxyConfig) {
+	if igmpProxy != nil && (config.upstream == "" || !igmpProxy.config.equal(config)) {
+		igmpProxyLeaveAll()
+		igmpProxy = nil
+		fmt.Println("IGMP proxy is stopped")
+	}
+	if config.upstream == "" || igmpProxy != nil {
+		return
+	}
+	igmpProxy = &igmpProxyState{config: config, groups: map[uint32]bool{}}
+	fmt.Printf("IGMP proxy is started, upstream %s, downstream %s\n", config.upstream, strings.Join(config.downstreams, ","))
+	igmpProxyUpdate()
+}
+
+// 上流のインターフェイスか
+func isIgmpProxyUpstream(netdev *netDevice) bool {
+	return igmpProxy != nil && netdev.name == igmpProxy.config.upstream && isDefaultInstanceDevice(netdev)
+}
+
+// 下流のインターフェイスか
+func isIgmpProxyDownstream(netdev *netDevice) bool {
+	if igmpProxy == nil || !isDefaultInstanceDevice(netdev) {
+		return false
+	}
+	for _, name := range igmpProxy.config.downstreams {
+		if netdev.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+下流のメンバーシップをまとめて、上流で参加するグループを合わせる
+新しいグループはレポートを送り、メンバーがいなくなったグループはLeaveを送る
+*/
+func igmpProxyUpdate() {
+	if igmpProxy == nil {
+		return
+	}
+	now := time.Now()
+	groups := map[uint32]bool{}
+	for _, membership := range multicastMembershipList {
+		if !membership.local && isIgmpProxyDownstream(membership.netdev) && now.Before(membership.expires) {
+			groups[membership.group] = true
+		}
+	}
+	upstream := searchNetDeviceByName(igmpProxy.config.upstream)
+	for group := range groups {
+		if igmpProxy.groups[group] {
+			continue
+		}
+		igmpProxy.groups[group] = true
+		fmt.Printf("Joined multicast group %s upstream by igmp proxy\n", printIPAddr(group))
+		if upstream != nil {
+			igmpSendReport(upstream, group)
+		}
+	}
+	for group := range igmpProxy.groups {
+		if groups[group] {
+			continue
+		}
+		delete(igmpProxy.groups, group)
+		fmt.Printf("Left multicast group %s upstream by igmp proxy\n", printIPAddr(group))
+		if upstream != nil && upstream.ipDev.address != 0 {
+			igmpOutput(upstream, IP_ADDRESS_ALL_ROUTERS, igmpPacket(IGMP_TYPE_LEAVE_GROUP, 0, group))
+		}
+	}
+}
+
+// 止める時は上流で参加していた全てのグループから抜ける
+func igmpProxyLeaveAll() {
+	upstream := searchNetDeviceByName(igmpProxy.config.upstream)
+	for group := range igmpProxy.groups {
+		if upstream != nil && upstream.ipDev.address != 0 {
+			igmpOutput(upstream, IP_ADDRESS_ALL_ROUTERS, igmpPacket(IGMP_TYPE_LEAVE_GROUP, 0, group))
+		}
+	}
+	igmpProxy.groups = map[uint32]bool{}
+}
+
+// 上流で受け取ったクエリに、下流でまとめたグループのレポートを返す
+func igmpProxyAnswerQuery(upstream *netDevice, group uint32) {
+	for _, g := range igmpProxyGroups() {
+		if group == 0 || group == g {
+			igmpSendReport(upstream, g)
+		}
+	}
+}
+
+// 上流で参加しているグループの一覧
+func igmpProxyGroups() []uint32 {
+	if igmpProxy == nil {
+		return nil
+	}
+	var groups []uint32
+	for group := range igmpProxy.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups
+}
+
+/*
+IGMPプロキシでマルチキャストのパケットを送るインターフェイスか
+上流から受け取ったら下流へ、下流から受け取ったら上流と他の下流へ送る
+*/
+func igmpProxyForwardTo(inputdev, netdev *netDevice) bool {
+	if netdev == inputdev {
+		return false
+	}
+	if isIgmpProxyUpstream(inputdev) {
+		return isIgmpProxyDownstream(netdev)
+	}
+	if isIgmpProxyDownstream(inputdev) {
+		return isIgmpProxyDownstream(netdev) || isIgmpProxyUpstream(netdev)
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+送信の遅延と損失のエミュレーション
+tc/netemを使わずに、ルータを通る通信でWANのような遅延や揺らぎ、パケットロスを再現する
+インターフェイスごとに指定して、送るフレームを時刻つきのキューに入れ、時間が来たらシェーピングと送信の処理に渡す
+  delay    全てのフレームを遅らせる時間
+  jitter   遅延を±jitterの範囲でランダムに揺らす、揺らいだ結果フレームの順番が入れ替わることもある
+  loss     フレームを捨てる割合(%)
+  reorder  遅延させずにすぐに送るフレームの割合(%)、先に待っているフレームを追い越すので順番が入れ替わる
+*/
+
+// 遅延させて送信を待つフレームの上限、超えたら破棄する
+const IMPAIRMENT_QUEUE_LEN = 1000
+
+type impairment struct {
+	delay   time.Duration
+	jitter  time.Duration
+	loss    float64 // %
+	reorder float64 // %
+}
+
+func (imp impairment) String() string {
+	return fmt.Sprintf("delay %s jitter %s loss %g%% reorder %g%%", imp.delay, imp.jitter, imp.loss, imp.reorder)
+}
+
+// 遅延させて送信を待っているフレーム
+type impairedFrame struct {
+	at    time.Time
+	frame []byte
+}
+
+// コマンドラインで指定されたインターフェイスごとの遅延と損失
+var impairmentFlags = map[string]impairment{}
+
+// "dev=eth1,delay=50ms,jitter=10ms,loss=1,reorder=5"の形式の設定を読む
+func parseImpairmentConfig(spec string) (string, impairment, error) {
+	var ifname string
+	var imp impairment
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return "", impairment{}, fmt.Errorf("invalid impairment config %q, format is dev=name,delay=duration,jitter=duration,loss=percent,reorder=percent", spec)
+		}
+		var err error
+		switch key {
+		case "dev":
+			ifname = value
+		case "delay":
+			imp.delay, err = time.ParseDuration(value)
+		case "jitter":
+			imp.jitter, err = time.ParseDuration(value)
+		case "loss":
+			imp.loss, err = strconv.ParseFloat(value, 64)
+		case "reorder":
+			imp.reorder, err = strconv.ParseFloat(value, 64)
+		default:
+			err = fmt.Errorf("unknown impairment config %q", key)
+		}
+		if err != nil {
+			return "", impairment{}, err
+		}
+	}
+	if ifname == "" {
+		return "", impairment{}, fmt.Errorf("impairment interface is not specified")
+	}
+	if err := imp.validate(); err != nil {
+		return "", impairment{}, fmt.Errorf("impairment of %s : %s", ifname, err)
+	}
+	return ifname, imp, nil
+}
+
+func (imp impairment) validate() error {
+	if imp.delay < 0 || imp.jitter < 0 {
+		return fmt.Errorf("delay and jitter must not be negative")
+	}
+	if imp.loss < 0 || imp.loss > 100 || imp.reorder < 0 || imp.reorder > 100 {
+		return fmt.Errorf("loss and reorder must be between 0 and 100")
+	}
+	return nil
+}
+
+// インターフェイスの遅延と損失を設定する、nilなら無効にする
+func setNetDeviceImpairment(netdev *netDevice, imp *impairment) {
+	if imp == nil {
+		if netdev.impairment != nil {
+			// 待っているフレームは送ってしまう
+			queue := netdev.impairQueue
+			netdev.impairQueue = nil
+			netdev.impairment = nil
+			for _, queued := range queue {
+				netdev.netDeviceEgress(queued.frame)
+			}
+			fmt.Printf("Disabled impairment on %s\n", netdev.name)
+		}
+		return
+	}
+	if netdev.impairment == nil || *netdev.impairment != *imp {
+		config := *imp
+		netdev.impairment = &config
+		fmt.Printf("Impairing %s with %s\n", netdev.name, imp)
+	}
+}
+
+// コマンドラインで指定した遅延と損失をインターフェイスに設定する
+func setNetDeviceImpairmentFromFlags(netdev *netDevice) {
+	if imp, ok := impairmentFlags[netdev.name]; ok {
+		setNetDeviceImpairment(netdev, &imp)
+		return
+	}
+	setNetDeviceImpairment(netdev, nil)
+}
+
+// 送るフレームを捨てるか、送る時刻を決めてキューに入れる
+func impairEnqueue(netdev *netDevice, data []byte, now time.Time) {
+	imp := netdev.impairment
+	if imp.loss > 0 && rand.Float64()*100 < imp.loss {
+		netdev.stats.impairLost++
+		countDrop(DROP_REASON_IMPAIRMENT_LOSS)
+		return
+	}
+	if len(netdev.impairQueue) >= IMPAIRMENT_QUEUE_LEN {
+		netdev.stats.txQueueDrops++
+		countDrop(DROP_REASON_TX_QUEUE_FULL)
+		return
+	}
+	delay := imp.delay
+	if imp.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*imp.jitter)+1)) - imp.jitter
+	}
+	if delay < 0 || (imp.reorder > 0 && rand.Float64()*100 < imp.reorder) {
+		delay = 0
+	}
+	// 呼び出し元はバッファを使い回すことがあるのでコピーしておく
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	at := now.Add(delay)
+	// 送る時刻の順に並べる、同じ時刻なら入れた順にする
+	i := sort.Search(len(netdev.impairQueue), func(i int) bool { return netdev.impairQueue[i].at.After(at) })
+	netdev.impairQueue = append(netdev.impairQueue, impairedFrame{})
+	copy(netdev.impairQueue[i+1:], netdev.impairQueue[i:])
+	netdev.impairQueue[i] = impairedFrame{at: at, frame: frame}
+}
+
+/*
+送る時刻になったフレームをシェーピングと送信の処理に渡す
+次のフレームを送る時刻までの時間を返し、待っているフレームが無ければ-1を返す
+*/
+func impairTransmitQueued(now time.Time) time.Duration {
+	next := time.Duration(-1)
+	for _, netdev := range netDeviceList {
+		n := 0
+		for n < len(netdev.impairQueue) && !netdev.impairQueue[n].at.After(now) {
+			frame := netdev.impairQueue[n].frame
+			netdev.impairQueue[n].frame = nil
+			n++
+			// 待っている間に止められたインターフェイスからは送らない
+			if !netdev.isUp() {
+				countDrop(DROP_REASON_INTERFACE_DOWN)
+				continue
+			}
+			netdev.netDeviceEgress(frame)
+		}
+		netdev.impairQueue = netdev.impairQueue[n:]
+		if len(netdev.impairQueue) == 0 {
+			netdev.impairQueue = nil
+			continue
+		}
+		if wait := netdev.impairQueue[0].at.Sub(now); next < 0 || wait < next {
+			next = wait
+		}
+	}
+	return next
+}
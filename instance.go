@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+マルチインスタンス
+1つのプロセスで独立した複数のルータを動かし、1台のマシンで複数のルータをつないだ実験をできるようにする
+インスタンスごとにインターフェイス、ルートテーブル(RIBとFIB)、ARPテーブルを持つ
+インスタンスのインターフェイスは別のnetnsのNICか、インスタンス用に作るtapデバイス
+  -instance name=r2,netns=r2,route=192.168.1.0/24@192.168.0.1
+  -instance name=r3,tap=tap10=10.0.0.1/24,tap=tap11=10.0.1.1/24,route=0.0.0.0/0@10.0.0.2
+全てのインスタンスのsocketを1つのepollで待ち、受信したインターフェイスのインスタンスに切り替えてから処理する
+ルータの処理はグローバル変数のテーブルを使うので、切り替える時に今のインスタンスのテーブルを退避して入れ替える
+epollのループの外(タイマーや管理API)では必ず既定のインスタンスに戻しておくので、
+NAT、VRRP、PPPoEなどの機能、設定ファイル、管理APIの/instances以外は既定のインスタンスだけが対象になる
+インスタンスのnetnsのインターフェイスの追加や削除は監視しない
+*/
+
+// 既定のインスタンスの名前
+const DEFAULT_INSTANCE_NAME = "default"
+
+// ip netns addで作ったnetnsの置き場所
+const NETNS_RUN_DIR = "/var/run/netns"
+
+type instanceRoute struct {
+	prefix    uint32
+	prefixLen uint32
+	nexthop   uint32
+}
+
+type routerInstance struct {
+	name   string
+	netns  string            // 空ならルータと同じnetns
+	taps   []tapDeviceConfig // インスタンス用に作るtapデバイス
+	routes []instanceRoute   // 起動時に入れる静的経路
+	// 動いていない間のテーブル、動いている間はグローバル変数にある
+	devices    []*netDevice
+	fib        radixTreeNode
+	rib        map[ribKey][]ipRouteEntry
+	arpTable   []arpTableEntry
+	arpPending map[uint32]*arpPendingEntry
+	staticArp  []staticArpEntry
+}
+
+// フラグで指定されたルータ自身
+var defaultRouterInstance = &routerInstance{name: DEFAULT_INSTANCE_NAME}
+
+// -instanceで追加したインスタンス
+var routerInstances []*routerInstance
+
+// テーブルがグローバル変数に入っているインスタンス
+var activeRouterInstance = defaultRouterInstance
+
+/*
+-instanceの値を読む
+例: name=r2,netns=r2,route=192.168.1.0/24@192.168.0.1
+tapとrouteは繰り返して指定できる
+*/
+func parseRouterInstance(spec string) (*routerInstance, error) {
+	inst := &routerInstance{
+		rib:        map[ribKey][]ipRouteEntry{},
+		arpPending: map[uint32]*arpPendingEntry{},
+	}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid instance %q, format is name=name,netns=netns,tap=name=address/prefix,route=prefix@nexthop", spec)
+		}
+		switch key {
+		case "name":
+			inst.name = value
+		case "netns":
+			inst.netns = value
+		case "tap":
+			taps, err := parseTapDeviceConfig(value)
+			if err != nil {
+				return nil, err
+			}
+			inst.taps = append(inst.taps, taps...)
+		case "route":
+			prefix, nexthop, found := strings.Cut(value, "@")
+			if !found {
+				return nil, fmt.Errorf("invalid instance route %q, format is prefix@nexthop", value)
+			}
+			route := instanceRoute{}
+			var err error
+			route.prefix, route.prefixLen, err = parsePrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
+			route.nexthop, err = parseIPAddr(nexthop)
+			if err != nil {
+				return nil, err
+			}
+			inst.routes = append(inst.routes, route)
+		default:
+			return nil, fmt.Errorf("unknown instance config %q", key)
+		}
+	}
+	if inst.name == "" || inst.name == DEFAULT_INSTANCE_NAME {
+		return nil, fmt.Errorf("instance name must be given and not %s", DEFAULT_INSTANCE_NAME)
+	}
+	for _, other := range routerInstances {
+		if other.name == inst.name {
+			return nil, fmt.Errorf("instance %s is already defined", inst.name)
+		}
+	}
+	if inst.netns == "" && len(inst.taps) == 0 {
+		return nil, fmt.Errorf("instance %s needs netns or tap", inst.name)
+	}
+	return inst, nil
+}
+
+/*
+インスタンスのテーブルをグローバル変数に入れる
+今動いているインスタンスのテーブルはそのインスタンスに退避する
+*/
+func (inst *routerInstance) activate() {
+	current := activeRouterInstance
+	if current == inst {
+		return
+	}
+	current.devices = netDeviceList
+	current.fib = iproute
+	current.rib = ipRib
+	current.arpTable = ArpTableEntryList
+	current.arpPending = arpPendingList
+	current.staticArp = staticArpEntries
+
+	netDeviceList = inst.devices
+	iproute = inst.fib
+	ipRib = inst.rib
+	ArpTableEntryList = inst.arpTable
+	arpPendingList = inst.arpPending
+	staticArpEntries = inst.staticArp
+	activeRouterInstance = inst
+}
+
+/*
+既定のインスタンスのインターフェイスか
+NATやACLなどの設定はインターフェイスの名前で持っていて既定のインスタンスのものなので、
+他のインスタンスのnetnsに同じ名前のインターフェイスがあっても効かないようにする
+*/
+func isDefaultInstanceDevice(netdev *netDevice) bool {
+	if len(routerInstances) == 0 {
+		return true
+	}
+	for _, dev := range defaultRouterInstance.netDevices() {
+		if dev == netdev {
+			return true
+		}
+	}
+	return false
+}
+
+// インスタンスのインターフェイス、動いているインスタンスならグローバル変数の方を見る
+func (inst *routerInstance) netDevices() []*netDevice {
+	if inst == activeRouterInstance {
+		return netDeviceList
+	}
+	return inst.devices
+}
+
+/*
+既定のインスタンスから順に全てのインスタンスに切り替えてfnを呼ぶ
+最後は既定のインスタンスに戻す
+*/
+func eachRouterInstance(fn func(inst *routerInstance)) {
+	for _, inst := range append([]*routerInstance{defaultRouterInstance}, routerInstances...) {
+		inst.activate()
+		fn(inst)
+	}
+	defaultRouterInstance.activate()
+}
+
+// socketからインスタンスとnetDeviceを探す
+func searchNetDeviceBySocket(fd int32) (*routerInstance, *netDevice) {
+	for _, inst := range append([]*routerInstance{defaultRouterInstance}, routerInstances...) {
+		for _, netdev := range inst.netDevices() {
+			if int32(netdev.socket) == fd {
+				return inst, netdev
+			}
+		}
+	}
+	return nil, nil
+}
+
+/*
+-instanceで追加したインスタンスのインターフェイスを作り、経路を入れる
+netnsが指定されていれば、そのnetnsに入ってNICのsocketやtapデバイスを作る
+*/
+func setupRouterInstances(epfd int, backend string) error {
+	defer defaultRouterInstance.activate()
+	for _, inst := range routerInstances {
+		inst.activate()
+		var devices []*netDevice
+		err := inNetns(inst.netns, func() error {
+			if inst.netns != "" && backend != "tun" {
+				interfaces, err := net.Interfaces()
+				if err != nil {
+					return err
+				}
+				for _, netif := range interfaces {
+					if isIgnoreInterfaces(netif.Name) {
+						continue
+					}
+					netdev, err := newInterfaceNetDevice(netif)
+					if err != nil {
+						return err
+					}
+					netdev.linkDown = !netifOperUp(netif)
+					devices = append(devices, netdev)
+				}
+			}
+			for _, config := range inst.taps {
+				netdev, err := newTapNetDevice(config)
+				if err != nil {
+					return fmt.Errorf("create tap device err : %s", err)
+				}
+				devices = append(devices, netdev)
+			}
+			// ethtoolはnetnsの中のインターフェイスの名前で調べる
+			for _, netdev := range devices {
+				detectChecksumOffload(netdev)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("instance %s : %s", inst.name, err)
+		}
+		for _, netdev := range devices {
+			err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, netdev.socket, &syscall.EpollEvent{
+				Events: syscall.EPOLLIN,
+				Fd:     int32(netdev.socket),
+			})
+			if err != nil {
+				return fmt.Errorf("epoll ctrl err : %s", err)
+			}
+			netdev.icmpRedirect = true
+			addConnectedRoute(netdev)
+			netDeviceList = append(netDeviceList, netdev)
+			netdev.updateSocketFilter()
+			fmt.Printf("Instance %s: device %s address [%s]\n", inst.name, netdev.name, netdev.ipDev.String())
+		}
+		for _, route := range inst.routes {
+			addStaticRoute(route.prefix, route.prefixLen, network, route.nexthop, 0, 0)
+			fmt.Printf("Instance %s: route %s/%d via %s\n",
+				inst.name, printIPAddr(route.prefix), route.prefixLen, printIPAddr(route.nexthop))
+		}
+	}
+	return nil
+}
+
+/*
+netnsに入ってfnを呼び、元のnetnsに戻る
+netnsはスレッドごとなので、fnの間はgoroutineをスレッドに固定する
+*/
+func inNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	path := netns
+	if !strings.Contains(netns, "/") {
+		path = filepath.Join(NETNS_RUN_DIR, netns)
+	}
+	runtime.LockOSThread()
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("open current netns err : %s", err)
+	}
+	defer origin.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("open netns %s err : %s", netns, err)
+	}
+	defer target.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("enter netns %s err : %s", netns, err)
+	}
+	fnErr := fn()
+	// 戻れなかったスレッドは他のgoroutineに使わせないように固定したままにする
+	if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("return from netns %s err : %s", netns, err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
+
+// 追加したインスタンスのインターフェイスを閉じる
+func closeRouterInstances(epfd int) {
+	for _, inst := range routerInstances {
+		for _, netdev := range inst.netDevices() {
+			syscall.EpollCtl(epfd, syscall.EPOLL_CTL_DEL, netdev.socket, nil)
+			netdev.closeSocket()
+			stats := netdev.stats
+			fmt.Printf("Instance %s: %s: rx %d packets %d bytes, tx %d packets %d bytes\n",
+				inst.name, netdev.name, stats.rxPackets, stats.rxBytes, stats.txPackets, stats.txBytes)
+		}
+	}
+}
+
+/*
+全てのインスタンスの遅延させているフレームとシェーピングの送信キュー、socketに送れずに残ったフレームを送る
+次に送り直すまでの時間を返す、送るものが無ければ負の値
+*/
+func transmitRouterInstances(now time.Time) time.Duration {
+	wait := time.Duration(-1)
+	eachRouterInstance(func(inst *routerInstance) {
+		next := impairTransmitQueued(now)
+		if queued := qosTransmitQueued(now); queued >= 0 && (next < 0 || queued < next) {
+			next = queued
+		}
+		if retry := flushTxQueues(); retry >= 0 && (next < 0 || retry < next) {
+			next = retry
+		}
+		if next >= 0 && (wait < 0 || next < wait) {
+			wait = next
+		}
+	})
+	return wait
+}
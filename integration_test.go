@@ -0,0 +1,4868 @@
+//go:build integration
+
+package main
+
+/*
+network namespaceとvethでトポロジを組んで、ルータを実際に動かして確認する結合テスト
+root権限が必要
+  sudo go test -tags=integration -v -run Integration
+
+  host1 (192.168.1.2) ── (192.168.1.1) router1 (192.168.0.1) ── (192.168.0.2) host2
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nilpoona/go-curo/proto/routerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	itNetnsPrefix    = "curo-it-"
+	itProbeEnvDest   = "CURO_IT_PROBE_DEST"
+	itProbeEnvTTL    = "CURO_IT_PROBE_TTL"
+	itMcastEnvJoin   = "CURO_IT_MCAST_JOIN"
+	itMcastEnvSend   = "CURO_IT_MCAST_SEND"
+	itMcastPort      = 5000
+	itBlastEnvDest   = "CURO_IT_BLAST_DEST"
+	itBlastPort      = 5001
+	itBlastCount     = 20
+	itBlastSize      = 1000
+	itDnsEnvServe    = "CURO_IT_DNS_SERVE"
+	itDnsEnvQuery    = "CURO_IT_DNS_QUERY"
+	itNtpEnvServe    = "CURO_IT_NTP_SERVE"
+	itNtpEnvQuery    = "CURO_IT_NTP_QUERY"
+	itPppoeEnvAC     = "CURO_IT_PPPOE_AC"
+	itArpEnvReply    = "CURO_IT_ARP_REPLY"
+	itIpEnvSpoof     = "CURO_IT_IP_SPOOF"
+	itTraceEnvDest   = "CURO_IT_TRACE_DEST"
+	itTracePort      = 33434
+	itSnmpEnv        = "CURO_IT_SNMP"
+	itSyslogEnvServe = "CURO_IT_SYSLOG_SERVE"
+	itUdpEnvEcho     = "CURO_IT_UDP_ECHO"
+	itUdpEnvSend     = "CURO_IT_UDP_SEND"
+	itUdpEnvSize     = "CURO_IT_UDP_SIZE"
+	itFtpEnvServe    = "CURO_IT_FTP_SERVE"
+	itFtpEnvCommand  = "CURO_IT_FTP_COMMAND"
+	itSipEnvServe    = "CURO_IT_SIP_SERVE"
+	itSipEnvInvite   = "CURO_IT_SIP_INVITE"
+	itTosEnvEcho     = "CURO_IT_TOS_ECHO"
+	itTosEnvSend     = "CURO_IT_TOS_SEND"
+	itIcmpEnvQuery   = "CURO_IT_ICMP_QUERY"
+	itDhcpv6EnvServe = "CURO_IT_DHCPV6_SERVE"
+	itV6EnvSend      = "CURO_IT_V6_SEND"
+	itSflowEnvServe  = "CURO_IT_SFLOW_SERVE"
+	itRouterStartMsg = "start router..."
+)
+
+var routerBinary string
+
+func TestMain(m *testing.M) {
+	// netnsの中で実行されるICMPプローブのヘルパープロセス
+	if dest := os.Getenv(itProbeEnvDest); dest != "" {
+		os.Exit(runProbeHelper(dest, os.Getenv(itProbeEnvTTL)))
+	}
+	// マルチキャストを受信、送信するヘルパープロセス
+	if group := os.Getenv(itMcastEnvJoin); group != "" {
+		os.Exit(runMulticastJoinHelper(group))
+	}
+	if group := os.Getenv(itMcastEnvSend); group != "" {
+		os.Exit(runMulticastSendHelper(group))
+	}
+	// UDPのデータグラムを連続で送るヘルパープロセス
+	if dest := os.Getenv(itBlastEnvDest); dest != "" {
+		os.Exit(runBlastHelper(dest))
+	}
+	// DNSサーバとクライアントのヘルパープロセス
+	if answer := os.Getenv(itDnsEnvServe); answer != "" {
+		os.Exit(runDnsServerHelper(answer))
+	}
+	if query := os.Getenv(itDnsEnvQuery); query != "" {
+		os.Exit(runDnsQueryHelper(query))
+	}
+	// NTPサーバとクライアントのヘルパープロセス
+	if offset := os.Getenv(itNtpEnvServe); offset != "" {
+		os.Exit(runNtpServerHelper(offset))
+	}
+	if server := os.Getenv(itNtpEnvQuery); server != "" {
+		os.Exit(runNtpQueryHelper(server))
+	}
+	// PPPoEのアクセスコンセントレータのヘルパープロセス
+	if ifname := os.Getenv(itPppoeEnvAC); ifname != "" {
+		os.Exit(runPppoeAcHelper(ifname))
+	}
+	// UDPのtracerouteのヘルパープロセス
+	if dest := os.Getenv(itTraceEnvDest); dest != "" {
+		os.Exit(runTraceHelper(dest))
+	}
+	// SNMPのマネージャのヘルパープロセス
+	if spec := os.Getenv(itSnmpEnv); spec != "" {
+		os.Exit(runSnmpHelper(spec))
+	}
+	// syslogのコレクタのヘルパープロセス
+	if port := os.Getenv(itSyslogEnvServe); port != "" {
+		os.Exit(runSyslogServerHelper(port))
+	}
+	// 偽のARPリプライを送るヘルパープロセス
+	if spec := os.Getenv(itArpEnvReply); spec != "" {
+		os.Exit(runArpReplyHelper(spec))
+	}
+	// 送信元を偽ったIPパケットを送るヘルパープロセス
+	if spec := os.Getenv(itIpEnvSpoof); spec != "" {
+		os.Exit(runIpSpoofHelper(spec))
+	}
+	// ICMPのTimestampとAddress Maskのリクエストを送るヘルパープロセス
+	if spec := os.Getenv(itIcmpEnvQuery); spec != "" {
+		os.Exit(runIcmpQueryHelper(spec))
+	}
+	// プレフィックスを委譲するDHCPv6サーバのヘルパープロセス
+	if ifname := os.Getenv(itDhcpv6EnvServe); ifname != "" {
+		os.Exit(runDhcpv6ServerHelper(ifname))
+	}
+	// IPv6でpingとUDP、DNSの問い合わせを送るヘルパープロセス
+	if spec := os.Getenv(itV6EnvSend); spec != "" {
+		os.Exit(runV6SendHelper(spec))
+	}
+	// sFlowのコレクタのヘルパープロセス
+	if port := os.Getenv(itSflowEnvServe); port != "" {
+		os.Exit(runSflowCollectorHelper(port))
+	}
+	// UDPのエコーサーバとクライアントのヘルパープロセス
+	if port := os.Getenv(itUdpEnvEcho); port != "" {
+		os.Exit(runUdpEchoHelper(port))
+	}
+	if dest := os.Getenv(itUdpEnvSend); dest != "" {
+		os.Exit(runUdpSendHelper(dest))
+	}
+	// FTPとSIPのALGを確かめるサーバとクライアントのヘルパープロセス
+	if os.Getenv(itFtpEnvServe) != "" {
+		os.Exit(runFtpServerHelper())
+	}
+	if spec := os.Getenv(itFtpEnvCommand); spec != "" {
+		os.Exit(runFtpCommandHelper(spec))
+	}
+	if os.Getenv(itSipEnvServe) != "" {
+		os.Exit(runSipServerHelper())
+	}
+	if spec := os.Getenv(itSipEnvInvite); spec != "" {
+		os.Exit(runSipInviteHelper(spec))
+	}
+	// 受信したToSを返すUDPのエコーサーバのヘルパープロセス
+	if port := os.Getenv(itTosEnvEcho); port != "" {
+		os.Exit(runTosEchoHelper(port))
+	}
+	if dest := os.Getenv(itTosEnvSend); dest != "" {
+		os.Exit(runTosSendHelper(dest))
+	}
+	if os.Geteuid() != 0 {
+		fmt.Println("integration tests require root privileges, skip")
+		os.Exit(0)
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		fmt.Println("ip command is not found, skip")
+		os.Exit(0)
+	}
+
+	dir, err := os.MkdirTemp("", "go-curo-it")
+	if err != nil {
+		fmt.Printf("create temp dir err : %s\n", err)
+		os.Exit(1)
+	}
+	routerBinary = filepath.Join(dir, "go-curo")
+	out, err := exec.Command("go", "build", "-o", routerBinary, ".").CombinedOutput()
+	if err != nil {
+		fmt.Printf("build router err : %s\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// テストで作るnetnsとvethの構成
+type labTopology struct {
+	namespaces []string
+}
+
+type labLink struct {
+	ns1, dev1, addr1 string
+	ns2, dev2, addr2 string
+}
+
+func runIP(t *testing.T, args ...string) {
+	t.Helper()
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip %s err : %s\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func netnsName(name string) string {
+	return itNetnsPrefix + name
+}
+
+/*
+namespaceとリンクを作成する
+テスト終了時に全て削除する
+*/
+func newLabTopology(t *testing.T, namespaces []string, links []labLink) *labTopology {
+	t.Helper()
+	topo := &labTopology{}
+	t.Cleanup(topo.destroy)
+
+	for _, ns := range namespaces {
+		// 前回のテストの残骸があれば消しておく
+		exec.Command("ip", "netns", "delete", netnsName(ns)).Run()
+		runIP(t, "netns", "add", netnsName(ns))
+		topo.namespaces = append(topo.namespaces, netnsName(ns))
+		runIP(t, "-n", netnsName(ns), "link", "set", "lo", "up")
+	}
+	for _, l := range links {
+		runIP(t, "link", "add", "name", l.dev1, "netns", netnsName(l.ns1),
+			"type", "veth", "peer", "name", l.dev2, "netns", netnsName(l.ns2))
+		// ブリッジのポートのようにアドレスをつけないインターフェイスもある
+		if l.addr1 != "" {
+			runIP(t, "-n", netnsName(l.ns1), "addr", "add", l.addr1, "dev", l.dev1)
+		}
+		if l.addr2 != "" {
+			runIP(t, "-n", netnsName(l.ns2), "addr", "add", l.addr2, "dev", l.dev2)
+		}
+		runIP(t, "-n", netnsName(l.ns1), "link", "set", l.dev1, "up")
+		runIP(t, "-n", netnsName(l.ns2), "link", "set", l.dev2, "up")
+	}
+	// ルータはリンクが上がっていないインターフェイスに経路を入れないので、全てのリンクが上がるまで待つ
+	for _, l := range links {
+		waitLinkUp(t, l.ns1, l.dev1)
+		waitLinkUp(t, l.ns2, l.dev2)
+	}
+	return topo
+}
+
+// vethのリンクの状態はカーネルが少し遅れて更新するので、state UPになるまで待つ
+func waitLinkUp(t *testing.T, ns, dev string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		out, err := exec.Command("ip", "-n", netnsName(ns), "-o", "link", "show", "dev", dev).CombinedOutput()
+		if err == nil && strings.Contains(string(out), "state UP") {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("link %s in %s did not come up", dev, ns)
+}
+
+func (topo *labTopology) destroy() {
+	for _, ns := range topo.namespaces {
+		exec.Command("ip", "netns", "delete", ns).Run()
+	}
+}
+
+// namespaceの中でコマンドを実行する
+func (topo *labTopology) exec(t *testing.T, ns string, args ...string) {
+	t.Helper()
+	out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName(ns)}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s in %s err : %s\n%s", strings.Join(args, " "), ns, err, out)
+	}
+}
+
+// 起動したルータプロセスと標準出力
+type routerProcess struct {
+	cmd    *exec.Cmd
+	mu     sync.Mutex
+	output bytes.Buffer
+}
+
+func (r *routerProcess) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.output.Write(p)
+}
+
+func (r *routerProcess) Output() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.output.String()
+}
+
+// SIGTERMで止めて、終わるまで待つ
+func (r *routerProcess) stop(t *testing.T) {
+	t.Helper()
+	r.cmd.Process.Signal(syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() { done <- r.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("router did not stop in time")
+	}
+}
+
+/*
+namespaceの中でルータを起動し、パケットの受信を開始するまで待つ
+nsが空の場合は現在のnamespaceで起動する
+カーネル自身がICMPに応答したりフォワードしないように設定しておく
+*/
+func (topo *labTopology) startRouter(t *testing.T, ns string, args ...string) *routerProcess {
+	t.Helper()
+	r := &routerProcess{}
+	if ns == "" {
+		// tapデバイスだけを使う場合はnamespaceを作らずに起動する
+		r.cmd = exec.Command(routerBinary, args...)
+	} else {
+		topo.exec(t, ns, "sysctl", "-q", "-w", "net.ipv4.icmp_echo_ignore_all=1")
+		topo.exec(t, ns, "sysctl", "-q", "-w", "net.ipv4.ip_forward=0")
+		r.cmd = exec.Command("ip", append([]string{"netns", "exec", netnsName(ns), routerBinary}, args...)...)
+	}
+	stdout, err := r.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.cmd.Stderr = r
+	if err := r.cmd.Start(); err != nil {
+		t.Fatalf("start router err : %s", err)
+	}
+	t.Cleanup(func() {
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+		if t.Failed() {
+			t.Logf("router output:\n%s", r.Output())
+		}
+	})
+
+	// 開始のメッセージの後の行もScannerが読み込んでいることがあるので、最後までScannerで読む
+	started := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		closed := false
+		for scanner.Scan() {
+			line := scanner.Text()
+			fmt.Fprintln(r, line)
+			if !closed && strings.Contains(line, itRouterStartMsg) {
+				close(started)
+				closed = true
+			}
+		}
+		io.Copy(r, stdout)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("router did not start in time")
+	}
+	return r
+}
+
+// プローブの結果
+type probeResult struct {
+	icmpType uint8
+	icmpCode uint8
+	from     string
+}
+
+/*
+namespaceの中からICMPエコーリクエストを送り、最初に受け取ったICMPメッセージを返す
+ttlを小さくすればtracerouteのようにTime Exceededを確認できる
+*/
+func (topo *labTopology) probe(t *testing.T, ns, dest string, ttl int) (probeResult, error) {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	if ns == "" {
+		cmd = exec.Command(os.Args[0])
+	}
+	cmd.Env = append(os.Environ(), itProbeEnvDest+"="+dest, itProbeEnvTTL+"="+strconv.Itoa(ttl))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return probeResult{}, fmt.Errorf("probe %s from %s err : %s %s", dest, ns, err, stderr.String())
+	}
+	var result probeResult
+	_, err = fmt.Sscanf(string(out), "%d %d %s", &result.icmpType, &result.icmpCode, &result.from)
+	if err != nil {
+		return probeResult{}, fmt.Errorf("parse probe output %q err : %s", out, err)
+	}
+	return result, nil
+}
+
+// 応答が返るまで何度かプローブする
+func (topo *labTopology) probeRetry(t *testing.T, ns, dest string, ttl int) probeResult {
+	t.Helper()
+	var lastErr error
+	// 初回はARPの解決で落ちるので何度か送る
+	for i := 0; i < 5; i++ {
+		result, err := topo.probe(t, ns, dest, ttl)
+		if err == nil {
+			return result
+		}
+		lastErr = err
+	}
+	t.Fatal(lastErr)
+	return probeResult{}
+}
+
+func runProbeHelper(dest, ttlstr string) int {
+	ttl, err := strconv.Atoi(ttlstr)
+	if err != nil {
+		ttl = 64
+	}
+	ip := net.ParseIP(dest).To4()
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "invalid dest %s\n", dest)
+		return 1
+	}
+	var destAddr [4]byte
+	copy(destAddr[:], ip)
+
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+
+	// identifierはプロセスIDにする
+	var b bytes.Buffer
+	b.Write([]byte{ICMP_TYPE_ECHO_REQUEST, 0x00, 0x00, 0x00})
+	b.Write(uint16ToByte(uint16(os.Getpid())))
+	b.Write(uint16ToByte(1))
+	b.Write(make([]byte, 8))
+	b.Write([]byte("go-curo integration test"))
+	request := b.Bytes()
+	checksum := calcChecksum(request)
+	request[2], request[3] = checksum[0], checksum[1]
+
+	err = syscall.Sendto(sock, request, 0, &syscall.SockaddrInet4{Addr: destAddr})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+		return 1
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		headerLen := int(buf[0]&0x0f) * 4
+		if n < headerLen+8 {
+			continue
+		}
+		icmpType := buf[headerLen]
+		// 自分が送ったリクエストを受け取った場合は無視する
+		if icmpType == ICMP_TYPE_ECHO_REQUEST {
+			continue
+		}
+		addr := from.(*syscall.SockaddrInet4).Addr
+		fmt.Printf("%d %d %d.%d.%d.%d\n", icmpType, buf[headerLen+1], addr[0], addr[1], addr[2], addr[3])
+		return 0
+	}
+}
+
+/*
+TTLを1から増やしながらUDPを大きいポートに送り、返ってきたICMPのタイプとコードと送信元を1行ずつ出力する
+Port Unreachableを受け取ったら終わる
+*/
+func runTraceHelper(dest string) int {
+	ip := net.ParseIP(dest).To4()
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "invalid dest %s\n", dest)
+		return 1
+	}
+	var destAddr [4]byte
+	copy(destAddr[:], ip)
+	icmpSock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(icmpSock)
+	syscall.SetsockoptTimeval(icmpSock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+	// vethではUDPのチェックサムの計算がオフロードされて未計算のままフォワードされるので、
+	// rawソケットでチェックサムを0(無し)にしたUDPを送る
+	udpSock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_UDP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(udpSock)
+
+	buf := make([]byte, 1500)
+	for ttl := 1; ttl <= 8; ttl++ {
+		syscall.SetsockoptInt(udpSock, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		payload := []byte("go-curo traceroute")
+		udp := make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(udp[0:2], itTracePort)
+		binary.BigEndian.PutUint16(udp[2:4], uint16(itTracePort+ttl))
+		binary.BigEndian.PutUint16(udp[4:6], uint16(8+len(payload)))
+		udp = append(udp, payload...)
+		err = syscall.Sendto(udpSock, udp, 0, &syscall.SockaddrInet4{Addr: destAddr})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+			return 1
+		}
+		n, from, err := syscall.Recvfrom(icmpSock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		headerLen := int(buf[0]&0x0f) * 4
+		if n < headerLen+8 {
+			continue
+		}
+		icmpType, icmpCode := buf[headerLen], buf[headerLen+1]
+		addr := from.(*syscall.SockaddrInet4).Addr
+		fmt.Printf("%d %d %d.%d.%d.%d\n", icmpType, icmpCode, addr[0], addr[1], addr[2], addr[3])
+		if icmpType == ICMP_TYPE_DESTINATION_UNREACHABLE && icmpCode == ICMP_DEST_UNREACHABLE_CODE_PORT_UNREACHABLE {
+			return 0
+		}
+	}
+	fmt.Fprintln(os.Stderr, "port unreachable is not received")
+	return 1
+}
+
+// 基本のトポロジを作る
+func newBasicLab(t *testing.T) *labTopology {
+	topo := newLabTopology(t, []string{"host1", "router1", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "host2", dev1: "host2-router1", addr1: "192.168.0.2/24",
+			ns2: "router1", dev2: "router1-host2", addr2: "192.168.0.1/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("host2"), "route", "add", "default", "via", "192.168.0.1")
+	return topo
+}
+
+func TestIntegrationPingRouter(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2")
+
+	result := topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.1.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	if !strings.Contains(router.Output(), "ICMP ECHO REQUEST is received") {
+		t.Fatalf("echo request was not handled by the router")
+	}
+}
+
+func TestIntegrationPingOtherInterface(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2")
+
+	// 受信したインターフェイスとは別のインターフェイスのアドレスも自分宛てとして応答する
+	result := topo.probeRetry(t, "host1", "192.168.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+func TestIntegrationTapBackend(t *testing.T) {
+	topo := newLabTopology(t, []string{"router1"}, nil)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-backend", "tun", "-tap", "tap0=10.10.0.1/24")
+	// カーネル側のtapインターフェイスをホストとして使う
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "10.10.0.2/24", "dev", "tap0")
+
+	result := topo.probeRetry(t, "router1", "10.10.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.10.0.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+func TestIntegrationForwarding(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2")
+
+	// host2はカーネルが応答する
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+func TestIntegrationXdpBackend(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-backend", "xdp")
+	if !strings.Contains(router.Output(), "Created xdp device router1-host1") {
+		t.Fatalf("xdp device is not created\n%s", router.Output())
+	}
+
+	// XDPで受信したフレームも同じ処理でフォワードする
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	result = topo.probeRetry(t, "host2", "192.168.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.1" {
+		t.Fatalf("unexpected reply from router %+v", result)
+	}
+}
+
+func TestIntegrationTraceroute(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2")
+
+	// TTL1ではルータがTime Exceededを返し、TTL2で宛先に届く
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 1)
+	if result.icmpType != ICMP_TYPE_TIME_EXCEEDED || result.from != "192.168.1.1" {
+		t.Fatalf("unexpected reply for ttl 1 %+v", result)
+	}
+	result = topo.probeRetry(t, "host1", "192.168.0.2", 2)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply for ttl 2 %+v", result)
+	}
+}
+
+func TestIntegrationHostUnreachable(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2")
+
+	// 存在しないホストへ送り続けるとARPの再送の上限の後にHost Unreachableが返る
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		result, err := topo.probe(t, "host1", "192.168.0.100", 64)
+		if err != nil {
+			continue
+		}
+		if result.icmpType != ICMP_TYPE_DESTINATION_UNREACHABLE ||
+			result.icmpCode != ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE {
+			t.Fatalf("unexpected reply %+v", result)
+		}
+		// リクエストは間隔を空けて送られている
+		if n := strings.Count(router.Output(), "Sending arp request via router1-host2 for c0a80064"); ARP_REQUEST_MAX_RETRY < n {
+			t.Fatalf("too many arp requests %d", n)
+		}
+		return
+	}
+	t.Fatalf("host unreachable was not received")
+}
+
+func TestIntegrationHotplugInterface(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2")
+
+	runIP(t, "-n", netnsName("router1"), "link", "add", "name", "router1-host3", "type", "veth", "peer", "name", "host3-router1")
+	waitRouterOutput(t, router, "Created device router1-host3")
+	waitRouterOutput(t, router, "Created device host3-router1")
+
+	// アドレスを設定すると経路が登録されて通信できるようになる
+	runIP(t, "-n", netnsName("router1"), "link", "set", "host3-router1", "netns", netnsName("host1"))
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "192.168.3.1/24", "dev", "router1-host3")
+	runIP(t, "-n", netnsName("router1"), "link", "set", "router1-host3", "up")
+	runIP(t, "-n", netnsName("host1"), "addr", "add", "192.168.3.2/24", "dev", "host3-router1")
+	runIP(t, "-n", netnsName("host1"), "link", "set", "host3-router1", "up")
+	waitRouterOutput(t, router, "Set directly connected route 192.168.3.0/24 via router1-host3")
+	result := topo.probeRetry(t, "host1", "192.168.3.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.3.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// アドレスを変更すると経路も入れ替わる
+	runIP(t, "-n", netnsName("router1"), "addr", "flush", "dev", "router1-host3")
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "192.168.4.1/24", "dev", "router1-host3")
+	waitRouterOutput(t, router, "Deleted directly connected route 192.168.3.0/24 via router1-host3")
+	waitRouterOutput(t, router, "Set directly connected route 192.168.4.0/24 via router1-host3")
+
+	runIP(t, "-n", netnsName("router1"), "link", "delete", "router1-host3")
+	waitRouterOutput(t, router, "Removed device router1-host3")
+	waitRouterOutput(t, router, "Removed device host3-router1")
+
+	// 残ったインターフェイスでは引き続き通信できる
+	result = topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+// ルータが指定した文字列を出力するまで待つ
+func waitRouterOutput(t *testing.T, router *routerProcess, s string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(router.Output(), s) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("router did not output %q", s)
+}
+
+func TestIntegrationKernelRoutes(t *testing.T) {
+	topo := newBasicLab(t)
+	runIP(t, "-n", netnsName("router1"), "route", "add", "10.0.0.0/8", "via", "192.168.0.2")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-import-kernel-routes", "-export-kernel-routes")
+
+	waitRouterOutput(t, router, "Imported kernel route 10.0.0.0/8 via 192.168.0.2")
+	out, err := exec.Command("ip", "-n", netnsName("router1"), "route", "show", "192.168.2.0/24").CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "via 192.168.0.2") {
+		t.Fatalf("static route was not exported to kernel: %s", out)
+	}
+	// 書き出した経路は取り込み直さない
+	if strings.Contains(router.Output(), "Imported kernel route 192.168.2.0/24") {
+		t.Fatalf("exported route was imported again")
+	}
+}
+
+func TestIntegrationGrpcAPI(t *testing.T) {
+	topo := &labTopology{}
+	topo.startRouter(t, "", "-mode", "ch2", "-backend", "tun", "-tap", "curo-it-tap0=10.20.0.1/24",
+		"-grpc-addr", "127.0.0.1:50151")
+
+	conn, err := grpc.Dial("127.0.0.1:50151", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := routerpb.NewRouterServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.AddRoute(ctx, &routerpb.AddRouteRequest{Prefix: "172.16.0.0/16", Nexthop: "10.20.0.254"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := client.ListRoutes(ctx, &routerpb.ListRoutesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, route := range routes.Routes {
+		if route.Prefix == "172.16.0.0/16" && route.Nexthop == "10.20.0.254" && route.Type == "network" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("added route is not listed: %v", routes.Routes)
+	}
+	_, err = client.DeleteRoute(ctx, &routerpb.DeleteRouteRequest{Prefix: "172.16.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteRoute(ctx, &routerpb.DeleteRouteRequest{Prefix: "172.16.0.0/16"})
+	if err == nil {
+		t.Fatalf("deleting unknown route should fail")
+	}
+
+	// パケットのイベントを購読してから通信する
+	stream, err := client.WatchPacketEvents(ctx, &routerpb.WatchPacketEventsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	runIP(t, "addr", "add", "10.20.0.2/24", "dev", "curo-it-tap0")
+	go topo.probe(t, "", "10.20.0.1", 64)
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Device != "curo-it-tap0" || event.SrcAddress != "10.20.0.2" {
+		t.Fatalf("unexpected event %v", event)
+	}
+
+	interfaces, err := client.ListInterfaces(ctx, &routerpb.ListInterfacesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interfaces.Interfaces) != 1 || interfaces.Interfaces[0].Counters.RxPackets == 0 {
+		t.Fatalf("unexpected interfaces %v", interfaces.Interfaces)
+	}
+	arp, err := client.ListArpEntries(ctx, &routerpb.ListArpEntriesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arp.Entries) == 0 || arp.Entries[0].IpAddress != "10.20.0.2" {
+		t.Fatalf("unexpected arp entries %v", arp.Entries)
+	}
+}
+
+func TestIntegrationAdminAPI(t *testing.T) {
+	topo := &labTopology{}
+	topo.startRouter(t, "", "-mode", "ch2", "-backend", "tun", "-tap", "curo-it-tap0=10.20.0.1/24",
+		"-admin-addr", "127.0.0.1:50152", "-admin-token", "secret")
+
+	request := func(method, path, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://127.0.0.1:50152"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	res, err := http.Get("http://127.0.0.1:50152/routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("request without token should be rejected, got %d", res.StatusCode)
+	}
+
+	code, body := request(http.MethodPost, "/routes", `{"prefix":"172.16.0.0/16","nexthop":"10.20.0.254"}`)
+	if code != http.StatusCreated {
+		t.Fatalf("add route failed %d %s", code, body)
+	}
+	code, body = request(http.MethodGet, "/routes", "")
+	if code != http.StatusOK || !strings.Contains(body, `"prefix":"172.16.0.0/16"`) {
+		t.Fatalf("unexpected routes %d %s", code, body)
+	}
+	code, body = request(http.MethodDelete, "/routes?prefix=172.16.0.0/16", "")
+	if code != http.StatusNoContent {
+		t.Fatalf("delete route failed %d %s", code, body)
+	}
+	code, body = request(http.MethodGet, "/interfaces", "")
+	if code != http.StatusOK || !strings.Contains(body, `"name":"curo-it-tap0"`) {
+		t.Fatalf("unexpected interfaces %d %s", code, body)
+	}
+	code, body = request(http.MethodGet, "/stats", "")
+	if code != http.StatusOK || !strings.Contains(body, `"interfaces":1`) {
+		t.Fatalf("unexpected stats %d %s", code, body)
+	}
+	code, body = request(http.MethodGet, "/arp", "")
+	if code != http.StatusOK || body != "[]\n" {
+		t.Fatalf("unexpected arp %d %s", code, body)
+	}
+}
+
+/*
+NATを通る分割されたUDPのデータグラムが、行きも帰りも組み立て直せてチェックサムも正しい
+最初の断片でポート番号とチェックサムを書き換え、残りの断片はアドレスだけを書き換える
+*/
+func TestIntegrationNATFragments(t *testing.T) {
+	topo := newBasicLab(t)
+	runIP(t, "-n", netnsName("host2"), "route", "del", "default")
+	echo := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	echo.Env = append(os.Environ(), itUdpEnvEcho+"=7000")
+	if err := echo.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		echo.Process.Kill()
+		echo.Wait()
+	}()
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"nat": {"outside": "router1-host2", "inside": ["router1-host1"]}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+	waitRouterOutput(t, router, "NAT is enabled")
+
+	// MTUが1500なので3つの断片に分かれる
+	from, seen := topo.udpSendSize(t, "host1", "192.168.0.2:7000", 4000)
+	if from != "192.168.0.2:7000" || !strings.HasPrefix(seen, "192.168.0.1:") {
+		t.Fatalf("unexpected reply from %s seen %s", from, seen)
+	}
+}
+
+/*
+受信したインターフェイスのACLを上から評価して、最初に一致したルールに従う
+どのルールにも一致しないパケットは捨てる
+*/
+func TestIntegrationACL(t *testing.T) {
+	topo := newBasicLab(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+  "acls": [
+    {"interface": "router1-host1", "rules": [
+      {"action": "deny", "protocol": "icmp", "dst": "192.168.0.0/24"},
+      {"action": "permit", "src": "192.168.1.0/24"}
+    ]},
+    {"interface": "router1-host2", "rules": [
+      {"action": "permit", "protocol": "udp"}
+    ]}
+  ]
+}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+
+	// 2番目のルールで許可される
+	result := topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.1.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	// 1番目のルールで捨てられる
+	if result, err := topo.probe(t, "host1", "192.168.0.2", 64); err == nil {
+		t.Fatalf("icmp to 192.168.0.0/24 was not denied by acl %+v", result)
+	}
+	// どのルールにも一致しない
+	if result, err := topo.probe(t, "host2", "192.168.0.1", 64); err == nil {
+		t.Fatalf("icmp from host2 was not denied by acl %+v", result)
+	}
+}
+
+/*
+内側から外側へのパケットの送信元をルータの外側のアドレスに書き換える
+host2は192.168.1.0/24への経路を持たないので、NATされた時だけ応答が返る
+*/
+func TestIntegrationNAT(t *testing.T) {
+	topo := newBasicLab(t)
+	runIP(t, "-n", netnsName("host2"), "route", "del", "default")
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(nat string) {
+		config := `{"nat": ` + nat + `}`
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"outside": "router1-host2", "inside": ["router1-host1"]}`)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+	waitRouterOutput(t, router, "NAT is enabled")
+
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// NATを止めると応答が戻ってこない
+	writeConfig(`{}`)
+	router.cmd.Process.Signal(syscall.SIGHUP)
+	waitRouterOutput(t, router, "NAT is disabled")
+	if result, err := topo.probe(t, "host1", "192.168.0.2", 64); err == nil {
+		t.Fatalf("reply was received without nat %+v", result)
+	}
+}
+
+func TestIntegrationConfigReload(t *testing.T) {
+	topo := newLabTopology(t, []string{"router1"}, nil)
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(routes, acl string) {
+		config := `{
+  "backend": "tun",
+  "interfaces": [{"name": "tap0", "address": "10.10.0.1/24"}],
+  "static_routes": [` + routes + `],
+  "acls": [{"interface": "tap0", "rules": [` + acl + `]}]
+}`
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("", `{"action": "deny", "protocol": "icmp"}, {"action": "permit"}`)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "10.10.0.2/24", "dev", "tap0")
+
+	// ACLでICMPを落としているので応答は返らない
+	if result, err := topo.probe(t, "router1", "10.10.0.1", 64); err == nil {
+		t.Fatalf("icmp was not denied by acl %+v", result)
+	}
+
+	// ACLと経路を変更してSIGHUPで読み直す
+	writeConfig(`{"prefix": "10.20.0.0/16", "nexthop": "10.10.0.2"}`, `{"action": "permit"}`)
+	router.cmd.Process.Signal(syscall.SIGHUP)
+	waitRouterOutput(t, router, "Config is reloaded")
+	waitRouterOutput(t, router, "Added static route 10.20.0.0/16 via 10.10.0.2")
+
+	result := topo.probeRetry(t, "router1", "10.10.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.10.0.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// 壊れた設定は今の設定のまま動き続ける
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router.cmd.Process.Signal(syscall.SIGHUP)
+	waitRouterOutput(t, router, "reload config err")
+	result = topo.probeRetry(t, "router1", "10.10.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.10.0.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+func TestIntegrationGracefulShutdown(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-export-kernel-routes")
+	topo.probeRetry(t, "host1", "192.168.1.1", 64)
+
+	router.cmd.Process.Signal(syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() { done <- router.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("router exited with err : %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("router did not stop in time")
+	}
+	waitRouterOutput(t, router, "Router is stopped")
+	waitRouterOutput(t, router, "router1-host1: rx ")
+
+	// 書き出した経路は取り消されている
+	out, err := exec.Command("ip", "-n", netnsName("router1"), "route", "show", "192.168.2.0/24").CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) != "" {
+		t.Fatalf("exported route is left in kernel: %s", out)
+	}
+}
+
+func TestIntegrationDropCounters(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50153")
+
+	// 経路のない宛先に送るとno_routeで破棄される
+	result := topo.probeRetry(t, "host1", "10.99.0.1", 64)
+	if result.icmpType != ICMP_TYPE_DESTINATION_UNREACHABLE {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50153/drops").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `"reason":"no_route"`) || strings.Contains(string(out), `"reason":"no_route","count":0}`) {
+		t.Fatalf("unexpected drops %s", out)
+	}
+}
+
+func TestIntegrationSocketFilter(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled=%v", disabled), func(t *testing.T) {
+			topo := newBasicLab(t)
+			addr := "127.0.0.1:50174"
+			args := []string{"-mode", "ch2", "-admin-addr", addr}
+			if disabled {
+				addr = "127.0.0.1:50175"
+				args = []string{"-mode", "ch2", "-admin-addr", addr, "-no-socket-filter"}
+			}
+			topo.startRouter(t, "router1", args...)
+			result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+			if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+				t.Fatalf("unexpected reply %+v", result)
+			}
+
+			// IPv6はルータが処理しないので、フィルタがあればカーネルで捨てられる
+			exec.Command("ip", "netns", "exec", netnsName("host1"),
+				"ping", "-6", "-c", "3", "-i", "0.2", "-w", "2", "ff02::1%host1-router1").Run()
+			out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+				"curl", "-s", "http://"+addr+"/drops").CombinedOutput()
+			if err != nil {
+				t.Fatalf("curl err : %s %s", err, out)
+			}
+			var drops []struct {
+				Reason string `json:"reason"`
+				Count  uint64 `json:"count"`
+			}
+			if err := json.Unmarshal(out, &drops); err != nil {
+				t.Fatalf("parse drops %s err : %s", out, err)
+			}
+			// マルチキャストのIPv6は宛先のMACアドレスでも破棄されるので合わせて数える
+			var unsupported uint64
+			for _, drop := range drops {
+				if drop.Reason == "unsupported_ether_type" || drop.Reason == "not_for_us" {
+					unsupported += drop.Count
+				}
+			}
+			if disabled && unsupported == 0 {
+				t.Fatalf("ipv6 frames are not received without filter %s", out)
+			}
+			if !disabled && unsupported != 0 {
+				t.Fatalf("ipv6 frames are received with filter %s", out)
+			}
+		})
+	}
+}
+
+func TestIntegrationPromiscAndMacFilter(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50176",
+		"-promisc", "router1-host1", "-mac-allow", "router1-host1=02:00:00:00:00:10")
+
+	// socketを開いている間はカーネルがプロミスキャスモードにする
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"ip", "-d", "link", "show", "dev", "router1-host1").CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip link err : %s %s", err, out)
+	}
+	// vethはユニキャストのフィルタを持たないので、MACアドレスを追加してもプロミスキャスモードの数が増える
+	if !strings.Contains(string(out), "promiscuity 1") && !strings.Contains(string(out), "promiscuity 2") {
+		t.Fatalf("router1-host1 is not promiscuous\n%s", out)
+	}
+	interfaces := adminInterfaces(t, "router1", "127.0.0.1:50176")
+	if netif := interfaces["router1-host1"]; !netif.Promisc || len(netif.MacFilter) != 1 || netif.MacFilter[0] != "02:00:00:00:00:10" {
+		t.Fatalf("unexpected mac filter %+v", netif)
+	}
+	if interfaces["router1-host2"].Promisc {
+		t.Fatalf("router1-host2 is promiscuous")
+	}
+
+	// 追加したMACアドレス宛てのフレームも自分宛てとして受け取る
+	cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), routerBinary,
+		"-gen", "icmp,dev=host1-router1,dst=192.168.1.1,dmac=02:00:00:00:00:10")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gen err : %s %s", err, out)
+	}
+	waitRouterOutput(t, router, "ICMP ECHO REQUEST is received")
+}
+
+func TestIntegrationInterfaceAdminAndLinkState(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50177")
+
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	setState := func(state string) {
+		t.Helper()
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+			"curl", "-s", "-f", "-X", "POST", "-d", `{"name":"router1-host2"}`,
+			"http://127.0.0.1:50177/interfaces/"+state).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+	}
+
+	// 止めると直接接続の経路が消えて届かなくなる
+	setState("down")
+	waitRouterOutput(t, router, "Deleted directly connected route 192.168.0.0/24 via router1-host2")
+	netif := adminInterfaces(t, "router1", "127.0.0.1:50177")["router1-host2"]
+	if netif.AdminState != "down" || netif.OperState != "down" {
+		t.Fatalf("unexpected state %+v", netif)
+	}
+	result, err := topo.probe(t, "host1", "192.168.0.2", 64)
+	if err == nil && result.icmpType == ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("reply was received through down interface %+v", result)
+	}
+
+	// 戻すと経路が入り直して通信できる
+	setState("up")
+	waitRouterOutput(t, router, "Interface router1-host2 is administratively up")
+	result = topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// vethの相手を落とすとリンクが落ちたことを検出して経路を消す
+	runIP(t, "-n", netnsName("host2"), "link", "set", "host2-router1", "down")
+	waitRouterOutput(t, router, "Link of router1-host2 is down")
+	netif = adminInterfaces(t, "router1", "127.0.0.1:50177")["router1-host2"]
+	if netif.AdminState != "up" || netif.OperState != "down" {
+		t.Fatalf("unexpected state %+v", netif)
+	}
+	runIP(t, "-n", netnsName("host2"), "link", "set", "host2-router1", "up")
+	waitRouterOutput(t, router, "Link of router1-host2 is up")
+	// リンクを落とすとhost2のデフォルト経路も消えるので入れ直す
+	runIP(t, "-n", netnsName("host2"), "route", "add", "default", "via", "192.168.0.1")
+	result = topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+// 受け取ったデータグラムの送信元を応答する
+func runUdpEchoHelper(port string) int {
+	conn, err := net.ListenPacket("udp4", ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		// 大きいデータグラムには同じ長さになるまで空白を詰めて返す
+		reply := []byte(from.String())
+		for len(reply) < n {
+			reply = append(reply, ' ')
+		}
+		conn.WriteTo(reply, from)
+	}
+}
+
+/*
+宛先に送って応答の送信元と内容を出力する
+sizeが0でなければその長さまで空白を詰めて送る
+ルータがARPを解決する間は破棄されるので応答が来るまで送り直す
+connectしないsocketを使い、ルータのカーネルが返すICMP Port Unreachableは無視する
+*/
+func runUdpSendHelper(dest string) int {
+	addr, err := net.ResolveUDPAddr("udp4", dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "resolve err : %s\n", err)
+		return 1
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	msg := []byte("ping")
+	size, _ := strconv.Atoi(os.Getenv(itUdpEnvSize))
+	for len(msg) < size {
+		msg = append(msg, ' ')
+	}
+	buf := make([]byte, 65536)
+	for i := 0; i < 10; i++ {
+		conn.WriteTo(msg, addr)
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s %s\n", from, bytes.TrimRight(buf[:n], " "))
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "no reply")
+	return 1
+}
+
+// nsから宛先に送り、応答の送信元とエコーサーバが見た送信元を返す
+func (topo *labTopology) udpSend(t *testing.T, ns, dest string) (string, string) {
+	t.Helper()
+	return topo.udpSendSize(t, ns, dest, 0)
+}
+
+// udpSendでsizeバイトのデータグラムを送る
+func (topo *labTopology) udpSendSize(t *testing.T, ns, dest string, size int) (string, string) {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), itUdpEnvSend+"="+dest, itUdpEnvSize+"="+strconv.Itoa(size))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("udp send to %s from %s err : %s", dest, ns, err)
+	}
+	var from, seen string
+	fmt.Sscanf(string(out), "%s %s", &from, &seen)
+	return from, seen
+}
+
+/*
+外側のアドレスのポート8080をhost1のポート7000に転送する
+host2からは外側のアドレスに送ると転送され、host1自身が外側のアドレスに送るとヘアピンNATで折り返す
+
+	host1 (192.168.1.2:7000) ── router1 (inside 192.168.1.1, outside 192.168.0.1:8080) ── host2 (192.168.0.2)
+*/
+func TestIntegrationNatPortForward(t *testing.T) {
+	topo := newBasicLab(t)
+	server := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	server.Env = append(os.Environ(), itUdpEnvEcho+"=7000")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"nat": {"outside": "router1-host2", "inside": ["router1-host1"], "port_forwards": [
+		{"protocol": "udp", "port": 8080, "to": "192.168.1.2:7000"}]}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+	waitRouterOutput(t, router, "Forward udp port 8080 of router1-host2 to 192.168.1.2:7000")
+
+	// 外側からは送信元を変えずに転送し、応答は外側のアドレスから返す
+	from, seen := topo.udpSend(t, "host2", "192.168.0.1:8080")
+	if from != "192.168.0.1:8080" || !strings.HasPrefix(seen, "192.168.0.2:") {
+		t.Fatalf("unexpected reply from %s, server saw %s", from, seen)
+	}
+
+	// 内側からは送信元も外側のアドレスにして折り返す
+	from, seen = topo.udpSend(t, "host1", "192.168.0.1:8080")
+	if from != "192.168.0.1:8080" || !strings.HasPrefix(seen, "192.168.0.1:") {
+		t.Fatalf("unexpected hairpin reply from %s, server saw %s", from, seen)
+	}
+}
+
+func TestIntegrationRouteDistance(t *testing.T) {
+	topo := newBasicLab(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"static_routes": [
+		{"prefix": "192.168.0.0/24", "nexthop": "192.168.1.2"},
+		{"prefix": "10.99.0.0/16", "nexthop": "192.168.0.2"},
+		{"prefix": "10.99.0.0/16", "nexthop": "192.168.1.2", "distance": 200}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path, "-admin-addr", "127.0.0.1:50178")
+	waitRouterOutput(t, router, "Added static route 10.99.0.0/16 via 192.168.1.2")
+
+	curl := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName("router1"), "curl", "-s", "-f"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+
+	// 直接接続の経路は静的経路より優先し、ディスタンスが大きい静的経路は使わない
+	routes := curl("http://127.0.0.1:50178/routes")
+	for _, want := range []string{
+		`"prefix":"192.168.0.0/24","type":"connected","device":"router1-host2","source":"connected","distance":0`,
+		`"prefix":"10.99.0.0/16","type":"network","nexthop":"192.168.0.2","source":"static","distance":1,"metric":0`,
+	} {
+		if !strings.Contains(routes, want) {
+			t.Fatalf("%s is not found in routes %s", want, routes)
+		}
+	}
+	rib := curl("http://127.0.0.1:50178/rib")
+	for _, want := range []string{
+		`"prefix":"192.168.0.0/24","type":"network","nexthop":"192.168.1.2","source":"static","distance":1,"metric":0,"selected":false`,
+		`"prefix":"10.99.0.0/16","type":"network","nexthop":"192.168.1.2","source":"static","distance":200,"metric":0,"selected":false`,
+	} {
+		if !strings.Contains(rib, want) {
+			t.Fatalf("%s is not found in rib %s", want, rib)
+		}
+	}
+
+	// 使っている経路を消すとフローティングスタティックに切り替わる
+	curl("-X", "DELETE", "http://127.0.0.1:50178/routes?prefix=10.99.0.0/16&nexthop=192.168.0.2")
+	waitRouterOutput(t, router, "Best route to 10.99.0.0/16 is changed from static to static (distance 200, metric 0)")
+	routes = curl("http://127.0.0.1:50178/routes")
+	if !strings.Contains(routes, `"prefix":"10.99.0.0/16","type":"network","nexthop":"192.168.1.2","source":"static","distance":200`) {
+		t.Fatalf("floating static route is not used %s", routes)
+	}
+}
+
+func TestIntegrationBlackholeAndRejectRoute(t *testing.T) {
+	topo := newBasicLab(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"static_routes": [
+		{"prefix": "10.98.0.0/16", "type": "blackhole"},
+		{"prefix": "10.97.0.0/16", "type": "reject"}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path, "-admin-addr", "127.0.0.1:50179")
+	waitRouterOutput(t, router, "Added static route 10.97.0.0/16 reject")
+
+	// リジェクトの経路はHost Unreachableを返す
+	result := topo.probeRetry(t, "host1", "10.97.0.1", 64)
+	if result.icmpType != ICMP_TYPE_DESTINATION_UNREACHABLE || result.icmpCode != ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE || result.from != "192.168.1.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	// ブラックホールの経路は何も返さない
+	if result, err := topo.probe(t, "host1", "10.98.0.1", 64); err == nil {
+		t.Fatalf("reply was received from blackhole route %+v", result)
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50179/drops").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	for _, reason := range []string{"blackhole_route", "reject_route"} {
+		if !strings.Contains(string(out), `"reason":"`+reason+`"`) || strings.Contains(string(out), `"reason":"`+reason+`","count":0}`) {
+			t.Fatalf("unexpected drops %s", out)
+		}
+	}
+	out, err = exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50179/routes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `"prefix":"10.98.0.0/16","type":"blackhole","source":"static"`) {
+		t.Fatalf("blackhole route is not found %s", out)
+	}
+}
+
+func TestIntegrationUrpf(t *testing.T) {
+	for i, mode := range []string{"strict", "loose"} {
+		t.Run(mode, func(t *testing.T) {
+			topo := newBasicLab(t)
+			addr := fmt.Sprintf("127.0.0.1:%d", 50180+i)
+			topo.startRouter(t, "router1", "-mode", "ch2", "-urpf", "router1-host1="+mode, "-admin-addr", addr)
+
+			result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+			if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+				t.Fatalf("unexpected reply %+v", result)
+			}
+			if netif := adminInterfaces(t, "router1", addr)["router1-host1"]; netif.Urpf != mode || netif.Counters.UrpfDrops != 0 {
+				t.Fatalf("unexpected interface %+v", netif)
+			}
+
+			// 送信元を偽装して送る、応答は偽装したアドレスに返るので届かない
+			spoof := func(src string) uint64 {
+				t.Helper()
+				runIP(t, "-n", netnsName("host1"), "addr", "add", src+"/32", "dev", "host1-router1")
+				runIP(t, "-n", netnsName("host1"), "route", "replace", "192.168.0.2/32", "via", "192.168.1.1", "src", src)
+				topo.probe(t, "host1", "192.168.0.2", 64)
+				return adminInterfaces(t, "router1", addr)["router1-host1"].Counters.UrpfDrops
+			}
+			// 戻りの経路は別のインターフェイスに向いているので、strictだけが破棄する
+			drops := spoof("192.168.0.50")
+			if (mode == "strict") != (drops != 0) {
+				t.Fatalf("unexpected urpf drops %d of source in other interface", drops)
+			}
+			// 戻りの経路が無い送信元はどちらでも破棄する
+			if next := spoof("10.77.0.1"); next == drops {
+				t.Fatalf("source without route was not dropped, urpf drops %d", next)
+			}
+		})
+	}
+}
+
+func TestIntegrationDebugPacket(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50182",
+		"-debug-packet", "dst=192.168.0.2/32,proto=icmp,dev=router1-host1")
+
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	waitRouterOutput(t, router, "route: 192.168.0.2 is connected dev router1-host2")
+	waitRouterOutput(t, router, "arp: host 192.168.0.2 is at")
+	waitRouterOutput(t, router, "output: router1-host2")
+	// 条件に一致しないルータ宛てのパケットと、戻りのEcho Replyはトレースしない
+	topo.probe(t, "host1", "192.168.1.1", 64)
+	if strings.Contains(router.Output(), "local: destined to router") || strings.Contains(router.Output(), "ip: 192.168.0.2 to") {
+		t.Fatalf("unmatched packet was traced:\n%s", router.Output())
+	}
+
+	curl := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName("router1"), "curl", "-s", "-f"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	// TTLが1のパケットだけを追って、破棄した理由を確認する
+	curl("-X", "POST", "-d", `{"dst":"192.168.0.0/24","protocol":"icmp","ttl":1}`, "http://127.0.0.1:50182/debug/packet")
+	if out := curl("http://127.0.0.1:50182/debug/packet"); !strings.Contains(out, `"ttl":1`) {
+		t.Fatalf("unexpected debug packet %s", out)
+	}
+	topo.probe(t, "host1", "192.168.0.2", 1)
+	waitRouterOutput(t, router, "dropped: ttl_exceeded")
+
+	curl("-X", "DELETE", "http://127.0.0.1:50182/debug/packet")
+	if out := curl("http://127.0.0.1:50182/debug/packet"); !strings.Contains(out, `"enabled":false`) {
+		t.Fatalf("unexpected debug packet %s", out)
+	}
+}
+
+func TestIntegrationWarmRestart(t *testing.T) {
+	topo := newBasicLab(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+	curl := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName("router1"), "curl", "-s", "-f"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50183", "-state-file", path)
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	curl("-X", "POST", "-d", `{"prefix":"10.99.0.0/16","nexthop":"192.168.0.2"}`, "http://127.0.0.1:50183/routes")
+	router.stop(t)
+	waitRouterOutput(t, router, "Saved state to "+path)
+
+	// 再起動した直後から、ARPを引き直さずに学習していたエントリと追加した経路を使う
+	router = topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50183", "-state-file", path)
+	waitRouterOutput(t, router, "Loaded state from "+path)
+	if out := curl("http://127.0.0.1:50183/arp"); !strings.Contains(out, `"ip_address":"192.168.0.2"`) {
+		t.Fatalf("arp entry was not loaded: %s", out)
+	}
+	if out := curl("http://127.0.0.1:50183/routes"); !strings.Contains(out, `"prefix":"10.99.0.0/16"`) {
+		t.Fatalf("static route was not loaded: %s", out)
+	}
+	router.stop(t)
+
+	// 古すぎる状態は使わない
+	router = topo.startRouter(t, "router1", "-mode", "ch2", "-state-file", path, "-state-max-age", "1ns")
+	waitRouterOutput(t, router, "ignored")
+	if strings.Contains(router.Output(), "Loaded state from") {
+		t.Fatalf("stale state was loaded:\n%s", router.Output())
+	}
+}
+
+// 停止する時に書き出したARPテーブルとルートテーブルを、次の起動で読み込む
+func TestIntegrationTablesDump(t *testing.T) {
+	topo := newBasicLab(t)
+	path := filepath.Join(t.TempDir(), "tables.json")
+	curl := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName("router1"), "curl", "-s", "-f"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50185", "-dump-tables", path)
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	curl("-X", "POST", "-d", `{"prefix":"10.98.0.0/16","type":"blackhole"}`, "http://127.0.0.1:50185/routes")
+	if out := curl("http://127.0.0.1:50185/tables"); !strings.Contains(out, `"prefix":"10.98.0.0/16"`) ||
+		!strings.Contains(out, `"ip_address":"192.168.0.2"`) {
+		t.Fatalf("unexpected tables: %s", out)
+	}
+	router.cmd.Process.Signal(syscall.SIGTERM)
+	router.cmd.Wait()
+	waitRouterOutput(t, router, "routes to "+path)
+
+	router = topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50185", "-load-tables", path)
+	waitRouterOutput(t, router, "Imported")
+	if out := curl("http://127.0.0.1:50185/arp"); !strings.Contains(out, `"ip_address":"192.168.0.2"`) {
+		t.Fatalf("arp entry was not loaded: %s", out)
+	}
+	if out := curl("http://127.0.0.1:50185/routes"); !strings.Contains(out, `"prefix":"10.98.0.0/16","type":"blackhole"`) {
+		t.Fatalf("route was not loaded: %s", out)
+	}
+	// 壊れた項目があれば何も読み込まない
+	out, _ := exec.Command("ip", "netns", "exec", netnsName("router1"), "curl", "-s", "-o", "/dev/null", "-w", "%{http_code}",
+		"-X", "POST", "-d", `{"routes":[{"prefix":"10.97.0.0/16","nexthop":"bad"}]}`, "http://127.0.0.1:50185/tables").Output()
+	if string(out) != "400" {
+		t.Fatalf("unexpected status %s for broken tables", out)
+	}
+}
+
+/*
+1つのプロセスで2台のルータを動かす、router1は既定のインスタンス、r2はnetns r2のNICを使うインスタンス
+
+	host1 (192.168.1.2) ── router1 (192.168.0.1) ── (192.168.0.2) r2 ── host2 (192.168.2.2)
+*/
+func TestIntegrationMultiInstance(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "r2", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "router1", dev1: "router1-r2", addr1: "192.168.0.1/24", ns2: "r2", dev2: "r2-router1", addr2: "192.168.0.2/24"},
+		{ns1: "host2", dev1: "host2-r2", addr1: "192.168.2.2/24", ns2: "r2", dev2: "r2-host2", addr2: "192.168.2.1/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("host2"), "route", "add", "default", "via", "192.168.2.1")
+
+	// ch2は192.168.2.0/24の経路を192.168.0.2に向ける
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50186",
+		"-instance", "name=r2,netns="+netnsName("r2")+",route=192.168.1.0/24@192.168.0.1")
+	waitRouterOutput(t, router, "Instance r2: route 192.168.1.0/24 via 192.168.0.1")
+
+	result := topo.probeRetry(t, "host1", "192.168.2.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.2.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	// 2台目のルータでTTLが切れる
+	result = topo.probeRetry(t, "host1", "192.168.2.2", 2)
+	if result.icmpType != ICMP_TYPE_TIME_EXCEEDED || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "-f", "http://127.0.0.1:50186/instances").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var instances []struct {
+		Name       string   `json:"name"`
+		Interfaces []string `json:"interfaces"`
+		Routes     []struct {
+			Prefix string `json:"prefix"`
+		} `json:"routes"`
+		Arp []struct {
+			IPAddress string `json:"ip_address"`
+			Device    string `json:"device"`
+		} `json:"arp"`
+	}
+	if err := json.Unmarshal(out, &instances); err != nil {
+		t.Fatalf("parse instances %s err : %s", out, err)
+	}
+	if len(instances) != 2 || instances[1].Name != "r2" || len(instances[1].Interfaces) != 2 {
+		t.Fatalf("unexpected instances %s", out)
+	}
+	// インスタンスごとに別のテーブルを持つ
+	hasRoute := func(i int, prefix string) bool {
+		for _, route := range instances[i].Routes {
+			if route.Prefix == prefix {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasRoute(0, "192.168.2.0/24") || len(instances[0].Routes) != 3 ||
+		!hasRoute(1, "192.168.1.0/24") || !hasRoute(1, "192.168.2.0/24") || len(instances[1].Routes) != 3 {
+		t.Fatalf("unexpected routes of instances %s", out)
+	}
+	for i, prefix := range []string{"router1-", "r2-"} {
+		if len(instances[i].Arp) == 0 {
+			t.Fatalf("no arp entry in %s", instances[i].Name)
+		}
+		for _, entry := range instances[i].Arp {
+			if !strings.HasPrefix(entry.Device, prefix) {
+				t.Fatalf("arp entry %+v of other instance is in %s", entry, instances[i].Name)
+			}
+		}
+	}
+}
+
+/*
+vethはチェックサムの計算をNICに任せるので、カーネルが送るUDPのチェックサムは途中までしか計算されていない
+ルータはそのままフォワードするので、受け取ったホストで破棄されないようにSO_NO_CHECKでチェックサムを0にして送る
+*/
+func openNoCheckUDPSocket() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, fmt.Errorf("create socket err : %s", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("setsockopt err : %s", err)
+	}
+	return fd, nil
+}
+
+// 受信したデータグラムのToSを数字で送り返す
+func runTosEchoHelper(port string) int {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid port %s\n", port)
+		return 1
+	}
+	fd, err := openNoCheckUDPSocket()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer syscall.Close(fd)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1); err != nil {
+		fmt.Fprintf(os.Stderr, "setsockopt err : %s\n", err)
+		return 1
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: p}); err != nil {
+		fmt.Fprintf(os.Stderr, "bind err : %s\n", err)
+		return 1
+	}
+	buf := make([]byte, 1500)
+	oob := make([]byte, 64)
+	for {
+		_, oobn, _, from, err := syscall.Recvmsg(fd, buf, oob, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+		tos := -1
+		for _, msg := range msgs {
+			if msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TOS && len(msg.Data) != 0 {
+				tos = int(msg.Data[0])
+			}
+		}
+		syscall.Sendto(fd, []byte(strconv.Itoa(tos)), 0, from)
+	}
+}
+
+// 宛先に送って、エコーサーバが返したToSを出力する
+func runTosSendHelper(dest string) int {
+	addr, err := netip.ParseAddrPort(dest)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid dest %s\n", dest)
+		return 1
+	}
+	fd, err := openNoCheckUDPSocket()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer syscall.Close(fd)
+	tv := syscall.NsecToTimeval(int64(300 * time.Millisecond))
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	to := &syscall.SockaddrInet4{Addr: addr.Addr().As4(), Port: int(addr.Port())}
+	buf := make([]byte, 1500)
+	// ルータがARPを解決する間は破棄されるので応答が来るまで送り直す
+	for i := 0; i < 10; i++ {
+		syscall.Sendto(fd, []byte("ping"), 0, to)
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s\n", buf[:n])
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "no reply")
+	return 1
+}
+
+// nsから宛先に送り、宛先で受信したToSを返す
+func (topo *labTopology) tosSend(t *testing.T, ns, dest string) string {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), itTosEnvSend+"="+dest)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("send to %s from %s err : %s", dest, ns, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+/*
+host1からhost2への宛先ポート5004のUDPをEFに、それ以外のUDPをCS1に書き換える
+host2のエコーサーバは受信したToSを返す
+*/
+func TestIntegrationDscpRemark(t *testing.T) {
+	topo := newBasicLab(t)
+	for _, port := range []string{"5004", "5005"} {
+		server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+		server.Env = append(os.Environ(), itTosEnvEcho+"="+port)
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			server.Process.Kill()
+			server.Wait()
+		}()
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"dscp_policies": [{"interface": "router1-host1", "rules": [
+		{"dst": "192.168.0.2/32", "protocol": "udp", "dst_port": 5004, "dscp": "ef"},
+		{"protocol": "udp", "dscp": "cs1"}]}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	topo.startRouter(t, "router1", "-mode", "ch2", "-config", path, "-admin-addr", "127.0.0.1:50184")
+
+	if tos := topo.tosSend(t, "host1", "192.168.0.2:5004"); tos != strconv.Itoa(46<<2) {
+		t.Fatalf("unexpected tos %s of remarked ef", tos)
+	}
+	if tos := topo.tosSend(t, "host1", "192.168.0.2:5005"); tos != strconv.Itoa(8<<2) {
+		t.Fatalf("unexpected tos %s of remarked cs1", tos)
+	}
+	// 戻りのパケットは別のインターフェイスで受信するので書き換えない
+	if netif := adminInterfaces(t, "router1", "127.0.0.1:50184")["router1-host2"]; netif.Counters.DscpRemarked != 0 {
+		t.Fatalf("unexpected remarked count %+v", netif)
+	}
+	if netif := adminInterfaces(t, "router1", "127.0.0.1:50184")["router1-host1"]; netif.Counters.DscpRemarked == 0 {
+		t.Fatalf("remarked packets were not counted %+v", netif)
+	}
+}
+
+/*
+"タイプ,宛先"のICMPのリクエストを送り、対になるリプライのタイプと識別子の後ろを16進数で出力する
+Timestamp(13)は3つの時刻、Address Mask(17)はサブネットマスクの分を0で埋めて送る
+*/
+func runIcmpQueryHelper(spec string) int {
+	typestr, dest, _ := strings.Cut(spec, ",")
+	icmpType, err := strconv.Atoi(typestr)
+	ip := net.ParseIP(dest).To4()
+	if err != nil || ip == nil {
+		fmt.Fprintf(os.Stderr, "invalid query %s\n", spec)
+		return 1
+	}
+	var destAddr [4]byte
+	copy(destAddr[:], ip)
+
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+
+	bodyLen := 4
+	if uint8(icmpType) == ICMP_TYPE_TIMESTAMP_REQUEST {
+		bodyLen = 12
+	}
+	var b bytes.Buffer
+	b.Write([]byte{uint8(icmpType), 0x00, 0x00, 0x00})
+	b.Write(uint16ToByte(uint16(os.Getpid())))
+	b.Write(uint16ToByte(1))
+	b.Write(make([]byte, bodyLen))
+	request := b.Bytes()
+	checksum := calcChecksum(request)
+	request[2], request[3] = checksum[0], checksum[1]
+
+	buf := make([]byte, 1500)
+	// ルータがARPを解決する間は破棄されるので送り直す
+	for i := 0; i < 3; i++ {
+		if err := syscall.Sendto(sock, request, 0, &syscall.SockaddrInet4{Addr: destAddr}); err != nil {
+			fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+			return 1
+		}
+		for {
+			n, _, err := syscall.Recvfrom(sock, buf, 0)
+			if err != nil {
+				break
+			}
+			headerLen := int(buf[0]&0x0f) * 4
+			if n < headerLen+8 || buf[headerLen] != uint8(icmpType)+1 ||
+				byteToUint16(buf[headerLen+4:headerLen+6]) != uint16(os.Getpid()) {
+				continue
+			}
+			fmt.Printf("%d %x\n", buf[headerLen], buf[headerLen+8:n])
+			return 0
+		}
+	}
+	fmt.Fprintln(os.Stderr, "no reply")
+	return 1
+}
+
+// nsから宛先にICMPのリクエストを送り、リプライのタイプと中身を返す、リプライが無ければokがfalse
+func icmpQuery(t *testing.T, ns string, icmpType uint8, dest string) (string, bool) {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d,%s", itIcmpEnvQuery, icmpType, dest))
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err == nil
+}
+
+/*
+router1-host1でだけTimestampとAddress Maskに答える
+Linuxのカーネルもnetnsに付けたアドレスへのTimestampに答えてしまうので、ルータが答えたかはログで確かめる
+Address Maskにはカーネルは答えない
+*/
+func TestIntegrationIcmpTimestampAddressMask(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2",
+		"-icmp-timestamp", "router1-host1", "-icmp-mask-reply", "router1-host1")
+
+	if reply, ok := icmpQuery(t, "host2", ICMP_TYPE_ADDRESS_MASK_REQUEST, "192.168.0.1"); ok {
+		t.Fatalf("unexpected address mask reply %s on disabled interface", reply)
+	}
+	icmpQuery(t, "host2", ICMP_TYPE_TIMESTAMP_REQUEST, "192.168.0.1")
+	if strings.Contains(router.Output(), "ICMP TIMESTAMP REQUEST is received") {
+		t.Fatalf("router answered timestamp request on disabled interface:\n%s", router.Output())
+	}
+
+	reply, ok := icmpQuery(t, "host1", ICMP_TYPE_ADDRESS_MASK_REQUEST, "192.168.1.1")
+	if !ok || reply != "18 ffffff00" {
+		t.Fatalf("unexpected address mask reply %q", reply)
+	}
+	reply, ok = icmpQuery(t, "host1", ICMP_TYPE_TIMESTAMP_REQUEST, "192.168.1.1")
+	if !ok || !strings.HasPrefix(reply, "14 00000000") {
+		t.Fatalf("unexpected timestamp reply %q", reply)
+	}
+	waitRouterOutput(t, router, "ICMP TIMESTAMP REQUEST is received, Create Reply Packet")
+}
+
+// FTPのコントロールコネクションで受け取ったコマンドを出力して200を返す、QUITで終わる
+func runFtpServerHelper() int {
+	listener, err := net.Listen("tcp4", ":21")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "accept err : %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 1
+		}
+		fmt.Print(line)
+		conn.Write([]byte("200 ok\r\n"))
+		if strings.HasPrefix(line, "QUIT") {
+			return 0
+		}
+	}
+}
+
+// "サーバ/コマンド"に接続してコマンドとQUITを送り、応答を待つ
+func runFtpCommandHelper(spec string) int {
+	server, command, _ := strings.Cut(spec, "/")
+	conn, err := net.DialTimeout("tcp4", server, 3*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dial err : %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{command, "QUIT"} {
+		conn.Write([]byte(line + "\r\n"))
+		if _, err := reader.ReadString('\n'); err != nil {
+			fmt.Fprintf(os.Stderr, "read err : %s\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// SIPのメッセージを受け取って出力し、SDPのc=とm=のアドレスとポート番号にRTPの代わりのデータグラムを送る
+func runSipServerHelper() int {
+	conn, err := net.ListenPacket("udp4", ":5060")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 1
+		}
+		fmt.Printf("%s\n--\n", buf[:n])
+		var addr, port string
+		for _, line := range strings.Split(string(buf[:n]), "\r\n") {
+			if fields := strings.Fields(line); strings.HasPrefix(line, "c=") && len(fields) == 3 {
+				addr = fields[2]
+			} else if strings.HasPrefix(line, "m=") && len(fields) >= 2 {
+				port = fields[1]
+			}
+		}
+		if rtp, err := net.ResolveUDPAddr("udp4", addr+":"+port); err == nil {
+			conn.WriteTo([]byte("rtp"), rtp)
+		}
+	}
+}
+
+/*
+"自分のアドレス/サーバ"の5060番からINVITEを送り、RTPのポート番号49170にデータグラムが届くまで送り直す
+*/
+func runSipInviteHelper(spec string) int {
+	local, server, _ := strings.Cut(spec, "/")
+	sip, err := net.ListenPacket("udp4", ":5060")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	rtp, err := net.ListenPacket("udp4", ":49170")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	dest, err := net.ResolveUDPAddr("udp4", server+":5060")
+	if err != nil {
+		return 1
+	}
+	sdp := fmt.Sprintf("v=0\r\no=- 1 1 IN IP4 %s\r\ns=-\r\nc=IN IP4 %s\r\nt=0 0\r\nm=audio 49170 RTP/AVP 0\r\n", local, local)
+	invite := fmt.Sprintf("INVITE sip:bob@%s SIP/2.0\r\nVia: SIP/2.0/UDP %s:5060\r\nContact: <sip:alice@%s:5060>\r\n"+
+		"Content-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", server, local, local, len(sdp), sdp)
+	buf := make([]byte, 1500)
+	for i := 0; i < 10; i++ {
+		sip.WriteTo([]byte(invite), dest)
+		rtp.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if n, _, err := rtp.ReadFrom(buf); err == nil {
+			fmt.Printf("%s\n", buf[:n])
+			return 0
+		}
+	}
+	fmt.Fprintln(os.Stderr, "no rtp")
+	return 1
+}
+
+/*
+NATの内側のhost1から外側のhost2へのFTPのPORTコマンドとSIPのINVITEのアドレスを外側のアドレスに書き換える
+PORTは書き換えで長さが変わるので、続くQUITと応答が届けばシーケンス番号のずれも直せている
+*/
+func TestIntegrationNatAlg(t *testing.T) {
+	topo := newBasicLab(t)
+	// カーネルが外側のアドレス宛てのTCPにRSTを返さないように、アドレスはルータの設定ファイルだけで持つ
+	runIP(t, "-n", netnsName("router1"), "addr", "flush", "dev", "router1-host2")
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"interfaces": [{"name": "router1-host2", "address": "192.168.0.1/24"}],
+		"nat": {"outside": "router1-host2", "inside": ["router1-host1"]}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path)
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	startServer := func(env string) (*exec.Cmd, *bytes.Buffer) {
+		server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+		server.Env = append(os.Environ(), env+"=1")
+		var out bytes.Buffer
+		server.Stdout = &out
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			server.Process.Kill()
+			server.Wait()
+		})
+		time.Sleep(200 * time.Millisecond)
+		return server, &out
+	}
+
+	// 192,168,1,2,0,80は外側のアドレスと20000番台のポート番号に書き換わって1文字長くなる
+	ftpServer, ftpOut := startServer(itFtpEnvServe)
+	client := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	client.Env = append(os.Environ(), itFtpEnvCommand+"=192.168.0.2:21/PORT 192,168,1,2,0,80")
+	if out, err := client.CombinedOutput(); err != nil {
+		t.Fatalf("ftp client err : %s %s\n%s", err, out, router.Output())
+	}
+	ftpServer.Wait()
+	lines := strings.Split(strings.TrimSpace(ftpOut.String()), "\r\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "PORT 192,168,0,1,") || lines[1] != "QUIT" {
+		t.Fatalf("unexpected ftp commands %q", lines)
+	}
+	waitRouterOutput(t, router, "Created NAT expectation 192.168.1.2:80 => 192.168.0.1:")
+
+	// SDPのアドレスとメディアのポート番号を書き換え、host2から書き換えたアドレスに送ったRTPがhost1に届く
+	_, sipOut := startServer(itSipEnvServe)
+	client = exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	client.Env = append(os.Environ(), itSipEnvInvite+"=192.168.1.2/192.168.0.2")
+	if out, err := client.CombinedOutput(); err != nil {
+		t.Fatalf("sip client err : %s %s\n%s\n%s", err, out, sipOut.String(), router.Output())
+	}
+	invite := strings.Split(sipOut.String(), "\n--\n")[0]
+	if strings.Contains(invite, "192.168.1.2") || !strings.Contains(invite, "c=IN IP4 192.168.0.1") ||
+		!strings.Contains(invite, "Via: SIP/2.0/UDP 192.168.0.1:") {
+		t.Fatalf("inside address is left in sip message\n%s", invite)
+	}
+	_, body, _ := strings.Cut(invite, "\r\n\r\n")
+	if !strings.Contains(invite, fmt.Sprintf("Content-Length: %d\r\n", len(body))) {
+		t.Fatalf("content length is not updated\n%s", invite)
+	}
+}
+
+func TestIntegrationIcmpRedirect(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled=%v", disabled), func(t *testing.T) {
+			topo := newBasicLab(t)
+			// host1と同じネットワークにいるルータをNextHopにする
+			path := filepath.Join(t.TempDir(), "config.json")
+			config := `{"static_routes": [{"prefix": "10.30.0.0/24", "nexthop": "192.168.1.3"}]}`
+			if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-mode", "ch2", "-config", path}
+			if disabled {
+				args = append(args, "-no-icmp-redirect", "router1-host1")
+			}
+			topo.startRouter(t, "router1", args...)
+
+			result, err := topo.probe(t, "host1", "10.30.0.1", 64)
+			if disabled {
+				if err == nil && result.icmpType == ICMP_TYPE_REDIRECT {
+					t.Fatalf("redirect was sent from disabled interface %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.icmpType != ICMP_TYPE_REDIRECT || result.icmpCode != ICMP_REDIRECT_CODE_HOST || result.from != "192.168.1.1" {
+				t.Fatalf("unexpected reply %+v", result)
+			}
+		})
+	}
+}
+
+// グループに参加して最初に受け取ったデータグラムを出力する
+func runMulticastJoinHelper(group string) int {
+	conn, err := net.ListenMulticastUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(group), Port: itMcastPort})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "join %s err : %s\n", group, err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", buf[:n])
+	return 0
+}
+
+// ルータを越えられるTTLでグループ宛てにデータグラムを送る
+func runMulticastSendHelper(group string) int {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 8)
+	// vethのチェックサムオフロードで計算途中のチェックサムがルータに届くので、UDPのチェックサムを使わない
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	var addr syscall.SockaddrInet4
+	copy(addr.Addr[:], net.ParseIP(group).To4())
+	addr.Port = itMcastPort
+	for i := 0; i < 5; i++ {
+		err = syscall.Sendto(sock, []byte("go-curo multicast"), 0, &addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+			return 1
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return 0
+}
+
+func TestIntegrationMulticastForwarding(t *testing.T) {
+	topo := newBasicLab(t)
+	// IGMPv3ではなくv2でレポートを送らせる
+	topo.exec(t, "host1", "sysctl", "-q", "-w", "net.ipv4.conf.all.force_igmp_version=2")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-multicast-forwarding")
+
+	receiver := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	receiver.Env = append(os.Environ(), itMcastEnvJoin+"=239.1.1.1")
+	var received bytes.Buffer
+	receiver.Stdout = &received
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Process.Kill()
+	waitRouterOutput(t, router, "Learned multicast group 239.1.1.1 on router1-host1 from 192.168.1.2")
+
+	sender := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	sender.Env = append(os.Environ(), itMcastEnvSend+"=239.1.1.1")
+	if out, err := sender.CombinedOutput(); err != nil {
+		t.Fatalf("send multicast err : %s %s", err, out)
+	}
+	if err := receiver.Wait(); err != nil {
+		t.Fatalf("multicast was not forwarded : %s", err)
+	}
+	if !strings.Contains(received.String(), "go-curo multicast") {
+		t.Fatalf("unexpected datagram %q", received.String())
+	}
+}
+
+func TestIntegrationLldp(t *testing.T) {
+	topo := newLabTopology(t, []string{"router1", "router2"}, []labLink{
+		{ns1: "router1", dev1: "router1-router2", addr1: "10.0.12.1/24",
+			ns2: "router2", dev2: "router2-router1", addr2: "10.0.12.2/24"},
+	})
+	router1 := topo.startRouter(t, "router1", "-mode", "ch2", "-lldp")
+	router2 := topo.startRouter(t, "router2", "-mode", "ch2", "-lldp")
+
+	// 後から起動したrouter2のLLDPDUをrouter1が受け取る
+	waitRouterOutput(t, router1, "port router2-router1 on router1-router2")
+
+	// 停止したらTTLが0のLLDPDUで隣接機器から消える
+	router2.cmd.Process.Signal(syscall.SIGTERM)
+	waitRouterOutput(t, router1, "port router2-router1 on router1-router2 is shut down")
+}
+
+func TestIntegrationBridge(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "bridge1", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-bridge1", addr1: "10.0.0.1/24",
+			ns2: "bridge1", dev2: "bridge1-host1"},
+		{ns1: "host2", dev1: "host2-bridge1", addr1: "10.0.0.2/24",
+			ns2: "bridge1", dev2: "bridge1-host2"},
+	})
+	topo.startRouter(t, "bridge1", "-mode", "ch2", "-bridge", "br0=bridge1-host1,bridge1-host2",
+		"-admin-addr", "127.0.0.1:50155")
+
+	// 同じネットワークのホスト同士がブリッジを通してARPとICMPをやりとりできる
+	result := topo.probeRetry(t, "host1", "10.0.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.0.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("bridge1"),
+		"curl", "-s", "http://127.0.0.1:50155/bridges").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	for _, port := range []string{`"port":"bridge1-host1"`, `"port":"bridge1-host2"`} {
+		if !strings.Contains(string(out), port) {
+			t.Fatalf("mac address on %s is not learned %s", port, out)
+		}
+	}
+}
+
+/*
+3台のブリッジをループにつないでSTPで1つのポートをブロックする
+
+	host1 ── b1 ── b2 ── host2
+	          \    /
+	            b3
+*/
+func TestIntegrationStp(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "host2", "b1", "b2", "b3"}, []labLink{
+		{ns1: "host1", dev1: "host1-b1", addr1: "10.0.0.1/24", ns2: "b1", dev2: "b1-host1"},
+		{ns1: "host2", dev1: "host2-b2", addr1: "10.0.0.2/24", ns2: "b2", dev2: "b2-host2"},
+		{ns1: "b1", dev1: "b1-b2", ns2: "b2", dev2: "b2-b1"},
+		{ns1: "b2", dev1: "b2-b3", ns2: "b3", dev2: "b3-b2"},
+		{ns1: "b3", dev1: "b3-b1", ns2: "b1", dev2: "b1-b3"},
+	})
+	bridges := map[string]string{
+		"b1": "br0=b1-host1,b1-b2,b1-b3",
+		"b2": "br0=b2-host2,b2-b1,b2-b3",
+		"b3": "br0=b3-b1,b3-b2",
+	}
+	adminAddrs := map[string]string{
+		"b1": "127.0.0.1:50156",
+		"b2": "127.0.0.1:50157",
+		"b3": "127.0.0.1:50158",
+	}
+	for _, ns := range []string{"b1", "b2", "b3"} {
+		args := []string{"-mode", "ch2", "-bridge", bridges[ns], "-stp", "-stp-forward-delay", "4s",
+			"-admin-addr", adminAddrs[ns]}
+		// b1をルートブリッジにする
+		if ns == "b1" {
+			args = append(args, "-stp-priority", "4096")
+		}
+		topo.startRouter(t, ns, args...)
+	}
+
+	// リスニングとラーニングを経てフォワーディングになるまで待つ
+	var outputs map[string]string
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		outputs = map[string]string{}
+		alternate, listening := 0, 0
+		for ns, addr := range adminAddrs {
+			out, err := exec.Command("ip", "netns", "exec", netnsName(ns),
+				"curl", "-s", "http://"+addr+"/bridges").CombinedOutput()
+			if err != nil {
+				t.Fatalf("curl err : %s %s", err, out)
+			}
+			outputs[ns] = string(out)
+			alternate += strings.Count(string(out), `"role":"alternate"`)
+			listening += strings.Count(string(out), `"state":"listening"`) + strings.Count(string(out), `"state":"learning"`)
+		}
+		if alternate == 1 && listening == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stp is not converged %v", outputs)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	for ns, out := range outputs {
+		if !strings.Contains(out, `"root_id":"4096.`) {
+			t.Fatalf("root bridge of %s is not b1 %s", ns, out)
+		}
+	}
+	if strings.Contains(outputs["b1"], `"root_port"`) {
+		t.Fatalf("root bridge has root port %s", outputs["b1"])
+	}
+	// ブロックしたポートはb2とb3の間にある
+	if !strings.Contains(outputs["b2"]+outputs["b3"], `"role":"alternate","state":"blocking"`) {
+		t.Fatalf("port between b2 and b3 is not blocked %v", outputs)
+	}
+
+	// ループがあってもブロードキャストストームにならずに通信できる
+	result := topo.probeRetry(t, "host1", "10.0.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.0.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+// 帯域制御を確かめるために間隔を空けずにデータグラムを送る
+func runBlastHelper(dest string) int {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	var addr syscall.SockaddrInet4
+	copy(addr.Addr[:], net.ParseIP(dest).To4())
+	addr.Port = itBlastPort
+	for i := 0; i < itBlastCount; i++ {
+		err = syscall.Sendto(sock, make([]byte, itBlastSize), 0, &addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func (topo *labTopology) blast(t *testing.T, ns, dest string) {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), itBlastEnvDest+"="+dest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("blast %s from %s err : %s %s", dest, ns, err, out)
+	}
+}
+
+// 管理APIからインターフェイスの情報を取得する
+func adminInterfaces(t *testing.T, ns, addr string) map[string]adminInterface {
+	t.Helper()
+	out, err := exec.Command("ip", "netns", "exec", netnsName(ns),
+		"curl", "-s", "http://"+addr+"/interfaces").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var interfaces []adminInterface
+	if err := json.Unmarshal(out, &interfaces); err != nil {
+		t.Fatalf("parse interfaces %s err : %s", out, err)
+	}
+	result := map[string]adminInterface{}
+	for _, netif := range interfaces {
+		result[netif.Name] = netif
+	}
+	return result
+}
+
+type adminInterface struct {
+	Name     string `json:"name"`
+	Counters struct {
+		TxPackets    uint64 `json:"tx_packets"`
+		RxPoliced    uint64 `json:"rx_policed"`
+		TxQueueDrops uint64 `json:"tx_queue_drops"`
+		TxErrors     uint64 `json:"tx_errors"`
+		UrpfDrops    uint64 `json:"urpf_drops"`
+		DscpRemarked uint64 `json:"dscp_remarked"`
+		ImpairLost   uint64 `json:"impair_lost"`
+	} `json:"counters"`
+	Promisc    bool     `json:"promisc"`
+	MacFilter  []string `json:"mac_filter"`
+	AdminState string   `json:"admin_state"`
+	OperState  string   `json:"oper_state"`
+	Urpf       string   `json:"urpf"`
+	TxQueue    int      `json:"tx_queue"`
+	// チェックサムの検証のポリシーと受信のチェックサムオフロード
+	ChecksumPolicy    string `json:"checksum_policy"`
+	RxChecksumOffload bool   `json:"rx_checksum_offload"`
+	// 送信の遅延と損失のエミュレーション
+	Impairment *struct {
+		DelayMs int64   `json:"delay_ms"`
+		Loss    float64 `json:"loss"`
+	} `json:"impairment"`
+	Queues []struct {
+		Class string `json:"class"`
+		Len   int    `json:"len"`
+		Sent  uint64 `json:"sent"`
+	} `json:"queues"`
+}
+
+func TestIntegrationShapingAndPolicing(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50159",
+		"-shape", "router1-host2=200/1514", "-police", "router1-host2=100/3000")
+
+	// ARPを解決しておく
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// ポリシングのバーストを超えた分は受信時に破棄される
+	topo.blast(t, "host2", "192.168.0.1")
+	interfaces := adminInterfaces(t, "router1", "127.0.0.1:50159")
+	if policed := interfaces["router1-host2"].Counters.RxPoliced; policed == 0 || policed == itBlastCount {
+		t.Fatalf("unexpected policed frames %d", policed)
+	}
+
+	// シェーピングでは破棄せずに送信キューで待たせる
+	time.Sleep(time.Second)
+	before := interfaces["router1-host2"].Counters.TxPackets
+	topo.blast(t, "host1", "192.168.0.2")
+	interfaces = adminInterfaces(t, "router1", "127.0.0.1:50159")
+	if interfaces["router1-host2"].TxQueue == 0 {
+		t.Fatalf("frames are not queued %+v", interfaces["router1-host2"])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for interfaces["router1-host2"].TxQueue != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue is not drained %+v", interfaces["router1-host2"])
+		}
+		time.Sleep(200 * time.Millisecond)
+		interfaces = adminInterfaces(t, "router1", "127.0.0.1:50159")
+	}
+	forwarded := interfaces["router1-host2"].Counters.TxPackets - before
+	if forwarded < itBlastCount {
+		t.Fatalf("forwarded %d frames, want %d", forwarded, itBlastCount)
+	}
+}
+
+func TestIntegrationPriorityQueueing(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50160",
+		"-shape", "router1-host2=100/1514", "-qos-scheduler", "strict")
+
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	time.Sleep(time.Second)
+
+	// UDPで送信キューを埋めても、ICMPは優先度の高いキューから先に送られる
+	topo.blast(t, "host1", "192.168.0.2")
+	start := time.Now()
+	result, err := topo.probe(t, "host1", "192.168.0.2", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("echo reply took %s behind bulk traffic", elapsed)
+	}
+
+	interfaces := adminInterfaces(t, "router1", "127.0.0.1:50160")
+	queues := map[string]int{}
+	for _, queue := range interfaces["router1-host2"].Queues {
+		queues[queue.Class] = queue.Len
+	}
+	if queues["normal"] == 0 || queues["high"] != 0 {
+		t.Fatalf("unexpected queues %+v", interfaces["router1-host2"].Queues)
+	}
+}
+
+// どの名前にも同じアドレスを答えるDNSサーバ、受けた問い合わせを出力する
+func runDnsServerHelper(answer string) int {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	if err := syscall.Bind(sock, &syscall.SockaddrInet4{Port: int(DNS_PORT)}); err != nil {
+		fmt.Fprintf(os.Stderr, "bind err : %s\n", err)
+		return 1
+	}
+	addr, _ := parseIPAddr(answer)
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		question, questionEnd, err := dnsReadQuestion(buf[:n])
+		if err != nil {
+			continue
+		}
+		var fromAddr string
+		if sa, ok := from.(*syscall.SockaddrInet4); ok {
+			fromAddr = net.IP(sa.Addr[:]).String()
+		}
+		fmt.Printf("query %s from %s\n", question.name, fromAddr)
+		response := dnsStaticResponse(buf[:n], questionEnd, question, addr)
+		// TTLを300秒にする
+		if byteToUint16(response[6:8]) != 0 {
+			copy(response[len(response)-10:len(response)-6], uint32ToByte(300))
+		}
+		syscall.Sendto(sock, response, 0, from)
+	}
+}
+
+// "server/name"に問い合わせて、最初の答えのアドレスとTTLを出力する
+func runDnsQueryHelper(spec string) int {
+	server, name, _ := strings.Cut(spec, "/")
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	for _, label := range strings.Split(name, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0x00, 0x00, 0x01, 0x00, 0x01)
+	var to syscall.SockaddrInet4
+	copy(to.Addr[:], net.ParseIP(server).To4())
+	to.Port = int(DNS_PORT)
+
+	buf := make([]byte, 1500)
+	// 初回はARPの解決で落ちるので何度か送る
+	for i := 0; i < 3; i++ {
+		syscall.Sendto(sock, query, 0, &to)
+		n, _, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			continue
+		}
+		response := buf[:n]
+		if n < len(query)+16 || byteToUint16(response[0:2]) != 0x1234 || byteToUint16(response[6:8]) == 0 {
+			fmt.Fprintf(os.Stderr, "unexpected response %x\n", response)
+			return 1
+		}
+		answer := response[len(query):]
+		fmt.Printf("%s %d\n", printIPAddr(byteToUint32(answer[12:16])), byteToUint32(answer[6:10]))
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "no response")
+	return 1
+}
+
+func (topo *labTopology) dnsQuery(t *testing.T, ns, server, name string) (string, int) {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), itDnsEnvQuery+"="+server+"/"+name)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("dns query %s err : %s %s", name, err, stderr.String())
+	}
+	var addr string
+	var ttl int
+	fmt.Sscanf(string(out), "%s %d", &addr, &ttl)
+	return addr, ttl
+}
+
+func TestIntegrationDnsForwarder(t *testing.T) {
+	topo := newBasicLab(t)
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itDnsEnvServe+"=10.1.2.3")
+	var queries bytes.Buffer
+	server.Stdout = &queries
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	topo.startRouter(t, "router1", "-mode", "ch2", "-dns-upstream", "192.168.0.2",
+		"-dns-host", "router.lan=192.168.1.1")
+
+	// 静的なホストの表にある名前はルータが答える
+	if addr, _ := topo.dnsQuery(t, "host1", "192.168.1.1", "Router.LAN"); addr != "192.168.1.1" {
+		t.Fatalf("router.lan is resolved to %s", addr)
+	}
+	// それ以外は上位のサーバに転送し、2回目はキャッシュから答える
+	if addr, ttl := topo.dnsQuery(t, "host1", "192.168.1.1", "www.example.com"); addr != "10.1.2.3" || ttl != 300 {
+		t.Fatalf("www.example.com is resolved to %s ttl %d", addr, ttl)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if addr, ttl := topo.dnsQuery(t, "host1", "192.168.1.1", "www.example.com"); addr != "10.1.2.3" || ttl >= 300 {
+		t.Fatalf("cached www.example.com is resolved to %s ttl %d", addr, ttl)
+	}
+	server.Process.Kill()
+	server.Wait()
+	if n := strings.Count(queries.String(), "query www.example.com"); n != 1 {
+		t.Fatalf("upstream received %d queries\n%s", n, queries.String())
+	}
+}
+
+// 指定した時間だけ進んだ時刻を答える階層2のNTPサーバ
+func runNtpServerHelper(offsetStr string) int {
+	offset, err := time.ParseDuration(offsetStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse offset err : %s\n", err)
+		return 1
+	}
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	if err := syscall.Bind(sock, &syscall.SockaddrInet4{Port: int(NTP_PORT)}); err != nil {
+		fmt.Fprintf(os.Stderr, "bind err : %s\n", err)
+		return 1
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		if n < NTP_PACKET_LEN {
+			continue
+		}
+		now := time.Now().Add(offset)
+		response := make([]byte, NTP_PACKET_LEN)
+		response[0] = NTP_VERSION<<3 | NTP_MODE_SERVER
+		response[1] = 2
+		copy(response[24:32], buf[40:48])
+		copy(response[32:40], ntpTimestamp(now))
+		copy(response[40:48], ntpTimestamp(now))
+		syscall.Sendto(sock, response, 0, from)
+	}
+}
+
+// NTPサーバに問い合わせて、時刻のずれと階層を出力する
+func runNtpQueryHelper(server string) int {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+	var to syscall.SockaddrInet4
+	copy(to.Addr[:], net.ParseIP(server).To4())
+	to.Port = int(NTP_PORT)
+
+	buf := make([]byte, 1500)
+	// 初回はARPの解決で落ちるので何度か送る
+	for i := 0; i < 3; i++ {
+		request := make([]byte, NTP_PACKET_LEN)
+		request[0] = NTP_VERSION<<3 | NTP_MODE_CLIENT
+		copy(request[40:48], ntpTimestamp(time.Now()))
+		syscall.Sendto(sock, request, 0, &to)
+		n, _, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			continue
+		}
+		response := buf[:n]
+		if n < NTP_PACKET_LEN || response[0]&0x07 != NTP_MODE_SERVER || !bytes.Equal(response[24:32], request[40:48]) {
+			fmt.Fprintf(os.Stderr, "unexpected response %x\n", response)
+			return 1
+		}
+		offset := ntpTime(response[40:48]).Sub(time.Now())
+		fmt.Printf("%d %d\n", offset.Round(time.Second)/time.Second, response[1])
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "no response")
+	return 1
+}
+
+func TestIntegrationNtp(t *testing.T) {
+	topo := newBasicLab(t)
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itNtpEnvServe+"=1h")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50161",
+		"-ntp", "192.168.0.2", "-ntp-serve")
+	waitRouterOutput(t, router, "NTP synchronized to 192.168.0.2")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50161/ntp").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var status struct {
+		Synchronized bool    `json:"synchronized"`
+		Server       string  `json:"server"`
+		OffsetMs     float64 `json:"offset_ms"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		t.Fatalf("parse ntp status %s err : %s", out, err)
+	}
+	if !status.Synchronized || status.Server != "192.168.0.2" || status.OffsetMs < 3599000 || status.OffsetMs > 3601000 {
+		t.Fatalf("unexpected ntp status %s", out)
+	}
+
+	// ルータは補正した時刻を1つ下の階層として配る
+	cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	cmd.Env = append(os.Environ(), itNtpEnvQuery+"=192.168.1.1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("ntp query err : %s %s", err, stderr.String())
+	}
+	var offset, stratum int
+	fmt.Sscanf(string(out), "%d %d", &offset, &stratum)
+	if offset != 3600 || stratum != 3 {
+		t.Fatalf("router answered offset %ds stratum %d", offset, stratum)
+	}
+}
+
+/*
+2台のルータで192.168.1.254を仮想ルータにして、マスターが止まったらバックアップが引き継ぐ
+
+	host1 ── sw(Linuxのブリッジ) ─┬─ r1 (192.168.1.1, 優先度200)
+	                               └─ r2 (192.168.1.3, 優先度100)
+*/
+func TestIntegrationVrrp(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "sw", "r1", "r2"}, []labLink{
+		{ns1: "host1", dev1: "host1-sw", addr1: "192.168.1.2/24", ns2: "sw", dev2: "sw-host1"},
+		{ns1: "r1", dev1: "r1-sw", addr1: "192.168.1.1/24", ns2: "sw", dev2: "sw-r1"},
+		{ns1: "r2", dev1: "r2-sw", addr1: "192.168.1.3/24", ns2: "sw", dev2: "sw-r2"},
+	})
+	runIP(t, "-n", netnsName("sw"), "link", "add", "br0", "type", "bridge")
+	for _, port := range []string{"sw-host1", "sw-r1", "sw-r2"} {
+		runIP(t, "-n", netnsName("sw"), "link", "set", port, "master", "br0")
+	}
+	runIP(t, "-n", netnsName("sw"), "link", "set", "br0", "up")
+
+	r1 := topo.startRouter(t, "r1", "-mode", "ch2", "-vrrp", "r1-sw=1/192.168.1.254/200",
+		"-admin-addr", "127.0.0.1:50162")
+	r2 := topo.startRouter(t, "r2", "-mode", "ch2", "-vrrp", "r2-sw=1/192.168.1.254",
+		"-admin-addr", "127.0.0.1:50163")
+	waitRouterOutput(t, r1, "VRRP 1 on r1-sw became master of 192.168.1.254")
+	waitRouterOutput(t, r2, "VRRP 1 on r2-sw became backup of 192.168.1.254")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("r2"),
+		"curl", "-s", "http://127.0.0.1:50163/vrrp").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `"state":"backup","master":"192.168.1.1"`) {
+		t.Fatalf("r2 is not backup of r1 %s", out)
+	}
+
+	// マスターが仮想IPアドレスに仮想MACアドレスで答える
+	result := topo.probeRetry(t, "host1", "192.168.1.254", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.1.254" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	out, err = exec.Command("ip", "-n", netnsName("host1"), "neigh", "show", "192.168.1.254").CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "00:00:5e:00:01:01") {
+		t.Fatalf("virtual mac address is not resolved %s", out)
+	}
+
+	// マスターを止めるとバックアップが引き継ぎ、ホストはARPを引き直さずに通信できる
+	r1.cmd.Process.Signal(syscall.SIGTERM)
+	waitRouterOutput(t, r2, "VRRP 1 on r2-sw became master of 192.168.1.254")
+	result = topo.probeRetry(t, "host1", "192.168.1.254", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.1.254" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+/*
+PPPoEのアクセスコンセントレータ
+セッション1でPAPの認証をして、IPCPで100.64.0.2を割り当てる
+自分は100.64.0.1としてICMPエコーリクエストに答える
+*/
+func runPppoeAcHelper(ifname string) int {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "interface %s err : %s\n", ifname, err)
+		return 1
+	}
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	addr := syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index}
+	if err := syscall.Bind(sock, &addr); err != nil {
+		fmt.Fprintf(os.Stderr, "bind err : %s\n", err)
+		return 1
+	}
+	const sessionID = 1
+	acAddr := uint32(100<<24 | 64<<16 | 1)
+	clientAddr := acAddr + 1
+	send := func(dest []byte, etherType uint16, payload []byte) {
+		frame := append(append(append([]byte{}, dest...), iface.HardwareAddr...), uint16ToByte(etherType)...)
+		syscall.Sendto(sock, append(frame, payload...), 0, &addr)
+	}
+	sendPpp := func(dest []byte, protocol uint16, payload []byte) {
+		send(dest, ETHER_TYPE_PPPOE_SESSION, pppoePacket(PPPOE_CODE_SESSION, sessionID, append(uint16ToByte(protocol), payload...)))
+	}
+	// クライアントのConfigure-Requestを最初に受けた時に自分の要求を送る
+	var lcpRequested, ipcpRequested bool
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); (ok && ll.Pkttype == syscall.PACKET_OUTGOING) || n < 14 {
+			continue
+		}
+		src := append([]byte{}, buf[6:12]...)
+		code, session, payload, ok := pppoeReadHeader(buf[14:n])
+		if !ok {
+			continue
+		}
+		switch byteToUint16(buf[12:14]) {
+		case ETHER_TYPE_PPPOE_DISCOVERY:
+			tags, _ := pppoeReadTags(payload)
+			reply := pppoeTag(PPPOE_TAG_SERVICE_NAME, nil)
+			reply = append(reply, pppoeTag(PPPOE_TAG_HOST_UNIQ, tags[PPPOE_TAG_HOST_UNIQ])...)
+			switch code {
+			case PPPOE_CODE_PADI:
+				reply = append(reply, pppoeTag(PPPOE_TAG_AC_NAME, []byte("curo-test-ac"))...)
+				reply = append(reply, pppoeTag(PPPOE_TAG_AC_COOKIE, []byte("cookie"))...)
+				send(src, ETHER_TYPE_PPPOE_DISCOVERY, pppoePacket(PPPOE_CODE_PADO, 0, reply))
+			case PPPOE_CODE_PADR:
+				if string(tags[PPPOE_TAG_AC_COOKIE]) != "cookie" {
+					fmt.Println("PADR without cookie")
+					continue
+				}
+				lcpRequested, ipcpRequested = false, false
+				send(src, ETHER_TYPE_PPPOE_DISCOVERY, pppoePacket(PPPOE_CODE_PADS, sessionID, reply))
+			case PPPOE_CODE_PADT:
+				fmt.Println("PADT")
+			}
+		case ETHER_TYPE_PPPOE_SESSION:
+			if session != sessionID || len(payload) < 2 {
+				continue
+			}
+			protocol := byteToUint16(payload[0:2])
+			code, id, data, ok := pppReadControlPacket(payload[2:])
+			switch {
+			case protocol == PPP_PROTOCOL_LCP && ok && code == PPP_CODE_CONFIGURE_REQUEST:
+				sendPpp(src, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_CONFIGURE_ACK, id, data))
+				if !lcpRequested {
+					lcpRequested = true
+					options := pppOptionsToBytes([]pppOption{
+						{optType: LCP_OPTION_MRU, value: uint16ToByte(PPPOE_MTU)},
+						{optType: LCP_OPTION_AUTH_PROTOCOL, value: uint16ToByte(PPP_PROTOCOL_PAP)},
+						{optType: LCP_OPTION_MAGIC_NUMBER, value: uint32ToByte(0x11223344)},
+					})
+					sendPpp(src, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_CONFIGURE_REQUEST, 1, options))
+				}
+			case protocol == PPP_PROTOCOL_LCP && ok && code == PPP_CODE_ECHO_REQUEST:
+				sendPpp(src, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_ECHO_REPLY, id, uint32ToByte(0x11223344)))
+			case protocol == PPP_PROTOCOL_PAP && ok && code == PAP_CODE_AUTHENTICATE_REQUEST:
+				user := string(data[1 : 1+data[0]])
+				password := string(data[2+data[0]:])
+				if user == "curo" && password == "secret" {
+					sendPpp(src, PPP_PROTOCOL_PAP, pppControlPacket(PAP_CODE_AUTHENTICATE_ACK, id, append([]byte{7}, "welcome"...)))
+				} else {
+					sendPpp(src, PPP_PROTOCOL_PAP, pppControlPacket(PAP_CODE_AUTHENTICATE_NAK, id, append([]byte{6}, "denied"...)))
+				}
+			case protocol == PPP_PROTOCOL_IPCP && ok && code == PPP_CODE_CONFIGURE_REQUEST:
+				options, _ := pppReadOptions(data)
+				if len(options) == 1 && byteToUint32(options[0].value) == clientAddr {
+					sendPpp(src, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_CONFIGURE_ACK, id, data))
+				} else {
+					nak := pppOptionsToBytes([]pppOption{{optType: IPCP_OPTION_IP_ADDRESS, value: uint32ToByte(clientAddr)}})
+					sendPpp(src, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_CONFIGURE_NAK, id, nak))
+				}
+				if !ipcpRequested {
+					ipcpRequested = true
+					options := pppOptionsToBytes([]pppOption{{optType: IPCP_OPTION_IP_ADDRESS, value: uint32ToByte(acAddr)}})
+					sendPpp(src, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_CONFIGURE_REQUEST, 1, options))
+				}
+			case protocol == PPP_PROTOCOL_IP && len(payload) >= 2+20+8:
+				// 自分宛てのICMPエコーリクエストに答える
+				packet := append([]byte{}, payload[2:]...)
+				headerLen := int(packet[0]&0x0f) * 4
+				if byteToUint32(packet[16:20]) != acAddr || packet[9] != IP_PROTOCOL_NUM_ICMP || packet[headerLen] != ICMP_TYPE_ECHO_REQUEST {
+					continue
+				}
+				copy(packet[16:20], packet[12:16])
+				copy(packet[12:16], uint32ToByte(acAddr))
+				packet[8] = 64
+				packet[10], packet[11] = 0, 0
+				copy(packet[10:12], calcChecksum(packet[:headerLen]))
+				icmp := packet[headerLen:]
+				icmp[0] = ICMP_TYPE_ECHO_REPLY
+				icmp[2], icmp[3] = 0, 0
+				copy(icmp[2:4], calcChecksum(icmp))
+				sendPpp(src, PPP_PROTOCOL_IP, packet)
+			}
+		}
+	}
+}
+
+/*
+PPPoEでアクセスコンセントレータからアドレスを受け取り、デフォルト経路をセッションに向ける
+
+	host1 (192.168.1.2) ── (192.168.1.1) router1 (PPPoE 100.64.0.2) ── ac (100.64.0.1)
+*/
+func TestIntegrationPppoe(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "ac"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "ac", dev1: "ac-router1", ns2: "router1", dev2: "router1-ac"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	ac := exec.Command("ip", "netns", "exec", netnsName("ac"), os.Args[0])
+	ac.Env = append(os.Environ(), itPppoeEnvAC+"=ac-router1")
+	if err := ac.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ac.Process.Kill()
+		ac.Wait()
+	}()
+
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50164",
+		"-pppoe", "router1-ac", "-pppoe-user", "curo", "-pppoe-password", "secret")
+	waitRouterOutput(t, router, "PPPoE authenticated as curo on router1-ac")
+	waitRouterOutput(t, router, "PPPoE session 1 on router1-ac is up, address 100.64.0.2 peer 100.64.0.1")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50164/pppoe").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var status struct {
+		State     string `json:"state"`
+		ACName    string `json:"ac_name"`
+		SessionID uint16 `json:"session_id"`
+		Address   string `json:"address"`
+		MRU       uint16 `json:"mru"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		t.Fatalf("parse pppoe status %s err : %s", out, err)
+	}
+	if status.State != "up" || status.ACName != "curo-test-ac" || status.SessionID != 1 ||
+		status.Address != "100.64.0.2" || status.MRU != PPPOE_MTU {
+		t.Fatalf("unexpected pppoe status %s", out)
+	}
+
+	// デフォルト経路でセッションの向こうに届く
+	result := topo.probeRetry(t, "host1", "100.64.0.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "100.64.0.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+/*
+2台のルータの間をIPsec ESPのトンネルでつなぎ、お互いのLANへの経路をトンネルに向ける
+
+	host1 (192.168.1.2) ── r1 (10.0.0.1) ══ ESP ══ (10.0.0.2) r2 ── host2 (192.168.2.2)
+*/
+func TestIntegrationIpsec(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "r1", "r2", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-r1", addr1: "192.168.1.2/24", ns2: "r1", dev2: "r1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "r1", dev1: "r1-r2", addr1: "10.0.0.1/24", ns2: "r2", dev2: "r2-r1", addr2: "10.0.0.2/24"},
+		{ns1: "host2", dev1: "host2-r2", addr1: "192.168.2.2/24", ns2: "r2", dev2: "r2-host2", addr2: "192.168.2.1/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("host2"), "route", "add", "default", "via", "192.168.2.1")
+
+	const key1 = "000102030405060708090a0b0c0d0e0f10111213"
+	const key2 = "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40414243"
+	topo.startRouter(t, "r1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50165",
+		"-ipsec", "peer=10.0.0.2,spi-out=0x1001,key-out="+key1+",spi-in=0x2001,key-in="+key2+",routes=192.168.2.0/24")
+	topo.startRouter(t, "r2", "-mode", "ch2", "-admin-addr", "127.0.0.1:50166",
+		"-ipsec", "peer=10.0.0.1,spi-out=0x2001,key-out="+key2+",spi-in=0x1001,key-in="+key1+",routes=192.168.1.0/24")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("r1"),
+		"curl", "-s", "http://127.0.0.1:50165/routes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `"prefix":"192.168.2.0/24","type":"ipsec","nexthop":"10.0.0.2"`) {
+		t.Fatalf("route via ipsec tunnel is not found %s", out)
+	}
+
+	result := topo.probeRetry(t, "host1", "192.168.2.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.2.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	out, err = exec.Command("ip", "netns", "exec", netnsName("r2"),
+		"curl", "-s", "http://127.0.0.1:50166/ipsec").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var tunnels []struct {
+		Peer         string `json:"peer"`
+		TxPackets    uint64 `json:"tx_packets"`
+		RxPackets    uint64 `json:"rx_packets"`
+		AuthFailures uint64 `json:"auth_failures"`
+	}
+	if err := json.Unmarshal(out, &tunnels); err != nil {
+		t.Fatalf("parse ipsec tunnels %s err : %s", out, err)
+	}
+	if len(tunnels) != 1 || tunnels[0].Peer != "10.0.0.1" || tunnels[0].RxPackets == 0 ||
+		tunnels[0].TxPackets == 0 || tunnels[0].AuthFailures != 0 {
+		t.Fatalf("unexpected ipsec tunnels %s", out)
+	}
+}
+
+/*
+r1を止めて起動し直しても、-state-fileで書き出したシーケンス番号の続きから送るので、
+r2のアンチリプレイで捨てられずにトンネルを使い続けられる
+*/
+func TestIntegrationIpsecRestart(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "r1", "r2", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-r1", addr1: "192.168.1.2/24", ns2: "r1", dev2: "r1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "r1", dev1: "r1-r2", addr1: "10.0.0.1/24", ns2: "r2", dev2: "r2-r1", addr2: "10.0.0.2/24"},
+		{ns1: "host2", dev1: "host2-r2", addr1: "192.168.2.2/24", ns2: "r2", dev2: "r2-host2", addr2: "192.168.2.1/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("host2"), "route", "add", "default", "via", "192.168.2.1")
+
+	const key1 = "000102030405060708090a0b0c0d0e0f10111213"
+	const key2 = "202122232425262728292a2b2c2d2e2f30313233"
+	path := filepath.Join(t.TempDir(), "state.json")
+	r1Args := []string{"-mode", "ch2", "-state-file", path,
+		"-ipsec", "peer=10.0.0.2,spi-out=0x1001,key-out=" + key1 + ",spi-in=0x2001,key-in=" + key2 + ",routes=192.168.2.0/24"}
+	r1 := topo.startRouter(t, "r1", r1Args...)
+	topo.startRouter(t, "r2", "-mode", "ch2",
+		"-ipsec", "peer=10.0.0.1,spi-out=0x2001,key-out="+key2+",spi-in=0x1001,key-in="+key1+",routes=192.168.1.0/24")
+
+	// 再起動した後の数回の送信では追いつけないくらいシーケンス番号を進めておく
+	topo.probeRetry(t, "host1", "192.168.2.2", 64)
+	topo.blast(t, "host1", "192.168.2.2")
+	r1.stop(t)
+	waitRouterOutput(t, r1, "Saved state to "+path)
+
+	r1 = topo.startRouter(t, "r1", r1Args...)
+	waitRouterOutput(t, r1, "Restored sequence numbers of 1 ipsec tunnels from "+path)
+	// 前回の番号を使い直すとr2のウィンドウに穴が無い限りリプレイとして捨てられる
+	replies := 0
+	for i := 0; i < 5; i++ {
+		result, err := topo.probe(t, "host1", "192.168.2.2", 64)
+		if err != nil {
+			continue
+		}
+		if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.2.2" {
+			t.Fatalf("unexpected reply %+v", result)
+		}
+		replies++
+	}
+	if replies < 4 {
+		t.Fatalf("only %d of 5 probes passed the tunnel after restart", replies)
+	}
+}
+
+/*
+-default-gatewayで入れた0.0.0.0/0の経路で、他に経路の無い宛先に届く
+管理APIで"default"を消すとNet Unreachableになる
+
+	host1 (192.168.1.2) ── (192.168.1.1) router1 (10.0.0.1) ── (10.0.0.2) wan (203.0.113.1)
+*/
+func TestIntegrationDefaultRoute(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "wan"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "wan", dev1: "wan-router1", addr1: "10.0.0.2/24",
+			ns2: "router1", dev2: "router1-wan", addr2: "10.0.0.1/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("wan"), "route", "add", "192.168.1.0/24", "via", "10.0.0.1")
+	runIP(t, "-n", netnsName("wan"), "addr", "add", "203.0.113.1/32", "dev", "lo")
+
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50167",
+		"-default-gateway", "10.0.0.2")
+	waitRouterOutput(t, router, "Set default route via 10.0.0.2")
+
+	curl := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("ip", append([]string{"netns", "exec", netnsName("router1"), "curl", "-s"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	if out := curl("http://127.0.0.1:50167/routes"); !strings.Contains(out, `"prefix":"0.0.0.0/0","type":"network","nexthop":"10.0.0.2"`) {
+		t.Fatalf("default route is not found %s", out)
+	}
+
+	result := topo.probeRetry(t, "host1", "203.0.113.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "203.0.113.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	curl("-X", "DELETE", "http://127.0.0.1:50167/routes?prefix=default")
+	if out := curl("http://127.0.0.1:50167/routes"); strings.Contains(out, `"prefix":"0.0.0.0/0"`) {
+		t.Fatalf("default route is not deleted %s", out)
+	}
+	result = topo.probeRetry(t, "host1", "203.0.113.1", 64)
+	if result.icmpType != ICMP_TYPE_DESTINATION_UNREACHABLE ||
+		result.icmpCode != ICMP_DEST_UNREACHABLE_CODE_NET_UNREACHABLE || result.from != "192.168.1.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+/*
+インターフェイスのセカンダリのアドレスにも直接接続の経路が入り、自分宛てとして応答する
+
+	host1 (192.168.1.2, 192.168.3.2) ── (192.168.1.1, 192.168.3.1) router1 (192.168.0.1) ── host2 (192.168.0.2)
+*/
+func TestIntegrationSecondaryAddress(t *testing.T) {
+	topo := newBasicLab(t)
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "192.168.3.1/24", "dev", "router1-host1")
+	runIP(t, "-n", netnsName("host1"), "addr", "add", "192.168.3.2/24", "dev", "host1-router1")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50169")
+	waitRouterOutput(t, router, "Set directly connected route 192.168.1.0/24 via router1-host1")
+	waitRouterOutput(t, router, "Set directly connected route 192.168.3.0/24 via router1-host1")
+
+	// セカンダリのアドレス宛てのping
+	result := topo.probeRetry(t, "host1", "192.168.3.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.3.1" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	// セカンダリのサブネットへのフォワーディング
+	result = topo.probeRetry(t, "host2", "192.168.3.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.3.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50169/interfaces").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `"address":"192.168.1.1/24"`) || !strings.Contains(string(out), `"secondary_addresses":["192.168.3.1/24"]`) {
+		t.Fatalf("secondary address is not found %s", out)
+	}
+
+	// セカンダリのアドレスを外すと経路も消える
+	runIP(t, "-n", netnsName("router1"), "addr", "del", "192.168.3.1/24", "dev", "router1-host1")
+	waitRouterOutput(t, router, "Deleted directly connected route 192.168.3.0/24 via router1-host1")
+	result = topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+}
+
+// ループバックのアドレスは自分宛てとして応答し、ルータIDになる
+func TestIntegrationLoopback(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50170",
+		"-loopback", "10.255.0.1,10.255.0.2/32")
+	waitRouterOutput(t, router, "Created loopback device lo0 address [10.255.0.1/32 10.255.0.2/32]")
+
+	for _, addr := range []string{"10.255.0.1", "10.255.0.2"} {
+		result := topo.probeRetry(t, "host1", addr, 64)
+		if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != addr {
+			t.Fatalf("unexpected reply %+v", result)
+		}
+	}
+
+	curl := func(path string) string {
+		t.Helper()
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+			"curl", "-s", "http://127.0.0.1:50170"+path).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	if out := curl("/stats"); !strings.Contains(out, `"router_id":"10.255.0.2"`) {
+		t.Fatalf("unexpected router id %s", out)
+	}
+	if out := curl("/routes"); !strings.Contains(out, `"prefix":"10.255.0.1/32","type":"connected"`) {
+		t.Fatalf("loopback route is not found %s", out)
+	}
+}
+
+/*
+ルータから送る問い合わせは、出力インターフェイスで上位のサーバと同じサブネットのセカンダリのアドレスから送る
+
+	host1 (192.168.1.2) ── router1 (192.168.0.1, 192.168.5.1) ── (192.168.0.2, 192.168.5.2) host2
+*/
+func TestIntegrationSourceAddressSelection(t *testing.T) {
+	topo := newBasicLab(t)
+	runIP(t, "-n", netnsName("router1"), "addr", "add", "192.168.5.1/24", "dev", "router1-host2")
+	runIP(t, "-n", netnsName("host2"), "addr", "add", "192.168.5.2/24", "dev", "host2-router1")
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itDnsEnvServe+"=10.1.2.3")
+	var queries bytes.Buffer
+	server.Stdout = &queries
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	topo.startRouter(t, "router1", "-mode", "ch2", "-dns-upstream", "192.168.5.2")
+
+	if addr, _ := topo.dnsQuery(t, "host1", "192.168.1.1", "www.example.com"); addr != "10.1.2.3" {
+		t.Fatalf("www.example.com is resolved to %s", addr)
+	}
+	server.Process.Kill()
+	server.Wait()
+	if !strings.Contains(queries.String(), "query www.example.com from 192.168.5.1") {
+		t.Fatalf("unexpected source address of query %s", queries.String())
+	}
+}
+
+// 管理APIの/eventsでフォワードした経路と破棄した理由のついたイベントが流れてくる
+func TestIntegrationPacketEventStream(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50171")
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+
+	curl := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-sN", "--max-time", "3", "http://127.0.0.1:50171/events?sample=1")
+	var stream bytes.Buffer
+	curl.Stdout = &stream
+	if err := curl.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	topo.probeRetry(t, "host1", "192.168.0.2", 1)
+	// --max-timeで切断されるのでエラーは無視する
+	curl.Wait()
+
+	var forwarded, dropped bool
+	packets := map[uint64][]string{}
+	for _, line := range strings.Split(stream.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Packet       uint64 `json:"packet"`
+			Device       string `json:"device"`
+			Action       string `json:"action"`
+			DestAddress  string `json:"dest_address"`
+			OutputDevice string `json:"output_device"`
+			Route        string `json:"route"`
+			DropReason   string `json:"drop_reason"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %s : %s", data, err)
+		}
+		packets[event.Packet] = append(packets[event.Packet], event.Action)
+		if event.Action == PACKET_EVENT_FORWARDED && event.Device == "router1-host1" &&
+			event.OutputDevice == "router1-host2" && event.Route == "192.168.0.0/24" {
+			forwarded = true
+		}
+		if event.Action == PACKET_EVENT_DROPPED && event.DestAddress == "192.168.0.2" && event.DropReason == "ttl_exceeded" {
+			dropped = true
+			if actions := packets[event.Packet]; actions[0] != PACKET_EVENT_RECEIVED {
+				t.Fatalf("dropped packet is not received %v", actions)
+			}
+		}
+	}
+	if !forwarded || !dropped {
+		t.Fatalf("events are not streamed (forwarded %v, dropped %v)\n%s", forwarded, dropped, stream.String())
+	}
+}
+
+// ダッシュボードのページはtoken無しで見られ、ページが使うNATとログのAPIはtokenで取得できる
+func TestIntegrationDashboard(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50172", "-admin-token", "secret")
+	waitRouterOutput(t, router, "Admin API server is listening on 127.0.0.1:50172")
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+
+	curl := func(args ...string) string {
+		t.Helper()
+		args = append([]string{"netns", "exec", netnsName("router1"), "curl", "-s"}, args...)
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	if out := curl("http://127.0.0.1:50172/"); !strings.Contains(out, "<title>go-curo dashboard</title>") {
+		t.Fatalf("dashboard is not served %s", out)
+	}
+	if out := curl("http://127.0.0.1:50172/logs"); !strings.Contains(out, "unauthorized") {
+		t.Fatalf("logs are served without token %s", out)
+	}
+	auth := []string{"-H", "Authorization: Bearer secret"}
+	if out := curl(append(auth, "http://127.0.0.1:50172/nat")...); !strings.Contains(out, `"enabled":false`) {
+		t.Fatalf("unexpected nat status %s", out)
+	}
+	// 標準出力に書いたログが取り込まれていて、ルータの出力にもそのまま出る
+	out := curl(append(auth, "http://127.0.0.1:50172/logs?lines=500")...)
+	var lines []struct {
+		Line string `json:"line"`
+	}
+	if err := json.Unmarshal([]byte(out), &lines); err != nil {
+		t.Fatalf("invalid logs %s : %s", out, err)
+	}
+	var found bool
+	for _, line := range lines {
+		if line.Line == "Set directly connected route 192.168.0.0/24 via router1-host2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("startup log is not found %s", out)
+	}
+	waitRouterOutput(t, router, "Forwarding ip packet from 192.168.1.2 to 192.168.0.2")
+}
+
+type snmpVarBindASN1 struct {
+	Name  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type snmpPDUASN1 struct {
+	RequestID   int
+	ErrorStatus int
+	ErrorIndex  int
+	VarBinds    []snmpVarBindASN1
+}
+
+type snmpMessageASN1 struct {
+	Version   int
+	Community []byte
+	PDU       asn1.RawValue
+}
+
+/*
+ルータの実装とは別にencoding/asn1でSNMPv2cのリクエストを作り、応答を"OID 値"の行で出力する
+"server,community,op,oid"のopはget、walk(GetNextで辿る)、bulkwalk(GetBulkで辿る)
+辿る時はOIDが増えていくことを確かめる
+*/
+func runSnmpHelper(spec string) int {
+	args := strings.Split(spec, ",")
+	if len(args) != 4 {
+		fmt.Fprintf(os.Stderr, "invalid spec %s\n", spec)
+		return 1
+	}
+	server, community, op := args[0], args[1], args[2]
+	var root asn1.ObjectIdentifier
+	for _, id := range strings.Split(args[3], ".") {
+		n, err := strconv.Atoi(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid oid %s\n", args[3])
+			return 1
+		}
+		root = append(root, n)
+	}
+	// ルータのnetnsのカーネルが返すPort Unreachableを受け取らないように、接続しないソケットを使う
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_NO_CHECK, 1)
+	syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 1})
+	var to syscall.SockaddrInet4
+	copy(to.Addr[:], net.ParseIP(server).To4())
+	to.Port = int(SNMP_PORT)
+
+	requestID := 1
+	request := func(pduTag, nonRepeaters, maxRepetitions int, oid asn1.ObjectIdentifier) ([]snmpVarBindASN1, error) {
+		requestID++
+		pdu, err := asn1.MarshalWithParams(snmpPDUASN1{
+			RequestID:   requestID,
+			ErrorStatus: nonRepeaters,
+			ErrorIndex:  maxRepetitions,
+			VarBinds:    []snmpVarBindASN1{{Name: oid, Value: asn1.RawValue{Tag: asn1.TagNull}}},
+		}, fmt.Sprintf("tag:%d", pduTag))
+		if err != nil {
+			return nil, err
+		}
+		msg, err := asn1.Marshal(snmpMessageASN1{Version: 1, Community: []byte(community), PDU: asn1.RawValue{FullBytes: pdu}})
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65536)
+		var n int
+		for i := 0; i < 3; i++ {
+			syscall.Sendto(sock, msg, 0, &to)
+			n, _, err = syscall.Recvfrom(sock, buf, 0)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		var response snmpMessageASN1
+		if _, err := asn1.Unmarshal(buf[:n], &response); err != nil {
+			return nil, err
+		}
+		var responsePDU snmpPDUASN1
+		if _, err := asn1.UnmarshalWithParams(response.PDU.FullBytes, &responsePDU, "tag:2"); err != nil {
+			return nil, err
+		}
+		if responsePDU.RequestID != requestID || responsePDU.ErrorStatus != 0 {
+			return nil, fmt.Errorf("request id %d error status %d", responsePDU.RequestID, responsePDU.ErrorStatus)
+		}
+		return responsePDU.VarBinds, nil
+	}
+	print := func(vb snmpVarBindASN1) {
+		value := vb.Value
+		var s string
+		switch {
+		case value.Class == asn1.ClassUniversal && value.Tag == asn1.TagInteger:
+			var v int
+			asn1.Unmarshal(value.FullBytes, &v)
+			s = strconv.Itoa(v)
+		case value.Class == asn1.ClassUniversal && value.Tag == asn1.TagOctetString:
+			s = fmt.Sprintf("%q", value.Bytes)
+			if len(value.Bytes) == 6 {
+				s = net.HardwareAddr(value.Bytes).String()
+			}
+		case value.Class == asn1.ClassApplication && value.Tag == 0:
+			s = net.IP(value.Bytes).String()
+		case value.Class == asn1.ClassApplication:
+			var v uint64
+			for _, c := range value.Bytes {
+				v = v<<8 | uint64(c)
+			}
+			s = strconv.FormatUint(v, 10)
+		default:
+			s = fmt.Sprintf("class %d tag %d", value.Class, value.Tag)
+		}
+		fmt.Printf("%s %s\n", vb.Name, s)
+	}
+
+	if op == "get" {
+		varBinds, err := request(0, 0, 0, root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "get err : %s\n", err)
+			return 1
+		}
+		print(varBinds[0])
+		return 0
+	}
+	last := root
+	for {
+		var varBinds []snmpVarBindASN1
+		if op == "bulkwalk" {
+			varBinds, err = request(5, 0, 10, last)
+		} else {
+			varBinds, err = request(1, 0, 0, last)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s err : %s\n", op, err)
+			return 1
+		}
+		for _, vb := range varBinds {
+			if vb.Value.Class == asn1.ClassContextSpecific || len(vb.Name) <= len(root) || !vb.Name[:len(root)].Equal(root) {
+				return 0
+			}
+			if snmpOIDLess(vb.Name, last) || vb.Name.Equal(last) {
+				fmt.Fprintf(os.Stderr, "oid %s is not increasing from %s\n", vb.Name, last)
+				return 1
+			}
+			print(vb)
+			last = vb.Name
+		}
+	}
+}
+
+func snmpOIDLess(a, b asn1.ObjectIdentifier) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// SNMPのGetとGetNextとGetBulkでインターフェイス、経路、ARPのテーブルが読める
+func TestIntegrationSnmpAgent(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-snmp-community", "labsecret")
+	waitRouterOutput(t, router, "SNMP agent is started")
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+
+	snmp := func(community, op, oid string) (string, error) {
+		t.Helper()
+		cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+		cmd.Env = append(os.Environ(), itSnmpEnv+"="+strings.Join([]string{"192.168.1.1", community, op, oid}, ","))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s %s", err, stderr.String())
+		}
+		return string(out), nil
+	}
+	mustSnmp := func(op, oid string) string {
+		t.Helper()
+		out, err := snmp("labsecret", op, oid)
+		if err != nil {
+			t.Fatalf("snmp %s %s err : %s", op, oid, err)
+		}
+		return out
+	}
+
+	if out := mustSnmp("get", "1.3.6.1.2.1.1.1.0"); out != "1.3.6.1.2.1.1.1.0 \"go-curo software router\"\n" {
+		t.Fatalf("unexpected sysDescr %q", out)
+	}
+	if out := mustSnmp("walk", "1.3.6.1.2.1.2.2.1.2"); !strings.Contains(out, `"router1-host1"`) || !strings.Contains(out, `"router1-host2"`) {
+		t.Fatalf("interfaces are not found in ifDescr %s", out)
+	}
+	// host1のMACアドレスがipNetToMediaPhysAddressにある
+	host1Mac := netnsMacAddr(t, "host1", "host1-router1")
+	if out := mustSnmp("bulkwalk", "1.3.6.1.2.1.4.22.1.2"); !strings.Contains(out, ".192.168.1.2 "+host1Mac+"\n") {
+		t.Fatalf("arp entry of host1 %s is not found %s", host1Mac, out)
+	}
+	// 192.168.2.0/24 via 192.168.0.2のipCidrRouteNextHop
+	if out := mustSnmp("walk", "1.3.6.1.2.1.4.24.4.1.4"); !strings.Contains(out, "1.3.6.1.2.1.4.24.4.1.4.192.168.2.0.255.255.255.0.0.192.168.0.2 192.168.0.2\n") {
+		t.Fatalf("static route is not found %s", out)
+	}
+	// 全体をGetNextとGetBulkで辿って同じ結果になる
+	walk := mustSnmp("walk", "1.3.6.1.2.1")
+	bulk := mustSnmp("bulkwalk", "1.3.6.1.2.1")
+	if !strings.Contains(walk, "1.3.6.1.2.1.31.1.1.1.1.") || strings.Count(walk, "\n") != strings.Count(bulk, "\n") {
+		t.Fatalf("walk and bulkwalk differ\n%s\n%s", walk, bulk)
+	}
+	// コミュニティ名が違えば答えない
+	if out, err := snmp("public", "get", "1.3.6.1.2.1.1.1.0"); err == nil {
+		t.Fatalf("agent answered to wrong community %s", out)
+	}
+}
+
+// UDPのtracerouteはルータで待っていないポートにPort Unreachableが返って終わる
+func TestIntegrationUdpTraceroute(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2")
+	// ARPを解決しておく
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+
+	trace := func(dest string) string {
+		t.Helper()
+		cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+		cmd.Env = append(os.Environ(), itTraceEnvDest+"="+dest)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("traceroute to %s err : %s %s %s", dest, err, out, stderr.String())
+		}
+		return string(out)
+	}
+	unreachable := fmt.Sprintf("%d %d ", ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_DEST_UNREACHABLE_CODE_PORT_UNREACHABLE)
+	timeExceeded := fmt.Sprintf("%d %d ", ICMP_TYPE_TIME_EXCEEDED, ICMP_TIME_EXCEEDED_CODE_TTL)
+	// ルータの反対側のアドレスまで
+	if out := trace("192.168.0.1"); out != unreachable+"192.168.0.1\n" {
+		t.Fatalf("unexpected traceroute to router %q", out)
+	}
+	// ルータの先のホストまで
+	if out := trace("192.168.0.2"); out != timeExceeded+"192.168.1.1\n"+unreachable+"192.168.0.2\n" {
+		t.Fatalf("unexpected traceroute to host2 %q", out)
+	}
+}
+
+// 受け取ったsyslogのメッセージを1行ずつ出力する
+func runSyslogServerHelper(port string) int {
+	conn, err := net.ListenPacket("udp4", ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		fmt.Println(string(buf[:n]))
+	}
+}
+
+func TestIntegrationSyslog(t *testing.T) {
+	topo := newBasicLab(t)
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itSyslogEnvServe+"=514")
+	var messages bytes.Buffer
+	server.Stdout = &messages
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-syslog", "udp://192.168.0.2:514",
+		"-syslog-facility", "local3", "-syslog-rate", "2")
+	waitRouterOutput(t, router, "Syslog is sent to udp://192.168.0.2:514 (facility local3)")
+
+	// 起動時のログはレートを超えるので、次の秒のログの前に捨てた数が送られる
+	time.Sleep(1100 * time.Millisecond)
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	time.Sleep(500 * time.Millisecond)
+	server.Process.Kill()
+	server.Wait()
+
+	lines := strings.Split(strings.TrimSpace(messages.String()), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("collector received too few messages\n%s", messages.String())
+	}
+	// local3(19)のinfo(6)
+	if !strings.HasPrefix(lines[0], "<158>1 ") || !strings.Contains(lines[0], " go-curo ") ||
+		!strings.Contains(lines[0], `[meta sequenceId="1"]`) {
+		t.Fatalf("unexpected syslog message %q", lines[0])
+	}
+	// local3(19)のwarning(4)
+	if !strings.Contains(messages.String(), "messages are suppressed by rate limit") ||
+		!strings.Contains(messages.String(), "<156>1 ") {
+		t.Fatalf("rate limit is not reported\n%s", messages.String())
+	}
+}
+
+func TestIntegrationPacketGenerator(t *testing.T) {
+	topo := newBasicLab(t)
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itSyslogEnvServe+"=5000")
+	var received bytes.Buffer
+	server.Stdout = &received
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	topo.startRouter(t, "router1", "-mode", "ch2")
+	// ルータのARPを解決しておく
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+
+	// host1からルータ経由でhost2にUDPを送る、ルータのMACアドレスはARPで解決する
+	cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), routerBinary,
+		"-gen", "udp,dev=host1-router1,dst=192.168.0.2,gw=192.168.1.1,dport=5000,size=64",
+		"-gen-count", "5", "-gen-rate", "50")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("gen err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), "Generated 5 packets") {
+		t.Fatalf("unexpected gen output\n%s", out)
+	}
+	time.Sleep(500 * time.Millisecond)
+	server.Process.Kill()
+	server.Wait()
+	for i := 0; i < 5; i++ {
+		if !strings.Contains(received.String(), fmt.Sprintf("go-curo gen %d\x00", i)) {
+			t.Fatalf("packet %d is not received\n%q", i, received.String())
+		}
+	}
+}
+
+func TestIntegrationTransmitBatching(t *testing.T) {
+	topo := newBasicLab(t)
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50173")
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	before := adminInterfaces(t, "router1", "127.0.0.1:50173")["router1-host2"].Counters.TxPackets
+
+	// 続けて届いたパケットはまとめて送信されるが、全て転送される
+	cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), routerBinary,
+		"-gen", "udp,dev=host1-router1,dst=192.168.0.2,gw=192.168.1.1",
+		"-gen-count", "300", "-gen-rate", "2000")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("gen err : %s %s", err, out)
+	}
+	time.Sleep(500 * time.Millisecond)
+	netif := adminInterfaces(t, "router1", "127.0.0.1:50173")["router1-host2"]
+	if forwarded := netif.Counters.TxPackets - before; forwarded < 300 {
+		t.Fatalf("forwarded %d frames, want 300 %+v", forwarded, netif)
+	}
+	if netif.Counters.TxErrors != 0 {
+		t.Fatalf("unexpected transmit errors %+v", netif)
+	}
+}
+
+// "ifname/address/mac"のARPリプライをブロードキャストで1つ送る
+func runArpReplyHelper(spec string) int {
+	fields := strings.Split(spec, "/")
+	iface, err := net.InterfaceByName(fields[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "interface %s err : %s\n", fields[0], err)
+		return 1
+	}
+	sender, _ := parseIPAddr(fields[1])
+	mac, _ := net.ParseMAC(fields[2])
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	arp := arpIPToEthernet{
+		hardwareType:        ARP_HTYPE_ETHERNET,
+		protocolType:        ETHER_TYPE_IP,
+		hardwareLen:         ETHERNET_ADDRES_LEN,
+		protocolLen:         IP_ADDRESS_LEN,
+		opcode:              ARP_OPERATION_CODE_REPLY,
+		senderHardwareAddr:  setMacAddr(mac),
+		senderIPAddr:        sender,
+		targetHardwareAddrr: ETHERNET_ADDRESS_BROADCAST,
+		targetIPAddr:        sender,
+	}.ToPacket()
+	frame := append(append(macToByte(ETHERNET_ADDRESS_BROADCAST), iface.HardwareAddr...), uint16ToByte(ETHER_TYPE_ARP)...)
+	addr := syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index}
+	if err := syscall.Sendto(sock, append(frame, arp...), 0, &addr); err != nil {
+		fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+/*
+"インターフェイス/送信元MAC/宛先MAC/送信元IP/宛先IP"のUDPパケットを1つ送る
+最後に"/bad"をつけるとIPヘッダのチェックサムを、"/badudp"をつけるとUDPのチェックサムを壊す
+*/
+func runIpSpoofHelper(spec string) int {
+	fields := strings.Split(spec, "/")
+	iface, err := net.InterfaceByName(fields[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "interface %s err : %s\n", fields[0], err)
+		return 1
+	}
+	srcMac, _ := net.ParseMAC(fields[1])
+	destMac, _ := net.ParseMAC(fields[2])
+	srcAddr, _ := parseIPAddr(fields[3])
+	destAddr, _ := parseIPAddr(fields[4])
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	// チェックサムの無いUDPでdiscardのポートに送る
+	udp := append(uint16ToByte(9), uint16ToByte(9)...)
+	udp = append(udp, uint16ToByte(UDP_HEADER_LEN)...)
+	udp = append(udp, 0, 0)
+	packet := ipHeader{
+		version:   4,
+		headerLen: 5,
+		totalLen:  20 + UDP_HEADER_LEN,
+		ttl:       64,
+		protocol:  IP_PROTOCOL_NUM_UDP,
+		srcAddr:   srcAddr,
+		destAddr:  destAddr,
+	}.ToPacket(true)
+	packet = append(packet, udp...)
+	if len(fields) == 6 {
+		switch fields[5] {
+		case "bad":
+			packet[10] ^= 0xff
+		case "badudp":
+			// 0ではない間違ったUDPのチェックサムにする
+			setTransportChecksum(packet, 6)
+			packet[20+6] ^= 0xff
+		}
+	}
+	frame := append(append(append([]byte{}, destMac...), srcMac...), uint16ToByte(ETHER_TYPE_IP)...)
+	frame = append(frame, packet...)
+	addr := syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index}
+	if err := syscall.Sendto(sock, frame, 0, &addr); err != nil {
+		fmt.Fprintf(os.Stderr, "send err : %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// netnsの中のインターフェイスのMACアドレス
+func netnsMacAddr(t *testing.T, ns, ifname string) string {
+	t.Helper()
+	out, err := exec.Command("ip", "-n", netnsName(ns), "-br", "link", "show", "dev", ifname).CombinedOutput()
+	fields := strings.Fields(string(out))
+	if err != nil || len(fields) < 3 {
+		t.Fatalf("get mac address of %s err : %s %s", ifname, err, out)
+	}
+	return fields[2]
+}
+
+/*
+静的なARPエントリは偽のリプライで上書きされず、学習したエントリのMACアドレスが変わると記録される
+リクエストしていないサブネット外のアドレスと、ルータのアドレスを名乗るリプライは受け取らない
+*/
+func TestIntegrationArpSpoofing(t *testing.T) {
+	topo := newBasicLab(t)
+	host2Mac := netnsMacAddr(t, "host2", "host2-router1")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50168",
+		"-static-arp", "router1-host2=192.168.0.2/"+host2Mac)
+	waitRouterOutput(t, router, "Set static arp entry 192.168.0.2")
+
+	// host2へは静的なエントリで送る
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "192.168.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	sendReply := func(ns, ifname, address string) {
+		t.Helper()
+		cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+		cmd.Env = append(os.Environ(), itArpEnvReply+"="+ifname+"/"+address+"/02:00:00:00:00:99")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("send arp reply err : %s %s", err, out)
+		}
+	}
+	sendReply("host1", "host1-router1", "192.168.0.2")
+	waitRouterOutput(t, router, "Ignored unsolicited arp reply for 192.168.0.2 on router1-host1")
+	sendReply("host2", "host2-router1", "192.168.0.2")
+	waitRouterOutput(t, router, "Ignored 2:0:0:0:0:99 for 192.168.0.2 on router1-host2")
+	sendReply("host1", "host1-router1", "192.168.1.1")
+	waitRouterOutput(t, router, "Ignored arp reply claiming our address 192.168.1.1")
+	sendReply("host1", "host1-router1", "192.168.1.2")
+	waitRouterOutput(t, router, "MAC address of 192.168.1.2 changed from")
+
+	curl := func(path string) string {
+		t.Helper()
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+			"curl", "-s", "http://127.0.0.1:50168"+path).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	if out := curl("/stats"); !strings.Contains(out, `"arp_mac_changes":1`) {
+		t.Fatalf("unexpected stats %s", out)
+	}
+	hwaddr, _ := net.ParseMAC(host2Mac)
+	if out := curl("/arp"); !strings.Contains(out, `"ip_address":"192.168.0.2","mac_address":"`+hwaddr.String()+`","device":"router1-host2","static":true`) {
+		t.Fatalf("static arp entry is not found %s", out)
+	}
+	out := curl("/drops")
+	for _, reason := range []string{`{"reason":"arp_unsolicited","count":1}`, `{"reason":"arp_spoofed","count":2}`} {
+		if !strings.Contains(out, reason) {
+			t.Fatalf("%s is not found in %s", reason, out)
+		}
+	}
+}
+
+/*
+IPパケットの送信元からは、サブネットの中で解決を待っているアドレスだけを学習する
+サブネットの外のアドレス、リクエストしていないアドレス、チェックサムの壊れたパケットからは学習しない
+*/
+func TestIntegrationArpLearnFromIP(t *testing.T) {
+	topo := newBasicLab(t)
+	host1Mac := netnsMacAddr(t, "host1", "host1-router1")
+	routerMac := netnsMacAddr(t, "router1", "router1-host1")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50193")
+	result := topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	spoof := func(srcMac, src string, bad bool) {
+		t.Helper()
+		spec := "host1-router1/" + srcMac + "/" + routerMac + "/" + src + "/192.168.1.1"
+		if bad {
+			spec += "/bad"
+		}
+		cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+		cmd.Env = append(os.Environ(), itIpEnvSpoof+"="+spec)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("send spoofed packet err : %s %s", err, out)
+		}
+	}
+	// 応答の無いアドレスに送らせて、ARPの解決を待たせる
+	topo.probe(t, "host2", "192.168.1.79", 64)
+	waitRouterOutput(t, router, "Sending arp request via router1-host1 for c0a8014f")
+
+	spoof(host1Mac, "203.0.113.5", false)
+	spoof(host1Mac, "192.168.1.77", false)
+	spoof("02:00:00:00:00:98", "192.168.1.79", true)
+	spoof(host1Mac, "192.168.1.79", false)
+
+	curl := func(path string) string {
+		t.Helper()
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+			"curl", "-s", "http://127.0.0.1:50193"+path).CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		return string(out)
+	}
+	hwaddr, _ := net.ParseMAC(host1Mac)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out := curl("/arp")
+		if strings.Contains(out, `"ip_address":"192.168.1.79","mac_address":"`+hwaddr.String()+`"`) {
+			if strings.Contains(out, "203.0.113.5") || strings.Contains(out, "192.168.1.77") {
+				t.Fatalf("arp entry is learned from unrequested address %s", out)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending arp entry is not learned from ip packet %s", out)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// MRTのTABLE_DUMP_V2のRIB_IPV4_UNICASTのレコードを作る
+func mrtRibIPv4Record(seq uint32, prefix uint32, prefixLen uint8, nexthop uint32) []byte {
+	body := uint32ToByte(seq)
+	body = append(body, prefixLen)
+	body = append(body, uint32ToByte(prefix)[:(prefixLen+7)/8]...)
+	body = append(body, uint16ToByte(1)...) // エントリの数
+	attrs := []byte{0x40, 1, 1, 0}          // ORIGIN
+	attrs = append(attrs, 0x40, BGP_ATTR_NEXT_HOP, 4)
+	attrs = append(attrs, uint32ToByte(nexthop)...)
+	body = append(body, uint16ToByte(0)...) // ピア番号
+	body = append(body, uint32ToByte(0)...) // 時刻
+	body = append(body, uint16ToByte(uint16(len(attrs)))...)
+	body = append(body, attrs...)
+	header := uint32ToByte(0)
+	header = append(header, uint16ToByte(MRT_TYPE_TABLE_DUMP_V2)...)
+	header = append(header, uint16ToByte(MRT_SUBTYPE_RIB_IPV4_UNICAST)...)
+	header = append(header, uint32ToByte(uint32(len(body)))...)
+	return append(header, body...)
+}
+
+// プレフィックスの一覧とMRTのダンプを読み込んで、2つのradix treeの検索結果が一致する
+func TestIntegrationRouteBenchmark(t *testing.T) {
+	dir := t.TempDir()
+	random := rand.New(rand.NewSource(1))
+	var list bytes.Buffer
+	var mrt bytes.Buffer
+	list.WriteString("# prefix list\n0.0.0.0/0 10.0.0.1\n")
+	for i := 0; i < 20000; i++ {
+		prefixLen := []uint8{8, 16, 20, 24, 24, 28, 32}[random.Intn(7)]
+		prefix := random.Uint32() & prefixMask(uint32(prefixLen))
+		nexthop := uint32(10<<24 | i)
+		fmt.Fprintf(&list, "%s/%d %s\n", printIPAddr(prefix), prefixLen, printIPAddr(nexthop))
+		mrt.Write(mrtRibIPv4Record(uint32(i), prefix, prefixLen, nexthop))
+	}
+	listPath := filepath.Join(dir, "routes.txt")
+	if err := os.WriteFile(listPath, list.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mrtPath := filepath.Join(dir, "rib.gz")
+	f, err := os.Create(mrtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write(mrt.Bytes())
+	gz.Close()
+	f.Close()
+
+	for path, routes := range map[string]int{listPath: 20001, mrtPath: 20000} {
+		out, err := exec.Command(routerBinary, "-bench-routes", path, "-bench-lookups", "100000").CombinedOutput()
+		if err != nil {
+			t.Fatalf("bench %s err : %s\n%s", path, err, out)
+		}
+		if !strings.Contains(string(out), fmt.Sprintf("Loaded %d routes", routes)) ||
+			!strings.Contains(string(out), "Results of 100000 lookups match") {
+			t.Fatalf("unexpected bench output for %s\n%s", path, out)
+		}
+	}
+}
+
+func TestIntegrationRouterAdvertisement(t *testing.T) {
+	topo := newBasicLab(t)
+	router := topo.startRouter(t, "router1", "-mode", "ch2",
+		"-ra", "dev=router1-host1,prefix=2001:db8:1::/64,mtu=1400")
+
+	// 起動直後の広告でhost1がSLAACでアドレスとデフォルト経路を作る
+	var addr string
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		out, _ := exec.Command("ip", "-n", netnsName("host1"), "-6", "addr", "show", "dev", "host1-router1").CombinedOutput()
+		addr = string(out)
+		if strings.Contains(addr, "2001:db8:1:") {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if !strings.Contains(addr, "2001:db8:1:") {
+		t.Fatalf("host1 did not configure slaac address:\n%s\n%s", addr, router.Output())
+	}
+	out, err := exec.Command("ip", "-n", netnsName("host1"), "-6", "route", "show", "default").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "via fe80::") {
+		t.Fatalf("host1 has no default route from ra: %s\n%s", err, out)
+	}
+	out, err = exec.Command("ip", "netns", "exec", netnsName("host1"),
+		"cat", "/proc/sys/net/ipv6/conf/host1-router1/mtu").CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "1400" {
+		t.Fatalf("unexpected ipv6 mtu %q: %v", out, err)
+	}
+	// host2側には広告しない
+	out, _ = exec.Command("ip", "-n", netnsName("host2"), "-6", "addr", "show", "dev", "host2-router1").CombinedOutput()
+	if strings.Contains(string(out), "2001:db8:") {
+		t.Fatalf("host2 configured address from ra on disabled interface:\n%s", out)
+	}
+
+	// リンクを上げ直すとhost1がRouter Solicitationを送る
+	runIP(t, "-n", netnsName("host1"), "link", "set", "host1-router1", "down")
+	runIP(t, "-n", netnsName("host1"), "link", "set", "host1-router1", "up")
+	waitRouterOutput(t, router, "Router solicitation is received")
+}
+
+/*
+ifnameで受け取ったDHCPv6のメッセージに2001:db8:100::/56を委譲する応答を返すDHCPv6サーバ
+カーネルのUDPのsocketはvethでチェックサムを計算しないまま送るので、AF_PACKETでフレームを組み立てて送る
+受け取ったメッセージの種類を出力する
+*/
+func runDhcpv6ServerHelper(ifname string) int {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "interface %s err : %s\n", ifname, err)
+		return 1
+	}
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ETHER_TYPE_IPV6)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	addr := syscall.SockaddrLinklayer{Protocol: htons(ETHER_TYPE_IPV6), Ifindex: iface.Index}
+	if err := syscall.Bind(sock, &addr); err != nil {
+		fmt.Fprintf(os.Stderr, "bind err : %s\n", err)
+		return 1
+	}
+	var mac [6]uint8
+	copy(mac[:], iface.HardwareAddr)
+	serverAddr := ipv6LinkLocalAddr(mac).As16()
+	names := map[uint8]string{DHCPV6_MSG_SOLICIT: "SOLICIT", DHCPV6_MSG_REQUEST: "REQUEST",
+		DHCPV6_MSG_RENEW: "RENEW", DHCPV6_MSG_REBIND: "REBIND", DHCPV6_MSG_RELEASE: "RELEASE"}
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); (ok && ll.Pkttype == syscall.PACKET_OUTGOING) || n < 14+IPV6_HEADER_LEN+UDP_HEADER_LEN+4 {
+			continue
+		}
+		packet := buf[14:n]
+		udp := packet[IPV6_HEADER_LEN:]
+		if packet[6] != IP_PROTOCOL_NUM_UDP || byteToUint16(udp[2:4]) != DHCPV6_SERVER_PORT {
+			continue
+		}
+		msg := udp[UDP_HEADER_LEN:]
+		options, ok := dhcpv6ReadOptions(msg[4:])
+		if !ok {
+			continue
+		}
+		fmt.Println(names[msg[0]])
+		reply := []byte{DHCPV6_MSG_REPLY}
+		if msg[0] == DHCPV6_MSG_SOLICIT {
+			reply[0] = DHCPV6_MSG_ADVERTISE
+		}
+		reply = append(reply, msg[1:4]...)
+		reply = append(reply, dhcpv6Option(DHCPV6_OPTION_CLIENTID, options[DHCPV6_OPTION_CLIENTID])...)
+		reply = append(reply, dhcpv6Option(DHCPV6_OPTION_SERVERID, []byte("curo-test-server"))...)
+		if msg[0] != DHCPV6_MSG_RELEASE {
+			// T1 30秒、T2 48秒、推奨の有効期間60秒、有効期間120秒
+			iapd := append(uint32ToByte(DHCPV6_IAID), uint32ToByte(30)...)
+			iapd = append(iapd, uint32ToByte(48)...)
+			iaprefix := append(uint32ToByte(60), uint32ToByte(120)...)
+			iaprefix = append(iaprefix, 56)
+			iaprefix = append(iaprefix, netip.MustParseAddr("2001:db8:100::").AsSlice()...)
+			iapd = append(iapd, dhcpv6Option(DHCPV6_OPTION_IAPREFIX, iaprefix)...)
+			reply = append(reply, dhcpv6Option(DHCPV6_OPTION_IA_PD, iapd)...)
+		}
+
+		var clientAddr [16]uint8
+		copy(clientAddr[:], packet[8:24])
+		datagram := append(uint16ToByte(DHCPV6_SERVER_PORT), uint16ToByte(DHCPV6_CLIENT_PORT)...)
+		datagram = append(datagram, uint16ToByte(uint16(UDP_HEADER_LEN+len(reply)))...)
+		datagram = append(datagram, 0x00, 0x00)
+		datagram = append(datagram, reply...)
+		checksum := calcChecksum(ipv6PseudoPacket(serverAddr, clientAddr, IP_PROTOCOL_NUM_UDP, datagram))
+		datagram[6], datagram[7] = checksum[0], checksum[1]
+		frame := append(append(append([]byte{}, buf[6:12]...), mac[:]...), uint16ToByte(ETHER_TYPE_IPV6)...)
+		frame = append(frame, ipv6Packet(serverAddr, clientAddr, IP_PROTOCOL_NUM_UDP, 64, datagram)...)
+		syscall.Sendto(sock, frame, 0, &addr)
+	}
+}
+
+/*
+WAN側でDHCPv6のプレフィックス委譲を受け、LAN側に/64を割り当ててルータ広告で配る
+
+	host1 (SLAAC) ── router1 ── isp (DHCPv6サーバ、2001:db8:100::/56を委譲する)
+*/
+func TestIntegrationDhcpv6PrefixDelegation(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "isp"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "isp", dev1: "isp-router1", ns2: "router1", dev2: "router1-isp"},
+	})
+	server := &routerProcess{}
+	server.cmd = exec.Command("ip", "netns", "exec", netnsName("isp"), os.Args[0])
+	server.cmd.Env = append(os.Environ(), itDhcpv6EnvServe+"=isp-router1")
+	server.cmd.Stdout = server
+	if err := server.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.cmd.Process.Kill()
+		server.cmd.Wait()
+	}()
+
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", "127.0.0.1:50187",
+		"-dhcpv6-pd", "router1-isp", "-dhcpv6-pd-lan", "router1-host1", "-dhcpv6-pd-hint", "56")
+	waitRouterOutput(t, router, "DHCPv6 prefix 2001:db8:100::/56 is delegated on router1-isp")
+	waitRouterOutput(t, router, "DHCPv6 prefix 2001:db8:100::/64 is assigned to router1-host1")
+	waitRouterOutput(t, server, "REQUEST")
+	if !strings.HasPrefix(server.Output(), "SOLICIT\n") {
+		t.Fatalf("unexpected dhcpv6 exchange:\n%s", server.Output())
+	}
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50187/dhcpv6-pd").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var status dhcpv6PdJSON
+	if err := json.Unmarshal(out, &status); err != nil {
+		t.Fatalf("parse dhcpv6-pd status %s err : %s", out, err)
+	}
+	if status.State != "bound" || status.Prefix != "2001:db8:100::/56" || len(status.Assigned) != 1 ||
+		status.Assigned[0].Device != "router1-host1" || status.Assigned[0].Prefix != "2001:db8:100::/64" {
+		t.Fatalf("unexpected dhcpv6-pd status %s", out)
+	}
+
+	// LAN側のhost1が割り当てた/64でSLAACのアドレスを作る
+	var addr string
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		out, _ := exec.Command("ip", "-n", netnsName("host1"), "-6", "addr", "show", "dev", "host1-router1").CombinedOutput()
+		addr = string(out)
+		if strings.Contains(addr, "2001:db8:100:0:") {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if !strings.Contains(addr, "2001:db8:100:0:") {
+		t.Fatalf("host1 did not configure address from delegated prefix:\n%s\n%s", addr, router.Output())
+	}
+
+	// 停止する時にプレフィックスを返す
+	router.cmd.Process.Signal(syscall.SIGTERM)
+	waitRouterOutput(t, router, "DHCPv6 prefix 2001:db8:100::/56 on router1-isp is withdrawn")
+	waitRouterOutput(t, server, "RELEASE")
+}
+
+// -state-fileで状態を書き出す時は、委譲されたプレフィックスを返さずに次の起動で使い続ける
+func TestIntegrationDhcpv6WarmRestart(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "isp"}, []labLink{
+		{ns1: "host1", dev1: "host1-router1", addr1: "192.168.1.2/24",
+			ns2: "router1", dev2: "router1-host1", addr2: "192.168.1.1/24"},
+		{ns1: "isp", dev1: "isp-router1", ns2: "router1", dev2: "router1-isp"},
+	})
+	path := filepath.Join(t.TempDir(), "state.json")
+	server := &routerProcess{}
+	server.cmd = exec.Command("ip", "netns", "exec", netnsName("isp"), os.Args[0])
+	server.cmd.Env = append(os.Environ(), itDhcpv6EnvServe+"=isp-router1")
+	server.cmd.Stdout = server
+	if err := server.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.cmd.Process.Kill()
+		server.cmd.Wait()
+	}()
+
+	args := []string{"-mode", "ch2", "-admin-addr", "127.0.0.1:50194", "-state-file", path,
+		"-dhcpv6-pd", "router1-isp", "-dhcpv6-pd-lan", "router1-host1", "-dhcpv6-pd-hint", "56"}
+	router := topo.startRouter(t, "router1", args...)
+	waitRouterOutput(t, router, "DHCPv6 prefix 2001:db8:100::/56 is delegated on router1-isp")
+	router.stop(t)
+	waitRouterOutput(t, router, "Saved state to "+path)
+	if strings.Contains(server.Output(), "RELEASE") {
+		t.Fatalf("prefix was released although state is saved:\n%s", server.Output())
+	}
+
+	// サーバを止めても、書き出したリースで同じプレフィックスを配り続ける
+	server.cmd.Process.Kill()
+	router = topo.startRouter(t, "router1", args...)
+	waitRouterOutput(t, router, "Restored DHCPv6 prefix 2001:db8:100::/56 on router1-isp")
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://127.0.0.1:50194/dhcpv6-pd").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var status dhcpv6PdJSON
+	if err := json.Unmarshal(out, &status); err != nil {
+		t.Fatalf("parse dhcpv6-pd status %s err : %s", out, err)
+	}
+	if status.State != "bound" || status.Prefix != "2001:db8:100::/56" || len(status.Assigned) != 1 ||
+		status.Assigned[0].Prefix != "2001:db8:100::/64" {
+		t.Fatalf("unexpected dhcpv6-pd status %s", out)
+	}
+}
+
+/*
+IPv6でpingかUDP、DNSの問い合わせを送り、応答を出力する
+
+	"ping,宛先"             Echo Replyの送信元を出力する
+	"udp,宛先,ポート"       応答の内容を出力する
+	"dns,宛先%zone,名前"    AAAAの問い合わせの答えのアドレスを出力する
+
+カーネルのUDPのsocketはvethでチェックサムを計算しないまま送るので、UDPはIPV6_CHECKSUMでチェックサムを計算させるraw socketで送り、
+同じポートをbindしたUDPのsocketで受ける
+ルータがARPを解決する間やDADが終わるまでは届かないので応答が来るまで送り直す
+*/
+func runV6SendHelper(spec string) int {
+	fields := strings.Split(spec, ",")
+	if len(fields) < 2 {
+		fmt.Fprintf(os.Stderr, "invalid spec %s\n", spec)
+		return 1
+	}
+	dest, err := netip.ParseAddr(fields[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse addr err : %s\n", err)
+		return 1
+	}
+	sa := &syscall.SockaddrInet6{Addr: dest.As16()}
+	if zone := dest.Zone(); zone != "" {
+		iface, err := net.InterfaceByName(zone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "interface %s err : %s\n", zone, err)
+			return 1
+		}
+		sa.ZoneId = uint32(iface.Index)
+	}
+
+	if fields[0] == "ping" {
+		sock, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+			return 1
+		}
+		defer syscall.Close(sock)
+		syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Usec: 300000})
+		buf := make([]byte, 1500)
+		for i := 0; i < 20; i++ {
+			// チェックサムはカーネルが計算する
+			request := []byte{ICMPV6_TYPE_ECHO_REQUEST, 0, 0, 0, 0x12, 0x34, 0x00, uint8(i), 'c', 'u', 'r', 'o'}
+			syscall.Sendto(sock, request, 0, sa)
+			deadline := time.Now().Add(300 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				n, from, err := syscall.Recvfrom(sock, buf, 0)
+				if err != nil {
+					break
+				}
+				if n >= 8 && buf[0] == ICMPV6_TYPE_ECHO_REPLY && byteToUint16(buf[4:6]) == 0x1234 {
+					fmt.Println(netip.AddrFrom16(from.(*syscall.SockaddrInet6).Addr))
+					return 0
+				}
+			}
+		}
+		fmt.Fprintln(os.Stderr, "no reply")
+		return 1
+	}
+
+	var port int
+	var payload []byte
+	switch fields[0] {
+	case "udp":
+		if len(fields) != 3 {
+			fmt.Fprintf(os.Stderr, "invalid spec %s\n", spec)
+			return 1
+		}
+		port, _ = strconv.Atoi(fields[2])
+		payload = []byte("ping")
+	case "dns":
+		if len(fields) != 3 {
+			fmt.Fprintf(os.Stderr, "invalid spec %s\n", spec)
+			return 1
+		}
+		port = int(DNS_PORT)
+		payload = []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		for _, label := range strings.Split(fields[2], ".") {
+			payload = append(payload, uint8(len(label)))
+			payload = append(payload, label...)
+		}
+		payload = append(payload, 0x00)
+		payload = append(payload, uint16ToByte(DNS_TYPE_AAAA)...)
+		payload = append(payload, uint16ToByte(DNS_CLASS_IN)...)
+	default:
+		fmt.Fprintf(os.Stderr, "invalid spec %s\n", spec)
+		return 1
+	}
+	conn, err := net.ListenPacket("udp6", ":0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	srcPort := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	sock, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_UDP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create socket err : %s\n", err)
+		return 1
+	}
+	defer syscall.Close(sock)
+	if err := syscall.SetsockoptInt(sock, syscall.IPPROTO_IPV6, syscall.IPV6_CHECKSUM, 6); err != nil {
+		fmt.Fprintf(os.Stderr, "setsockopt err : %s\n", err)
+		return 1
+	}
+	datagram := uint16ToByte(srcPort)
+	datagram = append(datagram, uint16ToByte(uint16(port))...)
+	datagram = append(datagram, uint16ToByte(uint16(UDP_HEADER_LEN+len(payload)))...)
+	datagram = append(datagram, 0x00, 0x00)
+	datagram = append(datagram, payload...)
+	buf := make([]byte, 1500)
+	for i := 0; i < 20; i++ {
+		syscall.Sendto(sock, datagram, 0, sa)
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		if fields[0] == "udp" {
+			fmt.Println(string(buf[:n]))
+			return 0
+		}
+		records, err := dnsReadAnswers(buf[:n])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid dns response : %s\n", err)
+			return 1
+		}
+		for _, record := range records {
+			if record.rtype == DNS_TYPE_AAAA && len(record.data) == 16 {
+				fmt.Println(netip.AddrFrom16([16]uint8(record.data)))
+			}
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "no reply")
+	return 1
+}
+
+// nsからIPv6で送り、ヘルパーの出力を返す
+func v6Send(t *testing.T, ns, spec string) string {
+	t.Helper()
+	cmd := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+	cmd.Env = append(os.Environ(), itV6EnvSend+"="+spec)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("ipv6 send %s from %s err : %s", spec, ns, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+/*
+IPv6だけのhost1からNAT64でIPv4のhost2に届き、DNS64で名前からIPv4アドレスを埋め込んだアドレスがわかる
+host1はルータ広告でアドレスとデフォルト経路を作る
+
+	host1 (2001:db8:1::/64) ── router1 (NAT64, 192.168.0.1) ── host2 (192.168.0.2, DNSサーバ)
+*/
+func TestIntegrationNat64(t *testing.T) {
+	topo := newBasicLab(t)
+	echo := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	echo.Env = append(os.Environ(), itUdpEnvEcho+"=7000")
+	if err := echo.Start(); err != nil {
+		t.Fatalf("start echo server err : %s", err)
+	}
+	t.Cleanup(func() { echo.Process.Kill(); echo.Wait() })
+	server := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	server.Env = append(os.Environ(), itDnsEnvServe+"=192.168.0.2")
+	if err := server.Start(); err != nil {
+		t.Fatalf("start dns server err : %s", err)
+	}
+	t.Cleanup(func() { server.Process.Kill(); server.Wait() })
+
+	router := topo.startRouter(t, "router1", "-mode", "ch2",
+		"-ra", "dev=router1-host1,prefix=2001:db8:1::/64", "-nat64", "router1-host1",
+		"-dns-upstream", "192.168.0.2", "-dns64")
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		out, _ := exec.Command("ip", "-n", netnsName("host1"), "-6", "route", "show", "default").CombinedOutput()
+		if strings.Contains(string(out), "via fe80::") {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	if from := v6Send(t, "host1", "ping,64:ff9b::c0a8:2"); from != "64:ff9b::c0a8:2" {
+		t.Fatalf("unexpected echo reply from %q\n%s", from, router.Output())
+	}
+	// host2からはルータのIPv4アドレスから届いたように見える
+	if seen := v6Send(t, "host1", "udp,64:ff9b::c0a8:2,7000"); !strings.HasPrefix(seen, "192.168.0.1:") {
+		t.Fatalf("echo server saw %q\n%s", seen, router.Output())
+	}
+	waitRouterOutput(t, router, "Created NAT64 session")
+
+	// host2のDNSサーバはAレコードしか答えないので、ルータがAAAAレコードを合成する
+	out, err := exec.Command("ip", "-n", netnsName("router1"), "-o", "link", "show", "router1-host1").CombinedOutput()
+	if err != nil {
+		t.Fatalf("show link err : %s: %s", err, out)
+	}
+	fields := strings.Fields(string(out))
+	var mac [6]uint8
+	for i, field := range fields {
+		if field == "link/ether" && i+1 < len(fields) {
+			hw, _ := net.ParseMAC(fields[i+1])
+			copy(mac[:], hw)
+		}
+	}
+	server6 := ipv6LinkLocalAddr(mac).WithZone("host1-router1")
+	if addr := v6Send(t, "host1", "dns,"+server6.String()+",server.test"); addr != "64:ff9b::c0a8:2" {
+		t.Fatalf("unexpected dns64 answer %q\n%s", addr, router.Output())
+	}
+}
+
+/*
+vethは受信のチェックサムオフロードが有効なので、autoではカーネルのUDPのsocketが送る計算途中のチェックサムを検証せずに受け取り、
+フォワードする時に計算し直す、verifyにしたインターフェイスでは検証して破棄する
+*/
+func TestIntegrationChecksumOffload(t *testing.T) {
+	topo := newBasicLab(t)
+	echo := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	echo.Env = append(os.Environ(), itUdpEnvEcho+"=7000")
+	if err := echo.Start(); err != nil {
+		t.Fatalf("start echo server err : %s", err)
+	}
+	t.Cleanup(func() { echo.Process.Kill(); echo.Wait() })
+	addr := "127.0.0.1:50188"
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", addr,
+		"-checksum-policy", "router1-host2=verify", "-dns-host", "router.lan=192.168.1.1")
+
+	interfaces := adminInterfaces(t, "router1", addr)
+	if netif := interfaces["router1-host1"]; netif.ChecksumPolicy != "auto" || !netif.RxChecksumOffload {
+		t.Fatalf("unexpected interface %+v", netif)
+	}
+	if netif := interfaces["router1-host2"]; netif.ChecksumPolicy != "verify" {
+		t.Fatalf("unexpected interface %+v", netif)
+	}
+
+	// 計算途中のチェックサムのままフォワードするとhost2のカーネルが破棄するので応答が来ない
+	if _, seen := topo.udpSend(t, "host1", "192.168.0.2:7000"); !strings.HasPrefix(seen, "192.168.1.2:") {
+		t.Fatalf("echo server saw %q\n%s", seen, router.Output())
+	}
+
+	drops := func() map[string]uint64 {
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+			"curl", "-s", "http://"+addr+"/drops").CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		var list []struct {
+			Reason string `json:"reason"`
+			Count  uint64 `json:"count"`
+		}
+		if err := json.Unmarshal(out, &list); err != nil {
+			t.Fatalf("parse drops %s err : %s", out, err)
+		}
+		result := map[string]uint64{}
+		for _, drop := range list {
+			result[drop.Reason] = drop.Count
+		}
+		return result
+	}
+	// DNSのメッセージではないデータグラムをルータの53番ポートに送り、どこで破棄されたかを見る
+	send := func(ns, dest, reason string) {
+		t.Helper()
+		before := drops()[reason]
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			exec.Command("ip", "netns", "exec", netnsName(ns), "bash", "-c", "echo x > /dev/udp/"+dest+"/53").Run()
+			time.Sleep(200 * time.Millisecond)
+			if drops()[reason] > before {
+				return
+			}
+		}
+		t.Fatalf("datagram from %s was not dropped by %s: %v", ns, reason, drops())
+	}
+	// autoのhost1側ではチェックサムを検証せずにDNSフォワーダまで届く
+	send("host1", "192.168.1.1", "dns_invalid")
+	// verifyのhost2側ではチェックサムが合わずに破棄する
+	send("host2", "192.168.0.1", "udp_invalid")
+}
+
+/*
+計算途中ではないチェックサムは、skipのインターフェイスで受けても計算し直さずにそのままフォワードする
+壊れたチェックサムのUDPは宛先のhost2のカーネルが破棄してInCsumErrorsを数える
+*/
+func TestIntegrationChecksumSkip(t *testing.T) {
+	topo := newBasicLab(t)
+	host1Mac := netnsMacAddr(t, "host1", "host1-router1")
+	routerMac := netnsMacAddr(t, "router1", "router1-host1")
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-checksum-policy", "router1-host1=skip")
+	result := topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// host2のカーネルが数えたUDPのチェックサムのエラー
+	csumErrors := func() int {
+		out, err := exec.Command("ip", "netns", "exec", netnsName("host2"), "cat", "/proc/net/snmp").CombinedOutput()
+		if err != nil {
+			t.Fatalf("read snmp err : %s %s", err, out)
+		}
+		var names []string
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] != "Udp:" {
+				continue
+			}
+			if names == nil {
+				names = fields
+				continue
+			}
+			for i, name := range names {
+				if name == "InCsumErrors" && i < len(fields) {
+					n, _ := strconv.Atoi(fields[i])
+					return n
+				}
+			}
+		}
+		t.Fatalf("InCsumErrors is not found:\n%s", out)
+		return 0
+	}
+	before := csumErrors()
+	spec := "host1-router1/" + host1Mac + "/" + routerMac + "/192.168.1.2/192.168.0.2/badudp"
+	cmd := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	cmd.Env = append(os.Environ(), itIpEnvSpoof+"="+spec)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("send packet err : %s %s", err, out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if csumErrors() > before {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("broken checksum was rewritten by router\n%s", router.Output())
+}
+
+func TestIntegrationPortSecurity(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "bridge1", "host2"}, []labLink{
+		{ns1: "host1", dev1: "host1-bridge1", addr1: "10.0.0.1/24",
+			ns2: "bridge1", dev2: "bridge1-host1"},
+		{ns1: "host2", dev1: "host2-bridge1", addr1: "10.0.0.2/24",
+			ns2: "bridge1", dev2: "bridge1-host2"},
+	})
+	// host2がIPv6の近隣探索やMLDを送るとFDBのエントリが更新され続けるので止める
+	topo.exec(t, "host2", "sysctl", "-q", "-w", "net.ipv6.conf.all.disable_ipv6=1", "net.ipv6.conf.default.disable_ipv6=1")
+	addr := "127.0.0.1:50189"
+	router := topo.startRouter(t, "bridge1", "-mode", "ch2", "-bridge", "br0=bridge1-host1,bridge1-host2",
+		"-bridge-aging", "2s", "-port-security", "dev=bridge1-host1,max=1,sticky=true,violation=restrict",
+		"-admin-addr", addr)
+
+	type bridgeStatus struct {
+		Ports []struct {
+			Name         string `json:"name"`
+			PortSecurity *struct {
+				MaxMacs    int    `json:"max_macs"`
+				Violations uint64 `json:"violations"`
+				Learned    int    `json:"learned"`
+			} `json:"port_security"`
+		} `json:"ports"`
+		FDB []struct {
+			MacAddress string `json:"mac_address"`
+			Port       string `json:"port"`
+			Sticky     bool   `json:"sticky"`
+		} `json:"fdb"`
+		AgingTime int `json:"aging_time"`
+	}
+	bridges := func() bridgeStatus {
+		out, err := exec.Command("ip", "netns", "exec", netnsName("bridge1"),
+			"curl", "-s", "http://"+addr+"/bridges").CombinedOutput()
+		if err != nil {
+			t.Fatalf("curl err : %s %s", err, out)
+		}
+		var list []bridgeStatus
+		if err := json.Unmarshal(out, &list); err != nil || len(list) != 1 {
+			t.Fatalf("parse bridges %s err : %v", out, err)
+		}
+		return list[0]
+	}
+
+	// 1つ目のMACアドレスはstickyで学習して通信できる
+	result := topo.probeRetry(t, "host1", "10.0.0.2", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY || result.from != "10.0.0.2" {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+	status := bridges()
+	if status.AgingTime != 2 {
+		t.Fatalf("unexpected aging time %+v", status)
+	}
+	var stickyMac string
+	for _, entry := range status.FDB {
+		if entry.Port == "bridge1-host1" && entry.Sticky {
+			stickyMac = entry.MacAddress
+		}
+	}
+	if stickyMac == "" {
+		t.Fatalf("sticky mac is not learned %+v", status)
+	}
+
+	// 2つ目のMACアドレスは上限を超えるので捨ててログに出す
+	topo.exec(t, "host1", "ip", "link", "set", "dev", "host1-bridge1", "address", "02:00:00:00:01:99")
+	if result, err := topo.probe(t, "host1", "10.0.0.2", 64); err == nil {
+		t.Fatalf("frame from second mac is forwarded %+v", result)
+	}
+	waitRouterOutput(t, router, "Port security violation by 2:0:0:0:1:99 on bridge1-host1")
+
+	// stickyでないhost2のMACアドレスはエージングで消え、stickyのものは残る
+	// host2がARPなどを送ると学習し直されるので、消えるまで待つ
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		status = bridges()
+		if len(status.FDB) == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	for _, port := range status.Ports {
+		if port.Name != "bridge1-host1" {
+			continue
+		}
+		if port.PortSecurity == nil || port.PortSecurity.MaxMacs != 1 || port.PortSecurity.Violations == 0 || port.PortSecurity.Learned != 1 {
+			t.Fatalf("unexpected port %+v", status)
+		}
+	}
+	if len(status.FDB) != 1 || status.FDB[0].MacAddress != stickyMac {
+		t.Fatalf("unexpected fdb %+v", status)
+	}
+}
+
+func TestIntegrationImpairment(t *testing.T) {
+	topo := newBasicLab(t)
+	addr := "127.0.0.1:50190"
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", addr,
+		"-impair", "dev=router1-host1,delay=300ms", "-impair", "dev=router1-host2,loss=50")
+
+	// ARPを解決しておく
+	result := topo.probeRetry(t, "host1", "192.168.1.1", 64)
+	if result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v", result)
+	}
+
+	// router1-host1から送るEcho Replyは遅れて届く
+	start := time.Now()
+	if result, err := topo.probe(t, "host1", "192.168.1.1", 64); err != nil || result.icmpType != ICMP_TYPE_ECHO_REPLY {
+		t.Fatalf("unexpected reply %+v %v", result, err)
+	}
+	if rtt := time.Since(start); rtt < 300*time.Millisecond {
+		t.Fatalf("reply is not delayed, rtt %s", rtt)
+	}
+
+	// router1-host2から送るフレームは一部が捨てられる、ARPのやりとりも捨てられるので応答が来るまで送る
+	for i := 0; ; i++ {
+		if _, err := topo.probe(t, "host2", "192.168.0.1", 64); err == nil {
+			break
+		} else if i == 20 {
+			t.Fatal(err)
+		}
+	}
+	topo.blast(t, "host1", "192.168.0.2")
+	interfaces := adminInterfaces(t, "router1", addr)
+	if imp := interfaces["router1-host1"].Impairment; imp == nil || imp.DelayMs != 300 {
+		t.Fatalf("unexpected interface %+v", interfaces["router1-host1"])
+	}
+	if lost := interfaces["router1-host2"].Counters.ImpairLost; lost == 0 || lost >= itBlastCount {
+		t.Fatalf("unexpected lost frames %d", lost)
+	}
+}
+
+/*
+sFlowのデータグラムを受け取り、フローサンプルごとに1行出力する
+"エージェント 受信のifIndex 送信のifIndex サンプリングレート 送信元 宛先 パケット長 ヘッダ長"
+*/
+func runSflowCollectorHelper(port string) int {
+	conn, err := net.ListenPacket("udp4", ":"+port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen err : %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "recv err : %s\n", err)
+			return 1
+		}
+		data := buf[:n]
+		if n < 28 || binary.BigEndian.Uint32(data[0:4]) != 5 {
+			fmt.Println("invalid datagram")
+			continue
+		}
+		agent := net.IP(data[8:12])
+		count := int(binary.BigEndian.Uint32(data[24:28]))
+		data = data[28:]
+		for i := 0; i < count && len(data) >= 8; i++ {
+			format, length := binary.BigEndian.Uint32(data[0:4]), int(binary.BigEndian.Uint32(data[4:8]))
+			sample := data[8 : 8+length]
+			data = data[8+length:]
+			if format != 1 || len(sample) < 76 {
+				continue
+			}
+			rate := binary.BigEndian.Uint32(sample[8:12])
+			input, output := binary.BigEndian.Uint32(sample[20:24]), binary.BigEndian.Uint32(sample[24:28])
+			// 最初のレコードがraw packet headerのIPv4ヘッダ
+			record := sample[40:]
+			frameLen, headerLen := binary.BigEndian.Uint32(record[4:8]), binary.BigEndian.Uint32(record[12:16])
+			header := record[16:]
+			fmt.Printf("%s %d %d %d %s %s %d %d\n", agent, input, output, rate,
+				net.IP(header[12:16]), net.IP(header[16:20]), frameLen, headerLen)
+		}
+	}
+}
+
+func TestIntegrationSflow(t *testing.T) {
+	topo := newBasicLab(t)
+	collector := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	collector.Env = append(os.Environ(), itSflowEnvServe+"=6343")
+	var samples bytes.Buffer
+	collector.Stdout = &samples
+	if err := collector.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		collector.Process.Kill()
+		collector.Wait()
+	}()
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-sflow", "collector=192.168.0.2:6343,rate=1,header=64")
+	waitRouterOutput(t, router, "Exporting sFlow to 192.168.0.2:6343, sampling 1 in 1")
+
+	ifindex := func(dev string) string {
+		out, err := exec.Command("ip", "netns", "exec", netnsName("router1"), "cat", "/sys/class/net/"+dev+"/ifindex").CombinedOutput()
+		if err != nil {
+			t.Fatalf("read ifindex of %s err : %s %s", dev, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	// 全てのパケットをサンプリングして、先頭の64バイトをifIndexと一緒に送る
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	topo.blast(t, "host1", "192.168.0.2")
+	time.Sleep(1500 * time.Millisecond)
+	collector.Process.Kill()
+	collector.Wait()
+
+	want := fmt.Sprintf("192.168.0.1 %s %s 1 192.168.1.2 192.168.0.2 %d 64", ifindex("router1-host1"), ifindex("router1-host2"), itBlastSize+28)
+	if count := strings.Count(samples.String(), want); count < itBlastCount {
+		t.Fatalf("collector received %d samples of %q\n%s", count, want, samples.String())
+	}
+}
+
+/*
+host2側を上流、host1側を下流にしてIGMPプロキシを動かす
+host1が参加したグループにルータが上流で参加し、host2からのマルチキャストをhost1に送る
+*/
+func TestIntegrationIgmpProxy(t *testing.T) {
+	topo := newBasicLab(t)
+	// IGMPv3ではなくv2でレポートを送らせる
+	topo.exec(t, "host1", "sysctl", "-q", "-w", "net.ipv4.conf.all.force_igmp_version=2")
+	addr := "127.0.0.1:50191"
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", addr,
+		"-igmp-proxy", "upstream=router1-host2,downstream=router1-host1")
+	waitRouterOutput(t, router, "IGMP proxy is started, upstream router1-host2, downstream router1-host1")
+
+	receiver := exec.Command("ip", "netns", "exec", netnsName("host1"), os.Args[0])
+	receiver.Env = append(os.Environ(), itMcastEnvJoin+"=239.1.1.2")
+	var received bytes.Buffer
+	receiver.Stdout = &received
+	if err := receiver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Process.Kill()
+	waitRouterOutput(t, router, "Joined multicast group 239.1.1.2 upstream by igmp proxy")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://"+addr+"/multicast").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	if !strings.Contains(string(out), `{"group":"239.1.1.2","device":"router1-host2","local":false,"proxy":true}`) {
+		t.Fatalf("upstream group is not listed %s", out)
+	}
+
+	sender := exec.Command("ip", "netns", "exec", netnsName("host2"), os.Args[0])
+	sender.Env = append(os.Environ(), itMcastEnvSend+"=239.1.1.2")
+	if out, err := sender.CombinedOutput(); err != nil {
+		t.Fatalf("send multicast err : %s %s", err, out)
+	}
+	if err := receiver.Wait(); err != nil {
+		t.Fatalf("multicast was not forwarded : %s\n%s", err, router.Output())
+	}
+	if !strings.Contains(received.String(), "go-curo multicast") {
+		t.Fatalf("unexpected data %q", received.String())
+	}
+}
+
+/*
+フローの表を2つにしてhost1からhost2にUDPを送り、レートが最も高いフローとして表示されることを確かめる
+pingのフローより後に来たので、表が溢れても消されずに残る
+*/
+func TestIntegrationTopTalkers(t *testing.T) {
+	topo := newBasicLab(t)
+	addr := "127.0.0.1:50192"
+	topo.startRouter(t, "router1", "-mode", "ch2", "-admin-addr", addr, "-flow-table-size", "2")
+	topo.probeRetry(t, "host1", "192.168.0.2", 64)
+	topo.blast(t, "host1", "192.168.0.2")
+
+	out, err := exec.Command("ip", "netns", "exec", netnsName("router1"),
+		"curl", "-s", "http://"+addr+"/top-talkers?limit=0").CombinedOutput()
+	if err != nil {
+		t.Fatalf("curl err : %s %s", err, out)
+	}
+	var talkers []struct {
+		Protocol string `json:"protocol"`
+		Src      string `json:"src"`
+		Dst      string `json:"dst"`
+		DstPort  uint16 `json:"dst_port"`
+		Packets  uint64 `json:"packets"`
+		Bytes    uint64 `json:"bytes"`
+		Bps      uint64 `json:"bps"`
+	}
+	if err := json.Unmarshal(out, &talkers); err != nil {
+		t.Fatalf("parse top talkers %s err : %s", out, err)
+	}
+	if len(talkers) == 0 || len(talkers) > 2 {
+		t.Fatalf("flow table must have 1 or 2 flows %s", out)
+	}
+	top := talkers[0]
+	if top.Protocol != "udp" || top.Src != "192.168.1.2" || top.Dst != "192.168.0.2" || top.DstPort != 5001 {
+		t.Fatalf("unexpected top talker %s", out)
+	}
+	if top.Packets < itBlastCount || top.Bytes < itBlastCount*(itBlastSize+28) || top.Bps == 0 {
+		t.Fatalf("top talker counters are too small %s", out)
+	}
+}
+
+/*
+既定のインスタンスと追加したインスタンスに同じ名前のインターフェイスがあっても、
+既定のインスタンスのNATの設定は追加したインスタンスのパケットに効かない
+*/
+func TestIntegrationInstanceSameInterfaceNames(t *testing.T) {
+	topo := newLabTopology(t, []string{"host1", "router1", "host2", "host3", "r2", "host4"}, []labLink{
+		{ns1: "host1", dev1: "host1-lan0", addr1: "192.168.1.2/24", ns2: "router1", dev2: "lan0", addr2: "192.168.1.1/24"},
+		{ns1: "router1", dev1: "wan0", addr1: "192.168.0.1/24", ns2: "host2", dev2: "host2-wan0", addr2: "192.168.0.2/24"},
+		{ns1: "host3", dev1: "host3-lan0", addr1: "10.1.0.2/24", ns2: "r2", dev2: "lan0", addr2: "10.1.0.1/24"},
+		{ns1: "r2", dev1: "wan0", addr1: "10.2.0.1/24", ns2: "host4", dev2: "host4-wan0", addr2: "10.2.0.2/24"},
+	})
+	runIP(t, "-n", netnsName("host1"), "route", "add", "default", "via", "192.168.1.1")
+	runIP(t, "-n", netnsName("host3"), "route", "add", "default", "via", "10.1.0.1")
+	runIP(t, "-n", netnsName("host4"), "route", "add", "default", "via", "10.2.0.1")
+	for _, ns := range []string{"host2", "host4"} {
+		server := exec.Command("ip", "netns", "exec", netnsName(ns), os.Args[0])
+		server.Env = append(os.Environ(), itUdpEnvEcho+"=7000")
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			server.Process.Kill()
+			server.Wait()
+		}()
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"nat": {"outside": "wan0", "inside": ["lan0"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := topo.startRouter(t, "router1", "-mode", "ch2", "-config", path,
+		"-instance", "name=r2,netns="+netnsName("r2"))
+	waitRouterOutput(t, router, "Instance r2: device wan0")
+
+	// 既定のインスタンスでは送信元を外側のアドレスに書き換える
+	if _, seen := topo.udpSend(t, "host1", "192.168.0.2:7000"); !strings.HasPrefix(seen, "192.168.0.1:") {
+		t.Fatalf("default instance did not nat, server saw %s", seen)
+	}
+	// 追加したインスタンスでは書き換えずにフォワードする
+	if _, seen := topo.udpSend(t, "host3", "10.2.0.2:7000"); !strings.HasPrefix(seen, "10.1.0.2:") {
+		t.Fatalf("instance r2 was nated by default instance config, server saw %s\n%s", seen, router.Output())
+	}
+}
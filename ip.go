@@ -4,19 +4,42 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"net"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
 	ICMP_TYPE_ECHO_REPLY              uint8 = 0
 	ICMP_TYPE_DESTINATION_UNREACHABLE uint8 = 3
+	ICMP_TYPE_REDIRECT                uint8 = 5
 	ICMP_TYPE_ECHO_REQUEST            uint8 = 8
 	ICMP_TYPE_TIME_EXCEEDED           uint8 = 11
+	ICMP_TYPE_TIMESTAMP_REQUEST       uint8 = 13
+	ICMP_TYPE_TIMESTAMP_REPLY         uint8 = 14
+	ICMP_TYPE_ADDRESS_MASK_REQUEST    uint8 = 17
+	ICMP_TYPE_ADDRESS_MASK_REPLY      uint8 = 18
 )
 
+// Timestampはヘッダと識別子、シーケンス番号の8バイトに、送信、受信、返信の3つの時刻が続く
+const ICMP_TIMESTAMP_LEN = 20
+
+// Address Maskはヘッダと識別子、シーケンス番号の8バイトにサブネットマスクが続く
+const ICMP_ADDRESS_MASK_LEN = 12
+
+const (
+	ICMP_DEST_UNREACHABLE_CODE_NET_UNREACHABLE  uint8 = 0
+	ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE uint8 = 1
+	ICMP_DEST_UNREACHABLE_CODE_PORT_UNREACHABLE uint8 = 3
+	// 分割が必要だがDFがついている
+	ICMP_DEST_UNREACHABLE_CODE_FRAGMENTATION_NEEDED uint8 = 4
+)
+
+const ICMP_TIME_EXCEEDED_CODE_TTL uint8 = 0
+
+const ICMP_REDIRECT_CODE_HOST uint8 = 1
+
 type icmpHeader struct {
 	icmpType uint8
 	icmpCode uint8
@@ -40,11 +63,17 @@ type icmpTimeExceeded struct {
 	data   []uint8
 }
 
+type icmpRedirect struct {
+	gateway uint32 // 代わりに使うべきルータのアドレス
+	data    []uint8
+}
+
 type icmpMessage struct {
 	icmpHeader                 icmpHeader
 	icmpEcho                   icmpEcho
 	icmpDestinationUnreachable icmpDestinationUnreachable
 	icmpTimeExceeded           icmpTimeExceeded
+	icmpRedirect               icmpRedirect
 }
 
 const IP_ADDRESS_LEN = 4
@@ -53,10 +82,100 @@ const IP_PROTOCOL_NUM_ICMP uint8 = 0x01
 const IP_PROTOCOL_NUM_TCP uint8 = 0x06
 const IP_PROTOCOL_NUM_UDP uint8 = 0x11
 
+/*
+インターフェイスのIPアドレス
+1つ目のアドレス(プライマリ)はaddress、netmask、broadcastに入れ、
+2つ目以降(セカンダリ)はsecondariesに入れる、送信元には基本的にプライマリを使う
+*/
 type ipDevice struct {
-	address   uint32 // デバイスのIPアドレス
-	netmask   uint32 // サブネットマスク
-	broadcast uint32 // ブロードキャストアドレス
+	address     uint32            // デバイスのIPアドレス
+	netmask     uint32            // サブネットマスク
+	broadcast   uint32            // ブロードキャストアドレス
+	secondaries []ipInterfaceAddr // セカンダリのアドレス
+}
+
+// アドレスとサブネットマスクの組
+type ipInterfaceAddr struct {
+	address   uint32
+	netmask   uint32
+	broadcast uint32
+}
+
+func newIPInterfaceAddr(address, netmask uint32) ipInterfaceAddr {
+	// ブロードキャストアドレスの計算はIPアドレスとサブネットマスクのbit反転の2進数「OR（論理和）」演算
+	return ipInterfaceAddr{address: address, netmask: netmask, broadcast: address | (^netmask)}
+}
+
+// アドレスを追加する、最初のアドレスがプライマリになる
+func (ipdev *ipDevice) addAddr(addr ipInterfaceAddr) {
+	if ipdev.address == 0 {
+		ipdev.address, ipdev.netmask, ipdev.broadcast = addr.address, addr.netmask, addr.broadcast
+		return
+	}
+	ipdev.secondaries = append(ipdev.secondaries, addr)
+}
+
+// プライマリとセカンダリの全てのアドレス
+func (ipdev *ipDevice) addrs() []ipInterfaceAddr {
+	if ipdev.address == 0 {
+		return nil
+	}
+	primary := ipInterfaceAddr{address: ipdev.address, netmask: ipdev.netmask, broadcast: ipdev.broadcast}
+	return append([]ipInterfaceAddr{primary}, ipdev.secondaries...)
+}
+
+// インターフェイスについているアドレスか
+func (ipdev *ipDevice) hasAddr(addr uint32) bool {
+	for _, a := range ipdev.addrs() {
+		if a.address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// いずれかのサブネットのディレクティッド・ブロードキャストアドレスか
+// /31と/32のサブネットにはブロードキャストアドレスが無い
+func (ipdev *ipDevice) isBroadcast(addr uint32) bool {
+	for _, a := range ipdev.addrs() {
+		if a.netmask < 0xfffffffe && a.broadcast == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// いずれかのアドレスのサブネットに含まれるか
+func (ipdev *ipDevice) inSubnet(addr uint32) bool {
+	for _, a := range ipdev.addrs() {
+		if addr&a.netmask == a.address&a.netmask {
+			return true
+		}
+	}
+	return false
+}
+
+// 宛先と同じサブネットのアドレス、無ければプライマリのアドレス
+func (ipdev *ipDevice) addrFor(dest uint32) uint32 {
+	for _, a := range ipdev.addrs() {
+		if dest&a.netmask == a.address&a.netmask {
+			return a.address
+		}
+	}
+	return ipdev.address
+}
+
+func (ipdev *ipDevice) equal(other ipDevice) bool {
+	return fmt.Sprint(ipdev.addrs()) == fmt.Sprint(other.addrs())
+}
+
+// "192.168.1.1/24 192.168.3.1/24"の形式
+func (ipdev *ipDevice) String() string {
+	var addrs []string
+	for _, a := range ipdev.addrs() {
+		addrs = append(addrs, fmt.Sprintf("%s/%d", printIPAddr(a.address), subnetToPrefixLen(a.netmask)))
+	}
+	return strings.Join(addrs, " ")
 }
 
 type ipHeader struct {
@@ -78,12 +197,20 @@ type ipRouteType uint8
 const (
 	connected ipRouteType = iota
 	network
+	ipsec     // IPsecのトンネルで対向に送る
+	blackhole // 何も返さずに破棄する
+	reject    // 破棄して送信元にICMP Destination Unreachableを返す
 )
 
 type ipRouteEntry struct {
 	iptype  ipRouteType
 	netdev  *netDevice
 	nexthop uint32
+	tunnel  *espTunnel
+	// 経路の元とアドミニストレーティブディスタンス、メトリック、RIBで一番良い経路を選ぶのに使う
+	source   routeSource
+	distance uint8
+	metric   uint32
 }
 
 func (ipheader ipHeader) ToPacket(calc bool) (ipHeaderByte []byte) {
@@ -114,21 +241,42 @@ func (ipheader ipHeader) ToPacket(calc bool) (ipHeaderByte []byte) {
 	return ipHeaderByte
 }
 
+// インターフェイスの全てのipv4アドレスを返す、カーネルはプライマリのアドレスを先に返す
 func getIPdevice(addrs []net.Addr) (ipdev ipDevice) {
 	for _, addr := range addrs {
-		// ipv6ではなくipv4アドレスをリターン
+		// ipv6ではなくipv4アドレス
 		ipaddrstr := addr.String()
 		if !strings.Contains(ipaddrstr, ":") && strings.Contains(ipaddrstr, ".") {
 			ip, ipnet, _ := net.ParseCIDR(ipaddrstr)
-			ipdev.address = byteToUint32(ip.To4())
-			ipdev.netmask = byteToUint32(ipnet.Mask)
-			// ブロードキャストアドレスの計算はIPアドレスとサブネットマスクのbit反転の2進数「OR（論理和）」演算
-			ipdev.broadcast = ipdev.address | (^ipdev.netmask)
+			ipdev.addAddr(newIPInterfaceAddr(byteToUint32(ip.To4()), byteToUint32(ipnet.Mask)))
 		}
 	}
 	return ipdev
 }
 
+// リミテッド・ブロードキャストか、いずれかのインターフェイスのディレクティッド・ブロードキャストアドレスか
+func isBroadcastAddr(addr uint32) bool {
+	if addr == IP_ADDRESS_LIMITED_BROADCAST {
+		return true
+	}
+	for _, dev := range netDeviceList {
+		if dev.ipDev.isBroadcast(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ルータのいずれかのインターフェイスについているIPアドレスか
+func isOurIPAddr(addr uint32) bool {
+	for _, dev := range netDeviceList {
+		if addr != 0 && dev.ipDev.hasAddr(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 func printIPAddr(ip uint32) string {
 	ipbyte := uint32ToByte(ip)
 	return fmt.Sprintf("%d.%d.%d.%d", ipbyte[0], ipbyte[1], ipbyte[2], ipbyte[3])
@@ -146,24 +294,37 @@ func subnetToPrefixLen(netmask uint32) uint32 {
 	return prefixlen
 }
 
+func init() {
+	registerEtherType(ETHER_TYPE_IP, ipInput)
+	registerIPProtocol(IP_PROTOCOL_NUM_ICMP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		fmt.Println("ICMP received!")
+		return icmpInput(ctx, ipheader.srcAddr, ipheader.destAddr, packet)
+	})
+	// TCPは終端しないので、知らないプロトコルとして表示せずに捨てる
+	registerIPProtocol(IP_PROTOCOL_NUM_TCP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		return dropPacket(DROP_REASON_UNSUPPORTED_PROTOCOL)
+	})
+}
+
 /*
 IPパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L51
 */
-func ipInput(inputdev *netDevice, packet []byte) {
+func ipInput(ctx *inputContext, packet []byte) error {
+	inputdev := ctx.netdev
 	// IPアドレスのついていないインターフェースからの受信は無視
 	if inputdev.ipDev.address == 0 {
-		return
+		return dropPacket(DROP_REASON_NO_IP_ADDRESS)
 	}
 	// IPヘッダ長より短かったらドロップ
 	if len(packet) < 20 {
 		fmt.Printf("Received IP packet too short from %s\n", inputdev.name)
-		return
+		return dropPacket(DROP_REASON_IP_TOO_SHORT)
 	}
 	// 受信したIPパケットをipHeader構造体にセットする
 	ipheader := ipHeader{
 		version:        packet[0] >> 4,
-		headerLen:      packet[0] << 5 >> 5,
+		headerLen:      packet[0] & 0x0f,
 		tos:            packet[1],
 		totalLen:       byteToUint16(packet[2:4]),
 		identify:       byteToUint16(packet[4:6]),
@@ -177,12 +338,11 @@ func ipInput(inputdev *netDevice, packet []byte) {
 
 	fmt.Printf("ipInput Received IP in %s, packet type %d from %s to %s\n", inputdev.name, ipheader.protocol,
 		printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
-
-	// 受信したMACアドレスがARPテーブルになければ追加しておく
-	macaddr, _ := searchArpTableEntry(ipheader.srcAddr)
-	if macaddr == [6]uint8{} {
-		addArpTableEntry(inputdev, ipheader.srcAddr, inputdev.etheHeader.srcAddr)
-	}
+	defer receivePacketEvent(inputdev.name, &ipheader)()
+	tracef("ethernet: received in %s from %s to %s (%s)", inputdev.name, hardwareAddr(ctx.ethHeader.srcAddr),
+		hardwareAddr(ctx.ethHeader.destAddr), traceEthernetReason(inputdev, ctx.ethHeader.destAddr))
+	tracef("ip: %s to %s, protocol %d, ttl %d, length %d", printIPAddr(ipheader.srcAddr),
+		printIPAddr(ipheader.destAddr), ipheader.protocol, ipheader.ttl, ipheader.totalLen)
 
 	// IPバージョンが4でなければドロップ
 	// Todo: IPv6の実装
@@ -192,59 +352,157 @@ func ipInput(inputdev *netDevice, packet []byte) {
 		} else {
 			fmt.Println("Incorrect IP version")
 		}
-		return
+		return dropPacket(DROP_REASON_IP_BAD_VERSION)
 	}
 
 	// IPヘッダオプションがついていたらドロップ = ヘッダ長が20byte以上だったら
-	if 20 < (ipheader.headerLen * 4) {
+	// IGMPはRouter Alertオプションがつくので受け取る
+	headerLen := int(ipheader.headerLen) * 4
+	if headerLen < 20 || (20 < headerLen && ipheader.protocol != IP_PROTOCOL_NUM_IGMP) {
 		fmt.Println("IP header option is not supported")
-		return
+		return dropPacket(DROP_REASON_IP_OPTIONS)
+	}
+
+	// IPパケットの全長より短かったらドロップ
+	if len(packet) < int(ipheader.totalLen) || int(ipheader.totalLen) < headerLen {
+		fmt.Printf("Received IP packet is shorter than total length from %s\n", inputdev.name)
+		return dropPacket(DROP_REASON_IP_BAD_LENGTH)
 	}
+	// イーサネットのパディングを取り除く
+	packet = packet[:ipheader.totalLen]
 
-	// 宛先アドレスがブロードキャストアドレスか受信したNICインターフェイスのIPアドレスの場合
-	if ipheader.destAddr == IP_ADDRESS_LIMITED_BROADCAST || inputdev.ipDev.address == ipheader.destAddr {
+	// ヘッダのチェックサムを検証する
+	if !verifyChecksum(packet[:headerLen]) {
+		inputdev.stats.ipChecksumErrors++
+		debugPrintf("Drop IP packet with invalid header checksum 0x%04x from %s in %s\n",
+			ipheader.headerChecksum, printIPAddr(ipheader.srcAddr), inputdev.name)
+		return dropPacket(DROP_REASON_IP_BAD_CHECKSUM)
+	}
+
+	// ACLで許可されていないパケットはドロップ
+	if !aclPermitted(inputdev, &ipheader) {
+		debugPrintf("Drop IP packet from %s to %s by acl of %s\n",
+			printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr), inputdev.name)
+		return dropPacket(DROP_REASON_ACL_DENIED)
+	}
+
+	// 送信元アドレスへの戻りの経路が無いパケットは偽装されたものとしてドロップ
+	if !urpfPermitted(inputdev, ipheader.srcAddr) {
+		inputdev.stats.urpfDrops++
+		debugPrintf("Drop IP packet from %s to %s by %s urpf of %s\n",
+			printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr), inputdev.urpf, inputdev.name)
+		return dropPacket(DROP_REASON_URPF_FAILED)
+	}
+
+	// 検証を通ったパケットの送信元で、解決中のARPエントリを埋める
+	// VRRPの仮想MACアドレスはマスターが変わると別のルータに移るので学習しない
+	// PPPoEのセッションで受信したパケットはARPを使わないので学習しない
+	if !isVrrpMacAddr(ctx.ethHeader.srcAddr) && inputdev.pppoe == nil {
+		arpLearnFromIP(inputdev, ipheader.srcAddr, ctx.ethHeader.srcAddr)
+	}
+
+	// ポリシーに一致したパケットはDSCPを書き換える
+	dscpRemark(inputdev, &ipheader, packet)
+
+	// NATの外側で受信したパケットは、エントリがあれば宛先を内側のホストに戻してフォワードする
+	if isNatOutsideDevice(inputdev) && inputdev.ipDev.hasAddr(ipheader.destAddr) {
+		if natInbound(packet) {
+			natAlgInbound(packet)
+			ipheader.destAddr = byteToUint32(packet[16:20])
+			tracef("nat: destination is translated to %s", printIPAddr(ipheader.destAddr))
+			return ipForward(ctx, &ipheader, packet)
+		}
+	}
+	// 内側から外側のアドレスに送られたパケットは、ポートフォワードの転送先に折り返す
+	if isNatInsideDevice(inputdev) {
+		outsidedev := searchNetDeviceByName(nat.outsideDevice)
+		if outsidedev != nil && outsidedev.ipDev.hasAddr(ipheader.destAddr) && natHairpin(packet, outsidedev) {
+			ipheader.srcAddr = byteToUint32(packet[12:16])
+			ipheader.destAddr = byteToUint32(packet[16:20])
+			tracef("nat: hairpin is translated from %s to %s", printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+			return ipForward(ctx, &ipheader, packet)
+		}
+	}
+	// NAT64のセッションへの応答はIPv6に戻して内側のホストに送る
+	if nat64Inbound(&ipheader, packet[headerLen:]) {
+		return nil
+	}
+
+	// マルチキャストは参加しているグループ宛てなら受け取り、メンバーがいればフォワードする
+	if isMulticastAddr(ipheader.destAddr) {
+		// IGMPはグループ宛てに送られてくるのでルータが全て処理する
+		if ipheader.protocol == IP_PROTOCOL_NUM_IGMP {
+			return ipInputToOurs(ctx, &ipheader, packet[headerLen:])
+		}
+		joined := isJoinedMulticastGroup(inputdev, ipheader.destAddr)
+		var err error
+		if joined {
+			err = ipInputToOurs(ctx, &ipheader, packet[headerLen:])
+		}
+		if (multicastForwarding || igmpProxy != nil) && !isLinkLocalMulticastAddr(ipheader.destAddr) {
+			multicastForward(inputdev, &ipheader, packet)
+		} else if !joined {
+			return dropPacket(DROP_REASON_MULTICAST_NOT_JOINED)
+		}
+		return err
+	}
+
+	// 宛先アドレスがブロードキャストアドレスか受信したNICインターフェイスのIPアドレス、VRRPのマスターの仮想IPアドレスの場合
+	if ipheader.destAddr == IP_ADDRESS_LIMITED_BROADCAST || inputdev.ipDev.hasAddr(ipheader.destAddr) ||
+		searchVrrpMaster(inputdev, ipheader.destAddr) != nil {
 		// 自分宛の通信として処理
-		ipInputToOurs(inputdev, &ipheader, packet[20:])
-		return
+		return ipInputToOurs(ctx, &ipheader, packet[headerLen:])
 	}
 
 	// 宛先IPアドレスをルータが持ってるか調べる
 	// つまり宛先IPが他のNICインターフェイスについてるIPアドレスだったら自分宛てのものとして処理する
 	for _, dev := range netDeviceList {
 		// 宛先IPアドレスがルータの持っているIPアドレス or ディレクティッド・ブロードキャストアドレスの時の処理
-		if dev.ipDev.address == ipheader.destAddr || dev.ipDev.broadcast == ipheader.destAddr {
+		if dev.ipDev.hasAddr(ipheader.destAddr) || dev.ipDev.isBroadcast(ipheader.destAddr) {
 			// 自分宛の通信として処理
-			ipInputToOurs(inputdev, &ipheader, packet[20:])
-			return
+			return ipInputToOurs(ctx, &ipheader, packet[headerLen:])
 		}
 	}
+
+	// 自分宛てでなければフォワーディングする
+	return ipForward(ctx, &ipheader, packet)
 }
 
 /*
 自分宛のIPパケットの処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L26
 */
-func ipInputToOurs(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+func ipInputToOurs(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+	inputdev := ctx.netdev
+	publishPacketEvent(inputdev.name, PACKET_EVENT_LOCAL, ipheader)
+	tracef("local: destined to router, protocol %d", ipheader.protocol)
 	// 上位プロトコルの処理に移行
-	switch ipheader.protocol {
-	case IP_PROTOCOL_NUM_ICMP:
-		fmt.Println("ICMP received!")
-		icmpInput(inputdev, ipheader.srcAddr, ipheader.destAddr, packet)
-	case IP_PROTOCOL_NUM_UDP:
-		fmt.Printf("udp received : %x\n", packet)
-		//return
-	case IP_PROTOCOL_NUM_TCP:
-		return
-	default:
+	handler, ok := lookupIPProtocolHandler(ipheader.protocol)
+	if !ok {
 		fmt.Printf("Unhandled ip protocol number : %d\n", ipheader.protocol)
-		return
+		return dropPacket(DROP_REASON_UNSUPPORTED_PROTOCOL)
 	}
+	return handler(ctx, ipheader, packet)
 }
 
-func icmpInput(inputdev *netDevice, sourceAddr, destAddr uint32, icmpPacket []byte) {
-	// ICMPメッセージ長より短かったら
-	if len(icmpPacket) < 4 {
+func icmpInput(ctx *inputContext, sourceAddr, destAddr uint32, icmpPacket []byte) error {
+	inputdev := ctx.netdev
+	// ICMPメッセージはヘッダと続く4バイト(エコーなら識別子とシーケンス番号)より短かったらドロップ
+	if len(icmpPacket) < 8 {
 		fmt.Println("Received ICMP Packet is too short")
+		return dropPacket(DROP_REASON_ICMP_TOO_SHORT)
+	}
+	// ICMPメッセージ全体のチェックサムを検証する
+	if !verifyChecksum(icmpPacket) {
+		inputdev.stats.icmpChecksumErrors++
+		debugPrintf("Drop ICMP packet with invalid checksum 0x%04x from %s in %s\n",
+			byteToUint16(icmpPacket[2:4]), printIPAddr(sourceAddr), inputdev.name)
+		return dropPacket(DROP_REASON_ICMP_BAD_CHECKSUM)
+	}
+	// タイムスタンプはエコーのデータの先頭8バイト、データが短ければ全てをタイムスタンプにする
+	timestampEnd := 16
+	if len(icmpPacket) < timestampEnd {
+		timestampEnd = len(icmpPacket)
 	}
 	// ICMPのパケットとして解釈する
 	icmpmsg := icmpMessage{
@@ -256,8 +514,8 @@ func icmpInput(inputdev *netDevice, sourceAddr, destAddr uint32, icmpPacket []by
 		icmpEcho: icmpEcho{
 			identify:  byteToUint16(icmpPacket[4:6]),
 			sequence:  byteToUint16(icmpPacket[6:8]),
-			timestamp: icmpPacket[8:16],
-			data:      icmpPacket[16:],
+			timestamp: icmpPacket[8:timestampEnd],
+			data:      icmpPacket[timestampEnd:],
 		},
 	}
 	// fmt.Printf("ICMP Packet is %+v\n", icmpmsg)
@@ -267,8 +525,83 @@ func icmpInput(inputdev *netDevice, sourceAddr, destAddr uint32, icmpPacket []by
 		fmt.Println("ICMP ECHO REPLY is received")
 	case ICMP_TYPE_ECHO_REQUEST:
 		fmt.Println("ICMP ECHO REQUEST is received, Create Reply Packet")
-		ipPacketEncapsulateOutput(inputdev, sourceAddr, destAddr, icmpmsg.ReplyPacket(), IP_PROTOCOL_NUM_ICMP)
+		// ブロードキャスト宛てのリクエストにはブロードキャストアドレスから返せないので送信元を選ぶ
+		replySrc := destAddr
+		if isBroadcastAddr(destAddr) {
+			replySrc = 0
+		}
+		return ipPacketEncapsulateOutput(sourceAddr, replySrc, icmpmsg.ReplyPacket(), IP_PROTOCOL_NUM_ICMP)
+	case ICMP_TYPE_TIMESTAMP_REQUEST:
+		if !inputdev.icmpTimestamp {
+			debugPrintf("ICMP TIMESTAMP REQUEST is received, but disabled on %s\n", inputdev.name)
+			return nil
+		}
+		if len(icmpPacket) < ICMP_TIMESTAMP_LEN {
+			return dropPacket(DROP_REASON_ICMP_TOO_SHORT)
+		}
+		fmt.Println("ICMP TIMESTAMP REQUEST is received, Create Reply Packet")
+		replySrc := destAddr
+		if isBroadcastAddr(destAddr) {
+			replySrc = 0
+		}
+		return ipPacketEncapsulateOutput(sourceAddr, replySrc, icmpTimestampReply(icmpPacket, routerNow()), IP_PROTOCOL_NUM_ICMP)
+	case ICMP_TYPE_ADDRESS_MASK_REQUEST:
+		if !inputdev.icmpMaskReply {
+			debugPrintf("ICMP ADDRESS MASK REQUEST is received, but disabled on %s\n", inputdev.name)
+			return nil
+		}
+		if len(icmpPacket) < ICMP_ADDRESS_MASK_LEN {
+			return dropPacket(DROP_REASON_ICMP_TOO_SHORT)
+		}
+		// 送信元と同じサブネットのアドレス(セカンダリを含む)のマスクを返す
+		netmask := inputdev.ipDev.netmask
+		for _, a := range inputdev.ipDev.addrs() {
+			if sourceAddr&a.netmask == a.address&a.netmask {
+				netmask = a.netmask
+				break
+			}
+		}
+		fmt.Printf("ICMP ADDRESS MASK REQUEST is received, Reply %s\n", printIPAddr(netmask))
+		return ipPacketEncapsulateOutput(sourceAddr, inputdev.ipDev.addrFor(sourceAddr),
+			icmpAddressMaskReply(icmpPacket, netmask), IP_PROTOCOL_NUM_ICMP)
 	}
+	return nil
+}
+
+/*
+ICMP Timestamp Replyを作る
+リクエストの送信時刻(Originate)はそのまま返し、受信時刻(Receive)と返信時刻(Transmit)には
+UTの0時からのミリ秒を入れる、NTPで合わせていれば補正した時刻になる
+*/
+func icmpTimestampReply(request []byte, now time.Time) []byte {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	ms := uint32(now.Sub(midnight) / time.Millisecond)
+
+	var b bytes.Buffer
+	b.Write([]byte{ICMP_TYPE_TIMESTAMP_REPLY, 0x00, 0x00, 0x00})
+	b.Write(request[4:8])     // 識別子とシーケンス番号
+	b.Write(request[8:12])    // Originate
+	b.Write(uint32ToByte(ms)) // Receive
+	b.Write(uint32ToByte(ms)) // Transmit
+	icmpPacket := b.Bytes()
+	checksum := calcChecksum(icmpPacket)
+	icmpPacket[2] = checksum[0]
+	icmpPacket[3] = checksum[1]
+	return icmpPacket
+}
+
+// ICMP Address Mask Replyを作る
+func icmpAddressMaskReply(request []byte, netmask uint32) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{ICMP_TYPE_ADDRESS_MASK_REPLY, 0x00, 0x00, 0x00})
+	b.Write(request[4:8]) // 識別子とシーケンス番号
+	b.Write(uint32ToByte(netmask))
+	icmpPacket := b.Bytes()
+	checksum := calcChecksum(icmpPacket)
+	icmpPacket[2] = checksum[0]
+	icmpPacket[3] = checksum[1]
+	return icmpPacket
 }
 
 func (icmpmsg icmpMessage) ReplyPacket() (icmpPacket []byte) {
@@ -294,19 +627,182 @@ func (icmpmsg icmpMessage) ReplyPacket() (icmpPacket []byte) {
 	return icmpPacket
 }
 
+// エコーリクエストかエコーリプライをByteにする
+func (echo icmpEcho) ToPacket(icmpType uint8) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{icmpType, 0x00, 0x00, 0x00})
+	b.Write(uint16ToByte(echo.identify))
+	b.Write(uint16ToByte(echo.sequence))
+	b.Write(echo.timestamp)
+	b.Write(echo.data)
+	icmpPacket := b.Bytes()
+	checksum := calcChecksum(icmpPacket)
+	icmpPacket[2] = checksum[0]
+	icmpPacket[3] = checksum[1]
+	return icmpPacket
+}
+
+// Destination UnreachableメッセージをByteにする
+func (unreach icmpDestinationUnreachable) ToPacket(code uint8) []byte {
+	return icmpErrorToPacket(ICMP_TYPE_DESTINATION_UNREACHABLE, code, unreach.unused, unreach.data)
+}
+
+// Time ExceededメッセージをByteにする
+func (exceeded icmpTimeExceeded) ToPacket(code uint8) []byte {
+	return icmpErrorToPacket(ICMP_TYPE_TIME_EXCEEDED, code, exceeded.unused, exceeded.data)
+}
+
+// RedirectメッセージをByteにする
+func (redirect icmpRedirect) ToPacket(code uint8) []byte {
+	return icmpErrorToPacket(ICMP_TYPE_REDIRECT, code, redirect.gateway, redirect.data)
+}
+
+func icmpErrorToPacket(icmpType, icmpCode uint8, rest uint32, data []uint8) (icmpPacket []byte) {
+	var b bytes.Buffer
+	// ICMPヘッダ
+	b.Write([]byte{icmpType})
+	b.Write([]byte{icmpCode})
+	b.Write([]byte{0x00, 0x00}) // checksum
+	// Redirectならゲートウェイのアドレス、それ以外は未使用
+	b.Write(uint32ToByte(rest))
+	// エラーの原因になったIPヘッダとペイロードの先頭
+	b.Write(data)
+
+	icmpPacket = b.Bytes()
+	checksum := calcChecksum(icmpPacket)
+	icmpPacket[2] = checksum[0]
+	icmpPacket[3] = checksum[1]
+	return icmpPacket
+}
+
+/*
+ICMPエラーメッセージに入れる元のパケットを取り出す
+エラーに対してエラーを返さないように、送るべきでないパケットの場合はfalseを返す
+https://www.rfc-editor.org/rfc/rfc1812#section-4.3.2.7
+*/
+func icmpErrorData(errorIPPacket []byte) ([]byte, bool) {
+	if len(errorIPPacket) < 20 {
+		return nil, false
+	}
+	srcAddr := byteToUint32(errorIPPacket[12:16])
+	destAddr := byteToUint32(errorIPPacket[16:20])
+	// 送信元が特定できないパケット、ブロードキャストやマルチキャスト宛てのパケットにはエラーを返さない
+	if srcAddr == 0 || srcAddr == IP_ADDRESS_LIMITED_BROADCAST || isBroadcastAddr(destAddr) ||
+		isMulticastAddr(srcAddr) || isMulticastAddr(destAddr) {
+		return nil, false
+	}
+	// 自分で送ったパケットにはエラーを返さない
+	if isOurIPAddr(srcAddr) {
+		return nil, false
+	}
+	// 先頭以外のフラグメントにはエラーを返さない
+	if byteToUint16(errorIPPacket[6:8])&0x1fff != 0 {
+		return nil, false
+	}
+	headerLen := int(errorIPPacket[0]&0x0f) * 4
+	// ICMPエラーメッセージにはエラーを返さない
+	if errorIPPacket[9] == IP_PROTOCOL_NUM_ICMP && headerLen < len(errorIPPacket) {
+		switch errorIPPacket[headerLen] {
+		case ICMP_TYPE_ECHO_REPLY, ICMP_TYPE_ECHO_REQUEST:
+		default:
+			return nil, false
+		}
+	}
+	// IPヘッダとペイロードの先頭8byteを入れる
+	dataLen := headerLen + 8
+	if len(errorIPPacket) < dataLen {
+		dataLen = len(errorIPPacket)
+	}
+	data := make([]byte, dataLen)
+	copy(data, errorIPPacket)
+	return data, true
+}
+
+/*
+ICMP Destination Unreachableを送信
+https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/icmp.cpp#L73
+*/
+func sendIcmpDestinationUnreachable(srcAddr uint32, code uint8, errorIPPacket []byte) {
+	data, ok := icmpErrorData(errorIPPacket)
+	if !ok {
+		return
+	}
+	destAddr := byteToUint32(errorIPPacket[12:16])
+	fmt.Printf("Sending icmp destination unreachable (code %d) to %s\n", code, printIPAddr(destAddr))
+	ipPacketEncapsulateOutput(destAddr, srcAddr, icmpDestinationUnreachable{data: data}.ToPacket(code), IP_PROTOCOL_NUM_ICMP)
+}
+
+/*
+ICMP Destination Unreachable (Fragmentation Needed)を送信
+未使用のフィールドの下位16bitで次のホップのMTUを知らせる
+https://www.rfc-editor.org/rfc/rfc1191#section-4
+*/
+func sendIcmpFragmentationNeeded(srcAddr uint32, mtu uint16, errorIPPacket []byte) {
+	data, ok := icmpErrorData(errorIPPacket)
+	if !ok {
+		return
+	}
+	destAddr := byteToUint32(errorIPPacket[12:16])
+	fmt.Printf("Sending icmp fragmentation needed (mtu %d) to %s\n", mtu, printIPAddr(destAddr))
+	unreach := icmpDestinationUnreachable{unused: uint32(mtu), data: data}
+	ipPacketEncapsulateOutput(destAddr, srcAddr, unreach.ToPacket(ICMP_DEST_UNREACHABLE_CODE_FRAGMENTATION_NEEDED), IP_PROTOCOL_NUM_ICMP)
+}
+
+/*
+ICMP Time Exceededを送信
+https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/icmp.cpp#L101
+*/
+func sendIcmpTimeExceeded(srcAddr uint32, code uint8, errorIPPacket []byte) {
+	data, ok := icmpErrorData(errorIPPacket)
+	if !ok {
+		return
+	}
+	destAddr := byteToUint32(errorIPPacket[12:16])
+	fmt.Printf("Sending icmp time exceeded to %s\n", printIPAddr(destAddr))
+	ipPacketEncapsulateOutput(destAddr, srcAddr, icmpTimeExceeded{data: data}.ToPacket(code), IP_PROTOCOL_NUM_ICMP)
+}
+
+/*
+ICMP Redirectを送信
+送信元と同じネットワークにいるgatewayに直接送るように通知する
+https://www.rfc-editor.org/rfc/rfc1812#section-5.2.7.2
+*/
+func sendIcmpRedirect(srcAddr, gateway uint32, errorIPPacket []byte) {
+	data, ok := icmpErrorData(errorIPPacket)
+	if !ok {
+		return
+	}
+	destAddr := byteToUint32(errorIPPacket[12:16])
+	fmt.Printf("Sending icmp redirect to %s, gateway is %s\n", printIPAddr(destAddr), printIPAddr(gateway))
+	ipPacketEncapsulateOutput(destAddr, srcAddr, icmpRedirect{gateway: gateway, data: data}.ToPacket(ICMP_REDIRECT_CODE_HOST), IP_PROTOCOL_NUM_ICMP)
+}
+
 func calcChecksum(packet []byte) []byte {
 	// まず16ビット毎に足す
 	sum := sumByteArr(packet)
 	// あふれた桁を足す
-	sum = (sum & 0xffff) + sum>>16
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + sum>>16
+	}
 	// 論理否定を取った値をbyteにして返す
 	return uint16ToByte(uint16(sum ^ 0xffff))
 }
 
+// チェックサムのフィールドを含めて計算して0になれば正しい
+func verifyChecksum(packet []byte) bool {
+	checksum := calcChecksum(packet)
+	return checksum[0] == 0 && checksum[1] == 0
+}
+
 func sumByteArr(packet []byte) (sum uint) {
 	for i, _ := range packet {
 		if i%2 == 0 {
-			sum += uint(byteToUint16(packet[i:]))
+			if i+1 < len(packet) {
+				sum += uint(byteToUint16(packet[i:]))
+			} else {
+				// 奇数長の場合は最後の1byteの後ろを0で埋めて足す
+				sum += uint(packet[i]) << 8
+			}
 		}
 	}
 	return sum
@@ -315,70 +811,120 @@ func sumByteArr(packet []byte) (sum uint) {
 /*
 IPパケットを直接イーサネットでホストに送信
 */
-func ipPacketOutputToHost(dev *netDevice, destAddr uint32, packet []byte) {
+func ipPacketOutputToHost(dev *netDevice, destAddr uint32, packet []byte) error {
+	// PPPoEのセッションの相手は1台だけなのでARPを引かない
+	if dev.pppoe != nil {
+		return pppoeOutputIP(dev, packet)
+	}
+	// ループバックのアドレスは自分宛てとして受け取るので、ここに来るのは自分から自分宛てのパケットだけ
+	if dev.backend == loopbackDevice {
+		fmt.Printf("Drop ip packet to loopback address %s\n", printIPAddr(destAddr))
+		return dropPacket(DROP_REASON_NO_ROUTE)
+	}
 	// ARPテーブルの検索
 	destMacAddr, _ := searchArpTableEntry(destAddr)
 	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
 		// ARPエントリが無かったら
 		fmt.Printf("Trying ip output to host, but no arp record to %s\n", printIPAddr(destAddr))
+		tracef("arp: no entry for host %s, resolving in %s", printIPAddr(destAddr), dev.name)
 		// ARPリクエストを送信
-		sendArpRequest(dev, destAddr)
-	} else {
-		// ARPエントリがあり、MACアドレスが得られたらイーサネットでカプセル化して送信
-		ethernetOutput(dev, destMacAddr, packet, ETHER_TYPE_IP)
+		if arpResolve(dev, destAddr) {
+			// 到達不能ならパケットの送信元に通知する
+			sendIcmpDestinationUnreachable(dev.ipDev.addrFor(destAddr), ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE, packet)
+			return dropPacket(DROP_REASON_HOST_UNREACHABLE)
+		}
+		return dropPacket(DROP_REASON_ARP_UNRESOLVED)
 	}
+	// ARPエントリがあり、MACアドレスが得られたらイーサネットでカプセル化して送信
+	tracef("arp: host %s is at %s", printIPAddr(destAddr), hardwareAddr(destMacAddr))
+	return ethernetOutput(dev, destMacAddr, packet, ETHER_TYPE_IP)
 }
 
 /*
 IPパケットをNextHopに送信
 */
-func ipPacketOutputToNetxhop(nextHop uint32, packet []byte) {
+func ipPacketOutputToNetxhop(nextHop uint32, packet []byte) error {
 	// ARPテーブルの検索
 	destMacAddr, dev := searchArpTableEntry(nextHop)
-	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
-		fmt.Printf("Trying ip output to next hop, but no arp record to %s\n", printIPAddr(nextHop))
-		// ルーティングテーブルのルックアップ
-		routeToNexthop := iproute.radixTreeSearch(nextHop)
-		//fmt.Printf("next hop route is from %s\n", routeToNexthop.netdev.name)
-		if routeToNexthop == (ipRouteEntry{}) || routeToNexthop.iptype != connected {
-			// next hopへの到達性が無かったら
-			fmt.Printf("Next hop %s is not reachable\n", printIPAddr(nextHop))
-		} else {
-			// ARPリクエストを送信
-			sendArpRequest(routeToNexthop.netdev, nextHop)
-		}
-	} else {
+	if destMacAddr != [6]uint8{0, 0, 0, 0, 0, 0} {
 		// ARPエントリがあり、MACアドレスが得られたらイーサネットでカプセル化して送信
-		ethernetOutput(dev, destMacAddr, packet, ETHER_TYPE_IP)
+		tracef("arp: next hop %s is at %s", printIPAddr(nextHop), hardwareAddr(destMacAddr))
+		return ethernetOutput(dev, destMacAddr, packet, ETHER_TYPE_IP)
+	}
+	fmt.Printf("Trying ip output to next hop, but no arp record to %s\n", printIPAddr(nextHop))
+	tracef("arp: no entry for next hop %s", printIPAddr(nextHop))
+	// ルーティングテーブルのルックアップ
+	routeToNexthop, ok := iproute.radixTreeSearch(nextHop)
+	//fmt.Printf("next hop route is from %s\n", routeToNexthop.netdev.name)
+	if !ok || routeToNexthop.iptype != connected {
+		// next hopへの到達性が無かったら
+		fmt.Printf("Next hop %s is not reachable\n", printIPAddr(nextHop))
+		return dropPacket(DROP_REASON_NEXTHOP_UNREACHABLE)
 	}
+	if routeToNexthop.netdev.pppoe != nil {
+		return pppoeOutputIP(routeToNexthop.netdev, packet)
+	}
+	// ARPリクエストを送信
+	if arpResolve(routeToNexthop.netdev, nextHop) {
+		// 到達不能ならパケットの送信元に通知する
+		sendIcmpDestinationUnreachable(routeToNexthop.netdev.ipDev.addrFor(nextHop), ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE, packet)
+		return dropPacket(DROP_REASON_HOST_UNREACHABLE)
+	}
+	return dropPacket(DROP_REASON_ARP_UNRESOLVED)
 }
 
 /*
 IPパケットを送信
 */
-func ipPacketOutput(outputdev *netDevice, routeTree radixTreeNode, destAddr uint32, packet []byte) {
+func ipPacketOutput(routeTree radixTreeNode, destAddr uint32, packet []byte) error {
 	// 宛先IPアドレスへの経路を検索
-	route := routeTree.radixTreeSearch(destAddr)
-	if route == (ipRouteEntry{}) {
+	route, ok := routeTree.radixTreeSearch(destAddr)
+	if !ok {
 		// 経路が見つからなかったら
 		fmt.Printf("No route to %s\n", printIPAddr(destAddr))
+		return dropPacket(DROP_REASON_NO_ROUTE)
 	}
-	if route.iptype == connected {
+	switch route.iptype {
+	case connected:
 		// 直接接続されたネットワークなら
-		ipPacketOutputToHost(outputdev, destAddr, packet)
-	} else if route.iptype == network {
+		return ipPacketOutputToHost(route.netdev, destAddr, packet)
+	case network:
 		// 直接つながっていないネットワークなら
-		ipPacketOutputToNetxhop(destAddr, packet)
+		return ipPacketOutputToNetxhop(route.nexthop, packet)
+	case ipsec:
+		// IPsecのトンネルの向こうのネットワークなら
+		return espOutput(route.tunnel, packet)
+	case blackhole, reject:
+		// ルータから送るパケットにはICMPを返さずに破棄する
+		fmt.Printf("Route to %s is %s\n", printIPAddr(destAddr), route.iptype)
+		return dropPacket(routeDropReason(route))
+	}
+	return nil
+}
+
+func routeDropReason(route ipRouteEntry) dropReason {
+	if route.iptype == reject {
+		return DROP_REASON_REJECT_ROUTE
 	}
+	return DROP_REASON_BLACKHOLE_ROUTE
 }
 
 /*
 IPパケットにカプセル化して送信
+srcAddrが0ならipSourceAddrで宛先への経路から選ぶ
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L102
 */
-func ipPacketEncapsulateOutput(inputdev *netDevice, destAddr, srcAddr uint32, payload []byte, protocolType uint8) {
+func ipPacketEncapsulateOutput(destAddr, srcAddr uint32, payload []byte, protocolType uint8) error {
 	var ipPacket []byte
 
+	if srcAddr == 0 {
+		srcAddr = ipSourceAddr(destAddr)
+		if srcAddr == 0 {
+			fmt.Printf("No source address to send to %s\n", printIPAddr(destAddr))
+			return dropPacket(DROP_REASON_NO_ROUTE)
+		}
+	}
+
 	// IPヘッダで必要なIPパケットの全長を算出する
 	// IPヘッダの20byte + パケットの長さ
 	totalLength := 20 + len(payload)
@@ -402,16 +948,143 @@ func ipPacketEncapsulateOutput(inputdev *netDevice, destAddr, srcAddr uint32, pa
 	// payloadを追加
 	ipPacket = append(ipPacket, payload...)
 
-	// ルートテーブルを検索して送信先IPのMACアドレスがなければ、
-	// ARPリクエストを生成して送信して結果を受信してから、ethernetからパケットを送る
-	destMacAddr, _ := searchArpTableEntry(destAddr)
-	if destMacAddr != [6]uint8{0, 0, 0, 0, 0, 0} {
-		// ルートテーブルに送信するIPアドレスのMACアドレスがあれば送信
-		ethernetOutput(inputdev, destMacAddr, ipPacket, ETHER_TYPE_IP)
-	} else {
-		// ARPリクエストを出す
-		sendArpRequest(inputdev, destAddr)
+	// ルートテーブルを検索して送信先へ送る
+	// 送信先のMACアドレスがなければARPリクエストを出す
+	return ipPacketOutput(iproute, destAddr, ipPacket)
+}
+
+/*
+ルータから送るパケットの送信元アドレスを選ぶ
+宛先が自分のアドレスならそのアドレス、そうでなければ経路の出力インターフェイスで、
+宛先かNextHopと同じサブネットのアドレス(セカンダリを含む)を使う
+出力インターフェイスにアドレスが無ければループバックのアドレスを使う
+経路が無ければ0を返す
+*/
+func ipSourceAddr(destAddr uint32) uint32 {
+	if isOurIPAddr(destAddr) {
+		return destAddr
+	}
+	route, ok := iproute.radixTreeSearch(destAddr)
+	if !ok {
+		return 0
+	}
+	// トンネルに入るパケットは対向に送る時のアドレスを使う
+	if route.iptype == ipsec {
+		destAddr = route.tunnel.config.peer
+		route, ok = iproute.radixTreeSearch(destAddr)
+		if !ok {
+			return 0
+		}
+	}
+	netdev := routeOutputDevice(route)
+	if netdev == nil {
+		return 0
 	}
+	gateway := destAddr
+	if route.iptype == network {
+		gateway = route.nexthop
+	}
+	if netdev.ipDev.address != 0 {
+		return netdev.ipDev.addrFor(gateway)
+	}
+	if loopback := searchLoopbackDevice(); loopback != nil {
+		return loopback.ipDev.address
+	}
+	return 0
+}
+
+// 経路に従って送信する時に使うデバイス
+// IPsecのトンネルはインターフェイスを持たないのでnilを返す
+func routeOutputDevice(route ipRouteEntry) *netDevice {
+	if route.iptype == connected {
+		return route.netdev
+	}
+	if route.iptype != network {
+		return nil
+	}
+	// NextHopへの直接接続の経路を探す
+	routeToNexthop, ok := iproute.radixTreeSearch(route.nexthop)
+	if ok && routeToNexthop.iptype == connected {
+		return routeToNexthop.netdev
+	}
+	return nil
+}
+
+/*
+IPパケットのフォワーディング
+https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L225
+*/
+func ipForward(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+	inputdev := ctx.netdev
+	fmt.Printf("Forwarding ip packet from %s to %s\n", printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+
+	// 宛先IPアドレスへの経路を検索
+	route, ok := iproute.radixTreeSearch(ipheader.destAddr)
+	if !ok {
+		// 経路が見つからなかったら送信元にNet Unreachableを送る
+		fmt.Printf("No route to %s\n", printIPAddr(ipheader.destAddr))
+		tracef("route: no route to %s", printIPAddr(ipheader.destAddr))
+		sendIcmpDestinationUnreachable(inputdev.ipDev.addrFor(ipheader.srcAddr), ICMP_DEST_UNREACHABLE_CODE_NET_UNREACHABLE, packet)
+		return dropPacket(DROP_REASON_NO_ROUTE)
+	}
+	tracef("route: %s is %s", printIPAddr(ipheader.destAddr), traceRouteString(route))
+	// ブラックホールの経路なら黙って捨て、リジェクトの経路なら送信元にHost Unreachableを送る
+	if route.iptype == blackhole || route.iptype == reject {
+		if route.iptype == reject {
+			sendIcmpDestinationUnreachable(inputdev.ipDev.addrFor(ipheader.srcAddr), ICMP_DEST_UNREACHABLE_CODE_HOST_UNREACHABLE, packet)
+		}
+		return dropPacket(routeDropReason(route))
+	}
+	// TTLが1以下ならドロップして送信元にTime Exceededを送る
+	if ipheader.ttl <= 1 {
+		sendIcmpTimeExceeded(inputdev.ipDev.addrFor(ipheader.srcAddr), ICMP_TIME_EXCEEDED_CODE_TTL, packet)
+		return dropPacket(DROP_REASON_TTL_EXCEEDED)
+	}
+
+	outputdev := routeOutputDevice(route)
+	// 受信したインターフェイスから送り返す場合は、送信元に直接NextHopへ送るように通知する
+	if outputdev == inputdev && inputdev.icmpRedirect {
+		gateway := route.nexthop
+		if route.iptype == connected {
+			gateway = ipheader.destAddr
+		}
+		if inputdev.ipDev.inSubnet(ipheader.srcAddr) && gateway != ipheader.srcAddr {
+			sendIcmpRedirect(inputdev.ipDev.addrFor(ipheader.srcAddr), gateway, packet)
+		}
+	}
+
+	// TTLを1減らしてチェックサムを計算し直す
+	forwardPacket := make([]byte, len(packet))
+	copy(forwardPacket, packet)
+	forwardPacket[8] = ipheader.ttl - 1
+
+	// 内側から外側へ出ていくパケットなら、ALGでペイロードの中のアドレスを書き換えてから送信元を書き換える
+	if outputdev != nil && isNatInsideDevice(inputdev) && isNatOutsideDevice(outputdev) {
+		forwardPacket = natAlgOutbound(forwardPacket, outputdev)
+		natOutbound(forwardPacket, outputdev)
+	}
+	// 計算途中のチェックサムで届いたパケットは、そのまま送らないようにする
+	if ctx.checksumPartial {
+		fixTransportChecksum(forwardPacket)
+	}
+	setIPHeaderChecksum(forwardPacket)
+
+	sflowSample(inputdev, outputdev, packet)
+	flowAccount(ipheader, packet)
+	publishForwardEvent(inputdev, ipheader, route, outputdev)
+	tracef("forward: ttl %d to %d", ipheader.ttl, ipheader.ttl-1)
+	switch route.iptype {
+	case connected:
+		// 直接接続されたネットワークなら宛先のホストに送信
+		return ipPacketOutputToHost(route.netdev, ipheader.destAddr, forwardPacket)
+	case network:
+		// 直接つながっていないネットワークならNextHopに送信
+		return ipPacketOutputToNetxhop(route.nexthop, forwardPacket)
+	case ipsec:
+		// IPsecのトンネルの向こうのネットワークなら暗号化して対向に送信
+		return espOutput(route.tunnel, forwardPacket)
+	}
+	return nil
 }
 
 func uint16ToByte(i uint16) []byte {
@@ -435,28 +1108,82 @@ func (ethHeader ethernetHeader) ToPacket() []byte {
 }
 
 // イーサネットにカプセル化して送信
-func ethernetOutput(netdev *netDevice, destaddr [6]uint8, packet []byte, ethType uint16) {
+func ethernetOutput(netdev *netDevice, destaddr [6]uint8, packet []byte, ethType uint16) error {
+	return ethernetOutputFrom(netdev, netdev.macAddr, destaddr, packet, ethType)
+}
+
+// 送信元MACアドレスを指定してイーサネットにカプセル化して送信、VRRPの仮想MACアドレスで送る時に使う
+func ethernetOutputFrom(netdev *netDevice, srcaddr, destaddr [6]uint8, packet []byte, ethType uint16) error {
 	// イーサネットヘッダのパケットを作成
 	ethHeaderPacket := ethernetHeader{
 		destAddr:  destaddr,
-		srcAddr:   netdev.macAddr,
+		srcAddr:   srcaddr,
 		etherType: ethType,
 	}.ToPacket()
 	// イーサネットヘッダに送信するパケットをつなげる
 	ethHeaderPacket = append(ethHeaderPacket, packet...)
+	tracef("output: %s to %s, ether type 0x%04x", netdev.name, hardwareAddr(destaddr), ethType)
 	// ネットワークデバイスに送信する
-	err := netdev.netDeviceTransmit(ethHeaderPacket)
-	if err != nil {
-		log.Fatalf("netDeviceTransmit is err : %v", err)
+	return netdev.netDeviceTransmit(ethHeaderPacket)
+}
+
+/*
+ネットデバイスの送信処理
+遅延と損失のエミュレーションをしていれば、時刻つきのキューに入れて時間が来てから送る
+シェーピングしていればトークンが無い時や先に待っているフレームがある時は送信キューに入れる
+AF_PACKETのsocketでは送信キューに入れてsendmmsgでまとめて送る
+送れなかったフレームは破棄してインターフェイスごとに数えてエラーを返すので、ルータは止めずに他のインターフェイスの処理を続ける
+キューに入れたフレームを後で送れなかった場合は数えるだけになる
+*/
+func (netDev *netDevice) netDeviceTransmit(data []byte) error {
+	// 止めているかリンクが落ちているインターフェイスからは送らない
+	if !netDev.isUp() {
+		return dropPacket(DROP_REASON_INTERFACE_DOWN)
+	}
+	if netDev.impairment != nil {
+		impairEnqueue(netDev, data, time.Now())
+		return nil
+	}
+	return netDev.netDeviceEgress(data)
+}
+
+// シェーピングの送信キューかデバイスの送信キューにフレームを入れる
+func (netDev *netDevice) netDeviceEgress(data []byte) error {
+	if netDev.shaper != nil {
+		if netDev.txQueues.len() != 0 || !netDev.shaper.take(len(data), time.Now()) {
+			qosEnqueue(netDev, data)
+			return nil
+		}
+	}
+	if netDev.backend == packetSocket {
+		netDev.txEnqueue(data)
+		return nil
 	}
+	if err := netDev.netDeviceWrite(data); err != nil {
+		return netDev.txError(err)
+	}
+	return nil
 }
 
-// ネットデバイスの送信処理
-func (netDev netDevice) netDeviceTransmit(data []byte) error {
-	err := syscall.Sendto(netDev.socket, data, 0, &netDev.sockAddr)
+// デバイスにフレームを書き込む
+func (netDev *netDevice) netDeviceWrite(data []byte) error {
+	var err error
+	switch netDev.backend {
+	case tapDevice:
+		_, err = syscall.Write(netDev.socket, data)
+	case loopbackDevice:
+		// ループバックから外には出ない
+		return nil
+	case xdpSocket:
+		err = netDev.xsk.transmit(data)
+	default:
+		err = syscall.Sendto(netDev.socket, data, 0, &netDev.sockAddr)
+	}
 	if err != nil {
 		return err
 	}
+	netDev.stats.txPackets++
+	netDev.stats.txBytes += uint64(len(data))
 	return nil
 }
 
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"net/netip"
+)
+
+/*
+IPv6
+このルータはIPv6のパケットをフォワードせず、リンクローカルで完結する制御のメッセージだけを受け取る
+  ICMPv6のRouter Solicitation   ルータ広告を送っているインターフェイスで答える(ra.go)
+  DHCPv6のAdvertiseとReply       プレフィックスの委譲を受けるWAN側のインターフェイスで処理する(dhcpv6.go)
+  DNSの問い合わせ                 DNSフォワーダでIPv4のサーバに転送する(dns.go)
+ただし-nat64のインターフェイスで受けた64:ff9b::/96宛てのパケットはIPv4に変換して送る(nat64.go)
+送信元にはMACアドレスから作ったリンクローカルアドレス(EUI-64)を使う
+拡張ヘッダは扱わない
+https://www.rfc-editor.org/rfc/rfc8200
+*/
+
+const IPV6_HEADER_LEN = 40
+
+const IP_PROTOCOL_NUM_ICMPV6 uint8 = 58
+
+var IPV6_ADDRESS_ALL_NODES = [16]uint8{0xff, 0x02, 15: 0x01}
+var IPV6_ADDRESS_ALL_ROUTERS = [16]uint8{0xff, 0x02, 15: 0x02}
+
+// IPv6のフレームを受け取るインターフェイスか
+func ipv6Enabled(netdev *netDevice) bool {
+	return searchRaInterface(netdev) != nil || dhcpv6Interface(netdev) || netdev.nat64
+}
+
+func init() {
+	registerEtherType(ETHER_TYPE_IPV6, ipv6Input)
+}
+
+/*
+IPv6のパケットの受信処理
+*/
+func ipv6Input(ctx *inputContext, packet []byte) error {
+	if !ipv6Enabled(ctx.netdev) {
+		return dropPacket(DROP_REASON_UNSUPPORTED_ETHER_TYPE)
+	}
+	if len(packet) < IPV6_HEADER_LEN {
+		return dropPacket(DROP_REASON_IP_TOO_SHORT)
+	}
+	if packet[0]>>4 != 6 {
+		return dropPacket(DROP_REASON_IP_BAD_VERSION)
+	}
+	payloadLen := int(byteToUint16(packet[4:6]))
+	if len(packet) < IPV6_HEADER_LEN+payloadLen {
+		return dropPacket(DROP_REASON_IP_BAD_LENGTH)
+	}
+	nextHeader := packet[6]
+	hopLimit := packet[7]
+	var srcAddr, destAddr [16]uint8
+	copy(srcAddr[:], packet[8:24])
+	copy(destAddr[:], packet[24:40])
+	payload := packet[IPV6_HEADER_LEN : IPV6_HEADER_LEN+payloadLen]
+
+	if ctx.netdev.nat64 && isNat64Addr(destAddr) {
+		return nat64Outbound(ctx, packet)
+	}
+	switch nextHeader {
+	case IP_PROTOCOL_NUM_ICMPV6:
+		if len(payload) != 0 && payload[0] == ICMPV6_TYPE_ROUTER_SOLICITATION {
+			return raSolicitationInput(ctx, srcAddr, destAddr, hopLimit, payload)
+		}
+	case IP_PROTOCOL_NUM_UDP:
+		return udpv6Input(ctx, srcAddr, destAddr, payload)
+	}
+	return dropPacket(DROP_REASON_UNSUPPORTED_PROTOCOL)
+}
+
+/*
+IPv6のUDPデータグラムの受信処理
+IPv6ではチェックサムを省略できないので、0のものも破棄する
+チェックサムオフロードで計算途中のまま届くインターフェイスでは0かどうかだけ確かめる
+*/
+func udpv6Input(ctx *inputContext, srcAddr, destAddr [16]uint8, packet []byte) error {
+	if len(packet) < UDP_HEADER_LEN {
+		return dropPacket(DROP_REASON_UDP_INVALID)
+	}
+	length := int(byteToUint16(packet[4:6]))
+	if length < UDP_HEADER_LEN || len(packet) < length {
+		return dropPacket(DROP_REASON_UDP_INVALID)
+	}
+	packet = packet[:length]
+	if byteToUint16(packet[6:8]) == 0 ||
+		(ctx.netdev.verifyTransportChecksum() && !verifyChecksum(ipv6PseudoPacket(srcAddr, destAddr, IP_PROTOCOL_NUM_UDP, packet))) {
+		debugPrintf("Drop UDP packet with invalid checksum from %s in %s\n", netip.AddrFrom16(srcAddr), ctx.netdev.name)
+		return dropPacket(DROP_REASON_UDP_INVALID)
+	}
+	destPort := byteToUint16(packet[2:4])
+	if destPort == DHCPV6_CLIENT_PORT && dhcpv6Interface(ctx.netdev) {
+		dhcpv6Input(dhcpv6, srcAddr, packet[UDP_HEADER_LEN:])
+		return nil
+	}
+	// DNSフォワーダはリンクローカルアドレス宛ての問い合わせだけ受ける
+	if destPort == DNS_PORT && dnsProxy != nil && destAddr == ipv6LinkLocalAddr(ctx.netdev.macAddr).As16() {
+		dnsQueryInput6(ctx, srcAddr, byteToUint16(packet[0:2]), packet[UDP_HEADER_LEN:])
+		return nil
+	}
+	debugPrintf("No UDP listener on port %d from %s\n", destPort, netip.AddrFrom16(srcAddr))
+	return dropPacket(DROP_REASON_UDP_NO_LISTENER)
+}
+
+// IPv6のUDPデータグラムをリンクローカルアドレスから送る
+func udpv6Output(netdev *netDevice, destAddr [16]uint8, destMac [6]uint8, srcPort, destPort uint16, hopLimit uint8, payload []byte) {
+	srcAddr := ipv6LinkLocalAddr(netdev.macAddr).As16()
+	packet := uint16ToByte(srcPort)
+	packet = append(packet, uint16ToByte(destPort)...)
+	packet = append(packet, uint16ToByte(uint16(UDP_HEADER_LEN+len(payload)))...)
+	packet = append(packet, 0x00, 0x00)
+	packet = append(packet, payload...)
+	checksum := calcChecksum(ipv6PseudoPacket(srcAddr, destAddr, IP_PROTOCOL_NUM_UDP, packet))
+	// 計算結果が0の場合は0xffffにする
+	if checksum[0] == 0 && checksum[1] == 0 {
+		checksum = []byte{0xff, 0xff}
+	}
+	packet[6], packet[7] = checksum[0], checksum[1]
+	ethernetOutput(netdev, destMac, ipv6Packet(srcAddr, destAddr, IP_PROTOCOL_NUM_UDP, hopLimit, packet), ETHER_TYPE_IPV6)
+}
+
+// ペイロードにIPv6ヘッダをつける
+func ipv6Packet(srcAddr, destAddr [16]uint8, nextHeader, hopLimit uint8, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x60, 0x00, 0x00, 0x00}) // バージョン6、トラフィッククラスとフローラベルは0
+	b.Write(uint16ToByte(uint16(len(payload))))
+	b.Write([]byte{nextHeader, hopLimit})
+	b.Write(srcAddr[:])
+	b.Write(destAddr[:])
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// ICMPv6とUDPのチェックサムを計算するための疑似ヘッダをつけたメッセージ
+func ipv6PseudoPacket(srcAddr, destAddr [16]uint8, nextHeader uint8, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(srcAddr[:])
+	b.Write(destAddr[:])
+	b.Write(uint32ToByte(uint32(len(payload))))
+	b.Write([]byte{0x00, 0x00, 0x00, nextHeader})
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// MACアドレスからEUI-64でインターフェイスIDを作ったfe80::/64のリンクローカルアドレス
+func ipv6LinkLocalAddr(macaddr [6]uint8) netip.Addr {
+	return netip.AddrFrom16([16]uint8{0xfe, 0x80, 8: macaddr[0] ^ 0x02, macaddr[1], macaddr[2], 0xff, 0xfe, macaddr[3], macaddr[4], macaddr[5]})
+}
+
+// IPv6のマルチキャストアドレスのMACアドレス、33:33に下位32bitをつなげる
+func ipv6MulticastMacAddr(addr [16]uint8) [6]uint8 {
+	return [6]uint8{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]}
+}
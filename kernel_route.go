@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// go-curoがカーネルに書き出した経路であることを示すプロトコル番号
+// /etc/iproute2/rt_protosで未使用の値
+const RTPROT_GOCURO = 0xc8
+
+// 起動時にカーネルの経路を読み込むか
+var importKernelRoutes bool
+
+// go-curoが登録した経路をカーネルにも書き出すか
+var exportKernelRoutes bool
+
+/*
+カーネルのメインテーブルのIPv4の経路を読み込んでルートテーブルに登録する
+直接接続の経路はデバイスの登録時に入っているので、ゲートウェイのある経路だけを取り込む
+*/
+func loadKernelRoutes() error {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return fmt.Errorf("dump kernel routes err : %s", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return fmt.Errorf("parse netlink message err : %s", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWROUTE || len(msg.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		rtmsg := (*syscall.RtMsg)(unsafe.Pointer(&msg.Data[0]))
+		// 自分で書き出した経路やローカル、ブロードキャストの経路は取り込まない
+		if rtmsg.Table != syscall.RT_TABLE_MAIN || rtmsg.Type != syscall.RTN_UNICAST || rtmsg.Protocol == RTPROT_GOCURO {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			continue
+		}
+		var prefix, nexthop, metric uint32
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				prefix = byteToUint32(attr.Value)
+			case syscall.RTA_GATEWAY:
+				nexthop = byteToUint32(attr.Value)
+			case syscall.RTA_PRIORITY:
+				if len(attr.Value) == 4 {
+					metric = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+				}
+			}
+		}
+		if nexthop == 0 {
+			continue
+		}
+		ribAddRoute(prefix, uint32(rtmsg.Dst_len), ipRouteEntry{
+			iptype:  network,
+			nexthop: nexthop,
+			source:  routeSourceKernel,
+			metric:  metric,
+		})
+		fmt.Printf("Imported kernel route %s/%d via %s\n", printIPAddr(prefix), rtmsg.Dst_len, printIPAddr(nexthop))
+	}
+	return nil
+}
+
+/*
+経路をカーネルのメインテーブルに追加または削除する
+ブラックホールとリジェクトの経路はカーネルでも同じ種類の経路にする
+*/
+func writeKernelRoute(prefix, prefixLen uint32, route ipRouteEntry, add bool) error {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("create netlink socket err : %s", err)
+	}
+	defer syscall.Close(sock)
+
+	msgType := uint16(syscall.RTM_NEWROUTE)
+	flags := uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+	if !add {
+		msgType = syscall.RTM_DELROUTE
+		flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	}
+
+	rtmsg := syscall.RtMsg{
+		Family:   syscall.AF_INET,
+		Dst_len:  uint8(prefixLen),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: RTPROT_GOCURO,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	switch route.iptype {
+	case blackhole:
+		rtmsg.Type = syscall.RTN_BLACKHOLE
+	case reject:
+		rtmsg.Type = syscall.RTN_UNREACHABLE
+	}
+	body := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&rtmsg))[:]
+	body = append(body, netlinkRouteAttr(syscall.RTA_DST, uint32ToByte(prefix))...)
+	if route.iptype == network {
+		body = append(body, netlinkRouteAttr(syscall.RTA_GATEWAY, uint32ToByte(route.nexthop))...)
+	}
+
+	header := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(body)),
+		Type:  msgType,
+		Flags: flags,
+		Seq:   1,
+	}
+	request := append((*[syscall.NLMSG_HDRLEN]byte)(unsafe.Pointer(&header))[:], body...)
+	err = syscall.Sendto(sock, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return fmt.Errorf("send netlink message err : %s", err)
+	}
+
+	// ACKを受け取って結果を確認する
+	recvBuffer := make([]byte, NETLINK_RECV_BUFFER_SIZE)
+	n, _, err := syscall.Recvfrom(sock, recvBuffer, 0)
+	if err != nil {
+		return fmt.Errorf("netlink recv err : %s", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(recvBuffer[:n])
+	if err != nil {
+		return fmt.Errorf("parse netlink message err : %s", err)
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type == syscall.NLMSG_ERROR && 4 <= len(msg.Data) {
+			errno := *(*int32)(unsafe.Pointer(&msg.Data[0]))
+			if errno != 0 {
+				return fmt.Errorf("write kernel route %s/%d err : %s", printIPAddr(prefix), prefixLen, syscall.Errno(-errno))
+			}
+		}
+	}
+	return nil
+}
+
+// rtattrを作成する
+func netlinkRouteAttr(attrType uint16, value []byte) []byte {
+	attr := syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(value)),
+		Type: attrType,
+	}
+	b := append((*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:], value...)
+	// 4byte境界に揃える
+	for len(b)%syscall.RTA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+/*
+go-curoが登録する経路を追加する
+iptypeはnetwork、blackhole、rejectのどれかで、blackholeとrejectではnexthopを使わない
+distanceが0なら静的経路の既定値の1、大きくすると他の経路が無い時だけ使うフローティングスタティックになる
+同じプレフィックスとネクストホップの経路があれば置き換える
+*/
+func addStaticRoute(prefix, prefixLen uint32, iptype ipRouteType, nexthop uint32, distance uint8, metric uint32) {
+	if iptype != network {
+		nexthop = 0
+	}
+	ribAddRoute(prefix, prefixLen, ipRouteEntry{
+		iptype:   iptype,
+		nexthop:  nexthop,
+		source:   routeSourceStatic,
+		distance: distance,
+		metric:   metric,
+	})
+}
+
+/*
+go-curoが登録した経路を削除する
+nexthopが0ならそのプレフィックスの静的経路を全て削除する、ブラックホールとリジェクトの経路もこれで消す
+*/
+func deleteStaticRoute(prefix, prefixLen, nexthop uint32) error {
+	found := false
+	for _, route := range append([]ipRouteEntry{}, ipRib[ribKey{prefix: prefix, prefixLen: prefixLen}]...) {
+		if route.source != routeSourceStatic || (nexthop != 0 && route.nexthop != nexthop) {
+			continue
+		}
+		ribDeleteRoute(prefix, prefixLen, route)
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("route %s/%d is not found", printIPAddr(prefix), prefixLen)
+	}
+	return nil
+}
+
+/*
+FIBの経路が変わった時に、カーネルへの書き出しが有効ならカーネルのルーティングテーブルにも反映する
+書き出すのはFIBに入った静的経路だけで、静的経路が他の経路に負けたらカーネルからも消す
+*/
+func exportFibChange(prefix, prefixLen uint32, old ipRouteEntry, hadOld bool, new ipRouteEntry, hasNew bool) {
+	// 他のインスタンスの経路はカーネルに書き出さない
+	if !exportKernelRoutes || activeRouterInstance != defaultRouterInstance {
+		return
+	}
+	if hasNew && new.source == routeSourceStatic {
+		err := writeKernelRoute(prefix, prefixLen, new, true)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if new.iptype == network {
+			fmt.Printf("Exported route %s/%d via %s to kernel\n", printIPAddr(prefix), prefixLen, printIPAddr(new.nexthop))
+		} else {
+			fmt.Printf("Exported %s route %s/%d to kernel\n", new.iptype, printIPAddr(prefix), prefixLen)
+		}
+		return
+	}
+	if hadOld && old.source == routeSourceStatic {
+		err := writeKernelRoute(prefix, prefixLen, old, false)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
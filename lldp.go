@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+LLDP(Link Layer Discovery Protocol)
+各インターフェイスから定期的に自分のシャーシとポートを送り、受け取ったLLDPDUで隣接する機器の表を作る
+vethやbridgeで組んだ構成が意図した通りにつながっているかを確認できる
+https://standards.ieee.org/ieee/802.1AB/6047/
+*/
+
+const ETHER_TYPE_LLDP uint16 = 0x88cc
+
+// Nearest Bridgeのマルチキャストアドレス
+var ETHERNET_ADDRESS_LLDP_MULTICAST = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+const (
+	LLDP_TLV_TYPE_END              uint8 = 0
+	LLDP_TLV_TYPE_CHASSIS_ID       uint8 = 1
+	LLDP_TLV_TYPE_PORT_ID          uint8 = 2
+	LLDP_TLV_TYPE_TTL              uint8 = 3
+	LLDP_TLV_TYPE_PORT_DESCRIPTION uint8 = 4
+	LLDP_TLV_TYPE_SYSTEM_NAME      uint8 = 5
+)
+
+const (
+	LLDP_CHASSIS_ID_SUBTYPE_MAC_ADDRESS uint8 = 4
+	LLDP_CHASSIS_ID_SUBTYPE_LOCAL       uint8 = 7
+	LLDP_PORT_ID_SUBTYPE_MAC_ADDRESS    uint8 = 3
+	LLDP_PORT_ID_SUBTYPE_INTERFACE_NAME uint8 = 5
+)
+
+const LLDP_TX_INTERVAL = 30 * time.Second
+
+// 受け取った側が情報を保持する時間、送信間隔の4倍にする
+const LLDP_TTL = 4 * LLDP_TX_INTERVAL
+
+// 隣接する機器
+type lldpNeighbor struct {
+	netdev          *netDevice
+	chassisID       string
+	portID          string
+	portDescription string
+	systemName      string
+	expires         time.Time
+}
+
+var lldpNeighborList []*lldpNeighbor
+
+// LLDPDUを送信するか
+var lldpEnabled bool
+
+// 送信するシャーシIDとシステム名
+var lldpSystemName string
+
+// TLVを1つ作る、先頭の7bitがタイプで残りの9bitが長さ
+func lldpTLV(tlvType uint8, value []byte) []byte {
+	tlv := uint16ToByte(uint16(tlvType)<<9 | uint16(len(value)))
+	return append(tlv, value...)
+}
+
+// インターフェイスから送るLLDPDUを作る、停止する時はttlを0にする
+func lldpPacket(netdev *netDevice, ttl time.Duration) []byte {
+	var packet []byte
+	packet = append(packet, lldpTLV(LLDP_TLV_TYPE_CHASSIS_ID, append([]byte{LLDP_CHASSIS_ID_SUBTYPE_LOCAL}, lldpSystemName...))...)
+	packet = append(packet, lldpTLV(LLDP_TLV_TYPE_PORT_ID, append([]byte{LLDP_PORT_ID_SUBTYPE_INTERFACE_NAME}, netdev.name...))...)
+	packet = append(packet, lldpTLV(LLDP_TLV_TYPE_TTL, uint16ToByte(uint16(ttl/time.Second)))...)
+	if netdev.ipDev.address != 0 {
+		description := fmt.Sprintf("%s %s/%d", netdev.name, printIPAddr(netdev.ipDev.address), subnetToPrefixLen(netdev.ipDev.netmask))
+		packet = append(packet, lldpTLV(LLDP_TLV_TYPE_PORT_DESCRIPTION, []byte(description))...)
+	}
+	packet = append(packet, lldpTLV(LLDP_TLV_TYPE_SYSTEM_NAME, []byte(lldpSystemName))...)
+	packet = append(packet, lldpTLV(LLDP_TLV_TYPE_END, nil)...)
+	return packet
+}
+
+// シャーシIDとポートIDを表示できる文字列にする
+func lldpIDString(subtype uint8, value []byte) string {
+	if (subtype == LLDP_CHASSIS_ID_SUBTYPE_MAC_ADDRESS || subtype == LLDP_PORT_ID_SUBTYPE_MAC_ADDRESS) && len(value) == ETHERNET_ADDRES_LEN {
+		return printMacAddr(setMacAddr(value))
+	}
+	return string(value)
+}
+
+func init() {
+	registerEtherType(ETHER_TYPE_LLDP, func(ctx *inputContext, packet []byte) error {
+		lldpInput(ctx.netdev, packet)
+		return nil
+	})
+}
+
+/*
+LLDPDUの受信処理
+*/
+func lldpInput(inputdev *netDevice, packet []byte) {
+	neighbor := lldpNeighbor{netdev: inputdev}
+	var ttl uint16
+	var hasTTL bool
+	for len(packet) >= 2 {
+		header := byteToUint16(packet[0:2])
+		tlvType := uint8(header >> 9)
+		length := int(header & 0x01ff)
+		if len(packet) < 2+length {
+			break
+		}
+		value := packet[2 : 2+length]
+		packet = packet[2+length:]
+
+		switch tlvType {
+		case LLDP_TLV_TYPE_END:
+			packet = nil
+		case LLDP_TLV_TYPE_CHASSIS_ID:
+			if length > 1 {
+				neighbor.chassisID = lldpIDString(value[0], value[1:])
+			}
+		case LLDP_TLV_TYPE_PORT_ID:
+			if length > 1 {
+				neighbor.portID = lldpIDString(value[0], value[1:])
+			}
+		case LLDP_TLV_TYPE_TTL:
+			if length >= 2 {
+				ttl = byteToUint16(value[0:2])
+				hasTTL = true
+			}
+		case LLDP_TLV_TYPE_PORT_DESCRIPTION:
+			neighbor.portDescription = string(value)
+		case LLDP_TLV_TYPE_SYSTEM_NAME:
+			neighbor.systemName = string(value)
+		}
+	}
+	// 必須のTLVが無ければ破棄する
+	if neighbor.chassisID == "" || neighbor.portID == "" || !hasTTL {
+		countDrop(DROP_REASON_LLDP_INVALID)
+		return
+	}
+
+	now := time.Now()
+	expireLldpNeighbors(now)
+	for i, n := range lldpNeighborList {
+		if n.netdev == inputdev && n.chassisID == neighbor.chassisID && n.portID == neighbor.portID {
+			// TTLが0なら機器が停止したので消す
+			if ttl == 0 {
+				fmt.Printf("LLDP neighbor %s port %s on %s is shut down\n", n.chassisID, n.portID, inputdev.name)
+				lldpNeighborList = append(lldpNeighborList[:i], lldpNeighborList[i+1:]...)
+				return
+			}
+			neighbor.expires = now.Add(time.Duration(ttl) * time.Second)
+			*n = neighbor
+			return
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	neighbor.expires = now.Add(time.Duration(ttl) * time.Second)
+	lldpNeighborList = append(lldpNeighborList, &neighbor)
+	fmt.Printf("New LLDP neighbor %s port %s on %s\n", neighbor.chassisID, neighbor.portID, inputdev.name)
+}
+
+// 期限切れの隣接機器を消す
+func expireLldpNeighbors(now time.Time) {
+	var neighbors []*lldpNeighbor
+	for _, n := range lldpNeighborList {
+		if now.Before(n.expires) {
+			neighbors = append(neighbors, n)
+		}
+	}
+	lldpNeighborList = neighbors
+}
+
+// インターフェイスの隣接機器を全て消す
+func flushLldpNeighbors(netdev *netDevice) {
+	var neighbors []*lldpNeighbor
+	for _, n := range lldpNeighborList {
+		if n.netdev != netdev {
+			neighbors = append(neighbors, n)
+		}
+	}
+	lldpNeighborList = neighbors
+}
+
+/*
+全てのインターフェイスから定期的にLLDPDUを送る
+*/
+func startLldp() {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "go-curo"
+	}
+	lldpSystemName = hostname
+
+	transmit := func() {
+		routerMutex.Lock()
+		defer routerMutex.Unlock()
+		for _, netdev := range netDeviceList {
+			ethernetOutput(netdev, ETHERNET_ADDRESS_LLDP_MULTICAST, lldpPacket(netdev, LLDP_TTL), ETHER_TYPE_LLDP)
+		}
+	}
+	transmit()
+	go func() {
+		ticker := time.NewTicker(LLDP_TX_INTERVAL)
+		for range ticker.C {
+			transmit()
+		}
+	}()
+}
+
+// 停止することを隣接機器に知らせる
+func lldpSendShutdown() {
+	for _, netdev := range netDeviceList {
+		ethernetOutput(netdev, ETHERNET_ADDRESS_LLDP_MULTICAST, lldpPacket(netdev, 0), ETHER_TYPE_LLDP)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+最近のログの行
+ログはfmt.Printfで標準出力に書いているので、標準出力をパイプに差し替えて行を読み取り、
+元の標準出力にそのまま流しながら最後のLOG_BUFFER_LINES行を覚えておく
+シェルに入れない環境でも管理APIのダッシュボードからログを見られるようにする
+syslogが設定されていれば、取り込んだ行をsyslogでも送る
+*/
+
+// 覚えておくログの行数
+const LOG_BUFFER_LINES = 500
+
+type logLine struct {
+	time time.Time
+	text string
+}
+
+var logBufferMutex sync.Mutex
+
+// リングバッファ、logBufferNextに次の行を書く
+var logBuffer []logLine
+var logBufferNext int
+
+// ログの取り込みを止めて、パイプに残っている行を書き出すまで待つ
+var logCaptureStop func()
+
+// 標準出力の行を取り込み始める
+func startLogCapture() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create pipe err : %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				io.WriteString(stdout, line)
+				recordLogLine(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	logCaptureStop = func() {
+		os.Stdout = stdout
+		w.Close()
+		<-done
+	}
+	return nil
+}
+
+func stopLogCapture() {
+	if logCaptureStop != nil {
+		logCaptureStop()
+		logCaptureStop = nil
+	}
+}
+
+func recordLogLine(text string) {
+	if text[len(text)-1] == '\n' {
+		text = text[:len(text)-1]
+	}
+	line := logLine{time: routerNow(), text: text}
+	syslogOutput(line.time, line.text)
+
+	logBufferMutex.Lock()
+	defer logBufferMutex.Unlock()
+	if len(logBuffer) < LOG_BUFFER_LINES {
+		logBuffer = append(logBuffer, line)
+		return
+	}
+	logBuffer[logBufferNext] = line
+	logBufferNext = (logBufferNext + 1) % LOG_BUFFER_LINES
+}
+
+// 最近のn行を古い順に返す
+func recentLogLines(n int) []logLine {
+	logBufferMutex.Lock()
+	defer logBufferMutex.Unlock()
+	lines := make([]logLine, 0, len(logBuffer))
+	lines = append(lines, logBuffer[logBufferNext:]...)
+	lines = append(lines, logBuffer[:logBufferNext]...)
+	if n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ループバックインターフェイス
+物理的なリンクを持たない仮想のnetDeviceで、/32のアドレスをつける
+リンクが落ちても消えないので、管理用のアドレスやOSPF/BGPのルータIDに使う
+パケットを送受信するsocketは無く、ついているアドレス宛てのパケットは他のインターフェイスで受けて自分宛てとして処理する
+*/
+
+// カーネルのloと区別するための名前
+const LOOPBACK_DEVICE_NAME = "lo0"
+
+// コマンドラインで指定されたループバックのアドレス
+var loopbackAddrs []uint32
+
+// コマンドラインで指定されたルータID
+var routerIDFlag uint32
+
+// 設定されたルータID、0ならアドレスから選ぶ
+var configuredRouterID uint32
+
+// "10.255.0.1"か"10.255.0.1/32"を読む
+func parseLoopbackAddr(s string) (uint32, error) {
+	if strings.Contains(s, "/") {
+		prefix, prefixLen, err := parsePrefix(s)
+		if err != nil {
+			return 0, err
+		}
+		if prefixLen != 32 {
+			return 0, fmt.Errorf("loopback address %s must be /32", s)
+		}
+		return prefix, nil
+	}
+	return parseIPAddr(s)
+}
+
+func searchLoopbackDevice() *netDevice {
+	for _, netdev := range netDeviceList {
+		if netdev.backend == loopbackDevice {
+			return netdev
+		}
+	}
+	return nil
+}
+
+/*
+ループバックのアドレスを入れ替える
+最初にアドレスを設定する時にデバイスを作り、アドレスが無くなったら取り除く
+*/
+func setLoopbackAddresses(addrs []uint32) {
+	var ipdev ipDevice
+	for _, addr := range addrs {
+		if addr != 0 && !ipdev.hasAddr(addr) {
+			ipdev.addAddr(newIPInterfaceAddr(addr, 0xffffffff))
+		}
+	}
+
+	netdev := searchLoopbackDevice()
+	if netdev == nil {
+		if ipdev.address == 0 {
+			return
+		}
+		netdev = &netDevice{
+			name:    LOOPBACK_DEVICE_NAME,
+			socket:  -1,
+			backend: loopbackDevice,
+			ipDev:   ipdev,
+		}
+		addConnectedRoute(netdev)
+		netDeviceList = append(netDeviceList, netdev)
+		fmt.Printf("Created loopback device %s address [%s]\n", netdev.name, ipdev.String())
+		return
+	}
+	if ipdev.address == 0 {
+		deleteConnectedRoute(netdev)
+		for i, dev := range netDeviceList {
+			if dev == netdev {
+				netDeviceList = append(netDeviceList[:i], netDeviceList[i+1:]...)
+				break
+			}
+		}
+		fmt.Printf("Removed loopback device %s\n", netdev.name)
+		return
+	}
+	if !ipdev.equal(netdev.ipDev) {
+		setNetDeviceAddress(netdev, ipdev)
+	}
+}
+
+/*
+ルータID
+設定されていなければOSPFと同じように、ループバックで一番大きいアドレス、無ければインターフェイスで一番大きいアドレスを使う
+*/
+func currentRouterID() uint32 {
+	if configuredRouterID != 0 {
+		return configuredRouterID
+	}
+	var loopback, others []uint32
+	for _, netdev := range netDeviceList {
+		for _, addr := range netdev.ipDev.addrs() {
+			if netdev.backend == loopbackDevice {
+				loopback = append(loopback, addr.address)
+			} else {
+				others = append(others, addr.address)
+			}
+		}
+	}
+	for _, addrs := range [][]uint32{loopback, others} {
+		if len(addrs) != 0 {
+			sort.Slice(addrs, func(i, j int) bool { return addrs[i] > addrs[j] })
+			return addrs[0]
+		}
+	}
+	return 0
+}
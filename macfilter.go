@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+インターフェイスごとのプロミスキャスモードとMACアドレスのフィルタ
+NICは自分のMACアドレス宛て、ブロードキャスト、参加したマルチキャストのフレームしか受け取らないので、
+それ以外の宛先のフレームを受け取る時はNICの設定を変える
+  プロミスキャスモード  全ての宛先のフレームを受け取る、ブリッジのポートと-promiscで指定したインターフェイス
+  ユニキャストのフィルタ  追加のMACアドレス宛てのフレームを受け取る、マスターのVRRPの仮想MACアドレスと-mac-allowで指定したアドレス
+どちらもAF_PACKETのsocketにPACKET_ADD_MEMBERSHIPで登録する、カーネルが登録の数を数えるので他のプログラムの設定を壊さず、
+socketを閉じると元に戻る、NICがたまたまプロミスキャスモードになっているかどうかに頼らない
+ethernetInputは自分のMACアドレスに加えて、フィルタに登録したMACアドレス宛てのフレームを自分宛てとして受け取る
+プロミスキャスモードでもブリッジのポート以外では自分宛てでないフレームは破棄する
+*/
+
+// syscallに定義が無いので、linux/if_packet.hの値を使う
+const PACKET_MR_UNICAST = 3
+
+// コマンドラインで指定されたプロミスキャスモードにするインターフェイス
+var promiscInterfaces = map[string]bool{}
+
+// コマンドラインで指定されたインターフェイスごとの追加で受け取るMACアドレス
+var macAllowFlags = map[string][][6]uint8{}
+
+// "eth1=02:00:00:00:00:10+02:00:00:00:00:11"を読む
+func parseMacAllowConfig(s string) (string, [][6]uint8, error) {
+	name, list, found := strings.Cut(s, "=")
+	if !found || name == "" || list == "" {
+		return "", nil, fmt.Errorf("invalid mac allow list %q, format is ifname=mac+mac", s)
+	}
+	macs, err := parseMacAllowList(strings.Split(list, "+"))
+	if err != nil {
+		return "", nil, err
+	}
+	return name, macs, nil
+}
+
+func parseMacAllowList(list []string) ([][6]uint8, error) {
+	var macs [][6]uint8
+	for _, s := range list {
+		mac, err := parseGenMac(s)
+		if err != nil {
+			return nil, err
+		}
+		if mac[0]&0x01 != 0 {
+			return nil, fmt.Errorf("%s is not unicast mac address", s)
+		}
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// インターフェイスに指定されたプロミスキャスモードと追加のMACアドレスを設定してフィルタを更新する
+func setNetDeviceMacFilter(netdev *netDevice, promisc bool, allow [][6]uint8) {
+	netdev.promiscConfig = promisc
+	netdev.macAllowConfig = allow
+	updateMacFilter(netdev)
+}
+
+/*
+今の設定に合わせてプロミスキャスモードとユニキャストのフィルタを登録し直す
+ブリッジのポートの追加と削除、VRRPの状態が変わった時にも呼ぶ
+*/
+func updateMacFilter(netdev *netDevice) {
+	promisc := netdev.promiscConfig || netdev.bridge != nil
+	if promisc != netdev.promisc {
+		if err := netdev.packetMembership(promisc, syscall.PACKET_MR_PROMISC, [6]uint8{}); err != nil {
+			fmt.Printf("set promiscuous mode of %s err : %s\n", netdev.name, err)
+		} else {
+			netdev.promisc = promisc
+			if promisc {
+				fmt.Printf("Enabled promiscuous mode on %s\n", netdev.name)
+			} else {
+				fmt.Printf("Disabled promiscuous mode on %s\n", netdev.name)
+			}
+		}
+	}
+
+	wanted := map[[6]uint8]bool{}
+	for _, mac := range netdev.macAllowConfig {
+		wanted[mac] = true
+	}
+	for _, vr := range vrrpRouters {
+		if vr.netdev == netdev && vr.state == vrrpStateMaster {
+			wanted[vrrpMacAddr(vr.config.vrid)] = true
+		}
+	}
+	for mac := range netdev.macFilter {
+		if !wanted[mac] {
+			if err := netdev.packetMembership(false, PACKET_MR_UNICAST, mac); err != nil {
+				fmt.Printf("remove %s from mac filter of %s err : %s\n", printMacAddr(mac), netdev.name, err)
+			}
+			delete(netdev.macFilter, mac)
+			debugPrintf("Removed %s from mac filter of %s\n", printMacAddr(mac), netdev.name)
+		}
+	}
+	for mac := range wanted {
+		if netdev.macFilter[mac] {
+			continue
+		}
+		// NICに登録できなくても、届いたフレームは受け取れるようにソフトウェアのフィルタには入れる
+		if err := netdev.packetMembership(true, PACKET_MR_UNICAST, mac); err != nil {
+			fmt.Printf("add %s to mac filter of %s err : %s\n", printMacAddr(mac), netdev.name, err)
+		}
+		if netdev.macFilter == nil {
+			netdev.macFilter = map[[6]uint8]bool{}
+		}
+		netdev.macFilter[mac] = true
+		debugPrintf("Added %s to mac filter of %s\n", printMacAddr(mac), netdev.name)
+	}
+}
+
+/*
+AF_PACKETのsocketにメンバーシップを登録するか外す
+tapデバイスには届いたフレームが全て渡り、AF_XDPのsocketでは登録できないので、packet socket以外では何もしない
+*/
+func (netdev *netDevice) packetMembership(add bool, mrType uint16, mac [6]uint8) error {
+	if netdev.backend != packetSocket {
+		return nil
+	}
+	mreq := struct {
+		ifindex int32
+		mrType  uint16
+		alen    uint16
+		address [8]uint8
+	}{
+		ifindex: int32(netdev.sockAddr.Ifindex),
+		mrType:  mrType,
+	}
+	if mrType == PACKET_MR_UNICAST || mrType == syscall.PACKET_MR_MULTICAST {
+		mreq.alen = ETHERNET_ADDRES_LEN
+		copy(mreq.address[:], mac[:])
+	}
+	opt := syscall.PACKET_ADD_MEMBERSHIP
+	if !add {
+		opt = syscall.PACKET_DROP_MEMBERSHIP
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(netdev.socket), syscall.SOL_PACKET,
+		uintptr(opt), uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// フィルタに登録したMACアドレスを文字列にする
+func (netdev *netDevice) macFilterStrings() []string {
+	var macs []string
+	for mac := range netdev.macFilter {
+		macs = append(macs, hardwareAddr(mac).String())
+	}
+	sort.Strings(macs)
+	return macs
+}
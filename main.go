@@ -6,53 +6,187 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type netDevice struct {
-	name       string
-	macAddr    [6]uint8
-	socket     int
-	sockAddr   syscall.SockaddrLinklayer
-	etheHeader ethernetHeader
-	ipDev      ipDevice
+	name     string
+	macAddr  [6]uint8
+	socket   int
+	sockAddr syscall.SockaddrLinklayer
+	ipDev    ipDevice
+	backend  netDeviceBackend
+	stats    netDeviceStats
+	// 受信したインターフェイスにフォワードする時にICMP Redirectを送るか
+	icmpRedirect bool
+	// ポートになっているブリッジ、nilならルーティングする
+	bridge *bridge
+	// PPPoEのセッションを張っているクライアント、nilならイーサネットで直接送る
+	pppoe *pppoeClient
+	// 送信のシェーピングと受信のポリシング、nilなら制限しない
+	shaper   *tokenBucket
+	policer  *tokenBucket
+	txQueues qosQueues // シェーピングで送信を待っているフレーム
+	// sendmmsgでまとめて送るのを待っているフレーム
+	txPending [][]byte
+	// AF_XDPのsocket、xdpSocketのバックエンドで使う
+	xsk *xskSocket
+	// 指定されたプロミスキャスモードと追加で受け取るMACアドレス
+	promiscConfig  bool
+	macAllowConfig [][6]uint8
+	// socketに登録しているプロミスキャスモードとユニキャストのMACアドレス
+	promisc   bool
+	macFilter map[[6]uint8]bool
+	// 管理上止めているか、リンクが落ちているか
+	adminDown bool
+	linkDown  bool
+	// 受信したパケットの送信元アドレスを検証するuRPFのモード
+	urpf urpfMode
+	// ICMPのTimestamp RequestとAddress Mask Requestに答えるか
+	icmpTimestamp bool
+	icmpMaskReply bool
+	// 64:ff9b::/96宛てのIPv6のパケットをNAT64で変換するか
+	nat64 bool
+	// 受信したTCP/UDPのチェックサムを検証するか、ethtoolで調べたチェックサムオフロード
+	checksumPolicy    checksumPolicy
+	rxChecksumOffload bool
+	txChecksumOffload bool
+	// 送信の遅延と損失のエミュレーション、nilなら無効
+	impairment  *impairment
+	impairQueue []impairedFrame
+	// sFlowでサンプリングの対象にしたパケットの数と、次にサンプリングするまでの数
+	sflowPool uint32
+	sflowSkip uint32
+}
+
+// インターフェイスごとの統計情報
+type netDeviceStats struct {
+	rxPackets          uint64 // 受信したフレームの数
+	rxBytes            uint64 // 受信したバイト数
+	txPackets          uint64 // 送信したフレームの数
+	txBytes            uint64 // 送信したバイト数
+	ipChecksumErrors   uint64 // ヘッダのチェックサムが不正で破棄したIPパケットの数
+	icmpChecksumErrors uint64 // チェックサムが不正で破棄したICMPパケットの数
+	rxPoliced          uint64 // ポリシングのレートを超えて破棄したフレームの数
+	txQueueDrops       uint64 // 送信キューが溢れて破棄したフレームの数
+	txErrors           uint64 // 送信に失敗して破棄したフレームの数
+	urpfDrops          uint64 // uRPFで戻りの経路が無く破棄したIPパケットの数
+	dscpRemarked       uint64 // ポリシーでDSCPを書き換えたIPパケットの数
+	impairLost         uint64 // 損失のエミュレーションで破棄したフレームの数
 }
 
+// netDeviceがパケットを読み書きする方法
+type netDeviceBackend uint8
+
+const (
+	packetSocket   netDeviceBackend = iota // AF_PACKETのraw socket
+	tapDevice                              // tun/tapドライバのtapデバイス
+	loopbackDevice                         // socketを持たない仮想のループバック
+	xdpSocket                              // XDPでカーネルを通さずに受信するAF_XDPのsocket
+)
+
 type radixTreeNode struct {
 	depth  int
 	parent *radixTreeNode
 	node0  *radixTreeNode // 0を入れる左のノード
 	node1  *radixTreeNode // 1を入れる右のノード
 	data   ipRouteEntry
-	value  int
+	// 経路が登録されているか、dataがゼロ値の経路と経路が無いことを区別する
+	hasRoute bool
+	value    int
 }
 
-func (node *radixTreeNode) radixTreeSearch(prefixIpAddr uint32) ipRouteEntry {
+/*
+最長一致で経路を検索する
+経路が無ければfalseを返す、ルートノードの経路(0.0.0.0/0)はデフォルト経路として全ての宛先に一致する
+*/
+func (node *radixTreeNode) radixTreeSearch(prefixIpAddr uint32) (ipRouteEntry, bool) {
 	current := node
 	var result ipRouteEntry
+	var found bool
 	// 検索するIPアドレスと比較して1ビットずつ辿っていく
 	for i := 1; i <= 32; i++ {
-		if current.data != (ipRouteEntry{}) {
-			result = current.data
+		if current.hasRoute {
+			result, found = current.data, true
 		}
 		if (prefixIpAddr>>(32-i))&0x01 == 1 { // 上からiビット目が1だったら
 			if current.node1 == nil {
-				return result
+				return result, found
 			}
 			current = current.node1
 		} else { // iビット目が0だったら
 			if current.node0 == nil {
-				return result
+				return result, found
 			}
 			current = current.node0
 		}
 	}
-	return result
+	// 32ビット目まで辿ったノードは/32の経路
+	if current.hasRoute {
+		result, found = current.data, true
+	}
+	return result, found
+}
+
+/*
+最長一致した経路のプレフィックス長を返す
+経路の入ったノードの深さがプレフィックス長になる
+*/
+func (node *radixTreeNode) radixTreeMatchedPrefixLen(prefixIpAddr uint32) (uint32, bool) {
+	current := node
+	var prefixLen uint32
+	var found bool
+	for current != nil {
+		if current.hasRoute {
+			prefixLen, found = uint32(current.depth), true
+		}
+		if current.depth == 32 {
+			break
+		}
+		if (prefixIpAddr>>(31-current.depth))&0x01 == 1 {
+			current = current.node1
+		} else {
+			current = current.node0
+		}
+	}
+	return prefixLen, found
 }
 
 var iproute radixTreeNode
 var netDeviceList []*netDevice
 
+// gRPCの管理APIのアドレス
+var grpcAddr string
+
+// HTTPの管理APIのアドレスと認証のtoken
+var adminAddr string
+var adminToken string
+
+// デフォルト経路のネクストホップ、0なら登録しない
+var defaultGateway uint32
+
+// ICMP Redirectを送らないインターフェイス
+var icmpRedirectDisabled = map[string]bool{}
+
+// ICMPのTimestamp RequestとAddress Mask Requestに答えるインターフェイス
+// 時刻とサブネットの情報を外に見せることになるので、指定したインターフェイスだけ答える
+var icmpTimestampInterfaces = map[string]bool{}
+var icmpMaskReplyInterfaces = map[string]bool{}
+
+// デバッグログを出力するか
+var debug bool
+
+func debugPrintf(format string, a ...any) {
+	if debug {
+		fmt.Printf(format, a...)
+	}
+}
+
 func byteToUint32(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
@@ -64,48 +198,117 @@ const ETHERNET_ADDRES_LEN = 6
 
 var ETHERNET_ADDRESS_BROADCAST = [6]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
+/*
+デバイスに届いているフレームを読んで受信処理をする
+受信のバッファは受信処理が終わったらプールに返す
+*/
 func (netDev *netDevice) netDevicePoll(mode string) error {
-	recvBuffer := make([]byte, 1500)
-	n, _, err := syscall.Recvfrom(netDev.socket, recvBuffer, 0)
-	if err != nil {
-		if n == -1 {
-			return nil
-		} else {
+	if netDev.backend == xdpSocket {
+		// AF_XDPのフレームにはチェックサムの状態が付かないので、受信のチェックサムオフロードが有効なら計算途中として扱う
+		partial := netDev.rxChecksumOffload && netDev.checksumPolicy != checksumSkip
+		netDev.xsk.receive(func(frame []byte) {
+			netDev.netDeviceReceive(mode, frame, partial)
+		})
+		return nil
+	}
+
+	batch := rxBatchPool.Get().(*rxBatch)
+	defer rxBatchPool.Put(batch)
+
+	if netDev.backend == tapDevice {
+		n, err := syscall.Read(netDev.socket, batch.bufs[0][:])
+		if err != nil {
+			if n == -1 {
+				return nil
+			}
 			return fmt.Errorf("recv err, n is %d, device is %s, err is %s", n, netDev.name, err)
 		}
+		// tapに書くカーネルはチェックサムを計算し終えてから渡す
+		netDev.netDeviceReceive(mode, batch.bufs[0][:n], false)
+		return nil
 	}
 
-	if mode == "ch1" {
-		fmt.Printf("Received %d bytes from %s: %x\n", n, netDev.name, recvBuffer[:n])
-	} else {
-		ethernetInput(netDev, recvBuffer[:n])
+	n, err := batch.recvmmsg(netDev.socket)
+	if err != nil {
+		// 読むフレームが無い時や、作ったばかりでまだリンクが上がっていないデバイスではエラーになるが、止めずに次の通知を待つ
+		if err != syscall.EAGAIN {
+			debugPrintf("recv err, device is %s, err is %s\n", netDev.name, err)
+		}
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		// 自分が送信したフレームもpacket socketで受け取るので無視する
+		if batch.outgoing(i) {
+			continue
+		}
+		netDev.netDeviceReceive(mode, batch.frame(i), batch.checksumPartial(i))
 	}
-
 	return nil
 }
 
+// 受信した1つのフレームの処理、checksumPartialはTCP/UDPのチェックサムが計算途中のフレームか
+func (netDev *netDevice) netDeviceReceive(mode string, frame []byte, checksumPartial bool) {
+	netDev.stats.rxPackets++
+	netDev.stats.rxBytes += uint64(len(frame))
+	if !qosPolice(netDev, len(frame)) {
+		return
+	}
+
+	if mode == "ch1" {
+		fmt.Printf("Received %d bytes from %s: %x\n", len(frame), netDev.name, frame)
+	} else if err := ethernetInput(&inputContext{netdev: netDev, checksumPartial: checksumPartial}, frame); err != nil {
+		// 破棄したパケットは理由ごとに数えているので、ここではデバッグの時だけ出力する
+		debugPrintf("%s in %s\n", err, netDev.name)
+	}
+}
+
 func byteToUint16(b []byte) uint16 {
 	return binary.BigEndian.Uint16(b)
 }
 
-// イーサネットの受信処理
-func ethernetInput(netdev *netDevice, packet []byte) {
+/*
+イーサネットの受信処理
+受信したフレームはどの長さでも受け取るので、ヘッダを読む前に長さを確認する
+破棄した時は理由をエラーとして返す
+*/
+func ethernetInput(ctx *inputContext, packet []byte) error {
+	netdev := ctx.netdev
+	// イーサネットヘッダより短かったらドロップ
+	if len(packet) < 14 {
+		return dropPacket(DROP_REASON_FRAME_TOO_SHORT)
+	}
+	// ブリッジのポートならL2で転送する、ただしLLDPなどのブリッジが転送しない宛先は自分で処理する
+	if netdev.bridge != nil {
+		destAddr := setMacAddr(packet[0:6])
+		if destAddr == ETHERNET_ADDRESS_STP_MULTICAST {
+			stpInput(netdev, packet)
+			return nil
+		}
+		if !isBridgeReservedMacAddr(destAddr) {
+			bridgeInput(netdev, packet)
+			return nil
+		}
+	}
 	// 送られてきた通信をイーサネットのフレームとして解釈する
-	netdev.etheHeader.destAddr = setMacAddr(packet[0:6])
-	netdev.etheHeader.srcAddr = setMacAddr(packet[6:12])
-	netdev.etheHeader.etherType = byteToUint16(packet[12:14])
+	ctx.ethHeader = ethernetHeader{
+		destAddr:  setMacAddr(packet[0:6]),
+		srcAddr:   setMacAddr(packet[6:12]),
+		etherType: byteToUint16(packet[12:14]),
+	}
+	destAddr := ctx.ethHeader.destAddr
 	// 自分のMACアドレス宛てかブロードキャストの通信かを確認する
-	if netdev.macAddr != netdev.etheHeader.destAddr && netdev.etheHeader.destAddr != ETHERNET_ADDRESS_BROADCAST {
-		// 自分のMACアドレス宛てかブロードキャストでなければ return する
-		return
+	if netdev.macAddr != destAddr && destAddr != ETHERNET_ADDRESS_BROADCAST &&
+		destAddr != ETHERNET_ADDRESS_LLDP_MULTICAST && !acceptMulticastMacAddr(netdev, destAddr) &&
+		!raAcceptMacAddr(netdev, destAddr) && !netdev.macFilter[destAddr] {
+		// 自分のMACアドレス宛てかブロードキャストでなければドロップ
+		return dropPacket(DROP_REASON_NOT_FOR_US)
 	}
 	// イーサタイプの値から上位プロトコルを特定する
-	switch netdev.etheHeader.etherType {
-	case ETHER_TYPE_ARP:
-		arpInput(netdev, packet[14:])
-	case ETHER_TYPE_IP:
-		ipInput(netdev, packet[14:])
+	handler, ok := lookupEtherTypeHandler(ctx.ethHeader.etherType)
+	if !ok {
+		return dropPacket(DROP_REASON_UNSUPPORTED_ETHER_TYPE)
 	}
+	return handler(ctx, packet[14:])
 }
 
 type ethernetHeader struct {
@@ -114,6 +317,14 @@ type ethernetHeader struct {
 	etherType uint16
 }
 
+// 受信したフレームの情報、受信処理の関数に順に渡していく
+type inputContext struct {
+	netdev    *netDevice     // 受信したインターフェイス
+	ethHeader ethernetHeader // イーサネットヘッダ、PPPoEやIPsecで取り出したパケットでは外側のもの
+	// TCP/UDPのチェックサムが計算途中で届いたか、フォワードする時に計算し直す
+	checksumPartial bool
+}
+
 var IgnoreInterfaces = []string{"lo", "bond0", "dummy0", "tunl0", "sit0"}
 
 func isIgnoreInterfaces(name string) bool {
@@ -204,15 +415,42 @@ func runChapter1() {
 	}
 }
 
-func runChapter2(mode string) {
+func runChapter2(mode, backend, tapSpec string) {
+	// 管理APIのダッシュボードで最近のログを見られるように、またsyslogで送れるように、標準出力を取り込む
+	// 終了する時は取り込みを止めてから、syslogで送り切る
+	defer stopSyslog()
+	defer stopLogCapture()
+	if adminAddr != "" || syslogFlagConfig.server != "" {
+		if err := startLogCapture(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// 直接接続ではないhost2へのルーティングを登録する
-	routeEntryTohost2 := ipRouteEntry{
-		iptype:  network,
-		nexthop: 0xc0a80002,
+	// 設定ファイルを読み込む
+	var config *routerConfig
+	var err error
+	if configPath != "" {
+		config, err = loadRouterConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config.backend != "" {
+			backend = config.backend
+		}
+		config.backend = backend
+		// 起動時のログも送れるように、syslogは最初に設定する
+		setSyslog(config.syslogConfig())
+	} else {
+		setSyslog(syslogFlagConfig)
+		// 直接接続ではないhost2へのルーティングを登録する
+		// 192.168.2.0/24の経路の登録
+		addStaticRoute(0xc0a80202&0xffffff00, 24, network, 0xc0a80002, 0, 0)
+		// 0.0.0.0/0の経路はradix treeのルートノードに入り、他に一致する経路が無い宛先に使われる
+		if defaultGateway != 0 {
+			addStaticRoute(0, 0, network, defaultGateway, 0, 0)
+			fmt.Printf("Set default route via %s\n", printIPAddr(defaultGateway))
+		}
 	}
-	// 192.168.2.0/24の経路の登録
-	iproute.radixTreeAdd(0xc0a80202&0xffffff00, 24, routeEntryTohost2)
 
 	// epoll作成
 	events := make([]syscall.EpollEvent, 10)
@@ -220,97 +458,756 @@ func runChapter2(mode string) {
 	if err != nil {
 		log.Fatalf("epoll create err : %s", err)
 	}
+	routerEpfd = epfd
 
-	// ネットワークインターフェイスの情報を取得
-	interfaces, _ := net.Interfaces()
-	for _, netif := range interfaces {
-		// 無視するインターフェイスか確認
-		if !isIgnoreInterfaces(netif.Name) {
-			// socketをオープン
-			sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
-			if err != nil {
-				log.Fatalf("create socket err : %s", err)
-			}
-			// socketにインターフェイスをbindする
-			addr := syscall.SockaddrLinklayer{
-				Protocol: htons(syscall.ETH_P_ALL),
-				Ifindex:  netif.Index,
-			}
-			err = syscall.Bind(sock, &addr)
-			if err != nil {
-				log.Fatalf("bind err : %s", err)
-			}
-			fmt.Printf("Created device %s socket %d adddress %s\n",
-				netif.Name, sock, netif.HardwareAddr.String())
-			// socketをepollの監視対象として登録
-			err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, sock, &syscall.EpollEvent{
-				Events: syscall.EPOLLIN,
-				Fd:     int32(sock),
-			})
-			// ノンブロッキングに設定←epollを使うのでしない
-			//err = syscall.SetNonblock(sock, true)
-			//if err != nil {
-			//	log.Fatalf("set non block is err : %s", err)
-			//}
-			netaddrs, err := netif.Addrs()
-			if err != nil {
-				log.Fatalf("get ip addr from nic interface is err : %s", err)
-			}
+	// インターフェイスの追加と削除、アドレスの変更を監視するnetlinkのsocket
+	netlinkSock := -1
+	switch backend {
+	case "packet", "xdp":
+		if backend == "xdp" {
+			newInterfaceNetDevice = newXdpNetDevice
+		}
+		setupPacketSocketDevices(epfd)
+		netlinkSock, err = openNetlinkSocket(RTMGRP_LINK | RTMGRP_IPV4_IFADDR)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, netlinkSock, &syscall.EpollEvent{
+			Events: syscall.EPOLLIN,
+			Fd:     int32(netlinkSock),
+		})
+		if err != nil {
+			log.Fatalf("epoll ctrl err : %s", err)
+		}
+	case "tun":
+		// 設定ファイルがあればtapデバイスは設定の反映時に作る
+		if tapSpec != "" || config == nil {
+			setupTapDevices(epfd, tapSpec)
+		}
+	default:
+		log.Fatalf("unknown backend %s", backend)
+	}
 
-			netdev := netDevice{
-				name:     netif.Name,
-				macAddr:  setMacAddr(netif.HardwareAddr),
-				socket:   sock,
-				sockAddr: addr,
-				ipDev:    getIPdevice(netaddrs),
-			}
+	// 同じプロセスで動かす他のルータのインスタンス
+	if len(routerInstances) != 0 {
+		err = setupRouterInstances(epfd, backend)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			// 直接接続ネットワークの経路をルートテーブルのエントリに設定
-			routeEntry := ipRouteEntry{
-				iptype: connected,
-				netdev: &netdev,
-			}
-			prefixLen := subnetToPrefixLen(netdev.ipDev.netmask)
-			iproute.radixTreeAdd(netdev.ipDev.address&netdev.ipDev.netmask, prefixLen, routeEntry)
-			fmt.Printf("Set directly connected route %s/%d via %s\n",
-				printIPAddr(netdev.ipDev.address&netdev.ipDev.netmask), prefixLen, netdev.name)
+	// ブリッジを作る
+	if len(bridgeConfigs) != 0 {
+		setBridges(bridgeConfigs)
+	}
+	startStpTimer()
 
-			// netDevice構造体を作成
-			// net_deviceの連結リストに連結させる
-			netDeviceList = append(netDeviceList, &netdev)
+	// ループバックのアドレスとルータID
+	if len(loopbackAddrs) != 0 {
+		setLoopbackAddresses(loopbackAddrs)
+	}
+	configuredRouterID = routerIDFlag
+
+	// 静的なARPエントリ
+	if len(staticArpConfigs) != 0 {
+		setStaticArpEntries(staticArpConfigs)
+	}
+
+	// VRRPの仮想ルータを動かす
+	if len(vrrpConfigs) != 0 {
+		setVrrpRouters(vrrpConfigs)
+	}
+	startVrrpTimer()
+
+	// IPv6のルータ広告を送る
+	if len(raConfigs) != 0 {
+		updateRouterAdvertisements()
+	}
+	startRaTimer()
+
+	// IPsecのトンネルの経路を入れる
+	if len(espTunnelConfigs) != 0 {
+		setEspTunnels(espTunnelConfigs)
+	}
+
+	// 設定を反映してSIGHUPで読み直せるようにする
+	if config != nil {
+		applyRouterConfig(epfd, nil, config)
+		currentConfig = config
+		watchConfigReload(epfd)
+	} else {
+		setDnsForwarder(dnsUpstreams, dnsHosts, dns64Enabled)
+		setNtp(ntpServers, ntpServe)
+		setSnmpAgent(snmpCommunity)
+		setSflow(sflowFlagConfig)
+		setIgmpProxy(igmpProxyFlagConfig)
+		setFlowTableSize(flowTableSize)
+		setPppoe(pppoeInterface, pppoeUsername, pppoePassword)
+		setDhcpv6Pd(dhcpv6PdInterface, dhcpv6PdLanInterfaces, dhcpv6PdHint)
+	}
+	startNtpClient()
+	startPppoeTimer()
+	startDhcpv6Timer()
+	startSflowTimer()
+
+	// 前回停止した時の状態を読み戻す
+	if stateFile != "" {
+		err = loadRouterState(stateFile, stateMaxAge)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	// 書き出しておいたARPテーブルとルートテーブルを読み込む
+	if loadTablesFile != "" {
+		err = loadTables(loadTablesFile)
+		if err != nil {
+			log.Fatalf("load tables err : %s", err)
 		}
 	}
 
+	// 管理APIを起動する
+	if grpcAddr != "" {
+		err = startGrpcServer(grpcAddr)
+		if err != nil {
+			log.Fatalf("start grpc server err : %s", err)
+		}
+		fmt.Printf("gRPC server is listening on %s\n", grpcAddr)
+	}
+	if adminAddr != "" {
+		err = startAdminAPIServer(adminAddr, adminToken)
+		if err != nil {
+			log.Fatalf("start admin api server err : %s", err)
+		}
+		fmt.Printf("Admin API server is listening on %s\n", adminAddr)
+	}
+
+	// カーネルの経路を取り込む
+	if importKernelRoutes {
+		err = loadKernelRoutes()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// IGMPのクエリアを起動する
+	startIgmpQuerier()
+
+	// LLDPの送信を開始する
+	if lldpEnabled {
+		startLldp()
+	}
+
+	// 停止のシグナルを受け取るpipe
+	shutdownFd, err := openShutdownPipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, shutdownFd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(shutdownFd),
+	})
+	if err != nil {
+		log.Fatalf("epoll ctrl err : %s", err)
+	}
+
 	fmt.Printf("mode is %s start router...\n", mode)
 
+	// シェーピングの送信キューにフレームがあれば送れるようになるまでの時間だけ待つ
+	timeout := -1
 	for {
 		// epoll_waitでパケットの受信を待つ
-		nfds, err := syscall.EpollWait(epfd, events, -1)
+		nfds, err := syscall.EpollWait(epfd, events, timeout)
 		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
 			log.Fatalf("epoll wait err : %s", err)
 		}
+		// 管理APIと同時にテーブルを触らないようにする
+		routerMutex.Lock()
+		// 受信したパケットを全て処理してから、送信をまとめて行う
+		txBatching = true
 		for i := 0; i < nfds; i++ {
+			// 停止のシグナルを受信
+			if events[i].Fd == int32(shutdownFd) {
+				txBatching = false
+				eachRouterInstance(func(inst *routerInstance) { flushTxQueues() })
+				if netlinkSock != -1 {
+					syscall.Close(netlinkSock)
+				}
+				shutdownRouter(epfd)
+				routerMutex.Unlock()
+				return
+			}
+			// インターフェイスの変化を受信
+			if events[i].Fd == int32(netlinkSock) {
+				err := netlinkInput(epfd, netlinkSock)
+				if err != nil {
+					fmt.Println(err)
+				}
+				continue
+			}
 			// デバイスから通信を受信
-			for _, netdev := range netDeviceList {
-				// イベントがあったソケットとマッチしたらパケットを読み込む処理を実行
-				if events[i].Fd == int32(netdev.socket) {
-					err := netdev.netDevicePoll(mode)
-					if err != nil {
-						log.Fatal(err)
-					}
+			// イベントがあったソケットのインスタンスに切り替えてパケットを読み込む処理を実行
+			if inst, netdev := searchNetDeviceBySocket(events[i].Fd); netdev != nil {
+				inst.activate()
+				// 読めなくなったデバイスがあっても、他のインターフェイスの処理は続ける
+				err := netdev.netDevicePoll(mode)
+				if err != nil {
+					fmt.Println(err)
 				}
 			}
 		}
+		defaultRouterInstance.activate()
+		txBatching = false
+		// socketのバッファが一杯で送れなかったフレームは少し待って送り直す
+		wait := transmitRouterInstances(time.Now())
+		timeout = -1
+		if wait >= 0 {
+			timeout = int((wait + time.Millisecond - 1) / time.Millisecond)
+		}
+		routerMutex.Unlock()
+	}
+}
+
+// NICからnetDeviceを作る関数、-backend xdpならAF_XDPのsocketを使う
+var newInterfaceNetDevice = newPacketSocketNetDevice
+
+// 物理NICごとにAF_PACKETかAF_XDPのsocketを作成してnetDeviceを登録する
+func setupPacketSocketDevices(epfd int) {
+	// ネットワークインターフェイスの情報を取得
+	interfaces, _ := net.Interfaces()
+	for _, netif := range interfaces {
+		// 無視するインターフェイスか確認
+		if !isIgnoreInterfaces(netif.Name) {
+			netdev, err := newInterfaceNetDevice(netif)
+			if err != nil {
+				log.Fatal(err)
+			}
+			netdev.linkDown = !netifOperUp(netif)
+			err = registerNetDevice(epfd, netdev)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// インターフェイスにbindしたAF_PACKETのsocketを作成してnetDevice構造体を作成する
+func newPacketSocketNetDevice(netif net.Interface) (*netDevice, error) {
+	// socketをオープン
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("create socket err : %s", err)
+	}
+	// socketにインターフェイスをbindする
+	addr := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  netif.Index,
+	}
+	err = syscall.Bind(sock, &addr)
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("bind err : %s", err)
+	}
+	// 受信したフレームごとにチェックサムが計算途中かを受け取る
+	err = unix.SetsockoptInt(sock, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1)
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("setsockopt PACKET_AUXDATA err : %s", err)
+	}
+	fmt.Printf("Created device %s socket %d adddress %s\n",
+		netif.Name, sock, netif.HardwareAddr.String())
+	// ノンブロッキングに設定←epollを使うのでしない
+	//err = syscall.SetNonblock(sock, true)
+	//if err != nil {
+	//	log.Fatalf("set non block is err : %s", err)
+	//}
+	netaddrs, err := netif.Addrs()
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("get ip addr from nic interface is err : %s", err)
+	}
+
+	return &netDevice{
+		name:     netif.Name,
+		macAddr:  setMacAddr(netif.HardwareAddr),
+		socket:   sock,
+		sockAddr: addr,
+		ipDev:    getIPdevice(netaddrs),
+	}, nil
+}
+
+// 指定されたtapデバイスを作成してnetDeviceを登録する
+func setupTapDevices(epfd int, tapSpec string) {
+	configs, err := parseTapDeviceConfig(tapSpec)
+	if err != nil {
+		log.Fatalf("tap device config err : %s", err)
+	}
+	for _, config := range configs {
+		netdev, err := newTapNetDevice(config)
+		if err != nil {
+			log.Fatalf("create tap device err : %s", err)
+		}
+		fmt.Printf("Created tap device %s fd %d adddress %s\n",
+			netdev.name, netdev.socket, printMacAddr(netdev.macAddr))
+		err = registerNetDevice(epfd, netdev)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+/*
+netDeviceをepollの監視対象に加え、直接接続ネットワークの経路を登録する
+*/
+func registerNetDevice(epfd int, netdev *netDevice) error {
+	// -shutdownで指定されたインターフェイスは受信しないのでepollに登録しない
+	netdev.adminDown = shutdownInterfaces[netdev.name]
+	if netdev.adminDown {
+		fmt.Printf("Interface %s is administratively down\n", netdev.name)
+	} else {
+		// socketをepollの監視対象として登録
+		err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, netdev.socket, &syscall.EpollEvent{
+			Events: syscall.EPOLLIN,
+			Fd:     int32(netdev.socket),
+		})
+		if err != nil {
+			return fmt.Errorf("epoll ctrl err : %s", err)
+		}
+	}
+
+	// 直接接続ネットワークの経路をルートテーブルのエントリに設定
+	addConnectedRoute(netdev)
+
+	netdev.icmpRedirect = !icmpRedirectDisabled[netdev.name]
+	netdev.icmpTimestamp = icmpTimestampInterfaces[netdev.name]
+	netdev.icmpMaskReply = icmpMaskReplyInterfaces[netdev.name]
+	netdev.nat64 = nat64Interfaces[netdev.name]
+	netdev.urpf = urpfFlags[netdev.name]
+	netdev.checksumPolicy = checksumPolicyFlags[netdev.name]
+	detectChecksumOffload(netdev)
+	setNetDeviceQosFromFlags(netdev)
+	setNetDeviceImpairmentFromFlags(netdev)
+	setNetDeviceMacFilter(netdev, promiscInterfaces[netdev.name], macAllowFlags[netdev.name])
+
+	// netDevice構造体を作成
+	// net_deviceの連結リストに連結させる
+	netDeviceList = append(netDeviceList, netdev)
+	// 処理しないフレームをカーネルで捨てる
+	netdev.updateSocketFilter()
+	return nil
+}
+
+/*
+netDeviceを取り除く
+socketを閉じて、経路とARPテーブルからこのデバイスのものを消す
+*/
+func unregisterNetDevice(epfd int, netdev *netDevice) {
+	syscall.EpollCtl(epfd, syscall.EPOLL_CTL_DEL, netdev.socket, nil)
+	netdev.closeSocket()
+	netdev.txPending = nil
+
+	deleteConnectedRoute(netdev)
+	flushArpTableEntry(netdev)
+	flushMulticastMembership(netdev)
+	flushLldpNeighbors(netdev)
+	bridgeDeletePort(netdev)
+	vrrpDeviceRemoved(netdev)
+	pppoeDeviceRemoved(netdev)
+	raDeviceRemoved(netdev)
+	dhcpv6DeviceRemoved(netdev)
+
+	for i, dev := range netDeviceList {
+		if dev == netdev {
+			netDeviceList = append(netDeviceList[:i], netDeviceList[i+1:]...)
+			break
+		}
+	}
+	fmt.Printf("Removed device %s\n", netdev.name)
+}
+
+// socketを閉じる、AF_XDPではXDPのプログラムも外す
+func (netdev *netDevice) closeSocket() {
+	if netdev.xsk != nil {
+		netdev.xsk.close()
+		return
+	}
+	syscall.Close(netdev.socket)
+}
+
+// デバイスのアドレスを変更して直接接続の経路を入れ替える
+func setNetDeviceAddress(netdev *netDevice, ipdev ipDevice) {
+	fmt.Printf("Address of %s is changed from [%s] to [%s]\n", netdev.name, netdev.ipDev.String(), ipdev.String())
+	deleteConnectedRoute(netdev)
+	netdev.ipDev = ipdev
+	addConnectedRoute(netdev)
+}
+
+// 名前からnetDeviceを探す
+func searchNetDeviceByName(name string) *netDevice {
+	for _, netdev := range netDeviceList {
+		if netdev.name == name {
+			return netdev
+		}
+	}
+	return nil
+}
+
+// 直接接続ネットワークの経路を登録する、セカンダリのアドレスのサブネットにも経路を入れる
+func addConnectedRoute(netdev *netDevice) {
+	// IPアドレスが設定されていなければ経路は無い、ブリッジのポートではルーティングしない
+	// ダウンしているインターフェイスはアップした時に登録する
+	if netdev.bridge != nil || !netdev.isUp() {
+		return
+	}
+	routeEntry := ipRouteEntry{
+		iptype: connected,
+		netdev: netdev,
+		source: routeSourceConnected,
+	}
+	for _, addr := range netdev.ipDev.addrs() {
+		prefixLen := subnetToPrefixLen(addr.netmask)
+		ribAddRoute(addr.address&addr.netmask, prefixLen, routeEntry)
+		fmt.Printf("Set directly connected route %s/%d via %s\n",
+			printIPAddr(addr.address&addr.netmask), prefixLen, netdev.name)
+	}
+}
+
+// 直接接続ネットワークの経路を削除する
+func deleteConnectedRoute(netdev *netDevice) {
+	for _, addr := range netdev.ipDev.addrs() {
+		prefix := addr.address & addr.netmask
+		prefixLen := subnetToPrefixLen(addr.netmask)
+		// 同じサブネットの他のデバイスの経路は残す
+		_, ok := ribDeleteRoute(prefix, prefixLen, ipRouteEntry{source: routeSourceConnected, netdev: netdev})
+		if !ok {
+			continue
+		}
+		fmt.Printf("Deleted directly connected route %s/%d via %s\n",
+			printIPAddr(prefix), prefixLen, netdev.name)
 	}
 }
 
 func main() {
 	var mode string
+	var backend string
+	var tapSpec string
+	var benchRoutes string
+	var benchLookups int
+	var genSpec string
+	var genCount, genRate int
 	flag.StringVar(&mode, "mode", "ch1", "set run router mode")
+	flag.StringVar(&backend, "backend", "packet", "set device backend (packet, xdp or tun)")
+	flag.StringVar(&tapSpec, "tap", "", "tap devices for tun backend (e.g. tap0=192.168.1.1/24,tap1=192.168.2.1/24)")
+	flag.BoolVar(&debug, "debug", false, "print debug logs")
+	flag.Func("debug-packet", "trace how matching packets are processed (e.g. src=192.168.1.0/24,dst=192.168.0.2/32,proto=icmp,dev=eth1,ttl=2)", func(s string) error {
+		var err error
+		packetTrace, err = parsePacketTraceMatch(s)
+		return err
+	})
+	flag.StringVar(&benchRoutes, "bench-routes", "", "compare longest prefix match of radix trees with routes in mrt dump or prefix list, then exit")
+	flag.IntVar(&benchLookups, "bench-lookups", 1000000, "number of lookups for -bench-routes")
+	flag.StringVar(&genSpec, "gen", "", "send generated arp, icmp or udp packets, then exit (e.g. udp,dev=eth1,dst=192.168.0.2,gw=192.168.1.1,dport=53)")
+	flag.IntVar(&genCount, "gen-count", 1, "number of packets for -gen")
+	flag.IntVar(&genRate, "gen-rate", 0, "packets per second for -gen (0 is as fast as possible)")
+	flag.StringVar(&configPath, "config", "", "router config file (reloaded on SIGHUP)")
+	flag.Func("no-icmp-redirect", "comma separated interfaces which do not send icmp redirect", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			icmpRedirectDisabled[name] = true
+		}
+		return nil
+	})
+	flag.Func("icmp-timestamp", "comma separated interfaces which answer icmp timestamp requests", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			icmpTimestampInterfaces[name] = true
+		}
+		return nil
+	})
+	flag.Func("icmp-mask-reply", "comma separated interfaces which answer icmp address mask requests", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			icmpMaskReplyInterfaces[name] = true
+		}
+		return nil
+	})
+	flag.Func("nat64", "comma separated interfaces whose ipv6 hosts reach ipv4 through nat64 (64:ff9b::/96)", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			nat64Interfaces[name] = true
+		}
+		return nil
+	})
+	flag.Func("promisc", "comma separated interfaces in promiscuous mode", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			promiscInterfaces[name] = true
+		}
+		return nil
+	})
+	flag.Func("urpf", "comma separated uRPF modes of interfaces (e.g. eth1=strict,eth2=loose)", func(s string) error {
+		for _, spec := range strings.Split(s, ",") {
+			name, mode, err := parseUrpfConfig(spec)
+			if err != nil {
+				return err
+			}
+			urpfFlags[name] = mode
+		}
+		return nil
+	})
+	flag.Func("checksum-policy", "comma separated tcp/udp checksum verification policies of interfaces (e.g. eth1=verify,eth2=skip, default is auto)", func(s string) error {
+		for _, spec := range strings.Split(s, ",") {
+			name, policy, err := parseChecksumPolicyConfig(spec)
+			if err != nil {
+				return err
+			}
+			checksumPolicyFlags[name] = policy
+		}
+		return nil
+	})
+	flag.Func("shutdown", "comma separated interfaces which are administratively down at startup", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			shutdownInterfaces[name] = true
+		}
+		return nil
+	})
+	flag.Func("mac-allow", "additional unicast macs received on interface (e.g. eth1=02:00:00:00:00:10+02:00:00:00:00:11), can be repeated", func(s string) error {
+		name, macs, err := parseMacAllowConfig(s)
+		if err != nil {
+			return err
+		}
+		macAllowFlags[name] = append(macAllowFlags[name], macs...)
+		return nil
+	})
+	flag.BoolVar(&socketFilterDisabled, "no-socket-filter", false, "receive all frames without attaching bpf filters to packet sockets")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "listen address of gRPC management API (e.g. 127.0.0.1:50051)")
+	flag.StringVar(&adminAddr, "admin-addr", "", "listen address of HTTP admin API (e.g. 127.0.0.1:8080)")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token required by HTTP admin API")
+	flag.BoolVar(&importKernelRoutes, "import-kernel-routes", false, "import routes from kernel main table at startup")
+	flag.BoolVar(&multicastForwarding, "multicast-forwarding", false, "send igmp queries and forward multicast to interfaces with members")
+	flag.Func("igmp-proxy", "proxy igmp memberships of downstream interfaces to upstream and forward multicast between them (e.g. upstream=eth0,downstream=eth1+eth2)", func(s string) error {
+		config, err := parseIgmpProxyConfig(s)
+		igmpProxyFlagConfig = config
+		return err
+	})
+	flag.Func("bridge", "bridge interfaces as a learning switch (e.g. br0=eth1,eth2), can be repeated", func(s string) error {
+		config, err := parseBridgeConfig(s)
+		if err != nil {
+			return err
+		}
+		bridgeConfigs = append(bridgeConfigs, config)
+		return nil
+	})
+	var stpEnabled bool
+	var stpPriority uint
+	var stpForwardDelay time.Duration
+	flag.BoolVar(&stpEnabled, "stp", false, "enable spanning tree protocol on bridges given by -bridge")
+	flag.UintVar(&stpPriority, "stp-priority", uint(STP_DEFAULT_BRIDGE_PRIORITY), "stp bridge priority (0-65535, lower becomes root)")
+	flag.DurationVar(&stpForwardDelay, "stp-forward-delay", STP_DEFAULT_FORWARD_DELAY, "stp forward delay")
+	var bridgeAgingTime time.Duration
+	flag.DurationVar(&bridgeAgingTime, "bridge-aging", BRIDGE_FDB_AGING_TIME, "aging time of learned mac addresses on bridges given by -bridge")
+	flag.Func("port-security", "limit learned macs on a bridge port (e.g. dev=eth1,max=2,sticky=true,violation=protect|restrict|shutdown), can be repeated", func(s string) error {
+		config, err := parsePortSecurityConfig(s)
+		if err != nil {
+			return err
+		}
+		portSecurityFlags[config.ifname] = config
+		return nil
+	})
+	flag.BoolVar(&lldpEnabled, "lldp", false, "send lldp from every interface")
+	flag.Func("loopback", "comma separated /32 addresses of loopback interface "+LOOPBACK_DEVICE_NAME, func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			addr, err := parseLoopbackAddr(v)
+			if err != nil {
+				return err
+			}
+			loopbackAddrs = append(loopbackAddrs, addr)
+		}
+		return nil
+	})
+	flag.Func("router-id", "router id (default is highest loopback address, or highest interface address)", func(s string) error {
+		addr, err := parseIPAddr(s)
+		if err != nil {
+			return err
+		}
+		routerIDFlag = addr
+		return nil
+	})
+	flag.Func("static-arp", "static arp entry not overwritten by learning (e.g. eth1=192.168.1.2/02:00:00:00:00:01), can be repeated", func(s string) error {
+		entry, err := parseStaticArpEntry(s)
+		if err != nil {
+			return err
+		}
+		staticArpConfigs = append(staticArpConfigs, entry)
+		return nil
+	})
+	flag.Func("vrrp", "vrrp virtual router (e.g. eth1=1/192.168.1.254/200 for vrid 1 with priority 200), can be repeated", func(s string) error {
+		config, err := parseVrrpConfig(s)
+		if err != nil {
+			return err
+		}
+		vrrpConfigs = append(vrrpConfigs, config)
+		return nil
+	})
+	flag.Func("ra", "ipv6 router advertisement on an interface (e.g. dev=eth1,prefix=2001:db8:1::/64,mtu=1500,interval=200s), can be repeated", func(s string) error {
+		config, err := parseRaConfig(s)
+		if err != nil {
+			return err
+		}
+		raConfigs = append(raConfigs, config)
+		return nil
+	})
+	flag.Func("shape", "shape egress traffic of an interface (e.g. eth1=1000/15000 for 1000kbps with 15000 bytes burst), can be repeated", func(s string) error {
+		return parseInterfaceQosRate(s, shapingRates)
+	})
+	flag.Func("impair", "emulate egress delay, jitter, loss and reordering on an interface (e.g. dev=eth1,delay=50ms,jitter=10ms,loss=1,reorder=5), can be repeated", func(s string) error {
+		name, imp, err := parseImpairmentConfig(s)
+		if err != nil {
+			return err
+		}
+		impairmentFlags[name] = imp
+		return nil
+	})
+	flag.Func("qos-scheduler", "scheduler of egress priority queues on shaped interfaces (strict or wrr)", func(s string) error {
+		scheduler, err := parseQosScheduler(s)
+		defaultQosScheduler = scheduler
+		return err
+	})
+	flag.Func("dns-upstream", "comma separated upstream dns servers, enables dns forwarder", func(s string) error {
+		for _, server := range strings.Split(s, ",") {
+			addr, err := parseIPAddr(server)
+			if err != nil {
+				return err
+			}
+			dnsUpstreams = append(dnsUpstreams, addr)
+		}
+		return nil
+	})
+	flag.Func("dns-host", "static host answered by dns forwarder (e.g. router.lan=192.168.1.1), can be repeated", func(s string) error {
+		return parseDnsHost(s, dnsHosts)
+	})
+	flag.BoolVar(&dns64Enabled, "dns64", false, "answer aaaa queries with 64:ff9b::/96 addresses synthesized from a records for nat64")
+	flag.Func("default-gateway", "nexthop of default route (0.0.0.0/0)", func(s string) error {
+		addr, err := parseIPAddr(s)
+		if err != nil {
+			return err
+		}
+		defaultGateway = addr
+		return nil
+	})
+	flag.Func("ntp", "comma separated ntp servers to synchronize router time with", func(s string) error {
+		for _, server := range strings.Split(s, ",") {
+			addr, err := parseIPAddr(server)
+			if err != nil {
+				return err
+			}
+			ntpServers = append(ntpServers, addr)
+		}
+		return nil
+	})
+	flag.BoolVar(&ntpServe, "ntp-serve", false, "answer ntp requests from hosts with router time")
+	flag.Func("syslog", "send logs to syslog server (e.g. udp://192.168.0.2:514 or tcp://192.168.0.2:514)", func(s string) error {
+		if _, _, err := parseSyslogServer(s); err != nil {
+			return err
+		}
+		syslogFlagConfig.server = s
+		return nil
+	})
+	flag.Func("syslog-facility", "syslog facility (kern, user, daemon or local0-local7, default local0)", func(s string) error {
+		if _, ok := syslogFacilities[s]; !ok {
+			return fmt.Errorf("unknown syslog facility %s", s)
+		}
+		syslogFlagConfig.facility = s
+		return nil
+	})
+	flag.IntVar(&syslogFlagConfig.rate, "syslog-rate", 0, "max syslog messages per second, excess messages are suppressed (0 is unlimited)")
+	flag.Func("sflow", "sample 1 in n forwarded packets and export them as sflow v5 (e.g. collector=192.168.0.2:6343,rate=1000,header=128)", func(s string) error {
+		config, err := parseSflowConfig(s)
+		sflowFlagConfig = config
+		return err
+	})
+	flag.IntVar(&flowTableSize, "flow-table-size", FLOW_DEFAULT_TABLE_SIZE, "max flows counted for top talkers, least recently seen flows are evicted (0 disables)")
+	flag.StringVar(&snmpCommunity, "snmp-community", "", "community of snmpv2c agent answering read requests on udp port 161")
+	flag.Func("ipsec", "ipsec esp tunnel with static keys (e.g. peer=192.168.0.2,spi-out=0x1001,key-out=hex,spi-in=0x2001,key-in=hex,routes=192.168.2.0/24), can be repeated", func(s string) error {
+		config, err := parseEspTunnelConfig(s)
+		if err != nil {
+			return err
+		}
+		espTunnelConfigs = append(espTunnelConfigs, config)
+		return nil
+	})
+	flag.StringVar(&pppoeInterface, "pppoe", "", "interface to get address from pppoe access concentrator")
+	flag.StringVar(&pppoeUsername, "pppoe-user", "", "username for pppoe pap authentication")
+	flag.StringVar(&pppoePassword, "pppoe-password", "", "password for pppoe pap authentication")
+	flag.StringVar(&dhcpv6PdInterface, "dhcpv6-pd", "", "interface to request ipv6 prefix delegation with dhcpv6")
+	flag.Func("dhcpv6-pd-lan", "comma separated interfaces to assign /64 of the delegated prefix and advertise it", func(s string) error {
+		dhcpv6PdLanInterfaces = strings.Split(s, ",")
+		return nil
+	})
+	flag.Func("dhcpv6-pd-hint", "prefix length to request with dhcpv6 prefix delegation (e.g. 56)", func(s string) error {
+		hint, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		dhcpv6PdHint = hint
+		return checkDhcpv6PdHint(hint)
+	})
+	flag.Func("police", "police ingress traffic of an interface (e.g. eth1=1000/15000), can be repeated", func(s string) error {
+		return parseInterfaceQosRate(s, policingRates)
+	})
+	flag.StringVar(&stateFile, "state-file", "", "save arp entries, nat sessions, static routes, ipsec sequence numbers and the dhcpv6-pd lease on shutdown and load them on start")
+	flag.DurationVar(&stateMaxAge, "state-max-age", STATE_DEFAULT_MAX_AGE, "ignore -state-file saved longer ago than this")
+	flag.Func("instance", "run another router instance in this process (e.g. name=r2,netns=r2,route=192.168.1.0/24@192.168.0.1), can be repeated", func(s string) error {
+		inst, err := parseRouterInstance(s)
+		if err != nil {
+			return err
+		}
+		routerInstances = append(routerInstances, inst)
+		return nil
+	})
+	flag.StringVar(&dumpTablesFile, "dump-tables", "", "dump arp and route tables as json to the file on shutdown")
+	flag.StringVar(&loadTablesFile, "load-tables", "", "load arp and route tables dumped by -dump-tables or GET /tables on start")
+	flag.BoolVar(&exportKernelRoutes, "export-kernel-routes", false, "export routes installed by go-curo to kernel main table")
 	flag.Parse()
+	if err := checkPipelineHandlers(); err != nil {
+		log.Fatal(err)
+	}
+	if stpPriority > 0xffff {
+		log.Fatalf("invalid stp priority %d", stpPriority)
+	}
+	if stpForwardDelay < 4*time.Second {
+		log.Fatalf("stp forward delay must be at least 4s")
+	}
+	if bridgeAgingTime < time.Second {
+		log.Fatalf("bridge aging time must be at least 1s")
+	}
+	for i := range bridgeConfigs {
+		bridgeConfigs[i].stp = stpEnabled
+		bridgeConfigs[i].priority = uint16(stpPriority)
+		bridgeConfigs[i].forwardDelay = stpForwardDelay
+		bridgeConfigs[i].agingTime = bridgeAgingTime
+		for _, port := range bridgeConfigs[i].ports {
+			if config, ok := portSecurityFlags[port]; ok {
+				bridgeConfigs[i].portSecurity = append(bridgeConfigs[i].portSecurity, config)
+			}
+		}
+	}
+	if benchRoutes != "" {
+		if err := runRouteBenchmark(benchRoutes, benchLookups); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if genSpec != "" {
+		config, err := parseGenSpec(genSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runPacketGenerator(config, genCount, genRate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if mode == "ch1" {
 		runChapter1()
 	} else {
-		runChapter2(mode)
+		runChapter2(mode, backend, tapSpec)
 	}
 }
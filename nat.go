@@ -0,0 +1,525 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+NAPT(IPマスカレード)
+内側のインターフェイスから外側のインターフェイスへフォワードするパケットの送信元を外側のアドレスに書き換える
+https://github.com/kametan0730/interface_2022_11/blob/master/chapter3/nat.cpp
+
+ポートフォワード(静的なDNAT)
+外側のアドレスの決めたポートに届いたTCP/UDPを、内側のホストのポートに宛先を書き換えて転送する
+内側のホストからの応答は送信元を外側のアドレスと受けたポートに戻す
+内側のホストが外側のアドレスでポートフォワードを使った場合(ヘアピンNAT)は、宛先をポートフォワードで書き換えた上で
+送信元も外側のアドレスに書き換える、送信元がそのままだとサーバは同じネットワークのクライアントに直接応答してしまい、
+クライアントは外側のアドレスではないところから応答を受け取ることになる
+
+分割されたパケット
+ポート番号は最初の断片にしか無いので、最初の断片でエントリを探してポート番号を書き換える
+TCP/UDPのチェックサムはデータグラム全体にかかるので、書き換えた分だけ差分で直す(RFC 1624)
+最初以外の断片はアドレスだけを書き換える、外側で受けた断片は最初の断片で書き換えた宛先を覚えておいて使う
+最初の断片より先に届いた断片は宛先が分からないので書き換えない
+https://www.rfc-editor.org/rfc/rfc1624
+*/
+
+// 外側のアドレスで割り当てるポート番号の範囲
+const NAT_GLOBAL_PORT_MIN uint16 = 20000
+const NAT_GLOBAL_PORT_MAX uint16 = 59999
+
+// 使われなくなったエントリを消すまでの時間
+const NAT_ENTRY_TIMEOUT = 60 * time.Second
+const NAT_TCP_ENTRY_TIMEOUT = 300 * time.Second
+
+// 最初の断片で書き換えた宛先を覚えておく時間
+const NAT_FRAGMENT_TIMEOUT = 30 * time.Second
+
+// NATの設定
+type natConfig struct {
+	outsideDevice   string          // 外側のインターフェイス
+	insideDevices   map[string]bool // 内側のインターフェイス
+	nextGlobalPorts map[uint8]uint16
+	portForwards    []natPortForward
+}
+
+// ポートフォワード
+type natPortForward struct {
+	protocol   uint8
+	globalPort uint16 // 外側のアドレスで受けるポート番号
+	localAddr  uint32 // 転送先の内側のホスト
+	localPort  uint16
+}
+
+// NATのエントリ
+type natEntry struct {
+	protocol   uint8
+	localAddr  uint32 // 内側のホストのアドレス
+	localPort  uint16 // 内側のホストのポート番号(ICMPはidentifier)
+	globalAddr uint32 // 外側のアドレス
+	globalPort uint16 // 外側で使うポート番号
+	lastUsed   time.Time
+}
+
+// 外側で受けた最初の断片を書き換えた宛先、送信元とIDが同じ断片に使う
+type natFragment struct {
+	protocol  uint8
+	srcAddr   uint32
+	id        uint16
+	localAddr uint32
+	lastUsed  time.Time
+}
+
+// NATの設定、nilならNATしない
+var nat *natConfig
+
+var natEntryList []*natEntry
+
+var natFragmentList []*natFragment
+
+// NATの外側のインターフェイスか
+func isNatOutsideDevice(netdev *netDevice) bool {
+	return nat != nil && netdev.name == nat.outsideDevice && isDefaultInstanceDevice(netdev)
+}
+
+// NATの内側のインターフェイスか
+func isNatInsideDevice(netdev *netDevice) bool {
+	return nat != nil && nat.insideDevices[netdev.name] && isDefaultInstanceDevice(netdev)
+}
+
+/*
+NATの設定を入れ替える
+外側のインターフェイスが変わった場合は今までのエントリは使えないので消す
+*/
+func setNatConfig(outside string, inside []string, portForwards []natPortForward) {
+	if outside == "" {
+		if nat != nil {
+			fmt.Println("NAT is disabled")
+		}
+		nat = nil
+		natEntryList = nil
+		natFragmentList = nil
+		natSeqAdjustList = nil
+		return
+	}
+	config := &natConfig{
+		outsideDevice:   outside,
+		insideDevices:   map[string]bool{},
+		nextGlobalPorts: map[uint8]uint16{},
+		portForwards:    portForwards,
+	}
+	for _, name := range inside {
+		config.insideDevices[name] = true
+	}
+	if nat != nil && nat.outsideDevice == outside {
+		config.nextGlobalPorts = nat.nextGlobalPorts
+	} else {
+		natEntryList = nil
+		natFragmentList = nil
+		natSeqAdjustList = nil
+	}
+	nat = config
+	fmt.Printf("NAT is enabled, outside %s inside %v\n", outside, inside)
+	for _, fwd := range portForwards {
+		fmt.Printf("Forward %s port %d of %s to %s:%d\n", ipProtocolName(fwd.protocol), fwd.globalPort, outside,
+			printIPAddr(fwd.localAddr), fwd.localPort)
+	}
+}
+
+/*
+"tcp", 8080, "192.168.1.2:80"からポートフォワードを作る
+転送先のポート番号を省略した場合は受けたポート番号と同じにする
+*/
+func parseNatPortForward(protocol string, port uint16, to string) (natPortForward, error) {
+	var fwd natPortForward
+	switch protocol {
+	case "tcp":
+		fwd.protocol = IP_PROTOCOL_NUM_TCP
+	case "udp":
+		fwd.protocol = IP_PROTOCOL_NUM_UDP
+	default:
+		return fwd, fmt.Errorf("unknown port forward protocol %s", protocol)
+	}
+	if port == 0 {
+		return fwd, fmt.Errorf("port forward port is not specified")
+	}
+	fwd.globalPort = port
+	fwd.localPort = port
+	addr, portStr, found := strings.Cut(to, ":")
+	if found {
+		localPort, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || localPort == 0 {
+			return fwd, fmt.Errorf("invalid port forward port %s", portStr)
+		}
+		fwd.localPort = uint16(localPort)
+	}
+	localAddr, err := parseIPAddr(addr)
+	if err != nil {
+		return fwd, err
+	}
+	fwd.localAddr = localAddr
+	return fwd, nil
+}
+
+// 外側で受けたポート番号のポートフォワードを探す
+func natSearchPortForward(protocol uint8, globalPort uint16) *natPortForward {
+	for i, fwd := range nat.portForwards {
+		if fwd.protocol == protocol && fwd.globalPort == globalPort {
+			return &nat.portForwards[i]
+		}
+	}
+	return nil
+}
+
+// 転送先のホストとポート番号からポートフォワードを探す
+func natSearchPortForwardByLocal(protocol uint8, localAddr uint32, localPort uint16) *natPortForward {
+	for i, fwd := range nat.portForwards {
+		if fwd.protocol == protocol && fwd.localAddr == localAddr && fwd.localPort == localPort {
+			return &nat.portForwards[i]
+		}
+	}
+	return nil
+}
+
+// NATの対象にするプロトコルか
+func isNatProtocol(protocol uint8) bool {
+	return protocol == IP_PROTOCOL_NUM_ICMP || protocol == IP_PROTOCOL_NUM_UDP || protocol == IP_PROTOCOL_NUM_TCP
+}
+
+// 最初以外の断片か、ポート番号もチェックサムも入っていない
+func isNonFirstFragment(ipPacket []byte) bool {
+	return byteToUint16(ipPacket[6:8])&0x1fff != 0
+}
+
+/*
+IPパケットからNATで書き換えるポート番号を取り出す
+ICMPはエコーのidentifierをポート番号の代わりに使う
+最初以外の断片はポート番号が無いのでfalseを返す
+*/
+func natPorts(ipPacket []byte) (srcPort, destPort uint16, ok bool) {
+	if isNonFirstFragment(ipPacket) {
+		return 0, 0, false
+	}
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	l4 := ipPacket[headerLen:]
+	switch ipPacket[9] {
+	case IP_PROTOCOL_NUM_ICMP:
+		if len(l4) < 8 || (l4[0] != ICMP_TYPE_ECHO_REQUEST && l4[0] != ICMP_TYPE_ECHO_REPLY) {
+			return 0, 0, false
+		}
+		id := byteToUint16(l4[4:6])
+		return id, id, true
+	case IP_PROTOCOL_NUM_UDP:
+		if len(l4) < UDP_HEADER_LEN {
+			return 0, 0, false
+		}
+		return byteToUint16(l4[0:2]), byteToUint16(l4[2:4]), true
+	case IP_PROTOCOL_NUM_TCP:
+		// チェックサムまで入っていないと書き換えられない
+		if len(l4) < 20 {
+			return 0, 0, false
+		}
+		return byteToUint16(l4[0:2]), byteToUint16(l4[2:4]), true
+	}
+	return 0, 0, false
+}
+
+// 期限切れのエントリを消す
+func natExpireEntries(now time.Time) {
+	var entries []*natEntry
+	for _, entry := range natEntryList {
+		timeout := NAT_ENTRY_TIMEOUT
+		if entry.protocol == IP_PROTOCOL_NUM_TCP {
+			timeout = NAT_TCP_ENTRY_TIMEOUT
+		}
+		if now.Sub(entry.lastUsed) < timeout {
+			entries = append(entries, entry)
+		}
+	}
+	natEntryList = entries
+}
+
+// 期限切れの断片の宛先を消す
+func natExpireFragments(now time.Time) {
+	var fragments []*natFragment
+	for _, frag := range natFragmentList {
+		if now.Sub(frag.lastUsed) < NAT_FRAGMENT_TIMEOUT {
+			fragments = append(fragments, frag)
+		}
+	}
+	natFragmentList = fragments
+}
+
+// 後ろに断片が続く最初の断片を書き換えた宛先を覚えておく
+func natRememberFragment(ipPacket []byte, now time.Time) {
+	if byteToUint16(ipPacket[6:8])&0x2000 == 0 {
+		return
+	}
+	natFragmentList = append(natFragmentList, &natFragment{
+		protocol:  ipPacket[9],
+		srcAddr:   byteToUint32(ipPacket[12:16]),
+		id:        byteToUint16(ipPacket[4:6]),
+		localAddr: byteToUint32(ipPacket[16:20]),
+		lastUsed:  now,
+	})
+}
+
+/*
+外側で受けた最初以外の断片の宛先を、最初の断片と同じ内側のホストに書き換える
+最初の断片をまだ受けていなければfalseを返す
+*/
+func natInboundFragment(ipPacket []byte) bool {
+	now := time.Now()
+	natExpireFragments(now)
+	srcAddr := byteToUint32(ipPacket[12:16])
+	id := byteToUint16(ipPacket[4:6])
+	for _, frag := range natFragmentList {
+		if frag.protocol == ipPacket[9] && frag.srcAddr == srcAddr && frag.id == id {
+			frag.lastUsed = now
+			natRewriteAddr(ipPacket, false, frag.localAddr)
+			return true
+		}
+	}
+	return false
+}
+
+// 外側のポート番号が使われているか、ポートフォワードで受けるポート番号も使わない
+func natGlobalPortInUse(protocol uint8, port uint16) bool {
+	if natSearchPortForward(protocol, port) != nil {
+		return true
+	}
+	for _, entry := range natEntryList {
+		if entry.protocol == protocol && entry.globalPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// 空いている外側のポート番号を割り当てる
+func natAllocateGlobalPort(protocol uint8) (uint16, bool) {
+	port := nat.nextGlobalPorts[protocol]
+	for i := 0; i <= int(NAT_GLOBAL_PORT_MAX-NAT_GLOBAL_PORT_MIN); i++ {
+		if port < NAT_GLOBAL_PORT_MIN || NAT_GLOBAL_PORT_MAX < port {
+			port = NAT_GLOBAL_PORT_MIN
+		}
+		if !natGlobalPortInUse(protocol, port) {
+			nat.nextGlobalPorts[protocol] = port + 1
+			return port, true
+		}
+		port++
+	}
+	return 0, false
+}
+
+/*
+内側から外側へ出ていくパケットの送信元を書き換える
+書き換えられないパケットの場合はfalseを返す
+*/
+func natOutbound(ipPacket []byte, outputdev *netDevice) bool {
+	protocol := ipPacket[9]
+	if !isNatProtocol(protocol) {
+		return false
+	}
+	// 最初以外の断片は送信元のアドレスだけを外側のアドレスにする
+	if isNonFirstFragment(ipPacket) {
+		natRewriteAddr(ipPacket, true, outputdev.ipDev.address)
+		return true
+	}
+	srcPort, _, ok := natPorts(ipPacket)
+	if !ok {
+		return false
+	}
+	srcAddr := byteToUint32(ipPacket[12:16])
+	// ポートフォワードの転送先からの応答は、外側のアドレスの受けたポート番号から送る
+	if fwd := natSearchPortForwardByLocal(protocol, srcAddr, srcPort); fwd != nil {
+		natRewrite(ipPacket, true, outputdev.ipDev.address, fwd.globalPort)
+		return true
+	}
+	now := time.Now()
+	natExpireEntries(now)
+
+	var entry *natEntry
+	for _, e := range natEntryList {
+		if e.protocol == protocol && e.localAddr == srcAddr && e.localPort == srcPort {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		globalPort, ok := natAllocateGlobalPort(protocol)
+		if !ok {
+			fmt.Println("NAT table is full")
+			return false
+		}
+		entry = &natEntry{
+			protocol:   protocol,
+			localAddr:  srcAddr,
+			localPort:  srcPort,
+			globalAddr: outputdev.ipDev.address,
+			globalPort: globalPort,
+		}
+		natEntryList = append(natEntryList, entry)
+		fmt.Printf("Created NAT entry %s:%d => %s:%d (protocol %d)\n", printIPAddr(entry.localAddr), entry.localPort,
+			printIPAddr(entry.globalAddr), entry.globalPort, protocol)
+	}
+	entry.lastUsed = now
+	natRewrite(ipPacket, true, entry.globalAddr, entry.globalPort)
+	return true
+}
+
+/*
+外側から入ってきたパケットの宛先を内側のホストに書き換える
+該当するエントリが無ければfalseを返す
+*/
+func natInbound(ipPacket []byte) bool {
+	protocol := ipPacket[9]
+	if !isNatProtocol(protocol) {
+		return false
+	}
+	if isNonFirstFragment(ipPacket) {
+		return natInboundFragment(ipPacket)
+	}
+	_, destPort, ok := natPorts(ipPacket)
+	if !ok {
+		return false
+	}
+	destAddr := byteToUint32(ipPacket[16:20])
+	now := time.Now()
+	natExpireEntries(now)
+	for _, entry := range natEntryList {
+		if entry.protocol == protocol && entry.globalAddr == destAddr && entry.globalPort == destPort {
+			entry.lastUsed = now
+			natRewrite(ipPacket, false, entry.localAddr, entry.localPort)
+			natRememberFragment(ipPacket, now)
+			return true
+		}
+	}
+	// セッションが無ければポートフォワードの転送先に書き換える
+	if fwd := natSearchPortForward(protocol, destPort); fwd != nil {
+		natRewrite(ipPacket, false, fwd.localAddr, fwd.localPort)
+		natRememberFragment(ipPacket, now)
+		return true
+	}
+	return false
+}
+
+/*
+内側から外側のアドレスに送られたパケットを内側のホストに折り返す(ヘアピンNAT)
+宛先をセッションかポートフォワードで内側のホストに書き換え、送信元を外側のアドレスに書き換える
+該当するセッションもポートフォワードも無ければfalseを返す
+*/
+func natHairpin(ipPacket []byte, outsidedev *netDevice) bool {
+	if !natInbound(ipPacket) {
+		return false
+	}
+	natOutbound(ipPacket, outsidedev)
+	return true
+}
+
+/*
+アドレスとポート番号を書き換えて、書き換えた分だけチェックサムを直す
+srcがtrueなら送信元を、falseなら宛先を書き換える
+最初の断片にはデータグラムの一部しか無いので、チェックサムを計算し直さずに差分で直す
+*/
+func natRewrite(ipPacket []byte, src bool, addr uint32, port uint16) {
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	l4 := ipPacket[headerLen:]
+	protocol := ipPacket[9]
+
+	addrOffset, portOffset := 16, 2
+	if src {
+		addrOffset, portOffset = 12, 0
+	}
+	// 疑似ヘッダのアドレスとポート番号をまとめて差分にする
+	newAddr, newPort := uint32ToByte(addr), uint16ToByte(port)
+	oldAddrPort := append(append([]byte{}, ipPacket[addrOffset:addrOffset+4]...), l4[portOffset:portOffset+2]...)
+	newAddrPort := append(append([]byte{}, newAddr...), newPort...)
+
+	switch protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		// ICMPのチェックサムは疑似ヘッダを含まないので、identifierの分だけ直す
+		adjustChecksum(l4[2:4], l4[4:6], newPort)
+		copy(l4[4:6], newPort)
+	case IP_PROTOCOL_NUM_UDP:
+		// UDPのチェックサムが0の場合は計算されていないのでそのままにする
+		if byteToUint16(l4[6:8]) != 0 {
+			adjustChecksum(l4[6:8], oldAddrPort, newAddrPort)
+			// UDPでは計算結果が0の場合は0xffffにする
+			if l4[6] == 0 && l4[7] == 0 {
+				l4[6], l4[7] = 0xff, 0xff
+			}
+		}
+		copy(l4[portOffset:portOffset+2], newPort)
+	case IP_PROTOCOL_NUM_TCP:
+		adjustChecksum(l4[16:18], oldAddrPort, newAddrPort)
+		copy(l4[portOffset:portOffset+2], newPort)
+	}
+	copy(ipPacket[addrOffset:addrOffset+4], newAddr)
+	setIPHeaderChecksum(ipPacket)
+}
+
+// 最初以外の断片のアドレスだけを書き換える、TCP/UDPのチェックサムは最初の断片で直している
+func natRewriteAddr(ipPacket []byte, src bool, addr uint32) {
+	addrOffset := 16
+	if src {
+		addrOffset = 12
+	}
+	copy(ipPacket[addrOffset:addrOffset+4], uint32ToByte(addr))
+	setIPHeaderChecksum(ipPacket)
+}
+
+/*
+書き換える前と後の値からチェックサムを直す(RFC 1624の式3)
+HC' = ~(~HC + ~m + m')
+fromとtoは同じ長さで、16ビット単位で区切りがそろっている
+*/
+func adjustChecksum(checksum, from, to []byte) {
+	sum := uint(^byteToUint16(checksum))
+	for i := 0; i+1 < len(from); i += 2 {
+		sum += uint(^byteToUint16(from[i:])) + uint(byteToUint16(to[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + sum>>16
+	}
+	copy(checksum, uint16ToByte(^uint16(sum)))
+}
+
+// IPヘッダのチェックサムを計算し直す
+func setIPHeaderChecksum(ipPacket []byte) {
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	ipPacket[10], ipPacket[11] = 0, 0
+	checksum := calcChecksum(ipPacket[:headerLen])
+	ipPacket[10], ipPacket[11] = checksum[0], checksum[1]
+}
+
+/*
+TCP/UDPのチェックサムを疑似ヘッダを含めて計算し直す
+offsetはTCP/UDPヘッダの中のチェックサムの位置
+*/
+func setTransportChecksum(ipPacket []byte, offset int) {
+	headerLen := int(ipPacket[0]&0x0f) * 4
+	l4 := ipPacket[headerLen:]
+	if len(l4) < offset+2 {
+		return
+	}
+	l4[offset], l4[offset+1] = 0, 0
+	checksum := calcChecksum(append(pseudoHeader(ipPacket, len(l4)), l4...))
+	// UDPでは計算結果が0の場合は0xffffにする
+	if ipPacket[9] == IP_PROTOCOL_NUM_UDP && checksum[0] == 0 && checksum[1] == 0 {
+		checksum = []byte{0xff, 0xff}
+	}
+	l4[offset], l4[offset+1] = checksum[0], checksum[1]
+}
+
+// TCP/UDPのチェックサムの計算に使う疑似ヘッダ
+func pseudoHeader(ipPacket []byte, l4Len int) []byte {
+	var b []byte
+	b = append(b, ipPacket[12:20]...)
+	b = append(b, 0x00, ipPacket[9])
+	b = append(b, uint16ToByte(uint16(l4Len))...)
+	return b
+}
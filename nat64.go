@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+/*
+NAT64(ステートフル)
+IPv6だけのホストが64:ff9b::/96のアドレス(下位32bitがIPv4アドレス)に送ったパケットをIPv4に変換して送り、
+応答をIPv6に戻して、IPv4だけのサーバにつながるようにする
+  IPv6側   -nat64で指定したインターフェイス、ホストは-raのルータ広告でアドレスとデフォルトルータを決める
+  IPv4側   宛先への経路で選んだルータのアドレスから、送信元ポート(ICMPはidentifier)を割り当てて送る
+TCP、UDP、ICMPのエコーを変換する、フラグメントとICMPのエラーは変換しない
+NAPTと同じようにチェックサムは検証せずに計算し直す
+このルータはIPv6をフォワードしないので、64:ff9b::/96以外のIPv6の宛先には届かない
+DNS64(dns.go)と組み合わせると、IPv6だけのホストから名前でIPv4だけのサーバにつながる
+https://www.rfc-editor.org/rfc/rfc6146
+https://www.rfc-editor.org/rfc/rfc6052
+*/
+
+// IPv4アドレスを埋め込むWell-Knownプレフィックス
+var NAT64_PREFIX = netip.MustParsePrefix("64:ff9b::/96")
+
+// IPv4側で割り当てるポート番号の範囲、NAPTとDNSフォワーダの問い合わせのポートと重ならないようにする
+const NAT64_PORT_MIN uint16 = 10000
+const NAT64_PORT_MAX uint16 = 19999
+
+const (
+	ICMPV6_TYPE_ECHO_REQUEST uint8 = 128
+	ICMPV6_TYPE_ECHO_REPLY   uint8 = 129
+)
+
+// 変換中のセッション
+type nat64Session struct {
+	protocol uint8     // IPv4のプロトコル番号
+	hostAddr [16]uint8 // IPv6のホストのアドレス
+	hostPort uint16    // IPv6のホストのポート番号(ICMPはidentifier)
+	hostMac  [6]uint8  // 応答を返すホストのMACアドレス
+	netdev   *netDevice
+	addr     uint32 // IPv4側で使うルータのアドレス
+	port     uint16 // IPv4側で使うポート番号
+	lastUsed time.Time
+}
+
+var nat64Sessions []*nat64Session
+
+var nat64NextPorts = map[uint8]uint16{}
+
+// コマンドラインで指定されたIPv6側のインターフェイス
+var nat64Interfaces = map[string]bool{}
+
+// 64:ff9b::/96の宛先か
+func isNat64Addr(addr [16]uint8) bool {
+	return NAT64_PREFIX.Contains(netip.AddrFrom16(addr))
+}
+
+// IPv4アドレスを埋め込んだIPv6アドレス
+func nat64Addr(addr uint32) [16]uint8 {
+	v6 := NAT64_PREFIX.Addr().As16()
+	copy(v6[12:16], uint32ToByte(addr))
+	return v6
+}
+
+// 期限切れのセッションを消す、時間はNAPTと同じ
+func nat64ExpireSessions(now time.Time) {
+	var sessions []*nat64Session
+	for _, session := range nat64Sessions {
+		timeout := NAT_ENTRY_TIMEOUT
+		if session.protocol == IP_PROTOCOL_NUM_TCP {
+			timeout = NAT_TCP_ENTRY_TIMEOUT
+		}
+		if now.Sub(session.lastUsed) < timeout {
+			sessions = append(sessions, session)
+		}
+	}
+	nat64Sessions = sessions
+}
+
+// 空いているIPv4側のポート番号を割り当てる、UDPはルータ自身が受けているポートも使わない
+func nat64AllocatePort(protocol uint8) (uint16, bool) {
+	port := nat64NextPorts[protocol]
+	for i := 0; i <= int(NAT64_PORT_MAX-NAT64_PORT_MIN); i++ {
+		if port < NAT64_PORT_MIN || NAT64_PORT_MAX < port {
+			port = NAT64_PORT_MIN
+		}
+		inUse := false
+		if _, ok := udpHandlers[port]; ok && protocol == IP_PROTOCOL_NUM_UDP {
+			inUse = true
+		}
+		for _, session := range nat64Sessions {
+			if session.protocol == protocol && session.port == port {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			nat64NextPorts[protocol] = port + 1
+			return port, true
+		}
+		port++
+	}
+	return 0, false
+}
+
+/*
+IPv6のホストから64:ff9b::/96に送られたパケットをIPv4に変換して送る
+*/
+func nat64Outbound(ctx *inputContext, packet []byte) error {
+	inputdev := ctx.netdev
+	var srcAddr, destAddr [16]uint8
+	copy(srcAddr[:], packet[8:24])
+	copy(destAddr[:], packet[24:40])
+	nextHeader := packet[6]
+	hopLimit := packet[7]
+	trafficClass := packet[0]<<4 | packet[1]>>4
+	l4 := append([]byte{}, packet[IPV6_HEADER_LEN:IPV6_HEADER_LEN+int(byteToUint16(packet[4:6]))]...)
+
+	if hopLimit <= 1 {
+		return dropPacket(DROP_REASON_TTL_EXCEEDED)
+	}
+	var protocol uint8
+	var hostPort uint16
+	switch nextHeader {
+	case IP_PROTOCOL_NUM_ICMPV6:
+		if len(l4) < 8 || l4[0] != ICMPV6_TYPE_ECHO_REQUEST {
+			return dropPacket(DROP_REASON_NAT64_UNTRANSLATABLE)
+		}
+		protocol, hostPort = IP_PROTOCOL_NUM_ICMP, byteToUint16(l4[4:6])
+	case IP_PROTOCOL_NUM_UDP, IP_PROTOCOL_NUM_TCP:
+		if len(l4) < UDP_HEADER_LEN || (nextHeader == IP_PROTOCOL_NUM_TCP && len(l4) < 20) {
+			return dropPacket(DROP_REASON_NAT64_UNTRANSLATABLE)
+		}
+		protocol, hostPort = nextHeader, byteToUint16(l4[0:2])
+	default:
+		return dropPacket(DROP_REASON_NAT64_UNTRANSLATABLE)
+	}
+	v4dest := byteToUint32(destAddr[12:16])
+	v4src := ipSourceAddr(v4dest)
+	if v4src == 0 {
+		return dropPacket(DROP_REASON_NO_ROUTE)
+	}
+
+	now := time.Now()
+	nat64ExpireSessions(now)
+	var session *nat64Session
+	for _, s := range nat64Sessions {
+		if s.protocol == protocol && s.hostAddr == srcAddr && s.hostPort == hostPort && s.addr == v4src {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		port, ok := nat64AllocatePort(protocol)
+		if !ok {
+			fmt.Println("NAT64 session table is full")
+			return dropPacket(DROP_REASON_NAT64_UNTRANSLATABLE)
+		}
+		session = &nat64Session{
+			protocol: protocol,
+			hostAddr: srcAddr,
+			hostPort: hostPort,
+			addr:     v4src,
+			port:     port,
+		}
+		nat64Sessions = append(nat64Sessions, session)
+		fmt.Printf("Created NAT64 session [%s]:%d => %s:%d (protocol %d)\n", netip.AddrFrom16(srcAddr), hostPort,
+			printIPAddr(v4src), port, protocol)
+	}
+	// ホストのMACアドレスとインターフェイスは最後に受けたパケットのものを使う
+	session.hostMac = ctx.ethHeader.srcAddr
+	session.netdev = inputdev
+	session.lastUsed = now
+
+	switch protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		l4[0] = ICMP_TYPE_ECHO_REQUEST
+		copy(l4[4:6], uint16ToByte(session.port))
+		l4[2], l4[3] = 0, 0
+		checksum := calcChecksum(l4)
+		l4[2], l4[3] = checksum[0], checksum[1]
+	case IP_PROTOCOL_NUM_UDP:
+		copy(l4[0:2], uint16ToByte(session.port))
+		nat64SetIpv4Checksum(protocol, v4src, v4dest, l4, 6)
+	case IP_PROTOCOL_NUM_TCP:
+		copy(l4[0:2], uint16ToByte(session.port))
+		nat64SetIpv4Checksum(protocol, v4src, v4dest, l4, 16)
+	}
+	ipheader := ipHeader{
+		version:    4,
+		headerLen:  20 / 4,
+		tos:        trafficClass,
+		totalLen:   uint16(20 + len(l4)),
+		fragOffset: 2 << 13,
+		ttl:        hopLimit - 1,
+		protocol:   protocol,
+		srcAddr:    v4src,
+		destAddr:   v4dest,
+	}
+	tracef("nat64: [%s] is translated to %s", netip.AddrFrom16(srcAddr), printIPAddr(v4src))
+	return ipPacketOutput(iproute, v4dest, append(ipheader.ToPacket(true), l4...))
+}
+
+/*
+IPv4側から受けた応答がセッションに一致すればIPv6に戻してホストに送る
+一致しなければfalseを返し、ルータ宛てのパケットとして処理を続ける
+*/
+func nat64Inbound(ipheader *ipHeader, l4 []byte) bool {
+	if len(nat64Sessions) == 0 || ipheader.fragOffset&0x3fff != 0 {
+		return false
+	}
+	var port uint16
+	var nextHeader uint8
+	switch ipheader.protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		if len(l4) < 8 || l4[0] != ICMP_TYPE_ECHO_REPLY {
+			return false
+		}
+		port, nextHeader = byteToUint16(l4[4:6]), IP_PROTOCOL_NUM_ICMPV6
+	case IP_PROTOCOL_NUM_UDP:
+		if len(l4) < UDP_HEADER_LEN {
+			return false
+		}
+		port, nextHeader = byteToUint16(l4[2:4]), IP_PROTOCOL_NUM_UDP
+	case IP_PROTOCOL_NUM_TCP:
+		if len(l4) < 20 {
+			return false
+		}
+		port, nextHeader = byteToUint16(l4[2:4]), IP_PROTOCOL_NUM_TCP
+	default:
+		return false
+	}
+	now := time.Now()
+	nat64ExpireSessions(now)
+	var session *nat64Session
+	for _, s := range nat64Sessions {
+		if s.protocol == ipheader.protocol && s.addr == ipheader.destAddr && s.port == port {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		return false
+	}
+	if ipheader.ttl <= 1 {
+		countDrop(DROP_REASON_TTL_EXCEEDED)
+		return true
+	}
+	session.lastUsed = now
+
+	srcAddr := nat64Addr(ipheader.srcAddr)
+	l4 = append([]byte{}, l4...)
+	switch nextHeader {
+	case IP_PROTOCOL_NUM_ICMPV6:
+		l4[0] = ICMPV6_TYPE_ECHO_REPLY
+		copy(l4[4:6], uint16ToByte(session.hostPort))
+		l4[2], l4[3] = 0, 0
+		checksum := calcChecksum(ipv6PseudoPacket(srcAddr, session.hostAddr, IP_PROTOCOL_NUM_ICMPV6, l4))
+		l4[2], l4[3] = checksum[0], checksum[1]
+	case IP_PROTOCOL_NUM_UDP, IP_PROTOCOL_NUM_TCP:
+		copy(l4[2:4], uint16ToByte(session.hostPort))
+		offset := 6
+		if nextHeader == IP_PROTOCOL_NUM_TCP {
+			offset = 16
+		}
+		// IPv6ではUDPのチェックサムを省略できないので、IPv4で0だったものも計算する
+		l4[offset], l4[offset+1] = 0, 0
+		checksum := calcChecksum(ipv6PseudoPacket(srcAddr, session.hostAddr, nextHeader, l4))
+		if checksum[0] == 0 && checksum[1] == 0 && nextHeader == IP_PROTOCOL_NUM_UDP {
+			checksum = []byte{0xff, 0xff}
+		}
+		l4[offset], l4[offset+1] = checksum[0], checksum[1]
+	}
+	tracef("nat64: %s is translated to [%s]", printIPAddr(ipheader.destAddr), netip.AddrFrom16(session.hostAddr))
+	packet := ipv6Packet(srcAddr, session.hostAddr, nextHeader, ipheader.ttl-1, l4)
+	// トラフィッククラスにToSを入れる
+	packet[0] |= ipheader.tos >> 4
+	packet[1] |= ipheader.tos << 4
+	ethernetOutput(session.netdev, session.hostMac, packet, ETHER_TYPE_IPV6)
+	return true
+}
+
+// IPv4の疑似ヘッダでTCP/UDPのチェックサムを計算し直す、offsetはチェックサムの位置
+func nat64SetIpv4Checksum(protocol uint8, srcAddr, destAddr uint32, l4 []byte, offset int) {
+	l4[offset], l4[offset+1] = 0, 0
+	pseudo := append(uint32ToByte(srcAddr), uint32ToByte(destAddr)...)
+	pseudo = append(pseudo, 0x00, protocol)
+	pseudo = append(pseudo, uint16ToByte(uint16(len(l4)))...)
+	checksum := calcChecksum(append(pseudo, l4...))
+	// UDPでは計算結果が0の場合は0xffffにする
+	if protocol == IP_PROTOCOL_NUM_UDP && checksum[0] == 0 && checksum[1] == 0 {
+		checksum = []byte{0xff, 0xff}
+	}
+	l4[offset], l4[offset+1] = checksum[0], checksum[1]
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+/*
+設定と管理APIで使うアドレスの型
+設定ファイル、コマンドライン、管理APIではnetip.Addr、netip.Prefix、net.HardwareAddrで扱い、
+文字列との変換や範囲の確認は標準ライブラリに任せる
+パケットの処理、ARPテーブル、radix treeはヘッダから読んだままのuint32と[6]uint8を使うので、
+その境目でここの関数を使って変換する
+*/
+
+// IPv4のアドレスを読む
+func parseIPv4Addr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Is4() {
+		return netip.Addr{}, fmt.Errorf("invalid ipv4 address %s", s)
+	}
+	return addr, nil
+}
+
+// "192.168.2.0/24"を読む、ホスト部のビットは落とす、"default"はデフォルト経路の0.0.0.0/0
+func parseIPv4Prefix(s string) (netip.Prefix, error) {
+	if s == "default" {
+		return netip.PrefixFrom(netip.IPv4Unspecified(), 0), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil || !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid ipv4 prefix %s", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// パケットの処理で使うuint32のアドレスにする、無効なアドレスは0にする
+func ipv4Uint32(addr netip.Addr) uint32 {
+	if !addr.Is4() {
+		return 0
+	}
+	b := addr.As4()
+	return byteToUint32(b[:])
+}
+
+// uint32のアドレスをnetip.Addrにする
+func ipv4Addr(addr uint32) netip.Addr {
+	b := uint32ToByte(addr)
+	return netip.AddrFrom4([4]byte{b[0], b[1], b[2], b[3]})
+}
+
+func ipv4Uint32s(addrs []netip.Addr) []uint32 {
+	var list []uint32
+	for _, addr := range addrs {
+		list = append(list, ipv4Uint32(addr))
+	}
+	return list
+}
+
+// radix treeで使うプレフィックスとプレフィックス長にする
+func prefixRoute(prefix netip.Prefix) (uint32, uint32) {
+	return ipv4Uint32(prefix.Addr()), uint32(prefix.Bits())
+}
+
+// radix treeのプレフィックスとプレフィックス長をnetip.Prefixにする
+func routePrefix(prefix, prefixLen uint32) netip.Prefix {
+	return netip.PrefixFrom(ipv4Addr(prefix), int(prefixLen))
+}
+
+// アドレスとサブネットマスクをnetip.Prefixにする、ホスト部のビットは残す
+func addrPrefix(addr, netmask uint32) netip.Prefix {
+	return netip.PrefixFrom(ipv4Addr(addr), int(subnetToPrefixLen(netmask)))
+}
+
+// [6]uint8のMACアドレスをnet.HardwareAddrにする
+func hardwareAddr(mac [6]uint8) net.HardwareAddr {
+	return net.HardwareAddr(mac[:])
+}
+
+// net.HardwareAddrを[6]uint8にする、イーサネットのアドレスでなければエラーにする
+func macFromHardwareAddr(hw net.HardwareAddr) ([6]uint8, error) {
+	var mac [6]uint8
+	if len(hw) != ETHERNET_ADDRES_LEN {
+		return mac, fmt.Errorf("invalid mac address %s", hw)
+	}
+	copy(mac[:], hw)
+	return mac, nil
+}
+
+// 管理APIで返す文字列にする、無効なアドレスは空文字列にして省略する
+func addrString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.String()
+}
+
+func prefixString(prefix netip.Prefix) string {
+	if !prefix.IsValid() {
+		return ""
+	}
+	return prefix.String()
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var list []string
+	for _, prefix := range prefixes {
+		list = append(list, prefix.String())
+	}
+	return list
+}
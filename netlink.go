@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// rtnetlinkのマルチキャストグループ
+// https://github.com/torvalds/linux/blob/master/include/uapi/linux/rtnetlink.h
+const (
+	RTMGRP_LINK        uint32 = 0x01
+	RTMGRP_IPV4_IFADDR uint32 = 0x10
+	RTMGRP_IPV4_ROUTE  uint32 = 0x40
+)
+
+const NETLINK_RECV_BUFFER_SIZE = 65536
+
+/*
+rtnetlinkのsocketを作成して指定したグループに参加する
+*/
+func openNetlinkSocket(groups uint32) (int, error) {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return -1, fmt.Errorf("create netlink socket err : %s", err)
+	}
+	err = syscall.Bind(sock, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: groups,
+	})
+	if err != nil {
+		syscall.Close(sock)
+		return -1, fmt.Errorf("bind netlink socket err : %s", err)
+	}
+	return sock, nil
+}
+
+/*
+netlinkのメッセージの受信処理
+*/
+func netlinkInput(epfd, sock int) error {
+	recvBuffer := make([]byte, NETLINK_RECV_BUFFER_SIZE)
+	n, _, err := syscall.Recvfrom(sock, recvBuffer, 0)
+	if err != nil {
+		return fmt.Errorf("netlink recv err : %s", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(recvBuffer[:n])
+	if err != nil {
+		return fmt.Errorf("parse netlink message err : %s", err)
+	}
+	for _, msg := range msgs {
+		switch msg.Header.Type {
+		case syscall.RTM_NEWLINK:
+			netlinkNewLink(epfd, msg)
+		case syscall.RTM_DELLINK:
+			netlinkDelLink(epfd, msg)
+		case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+			netlinkAddrChanged(msg)
+		}
+	}
+	return nil
+}
+
+// ifinfomsgからインターフェイスのindexを取り出す
+func netlinkIfIndex(msg syscall.NetlinkMessage) (int, bool) {
+	if len(msg.Data) < syscall.SizeofIfInfomsg {
+		return 0, false
+	}
+	ifinfo := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+	return int(ifinfo.Index), true
+}
+
+// ifindexからnetDeviceを探す
+func searchNetDeviceByIndex(index int) *netDevice {
+	for _, netdev := range netDeviceList {
+		if (netdev.backend == packetSocket || netdev.backend == xdpSocket) && netdev.sockAddr.Ifindex == index {
+			return netdev
+		}
+	}
+	return nil
+}
+
+/*
+インターフェイスが追加された時の処理
+状態の変化でも通知されるので、知っているインターフェイスならリンクの状態を反映し、知らないインターフェイスの場合だけnetDeviceを作る
+*/
+func netlinkNewLink(epfd int, msg syscall.NetlinkMessage) {
+	index, ok := netlinkIfIndex(msg)
+	if !ok {
+		return
+	}
+	if netdev := searchNetDeviceByIndex(index); netdev != nil {
+		ifinfo := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		setNetDeviceLinkState(netdev, operUp(ifinfo.Flags))
+		return
+	}
+	netif, err := net.InterfaceByIndex(index)
+	if err != nil {
+		// 通知を受け取るまでの間に消えていることがある
+		return
+	}
+	if isIgnoreInterfaces(netif.Name) {
+		return
+	}
+	fmt.Printf("Detected new interface %s\n", netif.Name)
+	netdev, err := newInterfaceNetDevice(*netif)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	netdev.linkDown = !netifOperUp(*netif)
+	err = registerNetDevice(epfd, netdev)
+	if err != nil {
+		netdev.closeSocket()
+		fmt.Println(err)
+	}
+}
+
+/*
+インターフェイスが削除された時の処理
+*/
+func netlinkDelLink(epfd int, msg syscall.NetlinkMessage) {
+	index, ok := netlinkIfIndex(msg)
+	if !ok {
+		return
+	}
+	netdev := searchNetDeviceByIndex(index)
+	if netdev == nil {
+		return
+	}
+	fmt.Printf("Detected interface %s is removed\n", netdev.name)
+	unregisterNetDevice(epfd, netdev)
+}
+
+/*
+インターフェイスのアドレスが変わった時の処理
+インターフェイスについているアドレスを読み直して、変わっていれば直接接続の経路を入れ替える
+*/
+func netlinkAddrChanged(msg syscall.NetlinkMessage) {
+	if len(msg.Data) < syscall.SizeofIfAddrmsg {
+		return
+	}
+	ifaddr := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+	if ifaddr.Family != syscall.AF_INET {
+		return
+	}
+	netdev := searchNetDeviceByIndex(int(ifaddr.Index))
+	if netdev == nil {
+		return
+	}
+	netif, err := net.InterfaceByIndex(int(ifaddr.Index))
+	if err != nil {
+		return
+	}
+	netaddrs, err := netif.Addrs()
+	if err != nil {
+		fmt.Printf("get ip addr from nic interface is err : %s\n", err)
+		return
+	}
+	ipdev := getIPdevice(netaddrs)
+	if ipdev.equal(netdev.ipDev) {
+		return
+	}
+	setNetDeviceAddress(netdev, ipdev)
+}
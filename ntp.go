@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+/*
+SNTPクライアントとサーバ
+上位のNTPサーバとの時刻のずれを測り、ルータが外に出す時刻(パケットのイベントなど)を補正する
+OSの時計は変更しない。ARPやFDBのエージングは経過時間で測るので時計のずれの影響を受けない
+-ntp-serveを指定すると、補正した時刻をラボのホストにNTPで配る
+https://www.rfc-editor.org/rfc/rfc4330
+*/
+
+const NTP_PORT uint16 = 123
+
+const NTP_PACKET_LEN = 48
+
+const (
+	NTP_MODE_CLIENT uint8 = 3
+	NTP_MODE_SERVER uint8 = 4
+)
+
+const NTP_VERSION uint8 = 4
+
+// 閏秒の指示子、3は同期していない
+const NTP_LEAP_NOT_SYNCHRONIZED uint8 = 3
+
+const NTP_STRATUM_UNSYNCHRONIZED uint8 = 16
+
+// 上位のサーバが無い時にローカルの時計で答える時の階層
+const NTP_STRATUM_LOCAL uint8 = 10
+
+// 1900年から1970年までの秒数
+const NTP_EPOCH_OFFSET = 2208988800
+
+// 同期してからの問い合わせの間隔と、同期するまで再送する間隔
+const NTP_POLL_INTERVAL = 64 * time.Second
+const NTP_RETRY_INTERVAL = 2 * time.Second
+
+// OSの時計に足すと正しい時刻になる、ナノ秒
+var ntpClockOffset atomic.Int64
+
+// 補正した現在時刻
+func routerNow() time.Time {
+	return time.Now().Add(time.Duration(ntpClockOffset.Load()))
+}
+
+type ntpClient struct {
+	servers     []uint32
+	current     int    // 問い合わせるサーバ
+	port        uint16 // 応答を受けるポート
+	transmitted [8]byte
+	sentAt      time.Time
+	// 最後に同期した結果
+	synchronized bool
+	server       uint32
+	stratum      uint8
+	offset       time.Duration
+	delay        time.Duration
+	lastSync     time.Time
+}
+
+// nilならSNTPクライアントは動いていない
+var ntpState *ntpClient
+
+// NTPサーバとして答えているか
+var ntpServing bool
+
+// コマンドラインで指定された上位のサーバとNTPサーバとして答えるか
+var ntpServers []uint32
+var ntpServe bool
+
+// NTPのタイムスタンプ、上位32bitが秒で下位32bitが秒の小数部
+func ntpTimestamp(t time.Time) []byte {
+	seconds := uint32(t.Unix() + NTP_EPOCH_OFFSET)
+	fraction := uint32((uint64(t.Nanosecond()) << 32) / uint64(time.Second))
+	return append(uint32ToByte(seconds), uint32ToByte(fraction)...)
+}
+
+func ntpTime(b []byte) time.Time {
+	seconds := int64(byteToUint32(b[0:4])) - NTP_EPOCH_OFFSET
+	nanoseconds := (uint64(byteToUint32(b[4:8])) * uint64(time.Second)) >> 32
+	return time.Unix(seconds, int64(nanoseconds))
+}
+
+/*
+SNTPクライアントとサーバを設定する
+*/
+func setNtp(servers []uint32, serve bool) {
+	if len(servers) == 0 {
+		if ntpState != nil {
+			udpClose(ntpState.port)
+			ntpState = nil
+			fmt.Println("NTP client is stopped")
+		}
+	} else {
+		if ntpState == nil {
+			ntpState = &ntpClient{}
+			for {
+				ntpState.port = uint16(49152 + rand.Intn(16384))
+				if _, ok := udpHandlers[ntpState.port]; !ok {
+					break
+				}
+			}
+			udpListen(ntpState.port, ntpResponseInput)
+			fmt.Println("NTP client is started")
+		}
+		ntpState.servers = servers
+		ntpState.current = 0
+	}
+
+	if serve != ntpServing {
+		ntpServing = serve
+		if serve {
+			udpListen(NTP_PORT, ntpRequestInput)
+			fmt.Println("NTP server is started")
+		} else {
+			udpClose(NTP_PORT)
+			fmt.Println("NTP server is stopped")
+		}
+	}
+}
+
+// 上位のサーバに問い合わせる
+func ntpSendRequest() {
+	client := ntpState
+	packet := make([]byte, NTP_PACKET_LEN)
+	packet[0] = NTP_VERSION<<3 | NTP_MODE_CLIENT
+	// 送信時刻は応答のOriginate Timestampにそのまま返ってくる
+	client.sentAt = time.Now()
+	copy(client.transmitted[:], ntpTimestamp(client.sentAt))
+	copy(packet[40:48], client.transmitted[:])
+	udpOutput(0, client.servers[client.current], client.port, NTP_PORT, packet)
+}
+
+/*
+上位のサーバからの応答の処理
+T1:問い合わせの送信 T2:サーバの受信 T3:サーバの送信 T4:応答の受信
+ずれ = ((T2 - T1) + (T3 - T4)) / 2
+往復の遅延 = (T4 - T1) - (T3 - T2)
+*/
+func ntpResponseInput(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, packet []byte) {
+	client := ntpState
+	receivedAt := time.Now()
+	if len(packet) < NTP_PACKET_LEN || packet[0]&0x07 != NTP_MODE_SERVER || srcPort != NTP_PORT ||
+		ipheader.srcAddr != client.servers[client.current] {
+		countDrop(DROP_REASON_NTP_INVALID)
+		return
+	}
+	// 問い合わせに対する応答でなければ破棄する
+	if [8]byte(packet[24:32]) != client.transmitted {
+		debugPrintf("Drop NTP response with unexpected originate timestamp from %s\n", printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_NTP_INVALID)
+		return
+	}
+	client.transmitted = [8]byte{}
+	stratum := packet[1]
+	if packet[0]>>6 == NTP_LEAP_NOT_SYNCHRONIZED || stratum == 0 || stratum >= NTP_STRATUM_UNSYNCHRONIZED {
+		fmt.Printf("NTP server %s is not synchronized\n", printIPAddr(ipheader.srcAddr))
+		return
+	}
+
+	// T1とT4はOSの時計、T2とT3はサーバの時計
+	t1 := client.sentAt.Round(0)
+	t2 := ntpTime(packet[32:40])
+	t3 := ntpTime(packet[40:48])
+	t4 := receivedAt.Round(0)
+	offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay := t4.Sub(t1) - t3.Sub(t2)
+
+	if !client.synchronized || client.server != ipheader.srcAddr {
+		fmt.Printf("NTP synchronized to %s, offset %s delay %s stratum %d\n",
+			printIPAddr(ipheader.srcAddr), offset, delay, stratum)
+	}
+	client.synchronized = true
+	client.server = ipheader.srcAddr
+	client.stratum = stratum
+	client.offset = offset
+	client.delay = delay
+	client.lastSync = receivedAt
+	ntpClockOffset.Store(int64(offset))
+}
+
+/*
+定期的に上位のサーバに問い合わせる
+応答が無ければ次のサーバに切り替えて再送する
+*/
+func startNtpClient() {
+	go func() {
+		next := time.Now()
+		for {
+			time.Sleep(time.Until(next))
+			routerMutex.Lock()
+			client := ntpState
+			if client == nil {
+				routerMutex.Unlock()
+				next = time.Now().Add(NTP_RETRY_INTERVAL)
+				continue
+			}
+			// 前の問い合わせに応答が無かった
+			if client.transmitted != [8]byte{} {
+				client.current = (client.current + 1) % len(client.servers)
+			}
+			ntpSendRequest()
+			if client.synchronized && time.Since(client.lastSync) < NTP_POLL_INTERVAL*4 {
+				next = time.Now().Add(NTP_POLL_INTERVAL)
+			} else {
+				next = time.Now().Add(NTP_RETRY_INTERVAL)
+			}
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+/*
+NTPサーバとしてクライアントからの問い合わせに答える
+*/
+func ntpRequestInput(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, packet []byte) {
+	receivedAt := routerNow()
+	if len(packet) < NTP_PACKET_LEN || packet[0]&0x07 != NTP_MODE_CLIENT || !inputdev.ipDev.hasAddr(ipheader.destAddr) {
+		countDrop(DROP_REASON_NTP_INVALID)
+		return
+	}
+	response := make([]byte, NTP_PACKET_LEN)
+	version := packet[0] >> 3 & 0x07
+	leap := uint8(0)
+	stratum := NTP_STRATUM_LOCAL
+	referenceID := []byte("LOCL")
+	var referenceTime time.Time
+	switch {
+	case ntpState != nil && ntpState.synchronized:
+		stratum = ntpState.stratum + 1
+		referenceID = uint32ToByte(ntpState.server)
+		referenceTime = ntpState.lastSync.Add(ntpState.offset)
+	case ntpState != nil:
+		// 上位のサーバと同期するまでは使わないように知らせる
+		leap = NTP_LEAP_NOT_SYNCHRONIZED
+		stratum = NTP_STRATUM_UNSYNCHRONIZED
+	default:
+		referenceTime = receivedAt
+	}
+	response[0] = leap<<6 | version<<3 | NTP_MODE_SERVER
+	response[1] = stratum
+	response[2] = packet[2] // Poll
+	response[3] = 0xec      // Precision、約60ns
+	copy(response[12:16], referenceID)
+	if !referenceTime.IsZero() {
+		copy(response[16:24], ntpTimestamp(referenceTime))
+	}
+	// クライアントの送信時刻をOriginate Timestampとして返す
+	copy(response[24:32], packet[40:48])
+	copy(response[32:40], ntpTimestamp(receivedAt))
+	copy(response[40:48], ntpTimestamp(routerNow()))
+	udpOutput(ipheader.destAddr, ipheader.srcAddr, NTP_PORT, srcPort, response)
+}
@@ -0,0 +1,76 @@
+/*
+go-curoの受信処理に外からプロトコルを足すためのハンドラの登録
+go-curoはmainパッケージで外からimportできないので、受信したフレームの情報とIPヘッダ、ハンドラの型はこのパッケージに置く
+別のモジュールのパッケージでもこのパッケージをimportしてinitで登録し、go-curoのディレクトリに
+`import _ "example.com/gre"`とだけ書いたファイルを足してビルドすれば、受信処理の本体を書き換えずに組み込める
+ARPやIP、UDPなどgo-curoが処理するイーサタイプとプロトコル番号には登録できず、起動する時に重なっていれば止まる
+ハンドラはルータの受信処理と同じgoroutineで呼ばれるので、ブロックしないようにする
+渡すパケットのスライスは受信のバッファを指していて呼び出しの間だけ有効なので、後で使う時はコピーする
+*/
+package pipeline
+
+import "fmt"
+
+// 受信したフレームの情報
+type Context struct {
+	Interface    string  // 受信したインターフェイスの名前
+	InterfaceMAC [6]byte // 受信したインターフェイスのMACアドレス
+	SrcMAC       [6]byte // 送信元MACアドレス
+	DestMAC      [6]byte // 宛先MACアドレス
+	EtherType    uint16
+	// 受信したインターフェイスから、イーサネットヘッダをつけてペイロードを送る
+	Output func(destMAC [6]byte, etherType uint16, payload []byte) error
+	// IPヘッダをつけてルートテーブルで選んだインターフェイスから送る、srcAddrが0なら経路から送信元アドレスを選ぶ
+	IPOutput func(destAddr, srcAddr uint32, protocol uint8, payload []byte) error
+}
+
+// 受信したIPパケットのヘッダ、アドレスはホストのバイトオーダー
+type IPHeader struct {
+	Version        uint8
+	HeaderLen      uint8 // 4バイト単位のヘッダ長
+	Tos            uint8
+	TotalLen       uint16
+	Identify       uint16
+	FragOffset     uint16 // フラグとフラグメントオフセット
+	TTL            uint8
+	Protocol       uint8
+	HeaderChecksum uint16
+	SrcAddr        uint32
+	DestAddr       uint32
+}
+
+// イーサネットのペイロードを受け取るハンドラ
+type EtherTypeHandler func(ctx *Context, packet []byte) error
+
+// 自分宛てのIPパケットのペイロード(IPヘッダの後ろ)を受け取るハンドラ
+type IPProtocolHandler func(ctx *Context, header *IPHeader, packet []byte) error
+
+var etherTypeHandlers = map[uint16]EtherTypeHandler{}
+
+var ipProtocolHandlers = map[uint8]IPProtocolHandler{}
+
+// イーサタイプのハンドラを登録する、同じイーサタイプを2回登録するのはプログラムの誤りなのでpanicする
+func RegisterEtherType(etherType uint16, handler EtherTypeHandler) {
+	if _, ok := etherTypeHandlers[etherType]; ok {
+		panic(fmt.Sprintf("ether type 0x%04x is already registered", etherType))
+	}
+	etherTypeHandlers[etherType] = handler
+}
+
+// IPのプロトコル番号のハンドラを登録する、同じ番号を2回登録するのはプログラムの誤りなのでpanicする
+func RegisterIPProtocol(protocol uint8, handler IPProtocolHandler) {
+	if _, ok := ipProtocolHandlers[protocol]; ok {
+		panic(fmt.Sprintf("ip protocol %d is already registered", protocol))
+	}
+	ipProtocolHandlers[protocol] = handler
+}
+
+// 登録されたイーサタイプのハンドラ、無ければnil
+func EtherTypeHandlerFor(etherType uint16) EtherTypeHandler {
+	return etherTypeHandlers[etherType]
+}
+
+// 登録されたIPのプロトコル番号のハンドラ、無ければnil
+func IPProtocolHandlerFor(protocol uint8) IPProtocolHandler {
+	return ipProtocolHandlers[protocol]
+}
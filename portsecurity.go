@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ブリッジのポートセキュリティ
+ポートごとに学習できるMACアドレスの数を制限して、それを超える送信元からのフレームを違反として扱う
+  max        ポートで学習できるMACアドレスの数(デフォルトは1)
+  sticky     学習したMACアドレスをエージングで消さずに保持して、他のポートで同じ送信元を受け取ったら違反にする
+  violation  違反した時の動作
+    protect   フレームを捨てる
+    restrict  フレームを捨ててログに出す(デフォルト)
+    shutdown  ログに出してポートのインターフェイスを止める、管理APIで上げ直すまで戻らない
+*/
+
+// ポートセキュリティの違反をログに出す間隔
+const PORT_SECURITY_LOG_INTERVAL = 1 * time.Second
+
+type portSecurityViolation uint8
+
+const (
+	portSecurityRestrict portSecurityViolation = iota
+	portSecurityProtect
+	portSecurityShutdown
+)
+
+func parsePortSecurityViolation(s string) (portSecurityViolation, error) {
+	switch s {
+	case "", "restrict":
+		return portSecurityRestrict, nil
+	case "protect":
+		return portSecurityProtect, nil
+	case "shutdown":
+		return portSecurityShutdown, nil
+	}
+	return portSecurityRestrict, fmt.Errorf("unknown port security violation action %s", s)
+}
+
+func (violation portSecurityViolation) String() string {
+	switch violation {
+	case portSecurityProtect:
+		return "protect"
+	case portSecurityShutdown:
+		return "shutdown"
+	}
+	return "restrict"
+}
+
+type portSecurityConfig struct {
+	ifname    string
+	maxMacs   int
+	sticky    bool
+	violation portSecurityViolation
+}
+
+// コマンドラインで指定されたポートセキュリティ
+var portSecurityFlags = map[string]portSecurityConfig{}
+
+// "dev=eth1,max=2,sticky=true,violation=restrict"の形式のポートセキュリティの設定
+func parsePortSecurityConfig(spec string) (portSecurityConfig, error) {
+	config := portSecurityConfig{maxMacs: 1}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return portSecurityConfig{}, fmt.Errorf("invalid port security config %q, format is dev=name,max=count,sticky=bool,violation=protect|restrict|shutdown", spec)
+		}
+		var err error
+		switch key {
+		case "dev":
+			config.ifname = value
+		case "max":
+			config.maxMacs, err = strconv.Atoi(value)
+		case "sticky":
+			config.sticky, err = strconv.ParseBool(value)
+		case "violation":
+			config.violation, err = parsePortSecurityViolation(value)
+		default:
+			err = fmt.Errorf("unknown port security config %q", key)
+		}
+		if err != nil {
+			return portSecurityConfig{}, err
+		}
+	}
+	if config.ifname == "" {
+		return portSecurityConfig{}, fmt.Errorf("port security interface is not specified")
+	}
+	if config.maxMacs < 1 {
+		return portSecurityConfig{}, fmt.Errorf("max macs of port security on %s must be at least 1", config.ifname)
+	}
+	return config, nil
+}
+
+// ポートで学習しているMACアドレスの数
+func (br *bridge) countPortMacs(netdev *netDevice, now time.Time) int {
+	count := 0
+	for _, entry := range br.fdb {
+		if entry.port == netdev && entry.valid(now) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+送信元のMACアドレスを学習する
+ポートセキュリティに違反したらfalseを返す
+*/
+func bridgeLearn(br *bridge, port *bridgePort, srcAddr [6]uint8, now time.Time) bool {
+	inputdev := port.netdev
+	entry, ok := br.fdb[srcAddr]
+	if ok && !entry.valid(now) {
+		ok = false
+	}
+	security := port.security
+	if security != nil {
+		// 他のポートにstickyで保持しているMACアドレスは移動させない
+		if ok && entry.port != inputdev && entry.sticky {
+			portSecurityViolate(br, port, srcAddr, now)
+			return false
+		}
+		if (!ok || entry.port != inputdev) && br.countPortMacs(inputdev, now) >= security.maxMacs {
+			portSecurityViolate(br, port, srcAddr, now)
+			return false
+		}
+	}
+	if !ok || entry.port != inputdev {
+		debugPrintf("Learned %s on %s in bridge %s\n", printMacAddr(srcAddr), inputdev.name, br.name)
+	}
+	br.fdb[srcAddr] = &fdbEntry{
+		port:    inputdev,
+		expires: now.Add(br.agingTime),
+		sticky:  security != nil && security.sticky,
+	}
+	return true
+}
+
+// ポートセキュリティの違反の動作をする
+func portSecurityViolate(br *bridge, port *bridgePort, srcAddr [6]uint8, now time.Time) {
+	port.violations++
+	countDrop(DROP_REASON_PORT_SECURITY)
+	switch port.security.violation {
+	case portSecurityProtect:
+		return
+	case portSecurityShutdown:
+		fmt.Printf("Port security violation by %s on %s in bridge %s, shutting down the port\n", printMacAddr(srcAddr), port.netdev.name, br.name)
+		if err := setNetDeviceAdminState(routerEpfd, port.netdev, false); err != nil {
+			fmt.Println(err)
+		}
+		// 止めたポートに転送しないように、stickyでないエントリを消す
+		for mac, entry := range br.fdb {
+			if entry.port == port.netdev && !entry.sticky {
+				delete(br.fdb, mac)
+			}
+		}
+		return
+	}
+	if now.Sub(port.lastViolationLog) < PORT_SECURITY_LOG_INTERVAL {
+		return
+	}
+	port.lastViolationLog = now
+	fmt.Printf("Port security violation by %s on %s in bridge %s\n", printMacAddr(srcAddr), port.netdev.name, br.name)
+}
@@ -0,0 +1,955 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+PPPoEクライアント
+WAN側のインターフェイスでPPPoEのセッションを張り、LCPで回線を確立してIPCPでISPからアドレスを受け取る
+セッションが上がるとアドレスをインターフェイスにつけて、デフォルト経路をセッションに向ける
+https://www.rfc-editor.org/rfc/rfc2516 (PPPoE)
+https://www.rfc-editor.org/rfc/rfc1661 (PPP、LCP)
+https://www.rfc-editor.org/rfc/rfc1334 (PAP)
+https://www.rfc-editor.org/rfc/rfc1332 (IPCP)
+*/
+
+const ETHER_TYPE_PPPOE_DISCOVERY uint16 = 0x8863
+const ETHER_TYPE_PPPOE_SESSION uint16 = 0x8864
+
+const PPPOE_VERSION_TYPE uint8 = 0x11
+const PPPOE_HEADER_LEN = 6
+
+const (
+	PPPOE_CODE_SESSION uint8 = 0x00
+	PPPOE_CODE_PADO    uint8 = 0x07 // Offer
+	PPPOE_CODE_PADI    uint8 = 0x09 // Initiation
+	PPPOE_CODE_PADR    uint8 = 0x19 // Request
+	PPPOE_CODE_PADS    uint8 = 0x65 // Session-confirmation
+	PPPOE_CODE_PADT    uint8 = 0xa7 // Terminate
+)
+
+const (
+	PPPOE_TAG_END_OF_LIST        uint16 = 0x0000
+	PPPOE_TAG_SERVICE_NAME       uint16 = 0x0101
+	PPPOE_TAG_AC_NAME            uint16 = 0x0102
+	PPPOE_TAG_HOST_UNIQ          uint16 = 0x0103
+	PPPOE_TAG_AC_COOKIE          uint16 = 0x0104
+	PPPOE_TAG_RELAY_SESSION_ID   uint16 = 0x0110
+	PPPOE_TAG_SERVICE_NAME_ERROR uint16 = 0x0201
+	PPPOE_TAG_AC_SYSTEM_ERROR    uint16 = 0x0202
+	PPPOE_TAG_GENERIC_ERROR      uint16 = 0x0203
+)
+
+// PPPoEヘッダとPPPのプロトコル番号の8バイトだけイーサネットのMTUより小さくなる
+const PPPOE_MTU = 1492
+
+const (
+	PPP_PROTOCOL_IP   uint16 = 0x0021
+	PPP_PROTOCOL_IPCP uint16 = 0x8021
+	PPP_PROTOCOL_LCP  uint16 = 0xc021
+	PPP_PROTOCOL_PAP  uint16 = 0xc023
+)
+
+// LCPとIPCPで共通のコード
+const (
+	PPP_CODE_CONFIGURE_REQUEST uint8 = 1
+	PPP_CODE_CONFIGURE_ACK     uint8 = 2
+	PPP_CODE_CONFIGURE_NAK     uint8 = 3
+	PPP_CODE_CONFIGURE_REJECT  uint8 = 4
+	PPP_CODE_TERMINATE_REQUEST uint8 = 5
+	PPP_CODE_TERMINATE_ACK     uint8 = 6
+	PPP_CODE_CODE_REJECT       uint8 = 7
+	PPP_CODE_PROTOCOL_REJECT   uint8 = 8 // ここからはLCPだけ
+	PPP_CODE_ECHO_REQUEST      uint8 = 9
+	PPP_CODE_ECHO_REPLY        uint8 = 10
+	PPP_CODE_DISCARD_REQUEST   uint8 = 11
+)
+
+const PPP_CONTROL_HEADER_LEN = 4
+
+const (
+	LCP_OPTION_MRU           uint8 = 1
+	LCP_OPTION_AUTH_PROTOCOL uint8 = 3
+	LCP_OPTION_MAGIC_NUMBER  uint8 = 5
+)
+
+const IPCP_OPTION_IP_ADDRESS uint8 = 3
+
+const (
+	PAP_CODE_AUTHENTICATE_REQUEST uint8 = 1
+	PAP_CODE_AUTHENTICATE_ACK     uint8 = 2
+	PAP_CODE_AUTHENTICATE_NAK     uint8 = 3
+)
+
+// PADIとPADRの再送間隔と、PADRに応答が無い時に探索からやり直すまでの回数
+const PPPOE_DISCOVERY_INTERVAL = 2 * time.Second
+const PPPOE_PADR_MAX_RETRY = 3
+
+// Configure-Requestの再送間隔と、交渉を諦めてセッションを張り直すまでの回数
+const PPP_RESTART_INTERVAL = 3 * time.Second
+const PPP_MAX_CONFIGURE = 10
+
+// 回線が生きているかを確かめるEcho-Requestの間隔と、応答が無い時に切断するまでの回数
+const PPP_ECHO_INTERVAL = 10 * time.Second
+const PPP_ECHO_MAX_FAILURE = 3
+
+type pppoeState uint8
+
+const (
+	pppoeStateDiscovery  pppoeState = iota // PADIを送ってPADOを待っている
+	pppoeStateRequesting                   // PADRを送ってPADSを待っている
+	pppoeStateLcp                          // セッションが張れてLCPで交渉している
+	pppoeStateAuth                         // PAPで認証している
+	pppoeStateIpcp                         // IPCPでアドレスを交渉している
+	pppoeStateUp                           // IPのパケットを送受信できる
+)
+
+func (state pppoeState) String() string {
+	switch state {
+	case pppoeStateRequesting:
+		return "requesting"
+	case pppoeStateLcp:
+		return "lcp"
+	case pppoeStateAuth:
+		return "auth"
+	case pppoeStateIpcp:
+		return "ipcp"
+	case pppoeStateUp:
+		return "up"
+	}
+	return "discovery"
+}
+
+// LCPとIPCPの交渉の状況、お互いにConfigure-Ackを送り合うと開通する
+type pppNegotiation struct {
+	id          uint8 // 最後に送ったConfigure-Requestの識別子
+	ackSent     bool  // 相手の要求を受け入れた
+	ackReceived bool  // 自分の要求を受け入れられた
+}
+
+func (n pppNegotiation) opened() bool {
+	return n.ackSent && n.ackReceived
+}
+
+type pppOption struct {
+	optType uint8
+	value   []byte
+}
+
+type pppoeClient struct {
+	ifname   string
+	username string // 空ならPAPの認証をしない
+	password string
+	netdev   *netDevice
+	state    pppoeState
+	hostUniq []byte // 自分宛ての応答を見分けるためにPADIとPADRにつける
+	// PADOを送ってきたアクセスコンセントレータ
+	acMacAddr      [6]uint8
+	acName         string
+	cookie         []byte
+	relaySessionID []byte
+	sessionID      uint16
+	identifier     uint8 // 次に送る要求の識別子
+	lastSent       time.Time
+	retry          int
+	lcp            pppNegotiation
+	ipcp           pppNegotiation
+	mru            uint16 // 自分が受け取れる大きさ
+	peerMru        uint16 // 相手が受け取れる大きさ、送信するIPパケットの上限
+	magic          uint32
+	rejectMru      bool
+	authProtocol   uint16 // 相手が要求した認証のプロトコル
+	localAddr      uint32
+	peerAddr       uint32
+	lastEcho       time.Time
+	echoFailures   int
+	upSince        time.Time
+}
+
+// nilならPPPoEを使わない
+var pppoe *pppoeClient
+
+// コマンドラインで指定されたPPPoEのインターフェイスと認証情報
+var pppoeInterface string
+var pppoeUsername string
+var pppoePassword string
+
+/*
+PPPoEクライアントを設定する
+インターフェイスと認証情報が変わらなければ今のセッションをそのまま使う
+*/
+func setPppoe(ifname, username, password string) {
+	if pppoe != nil && pppoe.ifname == ifname && pppoe.username == username && pppoe.password == password {
+		return
+	}
+	if pppoe != nil {
+		pppoeStop(pppoe)
+		fmt.Printf("PPPoE client on %s is stopped\n", pppoe.ifname)
+		pppoe = nil
+	}
+	if ifname == "" {
+		return
+	}
+	hostUniq := make([]byte, 4)
+	rand.Read(hostUniq)
+	pppoe = &pppoeClient{
+		ifname:   ifname,
+		username: username,
+		password: password,
+		hostUniq: hostUniq,
+	}
+	fmt.Printf("PPPoE client on %s is started\n", ifname)
+	pppoeStartDiscovery(pppoe)
+}
+
+// インターフェイスを探してセッションを張るデバイスにする
+func pppoeAttach(client *pppoeClient) bool {
+	if client.netdev != nil {
+		return true
+	}
+	netdev := searchNetDeviceByName(client.ifname)
+	if netdev == nil {
+		return false
+	}
+	client.netdev = netdev
+	netdev.pppoe = client
+	netdev.updateSocketFilter()
+	return true
+}
+
+// セッションの情報を消してPADIからやり直す
+func pppoeStartDiscovery(client *pppoeClient) {
+	client.state = pppoeStateDiscovery
+	client.acMacAddr = [6]uint8{}
+	client.acName = ""
+	client.cookie = nil
+	client.relaySessionID = nil
+	client.sessionID = 0
+	client.retry = 0
+	client.localAddr = 0
+	client.peerAddr = 0
+	client.authProtocol = 0
+	if pppoeAttach(client) {
+		pppoeSendPadi(client)
+	}
+}
+
+func pppoeTag(tagType uint16, value []byte) []byte {
+	tag := append(uint16ToByte(tagType), uint16ToByte(uint16(len(value)))...)
+	return append(tag, value...)
+}
+
+// PPPoEヘッダをつける
+func pppoePacket(code uint8, sessionID uint16, payload []byte) []byte {
+	packet := []byte{PPPOE_VERSION_TYPE, code}
+	packet = append(packet, uint16ToByte(sessionID)...)
+	packet = append(packet, uint16ToByte(uint16(len(payload)))...)
+	return append(packet, payload...)
+}
+
+// 探索のパケットにつけるタグ、Service-Nameは空でどのサービスでもよいことにする
+func pppoeDiscoveryTags(client *pppoeClient) []byte {
+	tags := pppoeTag(PPPOE_TAG_SERVICE_NAME, nil)
+	tags = append(tags, pppoeTag(PPPOE_TAG_HOST_UNIQ, client.hostUniq)...)
+	return tags
+}
+
+func pppoeSendPadi(client *pppoeClient) {
+	client.lastSent = time.Now()
+	packet := pppoePacket(PPPOE_CODE_PADI, 0, pppoeDiscoveryTags(client))
+	ethernetOutput(client.netdev, ETHERNET_ADDRESS_BROADCAST, packet, ETHER_TYPE_PPPOE_DISCOVERY)
+}
+
+// PADOに入っていたCookieとRelay-Session-Idはそのまま返す
+func pppoeSendPadr(client *pppoeClient) {
+	client.lastSent = time.Now()
+	tags := pppoeDiscoveryTags(client)
+	if client.cookie != nil {
+		tags = append(tags, pppoeTag(PPPOE_TAG_AC_COOKIE, client.cookie)...)
+	}
+	if client.relaySessionID != nil {
+		tags = append(tags, pppoeTag(PPPOE_TAG_RELAY_SESSION_ID, client.relaySessionID)...)
+	}
+	ethernetOutput(client.netdev, client.acMacAddr, pppoePacket(PPPOE_CODE_PADR, 0, tags), ETHER_TYPE_PPPOE_DISCOVERY)
+}
+
+func pppoeSendPadt(client *pppoeClient) {
+	ethernetOutput(client.netdev, client.acMacAddr, pppoePacket(PPPOE_CODE_PADT, client.sessionID, nil), ETHER_TYPE_PPPOE_DISCOVERY)
+}
+
+// タグを読む、同じタグが複数あれば最初のものを使う
+func pppoeReadTags(payload []byte) (map[uint16][]byte, bool) {
+	tags := map[uint16][]byte{}
+	for len(payload) >= 4 {
+		tagType := byteToUint16(payload[0:2])
+		length := int(byteToUint16(payload[2:4]))
+		if len(payload) < 4+length {
+			return nil, false
+		}
+		if tagType == PPPOE_TAG_END_OF_LIST {
+			break
+		}
+		if _, ok := tags[tagType]; !ok {
+			tags[tagType] = payload[4 : 4+length]
+		}
+		payload = payload[4+length:]
+	}
+	return tags, true
+}
+
+// タグの値をコピーする、無いタグ(nil)はnilのままにする
+func pppoeCopyTag(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+// PPPoEヘッダを確認してペイロードを返す
+func pppoeReadHeader(packet []byte) (code uint8, sessionID uint16, payload []byte, ok bool) {
+	if len(packet) < PPPOE_HEADER_LEN || packet[0] != PPPOE_VERSION_TYPE {
+		return 0, 0, nil, false
+	}
+	length := int(byteToUint16(packet[4:6]))
+	if len(packet) < PPPOE_HEADER_LEN+length {
+		return 0, 0, nil, false
+	}
+	return packet[1], byteToUint16(packet[2:4]), packet[PPPOE_HEADER_LEN : PPPOE_HEADER_LEN+length], true
+}
+
+func init() {
+	registerEtherType(ETHER_TYPE_PPPOE_DISCOVERY, func(ctx *inputContext, packet []byte) error {
+		pppoeDiscoveryInput(ctx, packet)
+		return nil
+	})
+	registerEtherType(ETHER_TYPE_PPPOE_SESSION, func(ctx *inputContext, packet []byte) error {
+		pppoeSessionInput(ctx, packet)
+		return nil
+	})
+}
+
+/*
+探索のパケットの受信処理
+*/
+func pppoeDiscoveryInput(ctx *inputContext, packet []byte) {
+	netdev := ctx.netdev
+	client := netdev.pppoe
+	if client == nil {
+		countDrop(DROP_REASON_UNSUPPORTED_ETHER_TYPE)
+		return
+	}
+	code, sessionID, payload, ok := pppoeReadHeader(packet)
+	if !ok {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	tags, ok := pppoeReadTags(payload)
+	if !ok {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	srcAddr := ctx.ethHeader.srcAddr
+
+	switch code {
+	case PPPOE_CODE_PADO:
+		if client.state != pppoeStateDiscovery || !bytes.Equal(tags[PPPOE_TAG_HOST_UNIQ], client.hostUniq) {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		if pppoePrintErrorTags(tags, srcAddr) {
+			return
+		}
+		client.acMacAddr = srcAddr
+		client.acName = string(tags[PPPOE_TAG_AC_NAME])
+		// タグは受信のバッファを指しているのでコピーして持っておく
+		client.cookie = pppoeCopyTag(tags[PPPOE_TAG_AC_COOKIE])
+		client.relaySessionID = pppoeCopyTag(tags[PPPOE_TAG_RELAY_SESSION_ID])
+		fmt.Printf("PPPoE offer from %s (%s) on %s\n", printMacAddr(srcAddr), client.acName, netdev.name)
+		client.state = pppoeStateRequesting
+		client.retry = 0
+		pppoeSendPadr(client)
+	case PPPOE_CODE_PADS:
+		if client.state != pppoeStateRequesting || srcAddr != client.acMacAddr ||
+			!bytes.Equal(tags[PPPOE_TAG_HOST_UNIQ], client.hostUniq) {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		if pppoePrintErrorTags(tags, srcAddr) || sessionID == 0 {
+			pppoeStartDiscovery(client)
+			return
+		}
+		client.sessionID = sessionID
+		fmt.Printf("PPPoE session %d is established with %s on %s\n", sessionID, printMacAddr(srcAddr), netdev.name)
+		pppLcpStart(client)
+	case PPPOE_CODE_PADT:
+		if client.state < pppoeStateLcp || srcAddr != client.acMacAddr || sessionID != client.sessionID {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		fmt.Printf("PPPoE session %d on %s is terminated by %s\n", sessionID, netdev.name, printMacAddr(srcAddr))
+		pppoeIpDown(client)
+		pppoeStartDiscovery(client)
+	default:
+		// PADIとPADRはアクセスコンセントレータ宛て
+		countDrop(DROP_REASON_PPPOE_INVALID)
+	}
+}
+
+// エラーのタグがあれば出力してtrueを返す
+func pppoePrintErrorTags(tags map[uint16][]byte, srcAddr [6]uint8) bool {
+	for _, tagType := range []uint16{PPPOE_TAG_SERVICE_NAME_ERROR, PPPOE_TAG_AC_SYSTEM_ERROR, PPPOE_TAG_GENERIC_ERROR} {
+		if value, ok := tags[tagType]; ok {
+			fmt.Printf("PPPoE error 0x%04x from %s : %s\n", tagType, printMacAddr(srcAddr), value)
+			return true
+		}
+	}
+	return false
+}
+
+// セッションのパケットとしてPPPのフレームを送る
+func pppoeSendPpp(client *pppoeClient, protocol uint16, payload []byte) error {
+	packet := pppoePacket(PPPOE_CODE_SESSION, client.sessionID, append(uint16ToByte(protocol), payload...))
+	return ethernetOutput(client.netdev, client.acMacAddr, packet, ETHER_TYPE_PPPOE_SESSION)
+}
+
+/*
+セッションのパケットの受信処理
+*/
+func pppoeSessionInput(ctx *inputContext, packet []byte) {
+	client := ctx.netdev.pppoe
+	if client == nil {
+		countDrop(DROP_REASON_UNSUPPORTED_ETHER_TYPE)
+		return
+	}
+	code, sessionID, payload, ok := pppoeReadHeader(packet)
+	if !ok || code != PPPOE_CODE_SESSION || len(payload) < 2 || client.state < pppoeStateLcp ||
+		sessionID != client.sessionID || ctx.ethHeader.srcAddr != client.acMacAddr {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	protocol := byteToUint16(payload[0:2])
+	data := payload[2:]
+	switch protocol {
+	case PPP_PROTOCOL_LCP:
+		pppLcpInput(client, data)
+	case PPP_PROTOCOL_PAP:
+		pppPapInput(client, data)
+	case PPP_PROTOCOL_IPCP:
+		// LCPが開通するまではIPCPを受け取らない
+		if client.state < pppoeStateIpcp {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		pppIpcpInput(client, data)
+	case PPP_PROTOCOL_IP:
+		if client.state != pppoeStateUp {
+			countDrop(DROP_REASON_PPPOE_DOWN)
+			return
+		}
+		ipInput(ctx, data)
+	default:
+		// 知らないプロトコルはLCPのProtocol-Rejectで知らせる
+		if client.lcp.opened() {
+			client.identifier++
+			pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_PROTOCOL_REJECT, client.identifier, payload))
+		}
+		countDrop(DROP_REASON_PPPOE_INVALID)
+	}
+}
+
+func pppControlPacket(code, id uint8, data []byte) []byte {
+	packet := []byte{code, id}
+	packet = append(packet, uint16ToByte(uint16(PPP_CONTROL_HEADER_LEN+len(data)))...)
+	return append(packet, data...)
+}
+
+// LCPとIPCPのパケットのヘッダを確認して、コードと識別子とデータを返す
+func pppReadControlPacket(packet []byte) (code, id uint8, data []byte, ok bool) {
+	if len(packet) < PPP_CONTROL_HEADER_LEN {
+		return 0, 0, nil, false
+	}
+	length := int(byteToUint16(packet[2:4]))
+	if length < PPP_CONTROL_HEADER_LEN || len(packet) < length {
+		return 0, 0, nil, false
+	}
+	return packet[0], packet[1], packet[PPP_CONTROL_HEADER_LEN:length], true
+}
+
+func pppReadOptions(data []byte) ([]pppOption, bool) {
+	var options []pppOption
+	for len(data) != 0 {
+		if len(data) < 2 || data[1] < 2 || len(data) < int(data[1]) {
+			return nil, false
+		}
+		options = append(options, pppOption{optType: data[0], value: data[2:data[1]]})
+		data = data[data[1]:]
+	}
+	return options, true
+}
+
+func pppOptionsToBytes(options []pppOption) []byte {
+	var b []byte
+	for _, opt := range options {
+		b = append(b, opt.optType, uint8(2+len(opt.value)))
+		b = append(b, opt.value...)
+	}
+	return b
+}
+
+/*
+相手のConfigure-Requestに答える
+acceptが受け入れられないオプションにNakで代わりの値を返すか、知らないオプションをRejectする
+全て受け入れた時はtrueを返す
+*/
+func pppAnswerConfigureRequest(client *pppoeClient, protocol uint16, id uint8, data []byte,
+	accept func(opt pppOption) (nak *pppOption, reject bool)) bool {
+	options, ok := pppReadOptions(data)
+	if !ok {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return false
+	}
+	var naks, rejects []pppOption
+	for _, opt := range options {
+		nak, reject := accept(opt)
+		if reject {
+			rejects = append(rejects, opt)
+		} else if nak != nil {
+			naks = append(naks, *nak)
+		}
+	}
+	switch {
+	case len(rejects) != 0:
+		pppoeSendPpp(client, protocol, pppControlPacket(PPP_CODE_CONFIGURE_REJECT, id, pppOptionsToBytes(rejects)))
+		return false
+	case len(naks) != 0:
+		pppoeSendPpp(client, protocol, pppControlPacket(PPP_CODE_CONFIGURE_NAK, id, pppOptionsToBytes(naks)))
+		return false
+	}
+	pppoeSendPpp(client, protocol, pppControlPacket(PPP_CODE_CONFIGURE_ACK, id, data))
+	return true
+}
+
+// セッションが張れたのでLCPの交渉を始める
+func pppLcpStart(client *pppoeClient) {
+	client.state = pppoeStateLcp
+	client.retry = 0
+	client.lcp = pppNegotiation{}
+	client.ipcp = pppNegotiation{}
+	client.mru = PPPOE_MTU
+	client.peerMru = PPPOE_MTU
+	client.rejectMru = false
+	client.magic = rand.Uint32()
+	client.authProtocol = 0
+	pppLcpSendConfigureRequest(client)
+}
+
+func pppLcpSendConfigureRequest(client *pppoeClient) {
+	var options []pppOption
+	if !client.rejectMru {
+		options = append(options, pppOption{optType: LCP_OPTION_MRU, value: uint16ToByte(client.mru)})
+	}
+	if client.magic != 0 {
+		options = append(options, pppOption{optType: LCP_OPTION_MAGIC_NUMBER, value: uint32ToByte(client.magic)})
+	}
+	client.identifier++
+	client.lcp.id = client.identifier
+	client.lastSent = time.Now()
+	pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_CONFIGURE_REQUEST, client.lcp.id, pppOptionsToBytes(options)))
+}
+
+/*
+LCPの受信処理
+*/
+func pppLcpInput(client *pppoeClient, packet []byte) {
+	code, id, data, ok := pppReadControlPacket(packet)
+	if !ok {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	switch code {
+	case PPP_CODE_CONFIGURE_REQUEST:
+		// 開通した後に交渉し直す場合は、IPの通信を止めて最初からやり直す
+		if client.state > pppoeStateLcp {
+			fmt.Printf("PPPoE session %d on %s is renegotiating LCP\n", client.sessionID, client.netdev.name)
+			pppoeIpDown(client)
+			pppLcpStart(client)
+		}
+		var authProtocol uint16
+		client.lcp.ackSent = pppAnswerConfigureRequest(client, PPP_PROTOCOL_LCP, id, data, func(opt pppOption) (*pppOption, bool) {
+			switch opt.optType {
+			case LCP_OPTION_MRU:
+				if len(opt.value) != 2 {
+					return nil, true
+				}
+				// PPPoEの上ではPPPOE_MTUより大きくは送れない
+				client.peerMru = byteToUint16(opt.value)
+				if client.peerMru > PPPOE_MTU {
+					client.peerMru = PPPOE_MTU
+				}
+			case LCP_OPTION_MAGIC_NUMBER:
+				if len(opt.value) != 4 {
+					return nil, true
+				}
+			case LCP_OPTION_AUTH_PROTOCOL:
+				// PAPにだけ対応する、認証情報が無ければ認証できない
+				if client.username == "" || len(opt.value) < 2 {
+					return nil, true
+				}
+				if byteToUint16(opt.value[0:2]) != PPP_PROTOCOL_PAP {
+					return &pppOption{optType: LCP_OPTION_AUTH_PROTOCOL, value: uint16ToByte(PPP_PROTOCOL_PAP)}, false
+				}
+				authProtocol = PPP_PROTOCOL_PAP
+			default:
+				return nil, true
+			}
+			return nil, false
+		})
+		if client.lcp.ackSent {
+			client.authProtocol = authProtocol
+		}
+	case PPP_CODE_CONFIGURE_ACK:
+		if client.state != pppoeStateLcp || id != client.lcp.id {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		client.lcp.ackReceived = true
+	case PPP_CODE_CONFIGURE_NAK, PPP_CODE_CONFIGURE_REJECT:
+		options, ok := pppReadOptions(data)
+		if client.state != pppoeStateLcp || id != client.lcp.id || !ok {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		for _, opt := range options {
+			switch {
+			case opt.optType == LCP_OPTION_MRU && code == PPP_CODE_CONFIGURE_REJECT:
+				client.rejectMru = true
+			case opt.optType == LCP_OPTION_MRU && len(opt.value) == 2 && byteToUint16(opt.value) <= PPPOE_MTU:
+				client.mru = byteToUint16(opt.value)
+			case opt.optType == LCP_OPTION_MAGIC_NUMBER && code == PPP_CODE_CONFIGURE_REJECT:
+				client.magic = 0
+			case opt.optType == LCP_OPTION_MAGIC_NUMBER:
+				client.magic = rand.Uint32()
+			}
+		}
+		pppLcpSendConfigureRequest(client)
+	case PPP_CODE_TERMINATE_REQUEST:
+		fmt.Printf("PPPoE session %d on %s is terminated by peer\n", client.sessionID, client.netdev.name)
+		pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_TERMINATE_ACK, id, nil))
+		pppoeSendPadt(client)
+		pppoeIpDown(client)
+		pppoeStartDiscovery(client)
+		return
+	case PPP_CODE_TERMINATE_ACK, PPP_CODE_DISCARD_REQUEST:
+	case PPP_CODE_ECHO_REQUEST:
+		if !client.lcp.opened() || len(data) < 4 {
+			return
+		}
+		reply := append(uint32ToByte(client.magic), data[4:]...)
+		pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_ECHO_REPLY, id, reply))
+	case PPP_CODE_ECHO_REPLY:
+		client.echoFailures = 0
+	case PPP_CODE_CODE_REJECT, PPP_CODE_PROTOCOL_REJECT:
+		fmt.Printf("PPPoE peer rejected %x\n", data)
+	default:
+		client.identifier++
+		pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_CODE_REJECT, client.identifier, packet))
+	}
+
+	if client.state == pppoeStateLcp && client.lcp.opened() {
+		fmt.Printf("PPPoE LCP is opened on %s, mru %d\n", client.netdev.name, client.peerMru)
+		client.lastEcho = time.Now()
+		client.echoFailures = 0
+		client.retry = 0
+		if client.authProtocol == PPP_PROTOCOL_PAP {
+			client.state = pppoeStateAuth
+			pppPapSendRequest(client)
+		} else {
+			pppIpcpStart(client)
+		}
+	}
+}
+
+func pppPapSendRequest(client *pppoeClient) {
+	data := append([]byte{uint8(len(client.username))}, client.username...)
+	data = append(data, uint8(len(client.password)))
+	data = append(data, client.password...)
+	client.identifier++
+	client.lastSent = time.Now()
+	pppoeSendPpp(client, PPP_PROTOCOL_PAP, pppControlPacket(PAP_CODE_AUTHENTICATE_REQUEST, client.identifier, data))
+}
+
+/*
+PAPの受信処理
+*/
+func pppPapInput(client *pppoeClient, packet []byte) {
+	code, id, data, ok := pppReadControlPacket(packet)
+	if !ok || client.state != pppoeStateAuth || id != client.identifier {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	// 応答にはメッセージがついている
+	var message string
+	if len(data) >= 1 && len(data) >= 1+int(data[0]) {
+		message = string(data[1 : 1+data[0]])
+	}
+	switch code {
+	case PAP_CODE_AUTHENTICATE_ACK:
+		fmt.Printf("PPPoE authenticated as %s on %s\n", client.username, client.netdev.name)
+		pppIpcpStart(client)
+	case PAP_CODE_AUTHENTICATE_NAK:
+		fmt.Printf("PPPoE authentication as %s failed on %s : %s\n", client.username, client.netdev.name, message)
+		pppoeTerminate(client)
+	default:
+		countDrop(DROP_REASON_PPPOE_INVALID)
+	}
+}
+
+// LCPが開通したのでIPCPでアドレスを交渉する
+func pppIpcpStart(client *pppoeClient) {
+	client.state = pppoeStateIpcp
+	client.retry = 0
+	client.ipcp = pppNegotiation{}
+	pppIpcpSendConfigureRequest(client)
+}
+
+// 最初は0.0.0.0を要求して、Nakで相手から割り当てるアドレスを受け取る
+func pppIpcpSendConfigureRequest(client *pppoeClient) {
+	options := []pppOption{{optType: IPCP_OPTION_IP_ADDRESS, value: uint32ToByte(client.localAddr)}}
+	client.identifier++
+	client.ipcp.id = client.identifier
+	client.lastSent = time.Now()
+	pppoeSendPpp(client, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_CONFIGURE_REQUEST, client.ipcp.id, pppOptionsToBytes(options)))
+}
+
+/*
+IPCPの受信処理
+*/
+func pppIpcpInput(client *pppoeClient, packet []byte) {
+	code, id, data, ok := pppReadControlPacket(packet)
+	if !ok {
+		countDrop(DROP_REASON_PPPOE_INVALID)
+		return
+	}
+	switch code {
+	case PPP_CODE_CONFIGURE_REQUEST:
+		if client.state == pppoeStateUp {
+			pppoeIpDown(client)
+			pppIpcpStart(client)
+		}
+		var peerAddr uint32
+		client.ipcp.ackSent = pppAnswerConfigureRequest(client, PPP_PROTOCOL_IPCP, id, data, func(opt pppOption) (*pppOption, bool) {
+			if opt.optType != IPCP_OPTION_IP_ADDRESS || len(opt.value) != 4 {
+				return nil, true
+			}
+			peerAddr = byteToUint32(opt.value)
+			return nil, false
+		})
+		if client.ipcp.ackSent {
+			client.peerAddr = peerAddr
+		}
+	case PPP_CODE_CONFIGURE_ACK:
+		if client.state != pppoeStateIpcp || id != client.ipcp.id {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		client.ipcp.ackReceived = true
+	case PPP_CODE_CONFIGURE_NAK:
+		options, ok := pppReadOptions(data)
+		if client.state != pppoeStateIpcp || id != client.ipcp.id || !ok {
+			countDrop(DROP_REASON_PPPOE_INVALID)
+			return
+		}
+		for _, opt := range options {
+			if opt.optType == IPCP_OPTION_IP_ADDRESS && len(opt.value) == 4 {
+				client.localAddr = byteToUint32(opt.value)
+			}
+		}
+		pppIpcpSendConfigureRequest(client)
+	case PPP_CODE_CONFIGURE_REJECT:
+		// アドレスを受け取れなければIPで通信できない
+		fmt.Printf("PPPoE peer rejected ip address option on %s\n", client.netdev.name)
+		pppoeTerminate(client)
+		return
+	case PPP_CODE_TERMINATE_REQUEST:
+		pppoeSendPpp(client, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_TERMINATE_ACK, id, nil))
+		pppoeIpDown(client)
+		pppIpcpStart(client)
+		return
+	case PPP_CODE_TERMINATE_ACK:
+	default:
+		client.identifier++
+		pppoeSendPpp(client, PPP_PROTOCOL_IPCP, pppControlPacket(PPP_CODE_CODE_REJECT, client.identifier, packet))
+	}
+
+	if client.state == pppoeStateIpcp && client.ipcp.opened() {
+		pppoeIpUp(client)
+	}
+}
+
+/*
+IPCPが開通したのでアドレスをつけて、デフォルト経路をセッションに向ける
+相手とは1対1でつながっているので、ARPを引かずに全てセッションに送る
+*/
+func pppoeIpUp(client *pppoeClient) {
+	netdev := client.netdev
+	client.state = pppoeStateUp
+	client.upSince = time.Now()
+	setNetDeviceAddress(netdev, ipDevice{
+		address:   client.localAddr,
+		netmask:   0xffffffff,
+		broadcast: client.localAddr,
+	})
+	ribAddRoute(0, 0, ipRouteEntry{iptype: connected, netdev: netdev, source: routeSourcePppoe})
+	fmt.Printf("PPPoE session %d on %s is up, address %s peer %s\n",
+		client.sessionID, netdev.name, printIPAddr(client.localAddr), printIPAddr(client.peerAddr))
+}
+
+// IPの通信を止めてアドレスとデフォルト経路を外す
+func pppoeIpDown(client *pppoeClient) {
+	if client.state != pppoeStateUp {
+		return
+	}
+	netdev := client.netdev
+	ribDeleteRoute(0, 0, ipRouteEntry{source: routeSourcePppoe, netdev: netdev})
+	setNetDeviceAddress(netdev, ipDevice{})
+	client.state = pppoeStateIpcp
+	fmt.Printf("PPPoE session %d on %s is down\n", client.sessionID, netdev.name)
+}
+
+// 自分からセッションを切って張り直す
+func pppoeTerminate(client *pppoeClient) {
+	pppoeStop(client)
+	pppoeStartDiscovery(client)
+}
+
+// セッションを張っていればLCPのTerminate-RequestとPADTで切断する
+func pppoeStop(client *pppoeClient) {
+	if client.netdev == nil {
+		return
+	}
+	if client.state >= pppoeStateLcp {
+		client.identifier++
+		pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_TERMINATE_REQUEST, client.identifier, nil))
+		pppoeSendPadt(client)
+		fmt.Printf("PPPoE session %d on %s is closed\n", client.sessionID, client.netdev.name)
+	}
+	pppoeIpDown(client)
+	client.netdev.pppoe = nil
+	client.netdev.updateSocketFilter()
+	client.netdev = nil
+	client.state = pppoeStateDiscovery
+}
+
+/*
+IPパケットをセッションで送る
+MRUを超える大きさは分割せずに破棄して、DFがついていれば送信元にICMPで知らせる
+*/
+func pppoeOutputIP(netdev *netDevice, packet []byte) error {
+	client := netdev.pppoe
+	if client.state != pppoeStateUp {
+		return dropPacket(DROP_REASON_PPPOE_DOWN)
+	}
+	if len(packet) > int(client.peerMru) {
+		srcAddr := byteToUint32(packet[12:16])
+		if byteToUint16(packet[6:8])&(1<<14) != 0 && !isOurIPAddr(srcAddr) {
+			sendIcmpFragmentationNeeded(ipSourceAddr(srcAddr), client.peerMru, packet)
+		}
+		return dropPacket(DROP_REASON_PPPOE_TOO_BIG)
+	}
+	tracef("pppoe: session 0x%04x in %s", client.sessionID, netdev.name)
+	return pppoeSendPpp(client, PPP_PROTOCOL_IP, packet)
+}
+
+/*
+PADIとConfigure-Requestの再送、Echo-Requestで回線の確認をする
+*/
+func pppoeTick(now time.Time) {
+	client := pppoe
+	if client == nil {
+		return
+	}
+	if client.netdev == nil {
+		if pppoeAttach(client) {
+			pppoeStartDiscovery(client)
+		}
+		return
+	}
+	switch client.state {
+	case pppoeStateDiscovery:
+		if now.Sub(client.lastSent) >= PPPOE_DISCOVERY_INTERVAL {
+			pppoeSendPadi(client)
+		}
+	case pppoeStateRequesting:
+		if now.Sub(client.lastSent) < PPPOE_DISCOVERY_INTERVAL {
+			return
+		}
+		client.retry++
+		if client.retry >= PPPOE_PADR_MAX_RETRY {
+			fmt.Printf("No PADS from %s, restart discovery\n", printMacAddr(client.acMacAddr))
+			pppoeStartDiscovery(client)
+			return
+		}
+		pppoeSendPadr(client)
+	case pppoeStateLcp, pppoeStateAuth, pppoeStateIpcp:
+		if now.Sub(client.lastSent) < PPP_RESTART_INTERVAL {
+			return
+		}
+		client.retry++
+		if client.retry >= PPP_MAX_CONFIGURE {
+			fmt.Printf("PPPoE negotiation on %s timed out in %s\n", client.netdev.name, client.state)
+			pppoeTerminate(client)
+			return
+		}
+		switch {
+		case client.state == pppoeStateLcp && !client.lcp.ackReceived:
+			pppLcpSendConfigureRequest(client)
+		case client.state == pppoeStateAuth:
+			pppPapSendRequest(client)
+		case client.state == pppoeStateIpcp && !client.ipcp.ackReceived:
+			pppIpcpSendConfigureRequest(client)
+		default:
+			// 相手のConfigure-Requestを待っている
+			client.lastSent = now
+		}
+	case pppoeStateUp:
+		if now.Sub(client.lastEcho) < PPP_ECHO_INTERVAL {
+			return
+		}
+		if client.echoFailures >= PPP_ECHO_MAX_FAILURE {
+			fmt.Printf("No LCP echo reply on %s, restart PPPoE session\n", client.netdev.name)
+			pppoeTerminate(client)
+			return
+		}
+		client.echoFailures++
+		client.lastEcho = now
+		client.identifier++
+		pppoeSendPpp(client, PPP_PROTOCOL_LCP, pppControlPacket(PPP_CODE_ECHO_REQUEST, client.identifier, uint32ToByte(client.magic)))
+	}
+}
+
+func startPppoeTimer() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for now := range ticker.C {
+			routerMutex.Lock()
+			pppoeTick(now)
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+// インターフェイスが無くなったら、また現れた時に探索からやり直す
+func pppoeDeviceRemoved(netdev *netDevice) {
+	client := netdev.pppoe
+	if client == nil {
+		return
+	}
+	pppoeIpDown(client)
+	netdev.pppoe = nil
+	client.netdev = nil
+	client.state = pppoeStateDiscovery
+}
@@ -0,0 +1,359 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: router.proto
+
+package routerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	RouterService_AddRoute_FullMethodName          = "/gocuro.router.RouterService/AddRoute"
+	RouterService_DeleteRoute_FullMethodName       = "/gocuro.router.RouterService/DeleteRoute"
+	RouterService_ListRoutes_FullMethodName        = "/gocuro.router.RouterService/ListRoutes"
+	RouterService_ListArpEntries_FullMethodName    = "/gocuro.router.RouterService/ListArpEntries"
+	RouterService_ListInterfaces_FullMethodName    = "/gocuro.router.RouterService/ListInterfaces"
+	RouterService_ListDropCounters_FullMethodName  = "/gocuro.router.RouterService/ListDropCounters"
+	RouterService_WatchPacketEvents_FullMethodName = "/gocuro.router.RouterService/WatchPacketEvents"
+)
+
+// RouterServiceClient is the client API for RouterService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RouterServiceClient interface {
+	AddRoute(ctx context.Context, in *AddRouteRequest, opts ...grpc.CallOption) (*AddRouteResponse, error)
+	DeleteRoute(ctx context.Context, in *DeleteRouteRequest, opts ...grpc.CallOption) (*DeleteRouteResponse, error)
+	ListRoutes(ctx context.Context, in *ListRoutesRequest, opts ...grpc.CallOption) (*ListRoutesResponse, error)
+	ListArpEntries(ctx context.Context, in *ListArpEntriesRequest, opts ...grpc.CallOption) (*ListArpEntriesResponse, error)
+	ListInterfaces(ctx context.Context, in *ListInterfacesRequest, opts ...grpc.CallOption) (*ListInterfacesResponse, error)
+	ListDropCounters(ctx context.Context, in *ListDropCountersRequest, opts ...grpc.CallOption) (*ListDropCountersResponse, error)
+	WatchPacketEvents(ctx context.Context, in *WatchPacketEventsRequest, opts ...grpc.CallOption) (RouterService_WatchPacketEventsClient, error)
+}
+
+type routerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRouterServiceClient(cc grpc.ClientConnInterface) RouterServiceClient {
+	return &routerServiceClient{cc}
+}
+
+func (c *routerServiceClient) AddRoute(ctx context.Context, in *AddRouteRequest, opts ...grpc.CallOption) (*AddRouteResponse, error) {
+	out := new(AddRouteResponse)
+	err := c.cc.Invoke(ctx, RouterService_AddRoute_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) DeleteRoute(ctx context.Context, in *DeleteRouteRequest, opts ...grpc.CallOption) (*DeleteRouteResponse, error) {
+	out := new(DeleteRouteResponse)
+	err := c.cc.Invoke(ctx, RouterService_DeleteRoute_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) ListRoutes(ctx context.Context, in *ListRoutesRequest, opts ...grpc.CallOption) (*ListRoutesResponse, error) {
+	out := new(ListRoutesResponse)
+	err := c.cc.Invoke(ctx, RouterService_ListRoutes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) ListArpEntries(ctx context.Context, in *ListArpEntriesRequest, opts ...grpc.CallOption) (*ListArpEntriesResponse, error) {
+	out := new(ListArpEntriesResponse)
+	err := c.cc.Invoke(ctx, RouterService_ListArpEntries_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) ListInterfaces(ctx context.Context, in *ListInterfacesRequest, opts ...grpc.CallOption) (*ListInterfacesResponse, error) {
+	out := new(ListInterfacesResponse)
+	err := c.cc.Invoke(ctx, RouterService_ListInterfaces_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) ListDropCounters(ctx context.Context, in *ListDropCountersRequest, opts ...grpc.CallOption) (*ListDropCountersResponse, error) {
+	out := new(ListDropCountersResponse)
+	err := c.cc.Invoke(ctx, RouterService_ListDropCounters_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerServiceClient) WatchPacketEvents(ctx context.Context, in *WatchPacketEventsRequest, opts ...grpc.CallOption) (RouterService_WatchPacketEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RouterService_ServiceDesc.Streams[0], RouterService_WatchPacketEvents_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &routerServiceWatchPacketEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RouterService_WatchPacketEventsClient interface {
+	Recv() (*PacketEvent, error)
+	grpc.ClientStream
+}
+
+type routerServiceWatchPacketEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *routerServiceWatchPacketEventsClient) Recv() (*PacketEvent, error) {
+	m := new(PacketEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RouterServiceServer is the server API for RouterService service.
+// All implementations must embed UnimplementedRouterServiceServer
+// for forward compatibility
+type RouterServiceServer interface {
+	AddRoute(context.Context, *AddRouteRequest) (*AddRouteResponse, error)
+	DeleteRoute(context.Context, *DeleteRouteRequest) (*DeleteRouteResponse, error)
+	ListRoutes(context.Context, *ListRoutesRequest) (*ListRoutesResponse, error)
+	ListArpEntries(context.Context, *ListArpEntriesRequest) (*ListArpEntriesResponse, error)
+	ListInterfaces(context.Context, *ListInterfacesRequest) (*ListInterfacesResponse, error)
+	ListDropCounters(context.Context, *ListDropCountersRequest) (*ListDropCountersResponse, error)
+	WatchPacketEvents(*WatchPacketEventsRequest, RouterService_WatchPacketEventsServer) error
+	mustEmbedUnimplementedRouterServiceServer()
+}
+
+// UnimplementedRouterServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedRouterServiceServer struct {
+}
+
+func (UnimplementedRouterServiceServer) AddRoute(context.Context, *AddRouteRequest) (*AddRouteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRoute not implemented")
+}
+func (UnimplementedRouterServiceServer) DeleteRoute(context.Context, *DeleteRouteRequest) (*DeleteRouteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteRoute not implemented")
+}
+func (UnimplementedRouterServiceServer) ListRoutes(context.Context, *ListRoutesRequest) (*ListRoutesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRoutes not implemented")
+}
+func (UnimplementedRouterServiceServer) ListArpEntries(context.Context, *ListArpEntriesRequest) (*ListArpEntriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListArpEntries not implemented")
+}
+func (UnimplementedRouterServiceServer) ListInterfaces(context.Context, *ListInterfacesRequest) (*ListInterfacesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListInterfaces not implemented")
+}
+func (UnimplementedRouterServiceServer) ListDropCounters(context.Context, *ListDropCountersRequest) (*ListDropCountersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDropCounters not implemented")
+}
+func (UnimplementedRouterServiceServer) WatchPacketEvents(*WatchPacketEventsRequest, RouterService_WatchPacketEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPacketEvents not implemented")
+}
+func (UnimplementedRouterServiceServer) mustEmbedUnimplementedRouterServiceServer() {}
+
+// UnsafeRouterServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RouterServiceServer will
+// result in compilation errors.
+type UnsafeRouterServiceServer interface {
+	mustEmbedUnimplementedRouterServiceServer()
+}
+
+func RegisterRouterServiceServer(s grpc.ServiceRegistrar, srv RouterServiceServer) {
+	s.RegisterService(&RouterService_ServiceDesc, srv)
+}
+
+func _RouterService_AddRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).AddRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_AddRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).AddRoute(ctx, req.(*AddRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_DeleteRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).DeleteRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_DeleteRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).DeleteRoute(ctx, req.(*DeleteRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_ListRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRoutesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).ListRoutes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_ListRoutes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).ListRoutes(ctx, req.(*ListRoutesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_ListArpEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListArpEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).ListArpEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_ListArpEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).ListArpEntries(ctx, req.(*ListArpEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_ListInterfaces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListInterfacesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).ListInterfaces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_ListInterfaces_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).ListInterfaces(ctx, req.(*ListInterfacesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_ListDropCounters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDropCountersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServiceServer).ListDropCounters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RouterService_ListDropCounters_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServiceServer).ListDropCounters(ctx, req.(*ListDropCountersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RouterService_WatchPacketEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPacketEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RouterServiceServer).WatchPacketEvents(m, &routerServiceWatchPacketEventsServer{stream})
+}
+
+type RouterService_WatchPacketEventsServer interface {
+	Send(*PacketEvent) error
+	grpc.ServerStream
+}
+
+type routerServiceWatchPacketEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *routerServiceWatchPacketEventsServer) Send(m *PacketEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// RouterService_ServiceDesc is the grpc.ServiceDesc for RouterService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RouterService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gocuro.router.RouterService",
+	HandlerType: (*RouterServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddRoute",
+			Handler:    _RouterService_AddRoute_Handler,
+		},
+		{
+			MethodName: "DeleteRoute",
+			Handler:    _RouterService_DeleteRoute_Handler,
+		},
+		{
+			MethodName: "ListRoutes",
+			Handler:    _RouterService_ListRoutes_Handler,
+		},
+		{
+			MethodName: "ListArpEntries",
+			Handler:    _RouterService_ListArpEntries_Handler,
+		},
+		{
+			MethodName: "ListInterfaces",
+			Handler:    _RouterService_ListInterfaces_Handler,
+		},
+		{
+			MethodName: "ListDropCounters",
+			Handler:    _RouterService_ListDropCounters_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPacketEvents",
+			Handler:       _RouterService_WatchPacketEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "router.proto",
+}
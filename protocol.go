@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nilpoona/go-curo/pipeline"
+)
+
+/*
+受信したパケットを上位のプロトコルに渡すハンドラの登録
+イーサタイプとIPのプロトコル番号ごとにハンドラを登録しておき、ethernetInputとipInputToOursはそれを呼ぶだけにする
+ARPやIP、LLDP、ESPなどの各プロトコルは自分のファイルのinitで登録するので、
+OSPFやGREのような新しいプロトコルを足す時も受信処理の本体を書き換えなくてよい
+ハンドラはルータが動き出す前(initかmainの最初)に登録する、動いている間の登録は考えていない
+go-curoの中のハンドラはinputContextでインターフェイスを直接触るので、このファイルの登録を使う
+外のパッケージのハンドラはpipelineパッケージに登録し、このファイルに無いイーサタイプとプロトコル番号の時に
+受信したフレームの情報をpipeline.Contextに詰め替えて呼ぶ
+*/
+
+// イーサネットのペイロードを受け取るハンドラ
+type etherTypeHandler func(ctx *inputContext, packet []byte) error
+
+// 自分宛てのIPパケットのペイロード(IPヘッダの後ろ)を受け取るハンドラ
+type ipProtocolHandler func(ctx *inputContext, ipheader *ipHeader, packet []byte) error
+
+var etherTypeHandlers = map[uint16]etherTypeHandler{}
+
+var ipProtocolHandlers = map[uint8]ipProtocolHandler{}
+
+// イーサタイプのハンドラを登録する、同じイーサタイプを2回登録するのはプログラムの誤りなのでpanicする
+func registerEtherType(etherType uint16, handler etherTypeHandler) {
+	if _, ok := etherTypeHandlers[etherType]; ok {
+		panic(fmt.Sprintf("ether type 0x%04x is already registered", etherType))
+	}
+	etherTypeHandlers[etherType] = handler
+}
+
+// IPのプロトコル番号のハンドラを登録する、同じ番号を2回登録するのはプログラムの誤りなのでpanicする
+func registerIPProtocol(protocol uint8, handler ipProtocolHandler) {
+	if _, ok := ipProtocolHandlers[protocol]; ok {
+		panic(fmt.Sprintf("ip protocol %d is already registered", protocol))
+	}
+	ipProtocolHandlers[protocol] = handler
+}
+
+// イーサタイプのハンドラを探す、go-curoの中に無ければpipelineパッケージに登録されたものを使う
+func lookupEtherTypeHandler(etherType uint16) (etherTypeHandler, bool) {
+	if handler, ok := etherTypeHandlers[etherType]; ok {
+		return handler, true
+	}
+	external := pipeline.EtherTypeHandlerFor(etherType)
+	if external == nil {
+		return nil, false
+	}
+	return func(ctx *inputContext, packet []byte) error {
+		return external(ctx.pipelineContext(), packet)
+	}, true
+}
+
+// IPのプロトコル番号のハンドラを探す、go-curoの中に無ければpipelineパッケージに登録されたものを使う
+func lookupIPProtocolHandler(protocol uint8) (ipProtocolHandler, bool) {
+	if handler, ok := ipProtocolHandlers[protocol]; ok {
+		return handler, true
+	}
+	external := pipeline.IPProtocolHandlerFor(protocol)
+	if external == nil {
+		return nil, false
+	}
+	return func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		header := pipeline.IPHeader{
+			Version:        ipheader.version,
+			HeaderLen:      ipheader.headerLen,
+			Tos:            ipheader.tos,
+			TotalLen:       ipheader.totalLen,
+			Identify:       ipheader.identify,
+			FragOffset:     ipheader.fragOffset,
+			TTL:            ipheader.ttl,
+			Protocol:       ipheader.protocol,
+			HeaderChecksum: ipheader.headerChecksum,
+			SrcAddr:        ipheader.srcAddr,
+			DestAddr:       ipheader.destAddr,
+		}
+		return external(ctx.pipelineContext(), &header, packet)
+	}, true
+}
+
+// 外のパッケージのハンドラに渡す、受信したフレームの情報と送信の関数
+func (ctx *inputContext) pipelineContext() *pipeline.Context {
+	netdev := ctx.netdev
+	return &pipeline.Context{
+		Interface:    netdev.name,
+		InterfaceMAC: netdev.macAddr,
+		SrcMAC:       ctx.ethHeader.srcAddr,
+		DestMAC:      ctx.ethHeader.destAddr,
+		EtherType:    ctx.ethHeader.etherType,
+		Output: func(destMAC [6]byte, etherType uint16, payload []byte) error {
+			return ethernetOutput(netdev, destMAC, payload, etherType)
+		},
+		IPOutput: func(destAddr, srcAddr uint32, protocol uint8, payload []byte) error {
+			return ipPacketEncapsulateOutput(destAddr, srcAddr, payload, protocol)
+		},
+	}
+}
+
+// pipelineパッケージに、go-curoが処理するイーサタイプかプロトコル番号が登録されていればエラーにする
+func checkPipelineHandlers() error {
+	for etherType := range etherTypeHandlers {
+		if pipeline.EtherTypeHandlerFor(etherType) != nil {
+			return fmt.Errorf("ether type 0x%04x is handled by go-curo and can not be registered to pipeline", etherType)
+		}
+	}
+	for protocol := range ipProtocolHandlers {
+		if pipeline.IPProtocolHandlerFor(protocol) != nil {
+			return fmt.Errorf("ip protocol %d is handled by go-curo and can not be registered to pipeline", protocol)
+		}
+	}
+	return nil
+}
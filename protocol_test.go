@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nilpoona/go-curo/pipeline"
+)
+
+// 実験用のイーサタイプとプロトコル番号、go-curoは処理しない
+const (
+	TEST_ETHER_TYPE_EXPERIMENTAL  = 0x88b5
+	TEST_IP_PROTOCOL_EXPERIMENTAL = 253
+)
+
+// pipelineパッケージに登録したハンドラに、go-curoが処理しないフレームとパケットが届く
+func TestPipelineHandlers(t *testing.T) {
+	var etherCtx, ipCtx *pipeline.Context
+	var etherPayload, ipPayload []byte
+	var header pipeline.IPHeader
+	pipeline.RegisterEtherType(TEST_ETHER_TYPE_EXPERIMENTAL, func(ctx *pipeline.Context, packet []byte) error {
+		etherCtx = ctx
+		etherPayload = append([]byte{}, packet...)
+		return nil
+	})
+	pipeline.RegisterIPProtocol(TEST_IP_PROTOCOL_EXPERIMENTAL, func(ctx *pipeline.Context, ipheader *pipeline.IPHeader, packet []byte) error {
+		ipCtx = ctx
+		header = *ipheader
+		ipPayload = append([]byte{}, packet...)
+		return nil
+	})
+	if err := checkPipelineHandlers(); err != nil {
+		t.Fatal(err)
+	}
+
+	netdev := setupFuzzDevice()
+	routerMutex.Lock()
+	defer routerMutex.Unlock()
+
+	frame := ethernetHeader{destAddr: fuzzRouterMac, srcAddr: fuzzHostMac, etherType: TEST_ETHER_TYPE_EXPERIMENTAL}.ToPacket()
+	if err := ethernetInput(&inputContext{netdev: netdev}, append(frame, "curo"...)); err != nil {
+		t.Fatalf("ethernet input err : %s", err)
+	}
+	if etherCtx == nil || etherCtx.Interface != "fuzz0" || etherCtx.SrcMAC != fuzzHostMac ||
+		etherCtx.EtherType != TEST_ETHER_TYPE_EXPERIMENTAL || !bytes.Equal(etherPayload, []byte("curo")) {
+		t.Fatalf("unexpected ether type handler call %+v %q", etherCtx, etherPayload)
+	}
+
+	packet := ipHeader{
+		version:   4,
+		headerLen: 5,
+		totalLen:  20 + 4,
+		ttl:       64,
+		protocol:  TEST_IP_PROTOCOL_EXPERIMENTAL,
+		srcAddr:   FUZZ_HOST_ADDR,
+		destAddr:  FUZZ_ROUTER_ADDR,
+	}.ToPacket(true)
+	ctx := &inputContext{netdev: netdev, ethHeader: ethernetHeader{srcAddr: fuzzHostMac}}
+	if err := ipInput(ctx, append(packet, "curo"...)); err != nil {
+		t.Fatalf("ip input err : %s", err)
+	}
+	if ipCtx == nil || ipCtx.Interface != "fuzz0" || header.SrcAddr != FUZZ_HOST_ADDR || header.DestAddr != FUZZ_ROUTER_ADDR ||
+		header.Protocol != TEST_IP_PROTOCOL_EXPERIMENTAL || !bytes.Equal(ipPayload, []byte("curo")) {
+		t.Fatalf("unexpected ip protocol handler call %+v %+v %q", ipCtx, header, ipPayload)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+トークンバケットによる帯域制御
+送信側はシェーピングで、レートを超えた分を送信キューに溜めてトークンが貯まってから送る
+受信側はポリシングで、レートを超えた分をその場で破棄する
+
+送信キューはIPヘッダのDSCPで分けた優先度ごとにあり、リンクが混んでいても
+制御用の通信やICMPが大量の通信に埋もれないように優先度の高いキューから送る
+*/
+
+// 優先度ごとの送信キューに溜められるフレームの数
+const QOS_TX_QUEUE_LEN = 1000
+
+// シェーピングしている時にepoll_waitで待つ最大の時間、管理APIなどから送ったフレームもこの間隔で送られる
+const QOS_MAX_WAIT = 100 * time.Millisecond
+
+// バーストを指定しなかった時は10ms分にする、ただし1フレームは必ず送れるようにする
+const QOS_DEFAULT_BURST_TIME = 10 * time.Millisecond
+const QOS_MIN_BURST = 1514
+
+// kbpsとバイトで指定するレート
+type qosRate struct {
+	kbps  uint64
+	burst uint64
+}
+
+func (rate qosRate) String() string {
+	return fmt.Sprintf("%dkbps burst %d bytes", rate.kbps, rate.burst)
+}
+
+/*
+"1000"か"1000/15000"の形式のレートを読む
+前がkbpsで、後ろがバーストのバイト数
+*/
+func parseQosRate(s string) (qosRate, error) {
+	kbpsStr, burstStr, hasBurst := strings.Cut(s, "/")
+	kbps, err := strconv.ParseUint(kbpsStr, 10, 64)
+	if err != nil || kbps == 0 {
+		return qosRate{}, fmt.Errorf("invalid rate %q", s)
+	}
+	rate := qosRate{kbps: kbps}
+	if hasBurst {
+		rate.burst, err = strconv.ParseUint(burstStr, 10, 64)
+		if err != nil {
+			return qosRate{}, fmt.Errorf("invalid burst %q", s)
+		}
+	} else {
+		rate.burst = kbps * 1000 / 8 * uint64(QOS_DEFAULT_BURST_TIME) / uint64(time.Second)
+	}
+	if rate.burst < QOS_MIN_BURST {
+		rate.burst = QOS_MIN_BURST
+	}
+	return rate, nil
+}
+
+// "eth1=1000/15000"の形式のインターフェイスごとのレートを読む
+func parseInterfaceQosRate(spec string, rates map[string]qosRate) error {
+	name, rateStr, found := strings.Cut(spec, "=")
+	if !found || name == "" {
+		return fmt.Errorf("invalid rate %q, format is name=kbps[/burst]", spec)
+	}
+	rate, err := parseQosRate(rateStr)
+	if err != nil {
+		return err
+	}
+	rates[name] = rate
+	return nil
+}
+
+// コマンドラインで指定されたインターフェイスごとのレート
+var shapingRates = map[string]qosRate{}
+var policingRates = map[string]qosRate{}
+
+type tokenBucket struct {
+	rate   qosRate
+	tokens float64 // 使えるバイト数
+	last   time.Time
+}
+
+func newTokenBucket(rate qosRate) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: float64(rate.burst),
+		last:   time.Now(),
+	}
+}
+
+// 経過した時間の分だけトークンを足す
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last)
+	if elapsed <= 0 {
+		return
+	}
+	tb.last = now
+	tb.tokens += float64(tb.rate.kbps) * 1000 / 8 * elapsed.Seconds()
+	if tb.tokens > float64(tb.rate.burst) {
+		tb.tokens = float64(tb.rate.burst)
+	}
+}
+
+// nバイト分のトークンがあれば使う
+func (tb *tokenBucket) take(n int, now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// nバイト分のトークンが貯まるまでの時間
+func (tb *tokenBucket) wait(n int, now time.Time) time.Duration {
+	tb.refill(now)
+	if tb.tokens >= float64(n) {
+		return 0
+	}
+	return time.Duration((float64(n) - tb.tokens) * 8 / 1000 / float64(tb.rate.kbps) * float64(time.Second))
+}
+
+// 送信キューの数、0が一番優先度が高い
+const QOS_CLASS_COUNT = 4
+
+const (
+	QOS_CLASS_NETWORK_CONTROL = 0 // CS6、CS7、EFとARPなどのIP以外のフレーム
+	QOS_CLASS_HIGH            = 1 // CS4、CS5、AF4xとDSCPが0のICMP
+	QOS_CLASS_NORMAL          = 2 // それ以外
+	QOS_CLASS_BULK            = 3 // CS1(Lower Effort)
+)
+
+var qosClassNames = [QOS_CLASS_COUNT]string{"network_control", "high", "normal", "bulk"}
+
+// WRRで1巡の間に各キューから送るフレームの数
+var QOS_WRR_WEIGHTS = [QOS_CLASS_COUNT]int{8, 4, 2, 1}
+
+type qosScheduler uint8
+
+const (
+	qosSchedulerStrict qosScheduler = iota // 優先度の高いキューが空になるまで低いキューは送らない
+	qosSchedulerWrr                        // 重みの比率で全てのキューから順に送る
+)
+
+func parseQosScheduler(s string) (qosScheduler, error) {
+	switch s {
+	case "strict":
+		return qosSchedulerStrict, nil
+	case "wrr":
+		return qosSchedulerWrr, nil
+	}
+	return 0, fmt.Errorf("unknown qos scheduler %s, strict or wrr", s)
+}
+
+func (scheduler qosScheduler) String() string {
+	if scheduler == qosSchedulerWrr {
+		return "wrr"
+	}
+	return "strict"
+}
+
+// コマンドラインで指定された送信キューのスケジューラ
+var defaultQosScheduler = qosSchedulerStrict
+
+// 優先度ごとの送信キュー
+type qosQueue struct {
+	frames  [][]byte
+	sent    uint64 // キューから送信したフレームの数
+	dropped uint64 // キューが溢れて破棄したフレームの数
+}
+
+type qosQueues struct {
+	queues    [QOS_CLASS_COUNT]qosQueue
+	scheduler qosScheduler
+	// WRRで今送っているキューと残りのフレームの数
+	current int
+	credit  int
+}
+
+// 次に送るフレームのあるキュー、全て空ならnil
+func (q *qosQueues) next() *qosQueue {
+	if q.scheduler == qosSchedulerStrict {
+		for i := range q.queues {
+			if len(q.queues[i].frames) != 0 {
+				return &q.queues[i]
+			}
+		}
+		return nil
+	}
+	for i := 0; i <= QOS_CLASS_COUNT; i++ {
+		if q.credit > 0 && len(q.queues[q.current].frames) != 0 {
+			return &q.queues[q.current]
+		}
+		q.current = (q.current + 1) % QOS_CLASS_COUNT
+		q.credit = QOS_WRR_WEIGHTS[q.current]
+	}
+	return nil
+}
+
+// キューの先頭のフレームを送ったので取り除く
+func (q *qosQueues) pop(queue *qosQueue) {
+	queue.frames[0] = nil
+	queue.frames = queue.frames[1:]
+	queue.sent++
+	q.credit--
+}
+
+// 待っているフレームの合計
+func (q *qosQueues) len() int {
+	n := 0
+	for i := range q.queues {
+		n += len(q.queues[i].frames)
+	}
+	return n
+}
+
+/*
+イーサネットフレームをどの送信キューに入れるかを決める
+DSCPはToSの上位6bitで、さらに上位3bitはIP Precedenceと同じ優先度になっている
+*/
+func qosClassify(frame []byte) int {
+	if len(frame) < 24 || byteToUint16(frame[12:14]) != ETHER_TYPE_IP {
+		return QOS_CLASS_NETWORK_CONTROL
+	}
+	dscp := frame[15] >> 2
+	switch {
+	case dscp == 46 || dscp>>3 >= 6:
+		return QOS_CLASS_NETWORK_CONTROL
+	case dscp>>3 >= 4:
+		return QOS_CLASS_HIGH
+	case dscp == 8:
+		return QOS_CLASS_BULK
+	case dscp == 0 && frame[23] == IP_PROTOCOL_NUM_ICMP:
+		return QOS_CLASS_HIGH
+	}
+	return QOS_CLASS_NORMAL
+}
+
+// インターフェイスのシェーピングとポリシングを設定する、nilなら無効にする
+func setNetDeviceQos(netdev *netDevice, shaping, policing *qosRate, scheduler qosScheduler) {
+	if shaping == nil {
+		if netdev.shaper != nil {
+			// 溜まっているフレームは送ってしまう
+			for queue := netdev.txQueues.next(); queue != nil; queue = netdev.txQueues.next() {
+				netdev.netDeviceWrite(queue.frames[0])
+				netdev.txQueues.pop(queue)
+			}
+			netdev.shaper = nil
+			fmt.Printf("Disabled shaping on %s\n", netdev.name)
+		}
+	} else {
+		if netdev.shaper == nil || netdev.shaper.rate != *shaping {
+			netdev.shaper = newTokenBucket(*shaping)
+			fmt.Printf("Shaping %s to %s\n", netdev.name, shaping)
+		}
+		if netdev.txQueues.scheduler != scheduler {
+			netdev.txQueues.scheduler = scheduler
+			fmt.Printf("Scheduling queues of %s by %s\n", netdev.name, scheduler)
+		}
+	}
+
+	if policing == nil {
+		if netdev.policer != nil {
+			netdev.policer = nil
+			fmt.Printf("Disabled policing on %s\n", netdev.name)
+		}
+	} else if netdev.policer == nil || netdev.policer.rate != *policing {
+		netdev.policer = newTokenBucket(*policing)
+		fmt.Printf("Policing %s to %s\n", netdev.name, policing)
+	}
+}
+
+// コマンドラインで指定したレートをインターフェイスに設定する
+func setNetDeviceQosFromFlags(netdev *netDevice) {
+	var shaping, policing *qosRate
+	if rate, ok := shapingRates[netdev.name]; ok {
+		shaping = &rate
+	}
+	if rate, ok := policingRates[netdev.name]; ok {
+		policing = &rate
+	}
+	setNetDeviceQos(netdev, shaping, policing, defaultQosScheduler)
+}
+
+// 受信したフレームがポリシングのレートを超えていないか
+func qosPolice(netdev *netDevice, n int) bool {
+	if netdev.policer == nil || netdev.policer.take(n, time.Now()) {
+		return true
+	}
+	netdev.stats.rxPoliced++
+	countDrop(DROP_REASON_POLICED)
+	return false
+}
+
+// シェーピングしているインターフェイスの送信キューにフレームを入れる
+func qosEnqueue(netdev *netDevice, data []byte) {
+	queue := &netdev.txQueues.queues[qosClassify(data)]
+	if len(queue.frames) >= QOS_TX_QUEUE_LEN {
+		queue.dropped++
+		netdev.stats.txQueueDrops++
+		countDrop(DROP_REASON_TX_QUEUE_FULL)
+		return
+	}
+	// 呼び出し元はバッファを使い回すことがあるのでコピーしておく
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	queue.frames = append(queue.frames, frame)
+}
+
+/*
+送信キューに溜まっているフレームをトークンがある分だけ送る
+次にフレームを送れるようになるまでの時間を返し、シェーピングしていなければ-1を返す
+*/
+func qosTransmitQueued(now time.Time) time.Duration {
+	next := time.Duration(-1)
+	for _, netdev := range netDeviceList {
+		if netdev.shaper == nil {
+			continue
+		}
+		if next < 0 {
+			next = QOS_MAX_WAIT
+		}
+		for {
+			queue := netdev.txQueues.next()
+			if queue == nil {
+				break
+			}
+			frame := queue.frames[0]
+			if !netdev.shaper.take(len(frame), now) {
+				if wait := netdev.shaper.wait(len(frame), now); wait < next {
+					next = wait
+				}
+				break
+			}
+			netdev.txQueues.pop(queue)
+			if err := netdev.netDeviceWrite(frame); err != nil {
+				netdev.txError(err)
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+IPv6のルータ広告(Router Advertisement)
+インターフェイスごとにプレフィックス、MTU、ルータの有効期間を広告し、後ろのホストがSLAACでアドレスを作れるようにする
+  定期的にff02::1(全ノード)に送る、起動直後の3回は間隔を短くする
+  ホストのRouter Solicitation(ff02::2宛て)には送ってきたホストに直接答える
+  停止する時はルータの有効期間を0にして送り、ホストにデフォルトルータから外させる
+送信元にはMACアドレスから作ったリンクローカルアドレス(EUI-64)を使う
+https://www.rfc-editor.org/rfc/rfc4861
+*/
+
+const (
+	ICMPV6_TYPE_ROUTER_SOLICITATION  uint8 = 133
+	ICMPV6_TYPE_ROUTER_ADVERTISEMENT uint8 = 134
+)
+
+const (
+	NDP_OPTION_SOURCE_LINK_ADDRESS uint8 = 1
+	NDP_OPTION_PREFIX_INFORMATION  uint8 = 3
+	NDP_OPTION_MTU                 uint8 = 5
+	NDP_OPTION_RDNSS               uint8 = 25
+)
+
+// 近隣探索のメッセージはホップリミットを255で送り、255でなければルータを越えてきたので破棄する
+const NDP_HOP_LIMIT uint8 = 255
+
+// RSのヘッダはタイプから予約の8バイト
+const RS_HEADER_LEN = 8
+
+// ホストに使わせるホップリミット
+const RA_CUR_HOP_LIMIT uint8 = 64
+
+// プレフィックス情報のオンリンク(L)と自動設定(A)のフラグ
+const RA_PREFIX_FLAG_ON_LINK uint8 = 0x80
+const RA_PREFIX_FLAG_AUTONOMOUS uint8 = 0x40
+
+// RFC 4861の既定値、有効期間はプレフィックスが30日と7日、ルータは広告の間隔の3倍
+const RA_DEFAULT_INTERVAL = 200 * time.Second
+const RA_DEFAULT_VALID_LIFETIME = 30 * 24 * time.Hour
+const RA_DEFAULT_PREFERRED_LIFETIME = 7 * 24 * time.Hour
+
+// 起動直後の広告の回数と間隔の上限
+const RA_MAX_INITIAL_ADVERTISEMENTS = 3
+const RA_MAX_INITIAL_INTERVAL = 16 * time.Second
+
+type raConfig struct {
+	ifname            string
+	prefixes          []netip.Prefix
+	mtu               uint32 // 0ならMTUのオプションをつけない
+	interval          time.Duration
+	routerLifetime    time.Duration
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+}
+
+type raInterface struct {
+	config     raConfig
+	netdev     *netDevice
+	nextAdvert time.Time
+	initial    int // 起動してから送った広告の数
+}
+
+var raInterfaces []*raInterface
+
+// コマンドラインで指定されたルータ広告
+var raConfigs []raConfig
+
+// 設定ファイルで指定されたルータ広告
+var raFileConfigs []raConfig
+
+/*
+-raの値を読む
+例: dev=eth1,prefix=2001:db8:1::/64,mtu=1500,interval=200s,lifetime=30m,valid=720h,preferred=168h
+prefixは+で複数つなげられる、dev以外は省略できる
+*/
+func parseRaConfig(spec string) (raConfig, error) {
+	var ifname string
+	var prefixes []string
+	var mtu uint64
+	var interval, lifetime, valid, preferred time.Duration
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return raConfig{}, fmt.Errorf("invalid ra config %q, format is dev=name,prefix=prefix+prefix,mtu=mtu,interval=duration,lifetime=duration,valid=duration,preferred=duration", spec)
+		}
+		var err error
+		switch key {
+		case "dev":
+			ifname = value
+		case "prefix":
+			prefixes = strings.Split(value, "+")
+		case "mtu":
+			mtu, err = strconv.ParseUint(value, 10, 32)
+		case "interval":
+			interval, err = time.ParseDuration(value)
+		case "lifetime":
+			lifetime, err = time.ParseDuration(value)
+		case "valid":
+			valid, err = time.ParseDuration(value)
+		case "preferred":
+			preferred, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown ra config %q", key)
+		}
+		if err != nil {
+			return raConfig{}, err
+		}
+	}
+	return newRaConfig(ifname, prefixes, uint32(mtu), interval, lifetime, valid, preferred)
+}
+
+/*
+値の範囲を確認してルータ広告の設定を作る
+0の値は既定値にする
+*/
+func newRaConfig(ifname string, prefixes []string, mtu uint32, interval, routerLifetime, validLifetime, preferredLifetime time.Duration) (raConfig, error) {
+	if ifname == "" {
+		return raConfig{}, fmt.Errorf("ra interface is not specified")
+	}
+	config := raConfig{
+		ifname:            ifname,
+		mtu:               mtu,
+		interval:          interval,
+		routerLifetime:    routerLifetime,
+		validLifetime:     validLifetime,
+		preferredLifetime: preferredLifetime,
+	}
+	for _, s := range prefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return raConfig{}, fmt.Errorf("invalid ipv6 prefix %q", s)
+		}
+		// SLAACはインターフェイスIDが64bitなので/64だけ
+		if prefix.Bits() != 64 {
+			return raConfig{}, fmt.Errorf("ra prefix %s must be /64", s)
+		}
+		config.prefixes = append(config.prefixes, prefix.Masked())
+	}
+	if mtu != 0 && mtu < 1280 {
+		return raConfig{}, fmt.Errorf("ra mtu %d must be 1280 or larger", mtu)
+	}
+	if config.interval == 0 {
+		config.interval = RA_DEFAULT_INTERVAL
+	}
+	if config.interval < 4*time.Second || config.interval > 1800*time.Second {
+		return raConfig{}, fmt.Errorf("ra interval %s must be 4-1800 seconds", config.interval)
+	}
+	if config.routerLifetime == 0 {
+		config.routerLifetime = 3 * config.interval
+	}
+	config.routerLifetime = config.routerLifetime.Truncate(time.Second)
+	if config.routerLifetime < config.interval || config.routerLifetime > 9000*time.Second {
+		return raConfig{}, fmt.Errorf("ra router lifetime %s must be between interval and 9000 seconds", config.routerLifetime)
+	}
+	if config.validLifetime == 0 {
+		config.validLifetime = RA_DEFAULT_VALID_LIFETIME
+	}
+	if config.preferredLifetime == 0 {
+		config.preferredLifetime = RA_DEFAULT_PREFERRED_LIFETIME
+	}
+	if config.preferredLifetime > config.validLifetime {
+		return raConfig{}, fmt.Errorf("ra preferred lifetime %s must not exceed valid lifetime %s", config.preferredLifetime, config.validLifetime)
+	}
+	return config, nil
+}
+
+// コマンドライン、設定ファイルの指定にDHCPv6で委譲されたプレフィックスを合わせてルータ広告を設定し直す
+func updateRouterAdvertisements() {
+	configs := append(append([]raConfig{}, raConfigs...), raFileConfigs...)
+	setRouterAdvertisements(dhcpv6DelegatedRaConfigs(configs))
+}
+
+// インターフェイスでルータ広告を送っていればその設定
+func searchRaInterface(netdev *netDevice) *raInterface {
+	for _, ra := range raInterfaces {
+		if ra.netdev == netdev {
+			return ra
+		}
+	}
+	return nil
+}
+
+/*
+ルータ広告を設定する
+同じインターフェイスの広告は送信の予定を引き継ぎ、設定から消えたインターフェイスはルータの有効期間を0にして送る
+*/
+func setRouterAdvertisements(configs []raConfig) {
+	var interfaces []*raInterface
+	for _, config := range configs {
+		var ra *raInterface
+		for _, old := range raInterfaces {
+			if old.config.ifname == config.ifname {
+				ra = old
+				break
+			}
+		}
+		if ra == nil {
+			ra = &raInterface{}
+			fmt.Printf("Router advertisement on %s is added\n", config.ifname)
+		}
+		ra.config = config
+		interfaces = append(interfaces, ra)
+	}
+
+	old := raInterfaces
+	raInterfaces = interfaces
+	for _, ra := range old {
+		if !containsRaInterface(interfaces, ra) {
+			raStop(ra)
+			fmt.Printf("Router advertisement on %s is deleted\n", ra.config.ifname)
+		}
+	}
+}
+
+func containsRaInterface(interfaces []*raInterface, ra *raInterface) bool {
+	for _, r := range interfaces {
+		if r == ra {
+			return true
+		}
+	}
+	return false
+}
+
+// インターフェイスがあれば広告を始める、IPv6のフレームを受け取るようにソケットのフィルタをつけ直す
+func raStart(ra *raInterface, now time.Time) {
+	netdev := searchNetDeviceByName(ra.config.ifname)
+	if netdev == nil {
+		return
+	}
+	ra.netdev = netdev
+	ra.initial = 0
+	ra.nextAdvert = now
+	if err := netdev.packetMembership(true, syscall.PACKET_MR_MULTICAST, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_ROUTERS)); err != nil {
+		fmt.Printf("join all routers group on %s err : %s\n", netdev.name, err)
+	}
+	netdev.updateSocketFilter()
+	fmt.Printf("Router advertisement on %s is started from %s\n", netdev.name, ipv6LinkLocalAddr(netdev.macAddr))
+}
+
+// 広告をやめる、ホストにデフォルトルータから外させる
+func raStop(ra *raInterface) {
+	netdev := ra.netdev
+	if netdev == nil {
+		return
+	}
+	if netdev.isUp() {
+		raOutput(ra, IPV6_ADDRESS_ALL_NODES, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_NODES), 0)
+	}
+	ra.netdev = nil
+	netdev.packetMembership(false, syscall.PACKET_MR_MULTICAST, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_ROUTERS))
+	netdev.updateSocketFilter()
+}
+
+// 定期的な広告を送る
+func raTick(now time.Time) {
+	for _, ra := range raInterfaces {
+		if ra.netdev == nil {
+			raStart(ra, now)
+		}
+		if ra.netdev == nil || !ra.netdev.isUp() || now.Before(ra.nextAdvert) {
+			continue
+		}
+		raOutput(ra, IPV6_ADDRESS_ALL_NODES, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_NODES), ra.config.routerLifetime)
+		// 同じリンクのルータと広告が揃わないように、間隔の3/4から1倍の間で揺らす
+		interval := ra.config.interval
+		if ra.initial < RA_MAX_INITIAL_ADVERTISEMENTS {
+			ra.initial++
+			if interval > RA_MAX_INITIAL_INTERVAL {
+				interval = RA_MAX_INITIAL_INTERVAL
+			}
+		}
+		ra.nextAdvert = now.Add(interval*3/4 + time.Duration(rand.Int63n(int64(interval/4))))
+	}
+}
+
+func startRaTimer() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		for now := range ticker.C {
+			routerMutex.Lock()
+			raTick(now)
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+// インターフェイスが無くなったら、また現れるまで止めておく
+func raDeviceRemoved(netdev *netDevice) {
+	for _, ra := range raInterfaces {
+		if ra.netdev == netdev {
+			fmt.Printf("Router advertisement on %s is stopped\n", netdev.name)
+			ra.netdev = nil
+		}
+	}
+}
+
+// ルータを止める時はデフォルトルータから外させる
+func raSendShutdown() {
+	for _, ra := range raInterfaces {
+		if ra.netdev != nil && ra.netdev.isUp() {
+			raOutput(ra, IPV6_ADDRESS_ALL_NODES, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_NODES), 0)
+		}
+	}
+}
+
+// ルータ広告を受け取るインターフェイスのall-routersのマルチキャスト宛て
+func raAcceptMacAddr(netdev *netDevice, macaddr [6]uint8) bool {
+	return macaddr == ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_ROUTERS) && searchRaInterface(netdev) != nil
+}
+
+/*
+Router Solicitationの受信処理
+送信元が未指定アドレスなら全ノードに、そうでなければ送ってきたホストに答える
+*/
+func raSolicitationInput(ctx *inputContext, srcAddr, destAddr [16]uint8, hopLimit uint8, icmpPacket []byte) error {
+	inputdev := ctx.netdev
+	ra := searchRaInterface(inputdev)
+	if ra == nil {
+		return dropPacket(DROP_REASON_UNSUPPORTED_PROTOCOL)
+	}
+	if len(icmpPacket) < RS_HEADER_LEN || hopLimit != NDP_HOP_LIMIT || icmpPacket[1] != 0 ||
+		!verifyChecksum(ipv6PseudoPacket(srcAddr, destAddr, IP_PROTOCOL_NUM_ICMPV6, icmpPacket)) {
+		return dropPacket(DROP_REASON_NDP_INVALID)
+	}
+	src := netip.AddrFrom16(srcAddr)
+	fmt.Printf("Router solicitation is received from %s on %s\n", src, inputdev.name)
+	if src.IsUnspecified() {
+		raOutput(ra, IPV6_ADDRESS_ALL_NODES, ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_NODES), ra.config.routerLifetime)
+	} else {
+		raOutput(ra, srcAddr, ctx.ethHeader.srcAddr, ra.config.routerLifetime)
+	}
+	return nil
+}
+
+// ルータ広告を作って送る
+func raOutput(ra *raInterface, destAddr [16]uint8, destMac [6]uint8, routerLifetime time.Duration) {
+	netdev := ra.netdev
+	srcAddr := ipv6LinkLocalAddr(netdev.macAddr).As16()
+
+	var b bytes.Buffer
+	b.Write([]byte{ICMPV6_TYPE_ROUTER_ADVERTISEMENT, 0x00, 0x00, 0x00})
+	b.Write([]byte{RA_CUR_HOP_LIMIT, 0x00}) // Managed、Otherのフラグは立てない
+	b.Write(uint16ToByte(uint16(routerLifetime / time.Second)))
+	b.Write(make([]byte, 8)) // Reachable Time、Retrans Timerはホストに任せる
+	// 送信元のMACアドレス、ホストがNSを送らずにルータのMACアドレスを知れる
+	b.Write([]byte{NDP_OPTION_SOURCE_LINK_ADDRESS, 1})
+	b.Write(netdev.macAddr[:])
+	if ra.config.mtu != 0 {
+		b.Write([]byte{NDP_OPTION_MTU, 1, 0x00, 0x00})
+		b.Write(uint32ToByte(ra.config.mtu))
+	}
+	for _, prefix := range ra.config.prefixes {
+		b.Write([]byte{NDP_OPTION_PREFIX_INFORMATION, 4, uint8(prefix.Bits()), RA_PREFIX_FLAG_ON_LINK | RA_PREFIX_FLAG_AUTONOMOUS})
+		b.Write(uint32ToByte(uint32(ra.config.validLifetime / time.Second)))
+		b.Write(uint32ToByte(uint32(ra.config.preferredLifetime / time.Second)))
+		b.Write(make([]byte, 4))
+		addr := prefix.Addr().As16()
+		b.Write(addr[:])
+	}
+	// DNSフォワーダが動いていれば、リンクローカルアドレスをDNSサーバとして教える(RFC 8106)
+	if dnsProxy != nil && dnsServesInterface(netdev) {
+		b.Write([]byte{NDP_OPTION_RDNSS, 3, 0x00, 0x00})
+		b.Write(uint32ToByte(uint32(routerLifetime / time.Second)))
+		b.Write(srcAddr[:])
+	}
+	icmpPacket := b.Bytes()
+	checksum := calcChecksum(ipv6PseudoPacket(srcAddr, destAddr, IP_PROTOCOL_NUM_ICMPV6, icmpPacket))
+	icmpPacket[2] = checksum[0]
+	icmpPacket[3] = checksum[1]
+
+	debugPrintf("Sending router advertisement to %s via %s\n", netip.AddrFrom16(destAddr), netdev.name)
+	ethernetOutput(netdev, destMac, ipv6Packet(srcAddr, destAddr, IP_PROTOCOL_NUM_ICMPV6, NDP_HOP_LIMIT, icmpPacket), ETHER_TYPE_IPV6)
+}
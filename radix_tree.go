@@ -28,4 +28,77 @@ func (node *radixTreeNode) radixTreeAdd(prefixIpAddr, prefixLen uint32, entryDat
 	}
 	// 最後にデータをセット
 	current.data = entryData
+	current.hasRoute = true
+}
+
+/*
+プレフィックスとプレフィックス長が一致する経路を返す
+最長一致ではないので、より短いプレフィックスの経路は返さない
+*/
+func (node *radixTreeNode) radixTreeLookup(prefixIpAddr, prefixLen uint32) (ipRouteEntry, bool) {
+	current := node
+	for i := 1; i <= int(prefixLen); i++ {
+		if prefixIpAddr>>(32-i)&0x01 == 1 {
+			current = current.node1
+		} else {
+			current = current.node0
+		}
+		if current == nil {
+			return ipRouteEntry{}, false
+		}
+	}
+	return current.data, current.hasRoute
+}
+
+/*
+経路の削除
+データを消した後、データも子も持たなくなったノードを親に向かって取り除く
+*/
+func (node *radixTreeNode) radixTreeDelete(prefixIpAddr, prefixLen uint32) {
+	current := node
+	// 枝を辿る
+	for i := 1; i <= int(prefixLen); i++ {
+		if prefixIpAddr>>(32-i)&0x01 == 1 { // 上からiビット目が1なら
+			current = current.node1
+		} else { // 上からiビット目が0なら
+			current = current.node0
+		}
+		// 辿る先の枝がなければ経路は登録されていない
+		if current == nil {
+			return
+		}
+	}
+	current.data = ipRouteEntry{}
+	current.hasRoute = false
+
+	// 不要になったノードを刈り取る
+	for current.parent != nil && !current.hasRoute && current.node0 == nil && current.node1 == nil {
+		parent := current.parent
+		if parent.node0 == current {
+			parent.node0 = nil
+		} else {
+			parent.node1 = nil
+		}
+		current = parent
+	}
+}
+
+/*
+登録されている経路を全て辿る
+辿ってきたビット列から各ノードのプレフィックスを組み立てる
+*/
+func (node *radixTreeNode) radixTreeWalk(fn func(prefix, prefixLen uint32, entry ipRouteEntry)) {
+	node.radixTreeWalkFrom(0, fn)
+}
+
+func (node *radixTreeNode) radixTreeWalkFrom(prefix uint32, fn func(prefix, prefixLen uint32, entry ipRouteEntry)) {
+	if node.hasRoute {
+		fn(prefix, uint32(node.depth), node.data)
+	}
+	if node.node0 != nil {
+		node.node0.radixTreeWalkFrom(prefix, fn)
+	}
+	if node.node1 != nil {
+		node.node1.radixTreeWalkFrom(prefix|1<<(32-node.node1.depth), fn)
+	}
 }
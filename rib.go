@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+RIBとFIB
+同じプレフィックスの経路を複数の経路の元(直接接続、静的経路、カーネル、IPsec、PPPoE)から受け取った時は、
+全ての候補をRIBに持っておき、一番良い経路だけをFIB(iproute、radix tree)に入れてパケットの転送に使う
+  アドミニストレーティブディスタンスが小さい経路を選ぶ、経路の元ごとの信頼度で既定値は下のrouteSourceDistances
+  ディスタンスが同じならメトリックが小さい経路を選ぶ
+  それも同じなら後から登録された経路を使う、RIBを入れる前の上書きしていた時の動きに合わせる
+選ばれた経路が消えると次に良い経路がFIBに入る(フローティングスタティック)
+経路の元ごとに持ち主(直接接続とPPPoEはデバイス、IPsecはトンネル、静的経路はネクストホップ)が違えば別の候補として持ち、
+同じなら置き換える
+FIBに入った静的経路は、カーネルへの書き出しが有効ならカーネルのルーティングテーブルにも書き出す
+*/
+
+type routeSource uint8
+
+const (
+	routeSourceConnected routeSource = iota
+	routeSourceStatic
+	routeSourceIpsec
+	routeSourcePppoe
+	routeSourceKernel
+	// 経路制御のプロトコルで学習した経路、プロトコルを実装したらribAddRouteで登録する
+	routeSourceOspf
+	routeSourceRip
+)
+
+var routeSourceNames = map[routeSource]string{
+	routeSourceConnected: "connected",
+	routeSourceStatic:    "static",
+	routeSourceIpsec:     "ipsec",
+	routeSourcePppoe:     "pppoe",
+	routeSourceKernel:    "kernel",
+	routeSourceOspf:      "ospf",
+	routeSourceRip:       "rip",
+}
+
+// 経路の元ごとのアドミニストレーティブディスタンスの既定値、値はCiscoのものに合わせる
+var routeSourceDistances = map[routeSource]uint8{
+	routeSourceConnected: 0,
+	routeSourceStatic:    1,
+	routeSourceIpsec:     1,
+	routeSourcePppoe:     1,
+	routeSourceKernel:    250,
+	routeSourceOspf:      110,
+	routeSourceRip:       120,
+}
+
+// ディスタンスが255の経路は信用できないので使わない
+const ROUTE_DISTANCE_UNREACHABLE = 255
+
+func (source routeSource) String() string {
+	if name, ok := routeSourceNames[source]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", source)
+}
+
+type ribKey struct {
+	prefix    uint32
+	prefixLen uint32
+}
+
+// プレフィックスごとの経路の候補、登録された順に並べる
+var ipRib = map[ribKey][]ipRouteEntry{}
+
+// 同じ経路の元で同じ持ち主の経路か
+func (entry ipRouteEntry) sameOwner(other ipRouteEntry) bool {
+	if entry.source != other.source || entry.netdev != other.netdev || entry.tunnel != other.tunnel {
+		return false
+	}
+	return entry.source != routeSourceStatic || entry.nexthop == other.nexthop
+}
+
+// otherより良い経路か
+func (entry ipRouteEntry) betterThan(other ipRouteEntry) bool {
+	if entry.distance != other.distance {
+		return entry.distance < other.distance
+	}
+	return entry.metric < other.metric
+}
+
+/*
+経路の候補をRIBに登録してFIBを更新する
+distanceが0の経路は経路の元の既定値を使う、直接接続の経路はもともと0
+*/
+func ribAddRoute(prefix, prefixLen uint32, entry ipRouteEntry) {
+	if entry.distance == 0 {
+		entry.distance = routeSourceDistances[entry.source]
+	}
+	key := ribKey{prefix: prefix, prefixLen: prefixLen}
+	routes := ipRib[key]
+	replaced := false
+	for i, route := range routes {
+		if route.sameOwner(entry) {
+			routes[i] = entry
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		routes = append(routes, entry)
+	}
+	ipRib[key] = routes
+	ribUpdateFib(key)
+}
+
+/*
+経路の元と持ち主が同じ候補をRIBから削除してFIBを更新する
+削除した候補を返す
+*/
+func ribDeleteRoute(prefix, prefixLen uint32, owner ipRouteEntry) (ipRouteEntry, bool) {
+	key := ribKey{prefix: prefix, prefixLen: prefixLen}
+	routes := ipRib[key]
+	for i, route := range routes {
+		if !route.sameOwner(owner) {
+			continue
+		}
+		routes = append(routes[:i:i], routes[i+1:]...)
+		if len(routes) == 0 {
+			delete(ipRib, key)
+		} else {
+			ipRib[key] = routes
+		}
+		ribUpdateFib(key)
+		return route, true
+	}
+	return ipRouteEntry{}, false
+}
+
+// 候補の中から一番良い経路を選ぶ
+func ribBestRoute(routes []ipRouteEntry) (ipRouteEntry, bool) {
+	var best ipRouteEntry
+	found := false
+	for _, route := range routes {
+		if route.distance == ROUTE_DISTANCE_UNREACHABLE {
+			continue
+		}
+		if !found || !best.betterThan(route) {
+			best = route
+			found = true
+		}
+	}
+	return best, found
+}
+
+// 一番良い経路をFIBに入れる、候補が無くなったらFIBから消す
+func ribUpdateFib(key ribKey) {
+	current, installed := iproute.radixTreeLookup(key.prefix, key.prefixLen)
+	best, found := ribBestRoute(ipRib[key])
+	if !found {
+		if installed {
+			iproute.radixTreeDelete(key.prefix, key.prefixLen)
+			exportFibChange(key.prefix, key.prefixLen, current, true, ipRouteEntry{}, false)
+		}
+		return
+	}
+	if installed && current == best {
+		return
+	}
+	iproute.radixTreeAdd(key.prefix, key.prefixLen, best)
+	if installed && !current.sameOwner(best) {
+		fmt.Printf("Best route to %s/%d is changed from %s to %s (distance %d, metric %d)\n",
+			printIPAddr(key.prefix), key.prefixLen, current.source, best.source, best.distance, best.metric)
+	}
+	exportFibChange(key.prefix, key.prefixLen, current, installed, best, true)
+}
+
+// RIBの候補を全て辿る、FIBに入っている経路はselectedがtrue
+func ribWalk(fn func(prefix, prefixLen uint32, entry ipRouteEntry, selected bool)) {
+	var keys []ribKey
+	for key := range ipRib {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].prefix != keys[j].prefix {
+			return keys[i].prefix < keys[j].prefix
+		}
+		return keys[i].prefixLen < keys[j].prefixLen
+	})
+	for _, key := range keys {
+		best, _ := iproute.radixTreeLookup(key.prefix, key.prefixLen)
+		for _, route := range ipRib[key] {
+			fn(key.prefix, key.prefixLen, route, route == best)
+		}
+	}
+}
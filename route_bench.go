@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+/*
+最長一致の検索のベンチマーク
+BGPのフルルートを読み込んでradixTreeNodeとcompressedRadixTreeに入れ、検索の速さとメモリの使用量を比べる
+ファイルはMRT形式のRIBのダンプ(RouteViewsやRIPE RISのbview、TABLE_DUMP_V2)か、1行に1つのプレフィックスを書いたもの
+.gzと.bz2はそのまま読める
+https://www.rfc-editor.org/rfc/rfc6396
+*/
+
+const (
+	MRT_TYPE_TABLE_DUMP_V2       uint16 = 13
+	MRT_SUBTYPE_RIB_IPV4_UNICAST uint16 = 2
+)
+
+const MRT_HEADER_LEN = 12
+
+const BGP_ATTR_NEXT_HOP uint8 = 3
+
+// 属性の長さが2バイトになるフラグ
+const BGP_ATTR_FLAG_EXTENDED_LENGTH uint8 = 0x10
+
+// 読み込んだ経路
+type benchRoute struct {
+	prefix    uint32
+	prefixLen uint32
+	nexthop   uint32
+}
+
+// ベンチマークで比べる経路表の実装
+type benchRouteTable struct {
+	name   string
+	build  func(routes []benchRoute) (nodes int)
+	search func(addr uint32) ipRouteEntry
+}
+
+/*
+経路を読み込んで両方の木を作り、同じ宛先を検索して速さと結果を比べる
+*/
+func runRouteBenchmark(path string, lookups int) error {
+	start := time.Now()
+	routes, skipped, err := loadBenchRoutes(path)
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("no ipv4 route in %s", path)
+	}
+	fmt.Printf("Loaded %d routes from %s (skipped %d) in %s\n", len(routes), path, skipped, time.Since(start).Round(time.Millisecond))
+
+	var tree radixTreeNode
+	var compressed compressedRadixTree
+	tables := []benchRouteTable{
+		{
+			name: "radix tree",
+			build: func(routes []benchRoute) int {
+				for _, route := range routes {
+					tree.radixTreeAdd(route.prefix, route.prefixLen, benchRouteEntry(route))
+				}
+				return tree.radixTreeCountNodes()
+			},
+			search: func(addr uint32) ipRouteEntry {
+				entry, _ := tree.radixTreeSearch(addr)
+				return entry
+			},
+		},
+		{
+			name: "compressed radix tree",
+			build: func(routes []benchRoute) int {
+				for _, route := range routes {
+					compressed.add(route.prefix, route.prefixLen, benchRouteEntry(route))
+				}
+				compressed.buildStrideTable()
+				return compressed.nodes
+			},
+			search: func(addr uint32) ipRouteEntry {
+				entry, _ := compressed.search(addr)
+				return entry
+			},
+		},
+	}
+
+	for _, table := range tables {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		nodes := table.build(routes)
+		elapsed := time.Since(start)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		fmt.Printf("%-22s build %s, %d nodes, %.1f MB\n", table.name+":", elapsed.Round(time.Millisecond), nodes,
+			float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/(1<<20))
+	}
+
+	addrs := benchLookupAddrs(routes, lookups)
+	fmt.Printf("Lookup %d addresses\n", len(addrs))
+	results := make([][]ipRouteEntry, len(tables))
+	for i, table := range tables {
+		results[i] = make([]ipRouteEntry, len(addrs))
+		start := time.Now()
+		for j, addr := range addrs {
+			results[i][j] = table.search(addr)
+		}
+		elapsed := time.Since(start)
+		fmt.Printf("%-22s %s, %.2f M lookups/s, %.1f ns/lookup\n", table.name+":", elapsed.Round(time.Millisecond),
+			float64(len(addrs))/elapsed.Seconds()/1e6, float64(elapsed.Nanoseconds())/float64(len(addrs)))
+	}
+
+	// 実装が違っても同じ経路を返すはず
+	var mismatches int
+	for j, addr := range addrs {
+		if results[0][j] != results[1][j] {
+			if mismatches < 10 {
+				fmt.Printf("Mismatch for %s : nexthop %s and %s\n", printIPAddr(addr),
+					printIPAddr(results[0][j].nexthop), printIPAddr(results[1][j].nexthop))
+			}
+			mismatches++
+		}
+	}
+	if mismatches != 0 {
+		return fmt.Errorf("%d of %d lookups did not match", mismatches, len(addrs))
+	}
+	fmt.Printf("Results of %d lookups match\n", len(addrs))
+	return nil
+}
+
+// NextHopが無いダンプもあるので、種類を入れてゼロ値にならないようにする
+func benchRouteEntry(route benchRoute) ipRouteEntry {
+	return ipRouteEntry{iptype: network, nexthop: route.nexthop}
+}
+
+/*
+検索する宛先を作る
+半分は読み込んだ経路の中のアドレス、半分は全体から一様に選ぶ
+*/
+func benchLookupAddrs(routes []benchRoute, n int) []uint32 {
+	random := rand.New(rand.NewSource(1))
+	addrs := make([]uint32, n)
+	for i := range addrs {
+		if i%2 == 0 {
+			route := routes[random.Intn(len(routes))]
+			addrs[i] = route.prefix | random.Uint32()&^prefixMask(route.prefixLen)
+		} else {
+			addrs[i] = random.Uint32()
+		}
+	}
+	return addrs
+}
+
+// ノードの数を数える
+func (node *radixTreeNode) radixTreeCountNodes() int {
+	n := 1
+	if node.node0 != nil {
+		n += node.node0.radixTreeCountNodes()
+	}
+	if node.node1 != nil {
+		n += node.node1.radixTreeCountNodes()
+	}
+	return n
+}
+
+/*
+ファイルから経路を読み込む
+先頭がMRTのヘッダに見えればMRTとして、そうでなければプレフィックスの一覧として読む
+IPv6の経路は読み飛ばす
+*/
+func loadBenchRoutes(path string) ([]benchRoute, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		r = gz
+	case strings.HasSuffix(path, ".bz2"):
+		r = bzip2.NewReader(f)
+	}
+	reader := bufio.NewReaderSize(r, 1<<20)
+	head, err := reader.Peek(MRT_HEADER_LEN)
+	if err == nil && binary.BigEndian.Uint16(head[4:6]) == MRT_TYPE_TABLE_DUMP_V2 {
+		return loadMrtRoutes(reader)
+	}
+	return loadPrefixListRoutes(reader)
+}
+
+// "192.168.0.0/16"か"192.168.0.0/16 10.0.0.1"の行を読む
+func loadPrefixListRoutes(r io.Reader) ([]benchRoute, int, error) {
+	var routes []benchRoute
+	var skipped int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		prefix, prefixLen, err := parsePrefix(fields[0])
+		if err != nil {
+			skipped++
+			continue
+		}
+		route := benchRoute{prefix: prefix, prefixLen: prefixLen}
+		if len(fields) >= 2 {
+			route.nexthop, _ = parseIPAddr(fields[1])
+		}
+		routes = append(routes, route)
+	}
+	return routes, skipped, scanner.Err()
+}
+
+/*
+MRTのTABLE_DUMP_V2からRIB_IPV4_UNICASTのエントリを読む
+同じプレフィックスに複数のピアからの経路があれば、最初のピアのNEXT_HOPを使う
+*/
+func loadMrtRoutes(r io.Reader) ([]benchRoute, int, error) {
+	var routes []benchRoute
+	var skipped int
+	header := make([]byte, MRT_HEADER_LEN)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return routes, skipped, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("read mrt header err : %s", err)
+		}
+		mrtType := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, 0, fmt.Errorf("read mrt record err : %s", err)
+		}
+		if mrtType != MRT_TYPE_TABLE_DUMP_V2 || subtype != MRT_SUBTYPE_RIB_IPV4_UNICAST {
+			// ピアの一覧やIPv6の経路
+			continue
+		}
+		route, ok := parseMrtRibIPv4(body)
+		if !ok {
+			skipped++
+			continue
+		}
+		routes = append(routes, route)
+	}
+}
+
+// シーケンス番号、プレフィックス長、プレフィックス、エントリの数、エントリ(ピア番号、時刻、属性)
+func parseMrtRibIPv4(body []byte) (benchRoute, bool) {
+	if len(body) < 5 || body[4] > 32 {
+		return benchRoute{}, false
+	}
+	prefixLen := uint32(body[4])
+	prefixBytes := int(prefixLen+7) / 8
+	if len(body) < 5+prefixBytes+2 {
+		return benchRoute{}, false
+	}
+	var addr [4]byte
+	copy(addr[:], body[5:5+prefixBytes])
+	route := benchRoute{prefix: byteToUint32(addr[:]) & prefixMask(prefixLen), prefixLen: prefixLen}
+
+	entries := body[5+prefixBytes+2:]
+	if binary.BigEndian.Uint16(body[5+prefixBytes:]) == 0 || len(entries) < 8 {
+		return route, true
+	}
+	attrLen := int(binary.BigEndian.Uint16(entries[6:8]))
+	if len(entries) < 8+attrLen {
+		return benchRoute{}, false
+	}
+	route.nexthop = mrtNextHop(entries[8 : 8+attrLen])
+	return route, true
+}
+
+// BGPのパス属性からNEXT_HOPを探す
+func mrtNextHop(attrs []byte) uint32 {
+	for len(attrs) >= 3 {
+		flags, attrType := attrs[0], attrs[1]
+		var length, headerLen int
+		if flags&BGP_ATTR_FLAG_EXTENDED_LENGTH != 0 {
+			if len(attrs) < 4 {
+				return 0
+			}
+			length, headerLen = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		} else {
+			length, headerLen = int(attrs[2]), 3
+		}
+		if len(attrs) < headerLen+length {
+			return 0
+		}
+		if attrType == BGP_ATTR_NEXT_HOP && length == 4 {
+			return byteToUint32(attrs[headerLen : headerLen+4])
+		}
+		attrs = attrs[headerLen+length:]
+	}
+	return 0
+}
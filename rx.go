@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+受信のバッチ処理
+epollで受信を通知されたら、recvmmsgで届いているフレームを1回のシステムコールでまとめて読む
+受信のバッファはsync.Poolで使い回し、フレームごとにバッファを作らないので、大量にパケットが届いてもGCの負荷が増えない
+バッファは受信処理が終わるとプールに返して次の受信で上書きするので、受信処理の後もフレームを持っておく処理はコピーする
+tapはsocketではないのでrecvmmsgを使えず、1回に1つのフレームを読む
+AF_PACKETのsocketにはPACKET_AUXDATAを設定し、フレームごとにTCP/UDPのチェックサムが計算途中(TP_STATUS_CSUMNOTREADY)かを受け取る
+*/
+
+// 1回のrecvmmsgで読むフレームの数
+const RX_BATCH_SIZE = 32
+
+// 受信するフレームの長さの上限、イーサネットヘッダの14バイトとMTUの1500バイト
+const RX_BUFFER_SIZE = 14 + 1500
+
+// PACKET_AUXDATAの補助データを受け取るバッファの長さ、cmsghdrとtpacket_auxdataが入ればよい
+const RX_CONTROL_SIZE = 64
+
+/*
+recvmmsgに渡すバッファ
+メッセージのヘッダは受信のバッファと送信元のアドレスを指すように作っておき、使い回す
+*/
+type rxBatch struct {
+	bufs     [RX_BATCH_SIZE][RX_BUFFER_SIZE]byte
+	iovs     [RX_BATCH_SIZE]unix.Iovec
+	names    [RX_BATCH_SIZE]unix.RawSockaddrLinklayer
+	controls [RX_BATCH_SIZE][RX_CONTROL_SIZE]byte
+	msgs     [RX_BATCH_SIZE]mmsghdr
+}
+
+var rxBatchPool = sync.Pool{
+	New: func() any {
+		batch := &rxBatch{}
+		for i := range batch.msgs {
+			batch.iovs[i].Base = &batch.bufs[i][0]
+			batch.iovs[i].SetLen(RX_BUFFER_SIZE)
+			batch.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&batch.names[i]))
+			batch.msgs[i].hdr.Iov = &batch.iovs[i]
+			batch.msgs[i].hdr.SetIovlen(1)
+			batch.msgs[i].hdr.Control = &batch.controls[i][0]
+		}
+		return batch
+	},
+}
+
+// i番目に受信したフレーム
+func (batch *rxBatch) frame(i int) []byte {
+	return batch.bufs[i][:batch.msgs[i].len]
+}
+
+// i番目に受信したフレームが自分が送信したものか
+func (batch *rxBatch) outgoing(i int) bool {
+	return batch.names[i].Pkttype == unix.PACKET_OUTGOING
+}
+
+/*
+i番目に受信したフレームのTCP/UDPのチェックサムが計算途中か
+送信側のカーネルがNICに計算を任せたまま(CHECKSUM_PARTIAL)渡したフレームは、PACKET_AUXDATAのtp_statusにTP_STATUS_CSUMNOTREADYが立つ
+受信処理のたびに呼ぶので、ParseSocketControlMessageでスライスを作らずにバッファを直接読む
+*/
+func (batch *rxBatch) checksumPartial(i int) bool {
+	b := batch.controls[i][:batch.msgs[i].hdr.Controllen]
+	for len(b) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		if h.Len < unix.SizeofCmsghdr || uint64(h.Len) > uint64(len(b)) {
+			return false
+		}
+		if h.Level == unix.SOL_PACKET && h.Type == unix.PACKET_AUXDATA &&
+			int(h.Len) >= unix.CmsgLen(int(unsafe.Sizeof(unix.TpacketAuxdata{}))) {
+			auxdata := (*unix.TpacketAuxdata)(unsafe.Pointer(&b[unix.CmsgLen(0)]))
+			return auxdata.Status&unix.TP_STATUS_CSUMNOTREADY != 0
+		}
+		space := unix.CmsgSpace(int(h.Len) - unix.CmsgLen(0))
+		if len(b) < space {
+			return false
+		}
+		b = b[space:]
+	}
+	return false
+}
+
+// ブロックせずにrecvmmsgで読み、受信したフレームの数を返す
+func (batch *rxBatch) recvmmsg(fd int) (int, error) {
+	for i := range batch.msgs {
+		// カーネルが書き換えるので毎回戻す
+		batch.msgs[i].hdr.Namelen = uint32(unsafe.Sizeof(batch.names[i]))
+		batch.msgs[i].hdr.SetControllen(RX_CONTROL_SIZE)
+		batch.msgs[i].hdr.Flags = 0
+		batch.msgs[i].len = 0
+	}
+	r, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&batch.msgs[0])),
+		uintptr(len(batch.msgs)), unix.MSG_DONTWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
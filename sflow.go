@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+sFlow v5でフォワードしたパケットをサンプリングしてコレクタに送る
+フローのキャッシュを持たずに、N個に1個の割合で選んだパケットの先頭をそのまま送るので、ルータの負荷が軽い
+受信したインターフェイスごとに平均でN個に1個になるように、次にサンプリングするまでの数を1から2N-1の乱数で決める
+サンプルはIPv4のヘッダから切り詰めて送り、受信と送信のインターフェイスはSNMPと同じifIndexで表す
+サンプルは溜めておき、データグラムが一杯になるか1秒ごとにルータからUDPで送る
+https://sflow.org/sflow_version_5.txt
+*/
+
+const SFLOW_DEFAULT_PORT = 6343
+
+const SFLOW_DEFAULT_SAMPLING_RATE = 1000
+
+// サンプルに入れるパケットの先頭のバイト数
+const SFLOW_DEFAULT_HEADER_SIZE = 128
+
+// 1つのデータグラムに入れるサンプルの数、フラグメントされないように最大のヘッダでも1500バイトに収める
+const SFLOW_MAX_SAMPLES = 8
+
+// 送信を待つサンプルの上限、超えたら捨ててdropsに数える
+const SFLOW_MAX_PENDING = 64
+
+const SFLOW_FLUSH_INTERVAL = time.Second
+
+const (
+	SFLOW_VERSION                = 5
+	SFLOW_ADDRESS_TYPE_IPV4      = 1
+	SFLOW_FORMAT_FLOW_SAMPLE     = 1
+	SFLOW_FORMAT_RAW_HEADER      = 1
+	SFLOW_HEADER_PROTOCOL_IPV4   = 11
+	SFLOW_SOURCE_ID_TYPE_IFINDEX = 0
+)
+
+type sflowConfig struct {
+	collector    netip.AddrPort // 無効なアドレスなら送らない
+	samplingRate uint32
+	headerSize   int
+}
+
+type sflowAgent struct {
+	config    sflowConfig
+	startTime time.Time
+	// データグラムとフローサンプルのシーケンス番号
+	sequence       uint32
+	sampleSequence uint32
+	// 送信を待っているサンプル
+	samples [][]byte
+	drops   uint32
+}
+
+var sflowState *sflowAgent
+
+// コマンドラインで指定された設定
+var sflowFlagConfig sflowConfig
+
+// "192.168.0.2:6343"か"192.168.0.2"を読む
+func parseSflowCollector(s string) (netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		if !addrPort.Addr().Is4() {
+			return netip.AddrPort{}, fmt.Errorf("sflow collector %s is not ipv4", s)
+		}
+		return addrPort, nil
+	}
+	addr, err := parseIPv4Addr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid sflow collector %s", s)
+	}
+	return netip.AddrPortFrom(addr, SFLOW_DEFAULT_PORT), nil
+}
+
+func newSflowConfig(collector string, samplingRate, headerSize int) (sflowConfig, error) {
+	var config sflowConfig
+	if collector != "" {
+		addrPort, err := parseSflowCollector(collector)
+		if err != nil {
+			return sflowConfig{}, err
+		}
+		config.collector = addrPort
+	}
+	if samplingRate < 1 {
+		return sflowConfig{}, fmt.Errorf("sflow sampling rate must be at least 1")
+	}
+	if headerSize < 20 || headerSize > 256 {
+		return sflowConfig{}, fmt.Errorf("sflow header size must be between 20 and 256")
+	}
+	config.samplingRate = uint32(samplingRate)
+	config.headerSize = headerSize
+	return config, nil
+}
+
+/*
+sFlowのエクスポートを設定する
+コレクタが無ければ止める
+*/
+func setSflow(config sflowConfig) {
+	if !config.collector.IsValid() {
+		if sflowState != nil {
+			sflowFlush()
+			sflowState = nil
+			fmt.Println("sFlow export is stopped")
+		}
+		return
+	}
+	if sflowState == nil {
+		sflowState = &sflowAgent{startTime: time.Now()}
+	}
+	if sflowState.config != config {
+		sflowState.config = config
+		for _, netdev := range netDeviceList {
+			netdev.sflowSkip = 0
+		}
+		fmt.Printf("Exporting sFlow to %s, sampling 1 in %d\n", config.collector, config.samplingRate)
+	}
+}
+
+// 次にサンプリングするまでのパケットの数
+func sflowNextSkip(rate uint32) uint32 {
+	if rate <= 1 {
+		return 1
+	}
+	return uint32(rand.Int63n(2*int64(rate)-1)) + 1
+}
+
+/*
+フォワードするパケットをサンプリングする
+packetはTTLを減らす前の受信したIPパケット
+*/
+func sflowSample(inputdev, outputdev *netDevice, packet []byte) {
+	agent := sflowState
+	if agent == nil {
+		return
+	}
+	inputdev.sflowPool++
+	if inputdev.sflowSkip == 0 {
+		inputdev.sflowSkip = sflowNextSkip(agent.config.samplingRate)
+	}
+	inputdev.sflowSkip--
+	if inputdev.sflowSkip != 0 {
+		return
+	}
+	if len(agent.samples) >= SFLOW_MAX_PENDING {
+		agent.drops++
+		return
+	}
+	var output uint32
+	if outputdev != nil {
+		output = snmpIfIndex(outputdev)
+	}
+	agent.sampleSequence++
+	agent.samples = append(agent.samples, sflowFlowSample(agent, inputdev, snmpIfIndex(inputdev), output, packet))
+	if len(agent.samples) >= SFLOW_MAX_SAMPLES {
+		sflowFlush()
+	}
+}
+
+// フローサンプルを作る、パケットの先頭をraw packet headerのレコードに入れる
+func sflowFlowSample(agent *sflowAgent, inputdev *netDevice, input, output uint32, packet []byte) []byte {
+	header := packet
+	if len(header) > agent.config.headerSize {
+		header = header[:agent.config.headerSize]
+	}
+	var record []byte
+	record = append(record, uint32ToByte(SFLOW_HEADER_PROTOCOL_IPV4)...)
+	record = append(record, uint32ToByte(uint32(len(packet)))...)
+	record = append(record, uint32ToByte(0)...) // stripped
+	record = append(record, uint32ToByte(uint32(len(header)))...)
+	record = append(record, header...)
+	// XDRなので4バイトの境界に揃える
+	for len(record)%4 != 0 {
+		record = append(record, 0)
+	}
+
+	var sample []byte
+	sample = append(sample, uint32ToByte(agent.sampleSequence)...)
+	sample = append(sample, uint32ToByte(SFLOW_SOURCE_ID_TYPE_IFINDEX<<24|input)...)
+	sample = append(sample, uint32ToByte(agent.config.samplingRate)...)
+	sample = append(sample, uint32ToByte(inputdev.sflowPool)...)
+	sample = append(sample, uint32ToByte(agent.drops)...)
+	sample = append(sample, uint32ToByte(input)...)
+	sample = append(sample, uint32ToByte(output)...)
+	sample = append(sample, uint32ToByte(1)...) // レコードの数
+	sample = append(sample, uint32ToByte(SFLOW_FORMAT_RAW_HEADER)...)
+	sample = append(sample, uint32ToByte(uint32(len(record)))...)
+	sample = append(sample, record...)
+
+	var data []byte
+	data = append(data, uint32ToByte(SFLOW_FORMAT_FLOW_SAMPLE)...)
+	data = append(data, uint32ToByte(uint32(len(sample)))...)
+	return append(data, sample...)
+}
+
+// 溜まっているサンプルをデータグラムにしてコレクタに送る
+func sflowFlush() {
+	agent := sflowState
+	if agent == nil || len(agent.samples) == 0 {
+		return
+	}
+	collector := ipv4Uint32(agent.config.collector.Addr())
+	agentAddr := ipSourceAddr(collector)
+	if agentAddr == 0 {
+		// コレクタへの経路が無いので送れない、サンプルは捨てる
+		agent.drops += uint32(len(agent.samples))
+		agent.samples = nil
+		return
+	}
+	agent.sequence++
+	var data []byte
+	data = append(data, uint32ToByte(SFLOW_VERSION)...)
+	data = append(data, uint32ToByte(SFLOW_ADDRESS_TYPE_IPV4)...)
+	data = append(data, uint32ToByte(agentAddr)...)
+	data = append(data, uint32ToByte(0)...) // sub agent id
+	data = append(data, uint32ToByte(agent.sequence)...)
+	data = append(data, uint32ToByte(uint32(time.Since(agent.startTime)/time.Millisecond))...)
+	data = append(data, uint32ToByte(uint32(len(agent.samples)))...)
+	for _, sample := range agent.samples {
+		data = append(data, sample...)
+	}
+	agent.samples = nil
+	if err := udpOutput(agentAddr, collector, SFLOW_DEFAULT_PORT, agent.config.collector.Port(), data); err != nil {
+		debugPrintf("send sflow datagram err : %s\n", err)
+	}
+}
+
+// 溜まっているサンプルを1秒ごとに送る
+func startSflowTimer() {
+	go func() {
+		ticker := time.NewTicker(SFLOW_FLUSH_INTERVAL)
+		for range ticker.C {
+			routerMutex.Lock()
+			sflowFlush()
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+// "collector=192.168.0.2:6343,rate=1000,header=128"の形式の設定を読む
+func parseSflowConfig(spec string) (sflowConfig, error) {
+	collector := ""
+	rate, header := SFLOW_DEFAULT_SAMPLING_RATE, SFLOW_DEFAULT_HEADER_SIZE
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			return sflowConfig{}, fmt.Errorf("invalid sflow config %q, format is collector=addr:port,rate=n,header=bytes", spec)
+		}
+		var err error
+		switch key {
+		case "collector":
+			collector = value
+		case "rate":
+			rate, err = strconv.Atoi(value)
+		case "header":
+			header, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown sflow config %q", key)
+		}
+		if err != nil {
+			return sflowConfig{}, err
+		}
+	}
+	if collector == "" {
+		return sflowConfig{}, fmt.Errorf("sflow collector is not specified")
+	}
+	return newSflowConfig(collector, rate, header)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+SIGINT/SIGTERMを受け取ったらepollのループを抜けて後片付けをする
+シグナルハンドラのgoroutineからepollを起こすためにpipeを使う
+*/
+func openShutdownPipe() (int, error) {
+	var fds [2]int
+	err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK)
+	if err != nil {
+		return -1, fmt.Errorf("create pipe err : %s", err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		fmt.Printf("Received %s, shutting down\n", s)
+		syscall.Write(fds[1], []byte{0})
+	}()
+	return fds[0], nil
+}
+
+/*
+ルータを停止する
+-state-fileを指定していれば状態を書き出し、カーネルに書き出した経路を取り消し、全てのデバイスのsocketを閉じて最後の統計情報と破棄したパケットの数を出力する
+*/
+func shutdownRouter(epfd int) {
+	// インターフェイスを閉じる前に、次に起動した時に読み戻す状態を書き出す
+	if stateFile != "" {
+		err := saveRouterState(stateFile)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if dumpTablesFile != "" {
+		err := writeTablesFile(dumpTablesFile)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if exportKernelRoutes {
+		iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+			if entry.source != routeSourceStatic {
+				return
+			}
+			err := writeKernelRoute(prefix, prefixLen, entry, false)
+			if err != nil {
+				fmt.Println(err)
+			}
+		})
+	}
+
+	if lldpEnabled {
+		lldpSendShutdown()
+	}
+	vrrpSendShutdown()
+	raSendShutdown()
+	if pppoe != nil {
+		pppoeStop(pppoe)
+	}
+	if dhcpv6 != nil {
+		// 状態ファイルに書き出したリースは次の起動で使い続けるので返さない
+		dhcpv6Stop(dhcpv6, stateFile == "")
+	}
+
+	closeRouterInstances(epfd)
+	for _, netdev := range netDeviceList {
+		syscall.EpollCtl(epfd, syscall.EPOLL_CTL_DEL, netdev.socket, nil)
+		netdev.closeSocket()
+		stats := netdev.stats
+		fmt.Printf("%s: rx %d packets %d bytes, tx %d packets %d bytes, checksum errors ip %d icmp %d\n",
+			netdev.name, stats.rxPackets, stats.rxBytes, stats.txPackets, stats.txBytes,
+			stats.ipChecksumErrors, stats.icmpChecksumErrors)
+	}
+	netDeviceList = nil
+	for reason, count := range dropCounters {
+		if count != 0 {
+			fmt.Printf("dropped %s: %d\n", dropReason(reason), count)
+		}
+	}
+	syscall.Close(epfd)
+	fmt.Println("Router is stopped")
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SNMPv2cのエージェント
+ルータ上のUDPの161番ポートでGetRequest、GetNextRequest、GetBulkRequestに答え、
+snmpwalkやLibreNMSのような監視ツールからインターフェイスのカウンタ、ルートテーブル、ARPテーブルを読めるようにする
+書き込み(SetRequest)は受け付けない
+  system                     1.3.6.1.2.1.1
+  IF-MIB ifTable             1.3.6.1.2.1.2.2
+  IF-MIB ifXTable            1.3.6.1.2.1.31.1.1
+  IP-MIB ipAddrTable         1.3.6.1.2.1.4.20
+  IP-MIB ipNetToMediaTable   1.3.6.1.2.1.4.22
+  IP-FORWARD-MIB ipCidrRouteTable 1.3.6.1.2.1.4.24.4
+https://www.rfc-editor.org/rfc/rfc3416
+https://www.rfc-editor.org/rfc/rfc2863
+*/
+
+const SNMP_PORT uint16 = 161
+
+// SNMPv2cのバージョン番号
+const SNMP_VERSION_2C = 1
+
+// BERのタグ
+const (
+	BER_TAG_INTEGER      uint8 = 0x02
+	BER_TAG_OCTET_STRING uint8 = 0x04
+	BER_TAG_NULL         uint8 = 0x05
+	BER_TAG_OID          uint8 = 0x06
+	BER_TAG_SEQUENCE     uint8 = 0x30
+)
+
+// SNMPv2-SMIのアプリケーションタグと、値が無いことを表す例外
+const (
+	SNMP_TAG_IP_ADDRESS       uint8 = 0x40
+	SNMP_TAG_COUNTER32        uint8 = 0x41
+	SNMP_TAG_GAUGE32          uint8 = 0x42
+	SNMP_TAG_TIMETICKS        uint8 = 0x43
+	SNMP_TAG_COUNTER64        uint8 = 0x46
+	SNMP_TAG_NO_SUCH_OBJECT   uint8 = 0x80
+	SNMP_TAG_NO_SUCH_INSTANCE uint8 = 0x81
+	SNMP_TAG_END_OF_MIB_VIEW  uint8 = 0x82
+)
+
+// PDUの種類
+const (
+	SNMP_PDU_GET_REQUEST      uint8 = 0xa0
+	SNMP_PDU_GET_NEXT_REQUEST uint8 = 0xa1
+	SNMP_PDU_RESPONSE         uint8 = 0xa2
+	SNMP_PDU_SET_REQUEST      uint8 = 0xa3
+	SNMP_PDU_GET_BULK_REQUEST uint8 = 0xa5
+)
+
+// 応答のerror-status
+const (
+	SNMP_ERROR_NO_ERROR     = 0
+	SNMP_ERROR_TOO_BIG      = 1
+	SNMP_ERROR_NOT_WRITABLE = 17
+)
+
+// 応答がフラグメントされないように、イーサネットのMTUからIPとUDPのヘッダを引いた大きさに収める
+const SNMP_MAX_MESSAGE_SIZE = 1500 - 20 - UDP_HEADER_LEN
+
+// GetBulkRequestで繰り返す回数の上限
+const SNMP_MAX_REPETITIONS = 100
+
+// カーネルのインターフェイス番号を持たないループバックにつけるifIndex
+const SNMP_IFINDEX_VIRTUAL_BASE = 10000
+
+// オブジェクトID
+type snmpOID []uint32
+
+var (
+	snmpOIDZeroDotZero  = snmpOID{0, 0}
+	snmpOIDSystem       = snmpOID{1, 3, 6, 1, 2, 1, 1}
+	snmpOIDIfNumber     = snmpOID{1, 3, 6, 1, 2, 1, 2, 1, 0}
+	snmpOIDIfEntry      = snmpOID{1, 3, 6, 1, 2, 1, 2, 2, 1}
+	snmpOIDIPForwarding = snmpOID{1, 3, 6, 1, 2, 1, 4, 1, 0}
+	snmpOIDIPAddrEntry  = snmpOID{1, 3, 6, 1, 2, 1, 4, 20, 1}
+	snmpOIDIPNetToMedia = snmpOID{1, 3, 6, 1, 2, 1, 4, 22, 1}
+	snmpOIDIPCidrNumber = snmpOID{1, 3, 6, 1, 2, 1, 4, 24, 3, 0}
+	snmpOIDIPCidrRoute  = snmpOID{1, 3, 6, 1, 2, 1, 4, 24, 4, 1}
+	snmpOIDIfXEntry     = snmpOID{1, 3, 6, 1, 2, 1, 31, 1, 1, 1}
+	snmpOIDSysDescr     = snmpOIDSystem.child(1, 0)
+	snmpOIDSysObjectID  = snmpOIDSystem.child(2, 0)
+	snmpOIDSysUpTime    = snmpOIDSystem.child(3, 0)
+	snmpOIDSysName      = snmpOIDSystem.child(5, 0)
+	snmpOIDSysServices  = snmpOIDSystem.child(7, 0)
+)
+
+const SNMP_SYS_DESCR = "go-curo software router"
+
+// sysServices、ネットワーク層とデータリンク層のビット
+const SNMP_SYS_SERVICES = 1<<(3-1) | 1<<(2-1)
+
+// 値のタグとBERでエンコードした中身
+type snmpValue struct {
+	tag  uint8
+	data []byte
+}
+
+type snmpVarBind struct {
+	oid   snmpOID
+	value snmpValue
+}
+
+// SNMPのメッセージ、GetBulkRequestではerrorStatusがnon-repeaters、errorIndexがmax-repetitions
+type snmpMessage struct {
+	version     int64
+	community   string
+	pduType     uint8
+	requestID   int64
+	errorStatus int64
+	errorIndex  int64
+	varBinds    []snmpVarBind
+}
+
+// エージェントの状態、nilなら答えない
+type snmpAgent struct {
+	community string
+	startTime time.Time
+	sysName   string
+}
+
+var snmpState *snmpAgent
+
+// コマンドラインで指定されたコミュニティ名
+var snmpCommunity string
+
+/*
+SNMPのエージェントを設定する
+コミュニティ名が空なら止める
+*/
+func setSnmpAgent(community string) {
+	if community == "" {
+		if snmpState != nil {
+			udpClose(SNMP_PORT)
+			snmpState = nil
+			fmt.Println("SNMP agent is stopped")
+		}
+		return
+	}
+	if snmpState == nil {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "go-curo"
+		}
+		snmpState = &snmpAgent{startTime: time.Now(), sysName: hostname}
+		udpListen(SNMP_PORT, snmpRequestInput)
+		fmt.Println("SNMP agent is started")
+	}
+	snmpState.community = community
+}
+
+/*
+SNMPのリクエストを受信して応答を返す
+コミュニティ名が違うリクエストには答えない
+*/
+func snmpRequestInput(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, packet []byte) {
+	if !isOurIPAddr(ipheader.destAddr) {
+		countDrop(DROP_REASON_SNMP_INVALID)
+		return
+	}
+	request, err := parseSnmpMessage(packet)
+	if err != nil {
+		debugPrintf("Drop invalid SNMP message from %s : %s\n", printIPAddr(ipheader.srcAddr), err)
+		countDrop(DROP_REASON_SNMP_INVALID)
+		return
+	}
+	if request.version != SNMP_VERSION_2C ||
+		subtle.ConstantTimeCompare([]byte(request.community), []byte(snmpState.community)) != 1 {
+		fmt.Printf("Drop SNMP request with unknown version %d or community from %s\n", request.version, printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_SNMP_INVALID)
+		return
+	}
+	switch request.pduType {
+	case SNMP_PDU_GET_REQUEST, SNMP_PDU_GET_NEXT_REQUEST, SNMP_PDU_GET_BULK_REQUEST, SNMP_PDU_SET_REQUEST:
+	default:
+		countDrop(DROP_REASON_SNMP_INVALID)
+		return
+	}
+	response := snmpResponse(request, snmpBuildMib())
+	udpOutput(ipheader.destAddr, ipheader.srcAddr, SNMP_PORT, srcPort, response)
+}
+
+// リクエストに対する応答のメッセージを作る
+func snmpResponse(request snmpMessage, mib snmpMib) []byte {
+	response := snmpMessage{
+		version:   request.version,
+		community: request.community,
+		pduType:   SNMP_PDU_RESPONSE,
+		requestID: request.requestID,
+	}
+	switch request.pduType {
+	case SNMP_PDU_GET_REQUEST:
+		for _, vb := range request.varBinds {
+			response.varBinds = append(response.varBinds, mib.get(vb.oid))
+		}
+	case SNMP_PDU_GET_NEXT_REQUEST:
+		for _, vb := range request.varBinds {
+			response.varBinds = append(response.varBinds, mib.next(vb.oid))
+		}
+	case SNMP_PDU_GET_BULK_REQUEST:
+		response.varBinds = snmpGetBulk(request, mib, response)
+	case SNMP_PDU_SET_REQUEST:
+		// 書き込みは受け付けない
+		response.errorStatus = SNMP_ERROR_NOT_WRITABLE
+		response.errorIndex = 1
+		response.varBinds = request.varBinds
+	}
+	b := response.encode()
+	if len(b) > SNMP_MAX_MESSAGE_SIZE {
+		response.errorStatus = SNMP_ERROR_TOO_BIG
+		response.errorIndex = 0
+		response.varBinds = nil
+		b = response.encode()
+	}
+	return b
+}
+
+/*
+GetBulkRequest
+最初のnon-repeaters個はGetNextと同じ、残りはmax-repetitions回まで続けて次を返す
+応答がSNMP_MAX_MESSAGE_SIZEを超える前に止める
+*/
+func snmpGetBulk(request snmpMessage, mib snmpMib, response snmpMessage) []snmpVarBind {
+	nonRepeaters := int(request.errorStatus)
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(request.varBinds) {
+		nonRepeaters = len(request.varBinds)
+	}
+	maxRepetitions := int(request.errorIndex)
+	if maxRepetitions > SNMP_MAX_REPETITIONS {
+		maxRepetitions = SNMP_MAX_REPETITIONS
+	}
+	var varBinds []snmpVarBind
+	for _, vb := range request.varBinds[:nonRepeaters] {
+		varBinds = append(varBinds, mib.next(vb.oid))
+	}
+	var last []snmpOID
+	for _, vb := range request.varBinds[nonRepeaters:] {
+		last = append(last, vb.oid)
+	}
+	for i := 0; i < maxRepetitions && len(last) != 0; i++ {
+		row := len(varBinds)
+		end := true
+		for j := range last {
+			vb := mib.next(last[j])
+			last[j] = vb.oid
+			varBinds = append(varBinds, vb)
+			if vb.value.tag != SNMP_TAG_END_OF_MIB_VIEW {
+				end = false
+			}
+		}
+		response.varBinds = varBinds
+		if i != 0 && len(response.encode()) > SNMP_MAX_MESSAGE_SIZE {
+			return varBinds[:row]
+		}
+		if end {
+			break
+		}
+	}
+	return varBinds
+}
+
+/*
+MIBの値を辞書順に並べたもの
+リクエストごとにルータの状態から作り直す
+*/
+type snmpMib []snmpVarBind
+
+func (mib *snmpMib) add(oid snmpOID, value snmpValue) {
+	*mib = append(*mib, snmpVarBind{oid: oid, value: value})
+}
+
+// 値が一致するOIDを返す、無ければ例外を返す
+func (mib snmpMib) get(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(mib), func(i int) bool { return mib[i].oid.compare(oid) >= 0 })
+	if i < len(mib) && mib[i].oid.compare(oid) == 0 {
+		return mib[i]
+	}
+	// オブジェクトはあるがインスタンスが無いか、オブジェクトが無いか
+	if i < len(mib) && len(oid) > 0 && mib[i].oid.hasPrefix(oid[:len(oid)-1]) {
+		return snmpVarBind{oid: oid, value: snmpValue{tag: SNMP_TAG_NO_SUCH_INSTANCE}}
+	}
+	return snmpVarBind{oid: oid, value: snmpValue{tag: SNMP_TAG_NO_SUCH_OBJECT}}
+}
+
+// 辞書順で次のOIDの値を返す
+func (mib snmpMib) next(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(mib), func(i int) bool { return mib[i].oid.compare(oid) > 0 })
+	if i < len(mib) {
+		return mib[i]
+	}
+	return snmpVarBind{oid: oid, value: snmpValue{tag: SNMP_TAG_END_OF_MIB_VIEW}}
+}
+
+// インターフェイスの番号、カーネルのインターフェイス番号と同じにする
+func snmpIfIndex(netdev *netDevice) uint32 {
+	if netdev.sockAddr.Ifindex != 0 {
+		return uint32(netdev.sockAddr.Ifindex)
+	}
+	for i, dev := range netDeviceList {
+		if dev == netdev {
+			return uint32(SNMP_IFINDEX_VIRTUAL_BASE + i)
+		}
+	}
+	return 0
+}
+
+/*
+ルータの状態からMIBを作る
+パケットの処理の中で呼ばれるのでrouterMutexは取得済み
+*/
+func snmpBuildMib() snmpMib {
+	var mib snmpMib
+	mib.add(snmpOIDSysDescr, snmpString(SNMP_SYS_DESCR))
+	mib.add(snmpOIDSysObjectID, snmpOIDValue(snmpOIDZeroDotZero))
+	mib.add(snmpOIDSysUpTime, snmpTimeTicks(time.Since(snmpState.startTime)))
+	mib.add(snmpOIDSysName, snmpString(snmpState.sysName))
+	mib.add(snmpOIDSysServices, snmpInteger(SNMP_SYS_SERVICES))
+
+	// IF-MIB
+	mib.add(snmpOIDIfNumber, snmpInteger(int64(len(netDeviceList))))
+	for _, netdev := range netDeviceList {
+		index := snmpIfIndex(netdev)
+		stats := netdev.stats
+		ifType := int64(6) // ethernetCsmacd
+		var physAddr []byte
+		if netdev.backend == loopbackDevice {
+			ifType = 24 // softwareLoopback
+		} else {
+			physAddr = netdev.macAddr[:]
+		}
+		column := func(n uint32, value snmpValue) {
+			mib.add(snmpOIDIfEntry.child(n, index), value)
+		}
+		column(1, snmpInteger(int64(index)))
+		column(2, snmpString(netdev.name))
+		column(3, snmpInteger(ifType))
+		column(6, snmpValue{tag: BER_TAG_OCTET_STRING, data: physAddr})
+		// ifAdminStatusとifOperStatusは1がup、2がdown
+		adminStatus, operStatus := int64(1), int64(1)
+		if netdev.adminDown {
+			adminStatus = 2
+		}
+		if !netdev.isUp() {
+			operStatus = 2
+		}
+		column(7, snmpInteger(adminStatus))
+		column(8, snmpInteger(operStatus))
+		column(10, snmpCounter32(stats.rxBytes))
+		column(11, snmpCounter32(stats.rxPackets))
+		column(13, snmpCounter32(stats.rxPoliced+stats.urpfDrops))
+		column(14, snmpCounter32(stats.ipChecksumErrors+stats.icmpChecksumErrors))
+		column(16, snmpCounter32(stats.txBytes))
+		column(17, snmpCounter32(stats.txPackets))
+		column(19, snmpCounter32(stats.txQueueDrops+stats.impairLost))
+		column(20, snmpCounter32(stats.txErrors))
+
+		xcolumn := func(n uint32, value snmpValue) {
+			mib.add(snmpOIDIfXEntry.child(n, index), value)
+		}
+		xcolumn(1, snmpString(netdev.name))
+		xcolumn(6, snmpCounter64(stats.rxBytes))
+		xcolumn(7, snmpCounter64(stats.rxPackets))
+		xcolumn(10, snmpCounter64(stats.txBytes))
+		xcolumn(11, snmpCounter64(stats.txPackets))
+	}
+
+	// IP-MIB
+	mib.add(snmpOIDIPForwarding, snmpInteger(1)) // forwarding
+	for _, netdev := range netDeviceList {
+		index := snmpIfIndex(netdev)
+		for _, addr := range netdev.ipDev.addrs() {
+			instance := snmpOIDIPAddrEntry.child(0).withAddr(addr.address)
+			for n, value := range map[uint32]snmpValue{
+				1: snmpIPAddress(addr.address),
+				2: snmpInteger(int64(index)),
+				3: snmpIPAddress(addr.netmask),
+				4: snmpInteger(1), // ipAdEntBcastAddr、ホスト部が全て1
+			} {
+				instance[len(snmpOIDIPAddrEntry)] = n
+				mib.add(append(snmpOID{}, instance...), value)
+			}
+		}
+	}
+	for _, entry := range staticArpEntries {
+		if netdev := searchNetDeviceByName(entry.ifname); netdev != nil {
+			snmpAddNetToMedia(&mib, snmpIfIndex(netdev), entry.ipAddr, entry.macAddr, 4) // static
+		}
+	}
+	for _, entry := range ArpTableEntryList {
+		if entry.netdev != nil && searchStaticArpEntry(entry.ipAddr) == nil {
+			snmpAddNetToMedia(&mib, snmpIfIndex(entry.netdev), entry.ipAddr, entry.macAddr, 3) // dynamic
+		}
+	}
+
+	// IP-FORWARD-MIB、インデックスは宛先、マスク、TOS、NextHop
+	var routes int
+	iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+		routes++
+		mask := prefixMask(prefixLen)
+		var nexthop uint32
+		routeType := int64(3) // local、直接接続
+		proto := int64(2)     // local
+		var index uint32
+		switch entry.iptype {
+		case network:
+			nexthop = entry.nexthop
+			routeType = 4 // remote
+			proto = 3     // netmgmt、静的に設定した経路
+		case ipsec:
+			nexthop = entry.tunnel.config.peer
+			routeType = 4
+			proto = 3
+		case blackhole, reject:
+			routeType = 2 // reject、パケットを捨てる経路
+			proto = 3
+		}
+		if netdev := routeOutputDevice(entry); netdev != nil {
+			index = snmpIfIndex(netdev)
+		}
+		instance := snmpOIDIPCidrRoute.child(0).withAddr(prefix).withAddr(mask).child(0).withAddr(nexthop)
+		for n, value := range map[uint32]snmpValue{
+			1:  snmpIPAddress(prefix),
+			2:  snmpIPAddress(mask),
+			3:  snmpInteger(0),
+			4:  snmpIPAddress(nexthop),
+			5:  snmpInteger(int64(index)),
+			6:  snmpInteger(routeType),
+			7:  snmpInteger(proto),
+			11: snmpInteger(int64(entry.metric)), // ipCidrRouteMetric1
+			16: snmpInteger(1),                   // active
+		} {
+			instance[len(snmpOIDIPCidrRoute)] = n
+			mib.add(append(snmpOID{}, instance...), value)
+		}
+	})
+	mib.add(snmpOIDIPCidrNumber, snmpGauge32(uint64(routes)))
+
+	sort.Slice(mib, func(i, j int) bool { return mib[i].oid.compare(mib[j].oid) < 0 })
+	return mib
+}
+
+// ipNetToMediaTableの行、インデックスはifIndexとIPアドレス
+func snmpAddNetToMedia(mib *snmpMib, index, addr uint32, macAddr [6]uint8, mediaType int64) {
+	instance := snmpOIDIPNetToMedia.child(0, index).withAddr(addr)
+	for n, value := range map[uint32]snmpValue{
+		1: snmpInteger(int64(index)),
+		2: {tag: BER_TAG_OCTET_STRING, data: append([]byte{}, macAddr[:]...)},
+		3: snmpIPAddress(addr),
+		4: snmpInteger(mediaType),
+	} {
+		instance[len(snmpOIDIPNetToMedia)] = n
+		mib.add(append(snmpOID{}, instance...), value)
+	}
+}
+
+// 子のOIDを新しいスライスで返す
+func (oid snmpOID) child(ids ...uint32) snmpOID {
+	return append(append(snmpOID{}, oid...), ids...)
+}
+
+// IPアドレスの4バイトをつなげる
+func (oid snmpOID) withAddr(addr uint32) snmpOID {
+	return oid.child(addr>>24, addr>>16&0xff, addr>>8&0xff, addr&0xff)
+}
+
+func (oid snmpOID) compare(other snmpOID) int {
+	for i := 0; i < len(oid) && i < len(other); i++ {
+		if oid[i] != other[i] {
+			if oid[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(oid) - len(other)
+}
+
+func (oid snmpOID) hasPrefix(prefix snmpOID) bool {
+	return len(oid) >= len(prefix) && oid[:len(prefix)].compare(prefix) == 0
+}
+
+func (oid snmpOID) String() string {
+	var s []string
+	for _, id := range oid {
+		s = append(s, strconv.FormatUint(uint64(id), 10))
+	}
+	return strings.Join(s, ".")
+}
+
+func snmpInteger(v int64) snmpValue {
+	return snmpValue{tag: BER_TAG_INTEGER, data: berInteger(v)}
+}
+
+func snmpString(s string) snmpValue {
+	return snmpValue{tag: BER_TAG_OCTET_STRING, data: []byte(s)}
+}
+
+func snmpOIDValue(oid snmpOID) snmpValue {
+	return snmpValue{tag: BER_TAG_OID, data: berOID(oid)}
+}
+
+func snmpIPAddress(addr uint32) snmpValue {
+	return snmpValue{tag: SNMP_TAG_IP_ADDRESS, data: uint32ToByte(addr)}
+}
+
+// 32bitのカウンタは溢れたら0に戻る
+func snmpCounter32(v uint64) snmpValue {
+	return snmpValue{tag: SNMP_TAG_COUNTER32, data: berUnsigned(v & 0xffffffff)}
+}
+
+func snmpGauge32(v uint64) snmpValue {
+	if v > 0xffffffff {
+		v = 0xffffffff
+	}
+	return snmpValue{tag: SNMP_TAG_GAUGE32, data: berUnsigned(v)}
+}
+
+func snmpCounter64(v uint64) snmpValue {
+	return snmpValue{tag: SNMP_TAG_COUNTER64, data: berUnsigned(v)}
+}
+
+// 1/100秒単位
+func snmpTimeTicks(d time.Duration) snmpValue {
+	return snmpValue{tag: SNMP_TAG_TIMETICKS, data: berUnsigned(uint64(d/(10*time.Millisecond)) & 0xffffffff)}
+}
+
+// メッセージをBERでエンコードする
+func (msg snmpMessage) encode() []byte {
+	var varBinds []byte
+	for _, vb := range msg.varBinds {
+		varBinds = append(varBinds, berTLV(BER_TAG_SEQUENCE,
+			append(berTLV(BER_TAG_OID, berOID(vb.oid)), berTLV(vb.value.tag, vb.value.data)...))...)
+	}
+	var pdu []byte
+	pdu = append(pdu, berTLV(BER_TAG_INTEGER, berInteger(msg.requestID))...)
+	pdu = append(pdu, berTLV(BER_TAG_INTEGER, berInteger(msg.errorStatus))...)
+	pdu = append(pdu, berTLV(BER_TAG_INTEGER, berInteger(msg.errorIndex))...)
+	pdu = append(pdu, berTLV(BER_TAG_SEQUENCE, varBinds)...)
+
+	var b []byte
+	b = append(b, berTLV(BER_TAG_INTEGER, berInteger(msg.version))...)
+	b = append(b, berTLV(BER_TAG_OCTET_STRING, []byte(msg.community))...)
+	b = append(b, berTLV(msg.pduType, pdu)...)
+	return berTLV(BER_TAG_SEQUENCE, b)
+}
+
+// BERのメッセージを読む
+func parseSnmpMessage(b []byte) (snmpMessage, error) {
+	var msg snmpMessage
+	tag, content, _, err := berReadTLV(b)
+	if err != nil {
+		return msg, err
+	}
+	if tag != BER_TAG_SEQUENCE {
+		return msg, errors.New("message is not sequence")
+	}
+	if msg.version, content, err = berReadInteger(content); err != nil {
+		return msg, err
+	}
+	tag, community, content, err := berReadTLV(content)
+	if err != nil {
+		return msg, err
+	}
+	if tag != BER_TAG_OCTET_STRING {
+		return msg, errors.New("community is not octet string")
+	}
+	msg.community = string(community)
+	msg.pduType, content, _, err = berReadTLV(content)
+	if err != nil {
+		return msg, err
+	}
+	if msg.requestID, content, err = berReadInteger(content); err != nil {
+		return msg, err
+	}
+	if msg.errorStatus, content, err = berReadInteger(content); err != nil {
+		return msg, err
+	}
+	if msg.errorIndex, content, err = berReadInteger(content); err != nil {
+		return msg, err
+	}
+	tag, varBinds, _, err := berReadTLV(content)
+	if err != nil {
+		return msg, err
+	}
+	if tag != BER_TAG_SEQUENCE {
+		return msg, errors.New("variable bindings is not sequence")
+	}
+	for len(varBinds) != 0 {
+		var vb, oid []byte
+		tag, vb, varBinds, err = berReadTLV(varBinds)
+		if err != nil {
+			return msg, err
+		}
+		if tag != BER_TAG_SEQUENCE {
+			return msg, errors.New("variable binding is not sequence")
+		}
+		tag, oid, vb, err = berReadTLV(vb)
+		if err != nil {
+			return msg, err
+		}
+		if tag != BER_TAG_OID {
+			return msg, errors.New("name of variable binding is not oid")
+		}
+		var varBind snmpVarBind
+		if varBind.oid, err = berParseOID(oid); err != nil {
+			return msg, err
+		}
+		if varBind.value.tag, varBind.value.data, _, err = berReadTLV(vb); err != nil {
+			return msg, err
+		}
+		msg.varBinds = append(msg.varBinds, varBind)
+	}
+	return msg, nil
+}
+
+// タグ、長さ、中身をつなげる
+func berTLV(tag uint8, content []byte) []byte {
+	b := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, uint8(n))
+	case n <= 0xff:
+		b = append(b, 0x81, uint8(n))
+	default:
+		b = append(b, 0x82, uint8(n>>8), uint8(n))
+	}
+	return append(b, content...)
+}
+
+// タグと中身と残りを返す
+func berReadTLV(b []byte) (uint8, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("ber too short")
+	}
+	tag := b[0]
+	n := int(b[1])
+	offset := 2
+	if n&0x80 != 0 {
+		lenBytes := n & 0x7f
+		if lenBytes == 0 || lenBytes > 2 || len(b) < 2+lenBytes {
+			return 0, nil, nil, errors.New("ber invalid length")
+		}
+		n = 0
+		for _, c := range b[2 : 2+lenBytes] {
+			n = n<<8 | int(c)
+		}
+		offset += lenBytes
+	}
+	if len(b) < offset+n {
+		return 0, nil, nil, errors.New("ber length exceeds message")
+	}
+	return tag, b[offset : offset+n], b[offset+n:], nil
+}
+
+func berReadInteger(b []byte) (int64, []byte, error) {
+	tag, content, rest, err := berReadTLV(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != BER_TAG_INTEGER || len(content) == 0 || len(content) > 8 {
+		return 0, nil, errors.New("ber invalid integer")
+	}
+	// 先頭のビットが符号
+	v := int64(int8(content[0]))
+	for _, c := range content[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, rest, nil
+}
+
+// 2の補数で最小のバイト数にする
+func berInteger(v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{uint8(v)}, b...)
+		// 残りが符号の拡張だけなら終わる
+		if -0x80 <= v && v <= 0x7f {
+			return b
+		}
+		v >>= 8
+	}
+}
+
+// 符号なしの値は先頭のビットが立っていれば0を前につける
+func berUnsigned(v uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{uint8(v)}, b...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// 最初の2つは40*X+Yにまとめ、残りは7bitずつ区切る
+func berOID(oid snmpOID) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	var b []byte
+	ids := append(snmpOID{oid[0]*40 + oid[1]}, oid[2:]...)
+	for _, id := range ids {
+		chunk := []byte{uint8(id & 0x7f)}
+		for id >>= 7; id != 0; id >>= 7 {
+			chunk = append([]byte{uint8(id&0x7f) | 0x80}, chunk...)
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
+
+func berParseOID(b []byte) (snmpOID, error) {
+	var ids []uint32
+	var id uint32
+	for i, c := range b {
+		if id > 0xffffffff>>7 {
+			return nil, errors.New("ber oid too large")
+		}
+		id = id<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, errors.New("ber oid truncated")
+			}
+			continue
+		}
+		ids = append(ids, id)
+		id = 0
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("ber empty oid")
+	}
+	first := ids[0]
+	switch {
+	case first < 40:
+		return append(snmpOID{0, first}, ids[1:]...), nil
+	case first < 80:
+		return append(snmpOID{1, first - 40}, ids[1:]...), nil
+	}
+	return append(snmpOID{2, first - 80}, ids[1:]...), nil
+}
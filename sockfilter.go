@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+AF_PACKETのsocketにつけるBPFのフィルタ(classic BPF)
+ルータが処理しないフレームをカーネルの中で捨てて、ユーザ空間に上げないようにする
+  自分が送信したフレーム(PACKET_OUTGOING)
+  ARP、IPv4、LLDP以外のイーサタイプ(IPv6など)、PPPoEはクライアントを動かしているインターフェイスだけ受け取る
+ブリッジのポートは全てのフレームを転送するので、自分が送信したフレームだけを捨てる
+ブリッジやPPPoEの設定が変わったらフィルタをつけ直す
+-no-socket-filterでフィルタをつけずに全てのフレームを受け取る
+https://docs.kernel.org/networking/filter.html
+*/
+
+// フィルタを通したフレームをユーザ空間に渡す長さ
+const SOCKET_FILTER_SNAP_LEN = 0x40000
+
+// フレームの種類(pkttype)を読むための補助データのオフセット、SKF_AD_OFF(-0x1000) + SKF_AD_PKTTYPE(4)
+const SKF_AD_PKTTYPE_OFFSET = 0xfffff004
+
+// フィルタをつけない
+var socketFilterDisabled bool
+
+// 受信するイーサタイプ
+func (netdev *netDevice) acceptEtherTypes() []uint16 {
+	types := []uint16{ETHER_TYPE_ARP, ETHER_TYPE_IP, ETHER_TYPE_LLDP}
+	if netdev.pppoe != nil {
+		types = append(types, ETHER_TYPE_PPPOE_DISCOVERY, ETHER_TYPE_PPPOE_SESSION)
+	}
+	if ipv6Enabled(netdev) {
+		types = append(types, ETHER_TYPE_IPV6)
+	}
+	return types
+}
+
+// インターフェイスの今の設定に合わせてフィルタをつける
+func (netdev *netDevice) updateSocketFilter() {
+	if netdev.backend != packetSocket || socketFilterDisabled {
+		return
+	}
+	var filter []unix.SockFilter
+	if netdev.bridge != nil {
+		filter = socketFilterProgram(nil)
+	} else {
+		filter = socketFilterProgram(netdev.acceptEtherTypes())
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(netdev.socket, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+		fmt.Printf("attach socket filter to %s err : %s\n", netdev.name, err)
+	}
+}
+
+/*
+フィルタのプログラムを作る、etherTypesがnilなら自分が送信したフレーム以外を全て受け取る
+
+	ld  #pkttype
+	jeq #PACKET_OUTGOING, drop
+	ldh [12]
+	jeq #etherTypes[0], accept
+	...
+	drop:   ret #0
+	accept: ret #SOCKET_FILTER_SNAP_LEN
+*/
+func socketFilterProgram(etherTypes []uint16) []unix.SockFilter {
+	n := len(etherTypes)
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: SKF_AD_PKTTYPE_OFFSET},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(n + 1), K: unix.PACKET_OUTGOING},
+	}
+	if etherTypes == nil {
+		filter[1].Jt = 0
+		filter[1].Jf = 1
+	} else {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12})
+		for i, etherType := range etherTypes {
+			filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(n - i), K: uint32(etherType)})
+		}
+	}
+	return append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: SOCKET_FILTER_SNAP_LEN})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ウォームリスタート
+停止する時に動的に覚えた状態をファイルに書き出し、次に起動した時に読み戻す
+実験の途中でルータを再起動しても、張られていたコネクションが切れないようにする
+  ARPテーブル      学習したエントリ、同じインターフェイスがあってサブネットに入るものだけ戻す
+  NATのセッション  NATのエントリとALGのシーケンス番号のずれ、外側のアドレスが同じで期限が切れていないものだけ戻す
+  経路             静的経路、設定ファイルやフラグで同じプレフィックスの静的経路が入っていれば、そちらを使って戻さない
+  IPsec            SAのシーケンス番号、SPIが同じSAだけ戻す
+  DHCPv6-PD        委譲されたプレフィックスとサーバ、T1とT2と有効期間、同じWAN側のインターフェイスで有効期間が残っているものだけ戻す
+                   状態を書き出す時は止める時にReleaseを送らないので、サーバ側でもリースはそのまま残っている
+書き出してからSTATE_DEFAULT_MAX_AGE(-state-max-ageで変える)より古いファイルは、状態が変わっているかもしれないので使わない
+ただしIPsecのシーケンス番号は古くても0からやり直すより進んでいるので、古いファイルからでも戻す
+*/
+
+const STATE_DEFAULT_MAX_AGE = 5 * time.Minute
+
+var stateFile string
+var stateMaxAge time.Duration
+
+type stateArpJSON struct {
+	Interface string `json:"interface"`
+	IPAddress string `json:"ip_address"`
+	MacAddr   string `json:"mac_address"`
+}
+
+type stateNatJSON struct {
+	Protocol   uint8     `json:"protocol"`
+	LocalAddr  string    `json:"local_address"`
+	LocalPort  uint16    `json:"local_port"`
+	GlobalAddr string    `json:"global_address"`
+	GlobalPort uint16    `json:"global_port"`
+	LastUsed   time.Time `json:"last_used"`
+}
+
+type stateSeqAdjustJSON struct {
+	LocalAddr     string    `json:"local_address"`
+	LocalPort     uint16    `json:"local_port"`
+	RemoteAddr    string    `json:"remote_address"`
+	RemotePort    uint16    `json:"remote_port"`
+	CorrectionPos uint32    `json:"correction_pos"`
+	OffsetBefore  int32     `json:"offset_before"`
+	OffsetAfter   int32     `json:"offset_after"`
+	LastUsed      time.Time `json:"last_used"`
+}
+
+type stateRouteJSON struct {
+	Prefix   string `json:"prefix"`
+	Type     string `json:"type,omitempty"`
+	Nexthop  string `json:"nexthop,omitempty"`
+	Distance uint8  `json:"distance"`
+	Metric   uint32 `json:"metric"`
+}
+
+type stateIpsecJSON struct {
+	Peer   string `json:"peer"`
+	SpiOut uint32 `json:"spi_out"`
+	SeqOut uint32 `json:"seq_out"`
+	SpiIn  uint32 `json:"spi_in"`
+	SeqIn  uint32 `json:"seq_in"`
+	Window uint64 `json:"replay_window"`
+}
+
+type stateDhcpv6PdJSON struct {
+	Interface         string    `json:"interface"`
+	ServerID          string    `json:"server_id"`
+	ServerAddr        string    `json:"server_address"`
+	Prefix            string    `json:"prefix"`
+	T1                uint32    `json:"t1"`
+	T2                uint32    `json:"t2"`
+	PreferredLifetime uint32    `json:"preferred_lifetime"`
+	ValidLifetime     uint32    `json:"valid_lifetime"`
+	BoundAt           time.Time `json:"bound_at"`
+}
+
+type routerStateJSON struct {
+	SavedAt    time.Time            `json:"saved_at"`
+	Arp        []stateArpJSON       `json:"arp"`
+	Nat        []stateNatJSON       `json:"nat"`
+	SeqAdjusts []stateSeqAdjustJSON `json:"nat_seq_adjusts"`
+	Routes     []stateRouteJSON     `json:"routes"`
+	Ipsec      []stateIpsecJSON     `json:"ipsec"`
+	Dhcpv6Pd   *stateDhcpv6PdJSON   `json:"dhcpv6_pd,omitempty"`
+}
+
+/*
+今の状態をファイルに書き出す
+途中で止まっても前のファイルが壊れないように、同じディレクトリの一時ファイルに書いてから置き換える
+*/
+func saveRouterState(path string) error {
+	state := routerStateJSON{SavedAt: time.Now()}
+	for _, entry := range ArpTableEntryList {
+		state.Arp = append(state.Arp, stateArpJSON{
+			Interface: entry.netdev.name,
+			IPAddress: printIPAddr(entry.ipAddr),
+			MacAddr:   hardwareAddr(entry.macAddr).String(),
+		})
+	}
+	for _, entry := range natEntryList {
+		state.Nat = append(state.Nat, stateNatJSON{
+			Protocol:   entry.protocol,
+			LocalAddr:  printIPAddr(entry.localAddr),
+			LocalPort:  entry.localPort,
+			GlobalAddr: printIPAddr(entry.globalAddr),
+			GlobalPort: entry.globalPort,
+			LastUsed:   entry.lastUsed,
+		})
+	}
+	for _, adjust := range natSeqAdjustList {
+		state.SeqAdjusts = append(state.SeqAdjusts, stateSeqAdjustJSON{
+			LocalAddr:     printIPAddr(adjust.localAddr),
+			LocalPort:     adjust.localPort,
+			RemoteAddr:    printIPAddr(adjust.remoteAddr),
+			RemotePort:    adjust.remotePort,
+			CorrectionPos: adjust.correctionPos,
+			OffsetBefore:  adjust.offsetBefore,
+			OffsetAfter:   adjust.offsetAfter,
+			LastUsed:      adjust.lastUsed,
+		})
+	}
+	ribWalk(func(prefix, prefixLen uint32, entry ipRouteEntry, selected bool) {
+		if entry.source != routeSourceStatic {
+			return
+		}
+		route := stateRouteJSON{
+			Prefix:   routePrefix(prefix, prefixLen).String(),
+			Distance: entry.distance,
+			Metric:   entry.metric,
+		}
+		if entry.iptype == network {
+			route.Nexthop = printIPAddr(entry.nexthop)
+		} else {
+			route.Type = entry.iptype.String()
+		}
+		state.Routes = append(state.Routes, route)
+	})
+
+	for _, tunnel := range espTunnels {
+		state.Ipsec = append(state.Ipsec, stateIpsecJSON{
+			Peer:   printIPAddr(tunnel.config.peer),
+			SpiOut: tunnel.out.spi,
+			SeqOut: tunnel.out.seq,
+			SpiIn:  tunnel.in.spi,
+			SeqIn:  tunnel.in.seq,
+			Window: tunnel.in.window,
+		})
+	}
+
+	if dhcpv6 != nil && dhcpv6.netdev != nil && dhcpv6.prefix.IsValid() {
+		state.Dhcpv6Pd = &stateDhcpv6PdJSON{
+			Interface:         dhcpv6.ifname,
+			ServerID:          hex.EncodeToString(dhcpv6.serverID),
+			ServerAddr:        netip.AddrFrom16(dhcpv6.serverAddr).String(),
+			Prefix:            dhcpv6.prefix.String(),
+			T1:                uint32(dhcpv6.t1 / time.Second),
+			T2:                uint32(dhcpv6.t2 / time.Second),
+			PreferredLifetime: uint32(dhcpv6.preferredLifetime / time.Second),
+			ValidLifetime:     uint32(dhcpv6.validLifetime / time.Second),
+			BoundAt:           dhcpv6.boundAt,
+		}
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal state err : %s", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("create state file err : %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write state file err : %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write state file err : %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename state file err : %s", err)
+	}
+	fmt.Printf("Saved state to %s: %d arp entries, %d nat entries, %d static routes, %d ipsec tunnels\n",
+		path, len(state.Arp), len(state.Nat), len(state.Routes), len(state.Ipsec))
+	return nil
+}
+
+/*
+書き出した状態を読み戻す
+ファイルが無い時と古すぎる時は何もしない
+今のインターフェイスや設定に合わない項目は読み飛ばす
+*/
+func loadRouterState(path string, maxAge time.Duration) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read state file err : %s", err)
+	}
+	var state routerStateJSON
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("parse state file %s err : %s", path, err)
+	}
+	// 同じシーケンス番号で送ると対向に捨てられるので、古さに関わらず戻す
+	ipsecCount := 0
+	for _, sa := range state.Ipsec {
+		peer, err := parseIPv4Addr(sa.Peer)
+		if err != nil {
+			continue
+		}
+		if restoreEspSequence(ipv4Uint32(peer), sa.SpiOut, sa.SeqOut, sa.SpiIn, sa.SeqIn, sa.Window) {
+			ipsecCount++
+		}
+	}
+	if ipsecCount != 0 {
+		fmt.Printf("Restored sequence numbers of %d ipsec tunnels from %s\n", ipsecCount, path)
+	}
+
+	now := time.Now()
+	if age := now.Sub(state.SavedAt); maxAge < age {
+		fmt.Printf("State file %s is saved %s ago, ignored\n", path, age.Round(time.Second))
+		return nil
+	}
+
+	arpCount := 0
+	for _, entry := range state.Arp {
+		netdev := searchNetDeviceByName(entry.Interface)
+		ipaddr, err := parseIPv4Addr(entry.IPAddress)
+		if netdev == nil || err != nil || !netdev.ipDev.inSubnet(ipv4Uint32(ipaddr)) {
+			continue
+		}
+		hwaddr, err := net.ParseMAC(entry.MacAddr)
+		if err != nil {
+			continue
+		}
+		macaddr, err := macFromHardwareAddr(hwaddr)
+		if err != nil {
+			continue
+		}
+		if addArpTableEntry(netdev, ipv4Uint32(ipaddr), macaddr) {
+			arpCount++
+		}
+	}
+
+	natCount := 0
+	if nat != nil {
+		outsidedev := searchNetDeviceByName(nat.outsideDevice)
+		for _, entry := range state.Nat {
+			localAddr, err := parseIPv4Addr(entry.LocalAddr)
+			if err != nil {
+				continue
+			}
+			globalAddr, err := parseIPv4Addr(entry.GlobalAddr)
+			if err != nil || outsidedev == nil || !outsidedev.ipDev.hasAddr(ipv4Uint32(globalAddr)) {
+				continue
+			}
+			timeout := NAT_ENTRY_TIMEOUT
+			if entry.Protocol == IP_PROTOCOL_NUM_TCP {
+				timeout = NAT_TCP_ENTRY_TIMEOUT
+			}
+			if timeout <= now.Sub(entry.LastUsed) || natGlobalPortInUse(entry.Protocol, entry.GlobalPort) {
+				continue
+			}
+			natEntryList = append(natEntryList, &natEntry{
+				protocol:   entry.Protocol,
+				localAddr:  ipv4Uint32(localAddr),
+				localPort:  entry.LocalPort,
+				globalAddr: ipv4Uint32(globalAddr),
+				globalPort: entry.GlobalPort,
+				lastUsed:   entry.LastUsed,
+			})
+			natCount++
+		}
+		for _, adjust := range state.SeqAdjusts {
+			localAddr, err := parseIPv4Addr(adjust.LocalAddr)
+			if err != nil {
+				continue
+			}
+			remoteAddr, err := parseIPv4Addr(adjust.RemoteAddr)
+			if err != nil || NAT_TCP_ENTRY_TIMEOUT <= now.Sub(adjust.LastUsed) {
+				continue
+			}
+			natSeqAdjustList = append(natSeqAdjustList, &natSeqAdjust{
+				localAddr:     ipv4Uint32(localAddr),
+				localPort:     adjust.LocalPort,
+				remoteAddr:    ipv4Uint32(remoteAddr),
+				remotePort:    adjust.RemotePort,
+				correctionPos: adjust.CorrectionPos,
+				offsetBefore:  adjust.OffsetBefore,
+				offsetAfter:   adjust.OffsetAfter,
+				lastUsed:      adjust.LastUsed,
+			})
+		}
+	}
+
+	// 設定ファイルやフラグで入れた静的経路があるプレフィックスは、そちらを優先する
+	configured := map[ribKey]bool{}
+	for key, routes := range ipRib {
+		for _, route := range routes {
+			if route.source == routeSourceStatic {
+				configured[key] = true
+			}
+		}
+	}
+	routeCount := 0
+	for _, route := range state.Routes {
+		prefix, err := parseIPv4Prefix(route.Prefix)
+		if err != nil {
+			continue
+		}
+		iptype, err := parseStaticRouteType(route.Type)
+		if err != nil {
+			continue
+		}
+		var nexthop uint32
+		if iptype == network {
+			addr, err := parseIPv4Addr(route.Nexthop)
+			if err != nil {
+				continue
+			}
+			nexthop = ipv4Uint32(addr)
+		}
+		prefixAddr, prefixLen := prefixRoute(prefix)
+		if configured[ribKey{prefix: prefixAddr, prefixLen: prefixLen}] {
+			continue
+		}
+		addStaticRoute(prefixAddr, prefixLen, iptype, nexthop, route.Distance, route.Metric)
+		routeCount++
+	}
+	if pd := state.Dhcpv6Pd; pd != nil {
+		restoreStateDhcpv6Pd(pd, now)
+	}
+	fmt.Printf("Loaded state from %s saved %s ago: %d arp entries, %d nat entries, %d static routes\n",
+		path, now.Sub(state.SavedAt).Round(time.Second), arpCount, natCount, routeCount)
+	return nil
+}
+
+// 書き出したDHCPv6-PDのリースを読み戻す、読めない項目があれば戻さずにSolicitからやり直す
+func restoreStateDhcpv6Pd(pd *stateDhcpv6PdJSON, now time.Time) bool {
+	serverID, err := hex.DecodeString(pd.ServerID)
+	if err != nil || len(serverID) == 0 {
+		return false
+	}
+	serverAddr, err := netip.ParseAddr(pd.ServerAddr)
+	if err != nil || !serverAddr.Is6() {
+		return false
+	}
+	prefix, err := netip.ParsePrefix(pd.Prefix)
+	if err != nil || !prefix.Addr().Is6() {
+		return false
+	}
+	iapd := dhcpv6IaPd{
+		t1:                time.Duration(pd.T1) * time.Second,
+		t2:                time.Duration(pd.T2) * time.Second,
+		prefix:            prefix.Masked(),
+		preferredLifetime: time.Duration(pd.PreferredLifetime) * time.Second,
+		validLifetime:     time.Duration(pd.ValidLifetime) * time.Second,
+	}
+	return restoreDhcpv6Lease(pd.Interface, serverID, serverAddr.As16(), iapd, pd.BoundAt, now)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+/*
+Spanning Tree Protocol(IEEE 802.1D)
+ブリッジ同士でBPDUを交換してルートブリッジを決め、ループになるポートをブロックする
+*/
+
+// BPDUの宛先のマルチキャストアドレス
+var ETHERNET_ADDRESS_STP_MULTICAST = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x00}
+
+// BPDUはLLCでカプセル化される
+var STP_LLC_HEADER = []byte{0x42, 0x42, 0x03}
+
+const (
+	STP_BPDU_TYPE_CONFIG uint8 = 0x00
+	STP_BPDU_TYPE_TCN    uint8 = 0x80
+)
+
+const STP_FLAG_TOPOLOGY_CHANGE uint8 = 0x01
+
+const STP_CONFIG_BPDU_LEN = 35
+
+const STP_DEFAULT_BRIDGE_PRIORITY uint16 = 32768
+const STP_DEFAULT_PORT_PRIORITY uint16 = 128
+
+// 100Mbpsのポートのパスコスト
+const STP_DEFAULT_PATH_COST uint32 = 19
+
+const STP_HELLO_TIME = 2 * time.Second
+const STP_MAX_AGE = 20 * time.Second
+const STP_DEFAULT_FORWARD_DELAY = 15 * time.Second
+
+type stpPortState uint8
+
+const (
+	stpPortDisabled stpPortState = iota
+	stpPortBlocking
+	stpPortListening
+	stpPortLearning
+	stpPortForwarding
+)
+
+func (state stpPortState) String() string {
+	switch state {
+	case stpPortDisabled:
+		return "disabled"
+	case stpPortBlocking:
+		return "blocking"
+	case stpPortListening:
+		return "listening"
+	case stpPortLearning:
+		return "learning"
+	case stpPortForwarding:
+		return "forwarding"
+	}
+	return "unknown"
+}
+
+type stpPortRole uint8
+
+const (
+	stpRoleDisabled stpPortRole = iota
+	stpRoleRoot
+	stpRoleDesignated
+	stpRoleAlternate
+)
+
+func (role stpPortRole) String() string {
+	switch role {
+	case stpRoleDisabled:
+		return "disabled"
+	case stpRoleRoot:
+		return "root"
+	case stpRoleDesignated:
+		return "designated"
+	case stpRoleAlternate:
+		return "alternate"
+	}
+	return "unknown"
+}
+
+// ブリッジIDは上位16bitがプライオリティ、下位48bitがMACアドレス
+func stpBridgeID(priority uint16, macaddr [6]uint8) uint64 {
+	id := uint64(priority) << 48
+	for i, b := range macaddr {
+		id |= uint64(b) << (8 * (5 - i))
+	}
+	return id
+}
+
+func printStpBridgeID(id uint64) string {
+	var macaddr [6]uint8
+	for i := range macaddr {
+		macaddr[i] = uint8(id >> (8 * (5 - i)))
+	}
+	return fmt.Sprintf("%d.%s", id>>48, printMacAddr(macaddr))
+}
+
+// BPDUで比較する優先度、全ての値が小さい方が優先される
+type stpVector struct {
+	rootID       uint64
+	rootPathCost uint32
+	bridgeID     uint64
+	portID       uint16
+}
+
+func (v stpVector) better(other stpVector) bool {
+	if v.rootID != other.rootID {
+		return v.rootID < other.rootID
+	}
+	if v.rootPathCost != other.rootPathCost {
+		return v.rootPathCost < other.rootPathCost
+	}
+	if v.bridgeID != other.bridgeID {
+		return v.bridgeID < other.bridgeID
+	}
+	return v.portID < other.portID
+}
+
+// ポートで受け取った一番新しいBPDU
+type stpReceivedInfo struct {
+	vector     stpVector
+	messageAge time.Duration
+	receivedAt time.Time
+}
+
+// ブリッジのSTPの状態
+type stpBridge struct {
+	priority     uint16
+	bridgeID     uint64
+	rootID       uint64
+	rootPathCost uint32
+	rootPort     *bridgePort
+	forwardDelay time.Duration
+	maxAge       time.Duration
+	lastHello    time.Time
+	// この時刻まではBPDUにTopology Changeフラグをつける
+	topologyChangeUntil time.Time
+}
+
+// ポートのSTPの状態
+type stpPort struct {
+	portID       uint16
+	pathCost     uint32
+	role         stpPortRole
+	state        stpPortState
+	stateChanged time.Time
+	received     *stpReceivedInfo
+}
+
+/*
+ブリッジのSTPを初期化する
+ブリッジIDのMACアドレスにはポートの中で一番小さいMACアドレスを使う
+設定を読み直した時は、前のブリッジに残っているポートの状態を引き継ぐ
+*/
+func stpInitBridge(br, old *bridge, priority uint16, forwardDelay time.Duration) {
+	var macaddr [6]uint8
+	for i, port := range br.ports {
+		if i == 0 || bytes.Compare(port.netdev.macAddr[:], macaddr[:]) < 0 {
+			macaddr = port.netdev.macAddr
+		}
+	}
+	maxAge := STP_MAX_AGE
+	// 2 * (Forward Delay - 1秒) >= Max Ageを満たすようにする
+	if limit := 2 * (forwardDelay - time.Second); limit < maxAge {
+		maxAge = limit
+	}
+	br.stp = &stpBridge{
+		priority:     priority,
+		bridgeID:     stpBridgeID(priority, macaddr),
+		forwardDelay: forwardDelay,
+		maxAge:       maxAge,
+	}
+	br.stp.rootID = br.stp.bridgeID
+	now := time.Now()
+	for i, port := range br.ports {
+		port.stp = stpPort{
+			portID:       STP_DEFAULT_PORT_PRIORITY<<8 | uint16(i+1),
+			pathCost:     STP_DEFAULT_PATH_COST,
+			role:         stpRoleDesignated,
+			state:        stpPortBlocking,
+			stateChanged: now,
+		}
+		if old == nil || old.stp == nil {
+			continue
+		}
+		if oldPort := old.searchPort(port.netdev); oldPort != nil {
+			port.stp.role = oldPort.stp.role
+			port.stp.state = oldPort.stp.state
+			port.stp.stateChanged = oldPort.stp.stateChanged
+			port.stp.received = oldPort.stp.received
+		}
+	}
+	if old == nil || old.stp == nil || old.stp.bridgeID != br.stp.bridgeID {
+		fmt.Printf("STP is enabled on bridge %s, bridge id %s\n", br.name, printStpBridgeID(br.stp.bridgeID))
+	}
+	stpRecompute(br, now)
+}
+
+// ポートの状態を変える
+func stpSetPortState(br *bridge, port *bridgePort, state stpPortState, now time.Time) {
+	if port.stp.state == state {
+		return
+	}
+	fmt.Printf("Port %s of bridge %s is %s\n", port.netdev.name, br.name, state)
+	changed := port.stp.state == stpPortForwarding || state == stpPortForwarding
+	port.stp.state = state
+	port.stp.stateChanged = now
+	// フォワードするポートが変わったら学習したMACアドレスは使えない
+	if changed {
+		stpTopologyChange(br, now)
+	}
+}
+
+/*
+トポロジの変更を検出した時の処理
+学習したMACアドレスを消し、ルートブリッジに向けてTCNを送る
+ルートブリッジはしばらくの間BPDUにTopology Changeフラグをつけて全てのブリッジに知らせる
+*/
+func stpTopologyChange(br *bridge, now time.Time) {
+	stp := br.stp
+	fmt.Printf("Topology change on bridge %s\n", br.name)
+	bridgeFlushFdb(br)
+	if stp.rootPort != nil {
+		stpOutput(stp.rootPort, stpTcnBPDU())
+	}
+	stp.topologyChangeUntil = now.Add(stp.maxAge + stp.forwardDelay)
+}
+
+/*
+ルートブリッジとルートポートを選び、各ポートの役割を決め直す
+*/
+func stpRecompute(br *bridge, now time.Time) {
+	stp := br.stp
+	var best *stpVector
+	var rootPort *bridgePort
+	for _, port := range br.ports {
+		if port.stp.received == nil {
+			continue
+		}
+		received := port.stp.received.vector
+		candidate := stpVector{
+			rootID:       received.rootID,
+			rootPathCost: received.rootPathCost + port.stp.pathCost,
+			bridgeID:     received.bridgeID,
+			portID:       received.portID,
+		}
+		// 自分がルートになるより良い場合だけ候補にする
+		if candidate.rootID >= stp.bridgeID {
+			continue
+		}
+		if best == nil || candidate.better(*best) ||
+			(candidate == *best && port.stp.portID < rootPort.stp.portID) {
+			best = &candidate
+			rootPort = port
+		}
+	}
+
+	oldRootID := stp.rootID
+	if best == nil {
+		stp.rootID = stp.bridgeID
+		stp.rootPathCost = 0
+	} else {
+		stp.rootID = best.rootID
+		stp.rootPathCost = best.rootPathCost
+	}
+	stp.rootPort = rootPort
+	if oldRootID != stp.rootID {
+		fmt.Printf("Root bridge of %s is %s\n", br.name, printStpBridgeID(stp.rootID))
+	}
+
+	for _, port := range br.ports {
+		role := stpRoleAlternate
+		if port == rootPort {
+			role = stpRoleRoot
+		} else {
+			designated := stpVector{
+				rootID:       stp.rootID,
+				rootPathCost: stp.rootPathCost,
+				bridgeID:     stp.bridgeID,
+				portID:       port.stp.portID,
+			}
+			if port.stp.received == nil || designated.better(port.stp.received.vector) {
+				role = stpRoleDesignated
+			}
+		}
+		if port.stp.role != role {
+			debugPrintf("Port %s of bridge %s is %s port\n", port.netdev.name, br.name, role)
+			port.stp.role = role
+		}
+		if role == stpRoleAlternate {
+			stpSetPortState(br, port, stpPortBlocking, now)
+		} else if port.stp.state == stpPortBlocking {
+			stpSetPortState(br, port, stpPortListening, now)
+		}
+	}
+}
+
+/*
+BPDUの受信処理
+*/
+func stpInput(inputdev *netDevice, frame []byte) {
+	br := inputdev.bridge
+	if br == nil || br.stp == nil {
+		return
+	}
+	port := br.searchPort(inputdev)
+	bpdu := frame[14:]
+	if len(bpdu) < 7 || bpdu[0] != STP_LLC_HEADER[0] || bpdu[1] != STP_LLC_HEADER[1] {
+		countDrop(DROP_REASON_STP_INVALID)
+		return
+	}
+	bpdu = bpdu[3:]
+	// プロトコルIDは0
+	if byteToUint16(bpdu[0:2]) != 0 {
+		countDrop(DROP_REASON_STP_INVALID)
+		return
+	}
+	switch bpdu[3] {
+	case STP_BPDU_TYPE_CONFIG:
+		if len(bpdu) < STP_CONFIG_BPDU_LEN {
+			countDrop(DROP_REASON_STP_INVALID)
+			return
+		}
+		vector := stpVector{
+			rootID:       uint64(byteToUint32(bpdu[5:9]))<<32 | uint64(byteToUint32(bpdu[9:13])),
+			rootPathCost: byteToUint32(bpdu[13:17]),
+			bridgeID:     uint64(byteToUint32(bpdu[17:21]))<<32 | uint64(byteToUint32(bpdu[21:25])),
+			portID:       byteToUint16(bpdu[25:27]),
+		}
+		now := time.Now()
+		port.stp.received = &stpReceivedInfo{
+			vector:     vector,
+			messageAge: time.Duration(byteToUint16(bpdu[27:29])) * time.Second / 256,
+			receivedAt: now,
+		}
+		stpRecompute(br, now)
+		// ルートブリッジからトポロジの変更を知らされたら学習したMACアドレスを消す
+		if port == br.stp.rootPort && bpdu[4]&STP_FLAG_TOPOLOGY_CHANGE != 0 && now.After(br.stp.topologyChangeUntil) {
+			fmt.Printf("Topology change on bridge %s\n", br.name)
+			bridgeFlushFdb(br)
+			br.stp.topologyChangeUntil = now.Add(br.stp.maxAge + br.stp.forwardDelay)
+		}
+	case STP_BPDU_TYPE_TCN:
+		// 下流のブリッジからのTCNはルートブリッジまで中継する
+		if port.stp.role == stpRoleDesignated {
+			stpTopologyChange(br, time.Now())
+		}
+	}
+}
+
+// Configuration BPDUを作る
+func stpConfigBPDU(br *bridge, port *bridgePort, messageAge time.Duration, now time.Time) []byte {
+	stp := br.stp
+	var flags uint8
+	if now.Before(stp.topologyChangeUntil) {
+		flags |= STP_FLAG_TOPOLOGY_CHANGE
+	}
+	var bpdu []byte
+	bpdu = append(bpdu, STP_LLC_HEADER...)
+	bpdu = append(bpdu, 0x00, 0x00, 0x00, STP_BPDU_TYPE_CONFIG, flags)
+	bpdu = append(bpdu, uint32ToByte(uint32(stp.rootID>>32))...)
+	bpdu = append(bpdu, uint32ToByte(uint32(stp.rootID))...)
+	bpdu = append(bpdu, uint32ToByte(stp.rootPathCost)...)
+	bpdu = append(bpdu, uint32ToByte(uint32(stp.bridgeID>>32))...)
+	bpdu = append(bpdu, uint32ToByte(uint32(stp.bridgeID))...)
+	bpdu = append(bpdu, uint16ToByte(port.stp.portID)...)
+	// 時間は1/256秒単位
+	for _, t := range []time.Duration{messageAge, stp.maxAge, STP_HELLO_TIME, stp.forwardDelay} {
+		bpdu = append(bpdu, uint16ToByte(uint16(t*256/time.Second))...)
+	}
+	return bpdu
+}
+
+// Topology Change Notification BPDUを作る
+func stpTcnBPDU() []byte {
+	return append(append([]byte{}, STP_LLC_HEADER...), 0x00, 0x00, 0x00, STP_BPDU_TYPE_TCN)
+}
+
+// 802.3のフレームで送る、タイプの代わりに長さを入れる
+func stpOutput(port *bridgePort, bpdu []byte) {
+	ethernetOutput(port.netdev, ETHERNET_ADDRESS_STP_MULTICAST, bpdu, uint16(len(bpdu)))
+}
+
+/*
+1秒ごとにタイマーを進める
+受け取った情報の期限切れ、ポートの状態の遷移、Hello BPDUの送信をする
+*/
+func stpTick(br *bridge, now time.Time) {
+	stp := br.stp
+	changed := false
+	for _, port := range br.ports {
+		received := port.stp.received
+		if received != nil && now.Sub(received.receivedAt)+received.messageAge >= stp.maxAge {
+			fmt.Printf("BPDU on %s of bridge %s is expired\n", port.netdev.name, br.name)
+			port.stp.received = nil
+			changed = true
+		}
+	}
+	if changed {
+		stpRecompute(br, now)
+	}
+
+	for _, port := range br.ports {
+		if now.Sub(port.stp.stateChanged) < stp.forwardDelay {
+			continue
+		}
+		switch port.stp.state {
+		case stpPortListening:
+			stpSetPortState(br, port, stpPortLearning, now)
+		case stpPortLearning:
+			stpSetPortState(br, port, stpPortForwarding, now)
+		}
+	}
+
+	if now.Sub(stp.lastHello) < STP_HELLO_TIME {
+		return
+	}
+	stp.lastHello = now
+	// ルートブリッジでなければルートポートで受け取った情報を中継する
+	var messageAge time.Duration
+	if stp.rootPort != nil {
+		received := stp.rootPort.stp.received
+		messageAge = received.messageAge + now.Sub(received.receivedAt) + time.Second
+	}
+	for _, port := range br.ports {
+		if port.stp.role == stpRoleDesignated {
+			stpOutput(port, stpConfigBPDU(br, port, messageAge, now))
+		}
+	}
+}
+
+// STPが有効なブリッジのタイマーを動かす
+func startStpTimer() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for now := range ticker.C {
+			routerMutex.Lock()
+			for _, br := range bridgeList {
+				if br.stp != nil {
+					stpTick(br, now)
+				}
+			}
+			routerMutex.Unlock()
+		}
+	}()
+}
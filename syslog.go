@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+syslog(RFC 5424)でログをリモートのコレクタに送る
+複数のラボのルータのログを1か所に集められるようにする
+標準出力に書いたログの行を取り込んで(logbuffer.go)、1行を1つのメッセージにする
+ルータのパケットの処理とは関係ないので、OSのソケットでUDPかTCPで送る
+  udp://192.168.0.2:514  1行を1つのデータグラムで送る
+  tcp://192.168.0.2:514  RFC 6587のoctet-countingで区切って送る、切れたら次のメッセージでつなぎ直す
+https://www.rfc-editor.org/rfc/rfc5424
+https://www.rfc-editor.org/rfc/rfc6587
+*/
+
+const SYSLOG_DEFAULT_PORT = "514"
+
+const SYSLOG_APP_NAME = "go-curo"
+
+// 送信を待つメッセージの数、溢れたら捨てる
+const SYSLOG_QUEUE_SIZE = 1024
+
+const SYSLOG_DIAL_TIMEOUT = 2 * time.Second
+
+// 重要度
+const (
+	SYSLOG_SEVERITY_ERR     = 3
+	SYSLOG_SEVERITY_WARNING = 4
+	SYSLOG_SEVERITY_NOTICE  = 5
+	SYSLOG_SEVERITY_INFO    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern":   0,
+	"user":   1,
+	"daemon": 3,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+/*
+ログの行から重要度を決める
+ログに重要度はついていないので、行に含まれる言葉で分ける、最初に一致したものを使う
+*/
+var syslogSeverityKeywords = []struct {
+	keyword  string
+	severity int
+}{
+	{" err", SYSLOG_SEVERITY_ERR},
+	{"error", SYSLOG_SEVERITY_ERR},
+	{"failed", SYSLOG_SEVERITY_WARNING},
+	{"spoofing", SYSLOG_SEVERITY_WARNING},
+	{"is full", SYSLOG_SEVERITY_WARNING},
+	{"Drop", SYSLOG_SEVERITY_NOTICE},
+	{"changed", SYSLOG_SEVERITY_NOTICE},
+}
+
+// syslogの設定
+type syslogConfig struct {
+	server   string // udp://host:portかtcp://host:port、空なら送らない
+	facility string
+	rate     int // 1秒あたりに送るメッセージの数、0なら制限しない
+}
+
+type syslogSink struct {
+	config   syslogConfig
+	network  string
+	addr     string
+	facility int
+	hostname string
+	queue    chan []byte
+	done     chan struct{}
+	sequence uint64
+	// レート制限、windowStartからの1秒間に送った数と捨てた数
+	windowStart time.Time
+	sent        int
+	suppressed  int
+}
+
+// ログを取り込むgoroutineとルータのgoroutineの両方から触るので、routerMutexとは別に排他する
+var syslogMutex sync.Mutex
+var syslogState *syslogSink
+
+// コマンドラインで指定された設定
+var syslogFlagConfig = syslogConfig{facility: "local0"}
+
+// "udp://host:port"、"tcp://host"、"host:port"を読む
+func parseSyslogServer(s string) (string, string, error) {
+	network := "udp"
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid syslog server %s", s)
+		}
+		network, s = u.Scheme, u.Host
+	}
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("unknown syslog transport %s", network)
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, SYSLOG_DEFAULT_PORT)
+	}
+	host, _, _ := net.SplitHostPort(s)
+	if host == "" {
+		return "", "", fmt.Errorf("syslog server host is empty")
+	}
+	return network, s, nil
+}
+
+// 設定を検証する
+func (config syslogConfig) validate() error {
+	if config.server != "" {
+		if _, _, err := parseSyslogServer(config.server); err != nil {
+			return err
+		}
+	}
+	if _, ok := syslogFacilities[config.facility]; !ok {
+		return fmt.Errorf("unknown syslog facility %s", config.facility)
+	}
+	if config.rate < 0 {
+		return fmt.Errorf("invalid syslog rate %d", config.rate)
+	}
+	return nil
+}
+
+/*
+syslogの送信先を設定する
+送信先が変わったら今までの送信を止めて新しく始める
+ログを標準出力から取り込むので、取り込んでいなければ始める
+*/
+func setSyslog(config syslogConfig) {
+	syslogMutex.Lock()
+	old := syslogState
+	if old != nil && old.config == config {
+		syslogMutex.Unlock()
+		return
+	}
+	syslogState = nil
+	var sink *syslogSink
+	if config.server != "" {
+		network, addr, _ := parseSyslogServer(config.server)
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "go-curo"
+		}
+		sink = &syslogSink{
+			config:   config,
+			network:  network,
+			addr:     addr,
+			facility: syslogFacilities[config.facility],
+			hostname: hostname,
+			queue:    make(chan []byte, SYSLOG_QUEUE_SIZE),
+			done:     make(chan struct{}),
+		}
+		go sink.run()
+		syslogState = sink
+	}
+	syslogMutex.Unlock()
+
+	// 今までの送信先には溜まっている分を送ってから閉じる
+	if old != nil {
+		close(old.queue)
+		<-old.done
+	}
+	if sink == nil {
+		if old != nil {
+			fmt.Println("Syslog is stopped")
+		}
+		return
+	}
+	if logCaptureStop == nil {
+		if err := startLogCapture(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	fmt.Printf("Syslog is sent to %s://%s (facility %s)\n", sink.network, sink.addr, config.facility)
+}
+
+// 終了する時に溜まっているメッセージを送り切る
+func stopSyslog() {
+	syslogMutex.Lock()
+	sink := syslogState
+	syslogState = nil
+	syslogMutex.Unlock()
+	if sink != nil {
+		close(sink.queue)
+		<-sink.done
+	}
+}
+
+/*
+ログの1行をsyslogのメッセージにしてキューに入れる
+レートを超えた分は捨てて、次に送れる時に捨てた数を知らせる
+*/
+func syslogOutput(t time.Time, text string) {
+	syslogMutex.Lock()
+	defer syslogMutex.Unlock()
+	sink := syslogState
+	if sink == nil {
+		return
+	}
+	if sink.config.rate != 0 {
+		if t.Sub(sink.windowStart) >= time.Second {
+			sink.windowStart = t
+			sink.sent = 0
+		}
+		if sink.sent >= sink.config.rate {
+			sink.suppressed++
+			return
+		}
+		sink.sent++
+		if sink.suppressed != 0 {
+			sink.enqueue(t, SYSLOG_SEVERITY_WARNING, fmt.Sprintf("%d messages are suppressed by rate limit", sink.suppressed))
+			sink.suppressed = 0
+		}
+	}
+	sink.enqueue(t, syslogSeverity(text), text)
+}
+
+func syslogSeverity(text string) int {
+	for _, rule := range syslogSeverityKeywords {
+		if strings.Contains(text, rule.keyword) {
+			return rule.severity
+		}
+	}
+	return SYSLOG_SEVERITY_INFO
+}
+
+/*
+RFC 5424の形式にする
+<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+STRUCTURED-DATAには送った順番を入れ、UDPで落ちたり順番が入れ替わったりしたことがわかるようにする
+*/
+func (sink *syslogSink) enqueue(t time.Time, severity int, text string) {
+	sink.sequence++
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - [meta sequenceId=\"%d\"] %s",
+		sink.facility*8+severity, t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), sink.hostname,
+		SYSLOG_APP_NAME, os.Getpid(), sink.sequence, text)
+	select {
+	case sink.queue <- []byte(msg):
+	default:
+	}
+}
+
+// キューのメッセージを送る、送れなかったメッセージは捨てる
+func (sink *syslogSink) run() {
+	defer close(sink.done)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for msg := range sink.queue {
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout(sink.network, sink.addr, SYSLOG_DIAL_TIMEOUT)
+			if err != nil {
+				conn = nil
+				continue
+			}
+		}
+		if sink.network == "tcp" {
+			msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+		}
+		if _, err := conn.Write(msg); err != nil && sink.network == "tcp" {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
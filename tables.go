@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+/*
+ARPテーブルとルートテーブルのJSONでの書き出しと読み込み
+不具合の報告や実験の状態を再現するために、動いているルータの表をファイルに書き出して、
+次の起動や別のルータで読み込む
+  -dump-tables   停止する時にファイルに書き出す
+  -load-tables   起動した時にファイルから読み込む
+  GET  /tables   管理APIで今の表を返す、curl -oでそのままファイルにできる
+  POST /tables   管理APIで書き出した表を読み込む
+項目の形式は管理APIの/arpと/routesと同じ
+ウォームリスタート(-state-file)と違ってファイルの古さは見ない
+ARPのエントリは静的なものは静的なエントリ、学習したものは学習したエントリとして入れる
+経路は直接接続とIPsecの経路はインターフェイスとトンネルの設定から作られるので読み込まず、
+それ以外はネクストホップ、タイプ、ディスタンス、メトリックをそのままに静的経路として入れる
+*/
+
+type tablesJSON struct {
+	Arp    []arpJSON   `json:"arp"`
+	Routes []routeJSON `json:"routes"`
+}
+
+var dumpTablesFile string
+var loadTablesFile string
+
+// 今のARPテーブルとFIBの経路を集める
+func dumpTables() tablesJSON {
+	tables := tablesJSON{Arp: []arpJSON{}, Routes: []routeJSON{}}
+	for _, static := range staticArpEntries {
+		tables.Arp = append(tables.Arp, arpJSON{
+			IPAddress:  printIPAddr(static.ipAddr),
+			MacAddress: hardwareAddr(static.macAddr).String(),
+			Device:     static.ifname,
+			Static:     true,
+		})
+	}
+	for _, entry := range ArpTableEntryList {
+		if entry.netdev == nil {
+			continue
+		}
+		tables.Arp = append(tables.Arp, arpJSON{
+			IPAddress:  printIPAddr(entry.ipAddr),
+			MacAddress: hardwareAddr(entry.macAddr).String(),
+			Device:     entry.netdev.name,
+		})
+	}
+	iproute.radixTreeWalk(func(prefix, prefixLen uint32, entry ipRouteEntry) {
+		tables.Routes = append(tables.Routes, newRouteJSON(newRouteInfo(prefix, prefixLen, entry, true)))
+	})
+	return tables
+}
+
+func writeTablesFile(path string) error {
+	tables := dumpTables()
+	b, err := json.MarshalIndent(tables, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal tables err : %s", err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("write tables file err : %s", err)
+	}
+	fmt.Printf("Dumped %d arp entries and %d routes to %s\n", len(tables.Arp), len(tables.Routes), path)
+	return nil
+}
+
+func readTablesFile(path string) (tablesJSON, error) {
+	var tables tablesJSON
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return tables, fmt.Errorf("read tables file err : %s", err)
+	}
+	if err := json.Unmarshal(b, &tables); err != nil {
+		return tables, fmt.Errorf("parse tables file %s err : %s", path, err)
+	}
+	return tables, nil
+}
+
+type importedRoute struct {
+	prefix, prefixLen uint32
+	iptype            ipRouteType
+	nexthop           uint32
+	distance          uint8
+	metric            uint32
+}
+
+/*
+書き出した表を読み込み、読み込んだARPのエントリと経路の数を返す
+形式が壊れた項目があれば何も入れずにエラーを返し、今のインターフェイスに合わない項目は読み飛ばす
+*/
+func importTables(tables tablesJSON) (int, int, error) {
+	var statics []staticArpEntry
+	var learned []arpTableEntry
+	for _, entry := range tables.Arp {
+		arp, err := newStaticArpEntry(entry.Device, entry.IPAddress, entry.MacAddress)
+		if err != nil {
+			return 0, 0, err
+		}
+		netdev := searchNetDeviceByName(entry.Device)
+		if netdev == nil || !netdev.ipDev.inSubnet(arp.ipAddr) {
+			fmt.Printf("Skip arp entry %s on %s, no such interface or subnet\n", entry.IPAddress, entry.Device)
+			continue
+		}
+		if entry.Static {
+			statics = append(statics, arp)
+		} else {
+			learned = append(learned, arpTableEntry{ipAddr: arp.ipAddr, macAddr: arp.macAddr, netdev: netdev})
+		}
+	}
+	var routes []importedRoute
+	for _, route := range tables.Routes {
+		if route.Type == connected.String() || route.Type == ipsec.String() {
+			continue
+		}
+		prefix, prefixLen, err := parsePrefix(route.Prefix)
+		if err != nil {
+			return 0, 0, err
+		}
+		iptype, err := parseStaticRouteType(route.Type)
+		if err != nil {
+			return 0, 0, err
+		}
+		var nexthop uint32
+		if iptype == network {
+			nexthop, err = parseIPAddr(route.Nexthop)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		routes = append(routes, importedRoute{prefix, prefixLen, iptype, nexthop, route.Distance, route.Metric})
+	}
+
+	// 同じアドレスの静的なエントリは読み込んだものに置き換える
+	if 0 < len(statics) {
+		imported := map[uint32]bool{}
+		for _, entry := range statics {
+			imported[entry.ipAddr] = true
+		}
+		merged := append([]staticArpEntry{}, statics...)
+		for _, entry := range staticArpEntries {
+			if !imported[entry.ipAddr] {
+				merged = append(merged, entry)
+			}
+		}
+		setStaticArpEntries(merged)
+	}
+	arpCount := len(statics)
+	for _, entry := range learned {
+		if addArpTableEntry(entry.netdev, entry.ipAddr, entry.macAddr) {
+			arpCount++
+		}
+	}
+	for _, route := range routes {
+		addStaticRoute(route.prefix, route.prefixLen, route.iptype, route.nexthop, route.distance, route.metric)
+	}
+	fmt.Printf("Imported %d arp entries and %d routes\n", arpCount, len(routes))
+	return arpCount, len(routes), nil
+}
+
+// ファイルから表を読み込む
+func loadTables(path string) error {
+	tables, err := readTablesFile(path)
+	if err != nil {
+		return err
+	}
+	_, _, err = importTables(tables)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+/*
+パケットのトレース(debug packet)
+条件に一致した受信パケットだけ、ルータがどう処理したかを1段階ずつログに出す
+  イーサネットで受け取った理由、IPヘッダ、NAT、自分宛てかフォワードか、選んだ経路、
+  ARPの状態、出力インターフェイス、破棄した理由
+-debugは全てのパケットのログを出すので、本番のルータで特定の通信だけ追いたい時に使う
+トレースするかは受信した時に1度だけ判定し、同じパケットの処理中はprocessingPacket.tracedで引き継ぐ
+*/
+
+type packetTraceMatch struct {
+	srcPrefix    uint32
+	srcPrefixLen uint32
+	dstPrefix    uint32
+	dstPrefixLen uint32
+	protocol     uint8  // 0なら全てのプロトコル
+	device       string // 空なら全てのインターフェイス
+	maxTTL       uint8  // 0でなければTTLがこの値以下のパケットだけ、ループやtracerouteを追う時に使う
+}
+
+// トレースの条件、nilならトレースしない
+var packetTrace *packetTraceMatch
+
+func (m *packetTraceMatch) match(device string, ipheader *ipHeader) bool {
+	if m == nil {
+		return false
+	}
+	if m.device != "" && m.device != device {
+		return false
+	}
+	if m.protocol != 0 && m.protocol != ipheader.protocol {
+		return false
+	}
+	if m.maxTTL != 0 && m.maxTTL < ipheader.ttl {
+		return false
+	}
+	return prefixContains(m.srcPrefix, m.srcPrefixLen, ipheader.srcAddr) &&
+		prefixContains(m.dstPrefix, m.dstPrefixLen, ipheader.destAddr)
+}
+
+func (m *packetTraceMatch) String() string {
+	if m == nil {
+		return "off"
+	}
+	s := fmt.Sprintf("src=%s,dst=%s", routePrefix(m.srcPrefix, m.srcPrefixLen), routePrefix(m.dstPrefix, m.dstPrefixLen))
+	if m.protocol != 0 {
+		s += ",proto=" + ipProtocolName(m.protocol)
+	}
+	if m.device != "" {
+		s += ",dev=" + m.device
+	}
+	if m.maxTTL != 0 {
+		s += fmt.Sprintf(",ttl=%d", m.maxTTL)
+	}
+	return s
+}
+
+/*
+トレースの条件を作る
+無効なプレフィックスは全てのアドレスに一致させる
+*/
+func newPacketTraceMatch(src, dst netip.Prefix, protocol uint8, device string, maxTTL uint8) *packetTraceMatch {
+	m := &packetTraceMatch{protocol: protocol, device: device, maxTTL: maxTTL}
+	if src.IsValid() {
+		m.srcPrefix, m.srcPrefixLen = prefixRoute(src.Masked())
+	}
+	if dst.IsValid() {
+		m.dstPrefix, m.dstPrefixLen = prefixRoute(dst.Masked())
+	}
+	return m
+}
+
+/*
+-debug-packetの値を読む
+例: src=192.168.1.0/24,dst=192.168.0.2/32,proto=icmp,dev=router1-host1,ttl=2
+protoはicmp、tcp、udpかプロトコル番号、指定しなかった条件は全てに一致する
+*/
+func parsePacketTraceMatch(s string) (*packetTraceMatch, error) {
+	var src, dst netip.Prefix
+	var protocol uint8
+	var device string
+	var maxTTL uint8
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid debug packet match %s", field)
+		}
+		var err error
+		switch key {
+		case "src":
+			src, err = parseIPv4Prefix(value)
+		case "dst":
+			dst, err = parseIPv4Prefix(value)
+		case "proto":
+			protocol, err = parseTraceProtocol(value)
+		case "dev":
+			device = value
+		case "ttl":
+			var ttl uint64
+			ttl, err = strconv.ParseUint(value, 10, 8)
+			maxTTL = uint8(ttl)
+		default:
+			err = fmt.Errorf("unknown debug packet match %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newPacketTraceMatch(src, dst, protocol, device, maxTTL), nil
+}
+
+// ACLと同じプロトコル名か、プロトコル番号を読む
+func parseTraceProtocol(s string) (uint8, error) {
+	if protocol, err := strconv.ParseUint(s, 10, 8); err == nil {
+		return uint8(protocol), nil
+	}
+	return parseACLProtocol(s)
+}
+
+// 処理中のパケットがトレースの対象なら、パケットの番号をつけてログに出す
+func tracef(format string, a ...any) {
+	if !processingPacket.traced {
+		return
+	}
+	fmt.Printf("Trace #%d %s\n", processingPacket.id, fmt.Sprintf(format, a...))
+}
+
+// 受信したフレームを自分で受け取った理由
+func traceEthernetReason(netdev *netDevice, destAddr [6]uint8) string {
+	switch {
+	case netdev.pppoe != nil:
+		return "pppoe session"
+	case destAddr == netdev.macAddr:
+		return "our mac"
+	case destAddr == ETHERNET_ADDRESS_BROADCAST:
+		return "broadcast"
+	case netdev.macFilter[destAddr]:
+		return "mac filter"
+	case isVrrpMacAddr(destAddr):
+		return "vrrp virtual mac"
+	}
+	return "multicast"
+}
+
+// 経路を1行で表す
+func traceRouteString(route ipRouteEntry) string {
+	s := route.iptype.String()
+	switch route.iptype {
+	case network:
+		s += " via " + printIPAddr(route.nexthop)
+	case connected:
+		s += " dev " + route.netdev.name
+	case ipsec:
+		s += " peer " + printIPAddr(route.tunnel.config.peer)
+	}
+	return fmt.Sprintf("%s (source %s, distance %d, metric %d)", s, route.source, route.distance, route.metric)
+}
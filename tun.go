@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const TUN_DEVICE_PATH = "/dev/net/tun"
+
+// ioctlで使うifreq構造体
+// https://man7.org/linux/man-pages/man7/netdevice.7.html
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+/*
+tapデバイスの設定
+"tap0=192.168.1.1/24"のような形式で、デバイス名とルータ側に設定するIPアドレスを指定する
+"tap0=192.168.1.1/24+192.168.3.1/24"のように+でつなぐと2つ目以降はセカンダリのアドレスになる
+*/
+type tapDeviceConfig struct {
+	name  string
+	ipdev ipDevice
+}
+
+// カンマ区切りのtapデバイスの設定をパースする
+func parseTapDeviceConfig(spec string) ([]tapDeviceConfig, error) {
+	var configs []tapDeviceConfig
+	for _, v := range strings.Split(spec, ",") {
+		if v == "" {
+			continue
+		}
+		name, ipaddr, found := strings.Cut(v, "=")
+		if !found || name == "" || ipaddr == "" {
+			return nil, fmt.Errorf("invalid tap device config %q, format is name=address/prefix[+address/prefix]", v)
+		}
+		ipdev, err := parseIPDevice(ipaddr)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, tapDeviceConfig{
+			name:  name,
+			ipdev: ipdev,
+		})
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no tap device is specified")
+	}
+	return configs, nil
+}
+
+/*
+tapデバイスを作成してファイルディスクリプタを返す
+IFF_NO_PIを指定してパケット情報のヘッダを付けずにイーサネットフレームをそのまま読み書きする
+*/
+func openTapDevice(name string) (int, error) {
+	fd, err := syscall.Open(TUN_DEVICE_PATH, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open %s err : %s", TUN_DEVICE_PATH, err)
+	}
+	var ifr ifreqFlags
+	copy(ifr.name[:], name)
+	ifr.flags = syscall.IFF_TAP | syscall.IFF_NO_PI
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("ioctl TUNSETIFF to %s err : %s", name, errno)
+	}
+	// カーネル側のインターフェイスをupにする
+	err = setInterfaceUp(name)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// SIOCSIFFLAGSでインターフェイスにIFF_UPを立てる
+func setInterfaceUp(name string) error {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("create socket err : %s", err)
+	}
+	defer syscall.Close(sock)
+
+	var ifr ifreqFlags
+	copy(ifr.name[:], name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("ioctl SIOCGIFFLAGS to %s err : %s", name, errno)
+	}
+	ifr.flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("ioctl SIOCSIFFLAGS to %s err : %s", name, errno)
+	}
+	return nil
+}
+
+/*
+ルータ側のMACアドレスを生成する
+カーネル側のtapインターフェイスとは別の端点になるので、ローカル管理アドレスをランダムに割り当てる
+*/
+func generateMacAddr() ([6]uint8, error) {
+	var macaddr [6]uint8
+	_, err := rand.Read(macaddr[:])
+	if err != nil {
+		return macaddr, err
+	}
+	// ユニキャストかつローカル管理のビットを立てる
+	macaddr[0] = macaddr[0]&0xfe | 0x02
+	return macaddr, nil
+}
+
+// tapデバイスを開いてnetDevice構造体を作成する
+func newTapNetDevice(config tapDeviceConfig) (*netDevice, error) {
+	if len(config.name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("tap device name %s is too long", config.name)
+	}
+	fd, err := openTapDevice(config.name)
+	if err != nil {
+		return nil, err
+	}
+	macaddr, err := generateMacAddr()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("generate mac address err : %s", err)
+	}
+	return &netDevice{
+		name:    config.name,
+		macAddr: macaddr,
+		socket:  fd,
+		backend: tapDevice,
+		ipDev:   config.ipdev,
+	}, nil
+}
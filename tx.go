@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+送信のバッチ処理
+受信したパケットを処理している間に送るフレームはデバイスごとの送信キューに溜めておき、
+epollで受け取ったイベントを全て処理した後にsendmmsgでまとめて送る、システムコールの回数が減るのでフォワーディングが速くなる
+フレームはコピーせずにそのまま溜める、ethernetOutputは送るたびにバッファを作り、ブリッジは受信のバッファをコピーしてから送るので後から書き換えられることはない
+socketのバッファが一杯で送れなかったフレームはキューに残して少し待ってから送り直し、キューが溢れたら破棄する
+それ以外のエラーで送れなかったフレームは破棄して数える
+*/
+
+// 1回のsendmmsgで送るフレームの数
+const TX_BATCH_SIZE = 64
+
+// 送信を待つフレームの上限、超えたら破棄する
+const TX_PENDING_MAX = 1024
+
+// socketのバッファが空くのを待つ時間
+const TX_RETRY_WAIT = time.Millisecond
+
+// 受信したパケットを処理している間はtrueにして、送信をキューに溜める
+var txBatching bool
+
+// sendmmsgに渡す構造体、カーネルが送った長さをlenに入れる
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// フレームを送信キューに入れる、バッチ処理中でなければすぐに送る
+func (netDev *netDevice) txEnqueue(data []byte) {
+	if len(netDev.txPending) >= TX_PENDING_MAX {
+		netDev.stats.txQueueDrops++
+		countDrop(DROP_REASON_TX_QUEUE_FULL)
+		return
+	}
+	netDev.txPending = append(netDev.txPending, data)
+	if !txBatching || len(netDev.txPending) >= TX_BATCH_SIZE {
+		netDev.txFlush()
+	}
+}
+
+/*
+送信キューのフレームをsendmmsgで送る
+socketのバッファが一杯ならキューに残してfalseを返す
+*/
+func (netDev *netDevice) txFlush() bool {
+	for len(netDev.txPending) != 0 {
+		batch := netDev.txPending
+		if len(batch) > TX_BATCH_SIZE {
+			batch = batch[:TX_BATCH_SIZE]
+		}
+		n, err := sendmmsg(netDev.socket, batch)
+		for _, frame := range batch[:n] {
+			netDev.stats.txPackets++
+			netDev.stats.txBytes += uint64(len(frame))
+		}
+		netDev.txPop(n)
+		if err == unix.EAGAIN || err == unix.ENOBUFS {
+			return false
+		}
+		if err != nil && err != unix.EINTR {
+			// 先頭のフレームが送れなかったので破棄して、残りを送り直す
+			netDev.txError(err)
+			netDev.txPop(1)
+		}
+	}
+	return true
+}
+
+// 送信キューの先頭からn個のフレームを取り除く
+func (netDev *netDevice) txPop(n int) {
+	for i := 0; i < n; i++ {
+		netDev.txPending[i] = nil
+	}
+	netDev.txPending = netDev.txPending[n:]
+	if len(netDev.txPending) == 0 {
+		netDev.txPending = nil
+	}
+}
+
+// 送信に失敗したフレームを数える、ルータは止めない
+func (netDev *netDevice) txError(err error) error {
+	netDev.stats.txErrors++
+	countDrop(DROP_REASON_TX_ERROR)
+	debugPrintf("transmit to %s err : %s\n", netDev.name, err)
+	return fmt.Errorf("transmit to %s err : %w", netDev.name, err)
+}
+
+/*
+全てのデバイスの送信キューを送る
+送れずに残ったフレームがあれば、送り直すまでの時間を返す、無ければ-1を返す
+*/
+func flushTxQueues() time.Duration {
+	wait := time.Duration(-1)
+	for _, netdev := range netDeviceList {
+		if !netdev.txFlush() {
+			wait = TX_RETRY_WAIT
+		}
+		// AF_XDPはtxリングに入れてあるので、カーネルに知らせるだけでよい
+		if netdev.xsk != nil && netdev.xsk.kick && !netdev.xsk.wakeup() {
+			wait = TX_RETRY_WAIT
+		}
+	}
+	return wait
+}
+
+// ブロックせずにsendmmsgで送り、送れたフレームの数を返す
+func sendmmsg(fd int, frames [][]byte) (int, error) {
+	iovs := make([]unix.Iovec, len(frames))
+	msgs := make([]mmsghdr, len(frames))
+	for i, frame := range frames {
+		iovs[i].Base = &frame[0]
+		iovs[i].SetLen(len(frame))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.SetIovlen(1)
+	}
+	r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])),
+		uintptr(len(msgs)), unix.MSG_DONTWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
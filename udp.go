@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+UDP
+ルータ自身宛てのデータグラムを宛先ポートに登録された処理に渡す
+DNSのようにルータ上で動くサービスはudpListenでポートを登録し、udpOutputで送信する
+https://www.rfc-editor.org/rfc/rfc768
+*/
+
+const UDP_HEADER_LEN = 8
+
+// 受信したデータグラムを処理する関数
+type udpHandler func(inputdev *netDevice, ipheader *ipHeader, srcPort uint16, payload []byte)
+
+// 宛先ポートごとの処理
+var udpHandlers = map[uint16]udpHandler{}
+
+func udpListen(port uint16, handler udpHandler) {
+	udpHandlers[port] = handler
+}
+
+func udpClose(port uint16) {
+	delete(udpHandlers, port)
+}
+
+// UDPのチェックサムを疑似ヘッダを含めて計算する
+func udpChecksum(srcAddr, destAddr uint32, udpPacket []byte) []byte {
+	var b []byte
+	b = append(b, uint32ToByte(srcAddr)...)
+	b = append(b, uint32ToByte(destAddr)...)
+	b = append(b, 0x00, IP_PROTOCOL_NUM_UDP)
+	b = append(b, uint16ToByte(uint16(len(udpPacket)))...)
+	return calcChecksum(append(b, udpPacket...))
+}
+
+func init() {
+	registerIPProtocol(IP_PROTOCOL_NUM_UDP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		udpInput(ctx.netdev, ipheader, packet)
+		return nil
+	})
+}
+
+/*
+UDPデータグラムの受信処理
+*/
+func udpInput(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+	if len(packet) < UDP_HEADER_LEN {
+		fmt.Println("Received UDP packet is too short")
+		countDrop(DROP_REASON_UDP_INVALID)
+		return
+	}
+	length := int(byteToUint16(packet[4:6]))
+	if length < UDP_HEADER_LEN || len(packet) < length {
+		countDrop(DROP_REASON_UDP_INVALID)
+		return
+	}
+	packet = packet[:length]
+	// チェックサムが0なら送信元で計算されていない
+	// チェックサムオフロードで計算途中のまま届くインターフェイスでは検証しない
+	if byteToUint16(packet[6:8]) != 0 && inputdev.verifyTransportChecksum() {
+		// 受信したチェックサムを含めて計算すると0になる
+		if checksum := udpChecksum(ipheader.srcAddr, ipheader.destAddr, packet); checksum[0] != 0 || checksum[1] != 0 {
+			debugPrintf("Drop UDP packet with invalid checksum from %s in %s\n", printIPAddr(ipheader.srcAddr), inputdev.name)
+			countDrop(DROP_REASON_UDP_INVALID)
+			return
+		}
+	}
+	srcPort := byteToUint16(packet[0:2])
+	destPort := byteToUint16(packet[2:4])
+
+	handler, ok := udpHandlers[destPort]
+	if !ok {
+		debugPrintf("No UDP listener on port %d from %s\n", destPort, printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_UDP_NO_LISTENER)
+		// UDPのtracerouteは使われていない大きいポートに送り、Port Unreachableが返ってきたら終わる
+		// ブロードキャストやマルチキャスト宛てにはsendIcmpDestinationUnreachableが返さない
+		sendIcmpDestinationUnreachable(ipheader.destAddr, ICMP_DEST_UNREACHABLE_CODE_PORT_UNREACHABLE,
+			append(ipheader.ToPacket(false), packet...))
+		return
+	}
+	handler(inputdev, ipheader, srcPort, packet[UDP_HEADER_LEN:])
+}
+
+/*
+UDPデータグラムを送信する
+srcAddrが0ならipSourceAddrで選ぶ、チェックサムの計算に必要なのでここで決める
+*/
+func udpOutput(srcAddr, destAddr uint32, srcPort, destPort uint16, payload []byte) error {
+	if srcAddr == 0 {
+		srcAddr = ipSourceAddr(destAddr)
+		if srcAddr == 0 {
+			return dropPacket(DROP_REASON_NO_ROUTE)
+		}
+	}
+	packet := uint16ToByte(srcPort)
+	packet = append(packet, uint16ToByte(destPort)...)
+	packet = append(packet, uint16ToByte(uint16(UDP_HEADER_LEN+len(payload)))...)
+	packet = append(packet, 0x00, 0x00)
+	packet = append(packet, payload...)
+	checksum := udpChecksum(srcAddr, destAddr, packet)
+	// 計算結果が0の場合は0xffffにする
+	if checksum[0] == 0 && checksum[1] == 0 {
+		checksum = []byte{0xff, 0xff}
+	}
+	packet[6], packet[7] = checksum[0], checksum[1]
+	return ipPacketEncapsulateOutput(destAddr, srcAddr, packet, IP_PROTOCOL_NUM_UDP)
+}
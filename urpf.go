@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+uRPF(Unicast Reverse Path Forwarding)による送信元アドレスの検証
+受信したパケットの送信元アドレスを宛先としてルートテーブルを検索し、戻りの経路が無いパケットを送信元の偽装として破棄する
+  strict  戻りの経路の出力インターフェイスが受信したインターフェイスと一致しなければ破棄する
+  loose   戻りの経路がどのインターフェイスに向いていてもよく、経路が無いかブラックホールかリジェクトの経路なら破棄する
+デフォルト経路も戻りの経路として扱うので、デフォルト経路があるとlooseでは全て通る(Linuxのrp_filterと同じ)
+送信元が0.0.0.0のパケット(DHCPのDiscoverなど)は検証しない
+-urpfや設定ファイルの"urpf"でインターフェイスごとに指定し、破棄したパケットはインターフェイスの統計情報で数える
+*/
+
+type urpfMode uint8
+
+const (
+	urpfOff urpfMode = iota
+	urpfStrict
+	urpfLoose
+)
+
+// コマンドラインで指定されたインターフェイスごとのuRPFのモード
+var urpfFlags = map[string]urpfMode{}
+
+func parseUrpfMode(s string) (urpfMode, error) {
+	switch s {
+	case "", "off":
+		return urpfOff, nil
+	case "strict":
+		return urpfStrict, nil
+	case "loose":
+		return urpfLoose, nil
+	}
+	return urpfOff, fmt.Errorf("unknown urpf mode %s", s)
+}
+
+func (mode urpfMode) String() string {
+	switch mode {
+	case urpfStrict:
+		return "strict"
+	case urpfLoose:
+		return "loose"
+	}
+	return "off"
+}
+
+// "eth1=strict"を読む
+func parseUrpfConfig(s string) (string, urpfMode, error) {
+	name, mode, found := strings.Cut(s, "=")
+	if !found || name == "" {
+		return "", urpfOff, fmt.Errorf("invalid urpf %q, format is ifname=strict or ifname=loose", s)
+	}
+	m, err := parseUrpfMode(mode)
+	if err != nil {
+		return "", urpfOff, err
+	}
+	return name, m, nil
+}
+
+// 送信元アドレスへの戻りの経路があるか
+func urpfPermitted(inputdev *netDevice, srcAddr uint32) bool {
+	if inputdev.urpf == urpfOff || srcAddr == 0 {
+		return true
+	}
+	route, ok := iproute.radixTreeSearch(srcAddr)
+	if !ok || route.iptype == blackhole || route.iptype == reject {
+		return false
+	}
+	if inputdev.urpf == urpfLoose {
+		return true
+	}
+	return routeOutputDevice(route) == inputdev
+}
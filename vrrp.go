@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+VRRPv2
+同じLANにつないだ複数のルータで1つの仮想ルータを作り、ホストのデフォルトゲートウェイを冗長化する
+優先度の一番高いルータがマスターになり、仮想IPアドレスのARPに仮想MACアドレスで答えてパケットを受け取る
+マスターが定期的に送るアドバタイズメントが途絶えると、バックアップのルータがマスターを引き継ぐ
+https://www.rfc-editor.org/rfc/rfc3768
+*/
+
+const IP_PROTOCOL_NUM_VRRP uint8 = 112
+
+const IP_ADDRESS_VRRP uint32 = 0xe0000012 // 224.0.0.18
+
+const VRRP_VERSION uint8 = 2
+const VRRP_TYPE_ADVERTISEMENT uint8 = 1
+
+// アドバタイズメントはTTLを255で送り、255でなければルータを越えてきたので破棄する
+const VRRP_TTL uint8 = 255
+
+const VRRP_HEADER_LEN = 8
+const VRRP_AUTH_DATA_LEN = 8
+
+const (
+	VRRP_PRIORITY_SHUTDOWN uint8 = 0   // マスターをやめる時に送り、バックアップにすぐ引き継がせる
+	VRRP_PRIORITY_DEFAULT  uint8 = 100 // バックアップの優先度の既定値
+	VRRP_PRIORITY_OWNER    uint8 = 255 // 仮想IPアドレスをインターフェイスに持っているルータ
+)
+
+const VRRP_DEFAULT_ADVERT_INTERVAL = 1 * time.Second
+
+type vrrpState uint8
+
+const (
+	vrrpStateInit   vrrpState = iota // インターフェイスが無いかアドレスがついていない
+	vrrpStateBackup                  // マスターのアドバタイズメントを待っている
+	vrrpStateMaster                  // 仮想IPアドレスと仮想MACアドレスを持っている
+)
+
+func (state vrrpState) String() string {
+	switch state {
+	case vrrpStateBackup:
+		return "backup"
+	case vrrpStateMaster:
+		return "master"
+	}
+	return "init"
+}
+
+type vrrpConfig struct {
+	ifname         string
+	vrid           uint8
+	address        uint32 // 仮想IPアドレス
+	priority       uint8
+	advertInterval time.Duration
+}
+
+type vrrpRouter struct {
+	config   vrrpConfig
+	netdev   *netDevice
+	priority uint8 // 仮想IPアドレスがインターフェイスのアドレスなら255
+	state    vrrpState
+	// マスターのアドレスと、アドバタイズメントが途絶えたとみなす時刻
+	masterAddr   uint32
+	masterDownAt time.Time
+	nextAdvert   time.Time
+}
+
+var vrrpRouters []*vrrpRouter
+
+// コマンドラインで指定された仮想ルータ
+var vrrpConfigs []vrrpConfig
+
+/*
+"eth1=1/192.168.1.254"か"eth1=1/192.168.1.254/200"の形式の仮想ルータを読む
+インターフェイス名=VRID/仮想IPアドレス/優先度
+*/
+func parseVrrpConfig(spec string) (vrrpConfig, error) {
+	ifname, rest, found := strings.Cut(spec, "=")
+	fields := strings.Split(rest, "/")
+	if !found || ifname == "" || len(fields) < 2 || len(fields) > 3 {
+		return vrrpConfig{}, fmt.Errorf("invalid vrrp config %q, format is name=vrid/address[/priority]", spec)
+	}
+	vrid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return vrrpConfig{}, fmt.Errorf("invalid vrid %q", fields[0])
+	}
+	address, err := parseIPAddr(fields[1])
+	if err != nil {
+		return vrrpConfig{}, err
+	}
+	priority := int(VRRP_PRIORITY_DEFAULT)
+	if len(fields) == 3 {
+		priority, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return vrrpConfig{}, fmt.Errorf("invalid vrrp priority %q", fields[2])
+		}
+	}
+	return newVrrpConfig(ifname, vrid, address, priority, VRRP_DEFAULT_ADVERT_INTERVAL)
+}
+
+// 値の範囲を確認して仮想ルータの設定を作る
+func newVrrpConfig(ifname string, vrid int, address uint32, priority int, advertInterval time.Duration) (vrrpConfig, error) {
+	if vrid < 1 || vrid > 255 {
+		return vrrpConfig{}, fmt.Errorf("vrid %d must be 1-255", vrid)
+	}
+	// 255はアドレスの持ち主、0は停止の通知に使うので指定できない
+	if priority < 1 || priority > 254 {
+		return vrrpConfig{}, fmt.Errorf("vrrp priority %d must be 1-254", priority)
+	}
+	if advertInterval < time.Second || advertInterval > 255*time.Second || advertInterval%time.Second != 0 {
+		return vrrpConfig{}, fmt.Errorf("vrrp advertisement interval %s must be 1-255 seconds", advertInterval)
+	}
+	return vrrpConfig{
+		ifname:         ifname,
+		vrid:           uint8(vrid),
+		address:        address,
+		priority:       uint8(priority),
+		advertInterval: advertInterval,
+	}, nil
+}
+
+// 00:00:5e:00:01:{VRID}
+func vrrpMacAddr(vrid uint8) [6]uint8 {
+	return [6]uint8{0x00, 0x00, 0x5e, 0x00, 0x01, vrid}
+}
+
+func isVrrpMacAddr(macaddr [6]uint8) bool {
+	return macaddr[0] == 0x00 && macaddr[1] == 0x00 && macaddr[2] == 0x5e && macaddr[3] == 0x00 && macaddr[4] == 0x01
+}
+
+// インターフェイスで仮想IPアドレスを持っているマスターの仮想ルータ
+func searchVrrpMaster(netdev *netDevice, addr uint32) *vrrpRouter {
+	for _, vr := range vrrpRouters {
+		if vr.netdev == netdev && vr.state == vrrpStateMaster && vr.config.address == addr {
+			return vr
+		}
+	}
+	return nil
+}
+
+// マスターのアドバタイズメントを待つ時間は優先度の高いルータほど短くする
+func (vr *vrrpRouter) skewTime() time.Duration {
+	return time.Duration(256-int(vr.priority)) * time.Second / 256
+}
+
+func (vr *vrrpRouter) masterDownInterval() time.Duration {
+	return 3*vr.config.advertInterval + vr.skewTime()
+}
+
+/*
+仮想ルータを設定する
+同じインターフェイスとVRIDの仮想ルータは状態を引き継ぐ
+*/
+func setVrrpRouters(configs []vrrpConfig) {
+	var routers []*vrrpRouter
+	for _, config := range configs {
+		var vr *vrrpRouter
+		for _, old := range vrrpRouters {
+			if old.config.ifname == config.ifname && old.config.vrid == config.vrid && old.config.address == config.address {
+				vr = old
+				break
+			}
+		}
+		if vr == nil {
+			vr = &vrrpRouter{}
+			fmt.Printf("VRRP %d on %s for %s is added\n", config.vrid, config.ifname, printIPAddr(config.address))
+		} else if vr.priority != VRRP_PRIORITY_OWNER {
+			vr.priority = config.priority
+		}
+		vr.config = config
+		routers = append(routers, vr)
+	}
+
+	old := vrrpRouters
+	vrrpRouters = routers
+	for _, vr := range old {
+		if !containsVrrpRouter(routers, vr) {
+			vrrpStop(vr)
+			fmt.Printf("VRRP %d on %s is deleted\n", vr.config.vrid, vr.config.ifname)
+		}
+	}
+}
+
+func containsVrrpRouter(routers []*vrrpRouter, vr *vrrpRouter) bool {
+	for _, r := range routers {
+		if r == vr {
+			return true
+		}
+	}
+	return false
+}
+
+// インターフェイスにアドレスがついていれば仮想ルータを動かし始める
+func vrrpStart(vr *vrrpRouter, now time.Time) {
+	netdev := searchNetDeviceByName(vr.config.ifname)
+	if netdev == nil || netdev.ipDev.address == 0 {
+		return
+	}
+	vr.netdev = netdev
+	joinMulticastGroup(netdev, IP_ADDRESS_VRRP)
+	vr.priority = vr.config.priority
+	if netdev.ipDev.address == vr.config.address {
+		vr.priority = VRRP_PRIORITY_OWNER
+		vrrpBecomeMaster(vr, now)
+		return
+	}
+	vrrpBecomeBackup(vr, 0, now)
+}
+
+// 仮想ルータを止める、マスターならバックアップにすぐ引き継がせる
+func vrrpStop(vr *vrrpRouter) {
+	if vr.netdev == nil {
+		return
+	}
+	if vr.state == vrrpStateMaster {
+		vrrpOutput(vr, VRRP_PRIORITY_SHUTDOWN)
+	}
+	// 同じインターフェイスで他の仮想ルータが動いていればグループに残る
+	inUse := false
+	for _, other := range vrrpRouters {
+		if other != vr && other.netdev == vr.netdev {
+			inUse = true
+		}
+	}
+	if !inUse {
+		leaveMulticastGroup(vr.netdev, IP_ADDRESS_VRRP)
+	}
+	vr.state = vrrpStateInit
+	updateMacFilter(vr.netdev)
+	vr.netdev = nil
+}
+
+func vrrpBecomeMaster(vr *vrrpRouter, now time.Time) {
+	vr.state = vrrpStateMaster
+	// 仮想MACアドレス宛てのフレームを受け取る
+	updateMacFilter(vr.netdev)
+	vr.masterAddr = vr.netdev.ipDev.address
+	fmt.Printf("VRRP %d on %s became master of %s\n", vr.config.vrid, vr.netdev.name, printIPAddr(vr.config.address))
+	vrrpOutput(vr, vr.priority)
+	vr.nextAdvert = now.Add(vr.config.advertInterval)
+	// スイッチとホストに仮想MACアドレスがこのポートにあることを知らせる
+	sendGratuitousArp(vr.netdev, vrrpMacAddr(vr.config.vrid), vr.config.address)
+}
+
+func vrrpBecomeBackup(vr *vrrpRouter, masterAddr uint32, now time.Time) {
+	if vr.state != vrrpStateBackup {
+		fmt.Printf("VRRP %d on %s became backup of %s\n", vr.config.vrid, vr.netdev.name, printIPAddr(vr.config.address))
+	}
+	wasMaster := vr.state == vrrpStateMaster
+	vr.state = vrrpStateBackup
+	if wasMaster {
+		updateMacFilter(vr.netdev)
+	}
+	vr.masterAddr = masterAddr
+	vr.masterDownAt = now.Add(vr.masterDownInterval())
+}
+
+// アドバタイズメントを作る、認証は使わない
+func vrrpPacket(vr *vrrpRouter, priority uint8) []byte {
+	packet := []byte{
+		VRRP_VERSION<<4 | VRRP_TYPE_ADVERTISEMENT,
+		vr.config.vrid,
+		priority,
+		1, // 仮想IPアドレスの数
+		0, // 認証なし
+		uint8(vr.config.advertInterval / time.Second),
+		0x00, 0x00,
+	}
+	packet = append(packet, uint32ToByte(vr.config.address)...)
+	packet = append(packet, make([]byte, VRRP_AUTH_DATA_LEN)...)
+	checksum := calcChecksum(packet)
+	packet[6], packet[7] = checksum[0], checksum[1]
+	return packet
+}
+
+/*
+アドバタイズメントを送信する
+送信元MACアドレスは仮想MACアドレスにして、スイッチに仮想MACアドレスの場所を学習させる
+*/
+func vrrpOutput(vr *vrrpRouter, priority uint8) {
+	payload := vrrpPacket(vr, priority)
+	ipheader := ipHeader{
+		version:   4,
+		headerLen: 20 / 4,
+		tos:       0xc0, // CS6
+		totalLen:  uint16(20 + len(payload)),
+		ttl:       VRRP_TTL,
+		protocol:  IP_PROTOCOL_NUM_VRRP,
+		srcAddr:   vr.netdev.ipDev.address,
+		destAddr:  IP_ADDRESS_VRRP,
+	}
+	packet := append(ipheader.ToPacket(true), payload...)
+	ethernetOutputFrom(vr.netdev, vrrpMacAddr(vr.config.vrid), multicastMacAddr(IP_ADDRESS_VRRP), packet, ETHER_TYPE_IP)
+}
+
+func init() {
+	registerIPProtocol(IP_PROTOCOL_NUM_VRRP, func(ctx *inputContext, ipheader *ipHeader, packet []byte) error {
+		vrrpInput(ctx.netdev, ipheader, packet)
+		return nil
+	})
+}
+
+/*
+アドバタイズメントの受信処理
+*/
+func vrrpInput(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
+	if ipheader.ttl != VRRP_TTL || len(packet) < VRRP_HEADER_LEN || packet[0] != VRRP_VERSION<<4|VRRP_TYPE_ADVERTISEMENT {
+		countDrop(DROP_REASON_VRRP_INVALID)
+		return
+	}
+	count := int(packet[3])
+	if len(packet) < VRRP_HEADER_LEN+count*IP_ADDRESS_LEN+VRRP_AUTH_DATA_LEN || !verifyChecksum(packet) {
+		countDrop(DROP_REASON_VRRP_INVALID)
+		return
+	}
+	vrid := packet[1]
+	priority := packet[2]
+	var vr *vrrpRouter
+	for _, r := range vrrpRouters {
+		if r.netdev == inputdev && r.config.vrid == vrid {
+			vr = r
+			break
+		}
+	}
+	if vr == nil {
+		debugPrintf("Drop VRRP advertisement of unknown vrid %d from %s\n", vrid, printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_VRRP_INVALID)
+		return
+	}
+	// 間隔が違うと切り替えの判断がずれるので受け取らない
+	if time.Duration(packet[5])*time.Second != vr.config.advertInterval {
+		fmt.Printf("VRRP %d on %s received advertisement interval %ds from %s, mismatched\n",
+			vrid, inputdev.name, packet[5], printIPAddr(ipheader.srcAddr))
+		countDrop(DROP_REASON_VRRP_INVALID)
+		return
+	}
+
+	now := time.Now()
+	switch vr.state {
+	case vrrpStateBackup:
+		if priority == VRRP_PRIORITY_SHUTDOWN {
+			vr.masterDownAt = now.Add(vr.skewTime())
+		} else if priority >= vr.priority {
+			vrrpBecomeBackup(vr, ipheader.srcAddr, now)
+		}
+		// 優先度の低いマスターは無視して、タイマーが切れたら引き継ぐ
+	case vrrpStateMaster:
+		if priority == VRRP_PRIORITY_SHUTDOWN {
+			vrrpOutput(vr, vr.priority)
+			vr.nextAdvert = now.Add(vr.config.advertInterval)
+		} else if priority > vr.priority || (priority == vr.priority && ipheader.srcAddr > inputdev.ipDev.address) {
+			vrrpBecomeBackup(vr, ipheader.srcAddr, now)
+		}
+	}
+}
+
+/*
+マスターのアドバタイズメントの送信と、バックアップのマスターが途絶えたかの確認
+*/
+func vrrpTick(now time.Time) {
+	for _, vr := range vrrpRouters {
+		switch vr.state {
+		case vrrpStateInit:
+			vrrpStart(vr, now)
+		case vrrpStateBackup:
+			if !now.Before(vr.masterDownAt) {
+				vrrpBecomeMaster(vr, now)
+			}
+		case vrrpStateMaster:
+			if !now.Before(vr.nextAdvert) {
+				vrrpOutput(vr, vr.priority)
+				vr.nextAdvert = now.Add(vr.config.advertInterval)
+			}
+		}
+	}
+}
+
+func startVrrpTimer() {
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		for now := range ticker.C {
+			routerMutex.Lock()
+			vrrpTick(now)
+			routerMutex.Unlock()
+		}
+	}()
+}
+
+// インターフェイスが無くなったら、また現れるまで止めておく
+func vrrpDeviceRemoved(netdev *netDevice) {
+	for _, vr := range vrrpRouters {
+		if vr.netdev == netdev {
+			fmt.Printf("VRRP %d on %s is stopped\n", vr.config.vrid, netdev.name)
+			vr.netdev = nil
+			vr.state = vrrpStateInit
+		}
+	}
+}
+
+// ルータを止める時はマスターを手放す
+func vrrpSendShutdown() {
+	for _, vr := range vrrpRouters {
+		if vr.state == vrrpStateMaster {
+			vrrpOutput(vr, VRRP_PRIORITY_SHUTDOWN)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+AF_XDPのバックエンド(実験的)
+-backend xdp
+インターフェイスにXDPのプログラムをつけて、受信したフレームをカーネルのネットワークスタックを通さずにAF_XDPのsocketに渡す
+フレームはUMEMというユーザ空間のメモリに置かれ、カーネルとは4つのリングでUMEMの中の位置をやり取りする
+  fill        受信に使うUMEMのフレームをカーネルに渡す
+  rx          カーネルが受信したフレームを受け取る
+  tx          送信するフレームをカーネルに渡す
+  completion  送信が終わったフレームをカーネルから返してもらう
+ドライバが対応していればゼロコピー、対応していなければコピーモードで動く
+XDPのプログラムはキュー0で受信したフレームをsocketにリダイレクトするだけの小さなもので、BPFの命令を直接書いてロードする
+他のキューで受信したフレームはカーネルに渡るので、マルチキューのNICではethtool -L <dev> combined 1でキューを1つにする
+受信したフレームはpacket socketと同じethernetInputで処理し、処理が終わったらUMEMのフレームをfillリングに戻す
+https://docs.kernel.org/networking/af_xdp.html
+*/
+
+// UMEMの1フレームの大きさとフレームの数、前半を受信に後半を送信に使う
+const XDP_FRAME_SIZE = 2048
+const XDP_FRAME_COUNT = 4096
+
+// 各リングの大きさ、2のべき乗にする
+const XDP_RING_SIZE = XDP_FRAME_COUNT / 2
+
+// XDPのプログラムが使うカーネルの定義
+const (
+	BPF_PSEUDO_MAP_FD      = 1
+	BPF_FUNC_REDIRECT_MAP  = 51
+	XDP_PASS               = 2
+	XDP_MD_RX_QUEUE_OFFSET = 16 // struct xdp_mdのrx_queue_index
+)
+
+// AF_XDPのsocketとUMEM
+type xskSocket struct {
+	fd     int
+	mapFd  int // socketを入れるXSKMAP
+	progFd int
+	linkFd int // XDPのプログラムをインターフェイスにつけたリンク、閉じると外れる
+	umem   []byte
+	fill   xskRing
+	comp   xskRing
+	rx     xskRing
+	tx     xskRing
+	// 送信に使えるUMEMのフレーム
+	freeFrames []uint64
+	zeroCopy   bool
+	// 送信リングに入れたフレームをまだカーネルに知らせていない
+	kick bool
+}
+
+// mmapしたリング、自分が書く側のインデックスは自分しか書き換えないので普通に読む
+type xskRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+// BPFの命令
+type bpfInsn struct {
+	code uint8
+	regs uint8 // 下位4ビットがdst、上位4ビットがsrc
+	off  int16
+	imm  int32
+}
+
+// インターフェイスにAF_XDPのsocketを作り、XDPのプログラムをつけてnetDevice構造体を作成する
+func newXdpNetDevice(netif net.Interface) (*netDevice, error) {
+	xsk, err := openXskSocket(netif.Index)
+	if err != nil {
+		return nil, fmt.Errorf("create xdp socket on %s err : %s", netif.Name, err)
+	}
+	mode := "copy"
+	if xsk.zeroCopy {
+		mode = "zero copy"
+	}
+	fmt.Printf("Created xdp device %s socket %d adddress %s (%s)\n",
+		netif.Name, xsk.fd, netif.HardwareAddr.String(), mode)
+	netaddrs, err := netif.Addrs()
+	if err != nil {
+		xsk.close()
+		return nil, fmt.Errorf("get ip addr from nic interface is err : %s", err)
+	}
+	return &netDevice{
+		name:    netif.Name,
+		macAddr: setMacAddr(netif.HardwareAddr),
+		socket:  xsk.fd,
+		// 送信には使わないが、ifindexでデバイスを探すのに使う
+		sockAddr: syscall.SockaddrLinklayer{Ifindex: netif.Index},
+		ipDev:    getIPdevice(netaddrs),
+		backend:  xdpSocket,
+		xsk:      xsk,
+	}, nil
+}
+
+func openXskSocket(ifindex int) (*xskSocket, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	xsk := &xskSocket{fd: fd, mapFd: -1, progFd: -1, linkFd: -1}
+	if err := xsk.setup(ifindex); err != nil {
+		xsk.close()
+		return nil, err
+	}
+	return xsk, nil
+}
+
+func (xsk *xskSocket) setup(ifindex int) error {
+	// UMEMを登録する
+	var err error
+	xsk.umem, err = unix.Mmap(-1, 0, XDP_FRAME_COUNT*XDP_FRAME_SIZE,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap umem err : %s", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&xsk.umem[0]))),
+		Len:  uint64(len(xsk.umem)),
+		Size: XDP_FRAME_SIZE,
+	}
+	if err := setsockoptPointer(xsk.fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("register umem err : %s", err)
+	}
+
+	// リングを作ってmmapする
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING, unix.XDP_TX_RING} {
+		if err := unix.SetsockoptInt(xsk.fd, unix.SOL_XDP, opt, XDP_RING_SIZE); err != nil {
+			return fmt.Errorf("set xdp ring size err : %s", err)
+		}
+	}
+	var off unix.XDPMmapOffsets
+	offLen := uint32(unsafe.Sizeof(off))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(xsk.fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&offLen)), 0)
+	if errno != 0 {
+		return fmt.Errorf("get xdp mmap offsets err : %s", errno)
+	}
+	rings := []struct {
+		ring     *xskRing
+		pgoff    int64
+		off      unix.XDPRingOffset
+		descSize int
+	}{
+		{&xsk.rx, unix.XDP_PGOFF_RX_RING, off.Rx, int(unsafe.Sizeof(unix.XDPDesc{}))},
+		{&xsk.tx, unix.XDP_PGOFF_TX_RING, off.Tx, int(unsafe.Sizeof(unix.XDPDesc{}))},
+		{&xsk.fill, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, 8},
+		{&xsk.comp, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, 8},
+	}
+	for _, r := range rings {
+		mem, err := unix.Mmap(xsk.fd, r.pgoff, int(r.off.Desc)+XDP_RING_SIZE*r.descSize,
+			unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return fmt.Errorf("mmap xdp ring err : %s", err)
+		}
+		*r.ring = xskRing{
+			mem:      mem,
+			producer: (*uint32)(unsafe.Pointer(&mem[r.off.Producer])),
+			consumer: (*uint32)(unsafe.Pointer(&mem[r.off.Consumer])),
+			descs:    unsafe.Pointer(&mem[r.off.Desc]),
+			mask:     XDP_RING_SIZE - 1,
+		}
+	}
+
+	// 前半のフレームを受信用にカーネルに渡し、後半を送信に使う
+	for i := 0; i < XDP_FRAME_COUNT/2; i++ {
+		xsk.fillFrame(uint64(i * XDP_FRAME_SIZE))
+	}
+	for i := XDP_FRAME_COUNT / 2; i < XDP_FRAME_COUNT; i++ {
+		xsk.freeFrames = append(xsk.freeFrames, uint64(i*XDP_FRAME_SIZE))
+	}
+
+	// キュー0にbindする、ゼロコピーに対応していないドライバではコピーモードにする
+	addr := &unix.SockaddrXDP{Flags: unix.XDP_ZEROCOPY, Ifindex: uint32(ifindex)}
+	if err := unix.Bind(xsk.fd, addr); err == nil {
+		xsk.zeroCopy = true
+	} else {
+		addr.Flags = unix.XDP_COPY
+		if err := unix.Bind(xsk.fd, addr); err != nil {
+			return fmt.Errorf("bind xdp socket err : %s", err)
+		}
+	}
+
+	// socketにリダイレクトするXDPのプログラムをつける
+	if xsk.mapFd, err = bpfCreateXskMap(); err != nil {
+		return fmt.Errorf("create xskmap err : %s", err)
+	}
+	if err := bpfMapUpdate(xsk.mapFd, 0, uint32(xsk.fd)); err != nil {
+		return fmt.Errorf("update xskmap err : %s", err)
+	}
+	if xsk.progFd, err = bpfLoadXdpProgram(xsk.mapFd); err != nil {
+		return fmt.Errorf("load xdp program err : %s", err)
+	}
+	if xsk.linkFd, err = bpfAttachXdp(xsk.progFd, ifindex); err != nil {
+		return fmt.Errorf("attach xdp program err : %s", err)
+	}
+	return nil
+}
+
+// XDPのプログラムを外してsocketを閉じ、リングとUMEMを解放する
+func (xsk *xskSocket) close() {
+	for _, fd := range []int{xsk.linkFd, xsk.progFd, xsk.mapFd, xsk.fd} {
+		if fd != -1 {
+			unix.Close(fd)
+		}
+	}
+	for _, ring := range []xskRing{xsk.rx, xsk.tx, xsk.fill, xsk.comp} {
+		if ring.mem != nil {
+			unix.Munmap(ring.mem)
+		}
+	}
+	if xsk.umem != nil {
+		unix.Munmap(xsk.umem)
+	}
+	*xsk = xskSocket{fd: -1, mapFd: -1, progFd: -1, linkFd: -1}
+}
+
+func (ring *xskRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Add(ring.descs, uintptr(i&ring.mask)*8))
+}
+
+func (ring *xskRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Add(ring.descs, uintptr(i&ring.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+// 受信に使うフレームをfillリングに入れる、受信用のフレームの数とリングの大きさが同じなので溢れない
+func (xsk *xskSocket) fillFrame(addr uint64) {
+	prod := *xsk.fill.producer
+	*xsk.fill.addr(prod) = addr
+	atomic.StoreUint32(xsk.fill.producer, prod+1)
+}
+
+/*
+rxリングから受信したフレームを取り出して処理する
+フレームはUMEMを指したまま渡すので、処理が終わるまでfillリングに戻さない
+*/
+func (xsk *xskSocket) receive(handler func(frame []byte)) {
+	cons := *xsk.rx.consumer
+	n := atomic.LoadUint32(xsk.rx.producer) - cons
+	if n > RX_BATCH_SIZE {
+		n = RX_BATCH_SIZE
+	}
+	for i := uint32(0); i < n; i++ {
+		desc := xsk.rx.desc(cons + i)
+		handler(xsk.umem[desc.Addr : desc.Addr+uint64(desc.Len)])
+		// フレームの先頭からずれていることがあるので、フレームの先頭に戻して渡す
+		xsk.fillFrame(desc.Addr &^ (XDP_FRAME_SIZE - 1))
+	}
+	atomic.StoreUint32(xsk.rx.consumer, cons+n)
+}
+
+/*
+フレームをUMEMにコピーしてtxリングに入れる
+バッチ処理中はカーネルに知らせるのを後でまとめて行う
+*/
+func (xsk *xskSocket) transmit(data []byte) error {
+	if len(data) > XDP_FRAME_SIZE {
+		return unix.EMSGSIZE
+	}
+	xsk.reclaim()
+	prod := *xsk.tx.producer
+	if len(xsk.freeFrames) == 0 || prod-atomic.LoadUint32(xsk.tx.consumer) >= XDP_RING_SIZE {
+		return unix.ENOBUFS
+	}
+	addr := xsk.freeFrames[len(xsk.freeFrames)-1]
+	xsk.freeFrames = xsk.freeFrames[:len(xsk.freeFrames)-1]
+	copy(xsk.umem[addr:addr+XDP_FRAME_SIZE], data)
+	*xsk.tx.desc(prod) = unix.XDPDesc{Addr: addr, Len: uint32(len(data))}
+	atomic.StoreUint32(xsk.tx.producer, prod+1)
+	xsk.kick = true
+	if !txBatching {
+		xsk.wakeup()
+	}
+	return nil
+}
+
+// 送信が終わったフレームをcompletionリングから取り出して、また送信に使えるようにする
+func (xsk *xskSocket) reclaim() {
+	cons := *xsk.comp.consumer
+	prod := atomic.LoadUint32(xsk.comp.producer)
+	for ; cons != prod; cons++ {
+		xsk.freeFrames = append(xsk.freeFrames, *xsk.comp.addr(cons))
+	}
+	atomic.StoreUint32(xsk.comp.consumer, cons)
+}
+
+// txリングに入れたフレームを送るようにカーネルに知らせる、カーネルが忙しければfalseを返す
+func (xsk *xskSocket) wakeup() bool {
+	err := unix.Sendto(xsk.fd, nil, unix.MSG_DONTWAIT, nil)
+	if err == unix.EAGAIN || err == unix.EBUSY || err == unix.ENOBUFS {
+		return false
+	}
+	xsk.kick = false
+	if err != nil {
+		debugPrintf("wakeup xdp socket err : %s\n", err)
+	}
+	return true
+}
+
+func setsockoptPointer(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(value), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// socketを1つ入れるXSKMAPを作る
+func bpfCreateXskMap() (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+	}{unix.BPF_MAP_TYPE_XSKMAP, 4, 4, 1}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(mapFd int, key, value uint32) error {
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFd: uint32(mapFd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+/*
+XDPのプログラムをロードする
+return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+マップにsocketが無いキューのフレームはXDP_PASSでカーネルに渡す
+*/
+func bpfLoadXdpProgram(mapFd int) (int, error) {
+	insns := []bpfInsn{
+		// r2 = ctx->rx_queue_index
+		{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, regs: 1<<4 | 2, off: XDP_MD_RX_QUEUE_OFFSET},
+		// r1 = マップ、64ビットの即値なので2命令を使う
+		{code: unix.BPF_LD | unix.BPF_IMM | unix.BPF_DW, regs: BPF_PSEUDO_MAP_FD<<4 | 1, imm: int32(mapFd)},
+		{},
+		// r3 = XDP_PASS
+		{code: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, regs: 3, imm: XDP_PASS},
+		{code: unix.BPF_JMP | unix.BPF_CALL, imm: BPF_FUNC_REDIRECT_MAP},
+		{code: unix.BPF_JMP | unix.BPF_EXIT},
+	}
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType           uint32
+		insnCnt            uint32
+		insns              uint64
+		license            uint64
+		logLevel           uint32
+		logSize            uint32
+		logBuf             uint64
+		kernVersion        uint32
+		progFlags          uint32
+		progName           [16]byte
+		progIfindex        uint32
+		expectedAttachType uint32
+	}{
+		progType:           unix.BPF_PROG_TYPE_XDP,
+		insnCnt:            uint32(len(insns)),
+		insns:              uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&license[0]))),
+		expectedAttachType: unix.BPF_XDP,
+	}
+	copy(attr.progName[:], "go_curo_xsk")
+	return bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// XDPのプログラムをインターフェイスにつける、ドライバが対応していればネイティブ、していなければジェネリックになる
+func bpfAttachXdp(progFd, ifindex int) (int, error) {
+	attr := struct {
+		progFd        uint32
+		targetIfindex uint32
+		attachType    uint32
+		flags         uint32
+	}{uint32(progFd), uint32(ifindex), unix.BPF_XDP, 0}
+	return bpf(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}